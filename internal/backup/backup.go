@@ -0,0 +1,230 @@
+// Package backup keeps snapshots of worktree databases that smudge is about
+// to replace, so data lost through an unexpected checkout can be recovered
+// with "gitsqlite undo <path>".
+//
+// Snapshots are stored per database under <git-dir>/gitsqlite/backups, named
+// by their UTC creation time so that lexical order is chronological.
+package backup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/danielsiegl/gitsqlite/internal/gitdir"
+)
+
+// DefaultKeep is the default number of snapshots kept per database.
+const DefaultKeep = 5
+
+// snapshotExt is the file extension of a snapshot.
+const snapshotExt = ".db"
+
+// Store is the backup directory of a repository.
+type Store struct {
+	// Dir is the directory snapshots are stored in.
+	Dir string
+	// Root is the worktree root; snapshots are keyed by the path of the
+	// database relative to it.
+	Root string
+}
+
+// Open returns the backup store of the repository containing the current
+// working directory.
+func Open(ctx context.Context) (*Store, error) {
+	dir, root, err := gitdir.WorktreeDir(ctx, "backups")
+	if err != nil {
+		return nil, err
+	}
+	return &Store{Dir: dir, Root: root}, nil
+}
+
+// dbDir returns the directory holding the snapshots of a worktree path.
+func (s *Store) dbDir(path string) string {
+	key := filepath.Clean(path)
+	if abs, err := filepath.Abs(path); err == nil {
+		if rel, err := filepath.Rel(s.Root, abs); err == nil && !strings.HasPrefix(rel, "..") {
+			key = rel
+		}
+	}
+	return filepath.Join(s.Dir, url.PathEscape(filepath.ToSlash(key)))
+}
+
+// List returns the snapshots of path, oldest first.
+func (s *Store) List(path string) ([]string, error) {
+	entries, err := os.ReadDir(s.dbDir(path))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var snapshots []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), snapshotExt) {
+			snapshots = append(snapshots, filepath.Join(s.dbDir(path), e.Name()))
+		}
+	}
+	sort.Strings(snapshots)
+	return snapshots, nil
+}
+
+// Save copies the current contents of path to a snapshot unless they equal
+// the newest snapshot, then prunes all but the newest keep snapshots. It
+// returns the snapshot file, or "" if nothing was saved.
+func (s *Store) Save(path string, keep int) (string, error) {
+	existing, err := s.List(path)
+	if err != nil {
+		return "", err
+	}
+	if n := len(existing); n > 0 {
+		if same, err := SameContents(existing[n-1], path); err == nil && same {
+			return "", nil
+		}
+	}
+
+	if err := os.MkdirAll(s.dbDir(path), 0o755); err != nil {
+		return "", err
+	}
+	name := filepath.Join(s.dbDir(path), time.Now().UTC().Format("20060102T150405.000000000Z")+snapshotExt)
+	// Write to a temporary name first so a crash never leaves a partial snapshot
+	tmp := name + ".tmp"
+	if err := copyFile(tmp, path); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+
+	if err := s.prune(path, keep); err != nil {
+		return name, err
+	}
+	return name, nil
+}
+
+// copyFile copies the file at src to a new file dst, without reading it into
+// memory.
+func copyFile(dst, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// SameContents reports whether the files at a and b hold the same bytes,
+// comparing them block by block.
+func SameContents(a, b string) (bool, error) {
+	fa, err := os.Open(a)
+	if err != nil {
+		return false, err
+	}
+	defer fa.Close()
+	fb, err := os.Open(b)
+	if err != nil {
+		return false, err
+	}
+	defer fb.Close()
+	ia, err := fa.Stat()
+	if err != nil {
+		return false, err
+	}
+	ib, err := fb.Stat()
+	if err != nil {
+		return false, err
+	}
+	if ia.Size() != ib.Size() {
+		return false, nil
+	}
+	bufA, bufB := make([]byte, 64*1024), make([]byte, 64*1024)
+	for {
+		n, errA := io.ReadFull(fa, bufA)
+		m, errB := io.ReadFull(fb, bufB)
+		if !bytes.Equal(bufA[:n], bufB[:m]) {
+			return false, nil
+		}
+		if errA == io.EOF || errA == io.ErrUnexpectedEOF {
+			return errB == io.EOF || errB == io.ErrUnexpectedEOF, nil
+		}
+		if errA != nil {
+			return false, errA
+		}
+		if errB != nil {
+			return false, errB
+		}
+	}
+}
+
+// prune removes all but the newest keep snapshots of path.
+func (s *Store) prune(path string, keep int) error {
+	snapshots, err := s.List(path)
+	if err != nil {
+		return err
+	}
+	for len(snapshots) > keep {
+		if err := os.Remove(snapshots[0]); err != nil {
+			return err
+		}
+		snapshots = snapshots[1:]
+	}
+	return nil
+}
+
+// Undo restores the newest snapshot of path into the worktree and removes it
+// from the backup directory. It returns the restored snapshot file.
+func (s *Store) Undo(path string) (string, error) {
+	snapshots, err := s.List(path)
+	if err != nil {
+		return "", err
+	}
+	if len(snapshots) == 0 {
+		return "", fmt.Errorf("no backup of %s found in %s", path, s.Dir)
+	}
+	latest := snapshots[len(snapshots)-1]
+
+	src, err := os.Open(latest)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".gitsqlite-undo-*")
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(tmp, src); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	src.Close()
+	if err := os.Remove(latest); err != nil {
+		return latest, err
+	}
+	return latest, nil
+}
@@ -0,0 +1,59 @@
+package backup
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSameContents(t *testing.T) {
+	dir := t.TempDir()
+	large := bytes.Repeat([]byte("gitsqlite"), 20000)
+	write := func(name string, data []byte) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	changed := bytes.Clone(large)
+	changed[len(changed)-1] = 'X'
+	a, b := write("a", large), write("b", large)
+	tests := []struct {
+		name  string
+		other string
+		want  bool
+	}{
+		{"equal", b, true},
+		{"last byte differs", write("c", changed), false},
+		{"shorter", write("d", large[:len(large)-1]), false},
+	}
+	for _, tt := range tests {
+		if got, err := SameContents(a, tt.other); err != nil || got != tt.want {
+			t.Errorf("%s: SameContents = %v, %v, want %v", tt.name, got, err, tt.want)
+		}
+	}
+	if got, err := SameContents(write("e", nil), write("f", nil)); err != nil || !got {
+		t.Errorf("empty files: SameContents = %v, %v, want true", got, err)
+	}
+}
+
+func TestSaveSkipsUnchanged(t *testing.T) {
+	dir := t.TempDir()
+	s := &Store{Dir: filepath.Join(dir, "backups"), Root: dir}
+	db := filepath.Join(dir, "test.db")
+	if err := os.WriteFile(db, []byte("first"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	first, err := s.Save(db, DefaultKeep)
+	if err != nil || first == "" {
+		t.Fatalf("Save = %q, %v, want a snapshot", first, err)
+	}
+	if again, err := s.Save(db, DefaultKeep); err != nil || again != "" {
+		t.Errorf("Save of unchanged file = %q, %v, want none", again, err)
+	}
+	if data, _ := os.ReadFile(first); string(data) != "first" {
+		t.Errorf("snapshot holds %q, want %q", data, "first")
+	}
+}
@@ -0,0 +1,81 @@
+// Package color decides whether the human-readable output of commands like
+// doctor, verify and logs is colored, and colors it with ANSI escape
+// sequences. The output of the filter operations is never colored.
+package color
+
+import (
+	"os"
+
+	"github.com/mattn/go-isatty"
+)
+
+// Modes for -color.
+const (
+	Auto   = "auto"
+	Always = "always"
+	Never  = "never"
+)
+
+// IsMode reports whether mode is a valid -color value.
+func IsMode(mode string) bool {
+	return mode == Auto || mode == Always || mode == Never
+}
+
+// Color is an ANSI SGR parameter.
+type Color string
+
+const (
+	Bold   Color = "1"
+	Dim    Color = "2"
+	Red    Color = "31"
+	Green  Color = "32"
+	Yellow Color = "33"
+)
+
+// Palette colors text if enabled; the zero value leaves it unchanged.
+type Palette struct {
+	enabled bool
+}
+
+// New returns the palette for output to f. Auto colors terminals, unless
+// NO_COLOR is set to anything non-empty or CLICOLOR is 0; CLICOLOR_FORCE
+// (other than 0) colors other output too. Always and Never ignore the
+// environment.
+func New(mode string, f *os.File) Palette {
+	switch mode {
+	case Always:
+		enableVirtualTerminal(f)
+		return Palette{enabled: true}
+	case Never:
+		return Palette{}
+	}
+	if os.Getenv("NO_COLOR") != "" {
+		return Palette{}
+	}
+	if force := os.Getenv("CLICOLOR_FORCE"); force != "" && force != "0" {
+		enableVirtualTerminal(f)
+		return Palette{enabled: true}
+	}
+	if os.Getenv("CLICOLOR") == "0" {
+		return Palette{}
+	}
+	fd := f.Fd()
+	if !isatty.IsTerminal(fd) && !isatty.IsCygwinTerminal(fd) {
+		return Palette{}
+	}
+	return Palette{enabled: enableVirtualTerminal(f)}
+}
+
+// Enabled reports whether the palette colors text.
+func (p Palette) Enabled() bool {
+	return p.enabled
+}
+
+// Paint returns s in color c. Pad s before painting it, so that the escape
+// sequences don't count towards the width of a column.
+func (p Palette) Paint(c Color, s string) string {
+	if !p.enabled || s == "" {
+		return s
+	}
+	return "\x1b[" + string(c) + "m" + s + "\x1b[0m"
+}
@@ -0,0 +1,47 @@
+package color
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	// A regular file is not a terminal
+	f, err := os.Create(filepath.Join(t.TempDir(), "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	tests := []struct {
+		mode string
+		env  map[string]string
+		want bool
+	}{
+		{Auto, nil, false},
+		{Always, nil, true},
+		{Always, map[string]string{"NO_COLOR": "1"}, true},
+		{Never, map[string]string{"CLICOLOR_FORCE": "1"}, false},
+		{Auto, map[string]string{"CLICOLOR_FORCE": "1"}, true},
+		{Auto, map[string]string{"CLICOLOR_FORCE": "0"}, false},
+		{Auto, map[string]string{"CLICOLOR_FORCE": "1", "NO_COLOR": "1"}, false},
+	}
+	for _, tt := range tests {
+		for _, name := range []string{"NO_COLOR", "CLICOLOR", "CLICOLOR_FORCE"} {
+			t.Setenv(name, tt.env[name])
+		}
+		if got := New(tt.mode, f).Enabled(); got != tt.want {
+			t.Errorf("New(%s) with %v: Enabled() = %v, want %v", tt.mode, tt.env, got, tt.want)
+		}
+	}
+}
+
+func TestPaint(t *testing.T) {
+	if got := (Palette{}).Paint(Red, "x"); got != "x" {
+		t.Errorf("disabled Paint = %q", got)
+	}
+	if got := (Palette{enabled: true}).Paint(Red, "x"); got != "\x1b[31mx\x1b[0m" {
+		t.Errorf("enabled Paint = %q", got)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !windows
+
+package color
+
+import "os"
+
+// enableVirtualTerminal reports whether escape sequences can be used; all
+// terminals outside Windows understand them.
+func enableVirtualTerminal(f *os.File) bool {
+	return true
+}
@@ -0,0 +1,199 @@
+// Package compression provides zstd dictionaries trained per table for
+// compressing very repetitive SQL dumps.
+package compression
+
+import (
+	"bytes"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// DefaultDictDir is the repository directory dictionaries are stored in.
+const DefaultDictDir = ".gitsqlitedicts"
+
+// dictExt is the file extension of a stored dictionary.
+const dictExt = ".zdict"
+
+// TrainOptions controls dictionary training.
+type TrainOptions struct {
+	// DictSize is the maximum size of the dictionary history in bytes.
+	DictSize int
+	// MinSample is the minimum amount of table data required to train a
+	// dictionary; smaller tables gain nothing from a dictionary.
+	MinSample int
+}
+
+// DefaultTrainOptions returns the default training options.
+func DefaultTrainOptions() TrainOptions {
+	return TrainOptions{DictSize: 64 * 1024, MinSample: 64 * 1024}
+}
+
+// dictID returns the ID of the dictionary trained for table from samples.
+// It is derived from both, so a dictionary trained again on changed data gets
+// a new ID, and dumps compressed with the old one still name it (see Store).
+// IDs are kept above 32767 as recommended for private dictionaries.
+func dictID(table string, samples []string) uint32 {
+	h := crc32.NewIEEE()
+	h.Write([]byte(strings.ToLower(table)))
+	for _, s := range samples {
+		h.Write([]byte{'\n'})
+		h.Write([]byte(s))
+	}
+	return 32768 + h.Sum32()%(1<<31-32768)
+}
+
+// Train builds a zstd dictionary from sample lines of a single table. The
+// result depends only on the samples, so training is reproducible.
+func Train(table string, samples []string, opts TrainOptions) ([]byte, error) {
+	total := 0
+	for _, s := range samples {
+		total += len(s) + 1
+	}
+	if total < opts.MinSample {
+		return nil, fmt.Errorf("table %s has only %d bytes of data (minimum %d)", table, total, opts.MinSample)
+	}
+
+	// The history is the tail of the sample data: zstd favours recent
+	// matches, and the last rows are the most representative of new data.
+	var history bytes.Buffer
+	for i := len(samples) - 1; i >= 0 && history.Len() < opts.DictSize; i-- {
+		line := samples[i] + "\n"
+		if history.Len()+len(line) > opts.DictSize {
+			break
+		}
+		history.WriteString(line)
+	}
+	hist := reverseLines(history.Bytes())
+
+	// Contents are ~4 KB blocks, matching how dump data is compressed.
+	var contents [][]byte
+	var block bytes.Buffer
+	for _, s := range samples {
+		block.WriteString(s)
+		block.WriteByte('\n')
+		if block.Len() >= 4096 {
+			contents = append(contents, append([]byte(nil), block.Bytes()...))
+			block.Reset()
+		}
+	}
+	if block.Len() > 0 {
+		contents = append(contents, block.Bytes())
+	}
+
+	return zstd.BuildDict(zstd.BuildDictOptions{
+		ID:       dictID(table, samples),
+		Contents: contents,
+		History:  hist,
+		Offsets:  [3]int{1, 4, 8},
+	})
+}
+
+// reverseLines restores the original line order of a history buffer that was
+// assembled from the last line backwards.
+func reverseLines(b []byte) []byte {
+	lines := bytes.SplitAfter(b, []byte("\n"))
+	var out bytes.Buffer
+	for i := len(lines) - 1; i >= 0; i-- {
+		out.Write(lines[i])
+	}
+	return out.Bytes()
+}
+
+// DictPath returns the file a table's dictionary is stored in.
+func DictPath(dir, table string) string {
+	return filepath.Join(dir, table+dictExt)
+}
+
+// retiredDir is the subdirectory of the dictionary directory holding the
+// dictionaries replaced by Store.
+const retiredDir = "retired"
+
+// Store writes the dictionary of table to dir and returns its file. A
+// different dictionary stored before is moved to the retired subdirectory
+// instead of being overwritten: the dumps compressed with it in the history
+// can only be read with it.
+func Store(dir, table string, dict []byte) (string, error) {
+	path := DictPath(dir, table)
+	old, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	if err == nil && !bytes.Equal(old, dict) {
+		info, err := zstd.InspectDictionary(old)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", path, err)
+		}
+		retired := filepath.Join(dir, retiredDir, fmt.Sprintf("%d%s", info.ID(), dictExt))
+		if err := os.MkdirAll(filepath.Dir(retired), 0o755); err != nil {
+			return "", err
+		}
+		if err := os.Rename(path, retired); err != nil {
+			return "", err
+		}
+	}
+	return path, os.WriteFile(path, dict, 0o644)
+}
+
+// Dicts are the dictionaries stored in a directory by Store.
+type Dicts struct {
+	// tables maps lower-case table names to the dictionary their rows are
+	// compressed with.
+	tables map[string][]byte
+	// all holds these and the retired dictionaries, for decompressing.
+	all [][]byte
+}
+
+// OpenDicts reads the dictionaries in dir. A missing directory, or "",
+// yields none.
+func OpenDicts(dir string) (*Dicts, error) {
+	d := &Dicts{tables: map[string][]byte{}}
+	if dir == "" {
+		return d, nil
+	}
+	for _, sub := range []string{dir, filepath.Join(dir, retiredDir)} {
+		entries, err := os.ReadDir(sub)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			if e.IsDir() || !strings.HasSuffix(e.Name(), dictExt) {
+				continue
+			}
+			data, err := os.ReadFile(filepath.Join(sub, e.Name()))
+			if err != nil {
+				return nil, err
+			}
+			if _, err := zstd.InspectDictionary(data); err != nil {
+				return nil, fmt.Errorf("%s: %w", filepath.Join(sub, e.Name()), err)
+			}
+			if sub == dir {
+				d.tables[strings.ToLower(strings.TrimSuffix(e.Name(), dictExt))] = data
+			}
+			d.all = append(d.all, data)
+		}
+	}
+	return d, nil
+}
+
+// String lists the tables with a dictionary and its ID, in sorted order.
+func (d *Dicts) String() string {
+	tables := make([]string, 0, len(d.tables))
+	for t := range d.tables {
+		tables = append(tables, t)
+	}
+	sort.Strings(tables)
+	for i, t := range tables {
+		info, _ := zstd.InspectDictionary(d.tables[t])
+		tables[i] = fmt.Sprintf("%s:%d", t, info.ID())
+	}
+	return strings.Join(tables, " ")
+}
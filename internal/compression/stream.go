@@ -0,0 +1,192 @@
+package compression
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Stream compression formats (-compress).
+const (
+	Gzip = "gzip"
+	Zstd = "zstd"
+)
+
+// magic is the first line of a compressed dump, followed by the format name
+// and a newline. It lets smudge tell compressed from plain SQL input, and
+// tells a reader of the raw blob what it is looking at.
+const magic = "-- gitsqlite-compressed: "
+
+// IsFormat reports whether name is a supported compression format.
+func IsFormat(name string) bool {
+	return name == Gzip || name == Zstd
+}
+
+// NewWriter writes the header of format to w and returns a writer that
+// compresses into w. The output is deterministic for a given gitsqlite
+// version and dictionaries, so unchanged data gives an unchanged blob. Close
+// flushes the compressed stream but does not close w.
+//
+// zstd compresses the rows of the tables with a dictionary in dictDir (see
+// OpenDicts) with it: tableOf returns the table of the rows a line of the
+// dump starts, or "" for other lines.
+func NewWriter(w io.Writer, format, dictDir string, tableOf func(line string) string) (io.WriteCloser, error) {
+	if !IsFormat(format) {
+		return nil, fmt.Errorf("unknown compression format %q (expected gzip or zstd)", format)
+	}
+	if _, err := io.WriteString(w, magic+format+"\n"); err != nil {
+		return nil, err
+	}
+	if format == Gzip {
+		// No name or modification time in the gzip header
+		return gzip.NewWriterLevel(w, gzip.BestCompression)
+	}
+	dicts, err := OpenDicts(dictDir)
+	if err != nil {
+		return nil, err
+	}
+	if len(dicts.tables) == 0 {
+		return newZstdWriter(w, nil)
+	}
+	return &dictWriter{w: w, dicts: dicts, tableOf: tableOf}, nil
+}
+
+// newZstdWriter returns a zstd encoder writing to w, with dict if not nil.
+func newZstdWriter(w io.Writer, dict []byte) (*zstd.Encoder, error) {
+	// A single encoder goroutine keeps the block boundaries, and so the
+	// output, independent of the machine
+	options := []zstd.EOption{zstd.WithEncoderLevel(zstd.SpeedBetterCompression), zstd.WithEncoderConcurrency(1)}
+	if dict != nil {
+		options = append(options, zstd.WithEncoderDict(dict))
+	}
+	return zstd.NewWriter(w, options...)
+}
+
+// dictWriter compresses a dump into a series of zstd frames, each started
+// with the dictionary of the table whose rows follow. A frame records the ID
+// of its dictionary, and a decoder reads the frames as one stream.
+type dictWriter struct {
+	w       io.Writer
+	dicts   *Dicts
+	tableOf func(line string) string
+	enc     *zstd.Encoder
+	// table is the table whose dictionary enc uses, "" for none.
+	table string
+	// line holds the start of a line not written completely yet.
+	line []byte
+}
+
+// Write compresses complete lines of p and keeps the rest for the next call.
+func (d *dictWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			d.line = append(d.line, p...)
+			break
+		}
+		line := p[:i+1]
+		if len(d.line) > 0 {
+			line = append(d.line, line...)
+		}
+		if err := d.writeLine(line); err != nil {
+			return 0, err
+		}
+		d.line = d.line[:0]
+		p = p[i+1:]
+	}
+	return n, nil
+}
+
+// writeLine compresses a line, starting a new frame first if it starts the
+// rows of a table with another dictionary than the current frame.
+func (d *dictWriter) writeLine(line []byte) error {
+	table := d.table
+	if name := d.tableOf(string(line)); name != "" {
+		if table = strings.ToLower(name); d.dicts.tables[table] == nil {
+			table = ""
+		}
+	}
+	if d.enc == nil || table != d.table {
+		if d.enc != nil {
+			if err := d.enc.Close(); err != nil {
+				return err
+			}
+		}
+		enc, err := newZstdWriter(d.w, d.dicts.tables[table])
+		if err != nil {
+			return err
+		}
+		d.enc, d.table = enc, table
+	}
+	_, err := d.enc.Write(line)
+	return err
+}
+
+// Close compresses the last line and ends the last frame.
+func (d *dictWriter) Close() error {
+	if len(d.line) > 0 || d.enc == nil {
+		if err := d.writeLine(d.line); err != nil {
+			return err
+		}
+		d.line = nil
+	}
+	return d.enc.Close()
+}
+
+// NewReader returns the decompressed contents of r if it starts with the
+// header written by NewWriter, and the format name; otherwise it returns the
+// unchanged contents of r and "". Dumps compressed with dictionaries are read
+// with those in dictDir.
+func NewReader(r io.Reader, dictDir string) (io.Reader, string, error) {
+	br := bufio.NewReader(r)
+	head, _ := br.Peek(len(magic))
+	if !bytes.HasPrefix(head, []byte(magic)) {
+		return br, "", nil
+	}
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return nil, "", fmt.Errorf("reading compression header: %w", err)
+	}
+	format := strings.TrimSpace(line[len(magic):])
+	switch format {
+	case Gzip:
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, "", fmt.Errorf("reading gzip stream: %w", err)
+		}
+		return zr, format, nil
+	case Zstd:
+		dicts, err := OpenDicts(dictDir)
+		if err != nil {
+			return nil, "", err
+		}
+		zr, err := zstd.NewReader(br, zstd.WithDecoderConcurrency(1), zstd.WithDecoderDicts(dicts.all...))
+		if err != nil {
+			return nil, "", fmt.Errorf("reading zstd stream: %w", err)
+		}
+		return &dictReader{r: zr.IOReadCloser(), dictDir: dictDir}, format, nil
+	}
+	return nil, "", fmt.Errorf("unknown compression format %q in header", format)
+}
+
+// dictReader explains the error of a zstd stream needing a dictionary that
+// is not in dictDir.
+type dictReader struct {
+	r       io.Reader
+	dictDir string
+}
+
+func (d *dictReader) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	if errors.Is(err, zstd.ErrUnknownDictionary) {
+		err = fmt.Errorf("%w: the dump was compressed with a dictionary of train-dict that is not in %q (see -dict-dir)", err, d.dictDir)
+	}
+	return n, err
+}
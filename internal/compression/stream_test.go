@@ -0,0 +1,130 @@
+package compression
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func TestStreamRoundTrip(t *testing.T) {
+	sql := "PRAGMA foreign_keys=OFF;\nBEGIN TRANSACTION;\nCOMMIT;\n"
+	for _, format := range []string{Gzip, Zstd} {
+		var buf bytes.Buffer
+		w, err := NewWriter(&buf, format, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, sql)
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		r, got, err := NewReader(&buf, "")
+		if err != nil || got != format {
+			t.Fatalf("%s: NewReader format = %q, %v", format, got, err)
+		}
+		if data, err := io.ReadAll(r); err != nil || string(data) != sql {
+			t.Errorf("%s: read %q, %v", format, data, err)
+		}
+	}
+
+	// Plain SQL passes through unchanged
+	r, format, err := NewReader(bytes.NewBufferString(sql), "")
+	if err != nil || format != "" {
+		t.Fatalf("plain: format = %q, %v", format, err)
+	}
+	if data, _ := io.ReadAll(r); string(data) != sql {
+		t.Errorf("plain: read %q", data)
+	}
+}
+
+func TestStreamDicts(t *testing.T) {
+	rows := func(table string, n, seed int) []string {
+		var lines []string
+		for i := 0; i < n; i++ {
+			lines = append(lines, fmt.Sprintf("INSERT INTO %s VALUES(%d,'customer-%d','active','2024-01-01T00:00:00Z');", table, i, i*seed))
+		}
+		return lines
+	}
+	tableOf := func(line string) string {
+		if rest, ok := strings.CutPrefix(line, "INSERT INTO "); ok {
+			return rest[:strings.IndexByte(rest, ' ')]
+		}
+		return ""
+	}
+	dir := t.TempDir()
+	for _, table := range []string{"a", "b"} {
+		dict, err := Train(table, rows(table, 2000, 7), DefaultTrainOptions())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Store(dir, table, dict); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Table c has no dictionary
+	sql := "CREATE TABLE a(x);\n" + strings.Join(rows("a", 300, 3), "\n") + "\nCREATE TABLE c(x);\n" +
+		strings.Join(rows("c", 300, 5), "\n") + "\n" + strings.Join(rows("b", 300, 11), "\n") + "\nCOMMIT;\n"
+	compress := func(dictDir string) []byte {
+		var buf bytes.Buffer
+		w, err := NewWriter(&buf, Zstd, dictDir, tableOf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Writes splitting lines do not change the output
+		for data := sql; data != ""; {
+			n := min(len(data), 1000)
+			io.WriteString(w, data[:n])
+			data = data[n:]
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	decompress := func(data []byte, dictDir string) (string, error) {
+		r, _, err := NewReader(bytes.NewReader(data), dictDir)
+		if err != nil {
+			return "", err
+		}
+		out, err := io.ReadAll(r)
+		return string(out), err
+	}
+
+	withDicts := compress(dir)
+	if again := compress(dir); !bytes.Equal(again, withDicts) {
+		t.Error("compressing with dictionaries is not deterministic")
+	}
+	if got, err := decompress(withDicts, dir); err != nil || got != sql {
+		t.Fatalf("round trip: %v, equal %v", err, got == sql)
+	}
+	if _, err := decompress(withDicts, ""); !errors.Is(err, zstd.ErrUnknownDictionary) {
+		t.Errorf("without dictionaries: error %v", err)
+	}
+
+	// A dictionary trained again replaces the old one, which still reads
+	// the dumps compressed with it
+	dict, err := Train("a", rows("a", 2000, 13), DefaultTrainOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Store(dir, "a", dict); err != nil {
+		t.Fatal(err)
+	}
+	if retired, _ := os.ReadDir(filepath.Join(dir, retiredDir)); len(retired) != 1 {
+		t.Errorf("retired dictionaries: %v", retired)
+	}
+	if got, err := decompress(withDicts, dir); err != nil || got != sql {
+		t.Fatalf("round trip after retraining: %v, equal %v", err, got == sql)
+	}
+	if bytes.Equal(compress(dir), withDicts) {
+		t.Error("the new dictionary is not used")
+	}
+}
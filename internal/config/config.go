@@ -0,0 +1,445 @@
+// Package config reads the repository configuration file .gitsqlite.toml,
+// which sets defaults for command line flags so that the filter commands in
+// git config can stay plain "gitsqlite clean" and "gitsqlite smudge":
+//
+//	float_precision = 6
+//	exclude_tables  = ["window_state", "cache"]
+//	schema_file     = ".gitsqliteschema"
+//	log_dir         = "logs"
+//	blob_threshold  = 65536
+//	blob_dir        = "assets/blobs"
+//	format_version  = 2
+//
+//	[redact]
+//	"users.email"    = "hash"
+//	"sessions.token" = "drop"
+//
+//	[[profile]]
+//	path            = "data/reference/*.db"
+//	float_precision = 3
+//
+//	[[profile]]
+//	name            = "sqlite-strict"
+//	on_error        = "fail"
+//
+// Profiles with a path apply to the database files their pattern matches.
+// Profiles with a name apply when selected with -config-profile, which the
+// filter commands registered by "gitsqlite install --name" do. Flags given on
+// the command line override all of them.
+package config
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// FileName is the name of the configuration file at the repository root.
+const FileName = ".gitsqlite.toml"
+
+// Settings are flag defaults; unset fields leave the flag's default alone.
+type Settings struct {
+	// FloatPrecision sets -float-precision.
+	FloatPrecision *int `toml:"float_precision"`
+	// ExcludeTables sets -local-tables: tables that are never versioned.
+	ExcludeTables []string `toml:"exclude_tables"`
+	// InternalTables sets -internal-tables.
+	InternalTables []string `toml:"internal_tables"`
+	// SchemaFile sets -schema-file.
+	SchemaFile *string `toml:"schema_file"`
+	// SQLite would set -sqlite, the sqlite3 binary; it is ignored (see
+	// Untrusted).
+	SQLite *string `toml:"sqlite"`
+	// Compress sets -compress.
+	Compress *string `toml:"compress"`
+	// Redact sets -redact: actions by "table.column".
+	Redact map[string]string `toml:"redact"`
+	// BlobThreshold sets -blob-threshold.
+	BlobThreshold *int64 `toml:"blob_threshold"`
+	// BlobDir sets -blob-dir.
+	BlobDir *string `toml:"blob_dir"`
+	// OnError sets -on-error.
+	OnError *string `toml:"on_error"`
+	// Attach would set -attach, database paths by schema name; it is
+	// ignored (see Untrusted).
+	Attach map[string]string `toml:"attach"`
+	// JournalMode sets -journal-mode.
+	JournalMode *string `toml:"journal_mode"`
+	// FormatVersion sets -format-version.
+	FormatVersion *int `toml:"format_version"`
+	// Format sets -format.
+	Format *string `toml:"format"`
+	// Collations sets -collations: collation names by the name used in the
+	// schema.
+	Collations map[string]string `toml:"collations"`
+	// Strict sets -strict.
+	Strict *bool `toml:"strict"`
+	// AssertIdempotent sets -assert-idempotent.
+	AssertIdempotent *bool `toml:"assert_idempotent"`
+	// TableHashes sets -table-hashes.
+	TableHashes *bool `toml:"table_hashes"`
+	// ChunkSize sets -chunk-size.
+	ChunkSize *int `toml:"chunk_size"`
+}
+
+// Profile holds settings for the database files matching Path, or for the
+// operations selecting it by Name. A profile has one of the two.
+type Profile struct {
+	// Path is a pattern as understood by path.Match, relative to the
+	// repository root and using forward slashes. A pattern without a slash
+	// matches the file name in any directory, as in .gitattributes.
+	Path string `toml:"path"`
+	// Name selects the profile with -config-profile. It is also the name of
+	// the filter and diff driver "gitsqlite install --name" registers for it,
+	// so it must be a valid git config section name.
+	Name string `toml:"name"`
+	Settings
+}
+
+// Config is the content of a configuration file.
+type Config struct {
+	Settings
+	Profiles []Profile `toml:"profile"`
+	// LogDir is the directory -log writes to, relative to the file. It does
+	// not enable logging, and -log-dir overrides it.
+	LogDir string `toml:"log_dir"`
+
+	// Dir is the directory holding the file; profile paths are relative to
+	// it.
+	Dir string `toml:"-"`
+}
+
+// Find returns the path of the configuration file for the working directory
+// dir: the first FileName found in dir or its parents, stopping at the root
+// of the repository. It returns "" if there is none.
+func Find(dir string) string {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return ""
+	}
+	for {
+		candidate := filepath.Join(dir, FileName)
+		if info, err := os.Stat(candidate); err == nil && !info.IsDir() {
+			return candidate
+		}
+		if _, err := os.Stat(filepath.Join(dir, ".git")); err == nil {
+			return ""
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// Load reads the configuration file filename. Unknown keys are errors, so that
+// a misspelt setting is not silently ignored.
+func Load(filename string) (*Config, error) {
+	cfg := &Config{Dir: filepath.Dir(filename)}
+	meta, err := toml.DecodeFile(filename, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+		keys := make([]string, len(undecoded))
+		for i, key := range undecoded {
+			keys[i] = key.String()
+			if name := key[len(key)-1]; name == "synchronous" || name == "temp_store" {
+				return nil, fmt.Errorf("%s: %s: SQLite does not store %s in the database file, the application sets it when opening the database", filename, keys[i], name)
+			}
+		}
+		return nil, fmt.Errorf("%s: unknown setting %s", filename, strings.Join(keys, ", "))
+	}
+	if err := cfg.Settings.resolvePaths(cfg.Dir); err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	if cfg.LogDir != "" {
+		if cfg.LogDir, err = resolvePath(cfg.Dir, "log_dir", cfg.LogDir); err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+	}
+	names := make(map[string]bool)
+	for i, p := range cfg.Profiles {
+		if err := cfg.Profiles[i].Settings.resolvePaths(cfg.Dir); err != nil {
+			return nil, fmt.Errorf("%s: profile %d: %w", filename, i+1, err)
+		}
+		switch {
+		case p.Path == "" && p.Name == "":
+			return nil, fmt.Errorf("%s: profile %d has neither path nor name", filename, i+1)
+		case p.Path != "" && p.Name != "":
+			return nil, fmt.Errorf("%s: profile %d has both path and name", filename, i+1)
+		case p.Name != "":
+			if !ValidName(p.Name) {
+				return nil, fmt.Errorf("%s: profile name %q: use letters, digits, '-' and '_'", filename, p.Name)
+			}
+			if names[p.Name] {
+				return nil, fmt.Errorf("%s: duplicate profile name %q", filename, p.Name)
+			}
+			names[p.Name] = true
+		default:
+			if _, err := path.Match(p.Path, ""); err != nil {
+				return nil, fmt.Errorf("%s: profile path %q: %w", filename, p.Path, err)
+			}
+		}
+	}
+	return cfg, nil
+}
+
+// ValidName reports whether name can name a profile: it must be usable as a
+// git config section name and as a single shell word.
+func ValidName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// HasProfile reports whether the file has a profile named name.
+func (c *Config) HasProfile(name string) bool {
+	for _, p := range c.Profiles {
+		if p.Name != "" && p.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Resolve returns the settings for the database file at file, which may be
+// "" if the operation has none: the top-level settings overridden by every
+// matching profile in file order, and then by the profile named profile, if
+// it is not "". An unknown profile name is an error.
+func (c *Config) Resolve(file, profile string) (Settings, error) {
+	s := c.Settings
+	if rel, ok := c.relative(file); file != "" && ok {
+		for _, p := range c.Profiles {
+			if p.Path != "" && matches(p.Path, rel) {
+				s = s.merge(p.Settings)
+			}
+		}
+	}
+	if profile == "" {
+		return s, nil
+	}
+	for _, p := range c.Profiles {
+		if p.Name == profile {
+			return s.merge(p.Settings), nil
+		}
+	}
+	return s, fmt.Errorf("no profile named %q", profile)
+}
+
+// relative returns file relative to the configuration directory with forward
+// slashes; ok is false if file lies outside it.
+func (c *Config) relative(file string) (string, bool) {
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return "", false
+	}
+	rel, err := filepath.Rel(c.Dir, abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+// matches reports whether the slash-separated path rel matches pattern.
+func matches(pattern, rel string) bool {
+	if !strings.Contains(pattern, "/") {
+		rel = path.Base(rel)
+	}
+	ok, _ := path.Match(strings.TrimPrefix(pattern, "/"), rel)
+	return ok
+}
+
+// resolvePaths makes relative file paths relative to dir. A sqlite setting
+// without a directory is a name searched like on the command line.
+func (s *Settings) resolvePaths(dir string) error {
+	for _, setting := range []struct {
+		key   string
+		value *string
+	}{{"schema_file", s.SchemaFile}, {"blob_dir", s.BlobDir}} {
+		if setting.value == nil || *setting.value == "" {
+			continue
+		}
+		abs, err := resolvePath(dir, setting.key, *setting.value)
+		if err != nil {
+			return err
+		}
+		*setting.value = abs
+	}
+	return nil
+}
+
+// resolvePath returns the path value of key relative to dir. The paths
+// clean and smudge write to must stay below dir: the file comes from the
+// repository, and a cloned repository could otherwise overwrite any file of
+// the user.
+func resolvePath(dir, key, value string) (string, error) {
+	abs := filepath.FromSlash(value)
+	if !filepath.IsAbs(abs) {
+		abs = filepath.Join(dir, abs)
+	}
+	abs = filepath.Clean(abs)
+	rel, err := filepath.Rel(dir, abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s = %q is outside %s; set paths outside the repository with flags in git config", key, value, dir)
+	}
+	return abs, nil
+}
+
+// merge returns s with the fields set in o replaced.
+func (s Settings) merge(o Settings) Settings {
+	if o.FloatPrecision != nil {
+		s.FloatPrecision = o.FloatPrecision
+	}
+	if o.ExcludeTables != nil {
+		s.ExcludeTables = o.ExcludeTables
+	}
+	if o.InternalTables != nil {
+		s.InternalTables = o.InternalTables
+	}
+	if o.SchemaFile != nil {
+		s.SchemaFile = o.SchemaFile
+	}
+	if o.SQLite != nil {
+		s.SQLite = o.SQLite
+	}
+	if o.Redact != nil {
+		s.Redact = o.Redact
+	}
+	if o.Compress != nil {
+		s.Compress = o.Compress
+	}
+	if o.BlobThreshold != nil {
+		s.BlobThreshold = o.BlobThreshold
+	}
+	if o.BlobDir != nil {
+		s.BlobDir = o.BlobDir
+	}
+	if o.OnError != nil {
+		s.OnError = o.OnError
+	}
+	if o.Attach != nil {
+		s.Attach = o.Attach
+	}
+	if o.JournalMode != nil {
+		s.JournalMode = o.JournalMode
+	}
+	if o.FormatVersion != nil {
+		s.FormatVersion = o.FormatVersion
+	}
+	if o.Format != nil {
+		s.Format = o.Format
+	}
+	if o.Collations != nil {
+		s.Collations = o.Collations
+	}
+	if o.Strict != nil {
+		s.Strict = o.Strict
+	}
+	if o.AssertIdempotent != nil {
+		s.AssertIdempotent = o.AssertIdempotent
+	}
+	if o.TableHashes != nil {
+		s.TableHashes = o.TableHashes
+	}
+	if o.ChunkSize != nil {
+		s.ChunkSize = o.ChunkSize
+	}
+	return s
+}
+
+// Untrusted returns the keys set in s that a file in the repository may not
+// set, sorted: sqlite chooses the program every clean and smudge runs and
+// attach the files they open, so a cloned repository could run its own code
+// on checkout. They belong in the filter commands in git config.
+func (s Settings) Untrusted() []string {
+	var keys []string
+	if s.Attach != nil {
+		keys = append(keys, "attach")
+	}
+	if s.SQLite != nil {
+		keys = append(keys, "sqlite")
+	}
+	return keys
+}
+
+// Flags returns the settings as flag names and values, without the Untrusted
+// ones.
+func (s Settings) Flags() map[string]string {
+	flags := make(map[string]string)
+	if s.FloatPrecision != nil {
+		flags["float-precision"] = strconv.Itoa(*s.FloatPrecision)
+	}
+	if s.ExcludeTables != nil {
+		flags["local-tables"] = strings.Join(s.ExcludeTables, ",")
+	}
+	if s.InternalTables != nil {
+		flags["internal-tables"] = strings.Join(s.InternalTables, ",")
+	}
+	if s.SchemaFile != nil {
+		flags["schema-file"] = *s.SchemaFile
+	}
+	if s.Compress != nil {
+		flags["compress"] = *s.Compress
+	}
+	if s.BlobThreshold != nil {
+		flags["blob-threshold"] = strconv.FormatInt(*s.BlobThreshold, 10)
+	}
+	if s.BlobDir != nil {
+		flags["blob-dir"] = *s.BlobDir
+	}
+	if s.OnError != nil {
+		flags["on-error"] = *s.OnError
+	}
+	if s.JournalMode != nil {
+		flags["journal-mode"] = *s.JournalMode
+	}
+	if s.FormatVersion != nil {
+		flags["format-version"] = strconv.Itoa(*s.FormatVersion)
+	}
+	if s.Format != nil {
+		flags["format"] = *s.Format
+	}
+	if s.Collations != nil {
+		items := make([]string, 0, len(s.Collations))
+		for name, other := range s.Collations {
+			items = append(items, name+"="+other)
+		}
+		sort.Strings(items)
+		flags["collations"] = strings.Join(items, ",")
+	}
+	if s.Strict != nil {
+		flags["strict"] = strconv.FormatBool(*s.Strict)
+	}
+	if s.AssertIdempotent != nil {
+		flags["assert-idempotent"] = strconv.FormatBool(*s.AssertIdempotent)
+	}
+	if s.TableHashes != nil {
+		flags["table-hashes"] = strconv.FormatBool(*s.TableHashes)
+	}
+	if s.ChunkSize != nil {
+		flags["chunk-size"] = strconv.Itoa(*s.ChunkSize)
+	}
+	if s.Redact != nil {
+		rules := make([]string, 0, len(s.Redact))
+		for column, action := range s.Redact {
+			rules = append(rules, column+"="+action)
+		}
+		sort.Strings(rules)
+		flags["redact"] = strings.Join(rules, ",")
+	}
+	return flags
+}
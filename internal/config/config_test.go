@@ -0,0 +1,184 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, FileName)
+	err := os.WriteFile(file, []byte(`
+float_precision = 4
+exclude_tables = ["cache"]
+
+[[profile]]
+path = "data/*.db"
+float_precision = 2
+
+[[profile]]
+path = "ref.db"
+exclude_tables = []
+
+[[profile]]
+name = "strict"
+float_precision = 8
+`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := Load(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		file    string
+		profile string
+		want    map[string]string
+	}{
+		{"", "", map[string]string{"float-precision": "4", "local-tables": "cache"}},
+		{"other.db", "", map[string]string{"float-precision": "4", "local-tables": "cache"}},
+		{"data/a.db", "", map[string]string{"float-precision": "2", "local-tables": "cache"}},
+		{"data/sub/ref.db", "", map[string]string{"float-precision": "4", "local-tables": ""}},
+		{"", "strict", map[string]string{"float-precision": "8", "local-tables": "cache"}},
+		{"data/sub/ref.db", "strict", map[string]string{"float-precision": "8", "local-tables": ""}},
+	}
+	for _, tt := range tests {
+		path := tt.file
+		if path != "" {
+			path = filepath.Join(dir, filepath.FromSlash(path))
+		}
+		settings, err := cfg.Resolve(path, tt.profile)
+		if err != nil {
+			t.Errorf("Resolve(%q, %q): %v", tt.file, tt.profile, err)
+			continue
+		}
+		got := settings.Flags()
+		if len(got) != len(tt.want) {
+			t.Errorf("Resolve(%q, %q) = %v, want %v", tt.file, tt.profile, got, tt.want)
+			continue
+		}
+		for k, v := range tt.want {
+			if got[k] != v {
+				t.Errorf("Resolve(%q, %q)[%s] = %q, want %q", tt.file, tt.profile, k, got[k], v)
+			}
+		}
+	}
+	if _, err := cfg.Resolve("", "missing"); err == nil {
+		t.Error("Resolve with an unknown profile succeeded")
+	}
+}
+
+func TestLoadRejectsUnknownSettings(t *testing.T) {
+	file := filepath.Join(t.TempDir(), FileName)
+	if err := os.WriteFile(file, []byte("float_precison = 4\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(file); err == nil {
+		t.Error("Load accepted a misspelt setting")
+	}
+}
+
+func TestLoadResolvesLogDir(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, FileName)
+	if err := os.WriteFile(file, []byte(`log_dir = "build/logs"`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := Load(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(dir, "build", "logs"); cfg.LogDir != want {
+		t.Errorf("LogDir = %q, want %q", cfg.LogDir, want)
+	}
+}
+
+func TestLoadRejectsPathsOutsideDir(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, FileName)
+	outside := filepath.ToSlash(filepath.Join(filepath.Dir(dir), "elsewhere"))
+	for _, text := range []string{
+		`schema_file = "../schema.sql"`,
+		`blob_dir = "` + outside + `"`,
+		`log_dir = "logs/../../logs"`,
+		"[[profile]]\nname = \"p\"\nschema_file = \"../../.bashrc\"\n",
+	} {
+		if err := os.WriteFile(file, []byte(text), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Load(file); err == nil || !strings.Contains(err.Error(), "is outside") {
+			t.Errorf("Load(%q) = %v, want an error", text, err)
+		}
+	}
+
+	inside := filepath.ToSlash(filepath.Join(dir, "blobs"))
+	if err := os.WriteFile(file, []byte(`schema_file = "db/../schema.sql"`+"\n"+`blob_dir = "`+inside+`"`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := Load(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join(dir, "schema.sql"); *cfg.Settings.SchemaFile != want {
+		t.Errorf("SchemaFile = %q, want %q", *cfg.Settings.SchemaFile, want)
+	}
+	if want := filepath.Join(dir, "blobs"); *cfg.Settings.BlobDir != want {
+		t.Errorf("BlobDir = %q, want %q", *cfg.Settings.BlobDir, want)
+	}
+}
+
+func TestLoadExplainsConnectionSettings(t *testing.T) {
+	file := filepath.Join(t.TempDir(), FileName)
+	if err := os.WriteFile(file, []byte("[[profile]]\nname = \"ea\"\nsynchronous = \"full\"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Load(file); err == nil || !strings.Contains(err.Error(), "does not store synchronous") {
+		t.Errorf("Load = %v, want an error explaining synchronous", err)
+	}
+}
+
+func TestUntrustedSettingsAreNotFlags(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, FileName)
+	err := os.WriteFile(file, []byte(`
+float_precision = 4
+sqlite = "./evil.sh"
+
+[attach]
+other = "/etc/passwd"
+
+[[profile]]
+name = "p"
+sqlite = "tools/sqlite3"
+`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := Load(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, profile := range []string{"", "p"} {
+		settings, err := cfg.Resolve("", profile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		flags := settings.Flags()
+		if _, ok := flags["sqlite"]; ok {
+			t.Errorf("profile %q: Flags() sets -sqlite from the file: %v", profile, flags)
+		}
+		if _, ok := flags["attach"]; ok {
+			t.Errorf("profile %q: Flags() sets -attach from the file: %v", profile, flags)
+		}
+		if flags["float-precision"] != "4" {
+			t.Errorf("profile %q: float-precision = %q, want 4", profile, flags["float-precision"])
+		}
+		if got := strings.Join(settings.Untrusted(), ","); got != "attach,sqlite" {
+			t.Errorf("profile %q: Untrusted() = %q, want attach,sqlite", profile, got)
+		}
+	}
+}
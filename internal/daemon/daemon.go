@@ -0,0 +1,332 @@
+// Package daemon runs clean and smudge jobs for the git filter in one
+// long-running gitsqlite process (gitsqlite daemon), listening on a local
+// socket, so that a checkout of hundreds of databases does not detect
+// sqlite3 and load the configuration once for every file.
+//
+// The filter started by git stays a thin client (-daemon <socket>): it sends
+// the job, copies its stdin to the daemon and the result to its stdout. A
+// client runs the job itself if no daemon listens on the socket or the
+// daemon was started with other settings.
+//
+// A session on a connection is:
+//
+//	client: {"op":"clean","key":"...","path":"app.db"}\n
+//	daemon: ready\n                      or error <message>\n
+//	client: the input, then closes its side for writing
+//	daemon: exit <code> <n> <m>\n, n bytes of output and m bytes of stderr
+//
+// Unix domain sockets are available on Windows 10 and later as well.
+package daemon
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/danielsiegl/gitsqlite/internal/errs"
+	"github.com/danielsiegl/gitsqlite/internal/filters"
+	"github.com/danielsiegl/gitsqlite/internal/shutdown"
+	"github.com/danielsiegl/gitsqlite/internal/sqlite"
+	"github.com/danielsiegl/gitsqlite/internal/warnings"
+)
+
+// SocketName is the name of the default socket in the gitsqlite directory of
+// the repository's git directory.
+const SocketName = "daemon.sock"
+
+// Job is the request of a client.
+type Job struct {
+	// Op is the operation, clean or smudge.
+	Op string `json:"op"`
+	// Key identifies the settings of the client (see Server.Key).
+	Key string `json:"key"`
+	// Path is the worktree path of the database (git %f), "" if not given.
+	Path string `json:"path,omitempty"`
+	// Output is the file smudge replaces (-output), "" to write to stdout.
+	Output string `json:"output,omitempty"`
+}
+
+// Server runs the jobs of clients with one engine and one set of options.
+type Server struct {
+	Engine *sqlite.Engine
+	// Key identifies the settings the options were made from; jobs with
+	// another key are refused, so their clients run them themselves.
+	Key string
+	// Clean and Smudge are the options of every job; the paths of the job
+	// are filled in. Smudge.Backups and Smudge.TableCache are only used for
+	// jobs that name their database.
+	Clean  filters.Options
+	Smudge filters.SmudgeOptions
+	// OnError is the failure policy (-on-error).
+	OnError string
+	// Idle, if > 0, stops the server after no job arrived for that long.
+	Idle time.Duration
+
+	// mu runs one job at a time: warnings are captured through the
+	// process-wide warnings.Output.
+	mu sync.Mutex
+}
+
+// Listen listens on the unix socket at path. A socket left behind by a
+// daemon that is gone is replaced; one that still answers is an error.
+func Listen(path string) (net.Listener, error) {
+	if _, err := os.Stat(path); err == nil {
+		if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("a daemon is already listening on %s", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	// Only the user running the daemon may hand it jobs
+	return listenPrivate(path)
+}
+
+// Serve accepts connections on l and runs their jobs until ctx is done or
+// the server was idle for s.Idle; it closes l, which removes the socket.
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	// Stopping closes the listener; running jobs still complete
+	listening, stop := context.WithCancel(ctx)
+	defer stop()
+	var idle *time.Timer
+	if s.Idle > 0 {
+		idle = time.AfterFunc(s.Idle, func() {
+			slog.Info("Daemon idle, stopping", "idle", s.Idle.String())
+			stop()
+		})
+	}
+	go func() {
+		<-listening.Done()
+		l.Close()
+	}()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if listening.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		if idle != nil {
+			idle.Stop()
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			if err := s.handle(ctx, conn); err != nil {
+				slog.Warn("Daemon connection failed", "error", err)
+			}
+			if idle != nil {
+				idle.Reset(s.Idle)
+			}
+		}()
+	}
+}
+
+// handle runs the job of one connection.
+func (s *Server) handle(ctx context.Context, conn net.Conn) error {
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("reading the job: %w", err)
+	}
+	var job Job
+	if err := json.Unmarshal([]byte(line), &job); err != nil {
+		_, _ = fmt.Fprintf(conn, "error invalid job: %v\n", err)
+		return err
+	}
+	switch {
+	case job.Op != "clean" && job.Op != "smudge":
+		_, err = fmt.Fprintf(conn, "error unknown operation %q (expected clean or smudge)\n", job.Op)
+		return err
+	case job.Key != s.Key:
+		slog.Info("Refusing job with other settings", "operation", job.Op, "path", job.Path)
+		_, err = fmt.Fprintf(conn, "error the daemon runs with other settings\n")
+		return err
+	}
+	if _, err := io.WriteString(conn, "ready\n"); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	startTime := time.Now()
+	slog.Info("Running job", "operation", job.Op, "path", job.Path, "output", job.Output)
+	out, err := os.CreateTemp("", "gitsqlite-daemon-*")
+	if err != nil {
+		return err
+	}
+	defer shutdown.Remove(out.Name())()
+	defer out.Close()
+	var stderr bytes.Buffer
+	warnings.Output = &stderr
+	code := s.run(ctx, job, r, out, &stderr)
+	warnings.Output = os.Stderr
+
+	size, err := out.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	if code != errs.ExitOK {
+		// git gets no partial output of a failed job
+		size = 0
+	}
+	if _, err := out.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "exit %d %d %d\n", code, size, stderr.Len())
+	if _, err := io.CopyN(w, out, size); err != nil {
+		return err
+	}
+	if _, err := w.Write(stderr.Bytes()); err != nil {
+		return err
+	}
+	slog.Info("Job completed", "operation", job.Op, "path", job.Path, "exit_code", code,
+		"duration", time.Since(startTime).String())
+	return w.Flush()
+}
+
+// run converts in to out and returns the exit code of the job; errors are
+// written to stderr as the filter prints them.
+func (s *Server) run(ctx context.Context, job Job, in io.Reader, out io.Writer, stderr io.Writer) int {
+	var convert func(in io.Reader, out io.Writer) error
+	switch job.Op {
+	case "clean":
+		opts := s.Clean
+		opts.SourcePath, opts.InputSize = job.Path, 0
+		convert = func(in io.Reader, out io.Writer) error {
+			return filters.Clean(ctx, s.Engine, in, out, opts)
+		}
+	case "smudge":
+		opts := s.Smudge
+		opts.Output, opts.TargetPath, opts.InputSize = job.Output, job.Output, 0
+		if job.Output == "" {
+			opts.TargetPath = job.Path
+		}
+		if opts.TargetPath == "" {
+			opts.Backups = nil
+		}
+		if opts.Output == "" {
+			opts.TableCache = nil
+		}
+		convert = func(in io.Reader, out io.Writer) error {
+			return filters.Smudge(ctx, s.Engine, in, out, opts)
+		}
+	}
+	err := filters.WithFallback(s.Engine, s.OnError, job.Op, in, out, convert)
+	if err == nil {
+		return errs.ExitOK
+	}
+	slog.Error(job.Op+" failed", "path", job.Path, slog.Any("error", err))
+	// Drain the input so that the client is not stuck writing it. convert
+	// has returned, and Clean and Smudge read no more of it then, also when
+	// they failed halfway through
+	_, _ = io.Copy(io.Discard, in)
+	fmt.Fprintf(stderr, "Error running SQLite command for %s operation: %v\n", job.Op, err)
+	if hint := sqlite.Hint(err); hint != "" {
+		fmt.Fprintf(stderr, "Hint: %s\n", hint)
+	}
+	return errs.Code(err)
+}
+
+// ErrUnavailable is returned by Forward if no daemon took the job, which the
+// client then runs itself.
+var ErrUnavailable = errors.New("no daemon took the job")
+
+// dialTimeout bounds connecting to the socket.
+const dialTimeout = 2 * time.Second
+
+// Forward hands job to the daemon listening on socket, sends it in and
+// copies the output to out and the messages to stderr. It returns the exit
+// code of the job, or an error wrapping ErrUnavailable if the daemon could
+// not be reached or refused the job, before in was read.
+func Forward(ctx context.Context, socket string, job Job, in io.Reader, out, stderr io.Writer) (int, error) {
+	conn, err := net.DialTimeout("unix", socket, dialTimeout)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	request, err := json.Marshal(job)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := conn.Write(append(request, '\n')); err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	r := bufio.NewReader(conn)
+	reply, err := r.ReadString('\n')
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrUnavailable, err)
+	}
+	reply = strings.TrimSuffix(reply, "\n")
+	if reply != "ready" {
+		return 0, fmt.Errorf("%w: %s", ErrUnavailable, strings.TrimPrefix(reply, "error "))
+	}
+
+	// The result is read while the input is still sent: a failed job
+	// answers before reading all of it
+	sent := make(chan error, 1)
+	go func() {
+		_, err := io.Copy(conn, in)
+		if err == nil {
+			err = conn.(*net.UnixConn).CloseWrite()
+		}
+		sent <- err
+	}()
+	code, err := readResult(r, out, stderr)
+	if err != nil {
+		if ctx.Err() != nil {
+			return 0, context.Cause(ctx)
+		}
+		if serr := <-sent; serr != nil {
+			return 0, fmt.Errorf("sending the input to the daemon: %w", serr)
+		}
+		return 0, fmt.Errorf("reading the result from the daemon: %w", err)
+	}
+	return code, nil
+}
+
+// readResult copies the result of a job from r.
+func readResult(r *bufio.Reader, out, stderr io.Writer) (int, error) {
+	header, err := r.ReadString('\n')
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(header)
+	if len(fields) != 4 || fields[0] != "exit" {
+		return 0, fmt.Errorf("unexpected result %q", strings.TrimSpace(header))
+	}
+	var numbers [3]int64
+	for i, field := range fields[1:] {
+		if numbers[i], err = strconv.ParseInt(field, 10, 64); err != nil {
+			return 0, fmt.Errorf("unexpected result %q", strings.TrimSpace(header))
+		}
+	}
+	if _, err := io.CopyN(out, r, numbers[1]); err != nil {
+		return 0, err
+	}
+	if _, err := io.CopyN(stderr, r, numbers[2]); err != nil {
+		return 0, err
+	}
+	return int(numbers[0]), nil
+}
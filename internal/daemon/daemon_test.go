@@ -0,0 +1,129 @@
+package daemon
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/danielsiegl/gitsqlite/internal/errs"
+	"github.com/danielsiegl/gitsqlite/internal/filters"
+	"github.com/danielsiegl/gitsqlite/internal/sqlite"
+)
+
+func TestForward(t *testing.T) {
+	ctx := context.Background()
+	// Socket paths are limited to about 100 bytes, shorter than some
+	// test directories
+	dir, err := os.MkdirTemp("", "gsd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, SocketName)
+
+	eng := &sqlite.Engine{Embedded: true}
+	dbPath := filepath.Join(dir, "app.db")
+	if err := eng.Restore(ctx, dbPath, strings.NewReader("CREATE TABLE t(id INTEGER PRIMARY KEY, v TEXT);\nINSERT INTO t VALUES(1,'a');\n")); err != nil {
+		t.Fatal(err)
+	}
+	db, err := os.ReadFile(dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want bytes.Buffer
+	if err := filters.Clean(ctx, eng, bytes.NewReader(db), &want, filters.DefaultOptions()); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Forward(ctx, socket, Job{Op: "clean", Key: "k"}, bytes.NewReader(db), &bytes.Buffer{}, &bytes.Buffer{}); !errors.Is(err, ErrUnavailable) {
+		t.Fatalf("without a daemon: error %v, want ErrUnavailable", err)
+	}
+
+	l, err := Listen(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Listen(socket); err == nil {
+		t.Error("listening twice on the same socket succeeded")
+	}
+	server := &Server{Engine: eng, Key: "k", Clean: filters.DefaultOptions(), Smudge: filters.SmudgeOptions{Jobs: 1}}
+	serveCtx, stop := context.WithCancel(ctx)
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(serveCtx, l) }()
+
+	var out, stderr bytes.Buffer
+	code, err := Forward(ctx, socket, Job{Op: "clean", Key: "k", Path: "app.db"}, bytes.NewReader(db), &out, &stderr)
+	if err != nil || code != errs.ExitOK {
+		t.Fatalf("clean: code %d, error %v, stderr %q", code, err, stderr.String())
+	}
+	if out.String() != want.String() {
+		t.Errorf("clean through the daemon differs:\n%s\nwant:\n%s", out.String(), want.String())
+	}
+
+	var restored bytes.Buffer
+	if code, err := Forward(ctx, socket, Job{Op: "smudge", Key: "k"}, strings.NewReader(want.String()), &restored, &stderr); err != nil || code != errs.ExitOK {
+		t.Fatalf("smudge: code %d, error %v, stderr %q", code, err, stderr.String())
+	}
+	if !bytes.HasPrefix(restored.Bytes(), []byte("SQLite format 3\x00")) {
+		t.Error("smudge through the daemon wrote no database")
+	}
+
+	out.Reset()
+	stderr.Reset()
+	code, err = Forward(ctx, socket, Job{Op: "clean", Key: "k"}, strings.NewReader("not a database"), &out, &stderr)
+	if err != nil || code == errs.ExitOK || out.Len() > 0 || !strings.Contains(stderr.String(), "Error running SQLite command for clean") {
+		t.Errorf("failing clean: code %d, error %v, output %q, stderr %q", code, err, out.String(), stderr.String())
+	}
+
+	if _, err := Forward(ctx, socket, Job{Op: "clean", Key: "other"}, bytes.NewReader(db), &out, &stderr); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("other settings: error %v, want ErrUnavailable", err)
+	}
+
+	stop()
+	if err := <-served; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(socket); err == nil {
+		t.Error("socket left behind after stopping")
+	}
+}
+
+func TestFailedSmudgeReleasesInput(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake binaries are shell scripts")
+	}
+	// A sqlite3 failing before it read its input
+	bin := filepath.Join(t.TempDir(), "sqlite3")
+	if err := os.WriteFile(bin, []byte("#!/bin/sh\nexit 1\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	server := &Server{Engine: &sqlite.Engine{Bin: bin}, Smudge: filters.SmudgeOptions{Jobs: 1}}
+	dump := "CREATE TABLE t(x);\n" + strings.Repeat("INSERT INTO t VALUES('"+strings.Repeat("x", 1000)+"');\n", 2000)
+
+	before := runtime.NumGoroutine()
+	for i := 0; i < 3; i++ {
+		in := strings.NewReader(dump)
+		var stderr bytes.Buffer
+		if code := server.run(context.Background(), Job{Op: "smudge"}, in, io.Discard, &stderr); code == errs.ExitOK {
+			t.Fatal("smudge with a failing sqlite3 succeeded")
+		}
+		if in.Len() > 0 {
+			t.Errorf("%d bytes of the input left unread", in.Len())
+		}
+	}
+	// Nothing goes on reading the input of a failed job
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > before && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Errorf("%d goroutines left behind by failed smudges", n-before)
+	}
+}
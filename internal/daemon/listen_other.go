@@ -0,0 +1,22 @@
+//go:build !unix
+
+package daemon
+
+import (
+	"net"
+	"os"
+)
+
+// listenPrivate listens on the unix socket at path and makes it accessible
+// to the current user only, as far as the platform has file modes.
+func listenPrivate(path string) (net.Listener, error) {
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0o600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
@@ -0,0 +1,18 @@
+//go:build unix
+
+package daemon
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// listenPrivate listens on the unix socket at path, which is created with
+// mode 0600 under a restrictive umask, so that no other user can connect
+// before the mode is set.
+func listenPrivate(path string) (net.Listener, error) {
+	old := unix.Umask(0o177)
+	defer unix.Umask(old)
+	return net.Listen("unix", path)
+}
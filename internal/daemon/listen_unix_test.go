@@ -0,0 +1,40 @@
+//go:build unix
+
+package daemon
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestListenPrivate(t *testing.T) {
+	dir, err := os.MkdirTemp("", "gsd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, SocketName)
+
+	// Under a permissive umask the socket is still created private, and
+	// the umask is restored afterwards
+	old := unix.Umask(0)
+	defer unix.Umask(old)
+	l, err := listenPrivate(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	info, err := os.Stat(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mode := info.Mode().Perm(); mode != 0o600 {
+		t.Errorf("socket mode = %o, want 600", mode)
+	}
+	if umask := unix.Umask(0); umask != 0 {
+		t.Errorf("umask after listenPrivate = %o, want 0", umask)
+	}
+}
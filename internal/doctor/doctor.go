@@ -0,0 +1,514 @@
+// Package doctor diagnoses the environment gitsqlite runs in: the sqlite3
+// binary, the git filter configuration and attributes, PATH, the temporary
+// and log directories, line ending settings, the journal mode of the
+// databases in the worktree and whether the data of databases stored next to
+// a schema file matches it (see CheckSplit). Each check reports what is wrong
+// and how to fix it; some problems can be fixed automatically (see Fix).
+package doctor
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/danielsiegl/gitsqlite/internal/config"
+	"github.com/danielsiegl/gitsqlite/internal/setup"
+	"github.com/danielsiegl/gitsqlite/internal/sqlite"
+)
+
+// Check statuses.
+const (
+	StatusOK   = "ok"
+	StatusWarn = "warn"
+	StatusFail = "fail"
+	StatusSkip = "skip"
+)
+
+// Check is the result of one diagnosis.
+type Check struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	// Detail describes what was found.
+	Detail string `json:"detail"`
+	// Fix tells how to resolve a warning or failure.
+	Fix string `json:"fix,omitempty"`
+	// Fixable is set if Fix can resolve the problem.
+	Fixable bool `json:"fixable"`
+
+	// fixID identifies the remediation; checks sharing one apply it once.
+	fixID string
+	apply func(ctx context.Context) (string, error)
+}
+
+// withFix returns c with the remediation apply, identified by id.
+func (c Check) withFix(id string, apply func(ctx context.Context) (string, error)) Check {
+	c.Fixable, c.fixID, c.apply = true, id, apply
+	return c
+}
+
+// FixResult describes a remediation applied by Fix.
+type FixResult struct {
+	// Check is the name of the (first) check the remediation resolves.
+	Check string `json:"check"`
+	// Action describes what was changed.
+	Action string `json:"action"`
+	// Error is set if the remediation failed.
+	Error string `json:"error,omitempty"`
+}
+
+// Fix applies the remediations of the checks that did not pass: it sets the
+// filter config to the running executable, adds missing attribute lines and
+// creates the log directory. It never touches tracked files other than
+// .gitattributes. Run the checks again to see the result.
+func Fix(ctx context.Context, checks []Check) []FixResult {
+	var results []FixResult
+	done := make(map[string]bool)
+	for _, c := range checks {
+		if c.apply == nil || c.Status == StatusOK || done[c.fixID] {
+			continue
+		}
+		done[c.fixID] = true
+		action, err := c.apply(ctx)
+		result := FixResult{Check: c.Name, Action: action}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// Failed reports whether any check failed.
+func Failed(checks []Check) bool {
+	for _, c := range checks {
+		if c.Status == StatusFail {
+			return true
+		}
+	}
+	return false
+}
+
+// databaseExtensions are the extensions of tracked files checked for a
+// missing filter attribute.
+var databaseExtensions = []string{".db", ".sqlite", ".sqlite3", ".qea"}
+
+// Run performs all checks with the sqlite3 binary selected by eng; logDir
+// is the directory -log writes to.
+func Run(ctx context.Context, eng *sqlite.Engine, logDir string) []Check {
+	checks := []Check{checkSQLite(ctx, eng)}
+	if !eng.Embedded {
+		checks = append(checks, checkCandidates(ctx, eng))
+	}
+	checks = append(checks, checkTempDir(), checkLogDir(logDir))
+
+	gitVersion, err := git(ctx, "--version")
+	if err != nil {
+		return append(checks, Check{Name: "git", Status: StatusFail,
+			Detail: fmt.Sprintf("git not found: %v", err),
+			Fix:    "install git and make sure it is on PATH"})
+	}
+	checks = append(checks, Check{Name: "git", Status: StatusOK, Detail: gitVersion})
+	root, err := git(ctx, "rev-parse", "--show-toplevel")
+	inRepo := err == nil
+	checks = append(checks, checkFilterConfig(ctx, !inRepo)...)
+
+	var files []attrFile
+	if !inRepo {
+		return append(checks, Check{Name: "attributes", Status: StatusSkip,
+			Detail: "not inside a git repository"})
+	}
+	paths, err := trackedDatabases(ctx, root)
+	if err == nil {
+		files, err = fileAttributes(ctx, root, paths)
+	}
+	if err != nil {
+		return append(checks, Check{Name: "attributes", Status: StatusFail, Detail: err.Error()})
+	}
+	drivers := gitsqliteDrivers(ctx, root, files)
+	checks = append(checks, checkAttributes(files, drivers))
+	checks = append(checks, checkLineEndings(ctx, root, files, drivers))
+	checks = append(checks, checkJournalModes(root, files, drivers))
+	checks = append(checks, checkSchemaSplit(ctx, root, files))
+	return checks
+}
+
+func checkSQLite(ctx context.Context, eng *sqlite.Engine) Check {
+	path, version, err := eng.CheckAvailability(ctx)
+	if err != nil {
+		return Check{Name: "sqlite", Status: StatusFail, Detail: err.Error(),
+			Fix: "install sqlite3, pass its path with -sqlite, or use -engine embedded"}
+	}
+	return Check{Name: "sqlite", Status: StatusOK, Detail: fmt.Sprintf("%s: %s", path, version)}
+}
+
+// checkCandidates warns when several sqlite3 versions are installed, since
+// the one found first may differ between the shell and git hooks or IDEs.
+func checkCandidates(ctx context.Context, eng *sqlite.Engine) Check {
+	versions := make(map[string]bool)
+	var found []string
+	for _, c := range eng.DetectionReport(ctx) {
+		if c.Err != nil || c.Version == "" {
+			continue
+		}
+		version := strings.Fields(c.Version)[0]
+		if !versions[version] {
+			versions[version] = true
+			found = append(found, fmt.Sprintf("%s (%s)", c.Path, version))
+		}
+	}
+	if len(found) > 1 && (eng.Select.Policy == "" || eng.Select.Policy == sqlite.SelectFirst) {
+		return Check{Name: "sqlite candidates", Status: StatusWarn,
+			Detail: "several sqlite3 versions installed: " + strings.Join(found, ", "),
+			Fix:    "pin one with -sqlite-select newest or exact:<version> (see gitsqlite detect --verbose)"}
+	}
+	return Check{Name: "sqlite candidates", Status: StatusOK,
+		Detail: fmt.Sprintf("%d version(s) installed", len(found))}
+}
+
+func checkTempDir() Check {
+	dir := os.TempDir()
+	f, err := os.CreateTemp("", "gitsqlite-doctor-*")
+	if err == nil {
+		_, err = f.WriteString("gitsqlite")
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		os.Remove(f.Name())
+	}
+	if err != nil {
+		return Check{Name: "temp dir", Status: StatusFail, Detail: err.Error(),
+			Fix: "make " + dir + " writable or point TMPDIR (TEMP on Windows) to a writable directory"}
+	}
+	return Check{Name: "temp dir", Status: StatusOK, Detail: dir + " is writable"}
+}
+
+// checkLogDir checks that log files can be created in dir.
+func checkLogDir(dir string) Check {
+	info, err := os.Stat(dir)
+	if os.IsNotExist(err) {
+		return Check{Name: "log dir", Status: StatusWarn, Detail: dir + " does not exist yet",
+			Fix: "create it, or let -log create it"}.withFix("log-dir", func(context.Context) (string, error) {
+			return "created " + dir, os.MkdirAll(dir, 0o755)
+		})
+	}
+	if err == nil && !info.IsDir() {
+		err = fmt.Errorf("%s is not a directory", dir)
+	}
+	if err == nil {
+		var f *os.File
+		if f, err = os.CreateTemp(dir, "gitsqlite-doctor-*"); err == nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}
+	if err != nil {
+		return Check{Name: "log dir", Status: StatusFail, Detail: err.Error(),
+			Fix: "make " + dir + " writable, or set log_dir in .gitsqlite.toml"}
+	}
+	return Check{Name: "log dir", Status: StatusOK, Detail: dir + " is writable"}
+}
+
+// checkFilterConfig checks the filter and diff driver commands in the
+// effective git config and that git can run them. Fixing them configures the
+// running executable, in the global config if global is set.
+func checkFilterConfig(ctx context.Context, global bool) []Check {
+	configure := func(ctx context.Context) (string, error) {
+		entries, err := setup.Configure(ctx, global, setup.Driver, setup.DefaultCommand())
+		scope := "local"
+		if global {
+			scope = "global"
+		}
+		return fmt.Sprintf("set %s in the %s git config", strings.Join(entries, ", "), scope), err
+	}
+	var checks []Check
+	for _, key := range []string{"filter." + setup.Driver + ".clean", "filter." + setup.Driver + ".smudge", "diff." + setup.Driver + ".textconv"} {
+		command, err := git(ctx, "config", "--get", key)
+		if err != nil || command == "" {
+			checks = append(checks, Check{Name: key, Status: StatusFail, Detail: "not set",
+				Fix: "run gitsqlite install (or gitsqlite install --global)"}.withFix("config", configure))
+			continue
+		}
+		if want := key[strings.LastIndexByte(key, '.')+1:]; operation(command) != "" && operation(command) != want {
+			checks = append(checks, Check{Name: key, Status: StatusFail,
+				Detail: fmt.Sprintf("%s runs %s instead of %s; clean and smudge are swapped", command, operation(command), want),
+				Fix:    "run gitsqlite install to configure the commands again"}.withFix("config", configure))
+			continue
+		}
+		exe := commandName(command)
+		path, err := exec.LookPath(exe)
+		if err != nil {
+			checks = append(checks, Check{Name: key, Status: StatusFail,
+				Detail: fmt.Sprintf("%s: %s not found on PATH", command, exe),
+				Fix:    "add the directory of gitsqlite to PATH, or run gitsqlite install to configure its absolute path"}.withFix("config", configure))
+			continue
+		}
+		if self, err := os.Executable(); err == nil && !sameFile(path, self) {
+			checks = append(checks, Check{Name: key, Status: StatusWarn,
+				Detail: fmt.Sprintf("%s runs %s, not this executable (%s)", command, path, self),
+				Fix:    "remove the other copy from PATH, or run gitsqlite install to configure this one"}.withFix("config", configure))
+			continue
+		}
+		checks = append(checks, Check{Name: key, Status: StatusOK, Detail: command})
+	}
+	key := "filter." + setup.Driver + ".required"
+	if required, _ := git(ctx, "config", "--bool", "--get", key); required != "true" {
+		checks = append(checks, Check{Name: key, Status: StatusWarn,
+			Detail: "not true: git commits the binary database if gitsqlite fails or is missing",
+			Fix:    "run git config " + key + " true"}.withFix("config", configure))
+	} else {
+		checks = append(checks, Check{Name: key, Status: StatusOK, Detail: required})
+	}
+	return checks
+}
+
+// commandName returns the executable of a config command, which git runs
+// through a shell: the first word, or the quoted path.
+func commandName(command string) string {
+	command = strings.TrimSpace(command)
+	if q := command[0]; q == '"' || q == '\'' {
+		if end := strings.IndexByte(command[1:], q); end >= 0 {
+			return command[1 : end+1]
+		}
+	}
+	return strings.Fields(command)[0]
+}
+
+// trackedDatabases returns the tracked files below root with a database
+// extension, relative to root.
+func trackedDatabases(ctx context.Context, root string) ([]string, error) {
+	args := []string{"-C", root, "ls-files", "--"}
+	for _, ext := range databaseExtensions {
+		args = append(args, "*"+ext)
+	}
+	out, err := git(ctx, args...)
+	if err != nil {
+		return nil, fmt.Errorf("git ls-files failed: %w", err)
+	}
+	if out == "" {
+		return nil, nil
+	}
+	return strings.Split(out, "\n"), nil
+}
+
+// gitsqliteDrivers returns the filter drivers of files that run gitsqlite:
+// the plain one and those registered with install --name, whose clean
+// command selects a configuration profile.
+func gitsqliteDrivers(ctx context.Context, root string, files []attrFile) map[string]bool {
+	drivers := map[string]bool{setup.Driver: true}
+	for _, f := range files {
+		if _, seen := drivers[f.filter]; seen || f.filter == "" || f.filter == "unspecified" || f.filter == "unset" || f.filter == "set" {
+			continue
+		}
+		clean, _ := git(ctx, "-C", root, "config", "--get", "filter."+f.filter+".clean")
+		drivers[f.filter] = operation(clean) == "clean" && strings.Contains(clean, " -config-profile="+f.filter)
+	}
+	return drivers
+}
+
+// checkAttributes reports tracked database files that git stores as binary
+// blobs because no attribute assigns them a gitsqlite filter driver.
+func checkAttributes(files []attrFile, drivers map[string]bool) Check {
+	if len(files) == 0 {
+		return Check{Name: "attributes", Status: StatusOK, Detail: "no tracked database files"}
+	}
+	var missing []string
+	for _, f := range files {
+		if !drivers[f.filter] {
+			missing = append(missing, f.path)
+		}
+	}
+	if len(missing) > 0 {
+		exts := make(map[string]bool)
+		var list []string
+		for _, path := range missing {
+			if ext := filepath.Ext(path); !exts[ext] {
+				exts[ext] = true
+				list = append(list, ext)
+			}
+		}
+		return Check{Name: "attributes", Status: StatusWarn,
+			Detail: fmt.Sprintf("%d of %d tracked database file(s) do not use filter=%s: %s", len(missing), len(files), setup.Driver, summarize(missing)),
+			Fix:    "run gitsqlite install --ext " + strings.Join(list, ",") + ", then git add --renormalize ."}.withFix("attributes", func(ctx context.Context) (string, error) {
+			file, added, err := setup.AddAttributes(ctx, false, setup.Driver, list)
+			return fmt.Sprintf("added %s to %s (run git add --renormalize . to convert the files)", strings.Join(added, ", "), file), err
+		})
+	}
+	return Check{Name: "attributes", Status: StatusOK,
+		Detail: fmt.Sprintf("%d tracked database file(s) use filter=%s", len(files), setup.Driver)}
+}
+
+// checkLineEndings warns if git may convert line endings of the SQL dumps:
+// on checkout, CRLF conversion happens before smudge, so text values would
+// gain carriage returns.
+func checkLineEndings(ctx context.Context, root string, files []attrFile, drivers map[string]bool) Check {
+	autocrlf, _ := git(ctx, "-C", root, "config", "--get", "core.autocrlf")
+	eol, _ := git(ctx, "-C", root, "config", "--get", "core.eol")
+	var converted []string
+	for _, f := range files {
+		if drivers[f.filter] && convertsToCRLF(f, autocrlf, eol, runtime.GOOS) {
+			converted = append(converted, f.path)
+		}
+	}
+	if len(converted) > 0 {
+		return Check{Name: "line endings", Status: StatusWarn,
+			Detail: fmt.Sprintf("git may convert line endings of %s (core.autocrlf=%s, core.eol=%s)", summarize(converted), valueOr(autocrlf, "unset"), valueOr(eol, "unset")),
+			Fix:    "add -text to the attribute lines of the databases, e.g. *.db filter=gitsqlite diff=gitsqlite -text"}
+	}
+	return Check{Name: "line endings", Status: StatusOK,
+		Detail: fmt.Sprintf("core.autocrlf=%s, core.eol=%s", valueOr(autocrlf, "unset"), valueOr(eol, "unset"))}
+}
+
+// checkJournalModes reports worktree databases whose journal mode differs
+// from the one their configuration declares (journal_mode, by default
+// delete), as after a smudge with another configuration or a program that
+// switched the mode. Only WAL mode is stored in the database file; the other
+// modes are chosen by whoever opens it.
+func checkJournalModes(root string, files []attrFile, drivers map[string]bool) Check {
+	var cfg *config.Config
+	if file := config.Find(root); file != "" {
+		var err error
+		if cfg, err = config.Load(file); err != nil {
+			return Check{Name: "journal mode", Status: StatusFail, Detail: err.Error(),
+				Fix: "correct " + config.FileName}
+		}
+	}
+	var checked int
+	var mismatched []string
+	for _, f := range files {
+		path := filepath.Join(root, filepath.FromSlash(f.path))
+		if !drivers[f.filter] || !sqlite.IsDatabaseFile(path) {
+			continue
+		}
+		declared := sqlite.JournalDelete
+		if cfg != nil {
+			profile := ""
+			if f.filter != setup.Driver {
+				profile = f.filter
+			}
+			s, err := cfg.Resolve(path, profile)
+			if err != nil {
+				return Check{Name: "journal mode", Status: StatusFail, Detail: fmt.Sprintf("%s: %v", f.path, err),
+					Fix: "add the profile to " + config.FileName + " or run gitsqlite uninstall --name " + f.filter}
+			}
+			if s.JournalMode != nil {
+				declared = *s.JournalMode
+			}
+		}
+		checked++
+		actual := sqlite.JournalDelete
+		if sqlite.IsWAL(path) {
+			actual = sqlite.JournalWAL
+		}
+		if actual != declared {
+			mismatched = append(mismatched, fmt.Sprintf("%s (%s, declared %s)", f.path, actual, declared))
+		}
+	}
+	if len(mismatched) > 0 {
+		return Check{Name: "journal mode", Status: StatusWarn,
+			Detail: fmt.Sprintf("%d of %d database file(s) are not in the declared journal mode: %s", len(mismatched), checked, summarize(mismatched)),
+			Fix:    "check the files out again (delete them, then git checkout -- <path>), or change journal_mode in " + config.FileName}
+	}
+	if checked == 0 {
+		return Check{Name: "journal mode", Status: StatusSkip, Detail: "no database files in the worktree"}
+	}
+	return Check{Name: "journal mode", Status: StatusOK,
+		Detail: fmt.Sprintf("%d database file(s) are in the declared journal mode", checked)}
+}
+
+// convertsToCRLF reports whether git converts LF to CRLF when checking out
+// f, given core.autocrlf, core.eol and the operating system.
+func convertsToCRLF(f attrFile, autocrlf, coreEOL, goos string) bool {
+	switch {
+	case f.text == "unset" || f.eol == "lf":
+		return false
+	case f.eol == "crlf":
+		return true
+	case autocrlf == "true":
+		return true
+	case f.text == "unspecified" || f.text == "" || autocrlf == "input":
+		return false
+	}
+	// text or text=auto: core.eol, which defaults to native
+	return coreEOL == "crlf" || ((coreEOL == "" || coreEOL == "native") && goos == "windows")
+}
+
+// attrFile holds the attributes of a tracked file that matter to gitsqlite.
+type attrFile struct {
+	path, filter, text, eol string
+}
+
+// fileAttributes looks up the filter, text and eol attributes of paths.
+func fileAttributes(ctx context.Context, root string, paths []string) ([]attrFile, error) {
+	if len(paths) == 0 {
+		return nil, nil
+	}
+	cmd := exec.CommandContext(ctx, "git", "-C", root, "check-attr", "-z", "--stdin", "filter", "text", "eol")
+	cmd.Stdin = strings.NewReader(strings.Join(paths, "\x00") + "\x00")
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git check-attr failed: %w", err)
+	}
+	byPath := make(map[string]*attrFile)
+	var files []attrFile
+	for _, p := range paths {
+		files = append(files, attrFile{path: p})
+	}
+	for i := range files {
+		byPath[files[i].path] = &files[i]
+	}
+	// Output is a sequence of <path> NUL <attribute> NUL <value> NUL
+	fields := strings.Split(string(out), "\x00")
+	for i := 0; i+2 < len(fields); i += 3 {
+		f := byPath[fields[i]]
+		if f == nil {
+			continue
+		}
+		switch fields[i+1] {
+		case "filter":
+			f.filter = fields[i+2]
+		case "text":
+			f.text = fields[i+2]
+		case "eol":
+			f.eol = fields[i+2]
+		}
+	}
+	return files, nil
+}
+
+// git runs git with args and returns its trimmed output.
+func git(ctx context.Context, args ...string) (string, error) {
+	out, err := exec.CommandContext(ctx, "git", args...).Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+// summarize lists up to three paths.
+func summarize(paths []string) string {
+	if len(paths) > 3 {
+		return strings.Join(paths[:3], ", ") + fmt.Sprintf(" and %d more", len(paths)-3)
+	}
+	return strings.Join(paths, ", ")
+}
+
+func valueOr(value, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+	return value
+}
+
+// sameFile reports whether a and b name the same file.
+func sameFile(a, b string) bool {
+	ia, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	ib, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(ia, ib)
+}
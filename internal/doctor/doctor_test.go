@@ -0,0 +1,127 @@
+package doctor
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestConvertsToCRLF(t *testing.T) {
+	tests := []struct {
+		text, eol, autocrlf, coreEOL, goos string
+		want                               bool
+	}{
+		{"unspecified", "unspecified", "", "", "linux", false},
+		{"unspecified", "unspecified", "", "", "windows", false},
+		{"unspecified", "unspecified", "true", "", "linux", true},
+		{"unspecified", "unspecified", "input", "", "windows", false},
+		{"unset", "unspecified", "true", "", "windows", false},
+		{"auto", "unspecified", "", "", "windows", true},
+		{"auto", "unspecified", "", "", "linux", false},
+		{"auto", "unspecified", "", "crlf", "linux", true},
+		{"auto", "unspecified", "input", "crlf", "linux", false},
+		{"set", "lf", "true", "", "windows", false},
+		{"unspecified", "crlf", "", "", "linux", true},
+	}
+	for _, tt := range tests {
+		f := attrFile{path: "a.db", filter: "gitsqlite", text: tt.text, eol: tt.eol}
+		if got := convertsToCRLF(f, tt.autocrlf, tt.coreEOL, tt.goos); got != tt.want {
+			t.Errorf("convertsToCRLF(text=%s eol=%s, autocrlf=%q, core.eol=%q, %s) = %v, want %v",
+				tt.text, tt.eol, tt.autocrlf, tt.coreEOL, tt.goos, got, tt.want)
+		}
+	}
+}
+
+func TestCommandName(t *testing.T) {
+	tests := map[string]string{
+		"gitsqlite clean":                           "gitsqlite",
+		"/usr/local/bin/gitsqlite smudge":           "/usr/local/bin/gitsqlite",
+		`"C:/Program Files/gitsqlite.exe" textconv`: "C:/Program Files/gitsqlite.exe",
+	}
+	for command, want := range tests {
+		if got := commandName(command); got != want {
+			t.Errorf("commandName(%q) = %q, want %q", command, got, want)
+		}
+	}
+}
+
+func TestFixCreatesLogDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "logs")
+	c := checkLogDir(dir)
+	if c.Status != StatusWarn || !c.Fixable {
+		t.Fatalf("missing log dir: got %+v, want a fixable warning", c)
+	}
+	fixes := Fix(context.Background(), []Check{c, c})
+	if len(fixes) != 1 || fixes[0].Error != "" {
+		t.Fatalf("Fix = %+v, want one successful fix", fixes)
+	}
+	if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+		t.Fatalf("log dir not created: %v", err)
+	}
+	if c := checkLogDir(dir); c.Status != StatusOK {
+		t.Errorf("after fix: got %+v", c)
+	}
+}
+
+func TestOperation(t *testing.T) {
+	tests := map[string]string{
+		"gitsqlite clean":                 "clean",
+		"gitsqlite -log smudge %f":        "smudge",
+		`"C:/Program Files/gs.exe" clean`: "clean",
+		"gitsqlite textconv":              "",
+	}
+	for command, want := range tests {
+		if got := operation(command); got != want {
+			t.Errorf("operation(%q) = %q, want %q", command, got, want)
+		}
+	}
+}
+
+func TestCheckJournalModes(t *testing.T) {
+	root := t.TempDir()
+	write := func(name string, content []byte) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(root, name), content, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	header := func(version byte) []byte {
+		h := make([]byte, 100)
+		copy(h, "SQLite format 3\x00")
+		h[18], h[19] = version, version
+		return h
+	}
+	write("rollback.db", header(1))
+	write("wal.db", header(2))
+	write("dump.db", []byte("CREATE TABLE t(a);\n"))
+	files := []attrFile{{path: "rollback.db", filter: "gitsqlite"}, {path: "wal.db", filter: "gitsqlite"}, {path: "dump.db", filter: "gitsqlite"}}
+	drivers := map[string]bool{"gitsqlite": true}
+
+	c := checkJournalModes(root, files, drivers)
+	if c.Status != StatusWarn || !strings.Contains(c.Detail, "wal.db (wal, declared delete)") || !strings.Contains(c.Detail, "of 2 ") {
+		t.Errorf("without configuration: got %+v", c)
+	}
+	write(".gitsqlite.toml", []byte("[[profile]]\npath = \"wal.db\"\njournal_mode = \"wal\"\n"))
+	if c := checkJournalModes(root, files, drivers); c.Status != StatusOK {
+		t.Errorf("with wal.db declared wal: got %+v", c)
+	}
+}
+
+func TestSchemaFlags(t *testing.T) {
+	tests := []struct {
+		command, schema, profile string
+	}{
+		{"gitsqlite -data-only -schema clean %f", ".gitsqliteschema", ""},
+		{"gitsqlite -schema=false clean", "", ""},
+		{"gitsqlite --schema-file db/schema.sql clean %f", "db/schema.sql", ""},
+		{`gitsqlite -schema-file="schema.sql" -config-profile=app clean`, "schema.sql", "app"},
+		{"gitsqlite clean %f", "", ""},
+	}
+	for _, tt := range tests {
+		if schema, profile := schemaFlags(tt.command); schema != tt.schema || profile != tt.profile {
+			t.Errorf("schemaFlags(%q) = %q, %q; want %q, %q", tt.command, schema, profile, tt.schema, tt.profile)
+		}
+	}
+}
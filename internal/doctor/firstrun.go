@@ -0,0 +1,129 @@
+package doctor
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/danielsiegl/gitsqlite/internal/gitdir"
+)
+
+// checkedStamp is the file in the gitsqlite directory of the repository whose
+// modification time records the last runtime configuration check.
+const checkedStamp = "config-checked"
+
+// Misconfigurations inspects how git runs the filter for the worktree file
+// path (git's %f, relative to the repository root) and returns each problem
+// found with its fix:
+//
+//   - the clean and smudge commands of the filter driver are swapped
+//   - filter.<driver>.required is not true, so git silently stores the binary
+//     database if gitsqlite fails or is missing
+//   - git converts line endings of the dump, which changes text values
+//
+// It is meant to be called by the clean and smudge filters. To keep them fast
+// and the warnings one-time, the check is skipped (nil is returned) unless the
+// git config or attribute files changed since the last check. Errors count
+// as nothing found.
+func Misconfigurations(ctx context.Context, path string) []string {
+	stamp, root, err := gitdir.WorktreeDir(ctx, checkedStamp)
+	if err != nil {
+		return nil
+	}
+	// The stamp is <git-dir>/gitsqlite/<name>
+	commonDir := filepath.Dir(filepath.Dir(stamp))
+	if checkedSince(stamp, configFiles(commonDir, root)) {
+		return nil
+	}
+
+	problems := misconfigurations(ctx, root, filepath.ToSlash(path))
+	if err := os.MkdirAll(filepath.Dir(stamp), 0o755); err == nil {
+		_ = os.WriteFile(stamp, []byte(time.Now().UTC().Format(time.RFC3339)+"\n"), 0o644)
+	}
+	return problems
+}
+
+func misconfigurations(ctx context.Context, root, path string) []string {
+	files, err := fileAttributes(ctx, root, []string{path})
+	if err != nil || len(files) != 1 {
+		return nil
+	}
+	f := files[0]
+	driver := f.filter
+	if driver == "" || driver == "unspecified" || driver == "unset" || driver == "set" {
+		return nil
+	}
+
+	var problems []string
+	clean, _ := git(ctx, "-C", root, "config", "--get", "filter."+driver+".clean")
+	smudge, _ := git(ctx, "-C", root, "config", "--get", "filter."+driver+".smudge")
+	if operation(clean) == "smudge" || operation(smudge) == "clean" {
+		problems = append(problems, fmt.Sprintf(
+			"filter.%s.clean and filter.%s.smudge are swapped (clean runs %q, smudge runs %q); run gitsqlite doctor --fix",
+			driver, driver, clean, smudge))
+	}
+	if required, _ := git(ctx, "-C", root, "config", "--bool", "--get", "filter."+driver+".required"); required != "true" {
+		problems = append(problems, fmt.Sprintf(
+			"filter.%s.required is not true, so git commits the binary database if gitsqlite fails or is missing; run git config filter.%s.required true",
+			driver, driver))
+	}
+	autocrlf, _ := git(ctx, "-C", root, "config", "--get", "core.autocrlf")
+	eol, _ := git(ctx, "-C", root, "config", "--get", "core.eol")
+	if convertsToCRLF(f, autocrlf, eol, runtime.GOOS) {
+		problems = append(problems, fmt.Sprintf(
+			"git may convert line endings of %s (core.autocrlf=%s, core.eol=%s, text=%s), which changes text values; add -text to its attribute line",
+			path, valueOr(autocrlf, "unset"), valueOr(eol, "unset"), valueOr(f.text, "unspecified")))
+	}
+	return problems
+}
+
+// operation returns the gitsqlite operation a filter command runs: its first
+// argument that is "clean" or "smudge".
+func operation(command string) string {
+	for _, word := range strings.Fields(command) {
+		if word == "clean" || word == "smudge" {
+			return word
+		}
+	}
+	return ""
+}
+
+// configFiles returns the git config and attribute files that decide how the
+// filter runs. Attribute files in subdirectories are not included.
+func configFiles(commonDir, root string) []string {
+	files := []string{
+		filepath.Join(commonDir, "config"),
+		filepath.Join(commonDir, "info", "attributes"),
+		filepath.Join(root, ".gitattributes"),
+	}
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if home, err := os.UserHomeDir(); err == nil {
+		files = append(files, filepath.Join(home, ".gitconfig"))
+		if configHome == "" {
+			configHome = filepath.Join(home, ".config")
+		}
+	}
+	if configHome != "" {
+		files = append(files, filepath.Join(configHome, "git", "config"), filepath.Join(configHome, "git", "attributes"))
+	}
+	return files
+}
+
+// checkedSince reports whether stamp exists and is newer than every existing
+// file in files.
+func checkedSince(stamp string, files []string) bool {
+	info, err := os.Stat(stamp)
+	if err != nil {
+		return false
+	}
+	for _, file := range files {
+		if fi, err := os.Stat(file); err == nil && !fi.ModTime().Before(info.ModTime()) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,250 @@
+package doctor
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/danielsiegl/gitsqlite/internal/compression"
+	"github.com/danielsiegl/gitsqlite/internal/config"
+	"github.com/danielsiegl/gitsqlite/internal/filters"
+)
+
+// defaultSchemaFile is the schema file of -schema.
+const defaultSchemaFile = ".gitsqliteschema"
+
+// SplitFile is the result of checking one tracked database that is stored as
+// data next to a schema file.
+type SplitFile struct {
+	Path string `json:"path"`
+	// Schema is the schema file, relative to the repository root; "" if the
+	// database is not stored through gitsqlite at all.
+	Schema string `json:"schema,omitempty"`
+	Status string `json:"status"`
+	// Problems describe what does not match.
+	Problems []string `json:"problems,omitempty"`
+}
+
+// CheckSplit checks the repository in the working directory, if any of its
+// tracked databases is stored as data next to a schema file (-schema or
+// -schema-file in the clean command of its filter driver, or schema_file in
+// .gitsqlite.toml): that the data in the git index records the hash of the
+// schema file in the worktree, has rows only for tables the schema file
+// declares, and holds no schema itself, and that no tracked database is
+// stored as binary file bypassing the filter. It returns nil if no database
+// uses a schema file.
+func CheckSplit(ctx context.Context) ([]SplitFile, error) {
+	root, err := git(ctx, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, fmt.Errorf("not inside a git repository")
+	}
+	root = filepath.FromSlash(root)
+	paths, err := trackedDatabases(ctx, root)
+	if err != nil {
+		return nil, err
+	}
+	files, err := fileAttributes(ctx, root, paths)
+	if err != nil {
+		return nil, err
+	}
+	return checkSplit(ctx, root, files)
+}
+
+func checkSplit(ctx context.Context, root string, files []attrFile) ([]SplitFile, error) {
+	var cfg *config.Config
+	if file := config.Find(root); file != "" {
+		var err error
+		if cfg, err = config.Load(file); err != nil {
+			return nil, err
+		}
+	}
+	results := make([]SplitFile, len(files))
+	split := false
+	users := map[string][]string{}
+	for i, f := range files {
+		results[i].Path = f.path
+		schema, ok, err := schemaFileOf(ctx, root, f, cfg)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case !ok:
+			results[i].Status = StatusFail
+		case schema == "":
+			results[i].Status = StatusSkip
+		default:
+			split = true
+			results[i].Schema = schema
+			users[schema] = append(users[schema], f.path)
+		}
+	}
+	if !split {
+		return nil, nil
+	}
+
+	for i := range results {
+		r := &results[i]
+		switch {
+		case r.Status == StatusFail:
+			r.Problems = []string{fmt.Sprintf("stored without gitsqlite (filter=%s), bypassing the schema split", valueOr(files[i].filter, "unspecified"))}
+			continue
+		case r.Status == StatusSkip:
+			continue
+		}
+		r.Status = StatusOK
+		check, binary, err := checkSplitFile(ctx, root, r.Path, r.Schema)
+		switch {
+		case err != nil:
+			r.Status, r.Problems = StatusFail, []string{err.Error()}
+		case binary:
+			r.Status, r.Problems = StatusFail, []string{"the git index holds the binary database, not its data; run git add --renormalize " + r.Path}
+		default:
+			r.Problems = check.Problems()
+			if len(r.Problems) > 0 {
+				r.Status = StatusFail
+				if others := len(users[r.Schema]) - 1; others > 0 && check.LinkedHash != "" && check.LinkedHash != check.SchemaHash {
+					r.Problems = append(r.Problems, fmt.Sprintf("%s is shared with %d other database(s), whose clean overwrites it; give each database its own schema file", r.Schema, others))
+				}
+			} else if check.Unlinked() {
+				r.Status = StatusWarn
+				r.Problems = []string{"the data records no schema hash (written by an older gitsqlite); add -upgrade-format to the clean command for one git add --renormalize to record it"}
+			}
+		}
+	}
+	return results, nil
+}
+
+// schemaFileOf returns the schema file f is stored with, relative to root,
+// "" if it is stored as complete dump. ok is false if f is not stored
+// through gitsqlite.
+func schemaFileOf(ctx context.Context, root string, f attrFile, cfg *config.Config) (schema string, ok bool, err error) {
+	if f.filter == "" || f.filter == "unspecified" || f.filter == "unset" || f.filter == "set" {
+		return "", false, nil
+	}
+	clean, _ := git(ctx, "-C", root, "config", "--get", "filter."+f.filter+".clean")
+	if operation(clean) != "clean" || !strings.Contains(filepath.Base(commandName(clean)), "gitsqlite") {
+		return "", false, nil
+	}
+	schema, profile := schemaFlags(clean)
+	if schema == "" && cfg != nil {
+		s, err := cfg.Resolve(filepath.Join(root, filepath.FromSlash(f.path)), profile)
+		if err != nil {
+			return "", true, fmt.Errorf("%s: %w", f.path, err)
+		}
+		if s.SchemaFile != nil {
+			schema = *s.SchemaFile
+		}
+	}
+	if schema == "" {
+		return "", true, nil
+	}
+	// git runs filters at the top of the worktree
+	if filepath.IsAbs(schema) {
+		if rel, err := filepath.Rel(root, schema); err == nil {
+			schema = rel
+		}
+	}
+	return filepath.ToSlash(schema), true, nil
+}
+
+// schemaFlags returns the schema file a filter command passes with -schema
+// or -schema-file, and its -config-profile.
+func schemaFlags(command string) (schema, profile string) {
+	words := strings.Fields(command)
+	for i, word := range words {
+		name, value, hasValue := strings.Cut(strings.TrimLeft(word, "-"), "=")
+		if !strings.HasPrefix(word, "-") {
+			continue
+		}
+		if !hasValue && i+1 < len(words) {
+			value = words[i+1]
+		}
+		value = strings.Trim(value, `"'`)
+		switch name {
+		case "schema":
+			if !hasValue || value == "true" {
+				schema = defaultSchemaFile
+			}
+		case "schema-file":
+			schema = value
+		case "config-profile":
+			profile = value
+		}
+	}
+	return schema, profile
+}
+
+// checkSplitFile compares the data of path in the git index with the schema
+// file. binary is set if the index holds a database file instead.
+func checkSplitFile(ctx context.Context, root, path, schemaPath string) (check *filters.SplitCheck, binary bool, err error) {
+	schema, err := os.Open(filepath.Join(root, filepath.FromSlash(schemaPath)))
+	if err != nil {
+		return nil, false, fmt.Errorf("cannot read the schema file: %w", err)
+	}
+	defer schema.Close()
+
+	cmd := exec.CommandContext(ctx, "git", "-C", root, "cat-file", "blob", ":"+path)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, false, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, false, err
+	}
+	br := bufio.NewReader(out)
+	if head, _ := br.Peek(len(sqliteHeader)); string(head) == sqliteHeader {
+		binary = true
+	} else {
+		check, err = filters.CheckSplit(br, schema, filepath.Join(root, compression.DefaultDictDir))
+	}
+	// Drain the rest so that git is not stopped by a closed pipe
+	_, _ = io.Copy(io.Discard, br)
+	if werr := cmd.Wait(); werr != nil && err == nil {
+		err = fmt.Errorf("cannot read %s from the git index: %w", path, werr)
+	}
+	return check, binary, err
+}
+
+// sqliteHeader starts every SQLite database file.
+const sqliteHeader = "SQLite format 3\x00"
+
+// checkSchemaSplit sums up CheckSplit for Run.
+func checkSchemaSplit(ctx context.Context, root string, files []attrFile) Check {
+	results, err := checkSplit(ctx, root, files)
+	if err != nil {
+		return Check{Name: "schema split", Status: StatusFail, Detail: err.Error()}
+	}
+	if results == nil {
+		return Check{Name: "schema split", Status: StatusSkip, Detail: "no database is stored next to a schema file"}
+	}
+	var failed, warned []string
+	split := 0
+	for _, r := range results {
+		switch r.Status {
+		case StatusFail:
+			failed = append(failed, r.Path)
+		case StatusWarn:
+			warned = append(warned, r.Path)
+		}
+		if r.Schema != "" {
+			split++
+		}
+	}
+	switch {
+	case len(failed) > 0:
+		return Check{Name: "schema split", Status: StatusFail,
+			Detail: fmt.Sprintf("%d database file(s) do not match their schema file or bypass it: %s", len(failed), summarize(failed)),
+			Fix:    "run gitsqlite check-split for details"}
+	case len(warned) > 0:
+		return Check{Name: "schema split", Status: StatusWarn,
+			Detail: fmt.Sprintf("%d database file(s) record no schema hash: %s", len(warned), summarize(warned)),
+			Fix:    "run gitsqlite check-split for details"}
+	}
+	return Check{Name: "schema split", Status: StatusOK,
+		Detail: fmt.Sprintf("%d database file(s) match their schema file", split)}
+}
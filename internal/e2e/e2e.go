@@ -0,0 +1,555 @@
+// Package e2e runs gitsqlite end to end, the way users run it: as the filter
+// and diff driver of a git repository, started by git through its shell, on
+// the machine and with the git and sqlite3 that show a problem. Every
+// scenario gets a temporary repository of its own; only the repository
+// configuration is set up, global git configuration stays in effect.
+package e2e
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/danielsiegl/gitsqlite/internal/errs"
+	"github.com/danielsiegl/gitsqlite/internal/hash"
+	"github.com/danielsiegl/gitsqlite/internal/sqlite"
+)
+
+// ScenarioTimeout is how long a scenario may take.
+const ScenarioTimeout = 2 * time.Minute
+
+// exitTimeout is how long a filter may take to exit once its output was
+// closed or its input stalled.
+const exitTimeout = 15 * time.Second
+
+// sampleDB is the name of the sample database in the repositories.
+const sampleDB = "sample.db"
+
+// sampleSQL creates the sample database: text with line breaks and non-ASCII
+// characters, reals, BLOBs, NULLs, an index, a view and a WITHOUT ROWID table,
+// and enough rows that the dump is much larger than a pipe buffer.
+const sampleSQL = `CREATE TABLE items(id INTEGER PRIMARY KEY, name TEXT NOT NULL, price REAL, data BLOB);
+CREATE INDEX items_name ON items(name);
+CREATE TABLE notes(key TEXT PRIMARY KEY, body TEXT) WITHOUT ROWID;
+CREATE VIEW cheap AS SELECT id, name FROM items WHERE price < 10;
+INSERT INTO notes VALUES('unicode', 'Grüße, 日本語 ✓'), ('lines', 'first' || char(13, 10) || 'second'), ('quote', 'it''s'), ('null', NULL);
+WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i + 1 FROM n WHERE i < 20000)
+INSERT INTO items SELECT i, printf('item %05d', i), i * 0.25, CAST(printf('%08x', i) AS BLOB) FROM n;
+`
+
+// Scenario is one end-to-end check.
+type Scenario struct {
+	Name        string
+	Description string
+	run         func(ctx context.Context, e *env) error
+}
+
+// Scenarios lists the scenarios in the order they run.
+var Scenarios = []Scenario{
+	{"roundtrip", "clean, smudge and clean again give the same dump", roundtrip},
+	{"commit", "git add stores the dump and leaves the worktree clean", commit},
+	{"checkout", "git checkout restores the database from the dump", checkout},
+	{"diff", "git diff shows a changed row through the diff driver", diff},
+	{"broken-pipe", "clean and smudge exit and clean up when their reader goes away", brokenPipe},
+	{"stalled-input", "clean fails with a timeout when its input stalls", stalledInput},
+}
+
+// Options configure Run.
+type Options struct {
+	// Executable is the gitsqlite binary under test. It is run with Args
+	// followed by the operation, by git and directly.
+	Executable string
+	Args       []string
+	// Only, if not empty, selects scenarios by name.
+	Only []string
+	// Keep keeps the temporary directory for inspection.
+	Keep bool
+}
+
+// Result is the outcome of a scenario.
+type Result struct {
+	Scenario Scenario
+	Duration time.Duration
+	// Err is why the scenario failed, nil if it passed.
+	Err error
+	// Dir is the repository of the scenario; it is removed unless
+	// Options.Keep is set.
+	Dir string
+}
+
+// Select returns the scenarios named in names, all if names is empty. An
+// unknown name is an error.
+func Select(names []string) ([]Scenario, error) {
+	if len(names) == 0 {
+		return Scenarios, nil
+	}
+	var selected []Scenario
+	for _, name := range names {
+		found := false
+		for _, s := range Scenarios {
+			if s.Name == name {
+				selected = append(selected, s)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown scenario %q", name)
+		}
+	}
+	return selected, nil
+}
+
+// Run runs the selected scenarios in a temporary directory and reports each
+// result. It returns the directory (removed unless opts.Keep is set), the
+// number of failed scenarios, and an error if the scenarios could not be run
+// at all or ctx was canceled.
+func Run(ctx context.Context, eng *sqlite.Engine, opts Options, report func(Result)) (string, int, error) {
+	scenarios, err := Select(opts.Only)
+	if err != nil {
+		return "", 0, errs.Mark(err, errs.ErrUsage)
+	}
+	if _, err := exec.LookPath("git"); err != nil {
+		return "", 0, fmt.Errorf("git is needed for the end-to-end scenarios: %w", err)
+	}
+	root, err := os.MkdirTemp("", "gitsqlite-e2e-*")
+	if err != nil {
+		return "", 0, err
+	}
+	if !opts.Keep {
+		defer os.RemoveAll(root)
+	}
+
+	failed := 0
+	for _, s := range scenarios {
+		if err := ctx.Err(); err != nil {
+			return root, failed, context.Cause(ctx)
+		}
+		result := Result{Scenario: s, Dir: filepath.Join(root, s.Name)}
+		start := time.Now()
+		result.Err = runScenario(ctx, eng, opts, s, result.Dir)
+		result.Duration = time.Since(start)
+		if result.Err != nil {
+			failed++
+		}
+		report(result)
+	}
+	return root, failed, nil
+}
+
+func runScenario(ctx context.Context, eng *sqlite.Engine, opts Options, s Scenario, dir string) error {
+	ctx, cancel := context.WithTimeout(ctx, ScenarioTimeout)
+	defer cancel()
+	e := &env{eng: eng, opts: opts, dir: dir, tmp: filepath.Join(dir, ".git", "e2e-tmp")}
+	if err := e.setup(ctx); err != nil {
+		return fmt.Errorf("setting up the repository: %w", err)
+	}
+	if err := s.run(ctx, e); err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("%w (scenario timed out after %s)", err, ScenarioTimeout)
+		}
+		return err
+	}
+	return nil
+}
+
+// env is the repository of a scenario.
+type env struct {
+	eng  *sqlite.Engine
+	opts Options
+	dir  string
+	// tmp is the temporary directory of the gitsqlite processes, which
+	// must be empty after each of them exits
+	tmp string
+}
+
+// setup creates the repository with gitsqlite configured as filter and diff
+// driver for *.db, the sample database and the attributes committed.
+func (e *env) setup(ctx context.Context) error {
+	if err := os.MkdirAll(e.dir, 0o755); err != nil {
+		return err
+	}
+	if _, err := e.git(ctx, "init", "-q"); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(e.tmp, 0o755); err != nil {
+		return err
+	}
+	command := e.command()
+	for _, kv := range [][2]string{
+		{"user.name", "gitsqlite e2e"},
+		{"user.email", "e2e@gitsqlite.invalid"},
+		{"commit.gpgsign", "false"},
+		{"core.autocrlf", "false"},
+		// Hooks of the user are not what is tested
+		{"core.hooksPath", ".git/e2e-no-hooks"},
+		{"filter.gitsqlite.clean", command + " clean"},
+		{"filter.gitsqlite.smudge", command + " smudge"},
+		{"filter.gitsqlite.required", "true"},
+		{"diff.gitsqlite.textconv", command + " textconv"},
+	} {
+		if _, err := e.git(ctx, "config", kv[0], kv[1]); err != nil {
+			return err
+		}
+	}
+	if err := os.WriteFile(filepath.Join(e.dir, ".gitattributes"), []byte("*.db filter=gitsqlite diff=gitsqlite\n"), 0o644); err != nil {
+		return err
+	}
+	if err := e.eng.Restore(ctx, e.path(sampleDB), strings.NewReader(sampleSQL)); err != nil {
+		return fmt.Errorf("creating the sample database: %w", err)
+	}
+	_, err := e.git(ctx, "add", ".gitattributes")
+	return err
+}
+
+// command returns the gitsqlite command line for git, which runs it through
+// a POSIX shell, also on Windows.
+func (e *env) command() string {
+	words := []string{shellQuote(filepath.ToSlash(e.opts.Executable))}
+	for _, arg := range e.opts.Args {
+		words = append(words, shellQuote(arg))
+	}
+	return strings.Join(words, " ")
+}
+
+func shellQuote(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\n'\"\\$`!*?[]{}()<>|&;#~") {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func (e *env) path(name string) string {
+	return filepath.Join(e.dir, name)
+}
+
+// git runs git in the repository and returns its output.
+func (e *env) git(ctx context.Context, args ...string) (string, error) {
+	out, err := e.run(ctx, nil, "git", args...)
+	return string(out), err
+}
+
+// gitsqlite runs the gitsqlite under test with the global flags and args.
+func (e *env) gitsqlite(ctx context.Context, stdin io.Reader, args ...string) ([]byte, error) {
+	return e.run(ctx, stdin, e.opts.Executable, append(append([]string{}, e.opts.Args...), args...)...)
+}
+
+// run runs name in the repository and returns its output; the error of a
+// failed command includes its error output.
+func (e *env) run(ctx context.Context, stdin io.Reader, name string, args ...string) ([]byte, error) {
+	cmd := e.cmd(ctx, name, args...)
+	cmd.Stdin = stdin
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s %s: %w%s", filepath.Base(name), strings.Join(args, " "), err, indent(stderr.String()))
+	}
+	if err := e.checkTemp(); err != nil {
+		return nil, fmt.Errorf("%s %s: %w", filepath.Base(name), strings.Join(args, " "), err)
+	}
+	return stdout.Bytes(), nil
+}
+
+// cmd returns the command running name in the repository. Variables of an
+// enclosing git (e.g. when run from a hook) would redirect git to another
+// repository and are dropped; temporary files go to e.tmp.
+func (e *env) cmd(ctx context.Context, name string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Dir = e.dir
+	for _, kv := range os.Environ() {
+		key, _, _ := strings.Cut(kv, "=")
+		switch strings.ToUpper(key) {
+		case "GIT_DIR", "GIT_WORK_TREE", "GIT_INDEX_FILE", "GIT_PREFIX", "TMPDIR", "TMP", "TEMP":
+			continue
+		}
+		cmd.Env = append(cmd.Env, kv)
+	}
+	cmd.Env = append(cmd.Env, "TMPDIR="+e.tmp, "TMP="+e.tmp, "TEMP="+e.tmp)
+	// Grandchildren keeping the output open must not keep a killed
+	// command waiting
+	cmd.WaitDelay = time.Second
+	return cmd
+}
+
+// checkTemp reports temporary files gitsqlite left behind.
+func (e *env) checkTemp() error {
+	entries, err := os.ReadDir(e.tmp)
+	if err != nil || len(entries) == 0 {
+		return nil
+	}
+	names := make([]string, len(entries))
+	for i, entry := range entries {
+		names[i] = entry.Name()
+		_ = os.RemoveAll(filepath.Join(e.tmp, entry.Name()))
+	}
+	return fmt.Errorf("temporary files left behind: %s", strings.Join(names, ", "))
+}
+
+// clean returns the dump of the database at path, made by the gitsqlite
+// under test.
+func (e *env) clean(ctx context.Context, path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return e.gitsqlite(ctx, f, "clean")
+}
+
+// commitSample commits the sample database and returns its stored blob.
+func (e *env) commitSample(ctx context.Context) (string, error) {
+	if _, err := e.git(ctx, "add", sampleDB); err != nil {
+		return "", err
+	}
+	if _, err := e.git(ctx, "commit", "-q", "-m", "Add sample database"); err != nil {
+		return "", err
+	}
+	return e.git(ctx, "cat-file", "blob", "HEAD:"+sampleDB)
+}
+
+// checkStatus fails if git sees changes in the worktree.
+func (e *env) checkStatus(ctx context.Context) error {
+	status, err := e.git(ctx, "status", "--porcelain")
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(status) != "" {
+		return fmt.Errorf("worktree not clean:%s", indent(status))
+	}
+	return nil
+}
+
+func roundtrip(ctx context.Context, e *env) error {
+	first, err := e.clean(ctx, e.path(sampleDB))
+	if err != nil {
+		return err
+	}
+	restored, err := e.gitsqlite(ctx, bytes.NewReader(first), "smudge")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(e.path("restored.db"), restored, 0o644); err != nil {
+		return err
+	}
+	if !sqlite.IsDatabaseFile(e.path("restored.db")) {
+		return errors.New("smudge did not write a SQLite database")
+	}
+	second, err := e.clean(ctx, e.path("restored.db"))
+	if err != nil {
+		return err
+	}
+	return sameDump(first, second, "dump of the restored database")
+}
+
+func commit(ctx context.Context, e *env) error {
+	want, err := e.clean(ctx, e.path(sampleDB))
+	if err != nil {
+		return err
+	}
+	blob, err := e.commitSample(ctx)
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(blob, hash.HashPrefix) {
+		return errors.New("the stored blob is not a gitsqlite dump; is the filter applied?")
+	}
+	if err := sameDump(want, []byte(blob), "stored blob"); err != nil {
+		return err
+	}
+	return e.checkStatus(ctx)
+}
+
+func checkout(ctx context.Context, e *env) error {
+	blob, err := e.commitSample(ctx)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(e.path(sampleDB)); err != nil {
+		return err
+	}
+	if _, err := e.git(ctx, "checkout", "--", sampleDB); err != nil {
+		return err
+	}
+	if !sqlite.IsDatabaseFile(e.path(sampleDB)) {
+		return errors.New("checkout did not write a SQLite database")
+	}
+	dump, err := e.clean(ctx, e.path(sampleDB))
+	if err != nil {
+		return err
+	}
+	if err := sameDump([]byte(blob), dump, "dump of the checked out database"); err != nil {
+		return err
+	}
+	return e.checkStatus(ctx)
+}
+
+func diff(ctx context.Context, e *env) error {
+	if _, err := e.commitSample(ctx); err != nil {
+		return err
+	}
+	const marker = "e2e changed row"
+	if _, err := e.eng.Query(ctx, e.path(sampleDB), "INSERT INTO items(name, price) VALUES('"+marker+"', 1.5);"); err != nil {
+		return fmt.Errorf("changing the sample database: %w", err)
+	}
+	out, err := e.git(ctx, "diff")
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(out, "+") || !strings.Contains(out, marker) {
+		return fmt.Errorf("git diff does not show the changed row:%s", indent(out))
+	}
+	if _, err := e.git(ctx, "commit", "-q", "-a", "-m", "Change sample database"); err != nil {
+		return err
+	}
+	if _, err := e.git(ctx, "checkout", "-q", "HEAD~1", "--", sampleDB); err != nil {
+		return err
+	}
+	dump, err := e.clean(ctx, e.path(sampleDB))
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(dump, []byte(marker)) {
+		return errors.New("checking out the previous commit kept the changed row")
+	}
+	return nil
+}
+
+func brokenPipe(ctx context.Context, e *env) error {
+	db, err := os.ReadFile(e.path(sampleDB))
+	if err != nil {
+		return err
+	}
+	sql, err := e.clean(ctx, e.path(sampleDB))
+	if err != nil {
+		return err
+	}
+	for _, run := range []struct {
+		op    string
+		input []byte
+	}{{"clean", db}, {"smudge", sql}} {
+		if err := e.closeEarly(ctx, run.op, run.input); err != nil {
+			return fmt.Errorf("%s: %w", run.op, err)
+		}
+	}
+	return nil
+}
+
+// closeEarly runs op, reads the start of its output and closes the pipe, as
+// git can; op must exit within exitTimeout and remove its temporary files.
+func (e *env) closeEarly(ctx context.Context, op string, input []byte) error {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	cmd := e.cmd(ctx, e.opts.Executable, append(append([]string{}, e.opts.Args...), op)...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Stdout = w
+	if err := cmd.Start(); err != nil {
+		w.Close()
+		return err
+	}
+	w.Close()
+	if _, err := io.ReadFull(r, make([]byte, 4096)); err != nil {
+		return fmt.Errorf("reading the start of the output: %w", err)
+	}
+	r.Close()
+	// Failing, typically with the broken pipe exit code, is expected
+	var exitErr *exec.ExitError
+	if err := waitWithin(cmd, exitTimeout); err != nil && !errors.As(err, &exitErr) {
+		return err
+	}
+	return e.checkTemp()
+}
+
+func stalledInput(ctx context.Context, e *env) error {
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	// The write end stays open without data until the child exits
+	defer w.Close()
+	cmd := e.cmd(ctx, e.opts.Executable, append(append([]string{}, e.opts.Args...), "-read-timeout", "1s", "clean")...)
+	cmd.Stdin = r
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		r.Close()
+		return err
+	}
+	r.Close()
+	err = waitWithin(cmd, exitTimeout)
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		if err == nil {
+			return errors.New("clean succeeded without input")
+		}
+		return err
+	}
+	if code := exitErr.ExitCode(); code != errs.ExitTimeout {
+		return fmt.Errorf("exit code %d, want %d (timeout)%s", code, errs.ExitTimeout, indent(stderr.String()))
+	}
+	return e.checkTemp()
+}
+
+// waitWithin waits for cmd and kills it if it does not exit within timeout.
+// It returns the error of the command, or an error saying that it hung.
+func waitWithin(cmd *exec.Cmd, timeout time.Duration) error {
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+		_ = cmd.Process.Kill()
+		<-done
+		return fmt.Errorf("did not exit within %s (hang)", timeout)
+	}
+}
+
+// sameDump fails with the first differing line if got differs from want.
+func sameDump(want, got []byte, what string) error {
+	if bytes.Equal(want, got) {
+		return nil
+	}
+	wantLines, gotLines := strings.Split(string(want), "\n"), strings.Split(string(got), "\n")
+	for i := 0; i < len(wantLines) || i < len(gotLines); i++ {
+		var w, g string
+		if i < len(wantLines) {
+			w = wantLines[i]
+		}
+		if i < len(gotLines) {
+			g = gotLines[i]
+		}
+		if w != g {
+			return fmt.Errorf("%s differs at line %d:\n  want: %s\n  got:  %s", what, i+1, shorten(w), shorten(g))
+		}
+	}
+	return fmt.Errorf("%s differs", what)
+}
+
+func shorten(s string) string {
+	if len(s) > 120 {
+		return s[:120] + "..."
+	}
+	return s
+}
+
+// indent returns the output of a command as indented lines, cut to a few
+// lines.
+func indent(out string) string {
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	if len(lines) == 1 && lines[0] == "" {
+		return ""
+	}
+	if len(lines) > 10 {
+		lines = append(lines[:10], "...")
+	}
+	return "\n    " + strings.Join(lines, "\n    ")
+}
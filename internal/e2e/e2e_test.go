@@ -0,0 +1,43 @@
+package e2e
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSelect(t *testing.T) {
+	all, err := Select(nil)
+	if err != nil || len(all) != len(Scenarios) {
+		t.Fatalf("Select(nil) = %d scenarios, %v; want all", len(all), err)
+	}
+	some, err := Select([]string{"checkout", "roundtrip"})
+	if err != nil || len(some) != 2 || some[0].Name != "checkout" || some[1].Name != "roundtrip" {
+		t.Fatalf("Select(checkout, roundtrip) = %v, %v", some, err)
+	}
+	if _, err := Select([]string{"nope"}); err == nil {
+		t.Error("unknown scenario accepted")
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	for _, tc := range []struct{ in, want string }{
+		{"/usr/bin/gitsqlite", "/usr/bin/gitsqlite"},
+		{"C:/Program Files/gitsqlite.exe", "'C:/Program Files/gitsqlite.exe'"},
+		{"it's", `'it'\''s'`},
+		{"", "''"},
+	} {
+		if got := shellQuote(tc.in); got != tc.want {
+			t.Errorf("shellQuote(%q) = %s, want %s", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestSameDump(t *testing.T) {
+	if err := sameDump([]byte("a\nb\n"), []byte("a\nb\n"), "dump"); err != nil {
+		t.Errorf("equal dumps: %v", err)
+	}
+	err := sameDump([]byte("a\nb\n"), []byte("a\nc\n"), "dump")
+	if err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("got %v, want a difference at line 2", err)
+	}
+}
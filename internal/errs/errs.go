@@ -0,0 +1,121 @@
+// Package errs defines the kinds of failure gitsqlite reports and the process
+// exit code of each, so scripts wrapping gitsqlite can tell them apart. Errors
+// carry their kind by wrapping a sentinel (see Mark); Code maps any error to
+// its exit code.
+package errs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"syscall"
+)
+
+// Kinds of failure. Test for them with errors.Is.
+var (
+	ErrUsage          = errors.New("invalid usage")
+	ErrSQLiteNotFound = errors.New("sqlite3 not found")
+	ErrFailed         = errors.New("operation failed")
+	ErrCheckFailed    = errors.New("check failed")
+	ErrHashMismatch   = errors.New("hash mismatch")
+	ErrTimeout        = errors.New("timed out")
+	ErrBrokenPipe     = errors.New("broken pipe")
+	ErrRestoreFailed  = errors.New("restore failed")
+	ErrDumpFailed     = errors.New("dump failed")
+	ErrCrash          = errors.New("crashed")
+	ErrInterrupted    = errors.New("interrupted")
+)
+
+// Exit codes of the kinds. They are part of the command line interface and
+// never change meaning.
+const (
+	ExitOK             = 0
+	ExitUsage          = 1   // invalid flags, arguments or configuration
+	ExitSQLiteNotFound = 2   // no usable sqlite3 binary
+	ExitFailed         = 3   // any other failure
+	ExitCheckFailed    = 4   // lint, check-links, verify, doctor or -assert-idempotent found problems
+	ExitHashMismatch   = 5   // the hash trailer is missing or wrong (-verify-hash)
+	ExitTimeout        = 6   // sqlite3 or the reader of the output stopped responding
+	ExitBrokenPipe     = 7   // the reader of the output went away
+	ExitRestoreFailed  = 8   // sqlite3 could not restore the SQL
+	ExitDumpFailed     = 9   // sqlite3 could not read or dump the database
+	ExitCrash          = 10  // gitsqlite panicked (see the crash report)
+	ExitInterrupted    = 130 // stopped by Ctrl+C, SIGTERM or closing the console (128+SIGINT, as shells report it)
+)
+
+// kinds lists the kinds with their exit codes. The first kind an error
+// matches decides, so the cause (an interrupt or a timeout) wins over the
+// operation that failed because of it (a restore).
+var kinds = []struct {
+	kind error
+	code int
+}{
+	{ErrCrash, ExitCrash},
+	{ErrInterrupted, ExitInterrupted},
+	{ErrUsage, ExitUsage},
+	{ErrSQLiteNotFound, ExitSQLiteNotFound},
+	{ErrCheckFailed, ExitCheckFailed},
+	{ErrHashMismatch, ExitHashMismatch},
+	{ErrTimeout, ExitTimeout},
+	{ErrBrokenPipe, ExitBrokenPipe},
+	{ErrRestoreFailed, ExitRestoreFailed},
+	{ErrDumpFailed, ExitDumpFailed},
+}
+
+// marked is an error tagged with a kind.
+type marked struct {
+	err  error
+	kind error
+}
+
+func (m *marked) Error() string        { return m.err.Error() }
+func (m *marked) Unwrap() error        { return m.err }
+func (m *marked) Is(target error) bool { return target == m.kind }
+
+// Mark returns err tagged with kind, so that errors.Is(err, kind) holds. The
+// message is unchanged. Mark(nil, kind) is nil.
+func Mark(err error, kind error) error {
+	if err == nil {
+		return nil
+	}
+	return &marked{err: err, kind: kind}
+}
+
+// Kind returns the kind of err, ErrFailed if it has none, or nil for nil.
+// Besides marked errors, canceled contexts (gitsqlite cancels its context only
+// when interrupted), timeouts of contexts and deadlines and writes to a closed
+// pipe are recognized.
+func Kind(err error) error {
+	if err == nil {
+		return nil
+	}
+	for _, k := range kinds {
+		if errors.Is(err, k.kind) {
+			return k.kind
+		}
+	}
+	switch {
+	case errors.Is(err, context.Canceled):
+		return ErrInterrupted
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded):
+		return ErrTimeout
+	case errors.Is(err, syscall.EPIPE), errors.Is(err, io.ErrClosedPipe), isBrokenPipe(err):
+		return ErrBrokenPipe
+	}
+	return ErrFailed
+}
+
+// Code returns the exit code for err, ExitOK for nil.
+func Code(err error) int {
+	kind := Kind(err)
+	if kind == nil {
+		return ExitOK
+	}
+	for _, k := range kinds {
+		if k.kind == kind {
+			return k.code
+		}
+	}
+	return ExitFailed
+}
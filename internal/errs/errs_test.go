@@ -0,0 +1,43 @@
+package errs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"syscall"
+	"testing"
+)
+
+func TestCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"nil", nil, ExitOK},
+		{"plain", errors.New("boom"), ExitFailed},
+		{"marked", Mark(errors.New("bad hash"), ErrHashMismatch), ExitHashMismatch},
+		{"wrapped", fmt.Errorf("smudge: %w", Mark(errors.New("bad hash"), ErrHashMismatch)), ExitHashMismatch},
+		{"deadline", fmt.Errorf("dump: %w", context.DeadlineExceeded), ExitTimeout},
+		{"epipe", fmt.Errorf("write: %w", syscall.EPIPE), ExitBrokenPipe},
+		// The cause wins over the operation
+		{"timeout in restore", Mark(Mark(errors.New("killed"), ErrTimeout), ErrRestoreFailed), ExitTimeout},
+		{"canceled", fmt.Errorf("dump: %w", context.Canceled), ExitInterrupted},
+		{"interrupted restore", Mark(Mark(errors.New("killed"), ErrInterrupted), ErrRestoreFailed), ExitInterrupted},
+	}
+	for _, tt := range tests {
+		if got := Code(tt.err); got != tt.want {
+			t.Errorf("%s: Code(%v) = %d, want %d", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestMarkKeepsMessage(t *testing.T) {
+	err := Mark(errors.New("sqlite3 not found"), ErrSQLiteNotFound)
+	if err.Error() != "sqlite3 not found" || !errors.Is(err, ErrSQLiteNotFound) {
+		t.Errorf("Mark() = %q, errors.Is = %v", err, errors.Is(err, ErrSQLiteNotFound))
+	}
+	if Mark(nil, ErrFailed) != nil {
+		t.Error("Mark(nil) != nil")
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !windows
+
+package errs
+
+// isBrokenPipe reports whether err is a platform specific broken pipe error;
+// elsewhere writes to a closed pipe fail with EPIPE.
+func isBrokenPipe(err error) bool {
+	return false
+}
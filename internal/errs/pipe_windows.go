@@ -0,0 +1,15 @@
+//go:build windows
+
+package errs
+
+import (
+	"errors"
+
+	"golang.org/x/sys/windows"
+)
+
+// isBrokenPipe reports whether err is the error Windows returns for writes
+// to a pipe whose reader has closed it.
+func isBrokenPipe(err error) bool {
+	return errors.Is(err, windows.ERROR_NO_DATA) || errors.Is(err, windows.ERROR_BROKEN_PIPE)
+}
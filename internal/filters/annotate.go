@@ -0,0 +1,124 @@
+package filters
+
+import (
+	"fmt"
+	"strings"
+)
+
+// RowCountPrefix starts the row-count annotation emitted by -annotate-counts.
+// It is an SQL comment, so smudge ignores it.
+const RowCountPrefix = "-- rows: "
+
+// rowCounter tracks the data section of the table currently being dumped and
+// produces a row-count annotation when the section ends.
+type rowCounter struct {
+	table     string
+	rows      int
+	active    bool
+	withEmpty bool // annotate tables without rows (only useful when schema is emitted)
+}
+
+// observe returns the annotation to emit before stmt, or "".
+func (c *rowCounter) observe(stmt string) string {
+	trimmed := strings.TrimSpace(stmt)
+	switch {
+	case strings.HasPrefix(trimmed, "CREATE TABLE"):
+		annotation := c.flush()
+		if ct, err := ParseCreateTable(trimmed); err == nil {
+			c.table, c.rows, c.active = strings.ToLower(ct.TableName()), 0, true
+		}
+		return annotation
+	case strings.HasPrefix(trimmed, "INSERT INTO"):
+		table := strings.ToLower(InsertTableName(trimmed))
+		if c.active && c.table == table {
+			c.rows++
+			return ""
+		}
+		annotation := c.flush()
+		c.table, c.rows, c.active = table, 1, true
+		return annotation
+	}
+	return c.flush()
+}
+
+// flush ends the current section and returns its annotation, or "".
+func (c *rowCounter) flush() string {
+	if !c.active {
+		return ""
+	}
+	c.active = false
+	if c.rows == 0 && !c.withEmpty {
+		return ""
+	}
+	return fmt.Sprintf("%s%d", RowCountPrefix, c.rows)
+}
+
+// InsertTableName returns the unquoted table name of an INSERT statement
+// without tokenizing the (potentially very long) VALUES part. All forms are
+// recognized: INSERT INTO, INSERT OR <action> INTO and REPLACE INTO, in any
+// case and with a schema qualifier, as third-party export tools write them.
+// It returns "" for any other statement.
+func InsertTableName(stmt string) string {
+	stmt = strings.TrimSpace(stmt)
+	if !strings.HasPrefix(stmt, "INSERT INTO") {
+		return insertTarget(stmt)
+	}
+	rest := strings.TrimSpace(strings.TrimPrefix(stmt, "INSERT INTO"))
+	if rest == "" {
+		return ""
+	}
+	end := len(rest)
+	switch rest[0] {
+	case '"', '`':
+		end = skipQuoted(rest, 0, rest[0])
+	case '[':
+		if i := strings.IndexByte(rest, ']'); i >= 0 {
+			end = i + 1
+		}
+	case '\'':
+		return insertTarget(stmt)
+	default:
+		if i := strings.IndexAny(rest, " (\t."); i >= 0 {
+			end = i
+		}
+	}
+	if end < len(rest) && rest[end] == '.' {
+		return insertTarget(stmt)
+	}
+	return UnquoteIdent(rest[:end])
+}
+
+// insertTarget is InsertTableName for the statements not written by sqlite3
+// .dump, reading their leading tokens.
+func insertTarget(stmt string) string {
+	next := leadingTokens(stmt)
+	word := next()
+	switch {
+	case word.Is("INSERT"):
+		if word = next(); word.Is("OR") {
+			next() // the conflict action
+			word = next()
+		}
+	case word.Is("REPLACE"):
+		word = next()
+	default:
+		return ""
+	}
+	if !word.Is("INTO") {
+		return ""
+	}
+	name := next()
+	if dot := next(); dot.Text == "." {
+		name = next()
+	}
+	switch name.Kind {
+	case TokenWord, TokenQuotedIdent:
+		return UnquoteIdent(name.Text)
+	case TokenString:
+		if len(name.Text) < 2 {
+			return ""
+		}
+		return strings.ReplaceAll(name.Text[1:len(name.Text)-1], "''", "'")
+	}
+	return ""
+}
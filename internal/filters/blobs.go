@@ -0,0 +1,205 @@
+package filters
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DefaultBlobDir is the directory externalized BLOBs are stored in, relative
+// to the repository root (where git runs the filters).
+const DefaultBlobDir = ".gitsqlite/blobs"
+
+// blobFunc names the pointer that replaces an externalized BLOB in the dump:
+//
+//	gitsqlite_blob('sha256:<64 hex digits>',<size in bytes>)
+//
+// It reads like a function call, so a dump restored without resolving it
+// fails loudly instead of storing the pointer.
+const blobFunc = "gitsqlite_blob"
+
+// blobPointer matches a pointer. It cannot match inside a string literal:
+// there the quote after the parenthesis would be doubled.
+var blobPointer = regexp.MustCompile(blobFunc + `\('sha256:([0-9a-f]{64})',([0-9]+)\)`)
+
+// blobPath returns the file holding the BLOB with the hex SHA-256 sum in dir,
+// fanned out by the first two digits like git's objects.
+func blobPath(dir, sum string) string {
+	return filepath.Join(dir, sum[:2], sum)
+}
+
+// blobExternalizer replaces BLOB literals larger than threshold bytes in
+// INSERT statements with pointers and stores their bytes in dir. With an
+// empty dir only the pointers are written (for diff).
+type blobExternalizer struct {
+	threshold int64
+	dir       string
+	replaced  int
+	stored    int
+}
+
+func newBlobExternalizer(threshold int64, dir string) *blobExternalizer {
+	return &blobExternalizer{threshold: threshold, dir: dir}
+}
+
+// apply returns stmt with the large BLOB literals replaced by pointers.
+func (b *blobExternalizer) apply(stmt string) (string, error) {
+	// X'..' holds two hex digits per byte
+	if b.threshold <= 0 || int64(len(stmt)) < 2*b.threshold || !strings.Contains(stmt, "X'") {
+		return stmt, nil
+	}
+	if ClassifyStatement(stmt) != StatementData {
+		return stmt, nil
+	}
+	tokens := Tokenize(stmt)
+	changed := false
+	for i, tok := range tokens {
+		if tok.Kind != TokenBlob || int64(len(tok.Text)-3) <= 2*b.threshold {
+			continue
+		}
+		data, err := hex.DecodeString(tok.Text[2 : len(tok.Text)-1])
+		if err != nil {
+			continue
+		}
+		sum := sha256.Sum256(data)
+		digest := hex.EncodeToString(sum[:])
+		if err := b.store(digest, data); err != nil {
+			return "", err
+		}
+		tokens[i] = Token{Kind: TokenWord, Text: fmt.Sprintf("%s('sha256:%s',%d)", blobFunc, digest, len(data))}
+		b.replaced++
+		changed = true
+	}
+	if !changed {
+		return stmt, nil
+	}
+	var out strings.Builder
+	for _, tok := range tokens {
+		out.WriteString(tok.Text)
+	}
+	return out.String(), nil
+}
+
+// store writes data to the blob directory unless it is already there. The
+// file is written under a temporary name and renamed, so a concurrent or
+// interrupted clean never leaves a truncated blob behind.
+func (b *blobExternalizer) store(digest string, data []byte) error {
+	if b.dir == "" {
+		return nil
+	}
+	path := blobPath(b.dir, digest)
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("cannot create blob directory: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".blob-*")
+	if err != nil {
+		return fmt.Errorf("cannot store blob: %w", err)
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("cannot store blob %s: %w", digest, err)
+	}
+	b.stored++
+	return nil
+}
+
+// report logs how many BLOBs were externalized.
+func (b *blobExternalizer) report() {
+	if b.replaced > 0 {
+		slog.Info("Externalized BLOBs", "pointers", b.replaced, "stored", b.stored, "dir", b.dir)
+	}
+}
+
+// blobResolver replaces the BLOB pointers in a dump with the BLOB literals
+// read from dir, line by line.
+type blobResolver struct {
+	r        *bufio.Reader
+	dir      string
+	pending  []byte
+	err      error
+	resolved int
+}
+
+// ResolveBlobs returns a reader of the dump from r with the pointers written
+// by clean -blob-threshold replaced by the BLOBs stored in dir. A BLOB that
+// is missing or does not match its hash fails the read.
+func ResolveBlobs(r io.Reader, dir string) io.Reader {
+	return &blobResolver{r: bufio.NewReaderSize(r, 64*1024), dir: dir}
+}
+
+func (b *blobResolver) Read(p []byte) (int, error) {
+	for len(b.pending) == 0 {
+		if b.err != nil {
+			if b.err == io.EOF && b.resolved > 0 {
+				slog.Info("Resolved BLOB pointers", "count", b.resolved, "dir", b.dir)
+				b.resolved = 0
+			}
+			return 0, b.err
+		}
+		line, err := b.r.ReadString('\n')
+		b.err = err
+		if strings.Contains(line, blobFunc) {
+			if line, err = b.resolve(line); err != nil {
+				b.err = err
+			}
+		}
+		b.pending = []byte(line)
+	}
+	n := copy(p, b.pending)
+	b.pending = b.pending[n:]
+	return n, nil
+}
+
+// resolve replaces the pointers in line.
+func (b *blobResolver) resolve(line string) (string, error) {
+	var resolveErr error
+	line = blobPointer.ReplaceAllStringFunc(line, func(pointer string) string {
+		m := blobPointer.FindStringSubmatch(pointer)
+		data, err := b.load(m[1], m[2])
+		if err != nil {
+			if resolveErr == nil {
+				resolveErr = err
+			}
+			return pointer
+		}
+		b.resolved++
+		return "X'" + hex.EncodeToString(data) + "'"
+	})
+	return line, resolveErr
+}
+
+// load reads the BLOB with the hex SHA-256 digest and the decimal size and
+// checks both.
+func (b *blobResolver) load(digest, size string) ([]byte, error) {
+	path := blobPath(b.dir, digest)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("blob sha256:%s not found in %s; commit the blob directory with the database, or fetch it (e.g. git lfs pull)", digest, b.dir)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(data)
+	if want, _ := strconv.Atoi(size); len(data) != want || hex.EncodeToString(sum[:]) != digest {
+		return nil, fmt.Errorf("blob %s is damaged: its content does not match sha256:%s", path, digest)
+	}
+	return data, nil
+}
@@ -0,0 +1,87 @@
+package filters
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// The dump of clean runs on a time budget rather than a fixed timeout: a
+// base, an allowance for every MiB of the database, and one for every table
+// the dump reaches. A large database that keeps making progress completes,
+// while a dump stuck on one table times out once the time it earned is used
+// up.
+const (
+	dumpBudgetBase     = 60 * time.Second
+	dumpBudgetPerMiB   = time.Second
+	dumpBudgetPerTable = 5 * time.Second
+)
+
+// dumpBudget cancels the context of a dump when its budget is used up.
+type dumpBudget struct {
+	mu       sync.Mutex
+	timer    *time.Timer
+	deadline time.Time
+	granted  time.Duration
+	perTable time.Duration
+	cancel   context.CancelCauseFunc
+	ctx      context.Context
+}
+
+// newDumpBudget returns a context for dumping a database of size bytes,
+// canceled with a cause wrapping context.DeadlineExceeded when the budget is
+// used up, and the budget; stop it when the dump is done.
+func newDumpBudget(ctx context.Context, size int64) (context.Context, *dumpBudget) {
+	return startBudget(ctx, dumpBudgetBase+time.Duration((max(size, 0)+1<<20-1)>>20)*dumpBudgetPerMiB, dumpBudgetPerTable)
+}
+
+// startBudget returns a context canceled after initial plus perTable for
+// every table, and the budget.
+func startBudget(ctx context.Context, initial, perTable time.Duration) (context.Context, *dumpBudget) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	b := &dumpBudget{deadline: time.Now().Add(initial), granted: initial, perTable: perTable, cancel: cancel, ctx: ctx}
+	b.timer = time.AfterFunc(initial, b.expire)
+	return ctx, b
+}
+
+// expire cancels the dump unless tables granted it more time meanwhile.
+func (b *dumpBudget) expire() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if left := time.Until(b.deadline); left > 0 {
+		b.timer.Reset(left)
+		return
+	}
+	b.cancel(fmt.Errorf("dump exceeded its time budget of %s: %w", b.granted.Round(time.Second), context.DeadlineExceeded))
+}
+
+// table grants the allowance of a table the dump reached.
+func (b *dumpBudget) table() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	b.deadline = b.deadline.Add(b.perTable)
+	b.granted += b.perTable
+	b.mu.Unlock()
+}
+
+// explain returns err, the error of the dump, as the timeout it is if the
+// budget was used up, rather than the cancellation it looks like.
+func (b *dumpBudget) explain(err error) error {
+	if err == nil || b == nil {
+		return err
+	}
+	if cause := context.Cause(b.ctx); errors.Is(cause, context.DeadlineExceeded) && !errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%w (%v)", cause, err)
+	}
+	return err
+}
+
+// stop ends the budget and releases its context.
+func (b *dumpBudget) stop() {
+	b.timer.Stop()
+	b.cancel(nil)
+}
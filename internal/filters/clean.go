@@ -7,26 +7,41 @@ import (
 	"os"
 	"time"
 
+	"github.com/danielsiegl/gitsqlite/internal/compression"
 	"github.com/danielsiegl/gitsqlite/internal/hash"
 	"github.com/danielsiegl/gitsqlite/internal/logging"
+	"github.com/danielsiegl/gitsqlite/internal/shutdown"
 	"github.com/danielsiegl/gitsqlite/internal/sqlite"
+	"github.com/danielsiegl/gitsqlite/internal/warnings"
 )
 
 // Clean reads a binary SQLite DB from 'in', dumps SQL via sqlite engine using
 // selective table dumping to exclude sqlite_sequence, and writes SQL to 'out'.
 // using temporary file for robustness, pipelining would be more efficient - but it has to survive ~500mb files
-// If dataOnly is true, only data (INSERT statements) are output to 'out'.
-// If schemaOutput is not empty, schema is saved to that file.
-func Clean(ctx context.Context, eng *sqlite.Engine, in io.Reader, out io.Writer, floatPrecision int, dataOnly bool, schemaOutput string) error {
+// If opts.DataOnly is true, only data (INSERT statements) are output to 'out'.
+// If opts.SchemaOutput is not empty, schema is saved to that file.
+// If opts.SourcePath names the worktree file, its -wal/-journal sidecars are
+// handled according to opts.Sidecars. A database in WAL mode is checkpointed
+// before it is dumped.
+// If opts.Compress is set, the output (but not the schema file) is compressed.
+// Unless opts.UpgradeFormat is set, the format version (unless
+// opts.FormatVersion pins one) and the quirks of an older release found in
+// the dump of opts.SourcePath in the git index are kept (see Quirks).
+func Clean(ctx context.Context, eng *sqlite.Engine, in io.Reader, out io.Writer, opts Options) error {
 	startTime := time.Now()
 	slog.Info("Starting clean operation")
 
+	if err := checkFreeSpace("", cleanSpaceNeeded(opts), "the temporary copy of the database"); err != nil {
+		slog.Error("Disk space preflight failed", "error", err)
+		return err
+	}
+
 	tmp, err := os.CreateTemp("", "gitsqlite-*.db")
 	if err != nil {
 		slog.Error("Failed to create temp file", "error", err)
 		return err
 	}
-	defer os.Remove(tmp.Name())
+	defer shutdown.Remove(tmp.Name())()
 
 	copyStart := time.Now()
 	if _, err := io.Copy(tmp, in); err != nil {
@@ -36,68 +51,226 @@ func Clean(ctx context.Context, eng *sqlite.Engine, in io.Reader, out io.Writer,
 	}
 	copyDuration := time.Since(copyStart)
 	slog.Info("Copied input to temp file", "duration", logging.FormatDuration(copyDuration))
+	opts.Summary.Stage("copy", copyDuration)
 
 	if err := tmp.Close(); err != nil {
 		slog.Error("Failed to close temp file", "error", err)
 		return err
 	}
 
+	// Fold journal files of the worktree database (passed by git as %f) into the snapshot
+	removeSidecars, err := applySidecars(opts.SourcePath, tmp.Name(), opts.Sidecars)
+	if err != nil {
+		slog.Error("Failed to handle sidecar files", "error", err)
+		return err
+	}
+	defer removeSidecars()
+
+	// A database cleaned before with the same settings is not dumped again.
+	// Journal files folded into the copy are not part of the input
+	var cacheKey string
+	var cacheEntry *os.File
+	var recorded func() []warnings.Warning
+	if opts.Cache != nil && fileSize(tmp.Name()+"-wal") == 0 && fileSize(tmp.Name()+"-journal") == 0 {
+		cacheKey = cleanKey(ctx, eng, tmp.Name(), opts)
+	}
+	if cacheKey != "" {
+		if cached, replay := opts.Cache.open(cacheKey); cached != nil {
+			defer cached.Close()
+			if _, err := io.Copy(out, cached); err != nil {
+				slog.Error("Failed to copy cached output", "file", cached.Name(), "error", err)
+				return err
+			}
+			// Report the data as the run that dumped it did
+			replay.replay(opts)
+			slog.Info("Clean operation served from cache", "key", cacheKey,
+				"totalDuration", logging.FormatDuration(time.Since(startTime)))
+			return nil
+		}
+		if cacheEntry, err = opts.Cache.create(); err != nil {
+			slog.Warn("Cannot write to the clean cache", "error", err)
+		} else {
+			defer shutdown.Remove(cacheEntry.Name())()
+			defer cacheEntry.Close()
+			out = io.MultiWriter(out, cacheEntry)
+			opts.replay = &cleanReplay{}
+			recorded = warnings.Record()
+			defer recorded()
+		}
+	}
+
+	// Checkpoint a database in WAL mode into the snapshot file, so that the
+	// dump holds the transactions still in the WAL and the sqlite3 processes
+	// dumping it need no -wal or -shm files
+	if sqlite.IsWAL(tmp.Name()) {
+		if err := eng.SetJournalMode(ctx, tmp.Name(), sqlite.JournalDelete); err != nil {
+			slog.Error("Failed to checkpoint WAL database", "error", err)
+			return err
+		}
+		slog.Info("Checkpointed WAL database before dumping")
+	}
+
+	dbPath := tmp.Name()
+	if opts.Vacuum {
+		vacuumStart := time.Now()
+		vacuumed, err := vacuumSnapshot(ctx, eng, dbPath)
+		if vacuumed != "" {
+			defer shutdown.Remove(vacuumed)()
+		}
+		if err != nil {
+			slog.Error("VACUUM INTO failed", "error", err)
+			return err
+		}
+		dbPath = vacuumed
+		opts.Summary.Stage("vacuum", time.Since(vacuumStart))
+	}
+
+	checkVersionDrift(ctx, eng, dbPath)
+
 	// Use SQLite native selective dumping instead of post-processing filter
 	dumpStart := time.Now()
 
-	// Create a cancelable context for the dump operation
-	dumpCtx, dumpCancel := context.WithTimeout(ctx, 60*time.Second)
-	defer dumpCancel()
+	// The dump may take longer the larger the database is and the more
+	// tables it gets through
+	dumpCtx, budget := newDumpBudget(ctx, fileSize(dbPath))
+	defer budget.stop()
 
-	slog.Info("Starting SQLite selective dump", "dbPath", tmp.Name())
+	slog.Info("Starting SQLite selective dump", "dbPath", dbPath)
+
+	// Keep the format of the dump committed before
+	var legacy Quirks
+	if !opts.UpgradeFormat {
+		legacy = indexQuirks(ctx, opts.SourcePath, opts.DictDir)
+	}
+	opts.FormatVersion = negotiateFormat(opts.FormatVersion, legacy.Format)
+	slog.Debug("Dump format", "version", opts.FormatVersion)
 
-	// Save schema to separate file if requested
-	if schemaOutput != "" {
-		schemaFile, err := os.Create(schemaOutput)
+	// Save schema to separate file if requested. It replaces the previous
+	// one only if the data is dumped too, so the two always match; git
+	// discards the output of a failed clean
+	var schemaFile *stagedFile
+	var schemaHash string
+	if opts.SchemaOutput != "" {
+		schemaFile, err = stageFile(opts.SchemaOutput)
 		if err != nil {
-			slog.Error("Failed to create schema output file", "file", schemaOutput, "error", err)
+			slog.Error("Failed to create schema output file", "file", opts.SchemaOutput, "error", err)
 			return err
 		}
-		defer schemaFile.Close()
+		defer schemaFile.discard()
 
 		// Wrap schema output with hash writer
 		schemaHashWriter := hash.NewHashWriter(schemaFile)
 
-		if err := DumpSchema(dumpCtx, eng, tmp.Name(), schemaHashWriter); err != nil {
+		if err := DumpSchema(dumpCtx, eng, dbPath, schemaHashWriter, opts); err != nil {
+			err = budget.explain(err)
 			slog.Error("Schema dump failed", "error", err)
 			return err
 		}
 
 		// Append hash to schema file
+		schemaHash = schemaHashWriter.GetHash()
 		if _, err := schemaFile.WriteString(schemaHashWriter.GetHashComment()); err != nil {
 			slog.Error("Failed to write schema hash", "error", err)
 			return err
 		}
-
-		slog.Info("Schema saved to file with hash", "file", schemaOutput)
 	}
 
 	// Use the new selective dumping method that excludes sqlite_sequence natively
 	// This now uses the logical filtering function from the filters package
 	// When schema is saved to a separate file, only output data to stdout
-	outputDataOnly := dataOnly || (schemaOutput != "")
+	dumpOpts := opts
+	dumpOpts.DataOnly = opts.DataOnly || (opts.SchemaOutput != "")
+	dumpOpts.legacy = legacy
+
+	// The hash covers the SQL, so it stays valid inside the compressed stream
+	var compressed io.WriteCloser
+	if opts.Compress != "" {
+		if compressed, err = compression.NewWriter(out, opts.Compress, opts.DictDir, InsertTableName); err != nil {
+			slog.Error("Failed to start compressed output", "format", opts.Compress, "error", err)
+			return err
+		}
+		out = compressed
+	}
 
 	// Wrap output with hash writer to compute hash of SQL content
 	hashWriter := hash.NewHashWriter(out)
+	if opts.TableHashes {
+		dumpOpts.tableHashes = hash.NewTableHasher()
+	}
+	dumpOpts.budget = budget
+	// Other formats are written from the same dump
+	if dumpOpts.sinks, err = openSinks(opts.Sinks); err != nil {
+		slog.Error("Failed to create sink file", "error", err)
+		return err
+	}
+	defer dumpOpts.sinks.discard()
 
-	if err := DumpTables(dumpCtx, eng, tmp.Name(), hashWriter, floatPrecision, outputDataOnly); err != nil {
+	if err := DumpTables(dumpCtx, eng, dbPath, hashWriter, dumpOpts); err != nil {
+		err = budget.explain(err)
 		slog.Error("SQLite selective dump failed", "error", err)
 		return err
 	}
 
+	// Link the data to the schema file written with it (see CheckSplit),
+	// unless the indexed dump was written before the link was
+	if schemaFile != nil {
+		if legacy.NoSchemaLink {
+			slog.Info("Keeping the data without the schema hash of an older gitsqlite release (use -upgrade-format to write it)", "path", opts.SourcePath)
+		} else if _, err := hashWriter.Write([]byte(hash.SchemaPrefix + schemaHash + "\n")); err != nil {
+			slog.Error("Failed to write schema hash", "error", err)
+			return err
+		}
+	}
+
+	// Table hashes are covered by the hash of the whole file
+	if dumpOpts.tableHashes != nil {
+		if _, err := hashWriter.Write([]byte(dumpOpts.tableHashes.Comments())); err != nil {
+			slog.Error("Failed to write table hashes", "error", err)
+			return err
+		}
+	}
+
 	// Append hash comment to output
-	if _, err := out.Write([]byte(hashWriter.GetHashComment())); err != nil {
-		slog.Error("Failed to write hash comment", "error", err)
+	if !dumpOpts.legacy.NoHash {
+		if _, err := out.Write([]byte(hashWriter.GetHashComment())); err != nil {
+			slog.Error("Failed to write hash comment", "error", err)
+			return err
+		}
+	}
+	if compressed != nil {
+		if err := compressed.Close(); err != nil {
+			slog.Error("Failed to finish compressed output", "format", opts.Compress, "error", err)
+			return err
+		}
+	}
+	primary := sinkOutput{Path: "-", Format: opts.DataFormat}
+	if !dumpOpts.legacy.NoHash {
+		primary.Hash = hashWriter.GetHash()
+	}
+	if err := dumpOpts.sinks.publish(dumpOpts, primary, dumpOpts.legacy.NoHash); err != nil {
+		slog.Error("Failed to write sinks", "error", err)
 		return err
 	}
+	if schemaFile != nil {
+		if err := schemaFile.publish(); err != nil {
+			slog.Error("Failed to save schema file", "file", opts.SchemaOutput, "error", err)
+			return err
+		}
+		slog.Info("Schema saved to file with hash", "file", opts.SchemaOutput)
+	}
+
+	if cacheEntry != nil {
+		opts.replay.Warnings = recorded()
+		if err := opts.Cache.store(cacheEntry, cacheKey, opts.replay); err != nil {
+			slog.Warn("Failed to store output in the clean cache", "error", err)
+		} else {
+			slog.Info("Stored output in the clean cache", "key", cacheKey)
+		}
+	}
 
 	dumpDuration := time.Since(dumpStart)
 	totalDuration := time.Since(startTime)
+	opts.Summary.Stage("dump", dumpDuration)
 
 	slog.Info("Clean operation completed with hash",
 		"totalDuration", logging.FormatDuration(totalDuration),
@@ -106,3 +279,40 @@ func Clean(ctx context.Context, eng *sqlite.Engine, in io.Reader, out io.Writer,
 
 	return nil
 }
+
+// cleanSpaceNeeded estimates the temporary space clean needs: the size of the
+// input, or else of the worktree database git passes as %f, plus any journal
+// files folded into the copy, twice with -vacuum, which writes a second copy
+// at most as large.
+func cleanSpaceNeeded(opts Options) int64 {
+	need := opts.InputSize
+	if need <= 0 && opts.SourcePath != "" {
+		need = fileSize(opts.SourcePath)
+	}
+	if need > 0 && opts.SourcePath != "" && opts.Sidecars == SidecarFold {
+		need += fileSize(opts.SourcePath+"-wal") + fileSize(opts.SourcePath+"-journal")
+	}
+	if opts.Vacuum {
+		need *= 2
+	}
+	return need
+}
+
+// vacuumSnapshot writes a compacted copy of the database at dbPath with VACUUM
+// INTO and returns its path, also on failure if the file was created. The
+// copy is rebuilt page by page like a fresh restore, so its dump does not
+// depend on free pages, fragmentation or an interrupted write of the input.
+func vacuumSnapshot(ctx context.Context, eng *sqlite.Engine, dbPath string) (string, error) {
+	f, err := os.CreateTemp("", "gitsqlite-vacuum-*.db")
+	if err != nil {
+		return "", err
+	}
+	// VACUUM INTO accepts an existing file only if it is empty
+	_ = f.Close()
+	start := time.Now()
+	if err := eng.VacuumInto(ctx, dbPath, f.Name()); err != nil {
+		return f.Name(), err
+	}
+	slog.Info("Vacuumed database before dumping", "path", f.Name(), "size", fileSize(f.Name()), "duration", logging.FormatDuration(time.Since(start)))
+	return f.Name(), nil
+}
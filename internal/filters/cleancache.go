@@ -0,0 +1,248 @@
+package filters
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/danielsiegl/gitsqlite/internal/compression"
+	"github.com/danielsiegl/gitsqlite/internal/gitdir"
+	"github.com/danielsiegl/gitsqlite/internal/sqlite"
+	"github.com/danielsiegl/gitsqlite/internal/version"
+	"github.com/danielsiegl/gitsqlite/internal/warnings"
+)
+
+// DefaultCleanCacheSize is the size the entries of a CleanCache are pruned
+// to unless MaxSize is set.
+const DefaultCleanCacheSize = 1 << 30
+
+// CleanCache holds the output of clean under <git-dir>/gitsqlite/cache, keyed
+// by the SHA-256 of the database and of everything else the dump depends on,
+// so that cleaning an unchanged database again, as git status and rebases
+// do, copies the stored output instead of running sqlite3.
+type CleanCache struct {
+	// Dir is the directory the outputs are stored in.
+	Dir string
+	// MaxSize bounds the size of all outputs; the least recently used ones
+	// are removed first. DefaultCleanCacheSize if 0.
+	MaxSize int64
+}
+
+// OpenCleanCache returns the clean cache of the repository containing the
+// current working directory.
+func OpenCleanCache(ctx context.Context) (*CleanCache, error) {
+	dir, err := gitdir.Dir(ctx, "cache")
+	if err != nil {
+		return nil, err
+	}
+	return &CleanCache{Dir: dir}, nil
+}
+
+// cleanKey returns the key of the output of cleaning the database at dbPath
+// with eng and opts, or "" if the output depends on more than the key covers:
+// attached databases, or files written besides it (see Sinks). The dump of
+// opts.SourcePath in the git index, whose format clean keeps, is covered by
+// its blob id, which is cheaper to get than its quirks.
+func cleanKey(ctx context.Context, eng *sqlite.Engine, dbPath string, opts Options) string {
+	if len(eng.Attach) > 0 || opts.SchemaOutput != "" || opts.BlobThreshold > 0 || len(opts.Sinks) > 0 {
+		return ""
+	}
+	h := sha256.New()
+	f, err := os.Open(dbPath)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	if _, err := io.Copy(h, f); err != nil {
+		return ""
+	}
+	fmt.Fprintf(h, "\n%s %s\n", version.Version, version.GitCommit)
+	// Development builds share their version
+	if exe, err := os.Executable(); err == nil {
+		fmt.Fprintln(h, fileStamp(exe))
+	}
+	if eng.Embedded {
+		fmt.Fprintln(h, sqlite.EmbeddedPath)
+	} else {
+		bin, err := eng.GetBinPath(ctx)
+		if err != nil {
+			return ""
+		}
+		fmt.Fprintln(h, fileStamp(bin))
+	}
+	for _, x := range eng.Extensions {
+		fmt.Fprintln(h, fileStamp(x.Path), x.EntryPoint)
+	}
+	if opts.Compress == compression.Zstd {
+		dicts, err := compression.OpenDicts(opts.DictDir)
+		if err != nil {
+			return ""
+		}
+		fmt.Fprintln(h, dicts)
+	}
+	if !opts.UpgradeFormat {
+		fmt.Fprintln(h, indexBlob(ctx, opts.SourcePath))
+	}
+	// Leave out what only locates or reports the run
+	settings := opts
+	settings.SourcePath, settings.InputSize, settings.Sidecars = "", 0, ""
+	settings.Progress, settings.Summary, settings.Cache = nil, nil, nil
+	settings.tableHashes, settings.budget, settings.replay = nil, nil, nil
+	fmt.Fprintf(h, "%+v\n", settings)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// fileStamp identifies the version of the file at path by its size and
+// modification time.
+func fileStamp(path string) string {
+	info, err := os.Stat(path)
+	if err != nil {
+		return path
+	}
+	return fmt.Sprintf("%s %d %d", path, info.Size(), info.ModTime().UnixNano())
+}
+
+// cleanReplay is what a clean run reports besides its output. It is stored
+// with the output in the clean cache, and reported again by the runs served
+// from there.
+type cleanReplay struct {
+	// Warnings are the warnings about the data, emitted after the cache
+	// was looked up.
+	Warnings []warnings.Warning `json:"warnings,omitempty"`
+	// Rows is the number of rows of the user tables dumped.
+	Rows int64 `json:"rows"`
+}
+
+// addRows counts n rows dumped; it does nothing on a nil replay.
+func (r *cleanReplay) addRows(n int64) {
+	if r != nil {
+		r.Rows += n
+	}
+}
+
+// replay emits the warnings again and records the rows in opts.Summary.
+func (r *cleanReplay) replay(opts Options) {
+	for _, w := range r.Warnings {
+		warnings.Emit(w.ID, "%s", w.Message)
+	}
+	opts.Summary.Rows(r.Rows)
+}
+
+// file returns the file holding the output stored under key.
+func (c *CleanCache) file(key string) string {
+	return filepath.Join(c.Dir, key+".out")
+}
+
+// replayFile returns the file holding the cleanReplay stored under key.
+func (c *CleanCache) replayFile(key string) string {
+	return filepath.Join(c.Dir, key+".json")
+}
+
+// open returns the output and the replay stored under key, or nil if there
+// are none.
+func (c *CleanCache) open(key string) (*os.File, *cleanReplay) {
+	data, err := os.ReadFile(c.replayFile(key))
+	if err != nil {
+		return nil, nil
+	}
+	replay := &cleanReplay{}
+	if err := json.Unmarshal(data, replay); err != nil {
+		return nil, nil
+	}
+	f, err := os.Open(c.file(key))
+	if err != nil {
+		return nil, nil
+	}
+	// Mark the entry as used, for pruning
+	now := time.Now()
+	_ = os.Chtimes(f.Name(), now, now)
+	return f, replay
+}
+
+// create returns a temporary file in the cache the output is written to
+// before it is stored with store.
+func (c *CleanCache) create() (*os.File, error) {
+	if err := os.MkdirAll(c.Dir, 0o755); err != nil {
+		return nil, err
+	}
+	return os.CreateTemp(c.Dir, "*.tmp")
+}
+
+// store closes f, written by create, keeps it as the output stored under key
+// together with replay, and prunes the cache.
+func (c *CleanCache) store(f *os.File, key string, replay *cleanReplay) error {
+	if err := f.Close(); err != nil {
+		return err
+	}
+	data, err := json.Marshal(replay)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(c.replayFile(key), data, 0o644); err != nil {
+		return err
+	}
+	// Renaming never leaves a partial output under the key
+	if err := os.Rename(f.Name(), c.file(key)); err != nil {
+		return err
+	}
+	return c.prune()
+}
+
+// prune removes the least recently used outputs, with their replays, until
+// all of them fit into MaxSize, and temporary files left behind by
+// interrupted runs.
+func (c *CleanCache) prune() error {
+	maxSize := c.MaxSize
+	if maxSize <= 0 {
+		maxSize = DefaultCleanCacheSize
+	}
+	entries, err := os.ReadDir(c.Dir)
+	if err != nil {
+		return err
+	}
+	var outputs []os.FileInfo
+	var total int64
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		switch filepath.Ext(entry.Name()) {
+		case ".out":
+			outputs = append(outputs, info)
+			total += info.Size()
+		case ".tmp":
+			if time.Since(info.ModTime()) > 24*time.Hour {
+				_ = os.Remove(filepath.Join(c.Dir, entry.Name()))
+			}
+		case ".json":
+			// A replay is written before its output is renamed into place
+			key := strings.TrimSuffix(entry.Name(), ".json")
+			if _, err := os.Stat(c.file(key)); os.IsNotExist(err) && time.Since(info.ModTime()) > 24*time.Hour {
+				_ = os.Remove(filepath.Join(c.Dir, entry.Name()))
+			}
+		}
+	}
+	sort.Slice(outputs, func(i, j int) bool { return outputs[i].ModTime().Before(outputs[j].ModTime()) })
+	for _, info := range outputs {
+		if total <= maxSize {
+			break
+		}
+		if err := os.Remove(filepath.Join(c.Dir, info.Name())); err != nil {
+			return err
+		}
+		_ = os.Remove(c.replayFile(strings.TrimSuffix(info.Name(), ".out")))
+		total -= info.Size()
+		slog.Debug("Pruned clean cache entry", "file", info.Name(), "size", info.Size())
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package filters
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/danielsiegl/gitsqlite/internal/errs"
+	"github.com/danielsiegl/gitsqlite/internal/sqlite"
+)
+
+// ParseCollationMap parses a comma-separated list of collation mappings in
+// the form
+//
+//	name=other
+//
+// which make smudge restore columns, indexes and views using collation name
+// with collation other instead. Names are case-insensitive, as in SQLite, and
+// may be quoted.
+func ParseCollationMap(list string) (map[string]string, error) {
+	mapping := map[string]string{}
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		from, to, ok := strings.Cut(item, "=")
+		from, to = UnquoteIdent(strings.TrimSpace(from)), UnquoteIdent(strings.TrimSpace(to))
+		if !ok || from == "" || to == "" {
+			return nil, fmt.Errorf("collation mapping %q: expected name=other", item)
+		}
+		if _, dup := mapping[strings.ToLower(from)]; dup {
+			return nil, fmt.Errorf("collation %q is mapped twice", from)
+		}
+		mapping[strings.ToLower(from)] = to
+	}
+	return mapping, nil
+}
+
+// plainIdent matches the collation names that need no quotes.
+var plainIdent = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// collationToken returns the index of the token naming the collation after
+// the COLLATE keyword at tokens[i], -1 if there is none.
+func collationToken(tokens []Token, i int) int {
+	if !tokens[i].Is("COLLATE") {
+		return -1
+	}
+	for j := i + 1; j < len(tokens); j++ {
+		switch tokens[j].Kind {
+		case TokenSpace, TokenComment:
+			continue
+		case TokenWord, TokenQuotedIdent:
+			return j
+		case TokenString:
+			if _, ok := unquoteString(tokens[j].Text); ok {
+				return j
+			}
+		}
+		return -1
+	}
+	return -1
+}
+
+// collationName returns the unquoted name of a collation token.
+func collationName(tok Token) string {
+	if tok.Kind == TokenString {
+		name, _ := unquoteString(tok.Text)
+		return name
+	}
+	return UnquoteIdent(tok.Text)
+}
+
+// collationCheck renames the collations of schema statements as a mapping
+// says (see ParseCollationMap), and checks that SQLite provides every
+// collation used. Names are kept as they are otherwise.
+//
+// A table using a collation SQLite does not know cannot be created, and an
+// index or view using one fails once it is used. After the first such
+// statement nothing more should be restored: the rest of the dump is only
+// read for the other missing collations, and err lists them with the objects
+// using them.
+type collationCheck struct {
+	ctx     context.Context
+	eng     *sqlite.Engine
+	mapping map[string]string
+	known   map[string]bool
+	missing map[string][]string
+	mapped  int
+}
+
+func newCollationCheck(ctx context.Context, eng *sqlite.Engine, mapping map[string]string) *collationCheck {
+	return &collationCheck{ctx: ctx, eng: eng, mapping: mapping, missing: map[string][]string{}}
+}
+
+// statement returns raw, the text of a statement as read, with its
+// collations mapped, and records the ones SQLite does not provide.
+func (c *collationCheck) statement(raw, text string) (string, error) {
+	if ClassifyStatement(text) != StatementSchema || !strings.Contains(strings.ToUpper(raw), "COLLATE") {
+		return raw, nil
+	}
+	tokens := Tokenize(raw)
+	var b strings.Builder
+	var unknown []string
+	for i := 0; i < len(tokens); i++ {
+		j := collationToken(tokens, i)
+		if j < 0 {
+			b.WriteString(tokens[i].Text)
+			continue
+		}
+		for _, t := range tokens[i:j] {
+			b.WriteString(t.Text)
+		}
+		name := collationName(tokens[j])
+		if to, ok := c.mapping[strings.ToLower(name)]; ok {
+			name = to
+			c.mapped++
+			if plainIdent.MatchString(to) {
+				b.WriteString(to)
+			} else {
+				b.WriteString(sqlite.QuoteIdent(to))
+			}
+		} else {
+			b.WriteString(tokens[j].Text)
+		}
+		if c.known == nil {
+			known, err := availableCollations(c.ctx, c.eng)
+			if err != nil {
+				return "", err
+			}
+			c.known = known
+		}
+		if !c.known[strings.ToLower(name)] {
+			unknown = append(unknown, name)
+		}
+		i = j
+	}
+	if len(unknown) > 0 {
+		stmt := stripLeadingComments(strings.TrimSpace(text))
+		_, object := schemaObjectName(stmt)
+		if object == "" {
+			object = SchemaObjectTable(stmt)
+		}
+		for _, name := range unknown {
+			c.missing[name] = appendUnique(c.missing[name], object)
+		}
+	}
+	return b.String(), nil
+}
+
+// failed reports whether a collation SQLite does not provide was found.
+func (c *collationCheck) failed() bool {
+	return len(c.missing) > 0
+}
+
+// err returns the error listing the missing collations, nil if there are
+// none. It logs the number of collations mapped otherwise.
+func (c *collationCheck) err() error {
+	if c == nil {
+		return nil
+	}
+	if len(c.missing) == 0 {
+		if c.mapped > 0 {
+			slog.Info("Mapped collations", "count", c.mapped)
+		}
+		return nil
+	}
+	names := make([]string, 0, len(c.missing))
+	for name := range c.missing {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	items := make([]string, len(names))
+	for i, name := range names {
+		items[i] = fmt.Sprintf("%s (used by %s)", name, strings.Join(c.missing[name], ", "))
+	}
+	hint := "load the extension defining them with -load-extension, or map them to collations SQLite has with -collations name=other"
+	if len(c.mapping) > 0 {
+		hint = "load the extension defining them with -load-extension, or check the -collations mappings"
+	}
+	return errs.Mark(fmt.Errorf("the dump uses collations SQLite does not provide: %s; %s", strings.Join(items, ", "), hint), errs.ErrRestoreFailed)
+}
+
+// availableCollations returns the lower-case names of the collations SQLite
+// provides, with the extensions the engine loads.
+func availableCollations(ctx context.Context, eng *sqlite.Engine) (map[string]bool, error) {
+	rows, err := eng.Query(ctx, ":memory:", "SELECT name FROM pragma_collation_list;")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list collations: %w", err)
+	}
+	known := map[string]bool{}
+	for _, row := range rows {
+		if len(row) == 1 {
+			known[strings.ToLower(row[0])] = true
+		}
+	}
+	return known, nil
+}
+
+// appendUnique appends s to list unless it is in it already.
+func appendUnique(list []string, s string) []string {
+	for _, item := range list {
+		if item == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
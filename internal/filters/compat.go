@@ -0,0 +1,355 @@
+package filters
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/danielsiegl/gitsqlite/internal/compression"
+	"github.com/danielsiegl/gitsqlite/internal/hash"
+)
+
+// Quirks are the ways a dump written by an older gitsqlite release differs
+// from the current format. Clean keeps writing them for a database whose
+// dump in the git index has them, so that upgrading gitsqlite does not turn
+// the next commit into a diff of the whole file; -upgrade-format writes the
+// current format instead.
+type Quirks struct {
+	// Header holds the header statements sqlite3 printed before gitsqlite
+	// wrote DumpHeader itself, if they differ from it.
+	Header string
+	// NoHash is set if the dump has no hash trailer.
+	NoHash bool
+	// IntegralReals is set if integral values in REAL columns are written
+	// as integers, as before NormalizeRealColumns.
+	IntegralReals bool
+	// DumpRowOrder is set if the rows of a table that RowOrderKey sorts are
+	// not in primary key order, as written before rows were sorted or with
+	// RowOrderDump.
+	DumpRowOrder bool
+	// Format is the format version of the dump, FormatUnversioned if it
+	// records none. It is 0 for an empty dump.
+	Format int
+	// NoSchemaLink is set if the dump holds neither schema statements nor
+	// the hash of a schema file, as the data written next to a -schema-file
+	// before the hash was recorded. It only matters with a schema file, so
+	// Any ignores it.
+	NoSchemaLink bool
+}
+
+// Any reports whether q has any quirk, an older format version included.
+func (q Quirks) Any() bool {
+	return q.Header != "" || q.NoHash || q.IntegralReals || q.DumpRowOrder || (q.Format > 0 && q.Format < CurrentFormat)
+}
+
+// String lists the quirks for log messages.
+func (q Quirks) String() string {
+	var names []string
+	for _, quirk := range []struct {
+		set  bool
+		name string
+	}{
+		{q.Header != "", "sqlite3 header"},
+		{q.NoHash, "no hash trailer"},
+		{q.IntegralReals, "integral REAL values"},
+		{q.DumpRowOrder, ".dump row order"},
+		{q.Format > 0 && q.Format < CurrentFormat, fmt.Sprintf("format %d", q.Format)},
+	} {
+		if quirk.set {
+			names = append(names, quirk.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ", ")
+}
+
+// DetectQuirks reads a dump written by clean, compressed or not (with the
+// dictionaries in dictDir), and returns how its format differs from the
+// current one.
+func DetectQuirks(r io.Reader, dictDir string) (Quirks, error) {
+	r, _, err := compression.NewReader(r, dictDir)
+	if err != nil {
+		return Quirks{}, err
+	}
+	var q Quirks
+	var header strings.Builder
+	inHeader := true
+	tables := TableMap{}
+	order := keyOrderCheck{}
+	lastLine := ""
+	schema, linked := false, false
+	scanner := NewStatementScanner(r)
+	for scanner.Scan() {
+		stmt := scanner.Text()
+		if trimmed := strings.TrimSpace(stmt); trimmed != "" {
+			lines := strings.Split(trimmed, "\n")
+			lastLine = lines[len(lines)-1]
+		}
+		if inHeader {
+			if version := statementFormat(stmt); version > 0 {
+				q.Format = version
+			}
+			if _, kind := canonicalControlStatement(stmt); kind == controlBegin || kind == controlPragma {
+				header.WriteString(strings.TrimSpace(stmt) + "\n")
+				continue
+			}
+			if ClassifyStatement(stmt) != StatementEmpty {
+				inHeader = false
+			}
+		}
+		switch {
+		case ClassifyStatement(stmt) == StatementSchema:
+			schema = true
+		case hasCommentLine(stmt, hash.SchemaPrefix):
+			linked = true
+		}
+		tables.Observe(stmt)
+		order.observe(stmt)
+		if !q.IntegralReals && InsertTableName(stmt) != "" {
+			q.IntegralReals = hasIntegralReal(stmt, tables)
+		}
+		if !q.DumpRowOrder && InsertTableName(stmt) != "" {
+			q.DumpRowOrder = !order.inOrder(stmt)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return Quirks{}, err
+	}
+	if lastLine == "" {
+		// Empty, nothing to keep
+		return Quirks{}, nil
+	}
+
+	if header.String() != DumpHeader {
+		q.Header = header.String()
+	}
+	q.NoHash = !strings.HasPrefix(lastLine, hash.HashPrefix)
+	q.NoSchemaLink = !schema && !linked
+	if q.Format == 0 {
+		q.Format = FormatUnversioned
+	}
+	return q, nil
+}
+
+// hasCommentLine reports whether a line of stmt starts with prefix.
+func hasCommentLine(stmt, prefix string) bool {
+	return strings.HasPrefix(strings.TrimLeft(stmt, "\r\n"), prefix) || strings.Contains(stmt, "\n"+prefix)
+}
+
+// hasIntegralReal reports whether the INSERT statement stmt writes an
+// integer literal into a REAL column.
+func hasIntegralReal(stmt string, tables TableMap) bool {
+	ins, err := ParseInsert(strings.TrimSpace(stmt))
+	if err != nil {
+		return false
+	}
+	table := tables.Lookup(ins.Table)
+	if table == nil || !table.HasAffinity(AffinityReal) {
+		return false
+	}
+	for _, row := range ins.Rows {
+		for pos, span := range row {
+			col := ins.ColumnIndex(table, pos)
+			if col >= 0 && col < len(table.Affinities) && table.Affinities[col] == AffinityReal && isIntegerLiteral(ins.Value(span)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// keyOrderCheck follows the rows of the tables that RowOrderKey sorts, to
+// tell whether a dump has them in key order. It maps lower-case table names
+// to their state; tables whose key order cannot be told from the dump, such
+// as keys with a collation, are left out.
+type keyOrderCheck map[string]*keyOrderState
+
+// keyOrderState is the key of the last row of a table.
+type keyOrderState struct {
+	info *TableInfo
+	// key holds the column indexes of the primary key.
+	key  []int
+	last []keyValue
+}
+
+// observe starts following the table a CREATE TABLE statement creates.
+func (c keyOrderCheck) observe(stmt string) {
+	if !strings.HasPrefix(strings.TrimSpace(stmt), "CREATE TABLE") {
+		return
+	}
+	ct, err := ParseCreateTable(stmt)
+	if err != nil {
+		return
+	}
+	columns := keyOrder(ct)
+	if columns == nil || ct.hasCollation() {
+		return
+	}
+	state := &keyOrderState{info: ct.Info()}
+	for _, column := range columns {
+		i := state.info.Index(column)
+		if i < 0 {
+			return
+		}
+		state.key = append(state.key, i)
+	}
+	c[strings.ToLower(state.info.Name)] = state
+}
+
+// inOrder reports whether the rows of the INSERT statement stmt follow the
+// rows before them in key order. Rows whose key is not made of plain
+// literals end the check of their table.
+func (c keyOrderCheck) inOrder(stmt string) bool {
+	state := c[strings.ToLower(InsertTableName(stmt))]
+	if state == nil {
+		return true
+	}
+	ins, err := ParseInsert(strings.TrimSpace(stmt))
+	if err != nil {
+		delete(c, strings.ToLower(state.info.Name))
+		return true
+	}
+	for _, row := range ins.Rows {
+		key := make([]keyValue, len(state.key))
+		found := 0
+		for pos, span := range row {
+			col := ins.ColumnIndex(state.info, pos)
+			for k, i := range state.key {
+				if col != i {
+					continue
+				}
+				v, ok := parseKeyValue(ins.Value(span))
+				if !ok {
+					delete(c, strings.ToLower(state.info.Name))
+					return true
+				}
+				key[k] = v
+				found++
+			}
+		}
+		if found != len(key) {
+			delete(c, strings.ToLower(state.info.Name))
+			return true
+		}
+		if state.last != nil && compareKeys(state.last, key) > 0 {
+			return false
+		}
+		state.last = key
+	}
+	return true
+}
+
+// keyValue is a literal of a dump, ordered as SQLite orders values with
+// the BINARY collation: NULL, numbers, text, blobs.
+type keyValue struct {
+	class  int
+	number float64
+	bytes  string
+}
+
+// parseKeyValue parses a NULL, numeric, string or blob literal.
+func parseKeyValue(lit string) (keyValue, bool) {
+	switch {
+	case strings.EqualFold(lit, "NULL"):
+		return keyValue{class: 0}, true
+	case len(lit) >= 2 && lit[0] == '\'' && lit[len(lit)-1] == '\'':
+		return keyValue{class: 2, bytes: strings.ReplaceAll(lit[1:len(lit)-1], "''", "'")}, true
+	case len(lit) >= 3 && (lit[0] == 'X' || lit[0] == 'x') && lit[1] == '\'' && lit[len(lit)-1] == '\'':
+		b, err := hex.DecodeString(lit[2 : len(lit)-1])
+		return keyValue{class: 3, bytes: string(b)}, err == nil
+	}
+	f, err := strconv.ParseFloat(lit, 64)
+	return keyValue{class: 1, number: f}, err == nil
+}
+
+// compareKeys compares two keys column by column.
+func compareKeys(a, b []keyValue) int {
+	for i := range a {
+		x, y := a[i], b[i]
+		switch {
+		case x.class != y.class:
+			return cmp.Compare(x.class, y.class)
+		case x.class == 1 && x.number != y.number:
+			return cmp.Compare(x.number, y.number)
+		case x.bytes != y.bytes:
+			return strings.Compare(x.bytes, y.bytes)
+		}
+	}
+	return 0
+}
+
+// sqliteHeader starts every SQLite database file.
+const sqliteHeader = "SQLite format 3\x00"
+
+// indexQuirks returns the quirks of the dump of sourcePath in the git index,
+// the format the last commit or git add wrote. Without a git repository or
+// an index entry there are none. A compressed dump is read with the
+// dictionaries in dictDir.
+func indexQuirks(ctx context.Context, sourcePath, dictDir string) Quirks {
+	if sourcePath == "" || filepath.IsAbs(sourcePath) {
+		return Quirks{}
+	}
+	// git runs filters at the top of the worktree, which %f is relative to
+	cmd := exec.CommandContext(ctx, "git", "cat-file", "blob", ":"+filepath.ToSlash(sourcePath))
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return Quirks{}
+	}
+	if err := cmd.Start(); err != nil {
+		slog.Debug("Cannot read the indexed dump", "path", sourcePath, "error", err)
+		return Quirks{}
+	}
+	// A database committed without the filter is not a dump
+	br := bufio.NewReader(out)
+	var q Quirks
+	var detectErr error
+	if head, _ := br.Peek(len(sqliteHeader)); string(head) != sqliteHeader {
+		q, detectErr = DetectQuirks(br, dictDir)
+	}
+	// Drain the rest so that git is not stopped by a closed pipe
+	_, _ = io.Copy(io.Discard, br)
+	if err := cmd.Wait(); err != nil {
+		slog.Debug("No indexed dump to keep the format of", "path", sourcePath, "error", err)
+		return Quirks{}
+	}
+	if detectErr != nil {
+		slog.Debug("Cannot read the indexed dump", "path", sourcePath, "error", detectErr)
+		return Quirks{}
+	}
+	if q.Any() {
+		slog.Info("Keeping the dump format of an older gitsqlite release (use -upgrade-format to write the current one)",
+			"path", sourcePath, "quirks", q.String())
+	}
+	return q
+}
+
+// indexBlob returns the blob id of the file at sourcePath in the git index,
+// or "" if there is none.
+func indexBlob(ctx context.Context, sourcePath string) string {
+	if sourcePath == "" || filepath.IsAbs(sourcePath) {
+		return ""
+	}
+	out, err := exec.CommandContext(ctx, "git", "rev-parse", "--verify", "--quiet", ":"+filepath.ToSlash(sourcePath)).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// legacyHeader returns the header clean writes for a dump with quirks q.
+func legacyHeader(q Quirks) string {
+	if q.Header != "" {
+		return q.Header
+	}
+	return DumpHeader
+}
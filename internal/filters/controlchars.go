@@ -0,0 +1,197 @@
+package filters
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Control character policies (-control-chars).
+const (
+	// ControlCharsKeep writes text values as the dump engine does: sqlite3
+	// uses raw line breaks, replace(...,char(10)) or unistr('\u000a')
+	// depending on its version.
+	ControlCharsKeep = "keep"
+	// ControlCharsChar writes text values holding control characters as
+	// concatenations such as 'a'||char(13,10)||'b', which keep every row on
+	// one line and restore with any SQLite version.
+	ControlCharsChar = "char"
+)
+
+// CanonicalizeControlChars rewrites the text values of an INSERT statement
+// that contain control characters (U+0000 to U+001F) as string literals
+// concatenated with char() calls. Values written by any sqlite3 version are
+// recognized: string literals with raw control characters, the
+// replace('..\n..','\n',char(10)) form and unistr('..\u000a..'). Other values
+// and statements are returned unchanged.
+func CanonicalizeControlChars(stmt string) string {
+	if !strings.HasPrefix(strings.TrimSpace(stmt), "INSERT INTO") {
+		return stmt
+	}
+	ins, err := ParseInsert(stmt)
+	if err != nil {
+		return stmt
+	}
+	changed := false
+	for _, row := range ins.Rows {
+		for _, span := range row {
+			var sig []Token
+			for _, t := range ins.Tokens[span.Start:span.End] {
+				if t.Kind != TokenSpace && t.Kind != TokenComment {
+					sig = append(sig, t)
+				}
+			}
+			value, n, ok := decodeText(sig)
+			if !ok || n != len(sig) || !hasControlChars(value) {
+				continue
+			}
+			if canonical := charConcat(value); canonical != ins.Value(span) {
+				ins.SetValue(span, canonical)
+				changed = true
+			}
+		}
+	}
+	if !changed {
+		return stmt
+	}
+	return ins.String()
+}
+
+// decodeText evaluates a text expression at the start of toks: a string
+// literal, unistr(literal) or replace(expr, literal, char(N,...)). It returns
+// the value and the number of tokens used; ok is false for anything else.
+func decodeText(toks []Token) (value string, n int, ok bool) {
+	if len(toks) == 0 {
+		return "", 0, false
+	}
+	if toks[0].Kind == TokenString {
+		s, ok := unquoteString(toks[0].Text)
+		return s, 1, ok
+	}
+	if len(toks) < 4 || toks[1].Text != "(" {
+		return "", 0, false
+	}
+	switch {
+	case toks[0].Is("unistr"):
+		if toks[2].Kind != TokenString || toks[3].Text != ")" {
+			return "", 0, false
+		}
+		s, ok := unquoteString(toks[2].Text)
+		if !ok {
+			return "", 0, false
+		}
+		s, ok = unescapeUnistr(s)
+		return s, 4, ok
+	case toks[0].Is("replace"):
+		// replace ( expr , 'marker' , char ( N ) )
+		s, k, ok := decodeText(toks[2:])
+		if !ok {
+			return "", 0, false
+		}
+		k += 2
+		if k+6 >= len(toks) || toks[k].Text != "," || toks[k+1].Kind != TokenString || toks[k+2].Text != "," ||
+			!toks[k+3].Is("char") || toks[k+4].Text != "(" {
+			return "", 0, false
+		}
+		marker, ok := unquoteString(toks[k+1].Text)
+		if !ok || marker == "" {
+			return "", 0, false
+		}
+		var with strings.Builder
+		k += 5
+		for ; k < len(toks) && toks[k].Text != ")"; k++ {
+			if toks[k].Text == "," {
+				continue
+			}
+			code, err := strconv.Atoi(toks[k].Text)
+			if err != nil || code < 0 || code > utf8.MaxRune {
+				return "", 0, false
+			}
+			with.WriteRune(rune(code))
+		}
+		if k+1 >= len(toks) || toks[k+1].Text != ")" {
+			return "", 0, false
+		}
+		return strings.ReplaceAll(s, marker, with.String()), k + 2, true
+	}
+	return "", 0, false
+}
+
+// unquoteString returns the value of a single-quoted SQL string literal.
+func unquoteString(lit string) (string, bool) {
+	if len(lit) < 2 || lit[0] != '\'' || lit[len(lit)-1] != '\'' {
+		return "", false
+	}
+	return strings.ReplaceAll(lit[1:len(lit)-1], "''", "'"), true
+}
+
+// unescapeUnistr decodes the escapes of SQLite's unistr(): \\, \XXXX,
+// \uXXXX, \+XXXXXX and \UXXXXXXXX with hexadecimal digits.
+func unescapeUnistr(s string) (string, bool) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i+1 < len(s) && s[i+1] == '\\' {
+			b.WriteByte('\\')
+			i++
+			continue
+		}
+		digits, skip := 4, 1
+		if i+1 < len(s) {
+			switch s[i+1] {
+			case 'u':
+				digits, skip = 4, 2
+			case '+':
+				digits, skip = 6, 2
+			case 'U':
+				digits, skip = 8, 2
+			}
+		}
+		if i+skip+digits > len(s) {
+			return "", false
+		}
+		code, err := strconv.ParseUint(s[i+skip:i+skip+digits], 16, 32)
+		if err != nil || code > utf8.MaxRune {
+			return "", false
+		}
+		b.WriteRune(rune(code))
+		i += skip + digits - 1
+	}
+	return b.String(), true
+}
+
+// hasControlChars reports whether s contains a character below U+0020.
+func hasControlChars(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x20 {
+			return true
+		}
+	}
+	return false
+}
+
+// charConcat writes s as string literals and char() calls joined with ||, one
+// char() call per run of control characters.
+func charConcat(s string) string {
+	var parts []string
+	for len(s) > 0 {
+		i := 0
+		if s[0] < 0x20 {
+			codes := []string{}
+			for ; i < len(s) && s[i] < 0x20; i++ {
+				codes = append(codes, strconv.Itoa(int(s[i])))
+			}
+			parts = append(parts, "char("+strings.Join(codes, ",")+")")
+		} else {
+			for i < len(s) && s[i] >= 0x20 {
+				i++
+			}
+			parts = append(parts, "'"+strings.ReplaceAll(s[:i], "'", "''")+"'")
+		}
+		s = s[i:]
+	}
+	return strings.Join(parts, "||")
+}
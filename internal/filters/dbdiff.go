@@ -0,0 +1,340 @@
+package filters
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/danielsiegl/gitsqlite/internal/sqlite"
+)
+
+// DBDiffOptions control DBDiff.
+type DBDiffOptions struct {
+	// Builtin compares the databases with DBDiff's own comparison even if
+	// sqldiff is available.
+	Builtin bool
+	// LocalTables are left out of the comparison, which sqldiff cannot do.
+	LocalTables []string
+}
+
+// oldSchema is the name the old database is attached under.
+const oldSchema = "gitsqlite_old"
+
+// DBDiff writes the SQL statements that turn the database at oldPath into
+// the one at newPath. The sqldiff tool of the SQLite project is used if it
+// is on PATH or next to sqlite3; otherwise rows are compared by primary key
+// (see diffDatabases).
+func DBDiff(ctx context.Context, eng *sqlite.Engine, oldPath, newPath string, out io.Writer, opts DBDiffOptions) error {
+	if !opts.Builtin && len(opts.LocalTables) == 0 {
+		if bin := findSQLDiff(ctx, eng); bin != "" {
+			cmd := exec.CommandContext(ctx, bin, oldPath, newPath)
+			var stderr strings.Builder
+			cmd.Stderr = &stderr
+			output, err := cmd.Output()
+			if err == nil {
+				slog.Info("Compared databases with sqldiff", "path", bin)
+				_, err = out.Write(output)
+				return err
+			}
+			slog.Warn("sqldiff failed, comparing the databases by primary key instead",
+				"path", bin, "error", err, "stderr", strings.TrimSpace(stderr.String()))
+		}
+	}
+	w := bufio.NewWriterSize(out, 64*1024)
+	if err := diffDatabases(ctx, eng, oldPath, newPath, w, opts.LocalTables); err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// findSQLDiff returns the path of sqldiff, or "" if there is none.
+func findSQLDiff(ctx context.Context, eng *sqlite.Engine) string {
+	if path, err := exec.LookPath("sqldiff"); err == nil {
+		return path
+	}
+	if eng.Embedded {
+		return ""
+	}
+	bin, err := eng.GetBinPath(ctx)
+	if err != nil {
+		return ""
+	}
+	path, err := exec.LookPath(filepath.Join(filepath.Dir(bin), "sqldiff"))
+	if err != nil {
+		return ""
+	}
+	return path
+}
+
+// schemaEntry is a row of sqlite_schema.
+type schemaEntry struct {
+	kind, name, sql string
+}
+
+// readSchemaEntries returns the tables, indexes, views and triggers of the
+// database attached as schema, by lower-case name. Internal objects and
+// automatic indexes are left out.
+func readSchemaEntries(ctx context.Context, eng *sqlite.Engine, dbPath, schema string) (map[string]schemaEntry, error) {
+	rows, err := eng.Query(ctx, dbPath, fmt.Sprintf("SELECT type, name, sql FROM %s.sqlite_schema WHERE sql NOT NULL AND name NOT LIKE 'sqlite\\_%%' ESCAPE '\\';",
+		sqlite.QuoteIdent(schema)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema: %w", err)
+	}
+	entries := map[string]schemaEntry{}
+	for _, row := range rows {
+		if len(row) == 3 {
+			entries[strings.ToLower(row[1])] = schemaEntry{kind: row[0], name: row[1], sql: row[2]}
+		}
+	}
+	return entries, nil
+}
+
+// diffDatabases writes the statements turning the database at oldPath into
+// the one at newPath, in this order: indexes, views and triggers that
+// changed or are gone are dropped, tables that are gone or whose CREATE
+// TABLE changed are dropped, new and changed tables are created with all
+// their rows, the rows of the other tables are deleted, updated and
+// inserted, and finally new and changed indexes, views and triggers are
+// created. Rows are matched by primary key, or by rowid in tables without
+// one, and written in key order; tables and other objects are sorted by
+// name.
+func diffDatabases(ctx context.Context, eng *sqlite.Engine, oldPath, newPath string, w io.Writer, localTables []string) error {
+	eng = eng.WithAttachment(sqlite.Attachment{Name: oldSchema, Path: oldPath})
+	oldEntries, err := readSchemaEntries(ctx, eng, newPath, oldSchema)
+	if err != nil {
+		return err
+	}
+	newEntries, err := readSchemaEntries(ctx, eng, newPath, "main")
+	if err != nil {
+		return err
+	}
+	local := map[string]bool{}
+	for _, table := range localTables {
+		local[strings.ToLower(table)] = true
+	}
+	names := func(entries map[string]schemaEntry, tables bool) []string {
+		var list []string
+		for key, e := range entries {
+			if (e.kind == "table") == tables && !local[key] {
+				list = append(list, key)
+			}
+		}
+		sort.Strings(list)
+		return list
+	}
+	changed := func(key string) bool {
+		return oldEntries[key].sql != newEntries[key].sql || oldEntries[key].kind != newEntries[key].kind
+	}
+
+	var b strings.Builder
+	for _, key := range names(oldEntries, false) {
+		if _, ok := newEntries[key]; !ok || changed(key) {
+			e := oldEntries[key]
+			fmt.Fprintf(&b, "DROP %s IF EXISTS %s;\n", strings.ToUpper(e.kind), sqlite.QuoteIdent(e.name))
+		}
+	}
+	for _, key := range names(oldEntries, true) {
+		if _, ok := newEntries[key]; !ok || changed(key) {
+			fmt.Fprintf(&b, "DROP TABLE %s;\n", sqlite.QuoteIdent(oldEntries[key].name))
+		}
+	}
+	if _, err := io.WriteString(w, b.String()); err != nil {
+		return err
+	}
+
+	var common []string
+	for _, key := range names(newEntries, true) {
+		e := newEntries[key]
+		if _, ok := oldEntries[key]; ok && !changed(key) {
+			common = append(common, key)
+			continue
+		}
+		if _, err := io.WriteString(w, e.sql+";\n"); err != nil {
+			return err
+		}
+		if isVirtualTable(e.sql) {
+			continue
+		}
+		if err := writeTableRows(ctx, eng, newPath, w, e.name); err != nil {
+			return err
+		}
+	}
+	for _, key := range common {
+		// The content of virtual tables is in their shadow tables
+		if isVirtualTable(newEntries[key].sql) {
+			continue
+		}
+		if err := writeRowChanges(ctx, eng, newPath, w, newEntries[key].name); err != nil {
+			return err
+		}
+	}
+
+	b.Reset()
+	for _, key := range names(newEntries, false) {
+		if _, ok := oldEntries[key]; !ok || changed(key) {
+			b.WriteString(newEntries[key].sql + ";\n")
+		}
+	}
+	_, err = io.WriteString(w, b.String())
+	return err
+}
+
+// isVirtualTable reports whether sql creates a virtual table.
+func isVirtualTable(sql string) bool {
+	next := leadingTokens(sql)
+	return next().Is("CREATE") && next().Is("VIRTUAL")
+}
+
+// tableKey returns the stored columns of table and the columns identifying
+// its rows: the primary key, or _rowid_ for tables without one.
+func tableKey(ctx context.Context, eng *sqlite.Engine, dbPath, table string) (columns, key []string, err error) {
+	rows, err := eng.Query(ctx, dbPath, fmt.Sprintf("SELECT name, pk FROM pragma_table_info(%s) ORDER BY cid;", sqlite.QuoteLiteral(table)))
+	if err != nil {
+		return nil, nil, err
+	}
+	keys := map[string]string{}
+	for _, row := range rows {
+		if len(row) != 2 {
+			continue
+		}
+		columns = append(columns, row[0])
+		if row[1] != "0" {
+			keys[row[1]] = row[0]
+		}
+	}
+	for i := 1; i <= len(keys); i++ {
+		key = append(key, keys[fmt.Sprint(i)])
+	}
+	if len(key) == 0 {
+		key = []string{"_rowid_"}
+	}
+	return columns, key, nil
+}
+
+// quotedList returns names quoted as identifiers, each prefixed with
+// alias and a dot if alias is not empty.
+func quotedList(names []string, alias string) []string {
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = sqlite.QuoteIdent(name)
+		if alias != "" {
+			quoted[i] = alias + "." + quoted[i]
+		}
+	}
+	return quoted
+}
+
+// insertExpr returns the SQL expression building the INSERT statement of a
+// row of table from the columns of alias, with the rowid if it is the key.
+func insertExpr(table, alias string, columns, key []string) string {
+	if key[0] == "_rowid_" {
+		columns = append([]string{"rowid"}, columns...)
+	}
+	values := make([]string, len(columns))
+	for i, col := range quotedList(columns, alias) {
+		values[i] = "quote(" + col + ")"
+	}
+	prefix := "INSERT INTO " + sqlite.QuoteIdent(table) + "(" + strings.Join(quotedList(columns, ""), ",") + ") VALUES("
+	return sqlite.QuoteLiteral(prefix) + " || " + strings.Join(values, " || ',' || ") + " || ');'"
+}
+
+// keyCondition returns the SQL expression building the WHERE clause that
+// selects a row of alias by key.
+func keyCondition(alias string, key []string) string {
+	parts := make([]string, len(key))
+	for i, col := range key {
+		name := sqlite.QuoteIdent(col)
+		if col == "_rowid_" {
+			name = "rowid"
+		}
+		parts[i] = sqlite.QuoteLiteral(name+"=") + " || quote(" + alias + "." + sqlite.QuoteIdent(col) + ")"
+	}
+	return "' WHERE ' || " + strings.Join(parts, " || ' AND ' || ")
+}
+
+// writeTableRows writes INSERT statements for all rows of table.
+func writeTableRows(ctx context.Context, eng *sqlite.Engine, dbPath string, w io.Writer, table string) error {
+	columns, key, err := tableKey(ctx, eng, dbPath, table)
+	if err != nil {
+		return err
+	}
+	query := fmt.Sprintf("SELECT %s FROM main.%s AS n ORDER BY %s;", insertExpr(table, "n", columns, key),
+		sqlite.QuoteIdent(table), strings.Join(quotedList(key, "n"), ","))
+	return writeStatements(ctx, eng, dbPath, w, query)
+}
+
+// writeRowChanges writes the DELETE, UPDATE and INSERT statements of the
+// rows of table that differ between the old and the new database.
+func writeRowChanges(ctx context.Context, eng *sqlite.Engine, dbPath string, w io.Writer, table string) error {
+	columns, key, err := tableKey(ctx, eng, dbPath, table)
+	if err != nil {
+		return err
+	}
+	isKey := map[string]bool{}
+	for _, col := range key {
+		isKey[col] = true
+	}
+	match := make([]string, len(key))
+	for i, col := range key {
+		match[i] = "n." + sqlite.QuoteIdent(col) + " IS o." + sqlite.QuoteIdent(col)
+	}
+	on := strings.Join(match, " AND ")
+	newTable := "main." + sqlite.QuoteIdent(table)
+	oldTable := oldSchema + "." + sqlite.QuoteIdent(table)
+	order := func(alias string) string { return strings.Join(quotedList(key, alias), ",") }
+
+	deletes := fmt.Sprintf("SELECT %s || %s || ';' FROM %s AS o WHERE NOT EXISTS (SELECT 1 FROM %s AS n WHERE %s) ORDER BY %s;",
+		sqlite.QuoteLiteral("DELETE FROM "+sqlite.QuoteIdent(table)), keyCondition("o", key), oldTable, newTable, on, order("o"))
+
+	var sets, differs []string
+	for _, col := range columns {
+		if isKey[col] {
+			continue
+		}
+		q := sqlite.QuoteIdent(col)
+		sets = append(sets, fmt.Sprintf("CASE WHEN n.%[1]s IS NOT o.%[1]s THEN %[2]s || quote(n.%[1]s) ELSE '' END", q, sqlite.QuoteLiteral(", "+q+"=")))
+		differs = append(differs, fmt.Sprintf("n.%[1]s IS NOT o.%[1]s", q))
+	}
+	var updates string
+	if len(sets) > 0 {
+		updates = fmt.Sprintf("SELECT %s || substr(%s, 3) || %s || ';' FROM %s AS n JOIN %s AS o ON %s WHERE %s ORDER BY %s;",
+			sqlite.QuoteLiteral("UPDATE "+sqlite.QuoteIdent(table)+" SET "), strings.Join(sets, " || "), keyCondition("n", key),
+			newTable, oldTable, on, strings.Join(differs, " OR "), order("n"))
+	}
+
+	inserts := fmt.Sprintf("SELECT %s FROM %s AS n WHERE NOT EXISTS (SELECT 1 FROM %s AS o WHERE %s) ORDER BY %s;",
+		insertExpr(table, "n", columns, key), newTable, oldTable, on, order("n"))
+
+	for _, query := range []string{deletes, updates, inserts} {
+		if query == "" {
+			continue
+		}
+		if err := writeStatements(ctx, eng, dbPath, w, query); err != nil {
+			return fmt.Errorf("table %s: %w", table, err)
+		}
+	}
+	return nil
+}
+
+// writeStatements runs a query returning one statement per row and writes
+// the statements, one per line.
+func writeStatements(ctx context.Context, eng *sqlite.Engine, dbPath string, w io.Writer, query string) error {
+	rows, err := eng.Query(ctx, dbPath, query)
+	if err != nil {
+		return err
+	}
+	for _, row := range rows {
+		if len(row) == 1 {
+			if _, err := io.WriteString(w, row[0]+"\n"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
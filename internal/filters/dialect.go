@@ -0,0 +1,152 @@
+package filters
+
+import (
+	"bufio"
+	"io"
+	"log/slog"
+	"strings"
+)
+
+// NormalizeDialect returns a reader that rewrites dump dialect variations
+// produced by other tools (DB Browser for SQLite, DBeaver, hand exports) into
+// the form sqlite3 .dump emits, so smudge restores them reliably:
+//
+//   - BEGIN; / BEGIN DEFERRED|IMMEDIATE|EXCLUSIVE [TRANSACTION]; become BEGIN TRANSACTION;
+//   - END [TRANSACTION]; / COMMIT TRANSACTION; become COMMIT;
+//   - PRAGMA foreign_keys=<anything> becomes PRAGMA foreign_keys=OFF; so rows
+//     restore regardless of insertion order
+//   - a transaction left open at end of input is committed instead of being
+//     rolled back by sqlite3
+//   - a UTF-8 byte order mark at the start, as added by some editors, is
+//     dropped
+//
+// All other statements are passed through byte for byte. The next clean
+// emits the canonical gitsqlite form. Closing the reader stops reading in,
+// also before its end.
+func NormalizeDialect(in io.Reader) io.ReadCloser {
+	return normalizeDialect(in, nil)
+}
+
+// normalizeDialect is NormalizeDialect with the collations of the dump
+// checked and mapped by collations, if not nil, in the same pass.
+func normalizeDialect(in io.Reader, collations *collationCheck) io.ReadCloser {
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w := bufio.NewWriterSize(pw, 64*1024)
+		scanner := NewStatementScanner(in)
+		open := false
+		rewritten := 0
+		first := true
+		for scanner.Scan() {
+			raw, text := scanner.Raw(), scanner.Text()
+			if first {
+				raw, text = strings.TrimPrefix(raw, bom), strings.TrimPrefix(text, bom)
+				first = false
+			}
+			canonical, kind := canonicalControlStatement(text)
+			switch kind {
+			case controlBegin:
+				open = true
+			case controlCommit:
+				open = false
+			}
+			if canonical != "" && canonical != strings.TrimSpace(text) {
+				rewritten++
+				raw = canonical + "\n"
+			}
+			if collations != nil {
+				var err error
+				if raw, err = collations.statement(raw, text); err != nil {
+					pw.CloseWithError(err)
+					return
+				}
+				if collations.failed() {
+					continue
+				}
+			}
+			if _, err := w.WriteString(raw); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if err := collations.err(); err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+		if open {
+			slog.Info("Input leaves a transaction open, appending COMMIT")
+			// The last statement may lack a trailing newline.
+			if _, err := w.WriteString("\nCOMMIT;\n"); err != nil {
+				pw.CloseWithError(err)
+				return
+			}
+		}
+		if rewritten > 0 {
+			slog.Info("Normalized foreign dump dialect", "rewrittenStatements", rewritten)
+		}
+		pw.CloseWithError(w.Flush())
+	}()
+	return &dialectStream{PipeReader: pr, done: done}
+}
+
+// dialectStream is the output of normalizeDialect.
+type dialectStream struct {
+	*io.PipeReader
+	done chan struct{}
+}
+
+// Close makes the writes of the goroutine converting the input fail, and
+// waits for it to return: the input is not read any more afterwards.
+func (s *dialectStream) Close() error {
+	s.CloseWithError(io.ErrClosedPipe)
+	<-s.done
+	return nil
+}
+
+type controlKind int
+
+const (
+	controlNone controlKind = iota
+	controlBegin
+	controlCommit
+	controlPragma
+)
+
+// canonicalControlStatement returns the canonical text of transaction control
+// and foreign_keys pragma statements, or "" for any other statement.
+func canonicalControlStatement(stmt string) (string, controlKind) {
+	var words []string
+	next := leadingTokens(stmt)
+	for t := next(); t.Text != ""; t = next() {
+		switch t.Kind {
+		case TokenWord:
+			words = append(words, strings.ToUpper(t.Text))
+		default:
+			words = append(words, t.Text)
+		}
+		if len(words) > 6 {
+			return "", controlNone
+		}
+	}
+	if len(words) == 0 || words[len(words)-1] != ";" {
+		return "", controlNone
+	}
+	words = words[:len(words)-1]
+	switch strings.Join(words, " ") {
+	case "BEGIN", "BEGIN TRANSACTION", "BEGIN DEFERRED", "BEGIN DEFERRED TRANSACTION",
+		"BEGIN IMMEDIATE", "BEGIN IMMEDIATE TRANSACTION", "BEGIN EXCLUSIVE", "BEGIN EXCLUSIVE TRANSACTION":
+		return "BEGIN TRANSACTION;", controlBegin
+	case "COMMIT", "COMMIT TRANSACTION", "END", "END TRANSACTION":
+		return "COMMIT;", controlCommit
+	}
+	if len(words) >= 2 && words[0] == "PRAGMA" && words[1] == "FOREIGN_KEYS" {
+		return "PRAGMA foreign_keys=OFF;", controlPragma
+	}
+	return "", controlNone
+}
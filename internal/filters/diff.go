@@ -4,7 +4,6 @@ import (
 	"context"
 	"io"
 	"log/slog"
-	"os"
 	"time"
 
 	"github.com/danielsiegl/gitsqlite/internal/sqlite"
@@ -12,35 +11,58 @@ import (
 
 // Diff streams a binary SQLite DB from 'in' directly into sqlite3 .dump and writes SQL to 'out'.
 // No temp file is created; input is piped to sqlite3 and output is streamed to stdout.
-// If dataOnly is true, only data (INSERT statements) are output.
-// If schemaOutput is not empty, schema is saved to that file.
-func Diff(ctx context.Context, eng *sqlite.Engine, dbFile string, out io.Writer, dataOnly bool, schemaOutput string) error {
+// If opts.DataOnly is true, only data (INSERT statements) are output.
+// If opts.SchemaOutput is not empty, schema is saved to that file.
+// Float normalization always uses the default precision for diff output.
+// Journal files next to dbFile are handled according to opts.Sidecars.
+func Diff(ctx context.Context, eng *sqlite.Engine, dbFile string, out io.Writer, opts Options) error {
 	startTime := time.Now()
 	slog.Info("Starting diff operation")
 
-	// Save schema to separate file if requested
-	if schemaOutput != "" {
-		schemaFile, err := os.Create(schemaOutput)
+	dbFile, removeSnapshot, err := snapshotJournaled(ctx, eng, dbFile, opts.Sidecars)
+	if err != nil {
+		slog.Error("Failed to handle journal files", "error", err)
+		return err
+	}
+	defer removeSnapshot()
+
+	// Save schema to separate file if requested, replacing the previous one
+	// only if the data is dumped too
+	var schemaFile *stagedFile
+	if opts.SchemaOutput != "" {
+		schemaFile, err = stageFile(opts.SchemaOutput)
 		if err != nil {
-			slog.Error("Failed to create schema output file", "file", schemaOutput, "error", err)
+			slog.Error("Failed to create schema output file", "file", opts.SchemaOutput, "error", err)
 			return err
 		}
-		defer schemaFile.Close()
+		defer schemaFile.discard()
 
-		if err := DumpSchema(ctx, eng, dbFile, schemaFile); err != nil {
+		if err := DumpSchema(ctx, eng, dbFile, schemaFile, opts); err != nil {
 			slog.Error("Schema dump failed", "error", err)
 			return err
 		}
-		slog.Info("Schema saved to file", "file", schemaOutput)
 	}
 
 	// For data output, use DumpTables with filtering
 	// When schema is saved to a separate file, only output data to stdout
-	outputDataOnly := dataOnly || (schemaOutput != "")
-	if err := DumpTables(ctx, eng, dbFile, out, 9, outputDataOnly); err != nil {
+	dumpOpts := opts
+	dumpOpts.FloatPrecision = DefaultOptions().FloatPrecision
+	dumpOpts.DataOnly = opts.DataOnly || (opts.SchemaOutput != "")
+	// Show pointers for large BLOBs, but only clean stores them
+	dumpOpts.BlobDir = ""
+	dumpStart := time.Now()
+	if err := DumpTables(ctx, eng, dbFile, out, dumpOpts); err != nil {
 		slog.Error("Diff dump failed", "error", err)
 		return err
 	}
+	opts.Summary.Stage("dump", time.Since(dumpStart))
+	if schemaFile != nil {
+		if err := schemaFile.publish(); err != nil {
+			slog.Error("Failed to save schema file", "file", opts.SchemaOutput, "error", err)
+			return err
+		}
+		slog.Info("Schema saved to file", "file", opts.SchemaOutput)
+	}
 
 	slog.Info("Diff operation completed", "duration", time.Since(startTime))
 	return nil
@@ -0,0 +1,141 @@
+package filters
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	"github.com/danielsiegl/gitsqlite/internal/shutdown"
+	"github.com/danielsiegl/gitsqlite/internal/sqlite"
+)
+
+// DiffDriverArgs are the arguments git passes to an external diff command
+// (diff.<driver>.command): the path, and the old and the new version.
+type DiffDriverArgs struct {
+	Path     string
+	Old, New DiffSide
+	// NewPath is the path of the new version if git detected a rename,
+	// else "".
+	NewPath string
+}
+
+// DiffSide is one version of the file: the file holding it, its object ID
+// and its mode. git passes the worktree file itself, with an ID of zeros, or
+// a temporary file holding the blob, which for a database with the
+// gitsqlite filter is the dump clean wrote. A version that does not exist
+// is /dev/null with "." as ID and mode.
+type DiffSide struct {
+	File, ID, Mode string
+}
+
+// missing reports whether the version does not exist: the file was added
+// or deleted.
+func (s DiffSide) missing() bool {
+	return s.Mode == "." || s.File == "/dev/null"
+}
+
+// regular reports whether the version is a regular file, not a symbolic
+// link or submodule.
+func (s DiffSide) regular() bool {
+	return s.missing() || s.Mode == "100644" || s.Mode == "100755"
+}
+
+// ParseDiffDriverArgs parses the 7 arguments git passes to an external diff
+// command, or the 9 of a rename, which add the new path and a message.
+func ParseDiffDriverArgs(args []string) (DiffDriverArgs, error) {
+	if len(args) != 7 && len(args) != 9 {
+		return DiffDriverArgs{}, fmt.Errorf("expected the 7 or 9 arguments git passes to diff.<driver>.command, got %d", len(args))
+	}
+	d := DiffDriverArgs{
+		Path: args[0],
+		Old:  DiffSide{File: args[1], ID: args[2], Mode: args[3]},
+		New:  DiffSide{File: args[4], ID: args[5], Mode: args[6]},
+	}
+	if len(args) == 9 {
+		d.NewPath = args[7]
+	}
+	return d, nil
+}
+
+// DiffDriver writes a git-style header for the change described by args,
+// followed by the SQL statements that turn the old version of the database
+// into the new one (see DBDiff). A version that is a dump is restored with
+// smudge first; one that does not exist is compared as an empty database.
+// Symbolic links and submodules are named in the header only.
+func DiffDriver(ctx context.Context, eng *sqlite.Engine, args DiffDriverArgs, out io.Writer, smudge SmudgeOptions, opts DBDiffOptions) error {
+	newPath := args.Path
+	if args.NewPath != "" {
+		newPath = args.NewPath
+	}
+	header := fmt.Sprintf("diff --gitsqlite a/%s b/%s\n", args.Path, newPath)
+	switch {
+	case args.Old.missing():
+		header += fmt.Sprintf("new file mode %s\n", args.New.Mode)
+	case args.New.missing():
+		header += fmt.Sprintf("deleted file mode %s\n", args.Old.Mode)
+	case args.Old.Mode != args.New.Mode:
+		header += fmt.Sprintf("old mode %s\nnew mode %s\n", args.Old.Mode, args.New.Mode)
+	}
+	if args.NewPath != "" {
+		header += fmt.Sprintf("rename from %s\nrename to %s\n", args.Path, args.NewPath)
+	}
+	if _, err := io.WriteString(out, header); err != nil {
+		return err
+	}
+	if !args.Old.regular() || !args.New.regular() {
+		_, err := io.WriteString(out, "-- not compared: symbolic link or submodule\n")
+		return err
+	}
+
+	oldDB, removeOld, err := diffSideDatabase(ctx, eng, args.Old, smudge)
+	if err != nil {
+		return fmt.Errorf("old version of %s: %w", args.Path, err)
+	}
+	defer removeOld()
+	newDB, removeNew, err := diffSideDatabase(ctx, eng, args.New, smudge)
+	if err != nil {
+		return fmt.Errorf("new version of %s: %w", newPath, err)
+	}
+	defer removeNew()
+	return DBDiff(ctx, eng, oldDB, newDB, out, opts)
+}
+
+// diffSideDatabase returns the path of a database holding side and a
+// function removing it if it is temporary: the file itself if it is a
+// database, an empty database if side does not exist, or else the dump in
+// the file restored.
+func diffSideDatabase(ctx context.Context, eng *sqlite.Engine, side DiffSide, opts SmudgeOptions) (string, func(), error) {
+	if !side.missing() && sqlite.IsDatabaseFile(side.File) {
+		return side.File, func() {}, nil
+	}
+	tmp, err := os.CreateTemp("", "gitsqlite-diff-*.db")
+	if err != nil {
+		return "", nil, err
+	}
+	remove := shutdown.Remove(tmp.Name())
+	if err := tmp.Close(); err != nil {
+		remove()
+		return "", nil, err
+	}
+	// An empty file is an empty database
+	if side.missing() {
+		return tmp.Name(), remove, nil
+	}
+
+	dump, err := os.Open(side.File)
+	if err != nil {
+		remove()
+		return "", nil, err
+	}
+	defer dump.Close()
+	slog.Info("Restoring dump for comparison", "file", side.File, "id", side.ID)
+	opts.Output, opts.TargetPath = tmp.Name(), ""
+	opts.Backups, opts.TableCache, opts.Summary = nil, nil, nil
+	if err := Smudge(ctx, eng, dump, io.Discard, opts); err != nil {
+		remove()
+		return "", nil, err
+	}
+	return tmp.Name(), remove, nil
+}
@@ -0,0 +1,72 @@
+package filters
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+// InputSize returns the number of bytes left to read from f if it is a
+// regular file, e.g. stdin redirected from a file, or -1 if that is unknown,
+// e.g. for the pipe git writes to.
+func InputSize(f *os.File) int64 {
+	info, err := f.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		return -1
+	}
+	offset, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return -1
+	}
+	return info.Size() - offset
+}
+
+// fileSize returns the size of the file at path, or 0 if it does not exist.
+func fileSize(path string) int64 {
+	if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+		return info.Size()
+	}
+	return 0
+}
+
+// checkFreeSpace fails if dir (the system temporary directory if empty) has
+// less than need bytes available for what. need <= 0 means the size is
+// unknown and passes, as does a file system whose free space cannot be read.
+func checkFreeSpace(dir string, need int64, what string) error {
+	if need <= 0 {
+		return nil
+	}
+	where := filepath.Clean(dir)
+	if dir == "" {
+		dir = os.TempDir()
+		where = fmt.Sprintf("%s (%s)", tempDirVar(), filepath.Clean(dir))
+	}
+	free, err := freeSpace(dir)
+	if err != nil {
+		slog.Debug("Could not determine free disk space", "dir", dir, "error", err)
+		return nil
+	}
+	slog.Debug("Disk space preflight", "dir", dir, "need", need, "free", free)
+	if free < uint64(need) {
+		return fmt.Errorf("not enough disk space for %s: need ~%s free in %s, %s available",
+			what, megabytes(need), where, megabytes(int64(free)))
+	}
+	return nil
+}
+
+// tempDirVar names the environment variable that selects the temporary
+// directory.
+func tempDirVar() string {
+	if runtime.GOOS == "windows" {
+		return "TEMP"
+	}
+	return "TMPDIR"
+}
+
+// megabytes formats n bytes as whole megabytes, rounded up.
+func megabytes(n int64) string {
+	return fmt.Sprintf("%d MB", (n+1<<20-1)>>20)
+}
@@ -0,0 +1,10 @@
+//go:build !unix && !windows
+
+package filters
+
+import "errors"
+
+// freeSpace is not supported on this platform.
+func freeSpace(dir string) (uint64, error) {
+	return 0, errors.New("free disk space is not available on this platform")
+}
@@ -0,0 +1,54 @@
+package filters
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/danielsiegl/gitsqlite/internal/sqlite"
+	"github.com/danielsiegl/gitsqlite/internal/warnings"
+)
+
+// LargeTableRows is the row count above which a table triggers W003.
+const LargeTableRows = 1000000
+
+// checkVersionDrift emits W002 when the database was last written by a newer
+// SQLite library than the engine that dumps it: newer features may be
+// dumped incompletely or fail to restore on older clients.
+func checkVersionDrift(ctx context.Context, eng *sqlite.Engine, dbPath string) {
+	if warnings.IsSuppressed(warnings.SQLiteVersionDrift) {
+		return
+	}
+	writer, err := sqlite.WriterVersion(dbPath)
+	if err != nil || writer == 0 {
+		return
+	}
+	_, version, err := eng.CheckAvailability(ctx)
+	if err != nil {
+		slog.Debug("Could not determine sqlite3 version", "error", err)
+		return
+	}
+	cli := sqlite.ParseVersionNumber(version)
+	if cli == 0 || writer <= cli {
+		return
+	}
+	if eng.Embedded {
+		warnings.Emit(warnings.SQLiteVersionDrift,
+			"database was last written by SQLite %s but the embedded engine is %s; upgrade gitsqlite to avoid dump differences",
+			sqlite.FormatVersionNumber(writer), sqlite.FormatVersionNumber(cli))
+		return
+	}
+	warnings.Emit(warnings.SQLiteVersionDrift,
+		"database was last written by SQLite %s but sqlite3 is %s; upgrade sqlite3 to avoid dump differences",
+		sqlite.FormatVersionNumber(writer), sqlite.FormatVersionNumber(cli))
+}
+
+// warnLargeTables emits W003 for every table with more than LargeTableRows rows.
+func warnLargeTables(rows map[string]int, order []string) {
+	for _, table := range order {
+		if rows[table] > LargeTableRows {
+			warnings.Emit(warnings.LargeTable,
+				"table %s has %d rows; diffs and merges of this table will be slow (consider -data-only or splitting it)",
+				table, rows[table])
+		}
+	}
+}
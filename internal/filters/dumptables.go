@@ -1,169 +1,293 @@
 package filters
 
 import (
-	"bufio"
 	"context"
 	"fmt"
 	"io"
 	"log/slog"
-	"os/exec"
 	"strings"
 
+	"github.com/danielsiegl/gitsqlite/internal/progress"
 	"github.com/danielsiegl/gitsqlite/internal/sqlite"
+	"github.com/danielsiegl/gitsqlite/internal/stats"
 )
 
-// DumpTables dumps only user tables (excluding sqlite_sequence) using selective filtering.
+// DumpTables dumps user tables and the internal tables opts.InternalTables keeps using selective filtering.
 // This function combines the technical SQLite dump operation with logical filtering
 // to exclude system tables and normalize floating point values for consistent output.
-// If dataOnly is true, only data (INSERT statements) are output, no schema.
-func DumpTables(ctx context.Context, eng *sqlite.Engine, dbPath string, out io.Writer, floatPrecision int, dataOnly bool) error {
-	binaryPath, err := eng.GetBinPath()
-	if err != nil {
+// If opts.DataOnly is true, only data (INSERT statements) are output, no schema.
+// Database settings that differ from their defaults follow the header as
+// pragma comments (see PragmaPrefix).
+func DumpTables(ctx context.Context, eng *sqlite.Engine, dbPath string, out io.Writer, opts Options) error {
+	local := newLocalTableFilter(opts.LocalTables)
+	if err := startProgress(ctx, eng, dbPath, opts.Progress, local); err != nil {
 		return err
 	}
+	defer opts.Progress.Finish()
+	out = opts.Progress.Writer(out)
 
 	// Run .dump and stream output line by line
-	cmd := exec.CommandContext(ctx, binaryPath, dbPath, ".dump")
-	stdoutPipe, err := cmd.StdoutPipe()
+	dump, err := eng.OpenDump(ctx, dbPath)
 	if err != nil {
-		return fmt.Errorf("failed to get stdout pipe: %w", err)
+		return err
 	}
-	var stderr strings.Builder
-	cmd.Stderr = &stderr
-
-	slog.Debug("Starting SQLite .dump command")
+	defer dump.Close()
 
-	if err := cmd.Start(); err != nil {
-		return fmt.Errorf("failed to start SQLite dump: %w", err)
+	start := legacyHeader(opts.legacy) + formatComment(opts.formatVersion())
+	if err := eng.WriteWithTimeout(out, []byte(start), "clean"); err != nil {
+		return err
 	}
-
-	reader := bufio.NewReader(stdoutPipe)
-	for {
-		line, readErr := reader.ReadString('\n')
-		if len(line) == 0 && readErr != nil {
-			break
+	if err := opts.sinks.write(start); err != nil {
+		return err
+	}
+	// Settings .dump leaves out, such as user_version, as comments for smudge
+	pragmas, err := ReadPragmas(ctx, eng, dbPath)
+	if err != nil {
+		return err
+	}
+	if len(pragmas) > 0 {
+		if err := eng.WriteWithTimeout(out, []byte(PragmaComments(pragmas)), "clean"); err != nil {
+			return err
 		}
-		// this way it should work with CRLF and LF
-		line = strings.TrimRight(line, "\n")
-		line = strings.TrimRight(line, "\r")
+		if err := opts.sinks.write(PragmaComments(pragmas)); err != nil {
+			return err
+		}
+	}
 
-		// Apply logical filtering to exclude sqlite_sequence operations
-		if ShouldSkipLine(line) {
+	rowScanner := newOrderedDump(ctx, eng, dbPath, dump, opts.rowOrderPolicy(), opts.Subset)
+	defer rowScanner.Close()
+	scanner, err := newSchemaOrder(ctx, eng, dbPath, rowScanner, opts.schemaOrderPolicy())
+	if err != nil {
+		return err
+	}
+	defer scanner.Close()
+	header := &headerFilter{}
+	internal := newInternalTableFilter(opts.InternalTables)
+	tables := TableMap{}
+	counter := &rowCounter{withEmpty: !opts.DataOnly}
+	fixer := &utf8Fixer{policy: opts.InvalidUTF8}
+	redact := newRedactor(opts.Redact, opts.FloatPrecision)
+	blobs := newBlobExternalizer(opts.BlobThreshold, opts.BlobDir)
+	normalizeLine := normalizerFor(opts.Normalizer)
+	jsonRows := opts.DataFormat == DataFormatJSONL
+	idempotent := newIdempotencyCheck(opts)
+	rows := map[string]int{}
+	var rowOrder []string
+	for scanner.Scan() {
+		stmt := scanner.Text()
+		if header.skip(stmt) || local.skip(stmt) {
 			continue
 		}
+		tables.Observe(stmt)
+		if kind, name := schemaObjectName(stmt); kind == "table" {
+			opts.Progress.Table(name)
+			opts.budget.table()
+		} else if table := InsertTableName(stmt); table != "" && !strings.HasPrefix(strings.ToLower(table), "sqlite_") {
+			opts.Progress.Rows(1)
+		}
 
-		// Apply data-only filtering if requested
-		if dataOnly {
-			// Only include data lines or structural lines, skip schema
-			if !IsDataLine(line) && !IsPragmaOrStructuralLine(line) {
-				continue
+		// Rows of tables that cannot hold REAL values have no floats to
+		// normalize, which saves the regex on text-heavy tables
+		normalize := true
+		if table := InsertTableName(stmt); table != "" {
+			if info := tables.Lookup(table); info != nil && !info.HoldsReals {
+				normalize = false
 			}
+			if rows[table] == 0 {
+				rowOrder = append(rowOrder, table)
+			}
+			rows[table]++
 		}
 
-		// Apply normalization for consistent cross-platform output
-		line = NormalizeLine(line, floatPrecision)
+		// Emit the row count of the table whose data section just ended
+		if opts.AnnotateCounts && !internal.skip(stmt) {
+			if annotation := counter.observe(stmt); annotation != "" {
+				if err := eng.WriteWithTimeout(out, []byte(annotation+"\n"), "clean"); err != nil {
+					return err
+				}
+				if err := opts.sinks.write(annotation + "\n"); err != nil {
+					return err
+				}
+			}
+		}
 
-		// Use the technical I/O operation from sqlite engine
-		if err := eng.WriteWithTimeout(out, []byte(line+"\n"), "clean"); err != nil {
+		if opts.CanonicalSchema && IsSchemaLine(stmt) {
+			stmt = CanonicalizeCreateTable(stmt)
+		}
+		if !opts.legacy.IntegralReals {
+			stmt = NormalizeRealColumns(stmt, tables, opts.FloatPrecision)
+		}
+		if opts.ControlChars == ControlCharsChar {
+			stmt = CanonicalizeControlChars(stmt)
+		}
+		stmt = redact.apply(stmt, tables)
+		if stmt, err = blobs.apply(stmt); err != nil {
 			return err
 		}
-		if readErr != nil {
-			if readErr == io.EOF {
-				break
+		stmt = fixer.fix(stmt)
+		if idempotent != nil {
+			first := stmt
+			if normalize {
+				first = idempotent.normalizeLines(stmt)
+			}
+			if err := idempotent.check(first, tables, normalize); err != nil {
+				return err
+			}
+		}
+
+		// Apply data-only filtering if requested; whole statements are
+		// classified so continuation lines of multi-line values are kept
+		if opts.DataOnly {
+			if kind := ClassifyStatement(stmt); kind != StatementData && kind != StatementStructural {
+				continue
+			}
+		}
+
+		lines := strings.Split(stmt, "\n")
+		var written []string
+		for _, line := range lines {
+			// Drop the content of internal tables that are not kept
+			if internal.skip(line) {
+				continue
+			}
+			line = internal.rewrite(line)
+
+			// Apply normalization for consistent cross-platform output
+			if normalize {
+				line = normalizeLine(line, opts.FloatPrecision)
+			}
+
+			if err := opts.sinks.writeLine(line, len(lines) == 1, tables); err != nil {
+				return err
+			}
+
+			// Rows as JSON objects; lines of multi-line values stay SQL
+			if jsonRows && len(lines) == 1 {
+				line = rowsToJSON(line, tables)
+			}
+
+			if opts.tableHashes != nil {
+				written = append(written, line)
+			}
+
+			// Use the technical I/O operation from sqlite engine
+			if err := eng.WriteWithTimeout(out, []byte(line+"\n"), "clean"); err != nil {
+				return err
 			}
-			return fmt.Errorf("error reading dump output: %w", readErr)
 		}
+		addTableHashes(opts.tableHashes, written)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading dump output: %w", err)
 	}
 
-	if err := cmd.Wait(); err != nil {
-		stderrOutput := stderr.String()
-		if stderrOutput != "" {
-			return fmt.Errorf("SQLite dump failed: %s: %w", stderrOutput, err)
+	if err := dump.Close(); err != nil {
+		return err
+	}
+	// Ends the progress line before warnings are printed
+	opts.Progress.Finish()
+	for table, n := range rows {
+		if !strings.HasPrefix(strings.ToLower(table), "sqlite_") {
+			opts.Summary.Rows(int64(n))
+			opts.replay.addRows(int64(n))
 		}
-		return fmt.Errorf("SQLite dump failed: %w", err)
 	}
+	if opts.sinks != nil {
+		opts.sinks.rows = rows
+	}
+	warnLargeTables(rows, rowOrder)
+	fixer.report()
+	redact.report(tables)
+	blobs.report()
+	idempotent.report()
 
 	slog.Debug("DumpTables completed successfully")
 	return nil
 }
 
-// DumpSchema dumps only schema (CREATE statements) from the database.
-// This function filters the SQLite dump to include only schema definitions.
-func DumpSchema(ctx context.Context, eng *sqlite.Engine, dbPath string, out io.Writer) error {
-	binaryPath, err := eng.GetBinPath()
+// startProgress starts reporting the progress of a dump of the database at
+// dbPath to p, with the number of tables and rows other than local tables
+// as the total. It does nothing if p is nil.
+func startProgress(ctx context.Context, eng *sqlite.Engine, dbPath string, p *progress.Reporter, local localTableFilter) error {
+	if p == nil {
+		return nil
+	}
+	db, err := stats.Collect(ctx, eng, dbPath, stats.Options{RowsOnly: true})
 	if err != nil {
 		return err
 	}
+	var tables int
+	var rows int64
+	for _, t := range db.Tables {
+		if !local[strings.ToLower(t.Name)] {
+			tables++
+			rows += t.Rows
+		}
+	}
+	p.Start(tables, rows)
+	return nil
+}
 
+// DumpSchema dumps only schema (CREATE statements) from the database.
+// This function filters the SQLite dump to include only schema definitions.
+func DumpSchema(ctx context.Context, eng *sqlite.Engine, dbPath string, out io.Writer, opts Options) error {
 	// Run .dump and stream output line by line
-	cmd := exec.CommandContext(ctx, binaryPath, dbPath, ".dump")
-	stdoutPipe, err := cmd.StdoutPipe()
+	dump, err := eng.OpenDump(ctx, dbPath)
 	if err != nil {
-		return fmt.Errorf("failed to get stdout pipe: %w", err)
+		return err
 	}
-	var stderr strings.Builder
-	cmd.Stderr = &stderr
+	defer dump.Close()
 
-	slog.Debug("Starting SQLite .dump command for schema")
-
-	if err := cmd.Start(); err != nil {
-		return fmt.Errorf("failed to start SQLite dump: %w", err)
+	if err := eng.WriteWithTimeout(out, []byte(DumpHeader), "schema"); err != nil {
+		return err
 	}
 
-	reader := bufio.NewReader(stdoutPipe)
-	var inCreateStatement bool
-
-	for {
-		line, readErr := reader.ReadString('\n')
-		if len(line) == 0 && readErr != nil {
-			break
+	scanner, err := newSchemaOrder(ctx, eng, dbPath, NewStatementScanner(dump), opts.schemaOrderPolicy())
+	if err != nil {
+		return err
+	}
+	defer scanner.Close()
+	header := &headerFilter{}
+	local := newLocalTableFilter(opts.LocalTables)
+	internal := newInternalTableFilter(opts.InternalTables)
+	fixer := &utf8Fixer{policy: opts.InvalidUTF8}
+	for scanner.Scan() {
+		stmt := scanner.Text()
+		if header.skip(stmt) || local.skip(stmt) {
+			continue
 		}
-		// Normalize line endings to LF only
-		line = strings.TrimRight(line, "\n")
-		line = strings.TrimRight(line, "\r")
 
-		// Apply logical filtering to exclude sqlite_sequence operations
-		if ShouldSkipLine(line) {
+		// Include schema and structural statements with all their lines
+		kind := ClassifyStatement(stmt)
+		if kind != StatementSchema && kind != StatementStructural {
 			continue
 		}
-
-		// Handle multi-line CREATE statements
-		trimmed := strings.TrimSpace(line)
-
-		// Check if we're starting a CREATE statement
-		if IsSchemaLine(line) {
-			inCreateStatement = true
+		if opts.CanonicalSchema && kind == StatementSchema {
+			stmt = CanonicalizeCreateTable(stmt)
 		}
+		stmt = fixer.fix(stmt)
+
+		for _, line := range strings.Split(stmt, "\n") {
+			// Drop the content of internal tables that are not kept
+			if internal.skip(line) {
+				continue
+			}
 
-		// Include line if it's a schema line, structural line, or we're inside a CREATE statement
-		if IsSchemaLine(line) || IsPragmaOrStructuralLine(line) || inCreateStatement {
 			// Use the technical I/O operation from sqlite engine
 			if err := eng.WriteWithTimeout(out, []byte(line+"\n"), "schema"); err != nil {
 				return err
 			}
 		}
-
-		// Check if we're ending a CREATE statement (line ends with semicolon)
-		if inCreateStatement && strings.HasSuffix(trimmed, ";") {
-			inCreateStatement = false
-		}
-
-		if readErr != nil {
-			if readErr == io.EOF {
-				break
-			}
-			return fmt.Errorf("error reading dump output: %w", readErr)
-		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading dump output: %w", err)
 	}
 
-	if err := cmd.Wait(); err != nil {
-		stderrOutput := stderr.String()
-		if stderrOutput != "" {
-			return fmt.Errorf("SQLite dump failed: %s: %w", stderrOutput, err)
-		}
-		return fmt.Errorf("SQLite dump failed: %w", err)
+	if err := dump.Close(); err != nil {
+		return err
 	}
 
+	fixer.report()
 	slog.Debug("DumpSchema completed successfully")
 	return nil
 }
@@ -0,0 +1,199 @@
+package filters
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/danielsiegl/gitsqlite/internal/sqlite"
+)
+
+// Export formats (export --format).
+const (
+	// ExportCSV writes comma-separated values.
+	ExportCSV = "csv"
+	// ExportTSV writes tab-separated values.
+	ExportTSV = "tsv"
+)
+
+// Export writes the rows of every table of the database at dbPath to a file
+// of its own in dir, named after the table with the format as extension,
+// and returns the names of the files written. The first line holds the
+// column names.
+//
+// The rows are those clean writes with opts, in the same order: local
+// tables, subset rules and redaction apply and floats are normalized, so
+// exports of databases with the same content are identical. Internal tables
+// are left out. NULL is written as an empty field, BLOBs in hexadecimal, and
+// values .dump writes as expressions other than text as the SQL expression.
+func Export(ctx context.Context, eng *sqlite.Engine, dbPath, dir, format string, opts Options) ([]string, error) {
+	if format != ExportCSV && format != ExportTSV {
+		return nil, fmt.Errorf("unknown export format '%s' (expected %s or %s)", format, ExportCSV, ExportTSV)
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	// The dump variant whose values can be read back as plain text
+	opts.DataOnly, opts.SchemaOutput, opts.AnnotateCounts, opts.CanonicalSchema = false, "", false, false
+	opts.InternalTables = nil
+	opts.DataFormat = DataFormatSQL
+	opts.InvalidUTF8, opts.ControlChars = UTF8Replace, ControlCharsKeep
+	opts.BlobThreshold, opts.BlobDir = 0, ""
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(DumpTables(ctx, eng, dbPath, pw, opts))
+	}()
+	// Stops the dump if the export fails first
+	defer pr.Close()
+
+	e := &exporter{dir: dir, format: format, tables: TableMap{}}
+	defer e.close()
+	scanner := NewStatementScanner(pr)
+	for scanner.Scan() {
+		if err := e.add(scanner.Text()); err != nil {
+			return nil, err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := e.close(); err != nil {
+		return nil, err
+	}
+	if e.expressions > 0 {
+		slog.Warn("Some values were exported as SQL expressions", "count", e.expressions)
+	}
+	return e.files, nil
+}
+
+// exporter writes the tables of a dump to files.
+type exporter struct {
+	dir, format string
+	tables      TableMap
+	files       []string
+	expressions int
+
+	// table is the lower-case name of the table being written.
+	table string
+	file  *os.File
+	buf   *bufio.Writer
+	w     *csv.Writer
+}
+
+// add writes stmt: a CREATE TABLE starts the file of the table, and its
+// INSERT statements add rows.
+func (e *exporter) add(stmt string) error {
+	stmt = stripLeadingComments(strings.TrimSpace(stmt))
+	if kind, name := schemaObjectName(stmt); kind == "table" {
+		e.tables.Observe(stmt)
+		table := e.tables.Lookup(name)
+		if table == nil {
+			return nil
+		}
+		return e.open(table)
+	}
+	if InsertTableName(stmt) == "" {
+		return nil
+	}
+	ins, err := ParseInsert(stmt)
+	if err != nil {
+		return fmt.Errorf("cannot export %.60q: %w", stmt, err)
+	}
+	if !strings.EqualFold(ins.Table, e.table) {
+		// Rows of tables without a CREATE TABLE, such as virtual tables
+		return nil
+	}
+	for _, row := range ins.Rows {
+		record := make([]string, len(row))
+		for i, span := range row {
+			record[i] = e.value(ins, span)
+		}
+		if err := e.w.Write(record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// open closes the current file and starts the one of table with its
+// column names.
+func (e *exporter) open(table *TableInfo) error {
+	if err := e.close(); err != nil {
+		return err
+	}
+	name := exportFileName(table.Name) + "." + e.format
+	f, err := os.Create(filepath.Join(e.dir, name))
+	if err != nil {
+		return err
+	}
+	e.table, e.file, e.buf = strings.ToLower(table.Name), f, bufio.NewWriterSize(f, 64*1024)
+	e.w = csv.NewWriter(e.buf)
+	if e.format == ExportTSV {
+		e.w.Comma = '\t'
+	}
+	e.files = append(e.files, name)
+	return e.w.Write(table.Columns)
+}
+
+// close finishes the current file; it may be called more than once.
+func (e *exporter) close() error {
+	if e.file == nil {
+		return nil
+	}
+	e.w.Flush()
+	err := e.w.Error()
+	if err == nil {
+		err = e.buf.Flush()
+	}
+	if cerr := e.file.Close(); err == nil {
+		err = cerr
+	}
+	e.table, e.file = "", nil
+	return err
+}
+
+// value returns the text of a value of ins.
+func (e *exporter) value(ins *Insert, span Span) string {
+	var sig []Token
+	for _, t := range ins.Tokens[span.Start:span.End] {
+		if t.Kind != TokenSpace && t.Kind != TokenComment {
+			sig = append(sig, t)
+		}
+	}
+	text := ins.Value(span)
+	switch {
+	case len(sig) == 1 && sig[0].Is("NULL"):
+		return ""
+	case len(sig) == 1 && sig[0].Kind == TokenBlob:
+		return text[2 : len(text)-1]
+	case len(sig) == 1 && sig[0].Kind == TokenNumber, len(sig) == 2 && sig[0].Text == "-" && sig[1].Kind == TokenNumber:
+		return text
+	}
+	if s, n, ok := decodeText(sig); ok && n == len(sig) {
+		return s
+	}
+	e.expressions++
+	return text
+}
+
+// exportFileName returns name with the characters that are not safe in file
+// names on all platforms escaped as %XX.
+func exportFileName(name string) string {
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c >= 0x80 || c == '-' || c == '_' || c == '.' && i > 0 || isDigit(c) || c|0x20 >= 'a' && c|0x20 <= 'z' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
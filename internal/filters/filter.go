@@ -1,74 +1,109 @@
 package filters
 
-import "strings"
+// StatementKind classifies an SQL statement for schema/data separation.
+type StatementKind int
 
-// ShouldSkipLine determines if a line should be skipped during dump filtering.
-// This function implements the logic to exclude sqlite_sequence table operations
-// from dumps to ensure consistent cross-platform behavior.
-func ShouldSkipLine(line string) bool {
-	// Skip CREATE TABLE sqlite_sequence line (with or without IF NOT EXISTS)
-	if strings.Contains(line, "CREATE TABLE") && strings.Contains(line, "sqlite_sequence") {
-		return true
-	}
-	// Skip INSERT INTO sqlite_sequence lines
-	if strings.Contains(line, "INSERT INTO sqlite_sequence") || strings.Contains(line, "INSERT INTO \"sqlite_sequence\"") {
-		return true
-	}
-	// Skip DELETE FROM sqlite_sequence;
-	if strings.Contains(line, "DELETE FROM sqlite_sequence") || strings.Contains(line, "DELETE FROM \"sqlite_sequence\"") {
-		return true
-	}
-	// Skip PRAGMA writable_schema (used when creating sqlite_sequence)
-	if strings.Contains(line, "PRAGMA writable_schema") {
-		return true
+const (
+	// StatementOther is any statement not covered by the other kinds
+	// (e.g. SELECT, or a continuation line of a multi-line statement).
+	StatementOther StatementKind = iota
+	// StatementEmpty is blank text or text consisting only of comments.
+	StatementEmpty
+	// StatementSchema creates or changes schema objects: CREATE [TEMP]
+	// TABLE/INDEX/VIEW/TRIGGER/VIRTUAL TABLE, ALTER, DROP and ANALYZE.
+	StatementSchema
+	// StatementData modifies rows: INSERT, REPLACE, UPDATE and DELETE,
+	// including INSERT ... SELECT and WITH ... INSERT.
+	StatementData
+	// StatementStructural controls the session: PRAGMA and transaction
+	// statements (BEGIN, COMMIT, END, ROLLBACK, SAVEPOINT, RELEASE).
+	StatementStructural
+)
+
+// ClassifyStatement determines the kind of a complete SQL statement (or of
+// the first line of one). Keywords are matched case-insensitively and leading
+// whitespace and comments are ignored. Only the leading tokens are examined,
+// so classifying a large INSERT statement is cheap.
+func ClassifyStatement(stmt string) StatementKind {
+	next := leadingTokens(stmt)
+	first := next()
+	switch {
+	case first.Text == "":
+		return StatementEmpty
+	case first.Is("CREATE"):
+		word := next()
+		if word.Is("TEMP") || word.Is("TEMPORARY") {
+			word = next()
+		}
+		if word.Is("UNIQUE") || word.Is("VIRTUAL") {
+			word = next()
+		}
+		if word.Is("TABLE") || word.Is("INDEX") || word.Is("VIEW") || word.Is("TRIGGER") {
+			return StatementSchema
+		}
+		return StatementOther
+	case first.Is("ALTER"), first.Is("DROP"), first.Is("ANALYZE"):
+		return StatementSchema
+	case first.Is("INSERT"), first.Is("REPLACE"), first.Is("UPDATE"), first.Is("DELETE"):
+		return StatementData
+	case first.Is("WITH"):
+		// A common table expression prefixes the actual statement; find the
+		// first statement keyword outside the CTE parentheses.
+		depth := 0
+		for tok := next(); tok.Text != ""; tok = next() {
+			switch {
+			case tok.Text == "(":
+				depth++
+			case tok.Text == ")":
+				depth--
+			case depth > 0:
+			case tok.Is("INSERT"), tok.Is("REPLACE"), tok.Is("UPDATE"), tok.Is("DELETE"):
+				return StatementData
+			case tok.Is("SELECT"), tok.Is("VALUES"):
+				return StatementOther
+			}
+		}
+		return StatementOther
+	case first.Is("PRAGMA"), first.Is("BEGIN"), first.Is("COMMIT"), first.Is("END"),
+		first.Is("ROLLBACK"), first.Is("SAVEPOINT"), first.Is("RELEASE"):
+		return StatementStructural
 	}
-	return false
+	return StatementOther
 }
 
-// IsSchemaLine determines if a line contains schema definition statements.
-// These are CREATE TABLE, CREATE INDEX, CREATE VIEW, etc.
-func IsSchemaLine(line string) bool {
-	trimmed := strings.TrimSpace(line)
-	if trimmed == "" {
-		return false
+// leadingTokens returns a function yielding the significant (non-space,
+// non-comment) tokens of stmt one at a time, and an empty token at the end.
+func leadingTokens(stmt string) func() Token {
+	i := 0
+	return func() Token {
+		for i < len(stmt) {
+			var tok Token
+			tok, i = nextToken(stmt, i)
+			if tok.Kind != TokenSpace && tok.Kind != TokenComment {
+				return tok
+			}
+		}
+		return Token{}
 	}
+}
 
-	// Schema statements
-	return strings.HasPrefix(trimmed, "CREATE TABLE") ||
-		strings.HasPrefix(trimmed, "CREATE INDEX") ||
-		strings.HasPrefix(trimmed, "CREATE UNIQUE INDEX") ||
-		strings.HasPrefix(trimmed, "CREATE VIEW") ||
-		strings.HasPrefix(trimmed, "CREATE TRIGGER") ||
-		strings.HasPrefix(trimmed, "CREATE VIRTUAL TABLE")
+// IsSchemaLine reports whether a statement creates or changes schema objects
+// (see StatementSchema). It accepts a complete statement or its first line.
+func IsSchemaLine(line string) bool {
+	return ClassifyStatement(line) == StatementSchema
 }
 
-// IsDataLine determines if a line contains data manipulation statements.
-// These are INSERT, UPDATE, DELETE statements.
+// IsDataLine reports whether a statement modifies rows (see StatementData).
+// It accepts a complete statement or its first line; continuation lines of a
+// multi-line statement are not data lines on their own, so callers filtering
+// dumps should classify whole statements.
 func IsDataLine(line string) bool {
-	trimmed := strings.TrimSpace(line)
-	if trimmed == "" {
-		return false
-	}
-
-	// Data manipulation statements
-	return strings.HasPrefix(trimmed, "INSERT INTO") ||
-		strings.HasPrefix(trimmed, "UPDATE ") ||
-		strings.HasPrefix(trimmed, "DELETE FROM")
+	return ClassifyStatement(line) == StatementData
 }
 
-// IsPragmaOrStructuralLine determines if a line is a structural SQL statement
-// that should be included in both schema and data outputs.
+// IsPragmaOrStructuralLine reports whether a statement is a PRAGMA or
+// transaction statement that belongs in both schema and data outputs
+// (see StatementStructural).
 func IsPragmaOrStructuralLine(line string) bool {
-	trimmed := strings.TrimSpace(line)
-	if trimmed == "" {
-		return false
-	}
-
-	// Structural statements that should be in both
-	return strings.HasPrefix(trimmed, "PRAGMA") ||
-		strings.HasPrefix(trimmed, "BEGIN") ||
-		strings.HasPrefix(trimmed, "COMMIT") ||
-		strings.HasPrefix(trimmed, "ROLLBACK") ||
-		trimmed == "BEGIN TRANSACTION;" ||
-		trimmed == "COMMIT;"
+	return ClassifyStatement(line) == StatementStructural
 }
@@ -0,0 +1,1852 @@
+package filters
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/danielsiegl/gitsqlite/internal/errs"
+	"github.com/danielsiegl/gitsqlite/internal/sqlite"
+	"github.com/danielsiegl/gitsqlite/internal/summary"
+	"github.com/danielsiegl/gitsqlite/internal/warnings"
+	_ "modernc.org/sqlite"
+)
+
+func TestClassifyStatement(t *testing.T) {
+	tests := []struct {
+		name string
+		stmt string
+		want StatementKind
+	}{
+		// Empty
+		{"empty", "", StatementEmpty},
+		{"whitespace", "  \t ", StatementEmpty},
+		{"line comment", "-- rows: 3", StatementEmpty},
+		{"block comment", "/* note */", StatementEmpty},
+
+		// Schema
+		{"create table", "CREATE TABLE t(id INTEGER);", StatementSchema},
+		{"create table lower case", "create table t(id integer);", StatementSchema},
+		{"create table if not exists", "CREATE TABLE IF NOT EXISTS t(id);", StatementSchema},
+		{"create temp table", "CREATE TEMP TABLE t(id);", StatementSchema},
+		{"create temporary view", "CREATE TEMPORARY VIEW v AS SELECT 1;", StatementSchema},
+		{"create index", "CREATE INDEX ix ON t(a);", StatementSchema},
+		{"create unique index", "CREATE UNIQUE INDEX ix ON t(a);", StatementSchema},
+		{"create view", "CREATE VIEW v AS SELECT * FROM t;", StatementSchema},
+		{"create trigger", "CREATE TRIGGER tr AFTER INSERT ON t BEGIN INSERT INTO u VALUES(1); END;", StatementSchema},
+		{"create virtual table", "CREATE VIRTUAL TABLE f USING fts5(body);", StatementSchema},
+		{"multi-line create table", "CREATE TABLE t(\n  a INT,\n  b TEXT\n);", StatementSchema},
+		{"leading comment", "-- table t\nCREATE TABLE t(a);", StatementSchema},
+		{"leading whitespace", "   CREATE TABLE t(a);", StatementSchema},
+		{"alter table", "ALTER TABLE t ADD COLUMN c;", StatementSchema},
+		{"drop table", "DROP TABLE t;", StatementSchema},
+		{"analyze", "ANALYZE sqlite_schema;", StatementSchema},
+		{"create unknown object", "CREATE SOMETHING x;", StatementOther},
+
+		// Data
+		{"insert", "INSERT INTO t VALUES(1,'a');", StatementData},
+		{"insert lower case", "insert into t values(1);", StatementData},
+		{"insert quoted table", `INSERT INTO "my table" VALUES(1);`, StatementData},
+		{"insert or replace", "INSERT OR REPLACE INTO t VALUES(1);", StatementData},
+		{"replace into", "REPLACE INTO t VALUES(1);", StatementData},
+		{"upsert", "INSERT INTO t VALUES(1,'a') ON CONFLICT(id) DO UPDATE SET v=excluded.v;", StatementData},
+		{"insert or ignore lower case", "insert or ignore into main.t values(1);", StatementData},
+		{"insert select", "INSERT INTO t SELECT * FROM u;", StatementData},
+		{"insert nested parens", "INSERT INTO t VALUES((1+(2*3)),'(x)');", StatementData},
+		{"insert multi-line value", "INSERT INTO t VALUES(1,'line one\nline two');", StatementData},
+		{"update", "UPDATE t SET a=1;", StatementData},
+		{"delete", "DELETE FROM t;", StatementData},
+		{"with insert", "WITH x(v) AS (SELECT 1) INSERT INTO t SELECT v FROM x;", StatementData},
+		{"with recursive insert", "WITH RECURSIVE c(n) AS (SELECT 1 UNION ALL SELECT n+1 FROM c WHERE n<3) INSERT INTO t SELECT n FROM c;", StatementData},
+		{"with select", "WITH x AS (SELECT 1) SELECT * FROM x;", StatementOther},
+		{"with insert keyword inside cte", "WITH x AS (SELECT 'INSERT' AS s) SELECT * FROM x;", StatementOther},
+
+		// Structural
+		{"pragma", "PRAGMA foreign_keys=OFF;", StatementStructural},
+		{"pragma lower case", "pragma foreign_keys=off;", StatementStructural},
+		{"begin transaction", "BEGIN TRANSACTION;", StatementStructural},
+		{"begin immediate", "BEGIN IMMEDIATE;", StatementStructural},
+		{"begin", "BEGIN;", StatementStructural},
+		{"commit", "COMMIT;", StatementStructural},
+		{"end transaction", "END TRANSACTION;", StatementStructural},
+		{"rollback", "ROLLBACK;", StatementStructural},
+		{"savepoint", "SAVEPOINT s1;", StatementStructural},
+		{"release", "RELEASE s1;", StatementStructural},
+
+		// Other
+		{"select", "SELECT 1;", StatementOther},
+		{"continuation line", "line two');", StatementOther},
+		{"string mentioning insert", "'INSERT INTO t VALUES(1)'", StatementOther},
+		{"identifier prefix", "INSERTED_ROWS;", StatementOther},
+		{"quoted keyword", `"INSERT" INTO t;`, StatementOther},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := ClassifyStatement(tt.stmt); got != tt.want {
+				t.Errorf("ClassifyStatement(%q) = %d, want %d", tt.stmt, got, tt.want)
+			}
+			if got := IsSchemaLine(tt.stmt); got != (tt.want == StatementSchema) {
+				t.Errorf("IsSchemaLine(%q) = %v", tt.stmt, got)
+			}
+			if got := IsDataLine(tt.stmt); got != (tt.want == StatementData) {
+				t.Errorf("IsDataLine(%q) = %v", tt.stmt, got)
+			}
+			if got := IsPragmaOrStructuralLine(tt.stmt); got != (tt.want == StatementStructural) {
+				t.Errorf("IsPragmaOrStructuralLine(%q) = %v", tt.stmt, got)
+			}
+		})
+	}
+}
+
+func TestClassifyDumpStatements(t *testing.T) {
+	// Older sqlite3 versions write newlines inside strings verbatim, so a
+	// single INSERT spans several lines. Classifying statements (not lines)
+	// must keep every line of it in data-only output.
+	dump := "PRAGMA foreign_keys=OFF;\n" +
+		"BEGIN TRANSACTION;\n" +
+		"CREATE TABLE t(\n  id INTEGER PRIMARY KEY,\n  body TEXT\n);\n" +
+		"INSERT INTO t VALUES(1,'first\nCREATE TABLE not_a_table(x);\nlast');\n" +
+		"CREATE INDEX ix ON t(body);\n" +
+		"COMMIT;\n"
+
+	var data, schema []string
+	scanner := NewStatementScanner(strings.NewReader(dump))
+	for scanner.Scan() {
+		stmt := scanner.Text()
+		switch ClassifyStatement(stmt) {
+		case StatementData:
+			data = append(data, stmt)
+		case StatementSchema:
+			schema = append(schema, stmt)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	wantData := []string{"INSERT INTO t VALUES(1,'first\nCREATE TABLE not_a_table(x);\nlast');"}
+	if strings.Join(data, "|") != strings.Join(wantData, "|") {
+		t.Errorf("data statements = %q, want %q", data, wantData)
+	}
+	wantSchema := []string{
+		"CREATE TABLE t(\n  id INTEGER PRIMARY KEY,\n  body TEXT\n);",
+		"CREATE INDEX ix ON t(body);",
+	}
+	if strings.Join(schema, "|") != strings.Join(wantSchema, "|") {
+		t.Errorf("schema statements = %q, want %q", schema, wantSchema)
+	}
+}
+
+func TestSchemaObjectTable(t *testing.T) {
+	tests := []struct {
+		stmt string
+		want string
+	}{
+		{"CREATE TABLE t(a);", "t"},
+		{`CREATE TABLE IF NOT EXISTS "my table"(a);`, "my table"},
+		{"CREATE TEMP TABLE main.t(a);", "t"},
+		{"CREATE VIRTUAL TABLE f USING fts5(body);", "f"},
+		{"CREATE INDEX ix ON t(a);", "t"},
+		{"CREATE UNIQUE INDEX IF NOT EXISTS ix ON [t](a);", "t"},
+		{"CREATE TRIGGER tr AFTER INSERT ON t BEGIN INSERT INTO u VALUES(1); END;", "t"},
+		{"CREATE TRIGGER tr BEFORE UPDATE OF a, b ON main.t BEGIN SELECT 1; END;", "t"},
+		{"CREATE VIEW v AS SELECT * FROM t;", ""},
+		{"INSERT INTO t VALUES(1);", ""},
+	}
+	for _, tt := range tests {
+		if got := SchemaObjectTable(tt.stmt); got != tt.want {
+			t.Errorf("SchemaObjectTable(%q) = %q, want %q", tt.stmt, got, tt.want)
+		}
+	}
+}
+
+func TestInsertTableName(t *testing.T) {
+	tests := []struct {
+		stmt string
+		want string
+	}{
+		{"INSERT INTO t VALUES(1);", "t"},
+		{`INSERT INTO "my table" VALUES(1);`, "my table"},
+		{"INSERT INTO [t](a) VALUES(1);", "t"},
+		{"INSERT INTO main.t VALUES(1);", "t"},
+		{"insert into t values(1);", "t"},
+		{"INSERT OR REPLACE INTO t VALUES(1);", "t"},
+		{"insert or ignore into \"t\"(a) values(1);", "t"},
+		{"REPLACE INTO main.[t] VALUES(1);", "t"},
+		{"INSERT INTO 'ft_data' VALUES(1,X'00');", "ft_data"},
+		{"INSERT INTO t VALUES(1,'a') ON CONFLICT(id) DO UPDATE SET v=excluded.v;", "t"},
+		{"  -- imported\nINSERT OR ABORT INTO t SELECT * FROM u;", "t"},
+		{"CREATE TABLE t(a);", ""},
+		{"UPDATE t SET a=1;", ""},
+		{"INSERTED;", ""},
+	}
+	for _, tt := range tests {
+		if got := InsertTableName(tt.stmt); got != tt.want {
+			t.Errorf("InsertTableName(%q) = %q, want %q", tt.stmt, got, tt.want)
+		}
+	}
+}
+
+func TestParseInsertForms(t *testing.T) {
+	tests := []struct {
+		stmt     string
+		conflict string
+		upsert   bool
+	}{
+		{"INSERT INTO t VALUES(1,'a');", "", false},
+		{"insert or replace into t values(1,'a');", "REPLACE", false},
+		{"REPLACE INTO t(id,v) VALUES(1,'a');", "REPLACE", false},
+		{"INSERT INTO t AS x VALUES(1,'a') ON CONFLICT(id) DO UPDATE SET v=excluded.v WHERE x.v<>excluded.v;", "", true},
+		{"INSERT INTO t VALUES(1,'a') RETURNING id;", "", true},
+	}
+	for _, tt := range tests {
+		ins, err := ParseInsert(tt.stmt)
+		if err != nil {
+			t.Errorf("ParseInsert(%q): %v", tt.stmt, err)
+			continue
+		}
+		if ins.Table != "t" || len(ins.Rows) != 1 || ins.Value(ins.Rows[0][1]) != "'a'" {
+			t.Errorf("ParseInsert(%q) = table %q, rows %v", tt.stmt, ins.Table, ins.Rows)
+		}
+		if ins.Conflict != tt.conflict || ins.Upsert != tt.upsert || ins.Plain() != (tt.conflict == "" && !tt.upsert) {
+			t.Errorf("ParseInsert(%q): Conflict %q, Upsert %v", tt.stmt, ins.Conflict, ins.Upsert)
+		}
+		if ins.String() != tt.stmt {
+			t.Errorf("ParseInsert(%q).String() = %q", tt.stmt, ins.String())
+		}
+	}
+
+	// Local tables are dropped whatever form their rows are written in
+	local := newLocalTableFilter([]string{"cache"})
+	for _, stmt := range []string{"INSERT OR REPLACE INTO cache VALUES(1);", "replace into main.cache values(1);"} {
+		if !local.skip(stmt) {
+			t.Errorf("local table filter keeps %q", stmt)
+		}
+	}
+}
+
+func TestPrimaryKeyIndexes(t *testing.T) {
+	tests := []struct {
+		stmt string
+		want []int
+	}{
+		{"CREATE TABLE t(a, b INTEGER PRIMARY KEY, c)", []int{1}},
+		{"CREATE TABLE t(b TEXT, a INT, PRIMARY KEY(a DESC, \"b\")) WITHOUT ROWID", []int{1, 0}},
+		{"CREATE TABLE t(a, b)", nil},
+	}
+	for _, tt := range tests {
+		ct, err := ParseCreateTable(tt.stmt)
+		if err != nil {
+			t.Fatalf("ParseCreateTable(%q): %v", tt.stmt, err)
+		}
+		got := primaryKeyIndexes(ct)
+		if len(got) != len(tt.want) {
+			t.Errorf("primaryKeyIndexes(%q) = %v, want %v", tt.stmt, got, tt.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("primaryKeyIndexes(%q) = %v, want %v", tt.stmt, got, tt.want)
+				break
+			}
+		}
+	}
+}
+
+func TestKeyOrder(t *testing.T) {
+	tests := []struct {
+		stmt string
+		want string
+	}{
+		{"CREATE TABLE t(id INTEGER PRIMARY KEY, v)", ""},
+		{"CREATE TABLE t(id INT PRIMARY KEY, v)", "id"},
+		{"CREATE TABLE t(code TEXT PRIMARY KEY, v)", "code"},
+		{"CREATE TABLE t(a, [b c], PRIMARY KEY([b c], a))", "b c,a"},
+		{"CREATE TABLE t(a TEXT PRIMARY KEY, b) WITHOUT ROWID", ""},
+		{"CREATE TABLE t(a, b)", ""},
+	}
+	for _, tt := range tests {
+		ct, err := ParseCreateTable(tt.stmt)
+		if err != nil {
+			t.Fatalf("ParseCreateTable(%q): %v", tt.stmt, err)
+		}
+		if got := strings.Join(keyOrder(ct), ","); got != tt.want {
+			t.Errorf("keyOrder(%q) = %q, want %q", tt.stmt, got, tt.want)
+		}
+	}
+}
+
+func TestParseRedactRules(t *testing.T) {
+	rules, err := ParseRedactRules(`users.email=hash, "my.table".Token = DROP`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []RedactRule{{"users", "email", RedactHash}, {"my.table", "Token", RedactDrop}}
+	if len(rules) != len(want) || rules[0] != want[0] || rules[1] != want[1] {
+		t.Errorf("ParseRedactRules = %v, want %v", rules, want)
+	}
+	for _, bad := range []string{"users=hash", "users.email", "users.email=mask", "a.b=hash,A.B=drop"} {
+		if _, err := ParseRedactRules(bad); err == nil {
+			t.Errorf("ParseRedactRules(%q): expected error", bad)
+		}
+	}
+}
+
+func TestRedactorApply(t *testing.T) {
+	tables := TableMap{}
+	tables.Observe("CREATE TABLE users(id INTEGER PRIMARY KEY, g AS (id*2), email TEXT, token TEXT)")
+	r := newRedactor([]RedactRule{{"users", "email", RedactHash}, {"users", "token", RedactDrop}}, 9)
+	tests := []struct{ in, want string }{
+		{"INSERT INTO users VALUES(1,'a@x.com','s');", "INSERT INTO users VALUES(1,'595b1a2124b525b2',NULL);"},
+		{"INSERT INTO users(token,id) VALUES('s',2);", "INSERT INTO users(token,id) VALUES(NULL,2);"},
+		{"INSERT INTO users VALUES(3,NULL,NULL);", "INSERT INTO users VALUES(3,NULL,NULL);"},
+		{"INSERT INTO other VALUES(1,'a@x.com','s');", "INSERT INTO other VALUES(1,'a@x.com','s');"},
+	}
+	for _, tt := range tests {
+		if got := r.apply(tt.in, tables); got != tt.want {
+			t.Errorf("apply(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestCanonicalizeControlChars(t *testing.T) {
+	tests := []struct{ in, want string }{
+		// sqlite3 before 3.34: raw line breaks
+		{"INSERT INTO t VALUES(1,'a\r\nb');", "INSERT INTO t VALUES(1,'a'||char(13,10)||'b');"},
+		// sqlite3 3.34 to 3.49
+		{`INSERT INTO t VALUES(1,replace(replace('a\r\nb','\r',char(13)),'\n',char(10)));`, "INSERT INTO t VALUES(1,'a'||char(13,10)||'b');"},
+		{`INSERT INTO t VALUES(1,replace('it''s\012','\012',char(10)));`, "INSERT INTO t VALUES(1,'it''s'||char(10));"},
+		// sqlite3 3.50 and the embedded engine
+		{`INSERT INTO t VALUES(1,unistr('a\u000d\u000ab\\'));`, "INSERT INTO t VALUES(1,'a'||char(13,10)||'b\\');"},
+		{`INSERT INTO t VALUES(1,unistr('\u00e9'),'plain',X'0a');`, `INSERT INTO t VALUES(1,unistr('\u00e9'),'plain',X'0a');`},
+		{"CREATE TABLE t(a DEFAULT 'x\ny');", "CREATE TABLE t(a DEFAULT 'x\ny');"},
+	}
+	for _, tt := range tests {
+		if got := CanonicalizeControlChars(tt.in); got != tt.want {
+			t.Errorf("CanonicalizeControlChars(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestHoldsReals(t *testing.T) {
+	tests := []struct {
+		stmt string
+		want bool
+	}{
+		{"CREATE TABLE t(id INTEGER PRIMARY KEY, name TEXT, note VARCHAR(10))", false},
+		{"CREATE TABLE t(id INTEGER, name TEXT, PRIMARY KEY(id))", false},
+		{"CREATE TABLE t(id INT PRIMARY KEY, name TEXT)", true},
+		{"CREATE TABLE t(name TEXT, v)", true},
+		{"CREATE TABLE t(k TEXT PRIMARY KEY, n INTEGER) WITHOUT ROWID", true},
+		{"CREATE TABLE t(id INTEGER PRIMARY KEY, n INT, s TEXT) STRICT", false},
+		{"CREATE TABLE t(id INTEGER PRIMARY KEY, v ANY) STRICT", true},
+	}
+	for _, tt := range tests {
+		ct, err := ParseCreateTable(tt.stmt)
+		if err != nil {
+			t.Fatalf("ParseCreateTable(%q): %v", tt.stmt, err)
+		}
+		if got := ct.Info().HoldsReals; got != tt.want {
+			t.Errorf("HoldsReals(%q) = %v, want %v", tt.stmt, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizersAgree(t *testing.T) {
+	lines := []string{
+		"INSERT INTO t VALUES(1,2.5,-0.125,'v1.2.3',X'00');",
+		"INSERT INTO t VALUES(1.5e+10,-9.0e+999,'a-1.5','--2.0','1.','.5','x.1','12.34.56.78');",
+		"INSERT INTO t VALUES(123456789012345678901234567890.123456789012345,'ü1.5é',1-2.5);",
+		"INSERT INTO t VALUES(1,2,3);",
+		"CREATE TABLE t(v REAL DEFAULT 1.5);",
+		"INSERT INTO t VALUES(9.",
+		"INSERT INTO t VALUES(-",
+	}
+	for _, line := range lines {
+		for _, precision := range []int{0, 3, 9} {
+			fast, regex := NormalizeLine(line, precision), NormalizeLineRegex(line, precision)
+			if fast != regex {
+				t.Errorf("precision %d: NormalizeLine(%q) = %q, regex gives %q", precision, line, fast, regex)
+			}
+		}
+	}
+}
+
+func TestNormalizeLineSkipsLiterals(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"INSERT INTO t VALUES(1,'3.14159 notes',-2.5,1.5e+10);", "INSERT INTO t VALUES(1,'3.14159 notes',-2.500,1.500e+10);"},
+		{`INSERT INTO "v1.5"("c2.5") VALUES(unistr('1.5\u000a'),0.25,X'1.5');`, `INSERT INTO "v1.5"("c2.5") VALUES(unistr('1.5\u000a'),0.250,X'1.5');`},
+		{"INSERT INTO t VALUES(1,'multi", "INSERT INTO t VALUES(1,'multi"},
+		{"INSERT INTO t VALUES(/* 1.5 */ 2.5);", "INSERT INTO t VALUES(/* 1.5 */ 2.500);"},
+	}
+	for _, tt := range tests {
+		for name, normalize := range map[string]func(string, int) string{"fast": NormalizeLine, "regex": NormalizeLineRegex} {
+			if got := normalize(tt.in, 3); got != tt.want {
+				t.Errorf("%s: NormalizeLine(%q) = %q, want %q", name, tt.in, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestNormalizeRealColumns(t *testing.T) {
+	tables := TableMap{}
+	tables.Observe("CREATE TABLE m(id INTEGER PRIMARY KEY, price REAL, qty INTEGER, label TEXT, ratio DOUBLE, raw);")
+	tables.Observe("CREATE TABLE n(id INTEGER PRIMARY KEY, label TEXT);")
+	tests := []struct {
+		name, in, want string
+	}{
+		{"integral real", "INSERT INTO m VALUES(1,2,3,'4',-5,6);", "INSERT INTO m VALUES(1,2.000,3,'4',-5.000,6);"},
+		{"real kept", "INSERT INTO m VALUES(1,2.5,3,'4',0.125,6);", "INSERT INTO m VALUES(1,2.5,3,'4',0.125,6);"},
+		{"null and text in real", "INSERT INTO m VALUES(1,NULL,3,'4','7',6);", "INSERT INTO m VALUES(1,NULL,3,'4','7',6);"},
+		{"column list", "INSERT INTO m(ratio,qty,price) VALUES(7,8,+9);", "INSERT INTO m(ratio,qty,price) VALUES(7.000,8,9.000);"},
+		{"several rows", "INSERT INTO m VALUES(1,2,3,'4',5,6),(2,10,3,'4',0.5,6);", "INSERT INTO m VALUES(1,2.000,3,'4',5.000,6),(2,10.000,3,'4',0.5,6);"},
+		{"table without reals", "INSERT INTO n VALUES(1,'2');", "INSERT INTO n VALUES(1,'2');"},
+		{"unknown table", "INSERT INTO x VALUES(1,2);", "INSERT INTO x VALUES(1,2);"},
+		{"not an insert", "UPDATE m SET price = 2;", "UPDATE m SET price = 2;"},
+	}
+	for _, tt := range tests {
+		if got := NormalizeRealColumns(tt.in, tables, 3); got != tt.want {
+			t.Errorf("%s: NormalizeRealColumns(%q) = %q, want %q", tt.name, tt.in, got, tt.want)
+		}
+	}
+}
+
+func benchmarkNormalizer(b *testing.B, normalize func(string, int) string) {
+	lines := []string{
+		"INSERT INTO measurements VALUES(1,'sensor-17',23.5,0.000123,-87.25,1699999999,'ok');",
+		"INSERT INTO notes VALUES(2,'Some body text with words and more words, nothing numeric here at all');",
+	}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for _, line := range lines {
+			normalize(line, 9)
+		}
+	}
+}
+
+func BenchmarkNormalizeLineFast(b *testing.B)  { benchmarkNormalizer(b, NormalizeLine) }
+func BenchmarkNormalizeLineRegex(b *testing.B) { benchmarkNormalizer(b, NormalizeLineRegex) }
+
+func TestSortValueOrder(t *testing.T) {
+	// Ascending in SQLite's order: NULL, numbers, text, blobs
+	values := []string{"NULL", "-3", "2", "2.5", "10", "99999999999999999", "'10'", "'a''b'", "'b'", "X'00'"}
+	for i := 0; i+1 < len(values); i++ {
+		a, b := parseSortValue(values[i]), parseSortValue(values[i+1])
+		if a.compare(b) >= 0 || b.compare(a) <= 0 {
+			t.Errorf("%s should sort before %s", values[i], values[i+1])
+		}
+	}
+}
+
+func TestEnsureUTF8(t *testing.T) {
+	tests := []struct {
+		name    string
+		stmt    string
+		policy  string
+		want    string
+		changed bool
+	}{
+		{"valid", "INSERT INTO t VALUES('é');", UTF8Escape, "INSERT INTO t VALUES('é');", false},
+		{"escape", "INSERT INTO t VALUES('ab\xffc',1);", UTF8Escape, "INSERT INTO t VALUES(CAST(X'6162FF63' AS TEXT),1);", true},
+		{"escape quotes", "INSERT INTO t VALUES('''\xfe''');", UTF8Escape, "INSERT INTO t VALUES(CAST(X'27FE27' AS TEXT));", true},
+		{"escape truncated sequence", "INSERT INTO t VALUES('\xc3');", UTF8Escape, "INSERT INTO t VALUES(CAST(X'C3' AS TEXT));", true},
+		{"inside unistr", "INSERT INTO t VALUES(unistr('\xff\\u000a'));", UTF8Escape, "INSERT INTO t VALUES(unistr(CAST(X'FF5C7530303061' AS TEXT)));", true},
+		{"replace", "INSERT INTO t VALUES('ab\xffc');", UTF8Replace, "INSERT INTO t VALUES('ab\uFFFDc');", true},
+		{"schema is replaced", "CREATE TABLE t(a DEFAULT 'x\xff');", UTF8Escape, "CREATE TABLE t(a DEFAULT 'x\uFFFD');", true},
+		{"identifier is replaced", "INSERT INTO \"t\xff\" VALUES(1);", UTF8Escape, "INSERT INTO \"t\uFFFD\" VALUES(1);", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, changed := EnsureUTF8(tt.stmt, tt.policy)
+			if got != tt.want || changed != tt.changed {
+				t.Errorf("EnsureUTF8(%q, %s) = %q, %v; want %q, %v", tt.stmt, tt.policy, got, changed, tt.want, tt.changed)
+			}
+		})
+	}
+}
+
+func TestNormalizeDialectDropsBOM(t *testing.T) {
+	out, err := io.ReadAll(NormalizeDialect(strings.NewReader("\uFEFFBEGIN;\nCREATE TABLE t(a);\nCOMMIT;\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "BEGIN TRANSACTION;\nCREATE TABLE t(a);\nCOMMIT;\n"; string(out) != want {
+		t.Errorf("NormalizeDialect = %q, want %q", out, want)
+	}
+}
+
+// endlessDump is an input that never ends, counting the reads of it.
+type endlessDump struct{ reads atomic.Int64 }
+
+func (d *endlessDump) Read(p []byte) (int, error) {
+	d.reads.Add(1)
+	return copy(p, "INSERT INTO t VALUES(1);\n"), nil
+}
+
+func TestNormalizeDialectClose(t *testing.T) {
+	in := &endlessDump{}
+	r := NormalizeDialect(in)
+	if _, err := io.ReadFull(r, make([]byte, 1000)); err != nil {
+		t.Fatal(err)
+	}
+	// A restore that stops early does not leave the input being read
+	r.Close()
+	reads := in.reads.Load()
+	time.Sleep(20 * time.Millisecond)
+	if n := in.reads.Load(); n != reads {
+		t.Errorf("input read %d more times after Close", n-reads)
+	}
+}
+
+func TestFirstDifference(t *testing.T) {
+	tests := []struct {
+		a, b       string
+		line       int
+		orig, rest string
+	}{
+		{"x\ny\n", "x\ny\n", 0, "", ""},
+		{"x\ny\n", "x\nz\n", 2, "y\n", "z\n"},
+		{"x\n", "x\ny\n", 2, endOfOutput, "y\n"},
+		{"x\ny", "x\ny\n", 2, "y", "y\n"},
+	}
+	dir := t.TempDir()
+	for _, tt := range tests {
+		a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+		if err := os.WriteFile(a, []byte(tt.a), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(b, []byte(tt.b), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		line, orig, rest, err := firstDifference(a, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if line != tt.line || orig != tt.orig || rest != tt.rest {
+			t.Errorf("firstDifference(%q, %q) = %d, %q, %q, want %d, %q, %q", tt.a, tt.b, line, orig, rest, tt.line, tt.orig, tt.rest)
+		}
+	}
+}
+
+func TestBlobRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	big := "X'" + strings.Repeat("ab", 40) + "'"
+	stmt := "INSERT INTO img VALUES(1," + big + ",X'01','gitsqlite_blob(''sha256:" + strings.Repeat("0", 64) + "'',1)');"
+
+	b := newBlobExternalizer(16, dir)
+	out, err := b.apply(stmt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out, big) || !strings.Contains(out, ",X'01',") || b.stored != 1 {
+		t.Fatalf("apply() = %q, stored %d", out, b.stored)
+	}
+
+	data, err := io.ReadAll(ResolveBlobs(strings.NewReader(out+"\n"), dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != stmt+"\n" {
+		t.Errorf("ResolveBlobs() = %q, want %q", data, stmt+"\n")
+	}
+
+	if _, err := io.ReadAll(ResolveBlobs(strings.NewReader(out+"\n"), t.TempDir())); err == nil {
+		t.Error("ResolveBlobs() with a missing blob succeeded")
+	}
+}
+
+func TestWithFallback(t *testing.T) {
+	failing := func(in io.Reader, out io.Writer) error {
+		buf := make([]byte, 2)
+		io.ReadFull(in, buf)
+		out.Write([]byte("partial"))
+		return errors.New("broken")
+	}
+	tests := []struct {
+		policy, want string
+		wantErr      bool
+	}{
+		{OnErrorFail, "partial", true},
+		{OnErrorPassthrough, "input data", false},
+		{OnErrorEmpty, "", false},
+	}
+	for _, tt := range tests {
+		var out strings.Builder
+		err := WithFallback(&sqlite.Engine{}, tt.policy, "clean", strings.NewReader("input data"), &out, failing)
+		if (err != nil) != tt.wantErr || out.String() != tt.want {
+			t.Errorf("%s: output %q, error %v; want %q", tt.policy, out.String(), err, tt.want)
+		}
+	}
+}
+
+func TestCleanVacuum(t *testing.T) {
+	ctx := context.Background()
+	eng := &sqlite.Engine{Embedded: true}
+	db := filepath.Join(t.TempDir(), "test.db")
+	script := "CREATE TABLE t(id INTEGER PRIMARY KEY, v TEXT);\n" +
+		"WITH RECURSIVE n(i) AS (SELECT 1 UNION ALL SELECT i+1 FROM n WHERE i < 500) INSERT INTO t SELECT i, printf('%0500d', i) FROM n;\n" +
+		"DELETE FROM t WHERE id % 2 = 0;\n"
+	if err := eng.Restore(ctx, db, strings.NewReader(script)); err != nil {
+		t.Fatal(err)
+	}
+
+	clean := func(vacuum bool) string {
+		f, err := os.Open(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		opts := DefaultOptions()
+		opts.Vacuum = vacuum
+		var out strings.Builder
+		if err := Clean(ctx, eng, f, &out, opts); err != nil {
+			t.Fatalf("Clean(vacuum=%v): %v", vacuum, err)
+		}
+		return out.String()
+	}
+	plain, vacuumed := clean(false), clean(true)
+	if plain != vacuumed {
+		t.Errorf("dump with -vacuum differs:\n%s\nwant:\n%s", vacuumed, plain)
+	}
+	if strings.Count(vacuumed, "INSERT INTO") != 250 {
+		t.Errorf("dump has %d rows, want 250", strings.Count(vacuumed, "INSERT INTO"))
+	}
+}
+
+func TestPragmasRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	eng := &sqlite.Engine{Embedded: true}
+	db := filepath.Join(t.TempDir(), "test.db")
+	script := "PRAGMA page_size=8192;\nPRAGMA encoding='UTF-16le';\nCREATE TABLE t(v TEXT);\nINSERT INTO t VALUES('x');\n" +
+		"PRAGMA user_version=42;\nPRAGMA application_id=1234;\n"
+	if err := eng.Restore(ctx, db, strings.NewReader(script)); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var dump strings.Builder
+	if err := Clean(ctx, eng, f, &dump, DefaultOptions()); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"encoding=UTF-16le", "page_size=8192", "application_id=1234", "user_version=42"} {
+		if !strings.Contains(dump.String(), PragmaPrefix+want+"\n") {
+			t.Errorf("dump lacks %s:\n%s", want, dump.String())
+		}
+	}
+
+	restored := filepath.Join(t.TempDir(), "restored.db")
+	if err := Smudge(ctx, eng, strings.NewReader(dump.String()), nil, SmudgeOptions{Output: restored}); err != nil {
+		t.Fatal(err)
+	}
+	pragmas, err := ReadPragmas(ctx, eng, restored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := PragmaComments(pragmas), PragmaComments([]Pragma{{"encoding", "UTF-16le"}, {"page_size", "8192"}, {"application_id", "1234"}, {"user_version", "42"}}); got != want {
+		t.Errorf("restored settings:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestPeekPragmas(t *testing.T) {
+	for _, tt := range []struct {
+		dump    string
+		want    int
+		wantErr bool
+	}{
+		{DumpHeader + "CREATE TABLE t(a);\n", 0, false},
+		{DumpHeader + PragmaPrefix + "user_version=7\n" + PragmaPrefix + "future_setting=1\nCREATE TABLE t(a);\n", 1, false},
+		{DumpHeader + "CREATE TABLE t(a);\n" + PragmaPrefix + "user_version=7\n", 0, false},
+		{DumpHeader + FormatPrefix + "9\n" + PragmaPrefix + "user_version=7\nCREATE TABLE t(a);\n", 1, false},
+		{DumpHeader + PragmaPrefix + "user_version=7; DROP TABLE t\n", 0, true},
+		{DumpHeader + PragmaPrefix + "encoding=EBCDIC\n", 0, true},
+	} {
+		pragmas, r, err := peekPragmas(strings.NewReader(tt.dump))
+		if (err != nil) != tt.wantErr || len(pragmas) != tt.want {
+			t.Errorf("peekPragmas(%q) = %v, %v; want %d pragmas, error %v", tt.dump, pragmas, err, tt.want, tt.wantErr)
+			continue
+		}
+		if rest, _ := io.ReadAll(r); err == nil && string(rest) != tt.dump {
+			t.Errorf("peekPragmas(%q) consumed input, left %q", tt.dump, rest)
+		}
+	}
+}
+
+func TestSortByDependencies(t *testing.T) {
+	for _, tt := range []struct {
+		names []string
+		deps  map[string][]string
+		want  string
+	}{
+		{[]string{"c", "a", "b"}, nil, "a b c"},
+		{[]string{"alpha", "b", "zeta"}, map[string][]string{"alpha": {"zeta"}}, "b zeta alpha"},
+		{[]string{"a", "b"}, map[string][]string{"a": {"a", "missing"}}, "a b"},
+		{[]string{"a", "b", "c"}, map[string][]string{"a": {"b"}, "b": {"a"}}, "c a b"},
+	} {
+		if got := strings.Join(sortByDependencies(tt.names, tt.deps), " "); got != tt.want {
+			t.Errorf("sortByDependencies(%v, %v) = %s, want %s", tt.names, tt.deps, got, tt.want)
+		}
+	}
+}
+
+func TestSchemaOrderIgnoresCreationOrder(t *testing.T) {
+	ctx := context.Background()
+	eng := &sqlite.Engine{Embedded: true}
+	dir := t.TempDir()
+	dump := func(name, script string) string {
+		db := filepath.Join(dir, name)
+		if err := eng.Restore(ctx, db, strings.NewReader(script)); err != nil {
+			t.Fatal(err)
+		}
+		var out strings.Builder
+		if err := DumpTables(ctx, eng, db, &out, DefaultOptions()); err != nil {
+			t.Fatal(err)
+		}
+		return out.String()
+	}
+	first := dump("first.db", "CREATE TABLE zeta(id INTEGER PRIMARY KEY);\nINSERT INTO zeta VALUES(1);\n"+
+		"CREATE TABLE alpha(id INTEGER PRIMARY KEY, z REFERENCES zeta(id));\nINSERT INTO alpha VALUES(1,1);\n"+
+		"CREATE TABLE b(x);\nINSERT INTO b VALUES(2);\nCREATE VIEW v1 AS SELECT * FROM zeta;\n"+
+		"CREATE VIEW a0 AS SELECT * FROM v1;\nCREATE INDEX bx ON b(x);\n")
+	second := dump("second.db", "CREATE TABLE b(x);\nINSERT INTO b VALUES(2);\nCREATE INDEX bx ON b(x);\n"+
+		"CREATE TABLE alpha(id INTEGER PRIMARY KEY, z REFERENCES zeta(id));\nINSERT INTO alpha VALUES(1,1);\n"+
+		"CREATE TABLE zeta(id INTEGER PRIMARY KEY);\nINSERT INTO zeta VALUES(1);\n"+
+		"CREATE VIEW v1 AS SELECT * FROM zeta;\nCREATE VIEW a0 AS SELECT * FROM v1;\n")
+	if first != second {
+		t.Fatalf("dumps differ:\n%s\nand:\n%s", first, second)
+	}
+	want := []string{"CREATE TABLE b(", "CREATE TABLE zeta(", "CREATE TABLE alpha(", "CREATE INDEX bx", "CREATE VIEW v1", "CREATE VIEW a0", "COMMIT;"}
+	pos := 0
+	for _, w := range want {
+		i := strings.Index(first[pos:], w)
+		if i < 0 {
+			t.Fatalf("%q missing or out of order in:\n%s", w, first)
+		}
+		pos += i
+	}
+	if matches, _ := filepath.Glob(filepath.Join(os.TempDir(), "gitsqlite-order-*")); len(matches) > 0 {
+		t.Errorf("spool files left behind: %v", matches)
+	}
+}
+
+func TestDetectQuirks(t *testing.T) {
+	const trailer = "-- gitsqlite-hash: sha256:00\n"
+	tables := "CREATE TABLE a(id INTEGER PRIMARY KEY, p REAL);\nINSERT INTO a VALUES(1,2.000000000);\nCREATE TABLE b(x);\n"
+	for _, tt := range []struct {
+		name string
+		dump string
+		want Quirks
+	}{
+		{"current", DumpHeader + "-- gitsqlite-format: 2\n" + tables + "COMMIT;\n" + trailer, Quirks{Format: CurrentFormat}},
+		{"empty", "", Quirks{}},
+		{"unversioned", DumpHeader + tables + "COMMIT;\n" + trailer, Quirks{Format: FormatUnversioned}},
+		{"newer", DumpHeader + "-- gitsqlite-format: 9\n-- gitsqlite-pragma: user_version=1\n" + tables + "COMMIT;\n" + trailer, Quirks{Format: 9}},
+		{"no hash", DumpHeader + tables + "COMMIT;\n", Quirks{NoHash: true, Format: FormatUnversioned}},
+		{"sqlite3 header", "PRAGMA foreign_keys=off;\nBEGIN;\n" + tables + "COMMIT;\n" + trailer, Quirks{Header: "PRAGMA foreign_keys=off;\nBEGIN;\n", Format: FormatUnversioned}},
+		{"integral real", DumpHeader + "CREATE TABLE a(id INTEGER PRIMARY KEY, p REAL);\nINSERT INTO a VALUES(1,2);\nCOMMIT;\n" + trailer, Quirks{IntegralReals: true, Format: FormatUnversioned}},
+		{"data without schema link", DumpHeader + "-- gitsqlite-format: 2\nINSERT INTO b VALUES(1);\nCOMMIT;\n" + trailer, Quirks{Format: CurrentFormat, NoSchemaLink: true}},
+		{"data with schema link", DumpHeader + "-- gitsqlite-format: 2\nINSERT INTO b VALUES(1);\nCOMMIT;\n-- gitsqlite-schema-hash: sha256:00\n" + trailer, Quirks{Format: CurrentFormat}},
+		{"key row order", DumpHeader + "-- gitsqlite-format: 2\nCREATE TABLE k(a TEXT, b, PRIMARY KEY(a, b));\nINSERT INTO k VALUES(NULL,1),('b',2);\nINSERT INTO k VALUES('b',10);\nINSERT INTO k VALUES('b','1');\nINSERT INTO k VALUES('z',X'00');\nCOMMIT;\n" + trailer, Quirks{Format: CurrentFormat}},
+		{"dump row order", DumpHeader + "-- gitsqlite-format: 2\nCREATE TABLE k(a TEXT PRIMARY KEY);\nINSERT INTO k VALUES('z');\nINSERT INTO k VALUES('b');\nCOMMIT;\n" + trailer, Quirks{Format: CurrentFormat, DumpRowOrder: true}},
+		{"rowid order", DumpHeader + "-- gitsqlite-format: 2\nCREATE TABLE k(a INTEGER PRIMARY KEY, b TEXT);\nINSERT INTO k VALUES(2,'a');\nINSERT INTO k VALUES(1,'b');\nCOMMIT;\n" + trailer, Quirks{Format: CurrentFormat}},
+		{"collated key", DumpHeader + "-- gitsqlite-format: 2\nCREATE TABLE k(a TEXT PRIMARY KEY COLLATE NOCASE);\nINSERT INTO k VALUES('b');\nINSERT INTO k VALUES('A');\nCOMMIT;\n" + trailer, Quirks{Format: CurrentFormat}},
+	} {
+		got, err := DetectQuirks(strings.NewReader(tt.dump), "")
+		if err != nil || got != tt.want {
+			t.Errorf("%s: DetectQuirks = %+v, %v; want %+v", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+func TestCleanKeepsIndexedRowOrder(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	ctx := context.Background()
+	eng := &sqlite.Engine{Embedded: true}
+	dir, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(dir)
+	// Rows inserted out of key order, which .dump keeps
+	if err := eng.Restore(ctx, "data.db", strings.NewReader("CREATE TABLE k(a TEXT PRIMARY KEY);\nINSERT INTO k VALUES('z');\nINSERT INTO k VALUES('b');\n")); err != nil {
+		t.Fatal(err)
+	}
+	clean := func(opts Options) string {
+		t.Helper()
+		f, err := os.Open("data.db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		var out strings.Builder
+		if err := Clean(ctx, eng, f, &out, opts); err != nil {
+			t.Fatal(err)
+		}
+		return out.String()
+	}
+	opts := DefaultOptions()
+	opts.FormatVersion = FormatUnversioned
+	baseline := clean(opts)
+	if !strings.Contains(baseline, "INSERT INTO k VALUES('z');\nINSERT INTO k VALUES('b');\n") {
+		t.Fatalf("format 1 dump does not keep the .dump row order:\n%s", baseline)
+	}
+
+	// With the baseline dump in the git index clean writes it unchanged
+	db, err := os.ReadFile("data.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile("data.db", []byte(baseline), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, args := range [][]string{{"init", "-q"}, {"add", "data.db"}} {
+		if out, err := exec.Command("git", args...).CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+	if err := os.WriteFile("data.db", db, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	opts = DefaultOptions()
+	opts.SourcePath = "data.db"
+	if got := clean(opts); got != baseline {
+		t.Errorf("clean changed the baseline dump:\n%s\nwant:\n%s", got, baseline)
+	}
+
+	// So does a current format dump with the rows in .dump order
+	opts.SourcePath = ""
+	opts.RowOrder = RowOrderDump
+	dumpOrder := clean(opts)
+	if err := os.WriteFile("data.db", []byte(dumpOrder), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command("git", "add", "data.db").CombinedOutput(); err != nil {
+		t.Fatalf("git add: %v\n%s", err, out)
+	}
+	if err := os.WriteFile("data.db", db, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	opts = DefaultOptions()
+	opts.SourcePath = "data.db"
+	if got := clean(opts); got != dumpOrder {
+		t.Errorf("clean changed the dump in .dump row order:\n%s\nwant:\n%s", got, dumpOrder)
+	}
+}
+
+func TestInternalTableFilter(t *testing.T) {
+	if _, err := ParseInternalTables("sqlite_stat1,sqlite_master"); err == nil {
+		t.Error("ParseInternalTables accepted sqlite_master")
+	}
+	const (
+		table    = "CREATE TABLE a(id INTEGER PRIMARY KEY AUTOINCREMENT, x);\nINSERT INTO a VALUES(1,1);\n"
+		stat     = "ANALYZE sqlite_schema;\nINSERT INTO sqlite_stat1 VALUES('a','ax','1 1');\n"
+		sequence = "INSERT INTO \"sqlite_sequence\" VALUES('a',2);\nINSERT INTO sqlite_sequence VALUES('b',7);\n"
+	)
+	dump := table + "CREATE TABLE IF NOT EXISTS sqlite_sequence(name,seq);\n" + stat + "DELETE FROM sqlite_sequence;\n" + sequence
+	for _, tt := range []struct {
+		policy string
+		want   string
+	}{
+		{InternalTablesNone, table},
+		{DefaultInternalTables, table + stat},
+		{"sqlite_sequence", table + "DELETE FROM sqlite_sequence;\n" + sequence},
+	} {
+		keep, err := ParseInternalTables(tt.policy)
+		if err != nil {
+			t.Fatalf("ParseInternalTables(%q): %v", tt.policy, err)
+		}
+		f := newInternalTableFilter(keep)
+		var got strings.Builder
+		for _, line := range strings.Split(strings.TrimSuffix(dump, "\n"), "\n") {
+			if !f.skip(line) {
+				got.WriteString(f.rewrite(line) + "\n")
+			}
+		}
+		if got.String() != tt.want {
+			t.Errorf("%s: kept\n%s\nwant\n%s", tt.policy, got.String(), tt.want)
+		}
+	}
+}
+
+func TestRestoreIncremental(t *testing.T) {
+	ctx := context.Background()
+	eng := &sqlite.Engine{Embedded: true}
+	dir := t.TempDir()
+	src, out := filepath.Join(dir, "src.db"), filepath.Join(dir, "out.db")
+	cache := &TableCache{Dir: filepath.Join(dir, "tables"), Root: dir}
+	smudge := func(script string) {
+		t.Helper()
+		if err := eng.Restore(ctx, src, strings.NewReader(script)); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Open(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		var dump strings.Builder
+		if err := Clean(ctx, eng, f, &dump, DefaultOptions()); err != nil {
+			t.Fatal(err)
+		}
+		if err := Smudge(ctx, eng, strings.NewReader(dump.String()), nil, SmudgeOptions{Output: out, TargetPath: out, TableCache: cache}); err != nil {
+			t.Fatal(err)
+		}
+		restored, err := os.Open(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer restored.Close()
+		var again strings.Builder
+		if err := Clean(ctx, eng, restored, &again, DefaultOptions()); err != nil {
+			t.Fatal(err)
+		}
+		if again.String() != dump.String() {
+			t.Fatalf("restored database dumps as:\n%s\nwant:\n%s", again.String(), dump.String())
+		}
+	}
+	smudge("CREATE TABLE a(id INTEGER PRIMARY KEY, x);\nINSERT INTO a VALUES(1,'a');\nCREATE TABLE b(y);\nINSERT INTO b VALUES(2);\n" +
+		"CREATE INDEX ax ON a(x);\nCREATE VIEW v AS SELECT * FROM a, b;\n")
+	smudge("UPDATE a SET x='changed';\nCREATE TABLE c(z);\n")
+
+	// Tables restored on their own are created after the unchanged ones
+	rows, err := eng.Query(ctx, out, "SELECT name FROM sqlite_schema WHERE type='table' ORDER BY rowid;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var order []string
+	for _, row := range rows {
+		order = append(order, row[0])
+	}
+	if got := strings.Join(order, " "); got != "b a c" {
+		t.Errorf("tables in creation order %q, want \"b a c\"", got)
+	}
+}
+
+func TestJSONRows(t *testing.T) {
+	tables := TableMap{}
+	tables.Observe("CREATE TABLE t(id INTEGER PRIMARY KEY, s TEXT, b BLOB, n);")
+	line := rowsToJSON(`INSERT INTO t VALUES(1,'it''s <a>',X'00ff',NULL),(2,replace('a\nb','\n',char(10)),NULL,-1.5e3);`, tables)
+	want := `{"table":"t","columns":["id","s","b","n"],"values":[1,"it's <a>",{"blob":"00ff"},null]}` + "\n" +
+		`{"table":"t","columns":["id","s","b","n"],"values":[2,{"sql":"replace('a\\nb','\\n',char(10))"},null,-1.5e3]}`
+	if line != want {
+		t.Fatalf("rowsToJSON:\n%s\nwant\n%s", line, want)
+	}
+	if got := rowsToJSON("INSERT INTO sqlite_stat1 VALUES('t',NULL,'2');", tables); got != "INSERT INTO sqlite_stat1 VALUES('t',NULL,'2');" {
+		t.Errorf("rowsToJSON converted a table of unknown columns: %s", got)
+	}
+
+	// A JSON line inside a multi-line value is not a row
+	dump := "INSERT INTO t VALUES(3,'x\r\n{\"table\":\"t\"}');\r\n" + line + "\n"
+	got, err := io.ReadAll(ExpandJSONRows(strings.NewReader(dump)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantSQL := "INSERT INTO t VALUES(3,'x\r\n{\"table\":\"t\"}');\r\n" +
+		`INSERT INTO "t"("id","s","b","n") VALUES(1,'it''s <a>',X'00ff',NULL);` + "\n" +
+		`INSERT INTO "t"("id","s","b","n") VALUES(2,replace('a\nb','\n',char(10)),NULL,-1.5e3);` + "\n"
+	if string(got) != wantSQL {
+		t.Errorf("ExpandJSONRows:\n%s\nwant\n%s", got, wantSQL)
+	}
+	if _, err := io.ReadAll(ExpandJSONRows(strings.NewReader(`{"table":"t","columns":["id"],"values":[true]}` + "\n"))); err == nil {
+		t.Error("ExpandJSONRows accepted a boolean value")
+	}
+}
+
+func TestExport(t *testing.T) {
+	ctx := context.Background()
+	eng := &sqlite.Engine{Embedded: true}
+	dir := t.TempDir()
+	db := filepath.Join(dir, "test.db")
+	script := "CREATE TABLE \"b/c\"(k TEXT PRIMARY KEY, v REAL, d BLOB);\n" +
+		"INSERT INTO \"b/c\" VALUES('y',2,NULL),('x','a\nb',X'00ff');\n" +
+		"CREATE TABLE a(id INTEGER PRIMARY KEY, s);\nCREATE TABLE secret(x);\nINSERT INTO secret VALUES(1);\n"
+	if err := eng.Restore(ctx, db, strings.NewReader(script)); err != nil {
+		t.Fatal(err)
+	}
+	opts := DefaultOptions()
+	opts.LocalTables = []string{"secret"}
+	out := filepath.Join(dir, "out")
+	files, err := Export(ctx, eng, db, out, ExportCSV, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(files, " "); got != "a.csv b%2Fc.csv" {
+		t.Fatalf("files %q, want a.csv b%%2Fc.csv", got)
+	}
+	data, err := os.ReadFile(filepath.Join(out, "b%2Fc.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Rows sorted by key, text with a newline quoted, floats normalized
+	want := "k,v,d\nx,\"a\nb\",00ff\ny,2.000000000,\n"
+	if string(data) != want {
+		t.Errorf("b/c exported as\n%s\nwant\n%s", data, want)
+	}
+	if data, _ := os.ReadFile(filepath.Join(out, "a.csv")); string(data) != "id,s\n" {
+		t.Errorf("empty table exported as %q", data)
+	}
+}
+
+func TestDBDiff(t *testing.T) {
+	ctx := context.Background()
+	eng := &sqlite.Engine{Embedded: true}
+	dir := t.TempDir()
+	oldDB, newDB := filepath.Join(dir, "old.db"), filepath.Join(dir, "new.db")
+	base := "CREATE TABLE t(id INTEGER PRIMARY KEY, s TEXT);\nINSERT INTO t VALUES(1,'a'),(2,'b');\n" +
+		"CREATE TABLE k(a, b, v, PRIMARY KEY(a, b)) WITHOUT ROWID;\nINSERT INTO k VALUES('x',1,'old');\n" +
+		"CREATE TABLE n(x);\nINSERT INTO n VALUES('r1');\nCREATE TABLE gone(z);\nCREATE VIEW v AS SELECT * FROM t;\n"
+	if err := eng.Restore(ctx, oldDB, strings.NewReader(base)); err != nil {
+		t.Fatal(err)
+	}
+	if err := eng.Restore(ctx, newDB, strings.NewReader(base+"UPDATE t SET s='it''s\nnew' WHERE id=1;\nDELETE FROM t WHERE id=2;\n"+
+		"INSERT INTO k VALUES('y',2,X'00ff');\nUPDATE n SET x='r2';\nDROP TABLE gone;\nDROP VIEW v;\nCREATE VIEW v AS SELECT id FROM t;\n")); err != nil {
+		t.Fatal(err)
+	}
+	var diff strings.Builder
+	if err := DBDiff(ctx, eng, oldDB, newDB, &diff, DBDiffOptions{Builtin: true}); err != nil {
+		t.Fatal(err)
+	}
+	want := "DROP VIEW IF EXISTS \"v\";\nDROP TABLE \"gone\";\n" +
+		"INSERT INTO \"k\"(\"a\",\"b\",\"v\") VALUES('y',2,X'00FF');\n" +
+		"UPDATE \"n\" SET \"x\"='r2' WHERE rowid=1;\n" +
+		"DELETE FROM \"t\" WHERE \"id\"=2;\nUPDATE \"t\" SET \"s\"='it''s\nnew' WHERE \"id\"=1;\n" +
+		"CREATE VIEW v AS SELECT id FROM t;\n"
+	if diff.String() != want {
+		t.Fatalf("dbdiff:\n%s\nwant:\n%s", diff.String(), want)
+	}
+
+	// Applying the statements to the old database gives the new one
+	if err := eng.Restore(ctx, oldDB, strings.NewReader(diff.String())); err != nil {
+		t.Fatal(err)
+	}
+	dump := func(path string) string {
+		var out strings.Builder
+		if err := DumpTables(ctx, eng, path, &out, DefaultOptions()); err != nil {
+			t.Fatal(err)
+		}
+		return out.String()
+	}
+	if got, want := dump(oldDB), dump(newDB); got != want {
+		t.Errorf("patched database dumps as:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestParseDiffDriverArgs(t *testing.T) {
+	zero := strings.Repeat("0", 40)
+	args, err := ParseDiffDriverArgs([]string{"c.db", "/dev/null", ".", ".", "c.db", zero, "100644"})
+	if err != nil || !args.Old.missing() || args.New.missing() || args.New.File != "c.db" || args.NewPath != "" {
+		t.Errorf("added file parsed as %+v, %v", args, err)
+	}
+	args, err = ParseDiffDriverArgs([]string{"a.db", "/tmp/x/a.db", "1234", "100644", "b.db", zero, "100755", "b.db", "similarity index 100%\n"})
+	if err != nil || args.NewPath != "b.db" || args.Old.ID != "1234" || args.New.Mode != "100755" {
+		t.Errorf("rename parsed as %+v, %v", args, err)
+	}
+	if _, err := ParseDiffDriverArgs([]string{"a.db", "b.db"}); err == nil {
+		t.Error("2 arguments accepted")
+	}
+}
+
+func TestDiffDriver(t *testing.T) {
+	ctx := context.Background()
+	eng := &sqlite.Engine{Embedded: true}
+	dir := t.TempDir()
+	// The old version as git stores it: the dump written by clean
+	newDB, oldDump := filepath.Join(dir, "c.db"), filepath.Join(dir, "old.sql")
+	if err := eng.Restore(ctx, newDB, strings.NewReader("CREATE TABLE t(id INTEGER PRIMARY KEY, s TEXT);\nINSERT INTO t VALUES(1,'a');\n")); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(newDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var dump strings.Builder
+	if err := Clean(ctx, eng, f, &dump, DefaultOptions()); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(oldDump, []byte(dump.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := eng.Restore(ctx, newDB, strings.NewReader("INSERT INTO t VALUES(2,'b');\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	run := func(old, new DiffSide) string {
+		var out strings.Builder
+		args := DiffDriverArgs{Path: "c.db", Old: old, New: new}
+		if err := DiffDriver(ctx, eng, args, &out, SmudgeOptions{}, DBDiffOptions{Builtin: true}); err != nil {
+			t.Fatal(err)
+		}
+		return out.String()
+	}
+	none := DiffSide{File: "/dev/null", ID: ".", Mode: "."}
+	old := DiffSide{File: oldDump, ID: "1234", Mode: "100644"}
+	worktree := DiffSide{File: newDB, ID: strings.Repeat("0", 40), Mode: "100644"}
+	if got, want := run(old, worktree), "diff --gitsqlite a/c.db b/c.db\nINSERT INTO \"t\"(\"id\",\"s\") VALUES(2,'b');\n"; got != want {
+		t.Errorf("changed file:\n%s\nwant:\n%s", got, want)
+	}
+	if got := run(none, worktree); !strings.HasPrefix(got, "diff --gitsqlite a/c.db b/c.db\nnew file mode 100644\nCREATE TABLE") {
+		t.Errorf("added file:\n%s", got)
+	}
+	if got, want := run(old, none), "diff --gitsqlite a/c.db b/c.db\ndeleted file mode 100644\nDROP TABLE \"t\";\n"; got != want {
+		t.Errorf("deleted file:\n%s\nwant:\n%s", got, want)
+	}
+	if got := run(worktree, DiffSide{File: newDB, ID: "5678", Mode: "120000"}); !strings.HasSuffix(got, "new mode 120000\n-- not compared: symbolic link or submodule\n") {
+		t.Errorf("symbolic link:\n%s", got)
+	}
+}
+
+func TestAssertIdempotent(t *testing.T) {
+	ctx := context.Background()
+	eng := &sqlite.Engine{Embedded: true}
+	dbPath := filepath.Join(t.TempDir(), "i.db")
+	if err := eng.Restore(ctx, dbPath, strings.NewReader("CREATE TABLE t(a REAL, b TEXT);\n"+
+		"INSERT INTO t VALUES(1e999, 'x'||char(10)||'y'),(0.1, CAST(X'ff' AS TEXT)),(3, NULL);\n")); err != nil {
+		t.Fatal(err)
+	}
+	opts := DefaultOptions()
+	opts.AssertIdempotent, opts.CanonicalSchema, opts.ControlChars = true, true, ControlCharsChar
+	if err := DumpTables(ctx, eng, dbPath, io.Discard, opts); err != nil {
+		t.Fatalf("idempotent dump failed: %v", err)
+	}
+
+	// A float normalizer adding a digit on every pass
+	c := newIdempotencyCheck(opts)
+	c.normalizeLine = func(line string, _ int) string { return strings.Replace(line, ".5", ".50", 1) }
+	err := c.check("INSERT INTO t VALUES(1.5,'a');", TableMap{}, true)
+	if !errors.Is(err, errs.ErrCheckFailed) || !strings.Contains(err.Error(), `"INSERT INTO t VALUES(1.5,'a');" to "INSERT INTO t VALUES(1.50,'a');"`) {
+		t.Errorf("check = %v, want the changed line", err)
+	}
+}
+
+func TestCollations(t *testing.T) {
+	ctx := context.Background()
+	eng := &sqlite.Engine{Embedded: true}
+	dump := "PRAGMA foreign_keys=OFF;\nBEGIN TRANSACTION;\n" +
+		"CREATE TABLE t(a TEXT COLLATE my_icu, b COLLATE NoCase, c TEXT DEFAULT 'COLLATE x');\n" +
+		"INSERT INTO t VALUES('COLLATE y','b','c');\n" +
+		"CREATE VIEW v AS SELECT a FROM t ORDER BY b COLLATE \"de-DE\", a COLLATE my_icu;\nCOMMIT;\n"
+
+	restored := filepath.Join(t.TempDir(), "r.db")
+	err := Smudge(ctx, eng, strings.NewReader(dump), nil, SmudgeOptions{Output: restored})
+	want := `collations SQLite does not provide: de-DE (used by v), my_icu (used by t, v);`
+	if !errors.Is(err, errs.ErrRestoreFailed) || !strings.Contains(err.Error(), want) {
+		t.Fatalf("smudge = %v, want an error with %q", err, want)
+	}
+
+	mapping, err := ParseCollationMap(`MY_ICU=nocase, "de-DE"=rtrim`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Smudge(ctx, eng, strings.NewReader(dump), nil, SmudgeOptions{Output: restored, Collations: mapping}); err != nil {
+		t.Fatal(err)
+	}
+	rows, err := eng.Query(ctx, restored, "SELECT sql FROM sqlite_schema ORDER BY name;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || rows[0][0] != "CREATE TABLE t(a TEXT COLLATE nocase, b COLLATE NoCase, c TEXT DEFAULT 'COLLATE x')" ||
+		rows[1][0] != "CREATE VIEW v AS SELECT a FROM t ORDER BY b COLLATE rtrim, a COLLATE nocase" {
+		t.Errorf("restored schema = %q", rows)
+	}
+
+	// Names are written as the schema has them
+	if got, want := CanonicalizeCreateTable("CREATE TABLE t(a text collate \"de-DE\", b COLLATE NoCase);"), "COLLATE \"de-DE\""; !strings.Contains(got, want) || !strings.Contains(got, "COLLATE NoCase") {
+		t.Errorf("canonical schema = %q, want the collation names verbatim", got)
+	}
+
+	for _, list := range []string{"a", "a=", "a=b,A=c"} {
+		if _, err := ParseCollationMap(list); err == nil {
+			t.Errorf("ParseCollationMap(%q) succeeded", list)
+		}
+	}
+}
+
+func TestTableHashes(t *testing.T) {
+	ctx := context.Background()
+	eng := &sqlite.Engine{Embedded: true}
+	db := filepath.Join(t.TempDir(), "test.db")
+	if err := eng.Restore(ctx, db, strings.NewReader("CREATE TABLE a(id INTEGER PRIMARY KEY, v TEXT);\n"+
+		"INSERT INTO a VALUES(1,'x'||char(10)||'y'),(2,NULL);\nCREATE TABLE \"b c\"(n REAL);\nINSERT INTO \"b c\" VALUES(0.5);\n")); err != nil {
+		t.Fatal(err)
+	}
+	clean := func(format string) string {
+		f, err := os.Open(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		opts := DefaultOptions()
+		opts.TableHashes, opts.AnnotateCounts, opts.DataFormat = true, true, format
+		var out strings.Builder
+		if err := Clean(ctx, eng, f, &out, opts); err != nil {
+			t.Fatal(err)
+		}
+		return out.String()
+	}
+	for _, format := range []string{DataFormatSQL, DataFormatJSONL} {
+		dump := clean(format)
+		result, err := VerifyDumpHashes(strings.NewReader(dump), nil, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !result.OK() || len(result.Tables) != 2 || result.Tables[1].Name != "b c" {
+			t.Errorf("%s: VerifyDumpHashes = %+v, want the file and tables a and b c to match:\n%s", format, result, dump)
+		}
+
+		changed := strings.Replace(dump, "0.5", "0.25", 1)
+		result, err = VerifyDumpHashes(strings.NewReader(changed), nil, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.File.OK() || !result.Tables[0].OK() || result.Tables[1].OK() {
+			t.Errorf("%s: changed row of b c: got %+v", format, result)
+		}
+		result, err = VerifyDumpHashes(strings.NewReader(changed), []string{"A"}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !result.OK() || result.File != nil || len(result.Tables) != 1 {
+			t.Errorf("%s: only table a: got %+v", format, result)
+		}
+	}
+}
+
+func TestCleanSchemaOutputIsAtomic(t *testing.T) {
+	ctx := context.Background()
+	eng := &sqlite.Engine{Embedded: true}
+	dir := t.TempDir()
+	db := filepath.Join(dir, "test.db")
+	if err := eng.Restore(ctx, db, strings.NewReader("CREATE TABLE t(id INTEGER PRIMARY KEY, v TEXT);\nINSERT INTO t VALUES(1,'a');\n")); err != nil {
+		t.Fatal(err)
+	}
+	schema := filepath.Join(dir, "schema.sql")
+	if err := os.WriteFile(schema, []byte("previous\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	clean := func(out io.Writer) error {
+		f, err := os.Open(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		opts := DefaultOptions()
+		opts.SchemaOutput = schema
+		return Clean(ctx, eng, f, out, opts)
+	}
+	if err := clean(failingWriter{}); err == nil {
+		t.Fatal("Clean to a failing writer succeeded")
+	}
+	if got, _ := os.ReadFile(schema); string(got) != "previous\n" {
+		t.Errorf("failed Clean changed the schema file to %q", got)
+	}
+	if err := clean(io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(schema); !strings.Contains(string(got), "CREATE TABLE t") {
+		t.Errorf("schema file after Clean = %q, want the schema", got)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 2 {
+		t.Errorf("directory holds %d files, want the database and the schema", len(entries))
+	}
+}
+
+func TestCleanSubset(t *testing.T) {
+	ctx := context.Background()
+	eng := &sqlite.Engine{Embedded: true}
+	db := filepath.Join(t.TempDir(), "test.db")
+	// Rows inserted out of key order, so the rowid order .dump uses differs
+	// from the primary key order of -row-order pk, and an index on the
+	// column of the rule, which must not change the order of the rows
+	script := "CREATE TABLE t(k TEXT PRIMARY KEY, keep INT);\n" +
+		"INSERT INTO t VALUES('b',1);\nINSERT INTO t VALUES('a',0);\nINSERT INTO t VALUES('c',0);\nINSERT INTO t VALUES('d',1);\n" +
+		"CREATE INDEX t_keep ON t(keep);\n" +
+		"CREATE TABLE n(id INTEGER PRIMARY KEY, keep INT);\n" +
+		"INSERT INTO n VALUES(3,1);\nINSERT INTO n VALUES(1,0);\nINSERT INTO n VALUES(2,1);\n" +
+		"CREATE TABLE w(k TEXT PRIMARY KEY, keep INT) WITHOUT ROWID;\n" +
+		"INSERT INTO w VALUES('y',0);\nINSERT INTO w VALUES('x',1);\n"
+	if err := eng.Restore(ctx, db, strings.NewReader(script)); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := ParseSubset(strings.NewReader("t: keep = 1\nn: keep = 1\nw: keep = 1\nmissing: 1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clean := func(rowOrder string) string {
+		f, err := os.Open(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		opts := DefaultOptions()
+		opts.RowOrder = rowOrder
+		opts.Subset = rules
+		var out strings.Builder
+		if err := Clean(ctx, eng, f, &out, opts); err != nil {
+			t.Fatalf("Clean(row order %s): %v", rowOrder, err)
+		}
+		return out.String()
+	}
+	for rowOrder, want := range map[string][]string{
+		RowOrderKey:  {"INSERT INTO t VALUES('b',1);\nINSERT INTO t VALUES('d',1);\n", "INSERT INTO n VALUES(2,1);\nINSERT INTO n VALUES(3,1);\n", "INSERT INTO w VALUES('x',1);\n"},
+		RowOrderDump: {"INSERT INTO t VALUES('b',1);\nINSERT INTO t VALUES('d',1);\n", "INSERT INTO n VALUES(2,1);\nINSERT INTO n VALUES(3,1);\n", "INSERT INTO w VALUES('x',1);\n"},
+	} {
+		got := clean(rowOrder)
+		for _, rows := range want {
+			if !strings.Contains(got, rows) {
+				t.Errorf("row order %s: dump lacks\n%s\ngot:\n%s", rowOrder, rows, got)
+			}
+		}
+		if n := strings.Count(got, "INSERT INTO"); n != 5 {
+			t.Errorf("row order %s: dump has %d rows, want 5:\n%s", rowOrder, n, got)
+		}
+	}
+
+	var textconv strings.Builder
+	opts := DefaultOptions()
+	opts.Subset = rules
+	if err := Textconv(ctx, eng, db, &textconv, opts); err != nil {
+		t.Fatal(err)
+	}
+	if got := textconv.String(); strings.Contains(got, "'a'") || strings.Contains(got, "'c'") || !strings.Contains(got, "'d'") {
+		t.Errorf("textconv with subset rules:\n%s", got)
+	}
+
+	opts.Subset = []SubsetRule{{Table: "t", Where: "no_such_column = 1"}}
+	if err := DumpTables(ctx, eng, db, io.Discard, opts); err == nil || !strings.Contains(err.Error(), "subset rule for table t") {
+		t.Errorf("invalid subset rule: error %v", err)
+	}
+}
+
+func TestCleanCache(t *testing.T) {
+	ctx := context.Background()
+	eng := &sqlite.Engine{Embedded: true}
+	dir := t.TempDir()
+	db := filepath.Join(dir, "test.db")
+	if err := eng.Restore(ctx, db, strings.NewReader("CREATE TABLE t(id INTEGER PRIMARY KEY, v REAL);\nINSERT INTO t VALUES(1,1.25);\n")); err != nil {
+		t.Fatal(err)
+	}
+	cache := &CleanCache{Dir: filepath.Join(dir, "cache")}
+
+	// A rule matching no column makes every run warn
+	var sum *summary.Summary
+	clean := func(out io.Writer, precision int) error {
+		f, err := os.Open(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		opts := DefaultOptions()
+		opts.FloatPrecision = precision
+		opts.Redact = []RedactRule{{"t", "missing", RedactDrop}}
+		opts.Cache = cache
+		opts.Summary = sum
+		return Clean(ctx, eng, f, out, opts)
+	}
+	entries := func() []string {
+		names, _ := filepath.Glob(filepath.Join(cache.Dir, "*.out"))
+		return names
+	}
+	if err := clean(failingWriter{}, 9); err == nil {
+		t.Fatal("Clean to a failing writer succeeded")
+	}
+	if names, _ := filepath.Glob(filepath.Join(cache.Dir, "*")); len(names) != 0 {
+		t.Fatalf("failed Clean left %v in the cache", names)
+	}
+	var want strings.Builder
+	if err := clean(&want, 9); err != nil {
+		t.Fatal(err)
+	}
+	names := entries()
+	if len(names) != 1 {
+		t.Fatalf("cache holds %v, want one output", names)
+	}
+	if got, _ := os.ReadFile(names[0]); string(got) != want.String() {
+		t.Errorf("cached output = %q, want %q", got, want.String())
+	}
+
+	// A hit is copied from the cache without dumping, and reports the
+	// warnings and rows of the dump
+	if err := os.WriteFile(names[0], []byte("cached\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	var got strings.Builder
+	sum = summary.New("clean", summary.FormatLine)
+	recorded := warnings.Record()
+	err := clean(&got, 9)
+	replayed := recorded()
+	if err != nil || got.String() != "cached\n" {
+		t.Errorf("second Clean = %q, %v; want the cached output", got.String(), err)
+	}
+	if len(replayed) != 1 || replayed[0].ID != warnings.RedactUnmatched {
+		t.Errorf("second Clean warned %v, want the unmatched redaction rule", replayed)
+	}
+	var line strings.Builder
+	if err := sum.Print(&line); err != nil || !strings.Contains(line.String(), ", 1 rows,") {
+		t.Errorf("second Clean summary = %q, %v; want 1 row", line.String(), err)
+	}
+	sum = nil
+	got.Reset()
+	if err := clean(&got, 1); err != nil || got.String() == "cached\n" {
+		t.Errorf("Clean with other settings = %q, %v; want a new dump", got.String(), err)
+	}
+
+	cache.MaxSize = 1
+	if err := cache.prune(); err != nil {
+		t.Fatal(err)
+	}
+	if names, _ := filepath.Glob(filepath.Join(cache.Dir, "*")); len(names) != 0 {
+		t.Errorf("cache holds %v after pruning to 1 byte", names)
+	}
+}
+
+func TestCleanSinks(t *testing.T) {
+	ctx := context.Background()
+	eng := &sqlite.Engine{Embedded: true}
+	dir := t.TempDir()
+	db := filepath.Join(dir, "test.db")
+	if err := eng.Restore(ctx, db, strings.NewReader("CREATE TABLE t(id INTEGER PRIMARY KEY, v TEXT);\nINSERT INTO t VALUES(1,'a');\nINSERT INTO t VALUES(2,'b');\n")); err != nil {
+		t.Fatal(err)
+	}
+	clean := func(out io.Writer, format string, sinks []Sink) error {
+		f, err := os.Open(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		opts := DefaultOptions()
+		opts.DataFormat = format
+		opts.Sinks = sinks
+		return Clean(ctx, eng, f, out, opts)
+	}
+	var sql, jsonl strings.Builder
+	if err := clean(&sql, DataFormatSQL, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := clean(&jsonl, DataFormatJSONL, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	sinks, err := ParseSinks("jsonl=" + filepath.Join(dir, "t.jsonl") + ", manifest=" + filepath.Join(dir, "manifest.json"))
+	if err != nil || len(sinks) != 2 {
+		t.Fatalf("ParseSinks = %+v, %v", sinks, err)
+	}
+	if err := clean(failingWriter{}, DataFormatSQL, sinks); err == nil {
+		t.Fatal("Clean to a failing writer succeeded")
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Fatalf("failed Clean left %d files besides the database", len(entries)-1)
+	}
+	var out strings.Builder
+	if err := clean(&out, DataFormatSQL, sinks); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != sql.String() {
+		t.Errorf("output with sinks = %q, want %q", out.String(), sql.String())
+	}
+	if got, _ := os.ReadFile(sinks[0].Path); string(got) != jsonl.String() {
+		t.Errorf("jsonl sink = %q, want %q", got, jsonl.String())
+	}
+	var m manifest
+	if data, err := os.ReadFile(sinks[1].Path); err != nil {
+		t.Fatal(err)
+	} else if err := json.Unmarshal(data, &m); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Tables) != 1 || m.Tables[0] != (tableRows{Name: "t", Rows: 2}) {
+		t.Errorf("manifest tables = %+v", m.Tables)
+	}
+	if len(m.Outputs) != 2 || !strings.Contains(sql.String(), m.Outputs[0].Hash) || !strings.Contains(jsonl.String(), m.Outputs[1].Hash) {
+		t.Errorf("manifest outputs = %+v", m.Outputs)
+	}
+
+	for _, list := range []string{"jsonl", "xml=a", "sql=a,jsonl=a"} {
+		if _, err := ParseSinks(list); err == nil {
+			t.Errorf("ParseSinks(%q) succeeded", list)
+		}
+	}
+}
+
+func TestCheckSplit(t *testing.T) {
+	ctx := context.Background()
+	eng := &sqlite.Engine{Embedded: true}
+	dir := t.TempDir()
+	clean := func(sql, schema string) string {
+		db := filepath.Join(dir, "split.db")
+		os.Remove(db)
+		if err := eng.Restore(ctx, db, strings.NewReader(sql)); err != nil {
+			t.Fatal(err)
+		}
+		f, err := os.Open(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		opts := DefaultOptions()
+		opts.SchemaOutput = schema
+		var data strings.Builder
+		if err := Clean(ctx, eng, f, &data, opts); err != nil {
+			t.Fatal(err)
+		}
+		return data.String()
+	}
+	read := func(path string) *os.File {
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { f.Close() })
+		return f
+	}
+	schemaA, schemaB := filepath.Join(dir, "a.sql"), filepath.Join(dir, "b.sql")
+	dataA := clean("CREATE TABLE t(id INTEGER PRIMARY KEY, v TEXT);\nINSERT INTO t VALUES(1,'a');\n", schemaA)
+	clean("CREATE TABLE t(id INTEGER PRIMARY KEY);\nCREATE TABLE u(x);\n", schemaB)
+
+	c, err := CheckSplit(strings.NewReader(dataA), read(schemaA), "")
+	if err != nil || len(c.Problems()) > 0 || c.Unlinked() || c.LinkedHash != c.SchemaHash {
+		t.Errorf("matching schema: %+v, %v", c, err)
+	}
+	c, err = CheckSplit(strings.NewReader(dataA), read(schemaB), "")
+	if err != nil || c.LinkedHash == c.SchemaHash || len(c.ColumnMismatches) != 1 || len(c.Problems()) != 2 {
+		t.Errorf("other schema: %+v, %v", c, err)
+	}
+	c, err = CheckSplit(strings.NewReader("INSERT INTO w VALUES(1);\nCREATE TABLE w(x);\n"), strings.NewReader("CREATE TABLE t(x);\n"), "")
+	if err != nil || strings.Join(c.MissingTables, ",") != "w" || c.SchemaStatements != 1 || c.SchemaHash != "" {
+		t.Errorf("data with schema: %+v, %v", c, err)
+	}
+	schema, err := os.ReadFile(schemaA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(schemaA, append([]byte("-- edited\n"), schema...), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if c, err = CheckSplit(strings.NewReader(dataA), read(schemaA), ""); err != nil || !c.SchemaModified {
+		t.Errorf("edited schema: %+v, %v", c, err)
+	}
+}
+
+// failingWriter fails every write.
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errors.New("write failed") }
+
+func TestDumpBudget(t *testing.T) {
+	ctx, budget := startBudget(context.Background(), 100*time.Millisecond, 100*time.Millisecond)
+	defer budget.stop()
+	budget.table()
+	time.Sleep(150 * time.Millisecond)
+	if ctx.Err() != nil {
+		t.Fatal("budget expired although a table granted more time")
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("budget did not expire")
+	}
+	err := budget.explain(context.Canceled)
+	if code := errs.Code(err); code != errs.ExitTimeout {
+		t.Errorf("explain = %v with exit code %d, want a timeout (%d)", err, code, errs.ExitTimeout)
+	}
+	if err := budget.explain(nil); err != nil {
+		t.Errorf("explain(nil) = %v", err)
+	}
+}
+
+// restorePlanOf splits dump for a parallel restore.
+func restorePlanOf(t *testing.T, dump string) (*restorePlan, string) {
+	t.Helper()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "dump.sql")
+	if err := os.WriteFile(path, []byte(dump), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	plan, reason, err := planRestore(path, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return plan, reason
+}
+
+func TestRestoreGroups(t *testing.T) {
+	// Tables connected by foreign keys in any order and case share a group,
+	// the largest group first, and tables without rows are left out
+	plan, reason := restorePlanOf(t, "PRAGMA foreign_keys=OFF;\nBEGIN TRANSACTION;\n"+
+		"CREATE TABLE grandchild(id INTEGER PRIMARY KEY, child_id INTEGER REFERENCES child(id));\nINSERT INTO grandchild VALUES(1,1);\n"+
+		"CREATE TABLE lone(id INTEGER PRIMARY KEY, v TEXT);\nINSERT INTO lone VALUES(1,'a');\n"+
+		"CREATE TABLE parent(id INTEGER PRIMARY KEY);\nINSERT INTO parent VALUES(1);\n"+
+		"CREATE TABLE child(id INTEGER PRIMARY KEY, parent_id INTEGER, FOREIGN KEY(parent_id) REFERENCES Parent(id));\nINSERT INTO child VALUES(1,1);\n"+
+		"CREATE TABLE empty(id INTEGER PRIMARY KEY REFERENCES lone(id));\n"+
+		"CREATE INDEX child_parent ON child(parent_id);\nCOMMIT;\n")
+	if plan == nil {
+		t.Fatalf("planRestore: %s", reason)
+	}
+	names := func(group []*plannedTable) string {
+		var names []string
+		for _, table := range group {
+			names = append(names, table.name)
+		}
+		return strings.Join(names, ",")
+	}
+	for jobs, want := range map[int][]string{
+		1: {"grandchild,parent,child,lone"},
+		2: {"grandchild,parent,child", "lone"},
+		8: {"grandchild,parent,child", "lone"},
+	} {
+		groups := plan.groups(jobs)
+		var got []string
+		for _, group := range groups {
+			got = append(got, names(group))
+		}
+		if strings.Join(got, " ") != strings.Join(want, " ") {
+			t.Errorf("groups(%d) = %q, want %q", jobs, got, want)
+		}
+	}
+	if len(plan.tail) != 1 || !strings.HasPrefix(plan.tail[0], "CREATE INDEX") {
+		t.Errorf("tail = %q, want the index", plan.tail)
+	}
+}
+
+func TestPlanRestoreFallbacks(t *testing.T) {
+	const table = "CREATE TABLE a(id INTEGER PRIMARY KEY, v);\n"
+	for _, tt := range []struct {
+		name   string
+		dump   string
+		reason string
+	}{
+		{"data after trigger", table + "CREATE TRIGGER a_ins AFTER INSERT ON a BEGIN SELECT 1; END;\nINSERT INTO a VALUES(1,1);\n", "data statement not bound"},
+		{"table after trigger", table + "CREATE TRIGGER a_ins AFTER INSERT ON a BEGIN SELECT 1; END;\nCREATE TABLE b(x);\n", "table created after a trigger"},
+		{"session statement", "PRAGMA recursive_triggers=ON;\n" + table + "INSERT INTO a VALUES(1,1);\n", "session statement"},
+		{"generated column", "CREATE TABLE g(x INTEGER, y INTEGER AS (x * 2));\nINSERT INTO g(x) VALUES(1);\n", "table definition not supported"},
+		{"update", table + "INSERT INTO a VALUES(1,1);\nUPDATE a SET v = 2;\n", "data statement not bound"},
+		{"table created twice", table + "CREATE TABLE A(id);\n", "table created twice"},
+	} {
+		if plan, reason := restorePlanOf(t, tt.dump); plan != nil || !strings.Contains(reason, tt.reason) {
+			t.Errorf("%s: planRestore = %v, %q; want no plan because of %q", tt.name, plan, reason, tt.reason)
+		}
+	}
+}
+
+func TestRestoreParallelMatchesSerial(t *testing.T) {
+	ctx := context.Background()
+	eng := &sqlite.Engine{Embedded: true}
+	// A dump above ParallelThreshold with two groups of tables and
+	// statements that run after the data
+	var dump strings.Builder
+	dump.WriteString("PRAGMA foreign_keys=OFF;\nBEGIN TRANSACTION;\n" +
+		"CREATE TABLE parent(id INTEGER PRIMARY KEY, name TEXT);\n" +
+		"CREATE TABLE child(id INTEGER PRIMARY KEY, parent_id INTEGER REFERENCES parent(id), note TEXT);\n" +
+		"CREATE TABLE other(k TEXT PRIMARY KEY, v REAL);\n" +
+		"CREATE TABLE log(at INTEGER, message TEXT);\n")
+	pad := strings.Repeat("x", 100)
+	for table, row := range []string{"parent VALUES(%d,'p%[1]d " + pad + "')", "child VALUES(%d,%[1]d,'c%[1]d " + pad + "')", "other VALUES('k%d',%[1]d.5)", "log VALUES(%d,'" + pad + "')"} {
+		for i := 1; dump.Len() < (table+1)*ParallelThreshold/4+1024; i++ {
+			fmt.Fprintf(&dump, "INSERT INTO "+row+";\n", i)
+		}
+	}
+	dump.WriteString("CREATE INDEX child_parent ON child(parent_id);\n" +
+		"CREATE VIEW parents AS SELECT name FROM parent;\n" +
+		"CREATE TRIGGER log_parent AFTER INSERT ON parent BEGIN INSERT INTO log VALUES(0,new.name); END;\n" +
+		"COMMIT;\n")
+	if plan, reason := restorePlanOf(t, dump.String()); plan == nil || len(plan.groups(4)) < 2 {
+		t.Fatalf("dump does not split into table groups: %s", reason)
+	}
+
+	dir := t.TempDir()
+	clean := func(jobs int) string {
+		t.Helper()
+		out := filepath.Join(dir, fmt.Sprintf("jobs%d.db", jobs))
+		if err := Smudge(ctx, eng, strings.NewReader(dump.String()), nil, SmudgeOptions{Output: out, Jobs: jobs}); err != nil {
+			t.Fatalf("Smudge with %d jobs: %v", jobs, err)
+		}
+		f, err := os.Open(out)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		var cleaned strings.Builder
+		if err := Clean(ctx, eng, f, &cleaned, DefaultOptions()); err != nil {
+			t.Fatal(err)
+		}
+		return cleaned.String()
+	}
+	serial, parallel := clean(1), clean(4)
+	if serial != parallel {
+		t.Errorf("dumps of the databases restored with -jobs 4 and -jobs 1 differ (%d and %d bytes)", len(parallel), len(serial))
+	}
+	if !strings.Contains(parallel, "CREATE TRIGGER log_parent") || !strings.Contains(parallel, "CREATE VIEW parents") {
+		t.Errorf("parallel restore lost the statements after the data")
+	}
+}
+
+func TestSmudgeKeepsLocalState(t *testing.T) {
+	ctx := context.Background()
+	eng := &sqlite.Engine{Embedded: true}
+	dir := t.TempDir()
+	worktree, out := filepath.Join(dir, "app.db"), filepath.Join(dir, "out.db")
+	// Row 2 is not versioned, notes is a local table, and the local cfg
+	// lacks a column of the versioned one
+	if err := eng.Restore(ctx, worktree, strings.NewReader("CREATE TABLE t(k INTEGER PRIMARY KEY, keep INT);\nINSERT INTO t VALUES(1,1),(2,0);\n"+
+		"CREATE TABLE notes(x);\nINSERT INTO notes VALUES('mine');\nCREATE TABLE cfg(a);\nINSERT INTO cfg VALUES(1);\n")); err != nil {
+		t.Fatal(err)
+	}
+	dump := "CREATE TABLE t(k INTEGER PRIMARY KEY, keep INT);\nINSERT INTO t VALUES(1,1);\nINSERT INTO t VALUES(3,1);\nCREATE TABLE cfg(a, b);\n"
+	rules, err := ParseSubset(strings.NewReader("t: keep = 1\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorded := warnings.Record()
+	err = Smudge(ctx, eng, strings.NewReader(dump), nil, SmudgeOptions{Output: out, TargetPath: worktree, Subset: rules, LocalTables: []string{"notes", "cfg"}})
+	emitted := recorded()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for query, want := range map[string]string{
+		"SELECT group_concat(k) FROM (SELECT k FROM t ORDER BY k);": "1,2,3",
+		"SELECT group_concat(x) FROM notes;":                        "mine",
+		"SELECT count(*) FROM cfg;":                                 "0",
+	} {
+		rows, err := eng.Query(ctx, out, query)
+		if err != nil || len(rows) != 1 || rows[0][0] != want {
+			t.Errorf("%s = %v, %v; want %s", query, rows, err, want)
+		}
+	}
+	if len(emitted) != 1 || emitted[0].ID != warnings.LocalMergeFailed || !strings.Contains(emitted[0].Message, "table cfg") {
+		t.Errorf("warnings = %v, want %s about table cfg", emitted, warnings.LocalMergeFailed)
+	}
+}
+
+func TestCleanSidecars(t *testing.T) {
+	ctx := context.Background()
+	eng := &sqlite.Engine{Embedded: true}
+	dir := t.TempDir()
+	live, src := filepath.Join(dir, "live.db"), filepath.Join(dir, "app.db")
+
+	// Row 2 is only in the WAL of a database still open in an application;
+	// copying the files while it is open leaves it un-checkpointed
+	db, err := sql.Open("sqlite", live)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for _, stmt := range []string{
+		"PRAGMA journal_mode=WAL;", "PRAGMA wal_autocheckpoint=0;",
+		"CREATE TABLE t(id INTEGER PRIMARY KEY, v TEXT);", "INSERT INTO t VALUES(1,'checkpointed');",
+		"PRAGMA wal_checkpoint(TRUNCATE);", "INSERT INTO t VALUES(2,'in the wal');",
+	} {
+		if _, err := conn.ExecContext(ctx, stmt); err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+	for _, suffix := range []string{"", "-wal"} {
+		data, err := os.ReadFile(live + suffix)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(src+suffix, data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wal, err := os.ReadFile(src + "-wal")
+	if err != nil || len(wal) == 0 {
+		t.Fatalf("no WAL next to the database: %v", err)
+	}
+
+	for _, tt := range []struct {
+		policy string
+		walRow bool
+		warned bool
+	}{
+		{SidecarFold, true, false},
+		{SidecarWarn, false, true},
+		{SidecarIgnore, false, false},
+	} {
+		f, err := os.Open(src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts := DefaultOptions()
+		opts.SourcePath = src
+		opts.Sidecars = tt.policy
+		var out strings.Builder
+		recorded := warnings.Record()
+		err = Clean(ctx, eng, f, &out, opts)
+		emitted := recorded()
+		f.Close()
+		if err != nil {
+			t.Fatalf("%s: %v", tt.policy, err)
+		}
+		if !strings.Contains(out.String(), "'checkpointed'") || strings.Contains(out.String(), "'in the wal'") != tt.walRow {
+			t.Errorf("%s: dump has the row in the WAL: %v, want %v:\n%s", tt.policy, !tt.walRow, tt.walRow, out.String())
+		}
+		if warned := len(emitted) == 1 && emitted[0].ID == warnings.JournalNotFolded; warned != tt.warned || len(emitted) > 1 {
+			t.Errorf("%s: warnings %v, want W004: %v", tt.policy, emitted, tt.warned)
+		}
+		// The worktree files are never written
+		if data, err := os.ReadFile(src + "-wal"); err != nil || !bytes.Equal(data, wal) {
+			t.Errorf("%s: the WAL next to the database changed: %v", tt.policy, err)
+		}
+		if _, err := os.Stat(src + "-shm"); err == nil {
+			t.Errorf("%s: clean created %s-shm", tt.policy, src)
+		}
+	}
+}
+
+func TestFreeSpacePreflight(t *testing.T) {
+	ctx := context.Background()
+	eng := &sqlite.Engine{Embedded: true}
+	dir := t.TempDir()
+	if _, err := freeSpace(dir); err != nil {
+		t.Skipf("free disk space unknown: %v", err)
+	}
+	// No disk holds 4 EiB, and the temporary files go to dir
+	const huge = 1 << 62
+	t.Setenv("TMPDIR", dir)
+	t.Setenv("TEMP", dir)
+	t.Setenv("TMP", dir)
+
+	opts := DefaultOptions()
+	opts.InputSize = huge
+	if err := Clean(ctx, eng, strings.NewReader("unread"), io.Discard, opts); err == nil || !strings.Contains(err.Error(), "not enough disk space") {
+		t.Errorf("Clean = %v, want a disk space error", err)
+	}
+	output := filepath.Join(dir, "out", "app.db")
+	if err := os.Mkdir(filepath.Dir(output), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	err := Smudge(ctx, eng, strings.NewReader("unread"), nil, SmudgeOptions{Output: output, InputSize: huge})
+	if err == nil || !strings.Contains(err.Error(), "not enough disk space") || !strings.Contains(err.Error(), filepath.Dir(output)) {
+		t.Errorf("Smudge = %v, want a disk space error naming the directory of the output", err)
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, _ := os.ReadDir(filepath.Dir(output)); len(entries) != 1 || len(out) != 0 {
+		t.Errorf("temporary files created: %v and %v", entries, out)
+	}
+}
@@ -0,0 +1,108 @@
+package filters
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+)
+
+// FormatPrefix starts the comment clean writes after the dump header to
+// record the version of the dump format, such as "-- gitsqlite-format: 2".
+const FormatPrefix = "-- gitsqlite-format: "
+
+// Dump format versions (-format-version). A release that changes the output
+// of clean for an unchanged database adds a version, and keeps writing the
+// older ones for repositories that pin them or have dumps in them.
+const (
+	// FormatUnversioned is the format of dumps written before versions were
+	// recorded: no version comment, and schema objects and rows in .dump
+	// order.
+	FormatUnversioned = 1
+	// FormatSortedSchema records the version and sorts schema objects
+	// (SchemaOrderSorted).
+	FormatSortedSchema = 2
+	// CurrentFormat is the newest version this release writes.
+	CurrentFormat = FormatSortedSchema
+)
+
+// formatComment returns the line recording version, empty for
+// FormatUnversioned.
+func formatComment(version int) string {
+	if version <= FormatUnversioned {
+		return ""
+	}
+	return fmt.Sprintf("%s%d\n", FormatPrefix, version)
+}
+
+// parseFormatComment returns the version the comment line records, 0 if line
+// is not a version comment.
+func parseFormatComment(line string) int {
+	rest, ok := strings.CutPrefix(strings.TrimRight(line, "\r"), FormatPrefix)
+	if !ok {
+		return 0
+	}
+	version, err := strconv.Atoi(strings.TrimSpace(rest))
+	if err != nil || version < 1 {
+		return 0
+	}
+	return version
+}
+
+// statementFormat returns the version recorded in the comment lines leading
+// stmt, 0 if there is none.
+func statementFormat(stmt string) int {
+	for _, line := range strings.Split(strings.TrimLeft(stmt, "\r\n"), "\n") {
+		if !strings.HasPrefix(line, "--") {
+			break
+		}
+		if version := parseFormatComment(line); version > 0 {
+			return version
+		}
+	}
+	return 0
+}
+
+// negotiateFormat returns the version clean writes: the pinned version if
+// there is one, else the version of the dump in the git index, else
+// CurrentFormat. indexed is 0 without an indexed dump.
+func negotiateFormat(pinned, indexed int) int {
+	switch {
+	case pinned > 0:
+		return pinned
+	case indexed > CurrentFormat:
+		slog.Warn("The dump in the git index has a newer format than this gitsqlite writes; upgrade gitsqlite or pin -format-version",
+			"format", indexed, "supported", CurrentFormat)
+		return CurrentFormat
+	case indexed > 0:
+		return indexed
+	}
+	return CurrentFormat
+}
+
+// formatVersion returns the version the dump functions write with opts.
+func (o Options) formatVersion() int {
+	if o.FormatVersion == 0 {
+		return CurrentFormat
+	}
+	return o.FormatVersion
+}
+
+// schemaOrderPolicy returns the schema order policy of opts, which
+// FormatUnversioned fixes to SchemaOrderDump.
+func (o Options) schemaOrderPolicy() string {
+	if o.formatVersion() == FormatUnversioned {
+		return SchemaOrderDump
+	}
+	return o.SchemaOrder
+}
+
+// rowOrderPolicy returns the row order policy of opts, which
+// FormatUnversioned and an indexed dump in .dump row order fix to
+// RowOrderDump.
+func (o Options) rowOrderPolicy() string {
+	if o.formatVersion() == FormatUnversioned || o.legacy.DumpRowOrder {
+		return RowOrderDump
+	}
+	return o.RowOrder
+}
@@ -0,0 +1,26 @@
+package filters
+
+// DumpHeader is the header block every clean/diff output starts with. It is
+// written by gitsqlite itself instead of being copied from sqlite3, whose
+// header lines vary between versions, so the first lines of every dump are
+// identical across environments.
+const DumpHeader = "PRAGMA foreign_keys=OFF;\nBEGIN TRANSACTION;\n"
+
+// headerFilter drops the header statements (foreign_keys pragmas and
+// transaction starts, in any spelling) sqlite3 emits before the first
+// schema or data statement of a dump.
+type headerFilter struct {
+	done bool
+}
+
+// skip reports whether stmt belongs to the sqlite3 header and must be dropped.
+func (h *headerFilter) skip(stmt string) bool {
+	if h.done || ClassifyStatement(stmt) == StatementEmpty {
+		return false
+	}
+	if _, kind := canonicalControlStatement(stmt); kind == controlBegin || kind == controlPragma {
+		return true
+	}
+	h.done = true
+	return false
+}
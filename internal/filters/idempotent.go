@@ -0,0 +1,89 @@
+package filters
+
+import (
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/danielsiegl/gitsqlite/internal/errs"
+)
+
+// idempotencyCheck normalizes the statements clean writes a second time and
+// fails if that changes them (-assert-idempotent). Normalization that is not
+// idempotent writes a different dump when a database restored from the dump
+// is cleaned again, so an unchanged database shows up as modified.
+//
+// Only the steps that rewrite values in place are repeated: canonical schema,
+// REAL columns, control characters, invalid UTF-8 and floats. Filtering,
+// redaction and BLOB pointers select or replace data and are not expected to
+// be idempotent on their own output.
+type idempotencyCheck struct {
+	opts          Options
+	normalizeLine func(line string, floatPrecision int) string
+	checked       int
+}
+
+func newIdempotencyCheck(opts Options) *idempotencyCheck {
+	if !opts.AssertIdempotent {
+		return nil
+	}
+	return &idempotencyCheck{opts: opts, normalizeLine: normalizerFor(opts.Normalizer)}
+}
+
+// normalize returns stmt normalized as DumpTables does.
+func (c *idempotencyCheck) normalize(stmt string, tables TableMap, lines bool) string {
+	if c.opts.CanonicalSchema && IsSchemaLine(stmt) {
+		stmt = CanonicalizeCreateTable(stmt)
+	}
+	if !c.opts.legacy.IntegralReals {
+		stmt = NormalizeRealColumns(stmt, tables, c.opts.FloatPrecision)
+	}
+	if c.opts.ControlChars == ControlCharsChar {
+		stmt = CanonicalizeControlChars(stmt)
+	}
+	stmt, _ = EnsureUTF8(stmt, c.opts.InvalidUTF8)
+	if !lines {
+		return stmt
+	}
+	return c.normalizeLines(stmt)
+}
+
+// normalizeLines returns stmt with the floats of every line normalized.
+func (c *idempotencyCheck) normalizeLines(stmt string) string {
+	parts := strings.Split(stmt, "\n")
+	for i, line := range parts {
+		parts[i] = c.normalizeLine(line, c.opts.FloatPrecision)
+	}
+	return strings.Join(parts, "\n")
+}
+
+// check returns an error if normalizing stmt, as written by the first pass
+// with its lines normalized if lines is set, changes it.
+func (c *idempotencyCheck) check(stmt string, tables TableMap, lines bool) error {
+	if c == nil {
+		return nil
+	}
+	c.checked++
+	second := c.normalize(stmt, tables, lines)
+	if second == stmt {
+		return nil
+	}
+	first, again := strings.Split(stmt, "\n"), strings.Split(second, "\n")
+	for i := range first {
+		if i >= len(again) || first[i] != again[i] {
+			var changed string
+			if i < len(again) {
+				changed = again[i]
+			}
+			return errs.Mark(fmt.Errorf("normalization is not idempotent: a second pass changes %.200q to %.200q", first[i], changed), errs.ErrCheckFailed)
+		}
+	}
+	return errs.Mark(fmt.Errorf("normalization is not idempotent: a second pass adds %.200q", again[len(first)]), errs.ErrCheckFailed)
+}
+
+// report logs how many statements were checked.
+func (c *idempotencyCheck) report() {
+	if c != nil {
+		slog.Info("Normalization is idempotent", "statements", c.checked)
+	}
+}
@@ -0,0 +1,363 @@
+package filters
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/danielsiegl/gitsqlite/internal/gitdir"
+	"github.com/danielsiegl/gitsqlite/internal/logging"
+	"github.com/danielsiegl/gitsqlite/internal/shutdown"
+	"github.com/danielsiegl/gitsqlite/internal/sqlite"
+)
+
+// TableCache holds the table hashes of the databases smudge -output wrote,
+// under <git-dir>/gitsqlite/tables, so that the next smudge of an unchanged
+// file only restores the tables whose part of the dump differs.
+type TableCache struct {
+	// Dir is the directory the hashes are stored in.
+	Dir string
+	// Root is the worktree root; hashes are keyed by the path of the
+	// database relative to it.
+	Root string
+}
+
+// OpenTableCache returns the table cache of the repository containing the
+// current working directory.
+func OpenTableCache(ctx context.Context) (*TableCache, error) {
+	dir, root, err := gitdir.WorktreeDir(ctx, "tables")
+	if err != nil {
+		return nil, err
+	}
+	return &TableCache{Dir: dir, Root: root}, nil
+}
+
+// tableHashes are the hashes of the parts of a dump, and the size and
+// modification time of the database file restored from it.
+type tableHashes struct {
+	Size    int64 `json:"size"`
+	ModTime int64 `json:"mtime"`
+	// Tables maps lower-case table names to the hash of the table's CREATE
+	// TABLE, rows, indexes and triggers.
+	Tables map[string]string `json:"tables"`
+	// Rest is the hash of everything else: views, internal tables, other
+	// statements and the database settings.
+	Rest string `json:"rest"`
+
+	// last holds the tables after the last statement of the rest between
+	// tables, sorted whether the tables are in the order clean sorts them.
+	last   map[string]bool
+	sorted bool
+}
+
+// file returns the file holding the hashes of a worktree path.
+func (c *TableCache) file(path string) string {
+	key := filepath.Clean(path)
+	if abs, err := filepath.Abs(path); err == nil {
+		if rel, err := filepath.Rel(c.Root, abs); err == nil && !strings.HasPrefix(rel, "..") {
+			key = rel
+		}
+	}
+	return filepath.Join(c.Dir, url.PathEscape(filepath.ToSlash(key))+".json")
+}
+
+// load returns the hashes stored for path, or nil if there are none or the
+// file was changed after they were stored.
+func (c *TableCache) load(path string) *tableHashes {
+	data, err := os.ReadFile(c.file(path))
+	if err != nil {
+		return nil
+	}
+	var h tableHashes
+	if err := json.Unmarshal(data, &h); err != nil {
+		slog.Debug("Ignoring unreadable table hashes", "path", path, "error", err)
+		return nil
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.Size() != h.Size || info.ModTime().UnixNano() != h.ModTime {
+		return nil
+	}
+	return &h
+}
+
+// save stores h as the hashes of the database just written to path.
+func (c *TableCache) save(path string, h *tableHashes) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	h.Size, h.ModTime = info.Size(), info.ModTime().UnixNano()
+	data, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(c.Dir, 0o755); err != nil {
+		return err
+	}
+	// Write to a temporary name first so a crash never leaves partial hashes
+	name := c.file(path)
+	if err := os.WriteFile(name+".tmp", data, 0o644); err != nil {
+		os.Remove(name + ".tmp")
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// dumpPart returns the lower-case name of the table a statement of a dump
+// belongs to, given the tables created so far, or "" for the rest.
+func dumpPart(stmt string, tables map[string]bool) string {
+	if kind, name := schemaObjectName(stmt); kind == "table" {
+		if name = strings.ToLower(name); !isInternalTable(name) {
+			return name
+		}
+		return ""
+	}
+	name := strings.ToLower(InsertTableName(stmt))
+	if name == "" {
+		name = strings.ToLower(SchemaObjectTable(stmt))
+	}
+	if tables[name] {
+		return name
+	}
+	return ""
+}
+
+// hashDump returns the hashes of the parts of the dump at dumpPath restored
+// into a database with pragmas.
+//
+// clean sorts the tables between two statements of the rest, such as the
+// ANALYZE of the statistics, but where such a statement lands depends on the
+// order the tables were created in. The rest therefore includes the tables
+// preceding each of them; a table can only be restored on its own, which
+// creates it anew, if it follows all of them.
+func hashDump(dumpPath string, pragmas []Pragma) (*tableHashes, error) {
+	f, err := os.Open(dumpPath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	parts := map[string]hash.Hash{}
+	rest := sha256.New()
+	io.WriteString(rest, PragmaComments(pragmas))
+	tables := map[string]bool{}
+	var names []string
+	deps := map[string][]string{}
+	// segment holds the tables since the last statement of the rest that
+	// clean does not move to the end, barrier whether such a statement
+	// followed them
+	var segment []string
+	barrier := false
+	format := 0
+	scanner := NewStatementScanner(f)
+	for scanner.Scan() {
+		stmt := scanner.Text()
+		if len(tables) == 0 && format == 0 {
+			format = statementFormat(stmt)
+		}
+		if ClassifyStatement(stmt) == StatementEmpty {
+			continue
+		}
+		// Comments such as the format version are not part of any table
+		stmt = stripLeadingComments(stmt)
+		part := dumpPart(stmt, tables)
+		if part == "" {
+			io.WriteString(rest, stmt+"\n")
+			// Views are sorted with the indexes and triggers at the end
+			if kind, _ := schemaObjectName(stmt); kind != "view" && len(tables) > 0 {
+				_, control := canonicalControlStatement(stmt)
+				barrier = barrier || control != controlCommit
+			}
+			continue
+		}
+		if !tables[part] {
+			if barrier {
+				fmt.Fprintf(rest, "-- after %s\n", strings.Join(segment, ","))
+				segment, barrier = nil, false
+			}
+			tables[part] = true
+			names = append(names, part)
+			segment = append(segment, part)
+			parts[part] = sha256.New()
+			if ct, err := ParseCreateTable(stmt); err == nil {
+				for _, ref := range ct.ReferencedTables() {
+					deps[part] = append(deps[part], strings.ToLower(ref))
+				}
+			}
+		}
+		io.WriteString(parts[part], stmt+"\n")
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if barrier {
+		fmt.Fprintf(rest, "-- after %s\n", strings.Join(segment, ","))
+		segment = nil
+	}
+	h := &tableHashes{Tables: map[string]string{}, Rest: hex.EncodeToString(rest.Sum(nil)), last: map[string]bool{}}
+	for name, sum := range parts {
+		h.Tables[name] = hex.EncodeToString(sum.Sum(nil))
+	}
+	for _, name := range segment {
+		h.last[name] = true
+	}
+	// Tables in .dump order are in creation order, which a new table changes
+	h.sorted = format >= FormatSortedSchema
+	var want []string
+	for _, name := range sortByDependencies(names, deps) {
+		if h.last[name] {
+			want = append(want, name)
+		}
+	}
+	for i := range segment {
+		h.sorted = h.sorted && segment[i] == want[i]
+	}
+	return h, nil
+}
+
+// stripLeadingComments removes the comment lines before a statement.
+func stripLeadingComments(stmt string) string {
+	for strings.HasPrefix(stmt, "--") {
+		_, rest, ok := strings.Cut(stmt, "\n")
+		if !ok {
+			return ""
+		}
+		stmt = rest
+	}
+	return stmt
+}
+
+// restoreIncremental restores the dump sql into dbPath like restore, and
+// returns the hashes of its parts for opts.TableCache. If the hashes stored
+// for opts.Output match the file and the dump differs from it only in tables,
+// dbPath becomes a copy of opts.Output in which only those tables are dropped
+// and restored, and updated is true. Internal tables such as sqlite_stat1 are
+// rewritten then, as dropping a table also drops its rows in them.
+func restoreIncremental(ctx context.Context, eng *sqlite.Engine, dbPath string, sql io.Reader, pragmas []Pragma, opts SmudgeOptions) (h *tableHashes, updated bool, err error) {
+	workDir, err := os.MkdirTemp("", "gitsqlite-incremental-*")
+	if err != nil {
+		return nil, false, err
+	}
+	defer shutdown.Remove(workDir)()
+	spoolPath := filepath.Join(workDir, "dump.sql")
+	if _, err := spoolToFile(sql, spoolPath); err != nil {
+		return nil, false, err
+	}
+	if h, err = hashDump(spoolPath, pragmas); err != nil {
+		return nil, false, err
+	}
+
+	full := func(reason string) (*tableHashes, bool, error) {
+		slog.Info("Restoring all tables", "reason", reason)
+		f, err := os.Open(spoolPath)
+		if err != nil {
+			return nil, false, err
+		}
+		defer f.Close()
+		return h, false, restore(ctx, eng, dbPath, f, opts.Jobs)
+	}
+	cached := opts.TableCache.load(opts.Output)
+	switch {
+	case cached == nil:
+		return full("no table hashes for the current file")
+	case cached.Rest != h.Rest:
+		return full("views, internal tables or settings changed")
+	case fileSize(opts.Output+"-wal") > 0:
+		return full("database has a write-ahead log")
+	case !h.sorted:
+		return full("tables are not sorted")
+	}
+
+	var changed []string
+	unchanged := 0
+	for name, sum := range h.Tables {
+		if cached.Tables[name] != sum {
+			changed = append(changed, name)
+		} else {
+			unchanged++
+		}
+	}
+	for name := range cached.Tables {
+		if _, ok := h.Tables[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	for _, name := range changed {
+		if _, ok := h.Tables[name]; ok && !h.last[name] {
+			return full("changed table " + name + " precedes internal tables or other statements")
+		}
+	}
+
+	start := time.Now()
+	if err := copyFile(opts.Output, dbPath); err != nil {
+		return nil, false, err
+	}
+	if len(changed) > 0 {
+		script, err := updateScript(spoolPath, changed)
+		if err != nil {
+			return nil, false, err
+		}
+		if err := eng.Restore(ctx, dbPath, strings.NewReader(script)); err != nil {
+			return nil, false, err
+		}
+	}
+	slog.Info("Restored changed tables only", "changed", changed, "unchanged", unchanged,
+		"duration", logging.FormatDuration(time.Since(start)))
+	return h, true, nil
+}
+
+// updateScript returns the statements that drop the changed tables and
+// restore them from the dump at dumpPath, followed by the rows of the
+// internal tables.
+func updateScript(dumpPath string, changed []string) (string, error) {
+	f, err := os.Open(dumpPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	isChanged := map[string]bool{}
+	var script strings.Builder
+	script.WriteString("PRAGMA foreign_keys=OFF;\nBEGIN TRANSACTION;\n")
+	for _, name := range changed {
+		isChanged[name] = true
+		fmt.Fprintf(&script, "DROP TABLE IF EXISTS %s;\n", sqlite.QuoteIdent(name))
+	}
+	var internal strings.Builder
+	cleared := map[string]bool{}
+	tables := map[string]bool{}
+	scanner := NewStatementScanner(f)
+	for scanner.Scan() {
+		stmt := stripLeadingComments(scanner.Text())
+		if part := dumpPart(stmt, tables); part != "" {
+			tables[part] = true
+			if isChanged[part] {
+				script.WriteString(stmt + "\n")
+			}
+			continue
+		}
+		if table := strings.ToLower(InsertTableName(stmt)); isInternalTable(table) {
+			if !cleared[table] {
+				fmt.Fprintf(&internal, "DELETE FROM %s;\n", table)
+				cleared[table] = true
+			}
+			internal.WriteString(stmt + "\n")
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	script.WriteString(internal.String())
+	script.WriteString("COMMIT;\n")
+	return script.String(), nil
+}
@@ -0,0 +1,181 @@
+package filters
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Span is a half-open range [Start, End) of token indices.
+type Span struct {
+	Start, End int
+}
+
+// Insert is a parsed INSERT ... VALUES statement. Tokens holds the complete
+// token stream, so String reproduces the statement exactly, including any
+// modification made to individual value tokens.
+type Insert struct {
+	Tokens  []Token
+	Table   string   // unquoted table name (without schema qualifier)
+	Columns []string // explicit column list, if any (unquoted)
+	Rows    [][]Span // value spans per row, excluding surrounding whitespace
+	// Conflict is the action of INSERT OR <action> in upper case, "REPLACE"
+	// for REPLACE INTO, and "" for a plain INSERT.
+	Conflict string
+	// Upsert is set if an ON CONFLICT or RETURNING clause follows the rows.
+	Upsert bool
+}
+
+// ParseInsert parses an INSERT INTO ... VALUES statement. INSERT OR <action>
+// and REPLACE INTO forms, a table alias and an ON CONFLICT (upsert) or
+// RETURNING clause after the rows are accepted; the clauses are kept in
+// Tokens.
+func ParseInsert(stmt string) (*Insert, error) {
+	toks := Tokenize(stmt)
+	ins := &Insert{Tokens: toks}
+
+	// sig holds the indices of significant (non-space, non-comment) tokens.
+	sig := make([]int, 0, len(toks))
+	for i, t := range toks {
+		if t.Kind != TokenSpace && t.Kind != TokenComment {
+			sig = append(sig, i)
+		}
+	}
+	at := func(k int) Token {
+		if k < len(sig) {
+			return toks[sig[k]]
+		}
+		return Token{}
+	}
+
+	k := 0
+	switch {
+	case at(k).Is("INSERT"):
+		k++
+		if at(k).Is("OR") {
+			ins.Conflict = strings.ToUpper(at(k + 1).Text)
+			k += 2
+		}
+	case at(k).Is("REPLACE"):
+		ins.Conflict = "REPLACE"
+		k++
+	default:
+		return nil, fmt.Errorf("not an INSERT statement")
+	}
+	if !at(k).Is("INTO") {
+		return nil, fmt.Errorf("expected INTO")
+	}
+	k++
+
+	// Table name, possibly schema-qualified.
+	name := at(k)
+	k++
+	if at(k).Text == "." {
+		name = at(k + 1)
+		k += 2
+	}
+	if name.Text == "" {
+		return nil, fmt.Errorf("missing table name")
+	}
+	ins.Table = UnquoteIdent(name.Text)
+	if at(k).Is("AS") {
+		k += 2
+	}
+
+	if at(k).Text == "(" {
+		k++
+		for k < len(sig) && at(k).Text != ")" {
+			if at(k).Text != "," {
+				ins.Columns = append(ins.Columns, UnquoteIdent(at(k).Text))
+			}
+			k++
+		}
+		k++
+	}
+	if !at(k).Is("VALUES") {
+		return nil, fmt.Errorf("expected VALUES")
+	}
+	k++
+
+	for at(k).Text == "(" {
+		k++
+		var row []Span
+		depth := 0
+		start := k
+		for k < len(sig) {
+			text := at(k).Text
+			if depth == 0 && (text == "," || text == ")") {
+				if k > start {
+					row = append(row, Span{Start: sig[start], End: sig[k-1] + 1})
+				}
+				if text == ")" {
+					break
+				}
+				start = k + 1
+			} else if text == "(" {
+				depth++
+			} else if text == ")" {
+				depth--
+			}
+			k++
+		}
+		if k >= len(sig) {
+			return nil, fmt.Errorf("unterminated VALUES row")
+		}
+		ins.Rows = append(ins.Rows, row)
+		k++ // closing parenthesis
+		if at(k).Text != "," {
+			break
+		}
+		k++
+	}
+	if len(ins.Rows) == 0 {
+		return nil, fmt.Errorf("no VALUES rows")
+	}
+	ins.Upsert = at(k).Text != "" && at(k).Text != ";"
+	return ins, nil
+}
+
+// Plain reports whether ins is a plain INSERT, whose rows are added to the
+// table whatever it holds, so they can be reordered or rewritten without
+// changing the result.
+func (ins *Insert) Plain() bool {
+	return ins.Conflict == "" && !ins.Upsert
+}
+
+// Value returns the text of a value span.
+func (ins *Insert) Value(s Span) string {
+	var b strings.Builder
+	for _, t := range ins.Tokens[s.Start:s.End] {
+		b.WriteString(t.Text)
+	}
+	return b.String()
+}
+
+// SetValue replaces the text of a value span.
+func (ins *Insert) SetValue(s Span, text string) {
+	ins.Tokens[s.Start] = Token{Kind: ins.Tokens[s.Start].Kind, Text: text}
+	for i := s.Start + 1; i < s.End; i++ {
+		ins.Tokens[i] = Token{Kind: TokenSpace}
+	}
+}
+
+// ColumnIndex maps a value position to a column index of the table, using
+// the explicit column list when present.
+func (ins *Insert) ColumnIndex(table *TableInfo, pos int) int {
+	if len(ins.Columns) == 0 {
+		return pos
+	}
+	if pos >= len(ins.Columns) {
+		return -1
+	}
+	return table.Index(ins.Columns[pos])
+}
+
+// String reassembles the statement.
+func (ins *Insert) String() string {
+	var b strings.Builder
+	for _, t := range ins.Tokens {
+		b.WriteString(t.Text)
+	}
+	return b.String()
+}
@@ -0,0 +1,121 @@
+package filters
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Keywords of -internal-tables besides table names.
+const (
+	// InternalTablesStat keeps the ANALYZE statistics, sqlite_stat1 to
+	// sqlite_stat4.
+	InternalTablesStat = "stat"
+	// InternalTablesAll keeps all internal tables.
+	InternalTablesAll = "all"
+	// InternalTablesNone drops all internal tables.
+	InternalTablesNone = "none"
+	// DefaultInternalTables keeps the statistics and drops sqlite_sequence,
+	// whose counters change with deleted rows that are not in the dump.
+	DefaultInternalTables = InternalTablesStat
+)
+
+// internalTables are the tables SQLite maintains itself whose content .dump
+// writes. Their rows are dumped as INSERT statements; sqlite_sequence is
+// created by AUTOINCREMENT and the statistics tables by ANALYZE.
+var internalTables = []string{"sqlite_sequence", "sqlite_stat1", "sqlite_stat2", "sqlite_stat3", "sqlite_stat4"}
+
+// ParseInternalTables returns the internal tables an -internal-tables value
+// keeps. The value is a comma-separated list of internal table names and
+// InternalTablesStat, or InternalTablesAll or InternalTablesNone.
+func ParseInternalTables(list string) ([]string, error) {
+	keep := []string{}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		switch name {
+		case "", InternalTablesNone:
+		case InternalTablesAll:
+			keep = append(keep, internalTables...)
+		case InternalTablesStat:
+			keep = append(keep, internalTables[1:]...)
+		default:
+			if !isInternalTable(name) {
+				return nil, fmt.Errorf("unknown internal table '%s' (expected %s, %s, %s or %s)",
+					name, strings.Join(internalTables, ", "), InternalTablesStat, InternalTablesAll, InternalTablesNone)
+			}
+			keep = append(keep, name)
+		}
+	}
+	return keep, nil
+}
+
+func isInternalTable(name string) bool {
+	for _, table := range internalTables {
+		if strings.EqualFold(name, table) {
+			return true
+		}
+	}
+	return false
+}
+
+// internalTableFilter drops the content of the internal tables that are not
+// kept from dumps.
+type internalTableFilter struct {
+	keep map[string]bool
+	// reset is set once the rows of sqlite_sequence are preceded by a DELETE.
+	reset bool
+}
+
+func newInternalTableFilter(keep []string) *internalTableFilter {
+	f := &internalTableFilter{keep: map[string]bool{}}
+	for _, table := range keep {
+		f.keep[strings.ToLower(table)] = true
+	}
+	return f
+}
+
+// skip reports whether line must be dropped: it inserts into an internal
+// table that is not kept, runs the ANALYZE creating the statistics tables
+// when none of them is kept, or is one of the CREATE TABLE, DELETE FROM
+// sqlite_sequence and writable_schema statements sqlite3 versions write
+// around internal tables, which restoring does not need (see rewrite).
+func (f *internalTableFilter) skip(line string) bool {
+	line = strings.TrimSpace(line)
+	// Skip PRAGMA writable_schema (used when creating sqlite_sequence)
+	if strings.Contains(line, "PRAGMA writable_schema") {
+		return true
+	}
+	if strings.Contains(line, "DELETE FROM sqlite_sequence") || strings.Contains(line, "DELETE FROM \"sqlite_sequence\"") {
+		return true
+	}
+	if kind, name := schemaObjectName(line); kind == "table" && isInternalTable(name) {
+		return true
+	}
+	if next := leadingTokens(line); next().Is("ANALYZE") {
+		if target := UnquoteIdent(next().Text); strings.EqualFold(target, "sqlite_schema") || strings.EqualFold(target, "sqlite_master") {
+			return !f.keepsStat()
+		}
+	}
+	table := strings.ToLower(InsertTableName(line))
+	return isInternalTable(table) && !f.keep[table]
+}
+
+// keepsStat reports whether any statistics table is kept.
+func (f *internalTableFilter) keepsStat() bool {
+	for _, table := range internalTables[1:] {
+		if f.keep[table] {
+			return true
+		}
+	}
+	return false
+}
+
+// rewrite returns line, with a DELETE FROM sqlite_sequence before the first
+// row of a kept sqlite_sequence: restoring the tables before it has filled
+// it already, and only some sqlite3 versions write the DELETE themselves.
+func (f *internalTableFilter) rewrite(line string) string {
+	if f.reset || !f.keep["sqlite_sequence"] || !strings.EqualFold(InsertTableName(strings.TrimSpace(line)), "sqlite_sequence") {
+		return line
+	}
+	f.reset = true
+	return "DELETE FROM sqlite_sequence;\n" + line
+}
@@ -0,0 +1,213 @@
+package filters
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"regexp"
+	"strings"
+
+	"github.com/danielsiegl/gitsqlite/internal/sqlite"
+)
+
+// Data formats (-format).
+const (
+	// DataFormatSQL writes rows as the INSERT statements of sqlite3 .dump.
+	DataFormatSQL = "sql"
+	// DataFormatJSONL writes every row as a JSON object on a line of its own,
+	// such as {"table":"t","columns":["id","name"],"values":[1,"a"]}. The
+	// schema and everything else stays SQL.
+	DataFormatJSONL = "jsonl"
+)
+
+// jsonRow is a row written by DataFormatJSONL.
+//
+// Values are JSON null, numbers and strings for SQL NULL, numeric and text
+// literals, {"blob":"<hex>"} for BLOB literals and {"sql":"<expression>"}
+// for anything else .dump writes, such as the replace() calls of text with
+// newlines, so that the rows restore to the same values.
+type jsonRow struct {
+	Table   string            `json:"table"`
+	Columns []string          `json:"columns"`
+	Values  []json.RawMessage `json:"values"`
+}
+
+// jsonNumber matches the numeric literals that are JSON numbers as well.
+var jsonNumber = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?$`)
+
+// rowsToJSON returns the rows of the single-line INSERT statement line as
+// JSON lines. Other statements, and rows of tables whose columns are not
+// known, such as the internal tables, are returned unchanged.
+func rowsToJSON(line string, tables TableMap) string {
+	ins, err := ParseInsert(strings.TrimSpace(line))
+	if err != nil || !ins.Plain() {
+		return line
+	}
+	columns := ins.Columns
+	if len(columns) == 0 {
+		table := tables.Lookup(ins.Table)
+		if table == nil {
+			return line
+		}
+		columns = table.Columns
+	}
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	// Text values are written as they are, < and > included
+	enc.SetEscapeHTML(false)
+	for _, row := range ins.Rows {
+		if len(row) != len(columns) {
+			return line
+		}
+		r := jsonRow{Table: ins.Table, Columns: columns, Values: make([]json.RawMessage, len(row))}
+		for i, span := range row {
+			r.Values[i] = jsonValue(ins, span)
+		}
+		if err := enc.Encode(r); err != nil {
+			return line
+		}
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// jsonValue returns the JSON form of a value of ins.
+func jsonValue(ins *Insert, span Span) json.RawMessage {
+	text := ins.Value(span)
+	encode := func(v any) json.RawMessage {
+		var b bytes.Buffer
+		enc := json.NewEncoder(&b)
+		enc.SetEscapeHTML(false)
+		_ = enc.Encode(v)
+		return bytes.TrimSuffix(b.Bytes(), []byte("\n"))
+	}
+	single := span.End-span.Start == 1
+	switch {
+	case strings.EqualFold(text, "NULL"):
+		return json.RawMessage("null")
+	case jsonNumber.MatchString(text):
+		return json.RawMessage(text)
+	case single && ins.Tokens[span.Start].Kind == TokenString:
+		if s, ok := unquoteString(text); ok {
+			return encode(s)
+		}
+	case single && ins.Tokens[span.Start].Kind == TokenBlob:
+		return encode(map[string]string{"blob": text[2 : len(text)-1]})
+	}
+	return encode(map[string]string{"sql": text})
+}
+
+// ExpandJSONRows returns a reader of the dump from r with the rows written
+// by DataFormatJSONL turned back into INSERT statements. A JSON line is only
+// recognized where a statement starts; everything else is passed through
+// byte for byte, so dumps in DataFormatSQL read unchanged.
+func ExpandJSONRows(r io.Reader) io.Reader {
+	return &jsonRowExpander{r: bufio.NewReaderSize(r, 64*1024)}
+}
+
+type jsonRowExpander struct {
+	r       *bufio.Reader
+	state   scanState
+	open    bool // inside a statement spanning lines
+	line    int
+	rows    int
+	pending []byte
+	err     error
+}
+
+func (e *jsonRowExpander) Read(p []byte) (int, error) {
+	for len(e.pending) == 0 {
+		if e.err != nil {
+			if e.err == io.EOF && e.rows > 0 {
+				slog.Info("Expanded JSON rows", "count", e.rows)
+				e.rows = 0
+			}
+			return 0, e.err
+		}
+		line, err := e.r.ReadString('\n')
+		e.err = err
+		e.line++
+		if !e.open && strings.HasPrefix(line, "{") {
+			stmt, err := jsonToInsert(line)
+			if err != nil {
+				e.err = fmt.Errorf("line %d: %w", e.line, err)
+				return 0, e.err
+			}
+			e.rows++
+			line = stmt
+		} else {
+			if !e.open {
+				e.state = scanState{}
+			}
+			e.state.feed(strings.TrimRight(line, "\r\n"))
+			e.open = !e.state.complete()
+		}
+		e.pending = []byte(line)
+	}
+	n := copy(p, e.pending)
+	e.pending = e.pending[n:]
+	return n, nil
+}
+
+// jsonToInsert returns the INSERT statement of a JSON line written by
+// rowsToJSON, with the line ending of line.
+func jsonToInsert(line string) (string, error) {
+	body := strings.TrimRight(line, "\r\n")
+	var row jsonRow
+	dec := json.NewDecoder(strings.NewReader(body))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&row); err != nil {
+		return "", fmt.Errorf("invalid JSON row: %w", err)
+	}
+	if row.Table == "" || len(row.Columns) != len(row.Values) {
+		return "", fmt.Errorf("invalid JSON row: need a table and as many columns as values")
+	}
+	columns := make([]string, len(row.Columns))
+	values := make([]string, len(row.Values))
+	for i, raw := range row.Values {
+		columns[i] = sqlite.QuoteIdent(row.Columns[i])
+		value, err := sqlValue(raw)
+		if err != nil {
+			return "", fmt.Errorf("invalid value of column %s: %w", row.Columns[i], err)
+		}
+		values[i] = value
+	}
+	return fmt.Sprintf("INSERT INTO %s(%s) VALUES(%s);", sqlite.QuoteIdent(row.Table), strings.Join(columns, ","), strings.Join(values, ",")) +
+		line[len(body):], nil
+}
+
+// sqlValue returns the SQL literal or expression of a JSON value.
+func sqlValue(raw json.RawMessage) (string, error) {
+	text := string(bytes.TrimSpace(raw))
+	switch {
+	case text == "null":
+		return "NULL", nil
+	case jsonNumber.MatchString(text):
+		return text, nil
+	case strings.HasPrefix(text, `"`):
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			return "", err
+		}
+		return sqlite.QuoteLiteral(s), nil
+	case strings.HasPrefix(text, "{"):
+		var obj map[string]string
+		if err := json.Unmarshal(raw, &obj); err != nil || len(obj) != 1 {
+			return "", fmt.Errorf("expected {\"blob\": hex} or {\"sql\": expression}")
+		}
+		if h, ok := obj["blob"]; ok {
+			if _, err := hex.DecodeString(h); err != nil {
+				return "", fmt.Errorf("invalid BLOB: %w", err)
+			}
+			return "X'" + h + "'", nil
+		}
+		if expr, ok := obj["sql"]; ok && expr != "" {
+			return expr, nil
+		}
+		return "", fmt.Errorf("expected {\"blob\": hex} or {\"sql\": expression}")
+	}
+	return "", fmt.Errorf("unsupported value %s", text)
+}
@@ -0,0 +1,160 @@
+package filters
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/danielsiegl/gitsqlite/internal/sqlite"
+)
+
+// ParseTableList splits a comma-separated list of table names.
+func ParseTableList(list string) []string {
+	var tables []string
+	for _, name := range strings.Split(list, ",") {
+		if name = UnquoteIdent(strings.TrimSpace(name)); name != "" {
+			tables = append(tables, name)
+		}
+	}
+	return tables
+}
+
+// SchemaObjectTable returns the table a schema statement belongs to: the
+// created table for CREATE [VIRTUAL] TABLE, and the indexed or triggering
+// table for CREATE INDEX and CREATE TRIGGER. It returns "" for any other
+// statement.
+func SchemaObjectTable(stmt string) string {
+	next := leadingTokens(stmt)
+	if !next().Is("CREATE") {
+		return ""
+	}
+	word := next()
+	if word.Is("TEMP") || word.Is("TEMPORARY") {
+		word = next()
+	}
+	if word.Is("UNIQUE") || word.Is("VIRTUAL") {
+		word = next()
+	}
+	isTable := word.Is("TABLE")
+	if !isTable && !word.Is("INDEX") && !word.Is("TRIGGER") {
+		return ""
+	}
+
+	// qualifiedName reads a possibly schema-qualified name starting at tok.
+	qualifiedName := func(tok Token) (string, Token) {
+		name := tok
+		after := next()
+		if after.Text == "." {
+			name = next()
+			after = next()
+		}
+		return UnquoteIdent(name.Text), after
+	}
+
+	tok := next()
+	if tok.Is("IF") {
+		next() // NOT
+		next() // EXISTS
+		tok = next()
+	}
+	name, tok := qualifiedName(tok)
+	if isTable {
+		return name
+	}
+	// Index and trigger: the table follows the first ON keyword
+	for ; tok.Text != ""; tok = next() {
+		if tok.Is("ON") {
+			table, _ := qualifiedName(next())
+			return table
+		}
+		if tok.Is("BEGIN") {
+			break
+		}
+	}
+	return ""
+}
+
+// localTableFilter drops the schema and rows of local-only tables from dumps.
+type localTableFilter map[string]bool
+
+func newLocalTableFilter(tables []string) localTableFilter {
+	f := localTableFilter{}
+	for _, t := range tables {
+		f[strings.ToLower(t)] = true
+	}
+	return f
+}
+
+// skip reports whether stmt creates, indexes, triggers on or inserts into a
+// local-only table.
+func (f localTableFilter) skip(stmt string) bool {
+	if len(f) == 0 {
+		return false
+	}
+	switch ClassifyStatement(stmt) {
+	case StatementData:
+		return f[strings.ToLower(InsertTableName(stmt))]
+	case StatementSchema:
+		return f[strings.ToLower(SchemaObjectTable(stmt))]
+	}
+	return false
+}
+
+// copyLocalTables copies local-only tables (schema, indexes, triggers and
+// rows) from the worktree database into the freshly restored database. A
+// table that also exists in the restored database keeps the restored schema
+// and gets the local rows. Tables that cannot be copied are skipped, and
+// their errors returned together.
+func copyLocalTables(ctx context.Context, eng *sqlite.Engine, restoredPath, localPath string, tables []string) error {
+	local, err := tableNames(ctx, eng, localPath)
+	if err != nil {
+		return err
+	}
+	restored, err := tableNames(ctx, eng, restoredPath)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, table := range tables {
+		if !local[strings.ToLower(table)] {
+			continue
+		}
+		var query strings.Builder
+		fmt.Fprintf(&query, "ATTACH DATABASE %s AS local_db; BEGIN;", sqlite.QuoteLiteral(localPath))
+		if restored[strings.ToLower(table)] {
+			columns, err := tableColumns(ctx, eng, restoredPath, "main", table)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("table %s: %w", table, err))
+				continue
+			}
+			list := quotedColumnList(columns)
+			fmt.Fprintf(&query, " DELETE FROM main.%s; INSERT INTO main.%s (%s) SELECT %s FROM local_db.%s;",
+				sqlite.QuoteIdent(table), sqlite.QuoteIdent(table), list, localColumnList(table, columns), sqlite.QuoteIdent(table))
+		} else {
+			rows, err := eng.Query(ctx, localPath, fmt.Sprintf(
+				"SELECT sql FROM sqlite_schema WHERE tbl_name = %s COLLATE NOCASE AND sql IS NOT NULL "+
+					"ORDER BY type <> 'table', rowid;", sqlite.QuoteLiteral(table)))
+			if err != nil {
+				errs = append(errs, fmt.Errorf("table %s: %w", table, err))
+				continue
+			}
+			for i, row := range rows {
+				query.WriteString(" " + row[0] + ";")
+				if i == 0 {
+					// Rows are copied before indexes and triggers are created
+					fmt.Fprintf(&query, " INSERT INTO main.%s SELECT * FROM local_db.%s;",
+						sqlite.QuoteIdent(table), sqlite.QuoteIdent(table))
+				}
+			}
+		}
+		query.WriteString(" COMMIT;")
+		if _, err := eng.Query(ctx, restoredPath, query.String()); err != nil {
+			errs = append(errs, fmt.Errorf("table %s: %w", table, err))
+			continue
+		}
+		slog.Info("Preserved local table", "table", table, "localPath", localPath)
+	}
+	return errors.Join(errs...)
+}
@@ -6,6 +6,16 @@ import (
 	"strings"
 )
 
+// Float normalizers (-normalizer).
+const (
+	// NormalizerFast finds floats with a byte scanner.
+	NormalizerFast = "fast"
+	// NormalizerRegex finds floats with a regular expression, as before the
+	// byte scanner was introduced. It gives the same output and is kept as a
+	// fallback during the transition.
+	NormalizerRegex = "regex"
+)
+
 // Normalization constants for consistent cross-platform float representation
 var (
 	// Match decimal floats in INSERT lines (simple & fast).
@@ -15,23 +25,182 @@ var (
 
 // NormalizeLine normalizes floating point numbers in SQL INSERT statements
 // to ensure consistent representation across different platforms (Windows/Linux/Mac).
-// This function only processes INSERT lines to avoid affecting DDL or comments.
+// This function only processes INSERT lines to avoid affecting DDL or comments,
+// and only the numeric literals of their VALUES section, so numbers inside
+// string literals, identifiers and comments are kept as they are.
 func NormalizeLine(line string, floatPrecision int) string {
 	trimmed := strings.TrimSpace(line)
 	// Only normalize INSERT lines (where values live)
-	if !strings.HasPrefix(trimmed, "INSERT INTO") {
+	if !strings.HasPrefix(trimmed, "INSERT INTO") || strings.IndexByte(line, '.') < 0 {
 		return line
 	}
 
+	return normalizeValues(line, floatPrecision, normalizeFloats)
+}
+
+// NormalizeLineRegex is NormalizeLine using the regular expression.
+func NormalizeLineRegex(line string, floatPrecision int) string {
+	if !strings.HasPrefix(strings.TrimSpace(line), "INSERT INTO") {
+		return line
+	}
+	return normalizeValues(line, floatPrecision, func(s string, floatPrecision int) string {
+		return floatRe.ReplaceAllStringFunc(s, func(m string) string {
+			return formatFloat(m, floatPrecision)
+		})
+	})
+}
+
+// normalizeValues applies floats to the numeric literals following the VALUES
+// keyword of an INSERT statement. A minus sign is a token of its own, which
+// gives the same result as rewriting it with the number.
+func normalizeValues(stmt string, floatPrecision int, floats func(string, int) string) string {
+	var b strings.Builder
+	last := 0
+	values := false
+	for i := 0; i < len(stmt); {
+		start := i
+		var tok Token
+		tok, i = nextToken(stmt, i)
+		switch {
+		case !values:
+			values = tok.Is("VALUES")
+		case tok.Kind == TokenNumber && strings.IndexByte(tok.Text, '.') >= 0:
+			if normalized := floats(tok.Text, floatPrecision); normalized != tok.Text {
+				b.WriteString(stmt[last:start])
+				b.WriteString(normalized)
+				last = i
+			}
+		}
+	}
+	if last == 0 {
+		return stmt
+	}
+	b.WriteString(stmt[last:])
+	return b.String()
+}
+
+// normalizerFor returns the line normalizer selected by name.
+func normalizerFor(name string) func(line string, floatPrecision int) string {
+	if name == NormalizerRegex {
+		return NormalizeLineRegex
+	}
+	return NormalizeLine
+}
+
+// normalizeFloats rewrites the decimal floats in s with floatPrecision digits
+// after the decimal point. A float is what floatRe matches, found the same
+// way: leftmost first, so "1.2.3" holds the float "1.2" and "a-1.5" holds
+// "-1.5".
+func normalizeFloats(s string, floatPrecision int) string {
+	if strings.IndexByte(s, '.') < 0 {
+		return s
+	}
+	var b strings.Builder
+	last := 0
+	for i := 0; i < len(s); {
+		// Candidate: optional minus, digits, point, digits
+		j := i
+		if s[j] == '-' {
+			j++
+		}
+		k := j
+		for k < len(s) && isDigit(s[k]) {
+			k++
+		}
+		if k == j {
+			i++
+			continue
+		}
+		if k+1 >= len(s) || s[k] != '.' || !isDigit(s[k+1]) {
+			// No match can start anywhere within these digits either
+			i = k
+			continue
+		}
+		end := k + 1
+		for end < len(s) && isDigit(s[end]) {
+			end++
+		}
+		if b.Len() == 0 {
+			b.Grow(len(s) + 16)
+		}
+		b.WriteString(s[last:i])
+		b.WriteString(formatFloat(s[i:end], floatPrecision))
+		last, i = end, end
+	}
+	if last == 0 {
+		return s
+	}
+	b.WriteString(s[last:])
+	return b.String()
+}
+
+// formatFloat rewrites the float literal m with floatPrecision digits after
+// the decimal point.
+func formatFloat(m string, floatPrecision int) string {
 	// Normalize floats to fixed precision using Go's consistent formatter.
-	line = floatRe.ReplaceAllStringFunc(line, func(m string) string {
-		f, err := strconv.ParseFloat(m, 64)
-		if err != nil {
-			return m // leave as-is if somehow unparsable
+	f, err := strconv.ParseFloat(m, 64)
+	if err != nil {
+		return m // leave as-is if somehow unparsable
+	}
+	// 'f' => decimal, fixed number of digits after the decimal point.
+	return strconv.FormatFloat(f, 'f', floatPrecision, 64)
+}
+
+// NormalizeRealColumns applies the canonical emission rule for REAL-affinity
+// columns: SQLite may store integral REAL values as integers and, depending on
+// the code path, dump them as "2" or "2.0". Integer literals in REAL columns
+// are therefore always emitted in float form, so round trips never flip
+// between the two representations. Columns with other affinities are left
+// untouched because there 2 and 2.0 are distinct values.
+func NormalizeRealColumns(stmt string, tables TableMap, floatPrecision int) string {
+	if !strings.HasPrefix(strings.TrimSpace(stmt), "INSERT INTO") {
+		return stmt
+	}
+	ins, err := ParseInsert(stmt)
+	if err != nil {
+		return stmt
+	}
+	table := tables.Lookup(ins.Table)
+	if table == nil || !table.HasAffinity(AffinityReal) {
+		return stmt
+	}
+	changed := false
+	for _, row := range ins.Rows {
+		for pos, span := range row {
+			col := ins.ColumnIndex(table, pos)
+			if col < 0 || col >= len(table.Affinities) || table.Affinities[col] != AffinityReal {
+				continue
+			}
+			value := ins.Value(span)
+			if !isIntegerLiteral(value) {
+				continue
+			}
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			ins.SetValue(span, strconv.FormatFloat(f, 'f', floatPrecision, 64))
+			changed = true
 		}
-		// 'f' => decimal, fixed number of digits after the decimal point.
-		return strconv.FormatFloat(f, 'f', floatPrecision, 64)
-	})
+	}
+	if !changed {
+		return stmt
+	}
+	return ins.String()
+}
 
-	return line
+// isIntegerLiteral reports whether s is an optionally signed decimal integer.
+func isIntegerLiteral(s string) bool {
+	if s != "" && (s[0] == '-' || s[0] == '+') {
+		s = s[1:]
+	}
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !isDigit(s[i]) {
+			return false
+		}
+	}
+	return true
 }
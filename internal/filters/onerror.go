@@ -0,0 +1,82 @@
+package filters
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+
+	"github.com/danielsiegl/gitsqlite/internal/errs"
+	"github.com/danielsiegl/gitsqlite/internal/shutdown"
+	"github.com/danielsiegl/gitsqlite/internal/sqlite"
+	"github.com/danielsiegl/gitsqlite/internal/warnings"
+)
+
+// Failure policies of clean and smudge (-on-error).
+const (
+	// OnErrorFail exits with an error: git aborts if the filter is
+	// required, otherwise it uses the unconverted content.
+	OnErrorFail = "fail"
+	// OnErrorPassthrough writes the input unchanged and succeeds.
+	OnErrorPassthrough = "passthrough"
+	// OnErrorEmpty writes nothing and succeeds.
+	OnErrorEmpty = "empty"
+)
+
+// IsOnErrorPolicy reports whether policy is a known failure policy.
+func IsOnErrorPolicy(policy string) bool {
+	return policy == OnErrorFail || policy == OnErrorPassthrough || policy == OnErrorEmpty
+}
+
+// WithFallback runs convert, the clean or smudge operation op, from in to
+// out under the failure policy. With OnErrorFail it just runs convert.
+// Otherwise the input is kept and the output buffered in temporary files, so
+// that out never receives partial output: if convert fails, out receives the
+// input unchanged (OnErrorPassthrough) or nothing (OnErrorEmpty), the decision
+// is logged and reported as a warning, and nil is returned. Interrupts are
+// never covered up.
+func WithFallback(eng *sqlite.Engine, policy, op string, in io.Reader, out io.Writer, convert func(in io.Reader, out io.Writer) error) error {
+	if policy == OnErrorFail || policy == "" {
+		return convert(in, out)
+	}
+
+	input, err := os.CreateTemp("", "gitsqlite-input-*")
+	if err != nil {
+		return err
+	}
+	defer shutdown.Remove(input.Name())()
+	defer input.Close()
+	output, err := os.CreateTemp("", "gitsqlite-output-*")
+	if err != nil {
+		return err
+	}
+	defer shutdown.Remove(output.Name())()
+	defer output.Close()
+
+	convertErr := convert(io.TeeReader(in, input), output)
+	if errs.Kind(convertErr) == errs.ErrInterrupted {
+		return convertErr
+	}
+	result := output
+	if convertErr != nil {
+		slog.Error(op+" failed, applying failure policy", "on_error", policy, "error", convertErr, "exit_code", errs.Code(convertErr))
+		switch policy {
+		case OnErrorPassthrough:
+			// convert may have stopped reading early
+			if _, err := io.Copy(input, in); err != nil {
+				return fmt.Errorf("%w (and reading the rest of the input failed: %v)", convertErr, err)
+			}
+			warnings.Emit(warnings.PassthroughUsed, "%s failed, passing the input through unconverted (-on-error passthrough): %v", op, convertErr)
+			result = input
+		case OnErrorEmpty:
+			warnings.Emit(warnings.EmptyOutputUsed, "%s failed, writing empty output (-on-error empty): %v", op, convertErr)
+			return nil
+		}
+	}
+
+	if _, err := result.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = eng.CopyWithTimeout(out, result, op)
+	return err
+}
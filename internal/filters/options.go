@@ -0,0 +1,165 @@
+package filters
+
+import (
+	"github.com/danielsiegl/gitsqlite/internal/backup"
+	"github.com/danielsiegl/gitsqlite/internal/hash"
+	"github.com/danielsiegl/gitsqlite/internal/progress"
+	"github.com/danielsiegl/gitsqlite/internal/summary"
+)
+
+// Options controls how clean and diff filter and normalize the SQL dump.
+type Options struct {
+	// FloatPrecision is the number of digits after the decimal point used
+	// when normalizing floats in INSERT statements.
+	FloatPrecision int
+	// Normalizer selects how floats are found: NormalizerFast or
+	// NormalizerRegex.
+	Normalizer string
+	// DataOnly restricts the output to data (INSERT statements), no schema.
+	DataOnly bool
+	// SchemaOutput, if not empty, is the file the schema is written to.
+	SchemaOutput string
+	// Compress, if not empty, is the format clean compresses its output
+	// with (see compression.NewWriter); smudge detects it by itself.
+	Compress string
+	// DictDir is the directory of the zstd dictionaries trained by
+	// train-dict, used with Compress zstd. If empty, none are used.
+	DictDir string
+	// CanonicalSchema rewrites CREATE TABLE statements into a canonical form
+	// (constraint order, keyword case, layout).
+	CanonicalSchema bool
+	// AnnotateCounts emits a "-- rows: N" comment after each table's data.
+	AnnotateCounts bool
+	// Vacuum makes clean dump a copy of the database written with VACUUM
+	// INTO.
+	Vacuum bool
+	// SourcePath is the worktree path of the database being cleaned (git %f),
+	// used to find journal sidecar files. Empty when unknown.
+	SourcePath string
+	// Sidecars is the policy for -wal/-journal files next to SourcePath:
+	// SidecarFold, SidecarWarn or SidecarIgnore.
+	Sidecars string
+	// InputSize is the size of the database read by clean if known (see
+	// InputSize), or <= 0. It is checked against the free temporary space.
+	InputSize int64
+	// Subset restricts the versioned rows of individual tables.
+	Subset []SubsetRule
+	// LocalTables lists tables that are never versioned (schema and rows).
+	LocalTables []string
+	// InternalTables lists the internal tables, such as sqlite_stat1, whose
+	// content is kept (see ParseInternalTables).
+	InternalTables []string
+	// Redact lists columns whose values are replaced before they are
+	// written.
+	Redact []RedactRule
+	// InvalidUTF8 is the policy for text that is not valid UTF-8:
+	// UTF8Escape or UTF8Replace.
+	InvalidUTF8 string
+	// ControlChars is the policy for text values holding control
+	// characters: ControlCharsKeep or ControlCharsChar.
+	ControlChars string
+	// RowOrder is RowOrderKey to sort the rows of tables by primary key, or
+	// RowOrderDump to keep the order of sqlite3 .dump.
+	RowOrder string
+	// SchemaOrder is SchemaOrderSorted to sort tables, indexes, views and
+	// triggers by dependencies and name, or SchemaOrderDump to keep the
+	// order of sqlite3 .dump.
+	SchemaOrder string
+	// DataFormat is DataFormatSQL to write rows as INSERT statements, or
+	// DataFormatJSONL to write them as JSON lines.
+	DataFormat string
+	// FormatVersion pins the dump format version (see CurrentFormat). If 0,
+	// clean keeps the version of the dump of SourcePath in the git index,
+	// and writes CurrentFormat without one.
+	FormatVersion int
+	// UpgradeFormat makes clean ignore the dump of SourcePath in the git
+	// index: it writes CurrentFormat, or the pinned FormatVersion, without
+	// the quirks of an older release (see Quirks).
+	UpgradeFormat bool
+	// AssertIdempotent makes clean normalize every statement it writes a
+	// second time and fail if that changes it.
+	AssertIdempotent bool
+	// TableHashes makes clean write the hash of every table before the hash
+	// of the whole file, so VerifyDumpHashes can tell which tables changed.
+	TableHashes bool
+	// tableHashes collects the table hashes while dumping.
+	tableHashes *hash.TableHasher
+	// Progress, if not nil, reports the progress of the dump.
+	Progress *progress.Reporter
+	// Summary, if not nil, records the rows written and the duration of
+	// each stage.
+	Summary *summary.Summary
+	// Sinks lists files clean writes besides its output in the same pass,
+	// in their own formats (see Sink).
+	Sinks []Sink
+	// sinks writes the dump to Sinks.
+	sinks *sinkSet
+	// replay, if not nil, records what the run reports for the clean cache.
+	replay *cleanReplay
+	// Cache, if not nil, keeps the output of clean and serves it again for
+	// the same database and settings (see CleanCache).
+	Cache *CleanCache
+	// legacy are the quirks clean keeps writing.
+	legacy Quirks
+	// budget, if not nil, grants the dump more time for every table.
+	budget *dumpBudget
+	// BlobThreshold, if > 0, is the size in bytes above which BLOB values
+	// are replaced by pointers and stored in BlobDir.
+	BlobThreshold int64
+	// BlobDir is the content-addressed directory externalized BLOBs are
+	// stored in. If empty, pointers are written without storing the BLOBs.
+	BlobDir string
+}
+
+// DefaultOptions returns the options used when no flags are given.
+func DefaultOptions() Options {
+	return Options{FloatPrecision: 9, Normalizer: NormalizerFast, Sidecars: SidecarFold, InvalidUTF8: UTF8Escape, ControlChars: ControlCharsKeep, RowOrder: RowOrderKey, SchemaOrder: SchemaOrderSorted, DataFormat: DataFormatSQL, InternalTables: internalTables[1:]}
+}
+
+// SmudgeOptions controls how smudge restores a database.
+type SmudgeOptions struct {
+	// SchemaFile, if not empty, is the file the schema is read from; the
+	// input then contains data only.
+	SchemaFile string
+	// EnforceHash fails the restore if the hash trailer is invalid or missing.
+	EnforceHash bool
+	// TargetPath is the worktree path of the database being restored (git %f),
+	// whose current contents may be merged into the result. Empty when unknown.
+	TargetPath string
+	// Subset lists the tables whose unversioned local rows are kept.
+	Subset []SubsetRule
+	// LocalTables lists tables copied from the existing database at TargetPath.
+	LocalTables []string
+	// Backups, if not nil, receives a snapshot of the existing database at
+	// TargetPath before it is replaced.
+	Backups *backup.Store
+	// BackupKeep is the number of snapshots kept per database.
+	BackupKeep int
+	// BlobDir is the directory BLOB pointers in the dump are resolved from.
+	BlobDir string
+	// DictDir is the directory of the zstd dictionaries a compressed dump
+	// is read with.
+	DictDir string
+	// Output, if not empty, is the file the restored database replaces
+	// instead of being written to the output stream.
+	Output string
+	// Jobs is the number of sqlite3 processes restoring large dumps in
+	// parallel; 1 restores serially.
+	Jobs int
+	// InputSize is the size of the dump read if known (see InputSize), or
+	// <= 0. The restored database is expected to be about as large.
+	InputSize int64
+	// JournalMode is the journal mode the database is written in:
+	// sqlite.JournalDelete (or "") or sqlite.JournalWAL.
+	JournalMode string
+	// TableCache, if not nil, stores the table hashes of the database
+	// written to Output, and lets the next smudge restore only the tables
+	// that changed (see restoreIncremental).
+	TableCache *TableCache
+	// Collations maps lower-case collation names used in the schema to the
+	// collations they are restored with (see ParseCollationMap).
+	Collations map[string]string
+	// Summary, if not nil, records the rows restored, the size of Output
+	// and the duration of each stage.
+	Summary *summary.Summary
+}
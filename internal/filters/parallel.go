@@ -0,0 +1,365 @@
+package filters
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/danielsiegl/gitsqlite/internal/logging"
+	"github.com/danielsiegl/gitsqlite/internal/shutdown"
+	"github.com/danielsiegl/gitsqlite/internal/sqlite"
+)
+
+// ParallelThreshold is the minimum dump size for a parallel restore; smaller
+// dumps restore faster in a single sqlite3 process.
+const ParallelThreshold = 16 << 20
+
+// MaxRestoreJobs bounds parallel restores by the number of databases the
+// sqlite3 CLI can attach at once.
+const MaxRestoreJobs = 8
+
+// plannedTable is a table of a dump split for parallel restore.
+type plannedTable struct {
+	name     string
+	create   string // raw CREATE TABLE statement
+	refs     []string
+	dataFile string // INSERT statements of the table
+	size     int64
+}
+
+// restorePlan is a dump split into tables that can be restored
+// independently and the statements that must run afterwards.
+type restorePlan struct {
+	tables []*plannedTable // in dump order
+	tail   []string        // raw statements run after all data, in dump order
+}
+
+// restoreParallel restores a dump into dbPath. Large dumps are split by table;
+// groups of tables connected by foreign keys are restored into separate
+// databases by up to jobs concurrent sqlite3 processes and then merged into
+// dbPath with INSERT ... SELECT, which is much cheaper than parsing SQL text.
+// Dumps that cannot be split safely are restored serially.
+func restoreParallel(ctx context.Context, eng *sqlite.Engine, dbPath string, sql io.Reader, jobs int) error {
+	if jobs > MaxRestoreJobs {
+		jobs = MaxRestoreJobs
+	}
+	workDir, err := os.MkdirTemp("", "gitsqlite-restore-*")
+	if err != nil {
+		return err
+	}
+	defer shutdown.Remove(workDir)()
+
+	// Spool the input so the serial restore remains possible
+	spoolPath := filepath.Join(workDir, "dump.sql")
+	size, err := spoolToFile(sql, spoolPath)
+	if err != nil {
+		return err
+	}
+	serial := func(reason string) error {
+		slog.Info("Restoring serially", "reason", reason, "size", size)
+		f, err := os.Open(spoolPath)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return eng.Restore(ctx, dbPath, f)
+	}
+	if size < ParallelThreshold {
+		return serial("dump below parallel threshold")
+	}
+
+	plan, reason, err := planRestore(spoolPath, workDir)
+	if err != nil {
+		return err
+	}
+	if plan == nil {
+		return serial(reason)
+	}
+	groups := plan.groups(jobs)
+	if len(groups) < 2 {
+		return serial("no independent table groups")
+	}
+
+	start := time.Now()
+	partPaths := make([]string, len(groups))
+	errs := make([]error, len(groups))
+	var wg sync.WaitGroup
+	for i, group := range groups {
+		partPaths[i] = filepath.Join(workDir, fmt.Sprintf("part%d.db", i))
+		wg.Add(1)
+		go func(i int, group []*plannedTable) {
+			defer wg.Done()
+			errs[i] = restorePart(ctx, eng, partPaths[i], group)
+		}(i, group)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return fmt.Errorf("parallel restore of group %d failed: %w", i, err)
+		}
+	}
+	slog.Info("Restored table groups in parallel", "groups", len(groups), "duration", logging.FormatDuration(time.Since(start)))
+
+	return mergeParts(ctx, eng, dbPath, plan, groups, partPaths)
+}
+
+// spoolToFile copies r into a new file at path and returns its size.
+func spoolToFile(r io.Reader, path string) (int64, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return n, err
+}
+
+// planRestore splits the dump at dumpPath into per-table data files in
+// workDir. It returns a nil plan and the reason if the dump contains
+// statements whose effect depends on restore order, such as triggers created
+// before data or UPDATE statements.
+func planRestore(dumpPath, workDir string) (*restorePlan, string, error) {
+	in, err := os.Open(dumpPath)
+	if err != nil {
+		return nil, "", err
+	}
+	defer in.Close()
+
+	plan := &restorePlan{}
+	byName := map[string]*plannedTable{}
+	var current *plannedTable
+	var data *os.File
+	var w *bufio.Writer
+	closeData := func() error {
+		if data == nil {
+			return nil
+		}
+		err := w.Flush()
+		if cerr := data.Close(); err == nil {
+			err = cerr
+		}
+		data, w, current = nil, nil, nil
+		return err
+	}
+	defer closeData()
+
+	// tailStarted is set once a statement that changes how later INSERTs
+	// behave (e.g. a trigger) has been seen; no more data may follow it.
+	tailStarted := false
+	scanner := NewStatementScanner(in)
+	for scanner.Scan() {
+		stmt, raw := scanner.Text(), scanner.Raw()
+		if !strings.HasSuffix(raw, "\n") {
+			raw += "\n"
+		}
+		switch ClassifyStatement(stmt) {
+		case StatementEmpty:
+			continue
+		case StatementStructural:
+			if _, kind := canonicalControlStatement(stmt); kind == controlNone {
+				return nil, "session statement " + firstLine(stmt), nil
+			}
+		case StatementSchema:
+			next := leadingTokens(stmt)
+			next() // CREATE
+			if word := next(); !word.Is("TABLE") {
+				// Indexes and views do not change how rows are inserted
+				if !word.Is("INDEX") && !word.Is("UNIQUE") && !word.Is("VIEW") {
+					tailStarted = true
+				}
+				plan.tail = append(plan.tail, raw)
+				continue
+			}
+			if tailStarted {
+				return nil, "table created after a trigger", nil
+			}
+			ct, err := ParseCreateTable(stmt)
+			if err != nil || ct.HasGeneratedColumns() {
+				return nil, "table definition not supported: " + firstLine(stmt), nil
+			}
+			name := strings.ToLower(ct.TableName())
+			if byName[name] != nil {
+				return nil, "table created twice: " + name, nil
+			}
+			t := &plannedTable{name: ct.TableName(), create: raw,
+				dataFile: filepath.Join(workDir, fmt.Sprintf("table%d.sql", len(plan.tables)))}
+			for _, ref := range ct.ReferencedTables() {
+				t.refs = append(t.refs, strings.ToLower(ref))
+			}
+			byName[name] = t
+			plan.tables = append(plan.tables, t)
+		case StatementData:
+			t := byName[strings.ToLower(InsertTableName(stmt))]
+			if t == nil || tailStarted {
+				return nil, "data statement not bound to a table: " + firstLine(stmt), nil
+			}
+			if t != current {
+				if err := closeData(); err != nil {
+					return nil, "", err
+				}
+				f, err := os.OpenFile(t.dataFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+				if err != nil {
+					return nil, "", err
+				}
+				data, w, current = f, bufio.NewWriterSize(f, 256*1024), t
+			}
+			if _, err := w.WriteString(raw); err != nil {
+				return nil, "", err
+			}
+			t.size += int64(len(raw))
+		default:
+			return nil, "unsupported statement " + firstLine(stmt), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, "", err
+	}
+	return plan, "", closeData()
+}
+
+// groups partitions the tables with data into at most jobs groups of similar
+// size. Tables connected by foreign keys always share a group.
+func (p *restorePlan) groups(jobs int) [][]*plannedTable {
+	parent := map[string]string{}
+	var find func(string) string
+	find = func(n string) string {
+		if parent[n] == "" || parent[n] == n {
+			return n
+		}
+		parent[n] = find(parent[n])
+		return parent[n]
+	}
+	known := map[string]bool{}
+	for _, t := range p.tables {
+		known[strings.ToLower(t.name)] = true
+	}
+	for _, t := range p.tables {
+		for _, ref := range t.refs {
+			if known[ref] {
+				parent[find(strings.ToLower(t.name))] = find(ref)
+			}
+		}
+	}
+
+	// Collect components of tables with data, keeping dump order within each
+	type component struct {
+		tables []*plannedTable
+		size   int64
+	}
+	var comps []*component
+	byRoot := map[string]*component{}
+	for _, t := range p.tables {
+		if t.size == 0 {
+			continue
+		}
+		root := find(strings.ToLower(t.name))
+		c := byRoot[root]
+		if c == nil {
+			c = &component{}
+			byRoot[root] = c
+			comps = append(comps, c)
+		}
+		c.tables = append(c.tables, t)
+		c.size += t.size
+	}
+
+	// Largest component first into the currently smallest group
+	sort.SliceStable(comps, func(i, j int) bool { return comps[i].size > comps[j].size })
+	if jobs > len(comps) {
+		jobs = len(comps)
+	}
+	groups := make([][]*plannedTable, jobs)
+	sizes := make([]int64, jobs)
+	for _, c := range comps {
+		smallest := 0
+		for i := range sizes {
+			if sizes[i] < sizes[smallest] {
+				smallest = i
+			}
+		}
+		groups[smallest] = append(groups[smallest], c.tables...)
+		sizes[smallest] += c.size
+	}
+	return groups
+}
+
+// restorePart restores the tables of one group into a separate database.
+func restorePart(ctx context.Context, eng *sqlite.Engine, partPath string, group []*plannedTable) error {
+	readers := []io.Reader{strings.NewReader("PRAGMA foreign_keys=OFF;\nBEGIN TRANSACTION;\n")}
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for _, t := range group {
+		readers = append(readers, strings.NewReader(t.create))
+	}
+	for _, t := range group {
+		f, err := os.Open(t.dataFile)
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+		readers = append(readers, f)
+	}
+	readers = append(readers, strings.NewReader("COMMIT;\n"))
+	return eng.Restore(ctx, partPath, io.MultiReader(readers...))
+}
+
+// mergeParts creates all tables in dbPath in dump order, copies their rows
+// from the part databases and runs the remaining statements.
+func mergeParts(ctx context.Context, eng *sqlite.Engine, dbPath string, plan *restorePlan, groups [][]*plannedTable, partPaths []string) error {
+	start := time.Now()
+	partOf := map[*plannedTable]int{}
+	for i, group := range groups {
+		for _, t := range group {
+			partOf[t] = i
+		}
+	}
+
+	var script strings.Builder
+	script.WriteString("PRAGMA foreign_keys=OFF;\n")
+	for i, path := range partPaths {
+		fmt.Fprintf(&script, "ATTACH DATABASE %s AS part%d;\n", sqlite.QuoteLiteral(path), i)
+	}
+	script.WriteString("BEGIN TRANSACTION;\n")
+	for _, t := range plan.tables {
+		script.WriteString(t.create)
+	}
+	for _, t := range plan.tables {
+		if i, ok := partOf[t]; ok {
+			fmt.Fprintf(&script, "INSERT INTO main.%s SELECT * FROM part%d.%s;\n",
+				sqlite.QuoteIdent(t.name), i, sqlite.QuoteIdent(t.name))
+		}
+	}
+	for _, stmt := range plan.tail {
+		script.WriteString(stmt)
+	}
+	script.WriteString("COMMIT;\n")
+
+	if err := eng.Restore(ctx, dbPath, strings.NewReader(script.String())); err != nil {
+		return fmt.Errorf("merging restored table groups failed: %w", err)
+	}
+	slog.Info("Merged table groups", "duration", logging.FormatDuration(time.Since(start)))
+	return nil
+}
+
+// firstLine returns the first line of a statement for log messages.
+func firstLine(stmt string) string {
+	line, _, _ := strings.Cut(strings.TrimSpace(stmt), "\n")
+	if len(line) > 80 {
+		line = line[:80] + "..."
+	}
+	return line
+}
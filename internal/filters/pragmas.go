@@ -0,0 +1,170 @@
+package filters
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+
+	"github.com/danielsiegl/gitsqlite/internal/sqlite"
+)
+
+// PragmaPrefix starts the comments clean writes after the dump header for
+// database settings that .dump does not contain, such as
+// "-- gitsqlite-pragma: user_version=7". Smudge applies them to the restored
+// database before the dump runs.
+const PragmaPrefix = "-- gitsqlite-pragma: "
+
+// Pragma is a database setting preserved in the dump.
+type Pragma struct {
+	Name  string
+	Value string
+}
+
+// filePragmas are the preserved settings in the order they must be applied
+// (encoding, page size and auto-vacuum only work on a new database) with the
+// value of a database created by sqlite3. Only other values are written, so
+// dumps of databases that never set them are unchanged.
+var filePragmas = []Pragma{
+	{"encoding", "UTF-8"},
+	{"page_size", "4096"},
+	{"auto_vacuum", "0"},
+	{"application_id", "0"},
+	{"user_version", "0"},
+}
+
+// encodings are the values PRAGMA encoding reports.
+var encodings = []string{"UTF-8", "UTF-16le", "UTF-16be"}
+
+// ReadPragmas returns the preserved settings of the database at dbPath that
+// differ from their defaults.
+func ReadPragmas(ctx context.Context, eng *sqlite.Engine, dbPath string) ([]Pragma, error) {
+	var columns []string
+	for _, p := range filePragmas {
+		columns = append(columns, "(SELECT * FROM pragma_"+p.Name+")")
+	}
+	rows, err := eng.Query(ctx, dbPath, "SELECT "+strings.Join(columns, ", ")+";")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read database settings: %w", err)
+	}
+	if len(rows) != 1 || len(rows[0]) != len(filePragmas) {
+		return nil, fmt.Errorf("failed to read database settings: unexpected result %v", rows)
+	}
+	var pragmas []Pragma
+	for i, p := range filePragmas {
+		if value := rows[0][i]; value != p.Value {
+			pragmas = append(pragmas, Pragma{p.Name, value})
+		}
+	}
+	return pragmas, nil
+}
+
+// PragmaComments returns the comment lines for pragmas.
+func PragmaComments(pragmas []Pragma) string {
+	var b strings.Builder
+	for _, p := range pragmas {
+		fmt.Fprintf(&b, "%s%s=%s\n", PragmaPrefix, p.Name, p.Value)
+	}
+	return b.String()
+}
+
+// pragmaPeekSize bounds how far into a dump its pragma comments are looked for.
+const pragmaPeekSize = 4096
+
+// peekPragmas returns the pragma comments following the header and format
+// version of the dump read from r, and a reader yielding the whole dump
+// including them. Comments of settings this version does not know are
+// ignored, and a format version newer than CurrentFormat only logs a warning;
+// a known setting with an invalid value is an error, as the value ends up in
+// a PRAGMA statement.
+func peekPragmas(r io.Reader) ([]Pragma, io.Reader, error) {
+	br := bufio.NewReaderSize(r, pragmaPeekSize)
+	head, _ := br.Peek(pragmaPeekSize)
+	var pragmas []Pragma
+	for _, line := range strings.Split(string(head), "\n") {
+		line = strings.TrimRight(line, "\r")
+		if version := parseFormatComment(line); version > 0 {
+			if version > CurrentFormat {
+				slog.Warn("The dump has a newer format than this gitsqlite writes; restoring it anyway",
+					"format", version, "supported", CurrentFormat)
+			}
+			continue
+		}
+		rest, ok := strings.CutPrefix(line, PragmaPrefix)
+		if !ok {
+			if _, kind := canonicalControlStatement(line); kind == controlBegin || kind == controlPragma {
+				continue
+			}
+			break
+		}
+		name, value, _ := strings.Cut(rest, "=")
+		p := Pragma{strings.TrimSpace(name), strings.TrimSpace(value)}
+		if !knownPragma(p.Name) {
+			slog.Debug("Ignoring unknown pragma comment", "line", line)
+			continue
+		}
+		if err := validatePragma(p); err != nil {
+			return nil, br, err
+		}
+		pragmas = append(pragmas, p)
+	}
+	// Hiding WriterTo keeps the reader like the one passed in
+	return pragmas, struct{ io.Reader }{br}, nil
+}
+
+func knownPragma(name string) bool {
+	for _, p := range filePragmas {
+		if p.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func validatePragma(p Pragma) error {
+	if p.Name == "encoding" {
+		for _, e := range encodings {
+			if strings.EqualFold(p.Value, e) {
+				return nil
+			}
+		}
+	} else if _, err := strconv.ParseInt(p.Value, 10, 32); err == nil {
+		return nil
+	}
+	return fmt.Errorf("invalid pragma comment %s%s=%s", PragmaPrefix, p.Name, p.Value)
+}
+
+// applyPragmas sets pragmas on the empty database at dbPath before the dump
+// is restored into it. The settings are written in the order of filePragmas.
+// sqlite3 stores the encoding only with the first table, so a table is
+// created and dropped after the settings of a new database, and VACUUM frees
+// its page again.
+func applyPragmas(ctx context.Context, eng *sqlite.Engine, dbPath string, pragmas []Pragma) error {
+	if len(pragmas) == 0 {
+		return nil
+	}
+	var script strings.Builder
+	for _, def := range filePragmas {
+		value := def.Value
+		for _, p := range pragmas {
+			if p.Name == def.Name {
+				value = p.Value
+			}
+		}
+		if def.Name == "encoding" {
+			value = sqlite.QuoteLiteral(value)
+		}
+		fmt.Fprintf(&script, "PRAGMA %s=%s;\n", def.Name, value)
+		if def.Name == "auto_vacuum" {
+			script.WriteString("CREATE TABLE gitsqlite_init(x);\nDROP TABLE gitsqlite_init;\nVACUUM;\n")
+		}
+	}
+	if err := eng.Restore(ctx, dbPath, strings.NewReader(script.String())); err != nil {
+		return fmt.Errorf("failed to apply database settings: %w", err)
+	}
+	slog.Info("Applied database settings from dump", "pragmas", pragmas)
+	return nil
+}
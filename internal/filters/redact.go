@@ -0,0 +1,162 @@
+package filters
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/danielsiegl/gitsqlite/internal/warnings"
+)
+
+// Redaction actions (-redact).
+const (
+	// RedactHash replaces a value with the first 16 hex digits of the
+	// SHA-256 of its SQL literal, so equal values stay equal (also across
+	// columns) without being readable.
+	RedactHash = "hash"
+	// RedactDrop replaces a value with NULL.
+	RedactDrop = "drop"
+	// RedactEmpty replaces a value with the empty string, for NOT NULL
+	// columns.
+	RedactEmpty = "empty"
+)
+
+// RedactRule replaces the values of one column in the versioned rows.
+type RedactRule struct {
+	Table  string
+	Column string
+	Action string
+}
+
+// ParseRedactRules parses a comma-separated list of rules in the form
+//
+//	table.column=action
+//
+// where action is hash, drop or empty. Names may be quoted as in SQL, e.g.
+// "my.table".email=hash.
+func ParseRedactRules(list string) ([]RedactRule, error) {
+	var rules []RedactRule
+	seen := map[string]bool{}
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		target, action, ok := strings.Cut(item, "=")
+		action = strings.ToLower(strings.TrimSpace(action))
+		var names []string
+		for _, tok := range Tokenize(strings.TrimSpace(target)) {
+			if tok.Text != "." {
+				names = append(names, UnquoteIdent(tok.Text))
+			}
+		}
+		if !ok || len(names) != 2 || names[0] == "" || names[1] == "" {
+			return nil, fmt.Errorf("redaction rule %q: expected table.column=action", item)
+		}
+		if action != RedactHash && action != RedactDrop && action != RedactEmpty {
+			return nil, fmt.Errorf("redaction rule %q: unknown action %q (expected hash, drop or empty)", item, action)
+		}
+		key := strings.ToLower(names[0] + "." + names[1])
+		if seen[key] {
+			return nil, fmt.Errorf("redaction rule %q: duplicate rule for %s.%s", item, names[0], names[1])
+		}
+		seen[key] = true
+		rules = append(rules, RedactRule{Table: names[0], Column: names[1], Action: action})
+	}
+	return rules, nil
+}
+
+// redactor applies redaction rules to the INSERT statements of a dump. Values
+// are mapped to columns through the table definitions seen earlier in the
+// dump. NULL stays NULL with every action.
+type redactor struct {
+	rules          []RedactRule
+	actions        map[string]map[string]string // lower-case table -> column -> action
+	floatPrecision int
+	redacted       int
+}
+
+func newRedactor(rules []RedactRule, floatPrecision int) *redactor {
+	r := &redactor{rules: rules, actions: map[string]map[string]string{}, floatPrecision: floatPrecision}
+	for _, rule := range rules {
+		table := strings.ToLower(rule.Table)
+		if r.actions[table] == nil {
+			r.actions[table] = map[string]string{}
+		}
+		r.actions[table][strings.ToLower(rule.Column)] = rule.Action
+	}
+	return r
+}
+
+// apply returns stmt with the values of redacted columns replaced.
+func (r *redactor) apply(stmt string, tables TableMap) string {
+	if len(r.actions) == 0 {
+		return stmt
+	}
+	name := InsertTableName(stmt)
+	columns := r.actions[strings.ToLower(name)]
+	table := tables.Lookup(name)
+	if columns == nil || table == nil {
+		return stmt
+	}
+	ins, err := ParseInsert(stmt)
+	if err != nil {
+		return stmt
+	}
+	changed := false
+	for _, row := range ins.Rows {
+		for pos, span := range row {
+			col := ins.ColumnIndex(table, pos)
+			if col < 0 || col >= len(table.Columns) {
+				continue
+			}
+			action, ok := columns[strings.ToLower(table.Columns[col])]
+			value := ins.Value(span)
+			if !ok || strings.EqualFold(value, "NULL") {
+				continue
+			}
+			ins.SetValue(span, r.replacement(value, action))
+			changed = true
+		}
+	}
+	if !changed {
+		return stmt
+	}
+	r.redacted++
+	return ins.String()
+}
+
+// replacement returns the literal that replaces value.
+func (r *redactor) replacement(value, action string) string {
+	switch action {
+	case RedactDrop:
+		return "NULL"
+	case RedactEmpty:
+		return "''"
+	}
+	// Hash the value as written in the output, so the hash does not depend
+	// on how the platform formats floats
+	if number := strings.TrimPrefix(value, "-"); number != "" {
+		if tok, end := nextToken(number, 0); tok.Kind == TokenNumber && end == len(number) {
+			value = normalizeFloats(value, r.floatPrecision)
+		}
+	}
+	sum := sha256.Sum256([]byte(value))
+	return "'" + hex.EncodeToString(sum[:8]) + "'"
+}
+
+// report logs how many statements were redacted and warns about rules that
+// match no column of the dumped tables, which usually means a misspelt name
+// and sensitive values being versioned.
+func (r *redactor) report(tables TableMap) {
+	for _, rule := range r.rules {
+		if table := tables.Lookup(rule.Table); table == nil || table.Index(rule.Column) < 0 {
+			warnings.Emit(warnings.RedactUnmatched, "redaction rule %s.%s=%s matches no column", rule.Table, rule.Column, rule.Action)
+		}
+	}
+	if r.redacted > 0 {
+		slog.Info("Redacted column values", "statements", r.redacted)
+	}
+}
@@ -0,0 +1,173 @@
+package filters
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"github.com/danielsiegl/gitsqlite/internal/sqlite"
+)
+
+// Row order policies (-row-order).
+const (
+	// RowOrderKey writes the rows of every table with a primary key in key
+	// order.
+	RowOrderKey = "pk"
+	// RowOrderDump keeps the order sqlite3 .dump emits.
+	RowOrderDump = "dump"
+)
+
+// orderedDump yields the statements of a dump, with the rows of tables whose
+// storage order is not their primary key order replaced by the same rows
+// sorted by key, and the rows of tables with a subset rule replaced by those
+// the rule keeps.
+//
+// .dump emits rows in storage order: rowid order for ordinary tables and key
+// order for WITHOUT ROWID tables. For a table whose INTEGER PRIMARY KEY is the
+// rowid both are the same, but a table keyed by other columns is stored by a
+// hidden rowid that reflects insertion order and may be renumbered by VACUUM,
+// so semantically identical databases dump differently. Tables without a
+// primary key keep the dump order; there is no key to sort by.
+type orderedDump struct {
+	ctx    context.Context
+	eng    *sqlite.Engine
+	dbPath string
+	dump   *StatementScanner
+	// sort is false with RowOrderDump.
+	sort bool
+	// subset maps lower-case table names to the condition of their subset
+	// rule.
+	subset map[string]string
+
+	// reordered holds the lower-case names of the tables whose dump rows
+	// are replaced.
+	reordered map[string]bool
+	// pending is the table whose rows follow the current statement, nil if
+	// there is none.
+	pending *rowQuery
+	// current is the query whose rows are read.
+	current *rowQuery
+	rows    *StatementScanner
+	stream  io.ReadCloser
+
+	text string
+	err  error
+}
+
+// rowQuery selects the rows of a table that replace those of the dump.
+type rowQuery struct {
+	table   string
+	where   string
+	orderBy []string
+}
+
+// newOrderedDump returns the statements of the dump of dbPath, with rows
+// ordered according to policy and restricted by the subset rules. Rules
+// naming tables that do not exist in the database are ignored.
+func newOrderedDump(ctx context.Context, eng *sqlite.Engine, dbPath string, dump io.Reader, policy string, rules []SubsetRule) *orderedDump {
+	subset := map[string]string{}
+	for _, rule := range rules {
+		subset[strings.ToLower(rule.Table)] = rule.condition()
+	}
+	return &orderedDump{
+		ctx:       ctx,
+		eng:       eng,
+		dbPath:    dbPath,
+		dump:      NewStatementScanner(dump),
+		sort:      policy != RowOrderDump,
+		subset:    subset,
+		reordered: map[string]bool{},
+	}
+}
+
+func (o *orderedDump) Scan() bool {
+	for {
+		if o.rows != nil {
+			if o.rows.Scan() {
+				o.text = o.rows.Text()
+				return true
+			}
+			err := o.rows.Err()
+			if closeErr := o.stream.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				o.err = o.explain(err)
+				return false
+			}
+			o.rows, o.stream, o.current = nil, nil, nil
+		}
+		if o.pending != nil {
+			o.current, o.pending = o.pending, nil
+			stream, err := o.eng.OpenTableRows(o.ctx, o.dbPath, o.current.table, o.current.where, o.current.orderBy)
+			if err != nil {
+				o.err = o.explain(err)
+				return false
+			}
+			o.rows, o.stream = NewStatementScanner(stream), stream
+			continue
+		}
+
+		if !o.dump.Scan() {
+			o.err = o.dump.Err()
+			return false
+		}
+		stmt := o.dump.Text()
+		if table := InsertTableName(stmt); table != "" {
+			if o.reordered[strings.ToLower(table)] {
+				continue
+			}
+		} else if kind, name := schemaObjectName(stmt); kind == "table" && strings.HasPrefix(stmt, "CREATE TABLE") {
+			query := &rowQuery{table: name, where: o.subset[strings.ToLower(name)]}
+			if o.sort {
+				if ct, err := ParseCreateTable(stmt); err == nil {
+					if query.orderBy = keyOrder(ct); query.orderBy != nil {
+						slog.Debug("Ordering rows by primary key", "table", name, "columns", query.orderBy)
+					}
+				}
+			}
+			if query.where != "" {
+				slog.Info("Applying subset rule", "table", name)
+			}
+			if query.where != "" || query.orderBy != nil {
+				o.reordered[strings.ToLower(name)] = true
+				o.pending = query
+			}
+		}
+		o.text = stmt
+		return true
+	}
+}
+
+// explain names the subset rule of the table whose rows failed, whose
+// condition is the likely culprit.
+func (o *orderedDump) explain(err error) error {
+	if o.current.where != "" {
+		return fmt.Errorf("subset rule for table %s: %w", o.current.table, err)
+	}
+	return err
+}
+
+func (o *orderedDump) Text() string { return o.text }
+
+func (o *orderedDump) Err() error { return o.err }
+
+// Close stops a sorted row query that is still running.
+func (o *orderedDump) Close() {
+	if o.stream != nil {
+		o.stream.Close()
+	}
+}
+
+// keyOrder returns the primary key columns to sort the rows of ct by, or nil
+// if .dump already emits them in a stable order.
+func keyOrder(ct *CreateTable) []string {
+	if ct.withoutRowid() || ct.rowidAlias() != "" {
+		// WITHOUT ROWID tables are stored in key order, and an INTEGER
+		// PRIMARY KEY is the rowid
+		return nil
+	}
+	return ct.primaryKeyColumns()
+}
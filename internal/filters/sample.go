@@ -0,0 +1,39 @@
+package filters
+
+import (
+	"context"
+	"io"
+
+	"github.com/danielsiegl/gitsqlite/internal/sqlite"
+)
+
+// SampleTableData returns the canonical INSERT lines of every table, keyed by
+// table name, keeping at most maxBytes of lines per table.
+func SampleTableData(ctx context.Context, eng *sqlite.Engine, dbPath string, maxBytes int) (map[string][]string, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		opts := DefaultOptions()
+		opts.DataOnly = true
+		pw.CloseWithError(DumpTables(ctx, eng, dbPath, pw, opts))
+	}()
+
+	samples := map[string][]string{}
+	sizes := map[string]int{}
+	scanner := NewStatementScanner(pr)
+	for scanner.Scan() {
+		stmt := scanner.Text()
+		table := InsertTableName(stmt)
+		if table == "" {
+			continue
+		}
+		if sizes[table]+len(stmt) > maxBytes {
+			continue
+		}
+		samples[table] = append(samples[table], stmt)
+		sizes[table] += len(stmt) + 1
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return samples, nil
+}
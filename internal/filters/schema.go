@@ -0,0 +1,813 @@
+package filters
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// CreateTable is a parsed CREATE TABLE statement. Only the parts needed to
+// emit a canonical form are modelled; expressions are kept as token lists.
+type CreateTable struct {
+	Prefix      []Token // CREATE [TEMP] TABLE [IF NOT EXISTS]
+	Name        []Token // possibly schema-qualified table name
+	Columns     []ColumnDef
+	Constraints [][]Token // table constraints (PRIMARY KEY(...), FOREIGN KEY ...)
+	Options     []Token   // WITHOUT ROWID, STRICT
+}
+
+// ColumnDef is a single column definition within a CREATE TABLE statement.
+type ColumnDef struct {
+	Name        Token
+	Type        []Token
+	Constraints []ColumnConstraint
+}
+
+// ColumnConstraint is a single column constraint such as NOT NULL or DEFAULT 0.
+type ColumnConstraint struct {
+	Name   []Token // optional CONSTRAINT <name>
+	Tokens []Token
+}
+
+// constraintRank defines the canonical order of column constraints.
+var constraintRank = map[string]int{
+	"PRIMARY":    0,
+	"NOT":        1,
+	"NULL":       1,
+	"UNIQUE":     2,
+	"CHECK":      3,
+	"DEFAULT":    4,
+	"COLLATE":    5,
+	"REFERENCES": 6,
+	"GENERATED":  7,
+	"AS":         7,
+}
+
+// grammarKeywords are words normalized to upper case when they appear in
+// column definitions outside of expressions.
+var grammarKeywords = map[string]bool{
+	"PRIMARY": true, "KEY": true, "NOT": true, "NULL": true, "UNIQUE": true, "CHECK": true,
+	"DEFAULT": true, "COLLATE": true, "REFERENCES": true, "ON": true, "DELETE": true,
+	"UPDATE": true, "CASCADE": true, "SET": true, "RESTRICT": true, "NO": true, "ACTION": true,
+	"CONFLICT": true, "ROLLBACK": true, "ABORT": true, "FAIL": true, "IGNORE": true,
+	"REPLACE": true, "ASC": true, "DESC": true, "AUTOINCREMENT": true, "GENERATED": true,
+	"ALWAYS": true, "AS": true, "STORED": true, "VIRTUAL": true, "DEFERRABLE": true,
+	"INITIALLY": true, "DEFERRED": true, "IMMEDIATE": true, "MATCH": true, "CONSTRAINT": true,
+	"FOREIGN": true, "CURRENT_TIME": true, "CURRENT_DATE": true, "CURRENT_TIMESTAMP": true,
+	"TRUE": true, "FALSE": true, "CREATE": true, "TABLE": true, "TEMP": true,
+	"TEMPORARY": true, "IF": true, "EXISTS": true, "WITHOUT": true, "ROWID": true, "STRICT": true,
+}
+
+// ParseCreateTable parses a CREATE TABLE statement. Comments are ignored.
+// Statements that cannot be represented (CREATE TABLE ... AS SELECT) return
+// an error so callers can fall back to the original text.
+func ParseCreateTable(stmt string) (*CreateTable, error) {
+	var toks []Token
+	for _, t := range Tokenize(strings.TrimSpace(stmt)) {
+		if t.Kind != TokenSpace && t.Kind != TokenComment {
+			toks = append(toks, t)
+		}
+	}
+	if len(toks) > 0 && toks[len(toks)-1].Text == ";" {
+		toks = toks[:len(toks)-1]
+	}
+
+	ct := &CreateTable{}
+	i := 0
+	for i < len(toks) && toks[i].Kind == TokenWord && isTablePrefixWord(toks[i]) {
+		ct.Prefix = append(ct.Prefix, toks[i])
+		i++
+	}
+	if len(ct.Prefix) < 2 || !ct.Prefix[0].Is("CREATE") || !ct.Prefix[len(ct.Prefix)-1].Is("TABLE") &&
+		!ct.Prefix[len(ct.Prefix)-1].Is("EXISTS") {
+		return nil, fmt.Errorf("not a CREATE TABLE statement")
+	}
+	for i < len(toks) && toks[i].Text != "(" {
+		if toks[i].Is("AS") {
+			return nil, fmt.Errorf("CREATE TABLE ... AS SELECT is not canonicalized")
+		}
+		ct.Name = append(ct.Name, toks[i])
+		i++
+	}
+	if i >= len(toks) || len(ct.Name) == 0 {
+		return nil, fmt.Errorf("missing column list")
+	}
+	end := matchParen(toks, i)
+	if end < 0 {
+		return nil, fmt.Errorf("unbalanced parentheses")
+	}
+	ct.Options = toks[end+1:]
+
+	for _, def := range splitTopLevel(toks[i+1 : end]) {
+		if len(def) == 0 {
+			return nil, fmt.Errorf("empty column definition")
+		}
+		if isTableConstraintStart(def) {
+			ct.Constraints = append(ct.Constraints, def)
+			continue
+		}
+		if len(ct.Constraints) > 0 {
+			return nil, fmt.Errorf("column definition after table constraint")
+		}
+		col, err := parseColumnDef(def)
+		if err != nil {
+			return nil, err
+		}
+		ct.Columns = append(ct.Columns, col)
+	}
+	if len(ct.Columns) == 0 {
+		return nil, fmt.Errorf("no columns")
+	}
+	return ct, nil
+}
+
+func isTablePrefixWord(t Token) bool {
+	for _, w := range []string{"CREATE", "TEMP", "TEMPORARY", "TABLE", "IF", "NOT", "EXISTS"} {
+		if t.Is(w) {
+			return true
+		}
+	}
+	return false
+}
+
+func isTableConstraintStart(def []Token) bool {
+	first := def[0]
+	if first.Is("CONSTRAINT") || first.Is("CHECK") || first.Is("FOREIGN") {
+		return true
+	}
+	return len(def) > 1 && ((first.Is("PRIMARY") && def[1].Is("KEY")) || (first.Is("UNIQUE") && def[1].Text == "("))
+}
+
+// parseColumnDef splits a column definition into name, type and constraints.
+func parseColumnDef(def []Token) (ColumnDef, error) {
+	col := ColumnDef{Name: def[0]}
+	i := 1
+	// Type name: words optionally followed by a parenthesized size.
+	for i < len(def) && def[i].Kind == TokenWord && !isConstraintStart(def, i) {
+		col.Type = append(col.Type, def[i])
+		i++
+	}
+	if len(col.Type) > 0 && i < len(def) && def[i].Text == "(" {
+		end := matchParen(def, i)
+		if end < 0 {
+			return col, fmt.Errorf("unbalanced type parameters")
+		}
+		col.Type = append(col.Type, def[i:end+1]...)
+		i = end + 1
+	}
+
+	var pendingName []Token
+	for i < len(def) {
+		if def[i].Is("CONSTRAINT") {
+			if i+1 >= len(def) {
+				return col, fmt.Errorf("dangling CONSTRAINT")
+			}
+			pendingName = def[i : i+2]
+			i += 2
+			continue
+		}
+		if !isConstraintStart(def, i) {
+			return col, fmt.Errorf("unexpected token %q in column %s", def[i].Text, col.Name.Text)
+		}
+		j := constraintEnd(def, i)
+		col.Constraints = append(col.Constraints, ColumnConstraint{Name: pendingName, Tokens: def[i:j]})
+		pendingName = nil
+		i = j
+	}
+	if pendingName != nil {
+		return col, fmt.Errorf("dangling CONSTRAINT")
+	}
+	return col, nil
+}
+
+// isConstraintStart reports whether def[i] starts a new column constraint.
+func isConstraintStart(def []Token, i int) bool {
+	t := def[i]
+	switch {
+	case t.Is("NOT"):
+		return i+1 < len(def) && def[i+1].Is("NULL")
+	case t.Is("PRIMARY"), t.Is("NULL"), t.Is("UNIQUE"), t.Is("CHECK"), t.Is("DEFAULT"),
+		t.Is("COLLATE"), t.Is("REFERENCES"), t.Is("GENERATED"), t.Is("AS"), t.Is("CONSTRAINT"):
+		return true
+	}
+	return false
+}
+
+// constraintEnd returns the index just past the constraint starting at def[i].
+func constraintEnd(def []Token, i int) int {
+	if def[i].Is("DEFAULT") {
+		j := i + 1
+		if j < len(def) && (def[j].Text == "-" || def[j].Text == "+") {
+			j++
+		}
+		if j < len(def) && def[j].Text == "(" {
+			if end := matchParen(def, j); end >= 0 {
+				return end + 1
+			}
+			return len(def)
+		}
+		return j + 1
+	}
+	if def[i].Is("GENERATED") {
+		// GENERATED ALWAYS AS (...) is one constraint.
+		j := i + 1
+		for j < len(def) && !def[j].Is("AS") {
+			j++
+		}
+		i = j
+	}
+	j := i + 1
+	if def[i].Is("NOT") {
+		j++ // NOT NULL
+	}
+	for j < len(def) {
+		if def[j].Text == "(" {
+			end := matchParen(def, j)
+			if end < 0 {
+				return len(def)
+			}
+			j = end + 1
+			continue
+		}
+		// NOT DEFERRABLE and ON DELETE SET NULL/DEFAULT belong to a
+		// REFERENCES clause.
+		if def[j].Is("NOT") && j+1 < len(def) && def[j+1].Is("DEFERRABLE") {
+			j += 2
+			continue
+		}
+		if (def[j].Is("NULL") || def[j].Is("DEFAULT")) && def[j-1].Is("SET") {
+			j++
+			continue
+		}
+		if isConstraintStart(def, j) {
+			return j
+		}
+		j++
+	}
+	return j
+}
+
+// matchParen returns the index of the parenthesis closing toks[open].
+func matchParen(toks []Token, open int) int {
+	depth := 0
+	for i := open; i < len(toks); i++ {
+		switch toks[i].Text {
+		case "(":
+			depth++
+		case ")":
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// splitTopLevel splits tokens on commas that are not nested in parentheses.
+func splitTopLevel(toks []Token) [][]Token {
+	var parts [][]Token
+	depth, start := 0, 0
+	for i, t := range toks {
+		switch t.Text {
+		case "(":
+			depth++
+		case ")":
+			depth--
+		case ",":
+			if depth == 0 {
+				parts = append(parts, toks[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(parts, toks[start:])
+}
+
+// String renders the canonical form: one column per line, column constraints
+// in a fixed order, grammar keywords and type names in upper case and
+// redundant parentheses around literal DEFAULT values removed.
+func (ct *CreateTable) String() string {
+	var b strings.Builder
+	b.WriteString(joinTokens(upperConstraintKeywords(ct.Prefix)))
+	b.WriteByte(' ')
+	b.WriteString(joinTokens(ct.Name))
+	b.WriteString("(\n")
+
+	lines := make([]string, 0, len(ct.Columns)+len(ct.Constraints))
+	for _, col := range ct.Columns {
+		lines = append(lines, "  "+col.String())
+	}
+	for _, c := range ct.Constraints {
+		lines = append(lines, "  "+joinTokens(upperConstraintKeywords(c)))
+	}
+	b.WriteString(strings.Join(lines, ",\n"))
+	b.WriteString("\n)")
+	if len(ct.Options) > 0 {
+		b.WriteByte(' ')
+		b.WriteString(joinTokens(upperConstraintKeywords(ct.Options)))
+	}
+	b.WriteByte(';')
+	return b.String()
+}
+
+// String renders the canonical column definition.
+func (col ColumnDef) String() string {
+	parts := []string{col.Name.Text}
+	if len(col.Type) > 0 {
+		typ := make([]Token, len(col.Type))
+		for i, t := range col.Type {
+			if t.Kind == TokenWord {
+				t.Text = strings.ToUpper(t.Text)
+			}
+			typ[i] = t
+		}
+		parts = append(parts, joinTokens(typ))
+	}
+
+	constraints := make([]ColumnConstraint, len(col.Constraints))
+	copy(constraints, col.Constraints)
+	sort.SliceStable(constraints, func(a, b int) bool {
+		return constraintRank[strings.ToUpper(constraints[a].Tokens[0].Text)] <
+			constraintRank[strings.ToUpper(constraints[b].Tokens[0].Text)]
+	})
+	for _, c := range constraints {
+		parts = append(parts, c.String())
+	}
+	return strings.Join(parts, " ")
+}
+
+// String renders the canonical column constraint.
+func (c ColumnConstraint) String() string {
+	toks := c.Tokens
+	if toks[0].Is("DEFAULT") {
+		toks = canonicalDefault(toks)
+	}
+	s := joinTokens(upperConstraintKeywords(toks))
+	if len(c.Name) > 0 {
+		s = "CONSTRAINT " + c.Name[1].Text + " " + s
+	}
+	return s
+}
+
+// canonicalDefault strips redundant parentheses around literal DEFAULT values.
+func canonicalDefault(toks []Token) []Token {
+	if len(toks) < 3 || toks[1].Text != "(" || toks[len(toks)-1].Text != ")" {
+		return toks
+	}
+	inner := toks[2 : len(toks)-1]
+	literal := false
+	switch len(inner) {
+	case 1:
+		switch inner[0].Kind {
+		case TokenNumber, TokenString, TokenBlob:
+			literal = true
+		case TokenWord:
+			literal = inner[0].Is("NULL") || inner[0].Is("TRUE") || inner[0].Is("FALSE") ||
+				inner[0].Is("CURRENT_TIME") || inner[0].Is("CURRENT_DATE") || inner[0].Is("CURRENT_TIMESTAMP")
+		}
+	case 2:
+		literal = (inner[0].Text == "-" || inner[0].Text == "+") && inner[1].Kind == TokenNumber
+	}
+	if !literal {
+		return toks
+	}
+	return append([]Token{toks[0]}, inner...)
+}
+
+// upperConstraintKeywords upper-cases grammar keywords but leaves CHECK,
+// DEFAULT and GENERATED expressions untouched.
+func upperConstraintKeywords(toks []Token) []Token {
+	out := make([]Token, len(toks))
+	copy(out, toks)
+	depth := 0
+	for i, t := range out {
+		switch t.Text {
+		case "(":
+			depth++
+		case ")":
+			depth--
+		}
+		if depth == 0 && t.Kind == TokenWord && grammarKeywords[strings.ToUpper(t.Text)] {
+			// The collation name after COLLATE is an identifier, not a keyword.
+			if i > 0 && out[i-1].Is("COLLATE") {
+				continue
+			}
+			out[i].Text = strings.ToUpper(t.Text)
+		}
+	}
+	return out
+}
+
+// spacedBeforeParen lists keywords that are separated from a following
+// opening parenthesis by a space.
+var spacedBeforeParen = map[string]bool{
+	"CHECK": true, "DEFAULT": true, "AS": true, "IN": true, "AND": true, "OR": true,
+	"NOT": true, "ON": true, "WHEN": true, "THEN": true, "ELSE": true, "EXISTS": true,
+}
+
+// isUnaryPosition reports whether the sign at toks[i] is a unary operator.
+func isUnaryPosition(toks []Token, i int) bool {
+	if i == 0 {
+		return true
+	}
+	prev := toks[i-1]
+	switch prev.Kind {
+	case TokenPunct:
+		return prev.Text != ")"
+	case TokenWord:
+		return grammarKeywords[strings.ToUpper(prev.Text)] || spacedBeforeParen[strings.ToUpper(prev.Text)]
+	}
+	return false
+}
+
+// joinTokens joins tokens with single spaces, omitting spaces inside
+// parentheses, before commas and between a name and its argument list.
+func joinTokens(toks []Token) string {
+	var b strings.Builder
+	for i, t := range toks {
+		if i > 0 {
+			prev := toks[i-1]
+			space := true
+			switch {
+			case prev.Text == "(" || t.Text == ")" || t.Text == "," || prev.Text == ".", t.Text == ".":
+				space = false
+			case t.Text == "(":
+				// Function calls, type sizes and REFERENCES targets hug the
+				// parenthesis; keywords and operators are followed by a space.
+				space = prev.Kind == TokenWord && spacedBeforeParen[strings.ToUpper(prev.Text)] ||
+					prev.Kind == TokenPunct
+			case (prev.Text == "-" || prev.Text == "+") && t.Kind == TokenNumber && isUnaryPosition(toks, i-1):
+				space = false
+			}
+			if space {
+				b.WriteByte(' ')
+			}
+		}
+		b.WriteString(t.Text)
+	}
+	return b.String()
+}
+
+// CanonicalizeCreateTable returns the canonical form of a CREATE TABLE
+// statement, or the statement unchanged if it cannot be parsed. Statements
+// containing comments are kept verbatim so that no information is lost.
+func CanonicalizeCreateTable(stmt string) string {
+	for _, t := range Tokenize(stmt) {
+		if t.Kind == TokenComment {
+			return stmt
+		}
+	}
+	ct, err := ParseCreateTable(stmt)
+	if err != nil {
+		return stmt
+	}
+	return ct.String()
+}
+
+// CreateIndex is a parsed CREATE INDEX statement.
+type CreateIndex struct {
+	Name    string
+	Table   string
+	Unique  bool
+	Columns []string // indexed column names or expressions
+}
+
+// ParseCreateIndex parses a CREATE [UNIQUE] INDEX statement.
+func ParseCreateIndex(stmt string) (*CreateIndex, error) {
+	var toks []Token
+	for _, t := range Tokenize(strings.TrimSpace(stmt)) {
+		if t.Kind != TokenSpace && t.Kind != TokenComment {
+			toks = append(toks, t)
+		}
+	}
+	if len(toks) < 2 || !toks[0].Is("CREATE") {
+		return nil, fmt.Errorf("not a CREATE INDEX statement")
+	}
+	idx := &CreateIndex{}
+	i := 1
+	if toks[i].Is("UNIQUE") {
+		idx.Unique = true
+		i++
+	}
+	if i >= len(toks) || !toks[i].Is("INDEX") {
+		return nil, fmt.Errorf("not a CREATE INDEX statement")
+	}
+	i++
+	if i+2 < len(toks) && toks[i].Is("IF") && toks[i+1].Is("NOT") && toks[i+2].Is("EXISTS") {
+		i += 3
+	}
+	var name []Token
+	for i < len(toks) && !toks[i].Is("ON") {
+		name = append(name, toks[i])
+		i++
+	}
+	if i+2 >= len(toks) || len(name) == 0 {
+		return nil, fmt.Errorf("malformed CREATE INDEX statement")
+	}
+	idx.Name = UnquoteIdent(joinTokens(name))
+	idx.Table = UnquoteIdent(toks[i+1].Text)
+	open := i + 2
+	if toks[open].Text != "(" {
+		return nil, fmt.Errorf("malformed CREATE INDEX statement")
+	}
+	end := matchParen(toks, open)
+	if end < 0 {
+		return nil, fmt.Errorf("unbalanced parentheses")
+	}
+	for _, part := range splitTopLevel(toks[open+1 : end]) {
+		if len(part) == 1 {
+			idx.Columns = append(idx.Columns, UnquoteIdent(part[0].Text))
+		} else {
+			idx.Columns = append(idx.Columns, joinTokens(part))
+		}
+	}
+	return idx, nil
+}
+
+// UnquoteIdent strips SQL identifier quoting ("x", `x`, [x]) from name.
+func UnquoteIdent(name string) string {
+	if len(name) >= 2 {
+		switch {
+		case name[0] == '"' && name[len(name)-1] == '"':
+			return strings.ReplaceAll(name[1:len(name)-1], `""`, `"`)
+		case name[0] == '`' && name[len(name)-1] == '`':
+			return strings.ReplaceAll(name[1:len(name)-1], "``", "`")
+		case name[0] == '[' && name[len(name)-1] == ']':
+			return name[1 : len(name)-1]
+		}
+	}
+	return name
+}
+
+// TableName returns the unquoted, unqualified name of the table.
+func (ct *CreateTable) TableName() string {
+	return UnquoteIdent(ct.Name[len(ct.Name)-1].Text)
+}
+
+// HasPrimaryKey reports whether the table declares a primary key, either on a
+// column or as a table constraint.
+func (ct *CreateTable) HasPrimaryKey() bool {
+	for _, col := range ct.Columns {
+		for _, c := range col.Constraints {
+			if c.Tokens[0].Is("PRIMARY") {
+				return true
+			}
+		}
+	}
+	for _, c := range ct.Constraints {
+		for _, t := range c {
+			if t.Is("PRIMARY") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ReferencedTables returns the unquoted names of the tables referenced by
+// foreign keys, on columns or as table constraints.
+func (ct *CreateTable) ReferencedTables() []string {
+	var tables []string
+	collect := func(toks []Token) {
+		for i := 0; i+1 < len(toks); i++ {
+			if toks[i].Is("REFERENCES") {
+				tables = append(tables, UnquoteIdent(toks[i+1].Text))
+			}
+		}
+	}
+	for _, col := range ct.Columns {
+		for _, c := range col.Constraints {
+			collect(c.Tokens)
+		}
+	}
+	for _, c := range ct.Constraints {
+		collect(c)
+	}
+	return tables
+}
+
+// HasGeneratedColumns reports whether any column is a generated column.
+func (ct *CreateTable) HasGeneratedColumns() bool {
+	for _, col := range ct.Columns {
+		if col.IsGenerated() {
+			return true
+		}
+	}
+	return false
+}
+
+// primaryKeyColumns returns the unquoted names of the table's primary key
+// columns in key order, or nil if it has none.
+func (ct *CreateTable) primaryKeyColumns() []string {
+	for _, col := range ct.Columns {
+		for _, c := range col.Constraints {
+			if c.Tokens[0].Is("PRIMARY") {
+				return []string{UnquoteIdent(col.Name.Text)}
+			}
+		}
+	}
+	for _, c := range ct.Constraints {
+		var sig []Token
+		for _, t := range c {
+			if t.Kind != TokenSpace && t.Kind != TokenComment {
+				sig = append(sig, t)
+			}
+		}
+		for i := 0; i+2 < len(sig); i++ {
+			if !sig[i].Is("PRIMARY") || !sig[i+1].Is("KEY") || sig[i+2].Text != "(" {
+				continue
+			}
+			var names []string
+			// Each key column is the first token after "(" or ","
+			for j := i + 2; j < len(sig) && sig[j].Text != ")"; j++ {
+				if sig[j].Text != "(" && sig[j].Text != "," || j+1 >= len(sig) {
+					continue
+				}
+				names = append(names, UnquoteIdent(sig[j+1].Text))
+			}
+			return names
+		}
+	}
+	return nil
+}
+
+// hasCollation reports whether a column or table constraint names a
+// collation other than BINARY.
+func (ct *CreateTable) hasCollation() bool {
+	collates := func(toks []Token) bool {
+		var sig []Token
+		for _, t := range toks {
+			if t.Kind != TokenSpace && t.Kind != TokenComment {
+				sig = append(sig, t)
+			}
+		}
+		for i := 0; i+1 < len(sig); i++ {
+			if sig[i].Is("COLLATE") && !strings.EqualFold(UnquoteIdent(sig[i+1].Text), "BINARY") {
+				return true
+			}
+		}
+		return false
+	}
+	for _, col := range ct.Columns {
+		for _, c := range col.Constraints {
+			if collates(c.Tokens) {
+				return true
+			}
+		}
+	}
+	for _, c := range ct.Constraints {
+		if collates(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// withoutRowid reports whether the table is a WITHOUT ROWID table.
+func (ct *CreateTable) withoutRowid() bool {
+	return ct.hasOption("ROWID")
+}
+
+// hasOption reports whether the table options include keyword, e.g. STRICT.
+func (ct *CreateTable) hasOption(keyword string) bool {
+	for _, t := range ct.Options {
+		if t.Is(keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+// rowidAlias returns the name of the column that is an alias of the rowid,
+// the INTEGER PRIMARY KEY of a rowid table, or "" if there is none.
+func (ct *CreateTable) rowidAlias() string {
+	key := ct.primaryKeyColumns()
+	if len(key) != 1 || ct.withoutRowid() {
+		return ""
+	}
+	for _, col := range ct.Columns {
+		if strings.EqualFold(UnquoteIdent(col.Name.Text), key[0]) && len(col.Type) == 1 && col.Type[0].Is("INTEGER") {
+			return key[0]
+		}
+	}
+	return ""
+}
+
+// IsGenerated reports whether the column is a generated column.
+func (col ColumnDef) IsGenerated() bool {
+	for _, c := range col.Constraints {
+		if c.Tokens[0].Is("GENERATED") || c.Tokens[0].Is("AS") {
+			return true
+		}
+	}
+	return false
+}
+
+// Affinity is the SQLite type affinity of a column, derived from its
+// declared type using the rules of https://sqlite.org/datatype3.html.
+type Affinity int
+
+const (
+	AffinityBlob Affinity = iota
+	AffinityText
+	AffinityNumeric
+	AffinityInteger
+	AffinityReal
+)
+
+// AffinityOf returns the affinity SQLite assigns to a declared column type.
+func AffinityOf(declType string) Affinity {
+	t := strings.ToUpper(declType)
+	switch {
+	case strings.Contains(t, "INT"):
+		return AffinityInteger
+	case strings.Contains(t, "CHAR"), strings.Contains(t, "CLOB"), strings.Contains(t, "TEXT"):
+		return AffinityText
+	case t == "", strings.Contains(t, "BLOB"):
+		return AffinityBlob
+	case strings.Contains(t, "REAL"), strings.Contains(t, "FLOA"), strings.Contains(t, "DOUB"):
+		return AffinityReal
+	}
+	return AffinityNumeric
+}
+
+// TableInfo describes the columns of a table as needed while processing
+// INSERT statements. Generated columns are left out, as in the INSERT
+// statements of a dump, so a value position is a column index.
+type TableInfo struct {
+	Name       string
+	Columns    []string
+	Affinities []Affinity
+	// HoldsReals is false if no column can store a REAL value: every column
+	// has TEXT affinity or is the rowid alias, or the table is STRICT and
+	// has no REAL or ANY column. Floats in such a table's rows can only
+	// appear inside string literals.
+	HoldsReals bool
+}
+
+// Info returns the column names and affinities of the table.
+func (ct *CreateTable) Info() *TableInfo {
+	info := &TableInfo{Name: ct.TableName()}
+	strict := ct.hasOption("STRICT")
+	rowid := ct.rowidAlias()
+	for _, col := range ct.Columns {
+		if col.IsGenerated() {
+			continue
+		}
+		name := UnquoteIdent(col.Name.Text)
+		declType := joinTokens(col.Type)
+		affinity := AffinityOf(declType)
+		info.Columns = append(info.Columns, name)
+		info.Affinities = append(info.Affinities, affinity)
+		switch {
+		case rowid != "" && strings.EqualFold(name, rowid):
+		case strict:
+			info.HoldsReals = info.HoldsReals || affinity == AffinityReal || strings.EqualFold(declType, "ANY")
+		default:
+			info.HoldsReals = info.HoldsReals || affinity != AffinityText
+		}
+	}
+	return info
+}
+
+// Index returns the position of the named column, or -1.
+func (t *TableInfo) Index(column string) int {
+	for i, c := range t.Columns {
+		if strings.EqualFold(c, column) {
+			return i
+		}
+	}
+	return -1
+}
+
+// HasAffinity reports whether any column of the table has affinity a.
+func (t *TableInfo) HasAffinity(a Affinity) bool {
+	for _, aff := range t.Affinities {
+		if aff == a {
+			return true
+		}
+	}
+	return false
+}
+
+// TableMap collects TableInfo for the tables seen in a dump stream.
+type TableMap map[string]*TableInfo
+
+// Observe records the table defined by stmt if it is a CREATE TABLE statement.
+func (m TableMap) Observe(stmt string) {
+	if !strings.HasPrefix(strings.TrimSpace(stmt), "CREATE TABLE") {
+		return
+	}
+	ct, err := ParseCreateTable(stmt)
+	if err != nil {
+		return
+	}
+	info := ct.Info()
+	m[strings.ToLower(info.Name)] = info
+}
+
+// Lookup returns the TableInfo for the named table, or nil.
+func (m TableMap) Lookup(table string) *TableInfo {
+	return m[strings.ToLower(table)]
+}
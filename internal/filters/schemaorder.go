@@ -0,0 +1,439 @@
+package filters
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/danielsiegl/gitsqlite/internal/shutdown"
+	"github.com/danielsiegl/gitsqlite/internal/sqlite"
+)
+
+// Schema order policies (-schema-order).
+const (
+	// SchemaOrderSorted writes tables, and then indexes, views and
+	// triggers, sorted by name, with tables after the tables their foreign
+	// keys reference and views after the views they select from.
+	SchemaOrderSorted = "sorted"
+	// SchemaOrderDump keeps the order sqlite3 .dump emits.
+	SchemaOrderDump = "dump"
+)
+
+// statementSource yields the statements of a dump.
+type statementSource interface {
+	Scan() bool
+	Text() string
+	Err() error
+}
+
+// schemaOrder yields the statements of a dump with schema objects in a
+// deterministic order.
+//
+// .dump emits objects in the order of their rows in sqlite_schema, which is
+// creation order: a migration that drops and recreates a table moves it to
+// the end, so databases with the same schema and data dump differently.
+// Every table is followed by its rows. Tables arriving in sorted order are
+// passed through; the others are spooled with their rows to a temporary file
+// until their turn. Indexes, views and triggers, which .dump emits after all
+// tables, are held in memory and written at the next statement that is not a
+// table, row or schema object, usually the final COMMIT. Such a statement,
+// e.g. the writable_schema pragma of a virtual table, also writes the
+// spooled tables, so tables are only sorted among those on the same side of
+// it.
+type schemaOrder struct {
+	src  statementSource
+	sort bool
+
+	// want holds the lower-case names of the tables in output order, next
+	// the position of the table to pass through next; written holds the
+	// tables already queued.
+	want    []string
+	next    int
+	written map[string]bool
+
+	// table is the lower-case name of the table whose rows are read,
+	// spooling whether they go to the spool file.
+	table    string
+	spooling bool
+	spool    *os.File
+	spoolW   *bufio.Writer
+	// removeSpool removes the spool file, also if gitsqlite exits early
+	removeSpool func()
+	size        int64
+	spooled     map[string]span
+	objects     []schemaObject
+
+	queue  []queued
+	replay *bufio.Reader
+	done   bool
+
+	text string
+	err  error
+}
+
+// span is the part of the spool file holding a table and its rows.
+type span struct{ start, end int64 }
+
+// queued is a statement to yield, or the spooled statements of a table.
+type queued struct {
+	stmt    string
+	spooled *span
+}
+
+// schemaObject is an index, view or trigger held back for sorting.
+type schemaObject struct {
+	kind, name string
+	stmt       string
+}
+
+// objectKinds is the order of the schema objects following the tables.
+var objectKinds = []string{"index", "view", "trigger"}
+
+// newSchemaOrder returns the statements of src, with schema objects ordered
+// according to policy. The table names are read from dbPath.
+func newSchemaOrder(ctx context.Context, eng *sqlite.Engine, dbPath string, src statementSource, policy string) (*schemaOrder, error) {
+	o := &schemaOrder{src: src, sort: policy != SchemaOrderDump, spooled: map[string]span{}, written: map[string]bool{}}
+	if !o.sort {
+		return o, nil
+	}
+	rows, err := eng.Query(ctx, dbPath, "SELECT name, sql FROM sqlite_schema WHERE type = 'table' AND sql NOT NULL;")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema: %w", err)
+	}
+	var names []string
+	deps := map[string][]string{}
+	for _, row := range rows {
+		if len(row) != 2 || strings.HasPrefix(strings.ToLower(row[0]), "sqlite_") {
+			continue
+		}
+		// Virtual tables are dumped as rows of sqlite_schema
+		if kind, _ := schemaObjectName(row[1]); kind != "table" {
+			continue
+		}
+		name := strings.ToLower(row[0])
+		names = append(names, name)
+		if ct, err := ParseCreateTable(row[1]); err == nil {
+			for _, ref := range ct.ReferencedTables() {
+				deps[name] = append(deps[name], strings.ToLower(ref))
+			}
+		}
+	}
+	o.want = sortByDependencies(names, deps)
+	return o, nil
+}
+
+func (o *schemaOrder) Scan() bool {
+	for {
+		if o.err != nil {
+			return false
+		}
+		if o.replay != nil {
+			if stmt, err := readSpooled(o.replay); err == nil {
+				o.text = stmt
+				return true
+			} else if err != io.EOF {
+				o.err = err
+				return false
+			}
+			o.replay = nil
+		}
+		if len(o.queue) > 0 {
+			q := o.queue[0]
+			o.queue = o.queue[1:]
+			if q.spooled == nil {
+				o.text = q.stmt
+				return true
+			}
+			if err := o.spoolW.Flush(); err != nil {
+				o.err = err
+				return false
+			}
+			o.replay = bufio.NewReader(io.NewSectionReader(o.spool, q.spooled.start, q.spooled.end-q.spooled.start))
+			continue
+		}
+		if o.done {
+			return false
+		}
+		if !o.src.Scan() {
+			if o.err = o.src.Err(); o.err != nil {
+				return false
+			}
+			o.done = true
+			o.flush()
+			continue
+		}
+		if !o.sort {
+			o.text = o.src.Text()
+			return true
+		}
+		o.err = o.handle(o.src.Text())
+	}
+}
+
+// handle queues, spools or holds back stmt.
+func (o *schemaOrder) handle(stmt string) error {
+	if o.table != "" && strings.EqualFold(InsertTableName(stmt), o.table) {
+		if o.spooling {
+			return o.write(stmt)
+		}
+		o.queue = append(o.queue, queued{stmt: stmt})
+		return nil
+	}
+	o.endTable()
+
+	kind, name := schemaObjectName(stmt)
+	switch kind {
+	case "table":
+		o.table = strings.ToLower(name)
+		if pos := o.position(o.table); pos > o.next {
+			o.spooling = true
+			o.spooled[o.table] = span{start: o.size}
+			return o.write(stmt)
+		}
+		o.queue = append(o.queue, queued{stmt: stmt})
+		return nil
+	case "index", "view", "trigger":
+		o.objects = append(o.objects, schemaObject{kind: kind, name: name, stmt: stmt})
+		return nil
+	}
+	o.flush()
+	o.queue = append(o.queue, queued{stmt: stmt})
+	return nil
+}
+
+// position returns the position of table in the output order, -1 if it is
+// not sorted or already due.
+func (o *schemaOrder) position(table string) int {
+	if o.written[table] {
+		return -1
+	}
+	for i := o.next; i < len(o.want); i++ {
+		if o.want[i] == table {
+			return i
+		}
+	}
+	return -1
+}
+
+// endTable ends the rows of the current table and queues the spooled tables
+// that are now due.
+func (o *schemaOrder) endTable() {
+	if o.table == "" {
+		return
+	}
+	if o.spooling {
+		s := o.spooled[o.table]
+		s.end = o.size
+		o.spooled[o.table] = s
+	} else {
+		o.written[o.table] = true
+		o.advance()
+	}
+	o.table, o.spooling = "", false
+}
+
+// advance moves next past the tables already written and queues the spooled
+// tables that are due.
+func (o *schemaOrder) advance() {
+	for ; o.next < len(o.want); o.next++ {
+		table := o.want[o.next]
+		if o.written[table] {
+			continue
+		}
+		s, ok := o.spooled[table]
+		if !ok {
+			return
+		}
+		o.queue = append(o.queue, queued{spooled: &s})
+		o.written[table] = true
+	}
+}
+
+// flush queues all spooled tables in output order and the held back schema
+// objects.
+func (o *schemaOrder) flush() {
+	o.endTable()
+	for _, table := range o.want {
+		if s, ok := o.spooled[table]; ok && !o.written[table] {
+			o.queue = append(o.queue, queued{spooled: &s})
+			o.written[table] = true
+		}
+	}
+	o.advance()
+	for _, obj := range sortObjects(o.objects) {
+		o.queue = append(o.queue, queued{stmt: obj.stmt})
+	}
+	o.objects = nil
+}
+
+// write appends stmt to the spool file, which is created on first use.
+func (o *schemaOrder) write(stmt string) error {
+	if o.spool == nil {
+		f, err := os.CreateTemp("", "gitsqlite-order-*.sql")
+		if err != nil {
+			return err
+		}
+		o.spool, o.spoolW = f, bufio.NewWriterSize(f, 64*1024)
+		o.removeSpool = shutdown.Remove(f.Name())
+		slog.Debug("Spooling tables to sort the schema", "file", f.Name())
+	}
+	var prefix [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(prefix[:], uint64(len(stmt)))
+	if _, err := o.spoolW.Write(prefix[:n]); err != nil {
+		return err
+	}
+	if _, err := o.spoolW.WriteString(stmt); err != nil {
+		return err
+	}
+	o.size += int64(n + len(stmt))
+	return nil
+}
+
+// readSpooled reads the next statement written by write.
+func readSpooled(r *bufio.Reader) (string, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+	return string(buf), nil
+}
+
+func (o *schemaOrder) Text() string { return o.text }
+
+func (o *schemaOrder) Err() error { return o.err }
+
+// Close removes the spool file.
+func (o *schemaOrder) Close() {
+	if o.spool != nil {
+		o.spool.Close()
+		o.removeSpool()
+		o.spool = nil
+	}
+}
+
+// sortObjects returns indexes, views and triggers in that order, each sorted
+// by name, with views after the views they select from.
+func sortObjects(objects []schemaObject) []schemaObject {
+	var sorted []schemaObject
+	for _, kind := range objectKinds {
+		byName := map[string]schemaObject{}
+		var names []string
+		for _, obj := range objects {
+			if obj.kind == kind {
+				key := strings.ToLower(obj.name)
+				if _, dup := byName[key]; dup {
+					// Cannot happen in one schema; keep both in dump order
+					key += fmt.Sprintf("\x00%d", len(names))
+				}
+				byName[key] = obj
+				names = append(names, key)
+			}
+		}
+		deps := map[string][]string{}
+		if kind == "view" {
+			for _, name := range names {
+				deps[name] = referencedNames(byName[name].stmt, byName)
+			}
+		}
+		for _, name := range sortByDependencies(names, deps) {
+			sorted = append(sorted, byName[name])
+		}
+	}
+	return sorted
+}
+
+// referencedNames returns the keys of names that occur as identifiers in stmt.
+func referencedNames(stmt string, names map[string]schemaObject) []string {
+	var refs []string
+	next := leadingTokens(stmt)
+	for tok := next(); tok.Text != ""; tok = next() {
+		if tok.Kind != TokenWord && tok.Kind != TokenQuotedIdent {
+			continue
+		}
+		if name := strings.ToLower(UnquoteIdent(tok.Text)); names[name].stmt != "" {
+			refs = append(refs, name)
+		}
+	}
+	return refs
+}
+
+// sortByDependencies returns names in lexicographic order, except that every
+// name follows the names it depends on. Dependencies on names not in names
+// are ignored and cycles are broken in lexicographic order.
+func sortByDependencies(names []string, deps map[string][]string) []string {
+	remaining := append([]string(nil), names...)
+	sort.Strings(remaining)
+	placed := map[string]bool{}
+	known := map[string]bool{}
+	for _, name := range names {
+		known[name] = true
+	}
+	ready := func(name string) bool {
+		for _, dep := range deps[name] {
+			if dep != name && known[dep] && !placed[dep] {
+				return false
+			}
+		}
+		return true
+	}
+	sorted := make([]string, 0, len(names))
+	for len(remaining) > 0 {
+		pick := 0
+		for i, name := range remaining {
+			if ready(name) {
+				pick = i
+				break
+			}
+		}
+		placed[remaining[pick]] = true
+		sorted = append(sorted, remaining[pick])
+		remaining = append(remaining[:pick], remaining[pick+1:]...)
+	}
+	return sorted
+}
+
+// schemaObjectName returns the kind ("table", "index", "view" or "trigger")
+// and the unquoted name of the object a CREATE statement creates. It returns
+// empty strings for other statements, including CREATE VIRTUAL TABLE.
+func schemaObjectName(stmt string) (string, string) {
+	next := leadingTokens(stmt)
+	if !next().Is("CREATE") {
+		return "", ""
+	}
+	word := next()
+	if word.Is("TEMP") || word.Is("TEMPORARY") {
+		word = next()
+	}
+	if word.Is("UNIQUE") {
+		word = next()
+	}
+	var kind string
+	for _, k := range []string{"table", "index", "view", "trigger"} {
+		if word.Is(k) {
+			kind = k
+		}
+	}
+	if kind == "" {
+		return "", ""
+	}
+	tok := next()
+	if tok.Is("IF") {
+		next() // NOT
+		next() // EXISTS
+		tok = next()
+	}
+	if after := next(); after.Text == "." {
+		tok = next()
+	}
+	return kind, UnquoteIdent(tok.Text)
+}
@@ -0,0 +1,172 @@
+package filters
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/danielsiegl/gitsqlite/internal/shutdown"
+	"github.com/danielsiegl/gitsqlite/internal/sqlite"
+	"github.com/danielsiegl/gitsqlite/internal/warnings"
+)
+
+// Sidecar policies for journal files found next to the source database.
+const (
+	// SidecarFold copies -wal/-journal files next to the temporary snapshot so
+	// sqlite applies (WAL) or rolls back (hot journal) them before dumping.
+	SidecarFold = "fold"
+	// SidecarWarn only warns about journal files.
+	SidecarWarn = "warn"
+	// SidecarIgnore disables sidecar detection.
+	SidecarIgnore = "ignore"
+)
+
+// Sidecars describes journal files and editor artifacts found next to a
+// database file.
+type Sidecars struct {
+	WAL             string   // path of a non-empty -wal file
+	Journal         string   // path of a rollback -journal file
+	EditorArtifacts []string // lock files and temp copies left by editors
+	IsEditorTemp    bool     // the database path itself looks like an editor temp copy
+}
+
+// FindSidecars looks for journal files and editor artifacts belonging to dbPath.
+func FindSidecars(dbPath string) Sidecars {
+	var sc Sidecars
+	if fi, err := os.Stat(dbPath + "-wal"); err == nil && fi.Size() > 0 {
+		sc.WAL = dbPath + "-wal"
+	}
+	if fi, err := os.Stat(dbPath + "-journal"); err == nil && fi.Size() > 0 {
+		sc.Journal = dbPath + "-journal"
+	}
+
+	dir, base := filepath.Split(dbPath)
+	for _, candidate := range []string{
+		".~lock." + base + "#", // LibreOffice
+		"~$" + base,            // Microsoft Office
+		"." + base + ".swp",    // vim
+		base + "~",             // emacs and others
+		"#" + base + "#",       // emacs auto-save
+		base + ".lock",
+		base + ".tmp",
+	} {
+		if _, err := os.Stat(filepath.Join(dir, candidate)); err == nil {
+			sc.EditorArtifacts = append(sc.EditorArtifacts, filepath.Join(dir, candidate))
+		}
+	}
+
+	sc.IsEditorTemp = strings.HasPrefix(base, "~$") || strings.HasPrefix(base, ".~lock.") ||
+		strings.HasSuffix(base, "~") || strings.HasSuffix(base, ".swp") ||
+		(strings.HasPrefix(base, "#") && strings.HasSuffix(base, "#"))
+	return sc
+}
+
+// applySidecars warns about sidecar files of sourcePath and, with the fold
+// policy, copies journal files next to the snapshot at tmpPath. The returned
+// function removes the copied files.
+func applySidecars(sourcePath string, tmpPath string, policy string) (func(), error) {
+	noop := func() {}
+	if sourcePath == "" || policy == SidecarIgnore {
+		return noop, nil
+	}
+	sc := FindSidecars(sourcePath)
+
+	if sc.IsEditorTemp {
+		warnings.Emit(warnings.EditorArtifact, "%s looks like an editor temporary copy; it is probably not meant to be committed", sourcePath)
+	}
+	for _, artifact := range sc.EditorArtifacts {
+		warnings.Emit(warnings.EditorArtifact, "%s exists; %s may be open with unsaved changes in another program", artifact, sourcePath)
+	}
+
+	var copied []string
+	cleanup := func() {
+		for _, p := range copied {
+			_ = os.Remove(p)
+		}
+		_ = os.Remove(tmpPath + "-shm")
+	}
+	for _, journal := range []struct{ path, suffix, effect string }{
+		{sc.WAL, "-wal", "committed transactions in the WAL file are not part of the dump"},
+		{sc.Journal, "-journal", "an interrupted transaction may be partially contained in the dump"},
+	} {
+		if journal.path == "" {
+			continue
+		}
+		if policy != SidecarFold {
+			warnings.Emit(warnings.JournalNotFolded, "%s exists: %s (use -sidecars fold to include it)", journal.path, journal.effect)
+			continue
+		}
+		if err := copyFile(journal.path, tmpPath+journal.suffix); err != nil {
+			cleanup()
+			return noop, fmt.Errorf("failed to fold %s into snapshot: %w", journal.path, err)
+		}
+		copied = append(copied, tmpPath+journal.suffix)
+		slog.Info("Folded journal file into snapshot", "journal", journal.path)
+	}
+	return cleanup, nil
+}
+
+// snapshotJournaled returns the path to dump the database at dbPath from. If
+// journal files lie next to it, typically because it is in WAL mode and open
+// in an application, and policy is SidecarFold, the database is copied to a
+// temporary snapshot, the journals are folded in and the WAL is checkpointed,
+// so that the dump sees one consistent state and the database and its -shm
+// file are never written. Otherwise dbPath is returned and read in place,
+// which sqlite3 does including the WAL. The returned function removes the
+// snapshot.
+func snapshotJournaled(ctx context.Context, eng *sqlite.Engine, dbPath, policy string) (string, func(), error) {
+	noop := func() {}
+	if sc := FindSidecars(dbPath); policy != SidecarFold || sc.WAL == "" && sc.Journal == "" {
+		return dbPath, noop, nil
+	}
+
+	tmp, err := os.CreateTemp("", "gitsqlite-*.db")
+	if err != nil {
+		return "", noop, err
+	}
+	_ = tmp.Close()
+	removeTmp := shutdown.Remove(tmp.Name())
+	remove := removeTmp
+	if err := copyFile(dbPath, tmp.Name()); err != nil {
+		remove()
+		return "", noop, fmt.Errorf("failed to snapshot %s: %w", dbPath, err)
+	}
+	removeSidecars, err := applySidecars(dbPath, tmp.Name(), policy)
+	if err != nil {
+		remove()
+		return "", noop, err
+	}
+	remove = func() {
+		removeSidecars()
+		removeTmp()
+	}
+	// Switching to rollback mode applies the WAL; opening the snapshot rolls
+	// back a hot journal
+	if err := eng.SetJournalMode(ctx, tmp.Name(), sqlite.JournalDelete); err != nil {
+		remove()
+		return "", noop, err
+	}
+	slog.Info("Dumping a snapshot with the journal files folded in", "database", dbPath, "snapshot", tmp.Name())
+	return tmp.Name(), remove, nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,211 @@
+package filters
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/danielsiegl/gitsqlite/internal/hash"
+)
+
+// SinkManifest is the format of a sink describing the dump instead of
+// holding it (see manifest).
+const SinkManifest = "manifest"
+
+// Sink is a file clean writes besides its output, in the same pass over the
+// database: the dump in another data format, or a manifest.
+type Sink struct {
+	// Format is DataFormatSQL, DataFormatJSONL or SinkManifest.
+	Format string
+	// Path is the file written; it is replaced only if clean succeeds.
+	Path string
+}
+
+// ParseSinks parses a comma-separated list of format=path items (-sinks).
+func ParseSinks(list string) ([]Sink, error) {
+	var sinks []Sink
+	seen := map[string]bool{}
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		format, path, ok := strings.Cut(item, "=")
+		format, path = strings.TrimSpace(format), strings.TrimSpace(path)
+		if !ok || format == "" || path == "" {
+			return nil, fmt.Errorf("sink %q: expected format=path", item)
+		}
+		if format != DataFormatSQL && format != DataFormatJSONL && format != SinkManifest {
+			return nil, fmt.Errorf("sink %q: unknown format %s (expected sql, jsonl or manifest)", item, format)
+		}
+		if seen[path] {
+			return nil, fmt.Errorf("sink %q: %s is written twice", item, path)
+		}
+		seen[path] = true
+		sinks = append(sinks, Sink{Format: format, Path: path})
+	}
+	return sinks, nil
+}
+
+// sinkSet writes the dump to the sinks of a clean run. Its methods do
+// nothing on a nil set.
+type sinkSet struct {
+	dumps     []*sinkDump
+	manifests []*stagedFile
+	// rows counts the rows of the user tables dumped, for the manifest.
+	rows map[string]int
+}
+
+// sinkDump is a sink receiving the dump.
+type sinkDump struct {
+	Sink
+	file *stagedFile
+	buf  *bufio.Writer
+	hash *hash.HashWriter
+}
+
+// openSinks starts writing the files of sinks; the set is nil without any.
+// Every file is discarded by discard unless publish succeeded.
+func openSinks(sinks []Sink) (*sinkSet, error) {
+	if len(sinks) == 0 {
+		return nil, nil
+	}
+	s := &sinkSet{}
+	for _, sink := range sinks {
+		f, err := stageFile(sink.Path)
+		if err != nil {
+			s.discard()
+			return nil, err
+		}
+		if sink.Format == SinkManifest {
+			s.manifests = append(s.manifests, f)
+			continue
+		}
+		buf := bufio.NewWriter(f)
+		s.dumps = append(s.dumps, &sinkDump{Sink: sink, file: f, buf: buf, hash: hash.NewHashWriter(buf)})
+	}
+	return s, nil
+}
+
+// write writes text, a part of the dump that is the same in every format, to
+// the dumps.
+func (s *sinkSet) write(text string) error {
+	if s == nil {
+		return nil
+	}
+	for _, d := range s.dumps {
+		if _, err := d.hash.Write([]byte(text)); err != nil {
+			return fmt.Errorf("writing %s: %w", d.Path, err)
+		}
+	}
+	return nil
+}
+
+// writeLine writes a line of the dump, as SQL, to the dumps; single-line
+// statements are rows JSON lines sinks convert.
+func (s *sinkSet) writeLine(line string, single bool, tables TableMap) error {
+	if s == nil {
+		return nil
+	}
+	var jsonLine string
+	for _, d := range s.dumps {
+		text := line
+		if d.Format == DataFormatJSONL && single {
+			if jsonLine == "" {
+				jsonLine = rowsToJSON(line, tables)
+			}
+			text = jsonLine
+		}
+		if _, err := d.hash.Write([]byte(text + "\n")); err != nil {
+			return fmt.Errorf("writing %s: %w", d.Path, err)
+		}
+	}
+	return nil
+}
+
+// sinkOutput describes an output of the run in the manifest.
+type sinkOutput struct {
+	Path   string `json:"path"`
+	Format string `json:"format"`
+	// Hash is the hash the trailer of the output records, "" if it has none.
+	Hash string `json:"sha256,omitempty"`
+}
+
+// manifest describes the dump of a clean run and the outputs written.
+type manifest struct {
+	Source        string       `json:"source,omitempty"`
+	FormatVersion int          `json:"format_version"`
+	Tables        []tableRows  `json:"tables"`
+	Outputs       []sinkOutput `json:"outputs"`
+}
+
+// tableRows is the number of rows of a table dumped.
+type tableRows struct {
+	Name string `json:"name"`
+	Rows int    `json:"rows"`
+}
+
+// publish ends the dumps with their hash trailer unless noHash is set,
+// writes the manifests describing them and primary, the output of clean,
+// and puts all files in place.
+func (s *sinkSet) publish(opts Options, primary sinkOutput, noHash bool) error {
+	if s == nil {
+		return nil
+	}
+	m := manifest{Source: opts.SourcePath, FormatVersion: opts.formatVersion(), Tables: []tableRows{}, Outputs: []sinkOutput{primary}}
+	for name, n := range s.rows {
+		if !strings.HasPrefix(strings.ToLower(name), "sqlite_") {
+			m.Tables = append(m.Tables, tableRows{Name: name, Rows: n})
+		}
+	}
+	sort.Slice(m.Tables, func(i, j int) bool { return m.Tables[i].Name < m.Tables[j].Name })
+	for _, d := range s.dumps {
+		output := sinkOutput{Path: d.Path, Format: d.Format}
+		if !noHash {
+			output.Hash = d.hash.GetHash()
+			if _, err := d.buf.WriteString(d.hash.GetHashComment()); err != nil {
+				return fmt.Errorf("writing %s: %w", d.Path, err)
+			}
+		}
+		if err := d.buf.Flush(); err != nil {
+			return fmt.Errorf("writing %s: %w", d.Path, err)
+		}
+		m.Outputs = append(m.Outputs, output)
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	for _, f := range s.manifests {
+		if _, err := f.Write(append(data, '\n')); err != nil {
+			return fmt.Errorf("writing %s: %w", f.path, err)
+		}
+	}
+	for _, d := range s.dumps {
+		if err := d.file.publish(); err != nil {
+			return fmt.Errorf("saving %s: %w", d.Path, err)
+		}
+	}
+	for _, f := range s.manifests {
+		if err := f.publish(); err != nil {
+			return fmt.Errorf("saving %s: %w", f.path, err)
+		}
+	}
+	return nil
+}
+
+// discard removes the files not published; it is deferred right after
+// openSinks.
+func (s *sinkSet) discard() {
+	if s == nil {
+		return
+	}
+	for _, d := range s.dumps {
+		d.file.discard()
+	}
+	for _, f := range s.manifests {
+		f.discard()
+	}
+}
@@ -6,35 +6,83 @@ import (
 	"io"
 	"log/slog"
 	"os"
+	"path/filepath"
 	"time"
 
+	"github.com/danielsiegl/gitsqlite/internal/backup"
+	"github.com/danielsiegl/gitsqlite/internal/compression"
 	"github.com/danielsiegl/gitsqlite/internal/hash"
 	"github.com/danielsiegl/gitsqlite/internal/logging"
+	"github.com/danielsiegl/gitsqlite/internal/shutdown"
 	"github.com/danielsiegl/gitsqlite/internal/sqlite"
+	"github.com/danielsiegl/gitsqlite/internal/stats"
+	"github.com/danielsiegl/gitsqlite/internal/warnings"
 )
 
 // Smudge reads SQL from 'in', restores into a temporary SQLite DB using the engine,
 // then streams the resulting DB bytes to 'out'.
-// If schemaFile is not empty and the file exists, schema is read from that file
+// If opts.SchemaFile is not empty and the file exists, schema is read from that file
 // and combined with data from 'in'.
-// If enforceHash is true, hash verification failures cause the operation to fail.
-// If enforceHash is false, hash verification status is logged but operation continues.
-func Smudge(ctx context.Context, eng *sqlite.Engine, in io.Reader, out io.Writer, schemaFile string, enforceHash bool) error {
+// If opts.EnforceHash is true, hash verification failures cause the operation to fail.
+// If opts.EnforceHash is false, hash verification status is logged but operation continues.
+// If opts.TargetPath names an existing database, its rows excluded from
+// versioning by opts.Subset and its opts.LocalTables are merged into the result,
+// and it is backed up to opts.Backups before being replaced.
+// If opts.Output is set, the database is written to that file instead of 'out'.
+// If opts.Jobs > 1, large dumps are restored in parallel; see restoreParallel.
+// Dumps written by other tools are accepted; see NormalizeDialect. Dumps
+// compressed by clean -compress are decompressed, and BLOB pointers written by
+// clean -blob-threshold are resolved from opts.BlobDir, and JSON rows written
+// by clean -format jsonl are turned back into INSERTs. Collations are renamed
+// as opts.Collations says, and a dump using collations SQLite does not
+// provide fails before they are used (see collationCheck). Database settings
+// recorded as pragma comments are applied first. The database is written in
+// opts.JournalMode. With opts.TableCache and opts.Output, only the tables that
+// changed since the last smudge of the output file are restored.
+func Smudge(ctx context.Context, eng *sqlite.Engine, in io.Reader, out io.Writer, opts SmudgeOptions) error {
 	startTime := time.Now()
 	slog.Info("Starting smudge operation")
 
-	tmp, err := os.CreateTemp("", "gitsqlite-*.db")
+	// With -output the database is restored next to the output file, so that
+	// it replaces the output by renaming instead of copying
+	tmpDir, tmpPattern := "", "gitsqlite-*.db"
+	if opts.Output != "" {
+		tmpDir, tmpPattern = filepath.Dir(opts.Output), ".gitsqlite-*.db"
+	}
+	if err := checkFreeSpace(tmpDir, opts.InputSize, "restoring the database"); err != nil {
+		slog.Error("Disk space preflight failed", "error", err)
+		return err
+	}
+	tmp, err := os.CreateTemp(tmpDir, tmpPattern)
 	if err != nil {
 		slog.Error("Failed to create temp file", "error", err)
 		return err
 	}
 	tmpPath := tmp.Name()
 	_ = tmp.Close()
-	defer os.Remove(tmpPath)
+	defer shutdown.Remove(tmpPath)()
+	// A sqlite3 killed during the restore leaves its rollback journal behind,
+	// one killed while switching to WAL mode its -wal and -shm files
+	defer shutdown.Remove(tmpPath + "-journal")()
+	defer shutdown.Remove(tmpPath + "-wal")()
+	defer shutdown.Remove(tmpPath + "-shm")()
+
+	in, format, err := compression.NewReader(in, opts.DictDir)
+	if err != nil {
+		slog.Error("Failed to read compressed input", "error", err)
+		return err
+	}
+	if format != "" {
+		slog.Info("Decompressing input", "format", format)
+	}
 
 	restoreStart := time.Now()
+	schemaFile := opts.SchemaFile
+	enforceHash := opts.EnforceHash
 
 	var verifiedDataReader io.Reader
+	var hashes *tableHashes
+	updated := false
 
 	// Verify hash from stdin data and strip it
 	if enforceHash {
@@ -60,6 +108,33 @@ func Smudge(ctx context.Context, eng *sqlite.Engine, in io.Reader, out io.Writer
 		}
 	}
 
+	// Apply the database settings recorded by clean before anything is restored
+	pragmas, verifiedDataReader, err := peekPragmas(verifiedDataReader)
+	if err != nil {
+		slog.Error("Invalid database settings in dump", "error", err)
+		return err
+	}
+	if err := applyPragmas(ctx, eng, tmpPath, pragmas); err != nil {
+		slog.Error("Failed to apply database settings", "error", err)
+		return err
+	}
+	// Rows written by clean -format jsonl
+	verifiedDataReader = ExpandJSONRows(verifiedDataReader)
+	// The SQL restored: BLOB pointers resolved, other dialects and
+	// collations mapped. A restore failing early leaves the input partly
+	// read; it is not read any more once Smudge returned
+	var prepared io.Closer
+	defer func() {
+		if prepared != nil {
+			prepared.Close()
+		}
+	}()
+	prepare := func(r io.Reader) io.Reader {
+		sql := normalizeDialect(ResolveBlobs(r, opts.BlobDir), newCollationCheck(ctx, eng, opts.Collations))
+		prepared = sql
+		return sql
+	}
+
 	// If schema file is specified and exists, combine schema + data
 	if schemaFile != "" {
 		if _, err := os.Stat(schemaFile); err == nil {
@@ -101,9 +176,9 @@ func Smudge(ctx context.Context, eng *sqlite.Engine, in io.Reader, out io.Writer
 			}
 
 			// Combine verified schema and data streams
-			combinedReader := io.MultiReader(verifiedSchemaReader, verifiedDataReader)
+			combinedReader := prepare(io.MultiReader(verifiedSchemaReader, verifiedDataReader))
 
-			if err := eng.Restore(ctx, tmpPath, combinedReader); err != nil {
+			if err := restore(ctx, eng, tmpPath, combinedReader, opts.Jobs); err != nil {
 				slog.Error("SQLite restore with schema file failed", "error", err, "duration", logging.FormatDuration(time.Since(restoreStart)))
 				return err
 			}
@@ -111,35 +186,90 @@ func Smudge(ctx context.Context, eng *sqlite.Engine, in io.Reader, out io.Writer
 			slog.Error("Schema file specified but not found", "schemaFile", schemaFile)
 			return fmt.Errorf("schema file not found: %s", schemaFile)
 		}
+	} else if opts.TableCache != nil && opts.Output != "" && len(opts.Subset) == 0 {
+		// Restore only the tables that changed since the output was written
+		hashes, updated, err = restoreIncremental(ctx, eng, tmpPath, prepare(verifiedDataReader), pragmas, opts)
+		if err != nil {
+			slog.Error("SQLite incremental restore failed", "error", err, "duration", logging.FormatDuration(time.Since(restoreStart)))
+			return err
+		}
 	} else {
 		// Normal restore without schema file - use verified data
-		if err := eng.Restore(ctx, tmpPath, verifiedDataReader); err != nil {
+		if err := restore(ctx, eng, tmpPath, prepare(verifiedDataReader), opts.Jobs); err != nil {
 			slog.Error("SQLite restore failed", "error", err, "duration", logging.FormatDuration(time.Since(restoreStart)))
 			return err
 		}
 	}
 	restoreDuration := time.Since(restoreStart)
 	slog.Info("SQLite restore completed", "duration", logging.FormatDuration(restoreDuration))
+	opts.Summary.Stage("restore", restoreDuration)
 
-	copyStart := time.Now()
-	f, err := os.Open(tmpPath)
-	if err != nil {
-		slog.Error("Failed to open restored database", "error", err)
-		return err
+	// Keep the local rows and tables of the worktree database that are not
+	// versioned; an updated copy of it still has them. Local state never
+	// blocks a checkout, so failures are warnings.
+	if opts.TargetPath != "" && !updated && sqlite.IsDatabaseFile(opts.TargetPath) {
+		if len(opts.Subset) > 0 {
+			if err := mergeLocalRows(ctx, eng, tmpPath, opts.TargetPath, opts.Subset); err != nil {
+				warnings.Emit(warnings.LocalMergeFailed, "cannot keep the local rows of %s: %v", opts.TargetPath, err)
+			}
+		}
+		if len(opts.LocalTables) > 0 {
+			if err := copyLocalTables(ctx, eng, tmpPath, opts.TargetPath, opts.LocalTables); err != nil {
+				warnings.Emit(warnings.LocalMergeFailed, "cannot keep the local tables of %s: %v", opts.TargetPath, err)
+			}
+		}
 	}
-	defer f.Close()
 
-	// Read the entire database into memory for chunked writing
-	dbData, err := io.ReadAll(f)
-	if err != nil {
-		slog.Error("Failed to read restored database", "error", err)
-		return err
+	if opts.JournalMode == sqlite.JournalWAL {
+		if err := eng.SetJournalMode(ctx, tmpPath, opts.JournalMode); err != nil {
+			slog.Error("Failed to set journal mode", "journal_mode", opts.JournalMode, "error", err)
+			return err
+		}
+		slog.Info("Database written in WAL mode")
+	}
+
+	if opts.Summary != nil {
+		if db, err := stats.Collect(ctx, eng, tmpPath, stats.Options{RowsOnly: true}); err == nil {
+			for _, t := range db.Tables {
+				opts.Summary.Rows(t.Rows)
+			}
+		}
 	}
 
-	// Use chunked writing with timeout protection for smudge output
-	err = eng.WriteWithTimeoutAndChunking(out, dbData, "smudge")
+	copyStart := time.Now()
+
+	// Phase 1: snapshot the database about to be replaced, unless nothing changes.
+	// git itself removes the worktree file before running the filter, so this
+	// mostly applies to -output; there a failed backup aborts the replacement.
+	if opts.Backups != nil && opts.TargetPath != "" && sqlite.IsDatabaseFile(opts.TargetPath) {
+		if err := backupTarget(opts, tmpPath); err != nil {
+			if opts.Output != "" {
+				slog.Error("Backup failed, database not replaced", "path", opts.TargetPath, "error", err)
+				return fmt.Errorf("backup of %s failed, database not replaced: %w", opts.TargetPath, err)
+			}
+			warnings.Emit(warnings.BackupFailed, "cannot back up %s: %v", opts.TargetPath, err)
+		}
+	}
+
+	// Phase 2: replace the output file atomically, or copy to 'out' without
+	// reading the database into memory
+	if opts.Output != "" {
+		size := fileSize(tmpPath)
+		err = os.Rename(tmpPath, opts.Output)
+		if err == nil {
+			opts.Summary.Output(size)
+		}
+		if err == nil && hashes != nil {
+			if cerr := opts.TableCache.save(opts.Output, hashes); cerr != nil {
+				slog.Warn("Failed to store table hashes", "path", opts.Output, "error", cerr)
+			}
+		}
+	} else {
+		err = copyDatabase(eng, tmpPath, out)
+	}
 	copyDuration := time.Since(copyStart)
 	totalDuration := time.Since(startTime)
+	opts.Summary.Stage("copy", copyDuration)
 
 	if err != nil {
 		slog.Error("Smudge operation failed", "error", err, "totalDuration", logging.FormatDuration(totalDuration))
@@ -152,3 +282,48 @@ func Smudge(ctx context.Context, eng *sqlite.Engine, in io.Reader, out io.Writer
 
 	return err
 }
+
+// restore restores a dump into dbPath, in parallel if jobs > 1.
+func restore(ctx context.Context, eng *sqlite.Engine, dbPath string, sql io.Reader, jobs int) error {
+	if jobs > 1 {
+		return restoreParallel(ctx, eng, dbPath, sql, jobs)
+	}
+	return eng.Restore(ctx, dbPath, sql)
+}
+
+// backupTarget saves the current worktree database if it differs from the
+// restored one. Both are compared and copied block by block, so databases
+// larger than the available memory can be backed up.
+func backupTarget(opts SmudgeOptions, restoredPath string) error {
+	same, err := backup.SameContents(restoredPath, opts.TargetPath)
+	if err != nil {
+		return err
+	}
+	if same {
+		return nil
+	}
+	snapshot, err := opts.Backups.Save(opts.TargetPath, opts.BackupKeep)
+	if err != nil {
+		return err
+	}
+	if snapshot != "" {
+		slog.Info("Backed up worktree database", "path", opts.TargetPath, "snapshot", snapshot)
+	}
+	return nil
+}
+
+// copyDatabase copies the database at path to out.
+func copyDatabase(eng *sqlite.Engine, path string, out io.Writer) error {
+	f, err := os.Open(path)
+	if err != nil {
+		slog.Error("Failed to open restored database", "error", err)
+		return err
+	}
+	defer f.Close()
+	n, err := eng.CopyWithTimeout(out, f, "smudge")
+	if err != nil {
+		return err
+	}
+	slog.Debug("Wrote database", "size_bytes", n)
+	return nil
+}
@@ -0,0 +1,192 @@
+package filters
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/danielsiegl/gitsqlite/internal/compression"
+	"github.com/danielsiegl/gitsqlite/internal/hash"
+)
+
+// SplitCheck is the result of comparing a data-only dump with the schema
+// file clean wrote next to it (-schema-file).
+type SplitCheck struct {
+	// LinkedHash is the hash of the schema file recorded in the data, ""
+	// if the data was written before clean recorded it.
+	LinkedHash string
+	// SchemaHash is the hash in the trailer of the schema file, "" if it
+	// has none.
+	SchemaHash string
+	// SchemaModified is set if the schema file does not match its trailer.
+	SchemaModified bool
+	// SchemaStatements is the number of schema statements in the data,
+	// which a dump written with a schema file has none of.
+	SchemaStatements int
+	// MissingTables are the tables with rows in the data but no CREATE
+	// TABLE in the schema file.
+	MissingTables []string
+	// ColumnMismatches describe the tables whose rows do not fit the
+	// columns the schema file declares.
+	ColumnMismatches []string
+}
+
+// Problems describes what does not match, one sentence each; none if the
+// data and the schema file belong together. A missing link is not one of
+// them: see Unlinked.
+func (c *SplitCheck) Problems() []string {
+	var problems []string
+	if c.SchemaStatements > 0 {
+		problems = append(problems, fmt.Sprintf("the data holds %d schema statement(s); it was not cleaned with the schema file", c.SchemaStatements))
+	}
+	if c.SchemaModified {
+		problems = append(problems, "the schema file does not match its hash line; it was edited after clean wrote it")
+	}
+	if c.LinkedHash != "" && c.LinkedHash != c.SchemaHash {
+		found := "none"
+		if c.SchemaHash != "" {
+			found = abbreviate(c.SchemaHash)
+		}
+		problems = append(problems, fmt.Sprintf("the data was written with another schema file (schema hash %s, the file has %s)", abbreviate(c.LinkedHash), found))
+	}
+	if len(c.MissingTables) > 0 {
+		problems = append(problems, "tables with rows missing from the schema file: "+strings.Join(c.MissingTables, ", "))
+	}
+	problems = append(problems, c.ColumnMismatches...)
+	return problems
+}
+
+// Unlinked reports whether the data records no schema hash, so only its
+// tables could be compared with the schema file.
+func (c *SplitCheck) Unlinked() bool {
+	return c.LinkedHash == "" && c.SchemaStatements == 0
+}
+
+// CheckSplit compares the data-only dump read from data, as clean writes it
+// to git (it may be compressed, with the dictionaries in dictDir, or have
+// JSON rows), with the schema file read from schema: the schema hash the data
+// records, and that every table with rows is declared in the schema with
+// columns that fit the first row.
+func CheckSplit(data, schema io.Reader, dictDir string) (*SplitCheck, error) {
+	c := &SplitCheck{}
+	content, err := io.ReadAll(schema)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema file: %w", err)
+	}
+	text := strings.TrimRight(string(content), "\r\n")
+	if i := strings.LastIndexByte(text, '\n'); strings.HasPrefix(text[i+1:], hash.HashPrefix) {
+		c.SchemaHash = strings.TrimSpace(strings.TrimPrefix(text[i+1:], hash.HashPrefix))
+		_, result := hash.VerifyHashOptional(strings.NewReader(string(content)))
+		c.SchemaModified = !result.Valid
+	}
+	tables, err := schemaTables(strings.NewReader(string(content)))
+	if err != nil {
+		return nil, err
+	}
+
+	data, _, err = compression.NewReader(data, dictDir)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	missing := map[string]bool{}
+	scanner := NewStatementScanner(ExpandJSONRows(data))
+	for scanner.Scan() {
+		stmt := strings.TrimSpace(scanner.Text())
+		if ClassifyStatement(stmt) == StatementSchema {
+			c.SchemaStatements++
+			continue
+		}
+		for _, line := range strings.Split(stmt, "\n") {
+			if rest, ok := strings.CutPrefix(line, hash.SchemaPrefix); ok {
+				c.LinkedHash = strings.TrimSpace(rest)
+			}
+		}
+		name := InsertTableName(stmt)
+		// Virtual tables are registered in sqlite_schema by the data
+		if name == "" || seen[strings.ToLower(name)] || isInternalTable(name) || isSchemaTable(name) {
+			continue
+		}
+		seen[strings.ToLower(name)] = true
+		table := tables[strings.ToLower(name)]
+		if table == nil {
+			missing[name] = true
+			continue
+		}
+		if mismatch := rowMismatch(stmt, table); mismatch != "" {
+			c.ColumnMismatches = append(c.ColumnMismatches, mismatch)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	for name := range missing {
+		c.MissingTables = append(c.MissingTables, name)
+	}
+	sort.Strings(c.MissingTables)
+	return c, nil
+}
+
+// schemaTables returns the tables the schema read from r declares, by lower
+// case name. Unlike TableMap it unquotes names written as string literals,
+// as .dump writes those of the shadow tables of virtual tables.
+func schemaTables(r io.Reader) (map[string]*TableInfo, error) {
+	tables := map[string]*TableInfo{}
+	scanner := NewStatementScanner(r)
+	for scanner.Scan() {
+		stmt := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(stmt, "CREATE TABLE") {
+			continue
+		}
+		ct, err := ParseCreateTable(stmt)
+		if err != nil {
+			continue
+		}
+		info := ct.Info()
+		if name := info.Name; len(name) >= 2 && name[0] == '\'' && name[len(name)-1] == '\'' {
+			info.Name = strings.ReplaceAll(name[1:len(name)-1], "''", "'")
+		}
+		tables[strings.ToLower(info.Name)] = info
+	}
+	return tables, scanner.Err()
+}
+
+// rowMismatch describes how the first row of the INSERT statement stmt does
+// not fit the columns of table, "" if it does.
+func rowMismatch(stmt string, table *TableInfo) string {
+	ins, err := ParseInsert(stmt)
+	if err != nil || len(ins.Rows) == 0 {
+		return ""
+	}
+	if len(ins.Columns) == 0 {
+		if values := len(ins.Rows[0]); values != len(table.Columns) {
+			return fmt.Sprintf("rows of %s have %d values, the schema file declares %d columns", table.Name, values, len(table.Columns))
+		}
+		return ""
+	}
+	for _, column := range ins.Columns {
+		if !hasColumn(table, column) {
+			return fmt.Sprintf("rows of %s set column %s, which the schema file does not declare", table.Name, column)
+		}
+	}
+	return ""
+}
+
+// hasColumn reports whether table has the named column.
+func hasColumn(table *TableInfo, name string) bool {
+	for _, column := range table.Columns {
+		if strings.EqualFold(column, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// abbreviate shortens a hash for messages.
+func abbreviate(sum string) string {
+	if len(sum) > 12 {
+		return sum[:12]
+	}
+	return sum
+}
@@ -0,0 +1,66 @@
+package filters
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	"github.com/danielsiegl/gitsqlite/internal/shutdown"
+)
+
+// stagedFile is a file written under a temporary name next to its final path
+// and renamed to it by publish once the whole operation succeeded. Readers
+// never see it half written, and a failed operation leaves the previous
+// version in place.
+type stagedFile struct {
+	*os.File
+	path   string
+	remove func()
+	done   bool
+}
+
+// stageFile starts writing the file at path. It gets the mode of the file it
+// replaces, or 0644.
+func stageFile(path string) (*stagedFile, error) {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return nil, err
+	}
+	s := &stagedFile{File: f, path: path, remove: shutdown.Remove(f.Name())}
+	mode := os.FileMode(0o644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode().Perm()
+	}
+	if err := f.Chmod(mode); err != nil && !errors.Is(err, errors.ErrUnsupported) {
+		s.discard()
+		return nil, err
+	}
+	return s, nil
+}
+
+// publish closes the file and renames it to its final path.
+func (s *stagedFile) publish() error {
+	err := s.Close()
+	if err == nil {
+		err = os.Rename(s.Name(), s.path)
+	}
+	if err != nil {
+		s.discard()
+		return err
+	}
+	s.done = true
+	// Only unregisters the removal: the temporary name is gone
+	s.remove()
+	return nil
+}
+
+// discard removes the file unless it was published; it is deferred right
+// after stageFile.
+func (s *stagedFile) discard() {
+	if s.done {
+		return
+	}
+	s.done = true
+	s.Close()
+	s.remove()
+}
@@ -0,0 +1,161 @@
+package filters
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/danielsiegl/gitsqlite/internal/sqlite"
+)
+
+// DefaultSubsetFile is the default name of the row subset configuration.
+const DefaultSubsetFile = ".gitsqlitesubset"
+
+// SubsetRule restricts the versioned rows of a table to those matching Where.
+type SubsetRule struct {
+	Table string
+	Where string
+}
+
+// condition returns an expression that is 1 for rows matching the rule and 0
+// otherwise (including when Where evaluates to NULL).
+func (r SubsetRule) condition() string {
+	return "CASE WHEN (" + r.Where + ") THEN 1 ELSE 0 END"
+}
+
+// ParseSubset reads subset rules, one per line in the form
+//
+//	table: condition
+//
+// where condition is an SQL expression as used in a WHERE clause. Empty lines
+// and lines starting with # are ignored.
+func ParseSubset(r io.Reader) ([]SubsetRule, error) {
+	var rules []SubsetRule
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		table, where, ok := strings.Cut(line, ":")
+		table = UnquoteIdent(strings.TrimSpace(table))
+		where = strings.TrimSpace(where)
+		if !ok || table == "" || where == "" {
+			return nil, fmt.Errorf("line %d: expected 'table: condition'", lineNo)
+		}
+		if seen[strings.ToLower(table)] {
+			return nil, fmt.Errorf("line %d: duplicate rule for table %s", lineNo, table)
+		}
+		seen[strings.ToLower(table)] = true
+		rules = append(rules, SubsetRule{Table: table, Where: where})
+	}
+	return rules, scanner.Err()
+}
+
+// LoadSubset reads subset rules from a file.
+func LoadSubset(path string) ([]SubsetRule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rules, err := ParseSubset(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return rules, nil
+}
+
+// tableNames returns the lower-case names of all tables in the database.
+func tableNames(ctx context.Context, eng *sqlite.Engine, dbPath string) (map[string]bool, error) {
+	rows, err := eng.Query(ctx, dbPath, "SELECT name FROM sqlite_schema WHERE type='table';")
+	if err != nil {
+		return nil, err
+	}
+	names := map[string]bool{}
+	for _, row := range rows {
+		if len(row) > 0 {
+			names[strings.ToLower(row[0])] = true
+		}
+	}
+	return names, nil
+}
+
+// tableColumns returns the column names of a table in declaration order.
+func tableColumns(ctx context.Context, eng *sqlite.Engine, dbPath, schema, table string) ([]string, error) {
+	rows, err := eng.Query(ctx, dbPath, fmt.Sprintf("SELECT name FROM %s.pragma_table_info(%s);",
+		sqlite.QuoteIdent(schema), sqlite.QuoteLiteral(table)))
+	if err != nil {
+		return nil, err
+	}
+	columns := make([]string, 0, len(rows))
+	for _, row := range rows {
+		if len(row) > 0 {
+			columns = append(columns, row[0])
+		}
+	}
+	return columns, nil
+}
+
+// quotedColumnList joins quoted column names for use in INSERT and SELECT.
+func quotedColumnList(columns []string) string {
+	quoted := make([]string, len(columns))
+	for i, c := range columns {
+		quoted[i] = sqlite.QuoteIdent(c)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// localColumnList joins the column names qualified by local_db.table for
+// a SELECT from the local database. SQLite takes an unqualified quoted name
+// that matches no column for a string, so a column missing from the local
+// table would otherwise be filled with its name instead of failing.
+func localColumnList(table string, columns []string) string {
+	quoted := make([]string, len(columns))
+	for i, c := range columns {
+		quoted[i] = "local_db." + sqlite.QuoteIdent(table) + "." + sqlite.QuoteIdent(c)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// mergeLocalRows copies the rows of the local database that subset rules
+// exclude from versioning into the freshly restored database, so smudge keeps
+// user data while replacing the versioned rows. Tables that cannot be merged
+// (e.g. missing columns in the local copy) are skipped, and their errors
+// returned together.
+func mergeLocalRows(ctx context.Context, eng *sqlite.Engine, restoredPath, localPath string, rules []SubsetRule) error {
+	restored, err := tableNames(ctx, eng, restoredPath)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, rule := range rules {
+		if !restored[strings.ToLower(rule.Table)] {
+			continue
+		}
+		columns, err := tableColumns(ctx, eng, restoredPath, "main", rule.Table)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("table %s: %w", rule.Table, err))
+			continue
+		}
+		list := quotedColumnList(columns)
+		query := fmt.Sprintf("ATTACH DATABASE %s AS local_db; "+
+			"INSERT OR IGNORE INTO main.%s (%s) SELECT %s FROM local_db.%s WHERE NOT (%s);",
+			sqlite.QuoteLiteral(localPath),
+			sqlite.QuoteIdent(rule.Table), list, localColumnList(rule.Table, columns), sqlite.QuoteIdent(rule.Table), rule.condition())
+		if _, err := eng.Query(ctx, restoredPath, query); err != nil {
+			errs = append(errs, fmt.Errorf("table %s: %w", rule.Table, err))
+			continue
+		}
+		slog.Info("Merged local rows", "table", rule.Table, "localPath", localPath)
+	}
+	return errors.Join(errs...)
+}
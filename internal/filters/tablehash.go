@@ -0,0 +1,198 @@
+package filters
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	gohash "hash"
+	"io"
+	"strings"
+
+	"github.com/danielsiegl/gitsqlite/internal/compression"
+	"github.com/danielsiegl/gitsqlite/internal/hash"
+)
+
+// tableHashPart returns the table whose hash covers the statement stmt, as
+// written to the dump: the table a CREATE TABLE creates or an INSERT fills,
+// "" for all other statements.
+func tableHashPart(stmt string) string {
+	if kind, name := schemaObjectName(stmt); kind == "table" {
+		return name
+	}
+	return InsertTableName(stmt)
+}
+
+// addTableHashes adds the lines written for a statement to the hash of its
+// table, as VerifyDumpHashes reads them: rows written by DataFormatJSONL are
+// hashed as the INSERT statements they expand to.
+func addTableHashes(h *hash.TableHasher, written []string) {
+	var sql []string
+	add := func(stmt string) {
+		stmt = stripLeadingComments(stmt)
+		if part := tableHashPart(stmt); part != "" {
+			h.Add(part, stmt+"\n")
+		}
+	}
+	for _, text := range written {
+		for _, line := range strings.Split(text, "\n") {
+			if len(sql) == 0 && strings.HasPrefix(line, "{") {
+				if stmt, err := jsonToInsert(line); err == nil {
+					add(stmt)
+					continue
+				}
+			}
+			sql = append(sql, line)
+		}
+	}
+	if len(sql) > 0 {
+		add(strings.Join(sql, "\n"))
+	}
+}
+
+// HashCheck compares a hash recorded in a dump with the one of its content.
+type HashCheck struct {
+	// Name is the table, or "" for the whole file.
+	Name string `json:"name,omitempty"`
+	// Expected is the recorded hash, "" if there is none.
+	Expected string `json:"expected"`
+	// Actual is the hash of the content, "" if the dump has no statements
+	// of the table.
+	Actual string `json:"actual"`
+}
+
+// OK reports whether the recorded hash matches the content.
+func (c HashCheck) OK() bool {
+	return c.Expected != "" && c.Expected == c.Actual
+}
+
+// DumpHashes is the result of VerifyDumpHashes.
+type DumpHashes struct {
+	// File checks the hash of the whole dump; nil if only some tables were
+	// verified.
+	File *HashCheck `json:"file,omitempty"`
+	// Tables checks the hashes of single tables (clean -table-hashes), in
+	// the order of the dump.
+	Tables []HashCheck `json:"tables"`
+}
+
+// OK reports whether every hash checked matches.
+func (d *DumpHashes) OK() bool {
+	if d.File != nil && !d.File.OK() {
+		return false
+	}
+	for _, t := range d.Tables {
+		if !t.OK() {
+			return false
+		}
+	}
+	return true
+}
+
+// VerifyDumpHashes reads the dump from r, compressed or not (with the
+// dictionaries in dictDir), and compares the hashes it records with its
+// content. With tables, only the hashes of these tables are checked, and the
+// hash of the whole file is not; otherwise all of them are. The dump is
+// streamed, so its size does not matter.
+func VerifyDumpHashes(r io.Reader, tables []string, dictDir string) (*DumpHashes, error) {
+	r, _, err := compression.NewReader(r, dictDir)
+	if err != nil {
+		return nil, err
+	}
+	selected := map[string]bool{}
+	for _, t := range tables {
+		selected[strings.ToLower(t)] = true
+	}
+	lines := &trailerHasher{hash: sha256.New()}
+	actual := hash.NewTableHasher()
+	scanner := NewStatementScanner(ExpandJSONRows(io.TeeReader(r, lines)))
+	for scanner.Scan() {
+		stmt := stripLeadingComments(scanner.Text())
+		if ClassifyStatement(stmt) == StatementEmpty {
+			continue
+		}
+		if part := tableHashPart(stmt); part != "" && (len(selected) == 0 || selected[strings.ToLower(part)]) {
+			actual.Add(part, stmt+"\n")
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	trailer := lines.finish()
+
+	result := &DumpHashes{Tables: []HashCheck{}}
+	if len(selected) == 0 {
+		result.File = &HashCheck{Actual: hex.EncodeToString(lines.hash.Sum(nil))}
+		if rest, ok := strings.CutPrefix(trailer, hash.HashPrefix); ok {
+			result.File.Expected = strings.TrimSpace(rest)
+		}
+	}
+	byName := map[string]int{}
+	add := func(name string) *HashCheck {
+		key := strings.ToLower(name)
+		if i, ok := byName[key]; ok {
+			return &result.Tables[i]
+		}
+		byName[key] = len(result.Tables)
+		result.Tables = append(result.Tables, HashCheck{Name: name})
+		return &result.Tables[len(result.Tables)-1]
+	}
+	// Without table hashes, only the hash of the whole file is checked
+	if len(lines.tables) > 0 || len(selected) > 0 {
+		for _, h := range actual.Hashes() {
+			add(h.Table).Actual = h.Hash
+		}
+	}
+	for _, h := range lines.tables {
+		if len(selected) == 0 || selected[strings.ToLower(h.Table)] {
+			add(h.Table).Expected = h.Hash
+		}
+	}
+	for _, t := range tables {
+		add(t)
+	}
+	return result, nil
+}
+
+// trailerHasher hashes the lines written to it except the last one, which
+// is the hash line of the whole file, and collects the table hash lines.
+type trailerHasher struct {
+	hash   gohash.Hash
+	line   []byte
+	last   []byte
+	tables []hash.TableHash
+}
+
+func (t *trailerHasher) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			t.line = append(t.line, p...)
+			break
+		}
+		t.line = append(t.line, p[:i+1]...)
+		p = p[i+1:]
+		t.endLine()
+	}
+	return n, nil
+}
+
+// endLine hashes the previous line and keeps the current one as the last.
+func (t *trailerHasher) endLine() {
+	t.hash.Write(t.last)
+	t.last = append(t.last[:0], t.line...)
+	t.line = t.line[:0]
+	if bytes.HasPrefix(t.last, []byte(hash.TablePrefix)) {
+		if h, ok := hash.ParseTableHashComment(string(t.last)); ok {
+			t.tables = append(t.tables, h)
+		}
+	}
+}
+
+// finish ends the input and returns its last line.
+func (t *trailerHasher) finish() string {
+	if len(t.line) > 0 {
+		t.endLine()
+	}
+	return strings.TrimRight(string(t.last), "\r\n")
+}
@@ -0,0 +1,277 @@
+package filters
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/danielsiegl/gitsqlite/internal/sqlite"
+)
+
+// Textconv writes the database at dbFile in a form tuned for "git diff": the
+// schema first, then the rows of each table, with tables sorted by name and
+// rows by primary key (by all columns if there is none). Every row is a
+// single-row INSERT with an explicit column list, so a row only changes
+// lines when its values change, whatever order SQLite stores rows in. The
+// output is meant for reading, not for restoring with smudge; rows are held
+// in memory for sorting. Journal files next to dbFile are handled according to
+// opts.Sidecars.
+func Textconv(ctx context.Context, eng *sqlite.Engine, dbFile string, out io.Writer, opts Options) error {
+	startTime := time.Now()
+	slog.Info("Starting textconv operation")
+
+	dbFile, removeSnapshot, err := snapshotJournaled(ctx, eng, dbFile, opts.Sidecars)
+	if err != nil {
+		slog.Error("Failed to handle journal files", "error", err)
+		return err
+	}
+	defer removeSnapshot()
+
+	dump, err := eng.OpenDump(ctx, dbFile)
+	if err != nil {
+		return err
+	}
+	defer dump.Close()
+
+	// Rows are sorted below; subset rules select them
+	scanner := newOrderedDump(ctx, eng, dbFile, dump, RowOrderDump, opts.Subset)
+	defer scanner.Close()
+	header := &headerFilter{}
+	local := newLocalTableFilter(opts.LocalTables)
+	internal := newInternalTableFilter(opts.InternalTables)
+	tables := TableMap{}
+	keys := map[string][]int{}
+	data := map[string]*textconvTable{}
+	fixer := &utf8Fixer{policy: opts.InvalidUTF8}
+	redact := newRedactor(opts.Redact, opts.FloatPrecision)
+	var schema, other []string
+	for scanner.Scan() {
+		stmt := scanner.Text()
+		if header.skip(stmt) || local.skip(stmt) || internal.skip(stmt) {
+			continue
+		}
+		stmt = fixer.fix(stmt)
+		switch ClassifyStatement(stmt) {
+		case StatementSchema:
+			tables.Observe(stmt)
+			if ct, err := ParseCreateTable(stmt); err == nil {
+				keys[strings.ToLower(ct.TableName())] = primaryKeyIndexes(ct)
+			}
+			if opts.CanonicalSchema {
+				stmt = CanonicalizeCreateTable(stmt)
+			}
+			schema = append(schema, stmt)
+			continue
+		case StatementStructural, StatementEmpty:
+			continue
+		}
+
+		ins, err := ParseInsert(stmt)
+		if err != nil || !ins.Plain() || isSchemaTable(ins.Table) {
+			// Statements other than plain INSERTs, and the rows that
+			// create virtual tables, are kept in dump order
+			other = append(other, stmt)
+			continue
+		}
+		stmt = NormalizeRealColumns(stmt, tables, opts.FloatPrecision)
+		if opts.ControlChars == ControlCharsChar {
+			stmt = CanonicalizeControlChars(stmt)
+		}
+		stmt = redact.apply(stmt, tables)
+		if ins, err = ParseInsert(stmt); err != nil {
+			other = append(other, stmt)
+			continue
+		}
+		key := strings.ToLower(ins.Table)
+		t := data[key]
+		if t == nil {
+			t = &textconvTable{name: ins.Table, info: tables.Lookup(ins.Table), keys: keys[key]}
+			data[key] = t
+		}
+		t.add(ins, normalizerFor(opts.Normalizer), opts.FloatPrecision)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading dump output: %w", err)
+	}
+	if err := dump.Close(); err != nil {
+		return err
+	}
+	fixer.report()
+	redact.report(tables)
+
+	var lines []string
+	if !opts.DataOnly {
+		lines = append(lines, schema...)
+		lines = append(lines, other...)
+	}
+	names := make([]string, 0, len(data))
+	for key := range data {
+		names = append(names, key)
+	}
+	sort.Strings(names)
+	for _, key := range names {
+		lines = append(lines, data[key].sorted()...)
+	}
+	for _, line := range lines {
+		if err := eng.WriteWithTimeout(out, []byte(line+"\n"), "textconv"); err != nil {
+			return err
+		}
+	}
+
+	slog.Info("Textconv operation completed", "duration", time.Since(startTime), "tables", len(data))
+	return nil
+}
+
+// isSchemaTable reports whether table is the schema table, which dumps
+// insert into to create virtual tables.
+func isSchemaTable(table string) bool {
+	return strings.EqualFold(table, "sqlite_schema") || strings.EqualFold(table, "sqlite_master")
+}
+
+// primaryKeyIndexes returns the positions of the table's primary key columns
+// in its TableInfo, or nil if it has none.
+func primaryKeyIndexes(ct *CreateTable) []int {
+	info := ct.Info()
+	var indexes []int
+	for _, name := range ct.primaryKeyColumns() {
+		if idx := info.Index(name); idx >= 0 {
+			indexes = append(indexes, idx)
+		}
+	}
+	return indexes
+}
+
+// textconvTable collects the rows of one table.
+type textconvTable struct {
+	name string
+	info *TableInfo
+	keys []int
+	rows []textconvRow
+}
+
+// textconvRow is a formatted row and the values it is sorted by.
+type textconvRow struct {
+	line string
+	key  []sortValue
+}
+
+// add records every row of ins as a single-row INSERT, with floats rewritten
+// by normalize.
+func (t *textconvTable) add(ins *Insert, normalize func(string, int) string, floatPrecision int) {
+	for _, row := range ins.Rows {
+		values := make([]string, len(row))
+		for i, span := range row {
+			values[i] = ins.Value(span)
+		}
+		columns := ins.Columns
+		if len(columns) == 0 && t.info != nil && len(t.info.Columns) == len(values) {
+			columns = t.info.Columns
+		}
+
+		var b strings.Builder
+		b.WriteString("INSERT INTO " + quoteIdentIfNeeded(t.name))
+		if len(columns) > 0 {
+			quoted := make([]string, len(columns))
+			for i, c := range columns {
+				quoted[i] = quoteIdentIfNeeded(c)
+			}
+			b.WriteString("(" + strings.Join(quoted, ",") + ")")
+		}
+		b.WriteString(" VALUES(" + strings.Join(values, ",") + ");")
+
+		var key []sortValue
+		if len(t.keys) > 0 && len(ins.Columns) == 0 {
+			for _, k := range t.keys {
+				if k < len(values) {
+					key = append(key, parseSortValue(values[k]))
+				}
+			}
+		} else {
+			for _, v := range values {
+				key = append(key, parseSortValue(v))
+			}
+		}
+		line := b.String()
+		if t.info == nil || t.info.HoldsReals {
+			line = normalize(line, floatPrecision)
+		}
+		t.rows = append(t.rows, textconvRow{line: line, key: key})
+	}
+}
+
+// sorted returns the rows ordered by their keys; rows with equal keys keep
+// their dump order.
+func (t *textconvTable) sorted() []string {
+	sort.SliceStable(t.rows, func(i, j int) bool {
+		a, b := t.rows[i].key, t.rows[j].key
+		for k := 0; k < len(a) && k < len(b); k++ {
+			if c := a[k].compare(b[k]); c != 0 {
+				return c < 0
+			}
+		}
+		return len(a) < len(b)
+	})
+	lines := make([]string, len(t.rows))
+	for i, r := range t.rows {
+		lines[i] = r.line
+	}
+	return lines
+}
+
+// quoteIdentIfNeeded returns name unchanged if it is a plain identifier and
+// quoted otherwise.
+func quoteIdentIfNeeded(name string) string {
+	if name == "" || !isWordStart(name[0]) {
+		return sqlite.QuoteIdent(name)
+	}
+	for i := 0; i < len(name); i++ {
+		if !isWordChar(name[i]) || name[i] >= 0x80 {
+			return sqlite.QuoteIdent(name)
+		}
+	}
+	return name
+}
+
+// sortValue is a literal value with the ordering SQLite applies: NULL, then
+// numbers, then text, then blobs.
+type sortValue struct {
+	class int
+	num   *big.Float
+	text  string
+}
+
+// parseSortValue classifies the SQL literal v.
+func parseSortValue(v string) sortValue {
+	switch {
+	case strings.EqualFold(v, "NULL"):
+		return sortValue{class: 0}
+	case len(v) > 1 && (v[0] == 'X' || v[0] == 'x') && v[1] == '\'':
+		return sortValue{class: 3, text: strings.ToUpper(v)}
+	case strings.HasPrefix(v, "'"):
+		return sortValue{class: 2, text: strings.ReplaceAll(strings.Trim(v, "'"), "''", "'")}
+	}
+	if f, _, err := big.ParseFloat(v, 10, 128, big.ToNearestEven); err == nil {
+		return sortValue{class: 1, num: f}
+	}
+	// Expressions such as unistr('...') sort as text
+	return sortValue{class: 2, text: v}
+}
+
+// compare returns -1, 0 or +1.
+func (a sortValue) compare(b sortValue) int {
+	if a.class != b.class {
+		if a.class < b.class {
+			return -1
+		}
+		return 1
+	}
+	if a.class == 1 {
+		return a.num.Cmp(b.num)
+	}
+	return strings.Compare(a.text, b.text)
+}
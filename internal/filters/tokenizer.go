@@ -0,0 +1,345 @@
+package filters
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// TokenKind classifies a lexical SQL token.
+type TokenKind int
+
+const (
+	// TokenWord is an unquoted identifier or keyword.
+	TokenWord TokenKind = iota
+	// TokenQuotedIdent is an identifier quoted with "", `` or [].
+	TokenQuotedIdent
+	// TokenString is a single-quoted string literal.
+	TokenString
+	// TokenBlob is a blob literal such as X'0A0B'.
+	TokenBlob
+	// TokenNumber is a numeric literal.
+	TokenNumber
+	// TokenPunct is an operator or punctuation character sequence.
+	TokenPunct
+	// TokenComment is a -- line comment or /* */ block comment.
+	TokenComment
+	// TokenSpace is a run of whitespace.
+	TokenSpace
+)
+
+// Token is a single lexical element of an SQL statement.
+type Token struct {
+	Kind TokenKind
+	Text string
+}
+
+// Is reports whether the token is the given (case-insensitive) word.
+func (t Token) Is(word string) bool {
+	return t.Kind == TokenWord && strings.EqualFold(t.Text, word)
+}
+
+// Tokenize splits an SQL text into tokens. Concatenating the Text of all
+// returned tokens reproduces the input exactly.
+func Tokenize(sql string) []Token {
+	var tokens []Token
+	for i := 0; i < len(sql); {
+		var tok Token
+		tok, i = nextToken(sql, i)
+		tokens = append(tokens, tok)
+	}
+	return tokens
+}
+
+// nextToken returns the token starting at offset i of sql and the offset just
+// past it. i must be less than len(sql).
+func nextToken(sql string, i int) (Token, int) {
+	c := sql[i]
+	start := i
+	kind := TokenPunct
+	switch {
+	case isSpace(c):
+		for i < len(sql) && isSpace(sql[i]) {
+			i++
+		}
+		kind = TokenSpace
+	case c == '-' && i+1 < len(sql) && sql[i+1] == '-':
+		for i < len(sql) && sql[i] != '\n' {
+			i++
+		}
+		kind = TokenComment
+	case c == '/' && i+1 < len(sql) && sql[i+1] == '*':
+		end := strings.Index(sql[i+2:], "*/")
+		if end < 0 {
+			i = len(sql)
+		} else {
+			i += end + 4
+		}
+		kind = TokenComment
+	case c == '\'':
+		i = skipQuoted(sql, i, '\'')
+		kind = TokenString
+	case c == '"' || c == '`':
+		i = skipQuoted(sql, i, c)
+		kind = TokenQuotedIdent
+	case c == '[':
+		end := strings.IndexByte(sql[i:], ']')
+		if end < 0 {
+			i = len(sql)
+		} else {
+			i += end + 1
+		}
+		kind = TokenQuotedIdent
+	case (c == 'x' || c == 'X') && i+1 < len(sql) && sql[i+1] == '\'':
+		i = skipQuoted(sql, i+1, '\'')
+		kind = TokenBlob
+	case isDigit(c) || (c == '.' && i+1 < len(sql) && isDigit(sql[i+1])):
+		i = skipNumber(sql, i)
+		kind = TokenNumber
+	case isWordStart(c):
+		for i < len(sql) && isWordChar(sql[i]) {
+			i++
+		}
+		kind = TokenWord
+	default:
+		i++
+		// Group multi-character operators so that they are kept intact.
+		if i < len(sql) {
+			switch sql[start : i+1] {
+			case "<=", ">=", "<>", "!=", "==", "||", "<<", ">>", "->":
+				i++
+				if sql[start:i] == "->" && i < len(sql) && sql[i] == '>' {
+					i++
+				}
+			}
+		}
+	}
+	return Token{Kind: kind, Text: sql[start:i]}, i
+}
+
+// skipQuoted returns the index just past the quoted token starting at i.
+// Doubled quote characters are treated as escapes.
+func skipQuoted(s string, i int, quote byte) int {
+	i++
+	for i < len(s) {
+		if s[i] == quote {
+			if i+1 < len(s) && s[i+1] == quote {
+				i += 2
+				continue
+			}
+			return i + 1
+		}
+		i++
+	}
+	return len(s)
+}
+
+// skipNumber returns the index just past the numeric literal starting at i.
+func skipNumber(s string, i int) int {
+	if strings.HasPrefix(s[i:], "0x") || strings.HasPrefix(s[i:], "0X") {
+		i += 2
+		for i < len(s) && isHexDigit(s[i]) {
+			i++
+		}
+		return i
+	}
+	for i < len(s) && (isDigit(s[i]) || s[i] == '_') {
+		i++
+	}
+	if i < len(s) && s[i] == '.' {
+		i++
+		for i < len(s) && (isDigit(s[i]) || s[i] == '_') {
+			i++
+		}
+	}
+	if i < len(s) && (s[i] == 'e' || s[i] == 'E') {
+		j := i + 1
+		if j < len(s) && (s[j] == '+' || s[j] == '-') {
+			j++
+		}
+		if j < len(s) && isDigit(s[j]) {
+			i = j
+			for i < len(s) && isDigit(s[i]) {
+				i++
+			}
+		}
+	}
+	return i
+}
+
+func isSpace(c byte) bool     { return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f' }
+func isDigit(c byte) bool     { return c >= '0' && c <= '9' }
+func isHexDigit(c byte) bool  { return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F') }
+func isWordStart(c byte) bool { return c == '_' || c >= 0x80 || (c|0x20 >= 'a' && c|0x20 <= 'z') }
+func isWordChar(c byte) bool  { return isWordStart(c) || isDigit(c) || c == '$' }
+
+// StatementScanner reads SQL text line by line and groups lines into complete
+// statements. It understands quoted literals, comments and CREATE TRIGGER
+// bodies, so statements spanning several lines (multi-line CREATE TABLE,
+// string values with embedded newlines) are returned as a single unit.
+type StatementScanner struct {
+	reader *bufio.Reader
+	text   string
+	raw    string
+	err    error
+	state  scanState
+}
+
+// NewStatementScanner creates a StatementScanner reading from r.
+func NewStatementScanner(r io.Reader) *StatementScanner {
+	return &StatementScanner{reader: bufio.NewReaderSize(r, 64*1024)}
+}
+
+// Scan advances to the next statement. It returns false when the input is
+// exhausted or a read error occurred.
+func (s *StatementScanner) Scan() bool {
+	var b, raw strings.Builder
+	lines := 0
+	s.state = scanState{}
+	for {
+		line, readErr := s.reader.ReadString('\n')
+		if len(line) == 0 && readErr != nil {
+			if readErr != io.EOF {
+				s.err = readErr
+			}
+			// Return a trailing incomplete statement as-is.
+			if lines > 0 {
+				s.text, s.raw = b.String(), raw.String()
+				return true
+			}
+			return false
+		}
+		raw.WriteString(line)
+		// this way it should work with CRLF and LF
+		line = strings.TrimRight(line, "\n")
+		line = strings.TrimRight(line, "\r")
+
+		if lines > 0 {
+			b.WriteByte('\n')
+		}
+		b.WriteString(line)
+		lines++
+
+		s.state.feed(line)
+		if s.state.complete() || (readErr != nil && readErr != io.EOF) {
+			if readErr != nil && readErr != io.EOF {
+				s.err = readErr
+			}
+			s.text, s.raw = b.String(), raw.String()
+			return true
+		}
+	}
+}
+
+// Text returns the most recent statement read by Scan. Lines are joined with
+// "\n" and the trailing newline is not included.
+func (s *StatementScanner) Text() string {
+	return s.text
+}
+
+// Raw returns the most recent statement exactly as read, including the
+// original line endings.
+func (s *StatementScanner) Raw() string {
+	return s.raw
+}
+
+// Err returns the first non-EOF error encountered by the scanner.
+func (s *StatementScanner) Err() error {
+	return s.err
+}
+
+// scanState tracks the lexical state needed to decide whether the text fed
+// so far forms a complete statement.
+type scanState struct {
+	quote   byte // closing quote character while inside a quoted token
+	block   bool // inside a /* */ comment
+	words   int  // number of significant tokens seen
+	trigger bool // statement is a CREATE TRIGGER
+	prefix  [3]string
+	last    [3]string // last three significant tokens ("" for punctuation other than ';')
+	sawAny  bool
+}
+
+func (st *scanState) push(tok string) {
+	st.sawAny = true
+	if st.words < len(st.prefix) {
+		st.prefix[st.words] = tok
+		if st.words == 2 || st.words == 1 {
+			st.trigger = strings.EqualFold(st.prefix[0], "CREATE") &&
+				(strings.EqualFold(st.prefix[1], "TRIGGER") ||
+					((strings.EqualFold(st.prefix[1], "TEMP") || strings.EqualFold(st.prefix[1], "TEMPORARY")) &&
+						strings.EqualFold(st.prefix[2], "TRIGGER")))
+		}
+	}
+	st.words++
+	st.last[0], st.last[1], st.last[2] = st.last[1], st.last[2], tok
+}
+
+func (st *scanState) feed(line string) {
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		if st.block {
+			if c == '*' && i+1 < len(line) && line[i+1] == '/' {
+				st.block = false
+				i++
+			}
+			continue
+		}
+		if st.quote != 0 {
+			if c == st.quote {
+				if st.quote != ']' && i+1 < len(line) && line[i+1] == st.quote {
+					i++
+					continue
+				}
+				st.quote = 0
+			}
+			continue
+		}
+		switch {
+		case c == '-' && i+1 < len(line) && line[i+1] == '-':
+			return
+		case c == '/' && i+1 < len(line) && line[i+1] == '*':
+			st.block = true
+			i++
+		case c == '\'' || c == '"' || c == '`':
+			st.quote = c
+			st.push("")
+		case c == '[':
+			st.quote = ']'
+			st.push("")
+		case c == ';':
+			st.push(";")
+		case isWordStart(c):
+			j := i
+			for j < len(line) && isWordChar(line[j]) {
+				j++
+			}
+			if st.words < len(st.prefix) || st.trigger {
+				st.push(line[i:j])
+			} else {
+				st.push("")
+			}
+			i = j - 1
+		case isSpace(c):
+		default:
+			st.push("")
+		}
+	}
+}
+
+func (st *scanState) complete() bool {
+	if st.quote != 0 || st.block {
+		return false
+	}
+	if !st.sawAny {
+		// Blank and comment-only lines stand on their own.
+		return true
+	}
+	if st.last[2] != ";" {
+		return false
+	}
+	if st.trigger {
+		return st.last[0] == ";" && strings.EqualFold(st.last[1], "END")
+	}
+	return true
+}
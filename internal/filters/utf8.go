@@ -0,0 +1,79 @@
+package filters
+
+import (
+	"encoding/hex"
+	"log/slog"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/danielsiegl/gitsqlite/internal/warnings"
+)
+
+// Policies for text that is not valid UTF-8 (-invalid-utf8).
+const (
+	// UTF8Escape rewrites string literals in INSERT statements as
+	// CAST(X'...' AS TEXT), which restores the exact bytes.
+	UTF8Escape = "escape"
+	// UTF8Replace replaces invalid sequences with U+FFFD, losing the
+	// original bytes.
+	UTF8Replace = "replace"
+)
+
+// bom is the UTF-8 byte order mark.
+const bom = "\uFEFF"
+
+// EnsureUTF8 returns stmt as valid UTF-8 and whether it had to be changed.
+// SQLite stores TEXT values as given, so a database may contain byte
+// sequences that are not UTF-8; sqlite3 .dump copies them into the dump,
+// where they break diff tools. With UTF8Escape the string literals of INSERT
+// statements holding such sequences are written as blob casts; invalid
+// sequences anywhere else (identifiers, schema, comments) and all of them with
+// UTF8Replace are replaced with U+FFFD.
+func EnsureUTF8(stmt, policy string) (string, bool) {
+	if utf8.ValidString(stmt) {
+		return stmt, false
+	}
+	escape := policy != UTF8Replace && ClassifyStatement(stmt) == StatementData
+	var b strings.Builder
+	for _, tok := range Tokenize(stmt) {
+		switch {
+		case utf8.ValidString(tok.Text):
+			b.WriteString(tok.Text)
+		case escape && tok.Kind == TokenString && len(tok.Text) >= 2 && strings.HasSuffix(tok.Text, "'"):
+			value := strings.ReplaceAll(tok.Text[1:len(tok.Text)-1], "''", "'")
+			b.WriteString("CAST(X'" + strings.ToUpper(hex.EncodeToString([]byte(value))) + "' AS TEXT)")
+		default:
+			b.WriteString(strings.ToValidUTF8(tok.Text, "\uFFFD"))
+		}
+	}
+	return b.String(), true
+}
+
+// utf8Fixer applies EnsureUTF8 to the statements of one dump and reports the
+// changed ones once at the end.
+type utf8Fixer struct {
+	policy  string
+	changed int
+}
+
+// fix returns stmt as valid UTF-8.
+func (f *utf8Fixer) fix(stmt string) string {
+	stmt, changed := EnsureUTF8(stmt, f.policy)
+	if changed {
+		f.changed++
+	}
+	return stmt
+}
+
+// report warns if invalid text was replaced, which changes the data restored
+// from the dump.
+func (f *utf8Fixer) report() {
+	if f.changed == 0 {
+		return
+	}
+	if f.policy == UTF8Replace {
+		warnings.Emit(warnings.InvalidUTF8, "%d statement(s) contained invalid UTF-8, replaced with U+FFFD (use -invalid-utf8 escape to keep the bytes)", f.changed)
+		return
+	}
+	slog.Info("Escaped invalid UTF-8 text", "statements", f.changed)
+}
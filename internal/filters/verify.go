@@ -0,0 +1,177 @@
+package filters
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/danielsiegl/gitsqlite/internal/logging"
+	"github.com/danielsiegl/gitsqlite/internal/shutdown"
+	"github.com/danielsiegl/gitsqlite/internal/sqlite"
+)
+
+// VerifyResult is the outcome of a round trip through clean and smudge.
+type VerifyResult struct {
+	// Identical reports whether cleaning the restored database gave the
+	// same SQL, byte for byte, as cleaning the original.
+	Identical bool
+	// Line is the first line that differs (1-based), 0 if Identical.
+	Line int
+	// Original and Restored are that line in the first and second dump;
+	// a missing line is reported as "<end of output>".
+	Original, Restored string
+	// Integrity holds the rows of PRAGMA integrity_check on the restored
+	// database, ["ok"] if it is sound.
+	Integrity []string
+	// Size is the size of the dump in bytes.
+	Size int64
+}
+
+// OK reports whether the round trip was faithful.
+func (r *VerifyResult) OK() bool {
+	return r.Identical && len(r.Integrity) == 1 && r.Integrity[0] == "ok"
+}
+
+// Verify cleans the database at dbPath, restores the dump with smudge and
+// cleans the restored database again, as git does on commit and checkout.
+// Both dumps are made with opts, but uncompressed and with the schema
+// inline, so they can be compared line by line.
+func Verify(ctx context.Context, eng *sqlite.Engine, dbPath string, opts Options) (*VerifyResult, error) {
+	startTime := time.Now()
+	slog.Info("Starting verify operation", "file", dbPath)
+
+	dir, err := os.MkdirTemp("", "gitsqlite-verify-*")
+	if err != nil {
+		slog.Error("Failed to create temp directory", "error", err)
+		return nil, err
+	}
+	defer shutdown.Remove(dir)()
+
+	opts.SchemaOutput = ""
+	opts.DataOnly = false
+	opts.Compress = ""
+	firstSQL := filepath.Join(dir, "first.sql")
+	restoredDB := filepath.Join(dir, "restored.db")
+	secondSQL := filepath.Join(dir, "second.sql")
+
+	firstOpts := opts
+	firstOpts.SourcePath = dbPath
+	if err := cleanFile(ctx, eng, dbPath, firstSQL, firstOpts); err != nil {
+		return nil, err
+	}
+	if err := smudgeFile(ctx, eng, firstSQL, restoredDB, opts.BlobDir); err != nil {
+		return nil, err
+	}
+	opts.SourcePath = ""
+	opts.InputSize = 0
+	if err := cleanFile(ctx, eng, restoredDB, secondSQL, opts); err != nil {
+		return nil, err
+	}
+
+	result := &VerifyResult{}
+	if info, err := os.Stat(firstSQL); err == nil {
+		result.Size = info.Size()
+	}
+	if result.Line, result.Original, result.Restored, err = firstDifference(firstSQL, secondSQL); err != nil {
+		slog.Error("Failed to compare dumps", "error", err)
+		return nil, err
+	}
+	result.Identical = result.Line == 0
+
+	rows, err := eng.Query(ctx, restoredDB, "PRAGMA integrity_check")
+	if err != nil {
+		slog.Error("Integrity check failed to run", "error", err)
+		return nil, err
+	}
+	for _, row := range rows {
+		if len(row) > 0 {
+			result.Integrity = append(result.Integrity, row[0])
+		}
+	}
+
+	slog.Info("Verify operation completed",
+		"identical", result.Identical, "line", result.Line, "integrity", result.Integrity,
+		"duration", logging.FormatDuration(time.Since(startTime)))
+	return result, nil
+}
+
+// cleanFile runs Clean on the database at src and writes the dump to dst.
+func cleanFile(ctx context.Context, eng *sqlite.Engine, src, dst string, opts Options) error {
+	return convertFile(src, dst, func(in io.Reader, out io.Writer) error {
+		return Clean(ctx, eng, in, out, opts)
+	})
+}
+
+// smudgeFile runs Smudge on the dump at src and writes the database to dst,
+// rejecting a dump whose hash trailer does not match. BLOB pointers are
+// resolved from blobDir.
+func smudgeFile(ctx context.Context, eng *sqlite.Engine, src, dst, blobDir string) error {
+	return convertFile(src, dst, func(in io.Reader, out io.Writer) error {
+		return Smudge(ctx, eng, in, out, SmudgeOptions{EnforceHash: true, Jobs: 1, BlobDir: blobDir})
+	})
+}
+
+func convertFile(src, dst string, convert func(in io.Reader, out io.Writer) error) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if err := convert(in, out); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// endOfOutput stands for the missing line when one dump is shorter.
+const endOfOutput = "<end of output>"
+
+// firstDifference compares the files a and b line by line and returns the
+// number and contents of the first line that differs, or 0 if the files are
+// identical.
+func firstDifference(a, b string) (int, string, string, error) {
+	fa, err := os.Open(a)
+	if err != nil {
+		return 0, "", "", err
+	}
+	defer fa.Close()
+	fb, err := os.Open(b)
+	if err != nil {
+		return 0, "", "", err
+	}
+	defer fb.Close()
+
+	ra, rb := bufio.NewReader(fa), bufio.NewReader(fb)
+	for line := 1; ; line++ {
+		la, errA := ra.ReadString('\n')
+		lb, errB := rb.ReadString('\n')
+		if errA != nil && !errors.Is(errA, io.EOF) {
+			return 0, "", "", errA
+		}
+		if errB != nil && !errors.Is(errB, io.EOF) {
+			return 0, "", "", errB
+		}
+		if la != lb {
+			if la == "" {
+				la = endOfOutput
+			}
+			if lb == "" {
+				lb = endOfOutput
+			}
+			return line, la, lb, nil
+		}
+		if errA != nil {
+			return 0, "", "", nil
+		}
+	}
+}
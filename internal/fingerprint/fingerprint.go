@@ -0,0 +1,134 @@
+// Package fingerprint describes what the output of a run depends on besides
+// the database: the gitsqlite build, platform and locale, the SQLite engine
+// with its version and compile options, and the options of the run. When two
+// machines write different dumps of the same database, comparing their
+// fingerprints field by field (gitsqlite fingerprint --json) narrows down why.
+package fingerprint
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/danielsiegl/gitsqlite/internal/sqlite"
+	"github.com/danielsiegl/gitsqlite/internal/version"
+)
+
+// Fingerprint is the environment of a run.
+type Fingerprint struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	GoVersion string `json:"go_version"`
+	OS        string `json:"os"`
+	Arch      string `json:"arch"`
+	// Locale is the locale of the user, such as en_US.UTF-8 or de-DE; empty
+	// if none is set.
+	Locale string `json:"locale"`
+	// Engine is cli or embedded, SQLite the sqlite3 executable used or
+	// sqlite.EmbeddedPath.
+	Engine         string   `json:"engine"`
+	SQLite         string   `json:"sqlite"`
+	SQLiteVersion  string   `json:"sqlite_version"`
+	SQLiteSourceID string   `json:"sqlite_source_id"`
+	CompileOptions []string `json:"compile_options"`
+	// Options are the options of the run as name=value, OptionsHash their
+	// SHA-256, which is equal for runs with equal options.
+	Options     []string `json:"options"`
+	OptionsHash string   `json:"options_hash"`
+}
+
+// Collect returns the fingerprint of a run with eng and options. If SQLite
+// cannot be queried, it returns the fingerprint without the SQLite fields
+// and the error.
+func Collect(ctx context.Context, eng *sqlite.Engine, options []string) (*Fingerprint, error) {
+	f := &Fingerprint{
+		Version:     version.Version,
+		Commit:      version.GitCommit,
+		GoVersion:   runtime.Version(),
+		OS:          runtime.GOOS,
+		Arch:        runtime.GOARCH,
+		Locale:      locale(),
+		Engine:      sqlite.EngineCLI,
+		Options:     append([]string{}, options...),
+		OptionsHash: hashOptions(options),
+	}
+	if eng.Embedded {
+		f.Engine, f.SQLite = sqlite.EngineEmbedded, sqlite.EmbeddedPath
+	} else {
+		path, err := eng.GetBinPath(ctx)
+		if err != nil {
+			return f, err
+		}
+		f.SQLite = path
+	}
+	rows, err := eng.Query(ctx, ":memory:", "SELECT sqlite_version(), sqlite_source_id();")
+	if err != nil {
+		return f, err
+	}
+	if len(rows) == 1 && len(rows[0]) == 2 {
+		f.SQLiteVersion, f.SQLiteSourceID = rows[0][0], rows[0][1]
+	}
+	if rows, err = eng.Query(ctx, ":memory:", "PRAGMA compile_options;"); err != nil {
+		return f, err
+	}
+	f.CompileOptions = []string{}
+	for _, row := range rows {
+		if len(row) > 0 {
+			f.CompileOptions = append(f.CompileOptions, row[0])
+		}
+	}
+	return f, nil
+}
+
+// hashOptions returns the hex SHA-256 of options, one per line.
+func hashOptions(options []string) string {
+	sum := sha256.Sum256([]byte(strings.Join(options, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// localeVars are the environment variables setting the locale, in the order
+// of precedence of POSIX.
+var localeVars = []string{"LC_ALL", "LC_CTYPE", "LANG"}
+
+// envLocale returns the locale set in the environment, or "".
+func envLocale() string {
+	for _, name := range localeVars {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// Print writes f as text, one field per line.
+func (f *Fingerprint) Print(w io.Writer) error {
+	commit := ""
+	if f.Commit != "" {
+		commit = " (" + f.Commit + ")"
+	}
+	lines := []string{
+		fmt.Sprintf("gitsqlite:       %s%s", f.Version, commit),
+		fmt.Sprintf("go:              %s %s/%s", f.GoVersion, f.OS, f.Arch),
+		fmt.Sprintf("locale:          %s", orNone(f.Locale)),
+		fmt.Sprintf("engine:          %s %s", f.Engine, f.SQLite),
+		fmt.Sprintf("sqlite:          %s %s", orNone(f.SQLiteVersion), f.SQLiteSourceID),
+		fmt.Sprintf("compile options: %s", orNone(strings.Join(f.CompileOptions, " "))),
+		fmt.Sprintf("options:         %s", orNone(strings.Join(f.Options, " "))),
+		fmt.Sprintf("options hash:    %s", f.OptionsHash),
+	}
+	_, err := fmt.Fprintln(w, strings.Join(lines, "\n"))
+	return err
+}
+
+// orNone returns s, or "(none)" if it is empty.
+func orNone(s string) string {
+	if s == "" {
+		return "(none)"
+	}
+	return s
+}
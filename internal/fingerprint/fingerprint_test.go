@@ -0,0 +1,37 @@
+package fingerprint
+
+import (
+	"context"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/danielsiegl/gitsqlite/internal/sqlite"
+)
+
+func TestCollect(t *testing.T) {
+	eng := &sqlite.Engine{Embedded: true}
+	f, err := Collect(context.Background(), eng, []string{"format=jsonl"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.OS != runtime.GOOS || f.Engine != sqlite.EngineEmbedded {
+		t.Errorf("Collect = %+v, want os %s and the embedded engine", f, runtime.GOOS)
+	}
+	if !strings.HasPrefix(f.SQLiteVersion, "3.") || f.SQLiteSourceID == "" || len(f.CompileOptions) == 0 {
+		t.Errorf("SQLite fields = %q %q %q, want version, source id and compile options", f.SQLiteVersion, f.SQLiteSourceID, f.CompileOptions)
+	}
+}
+
+func TestHashOptions(t *testing.T) {
+	a := hashOptions([]string{"format=jsonl", "vacuum=true"})
+	if len(a) != 64 {
+		t.Errorf("hash %q is not a hex SHA-256", a)
+	}
+	if a != hashOptions([]string{"format=jsonl", "vacuum=true"}) {
+		t.Error("equal options hash differently")
+	}
+	if a == hashOptions([]string{"format=jsonl"}) {
+		t.Error("different options hash equally")
+	}
+}
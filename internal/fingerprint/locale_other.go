@@ -0,0 +1,8 @@
+//go:build !windows
+
+package fingerprint
+
+// locale returns the locale set in the environment.
+func locale() string {
+	return envLocale()
+}
@@ -0,0 +1,16 @@
+package fingerprint
+
+import "golang.org/x/sys/windows"
+
+// locale returns the locale set in the environment, e.g. by MSYS2, else the
+// preferred UI language of the user, such as de-DE.
+func locale() string {
+	if l := envLocale(); l != "" {
+		return l
+	}
+	languages, err := windows.GetUserPreferredUILanguages(windows.MUI_LANGUAGE_NAME)
+	if err != nil || len(languages) == 0 {
+		return ""
+	}
+	return languages[0]
+}
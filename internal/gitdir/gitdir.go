@@ -0,0 +1,62 @@
+// Package gitdir locates the files gitsqlite keeps in the git directory of a
+// repository, <git-dir>/gitsqlite/<name>: logs, temporary files, backups and
+// caches. They are on the disk of the repository, shared by all its
+// worktrees, and never committed.
+package gitdir
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Dir returns <git-dir>/gitsqlite/name of the repository containing the
+// current working directory.
+func Dir(ctx context.Context, name string) (string, error) {
+	lines, err := revParse(ctx, "--git-common-dir")
+	if err != nil {
+		return "", err
+	}
+	return join(lines[0], name)
+}
+
+// WorktreeDir is Dir that also returns the root of the worktree, which the
+// paths of the databases stored in the directory are relative to.
+func WorktreeDir(ctx context.Context, name string) (dir, root string, err error) {
+	lines, err := revParse(ctx, "--git-common-dir", "--show-toplevel")
+	if err != nil {
+		return "", "", err
+	}
+	if dir, err = join(lines[0], name); err != nil {
+		return "", "", err
+	}
+	return dir, filepath.Clean(filepath.FromSlash(lines[1])), nil
+}
+
+// revParse runs git rev-parse with one option per line of output.
+func revParse(ctx context.Context, options ...string) ([]string, error) {
+	out, err := exec.CommandContext(ctx, "git", append([]string{"rev-parse"}, options...)...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("not inside a git repository: %w", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(lines) != len(options) {
+		return nil, fmt.Errorf("unexpected git rev-parse output %q", out)
+	}
+	for i := range lines {
+		lines[i] = strings.TrimSpace(lines[i])
+	}
+	return lines, nil
+}
+
+// join returns name in the gitsqlite directory of gitDir, which git prints
+// relative to the working directory.
+func join(gitDir, name string) (string, error) {
+	abs, err := filepath.Abs(gitDir)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(abs, "gitsqlite", name), nil
+}
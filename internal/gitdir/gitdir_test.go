@@ -0,0 +1,41 @@
+package gitdir
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestDir(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	ctx := context.Background()
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(root)
+	if _, err := Dir(ctx, "logs"); err == nil {
+		t.Error("Dir outside a repository succeeded")
+	}
+	if out, err := exec.Command("git", "init", "-q").CombinedOutput(); err != nil {
+		t.Fatalf("git init: %v\n%s", err, out)
+	}
+
+	// git prints the git directory relative to a subdirectory
+	sub := filepath.Join(root, "data")
+	if err := os.Mkdir(sub, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Chdir(sub)
+	want := filepath.Join(root, ".git", "gitsqlite", "logs")
+	if dir, err := Dir(ctx, "logs"); err != nil || dir != want {
+		t.Errorf("Dir = %q, %v; want %q", dir, err, want)
+	}
+	if dir, gotRoot, err := WorktreeDir(ctx, "logs"); err != nil || dir != want || gotRoot != root {
+		t.Errorf("WorktreeDir = %q, %q, %v; want %q, %q", dir, gotRoot, err, want, root)
+	}
+}
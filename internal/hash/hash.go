@@ -9,11 +9,16 @@ import (
 	"hash"
 	"io"
 	"strings"
+
+	"github.com/danielsiegl/gitsqlite/internal/errs"
 )
 
 const (
 	// HashPrefix is the SQL comment prefix for the hash line
 	HashPrefix = "-- gitsqlite-hash: sha256:"
+	// SchemaPrefix is the SQL comment prefix for the line of a data-only
+	// dump recording the hash of the schema file written with it
+	SchemaPrefix = "-- gitsqlite-schema-hash: sha256:"
 )
 
 // HashWriter wraps an io.Writer and computes SHA-256 hash of all data written through it
@@ -38,6 +43,11 @@ func (hw *HashWriter) Write(p []byte) (n int, err error) {
 	return hw.writer.Write(p)
 }
 
+// Unwrap returns the underlying writer
+func (hw *HashWriter) Unwrap() io.Writer {
+	return hw.writer
+}
+
 // GetHash returns the hex-encoded SHA-256 hash of all data written
 func (hw *HashWriter) GetHash() string {
 	return hex.EncodeToString(hw.hash.Sum(nil))
@@ -79,7 +89,7 @@ func VerifyAndStripHash(r io.Reader) (io.Reader, error) {
 	// Check if last line is a hash comment
 	lastLineStr := string(lastLine)
 	if !strings.HasPrefix(lastLineStr, HashPrefix) {
-		return nil, fmt.Errorf("missing gitsqlite hash signature (expected last line to start with '%s')", HashPrefix)
+		return nil, errs.Mark(fmt.Errorf("missing gitsqlite hash signature (expected last line to start with '%s')", HashPrefix), errs.ErrHashMismatch)
 	}
 
 	// Extract the hash from the last line
@@ -106,7 +116,7 @@ func VerifyAndStripHash(r io.Reader) (io.Reader, error) {
 
 	// Verify hash matches
 	if actualHash != expectedHash {
-		return nil, fmt.Errorf("hash verification failed: expected %s, got %s (file may have been modified)", expectedHash, actualHash)
+		return nil, errs.Mark(fmt.Errorf("hash verification failed: expected %s, got %s (file may have been modified)", expectedHash, actualHash), errs.ErrHashMismatch)
 	}
 
 	// Return content without hash line
@@ -123,11 +133,12 @@ type VerificationResult struct {
 // VerifyHashOptional reads all data from r, attempts to verify the hash comment at the end,
 // and returns the content without the hash line along with verification status.
 // Unlike VerifyAndStripHash, this function does not return an error on verification failure.
+// If reading r fails, the returned reader fails with the same error.
 func VerifyHashOptional(r io.Reader) (io.Reader, *VerificationResult) {
 	// Read all content
 	data, err := io.ReadAll(r)
 	if err != nil {
-		return nil, &VerificationResult{
+		return failedReader{fmt.Errorf("failed to read input: %w", err)}, &VerificationResult{
 			Valid:   false,
 			Error:   err.Error(),
 			Message: fmt.Sprintf("Failed to read input: %v", err),
@@ -224,3 +235,8 @@ func ExtractHashFromReader(r io.Reader) (string, error) {
 	hash := strings.TrimPrefix(lastLine, HashPrefix)
 	return strings.TrimSpace(hash), nil
 }
+
+// failedReader is a reader whose every read fails with err.
+type failedReader struct{ err error }
+
+func (f failedReader) Read([]byte) (int, error) { return 0, f.err }
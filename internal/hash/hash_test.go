@@ -2,9 +2,11 @@ package hash
 
 import (
 	"bytes"
+	"errors"
 	"io"
 	"strings"
 	"testing"
+	"testing/iotest"
 )
 
 func TestHashWriter(t *testing.T) {
@@ -193,3 +195,46 @@ func TestRoundTrip(t *testing.T) {
 		})
 	}
 }
+
+func TestVerifyHashOptionalReadError(t *testing.T) {
+	readErr := errors.New("stalled")
+	r, result := VerifyHashOptional(iotest.ErrReader(readErr))
+	if result.Valid {
+		t.Error("result is valid after a read error")
+	}
+	if _, err := io.ReadAll(r); !errors.Is(err, readErr) {
+		t.Errorf("reading the returned reader: %v, want %v", err, readErr)
+	}
+}
+
+func TestTableHasher(t *testing.T) {
+	th := NewTableHasher()
+	th.Add("Users", "CREATE TABLE Users(id);\n")
+	th.Add("orders", "CREATE TABLE orders(id);\n")
+	th.Add("users", "INSERT INTO users VALUES(1);\n")
+
+	hashes := th.Hashes()
+	if len(hashes) != 2 || hashes[0].Table != "Users" || hashes[1].Table != "orders" {
+		t.Fatalf("Hashes() = %+v, want Users and orders in that order", hashes)
+	}
+	whole := NewHashWriter(io.Discard)
+	whole.Write([]byte("CREATE TABLE Users(id);\nINSERT INTO users VALUES(1);\n"))
+	if hashes[0].Hash != whole.GetHash() {
+		t.Errorf("hash of Users = %s, want %s", hashes[0].Hash, whole.GetHash())
+	}
+
+	for _, line := range strings.SplitAfter(strings.TrimSuffix(th.Comments(), "\n"), "\n") {
+		h, ok := ParseTableHashComment(line)
+		if !ok {
+			t.Fatalf("ParseTableHashComment(%q) failed", line)
+		}
+		if h != hashes[0] && h != hashes[1] {
+			t.Errorf("ParseTableHashComment(%q) = %+v", line, h)
+		}
+	}
+	for _, line := range []string{HashPrefix + hashes[0].Hash, TablePrefix + "abc users", TablePrefix + hashes[0].Hash} {
+		if _, ok := ParseTableHashComment(line); ok {
+			t.Errorf("ParseTableHashComment(%q) succeeded", line)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package hash
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+const (
+	// TablePrefix is the SQL comment prefix for the hash lines of single
+	// tables, which precede the hash line of the whole file
+	TablePrefix = "-- gitsqlite-table-hash: sha256:"
+)
+
+// TableHasher computes a SHA-256 hash per table of the statements added to it
+type TableHasher struct {
+	names  []string
+	byName map[string]hash.Hash
+}
+
+// NewTableHasher creates an empty TableHasher
+func NewTableHasher() *TableHasher {
+	return &TableHasher{byName: map[string]hash.Hash{}}
+}
+
+// Add adds text to the hash of table. Table names are case-insensitive; the
+// first spelling added is the one reported.
+func (t *TableHasher) Add(table, text string) {
+	key := strings.ToLower(table)
+	h, ok := t.byName[key]
+	if !ok {
+		h = sha256.New()
+		t.byName[key] = h
+		t.names = append(t.names, table)
+	}
+	h.Write([]byte(text))
+}
+
+// Hashes returns the hex-encoded hashes of the tables in the order they were
+// first added
+func (t *TableHasher) Hashes() []TableHash {
+	hashes := make([]TableHash, len(t.names))
+	for i, name := range t.names {
+		hashes[i] = TableHash{Table: name, Hash: hex.EncodeToString(t.byName[strings.ToLower(name)].Sum(nil))}
+	}
+	return hashes
+}
+
+// Comments returns the hashes formatted as SQL comments, one per line
+func (t *TableHasher) Comments() string {
+	var b strings.Builder
+	for _, h := range t.Hashes() {
+		fmt.Fprintf(&b, "%s%s %s\n", TablePrefix, h.Hash, h.Table)
+	}
+	return b.String()
+}
+
+// TableHash is the hash of the statements of one table
+type TableHash struct {
+	Table string
+	Hash  string
+}
+
+// ParseTableHashComment returns the table hash of a line written by
+// Comments; ok is false if line is not one
+func ParseTableHashComment(line string) (h TableHash, ok bool) {
+	rest, found := strings.CutPrefix(strings.TrimRight(line, "\r\n"), TablePrefix)
+	if !found {
+		return TableHash{}, false
+	}
+	sum, table, found := strings.Cut(rest, " ")
+	if !found || len(sum) != sha256.Size*2 || table == "" {
+		return TableHash{}, false
+	}
+	return TableHash{Table: table, Hash: sum}, true
+}
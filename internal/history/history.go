@@ -0,0 +1,277 @@
+// Package history finds the SQLite databases a repository committed as binary
+// files, typically before it adopted the gitsqlite filter, and plans
+// rewriting its history to get rid of them: converting them to dumps with git
+// filter-repo, or moving them to Git LFS. It only reads the repository; the
+// plans are commands for the maintainer to review and run.
+package history
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// DefaultExtensions are the extensions of the files looked at, the ones
+// doctor checks for a missing filter attribute.
+var DefaultExtensions = []string{".db", ".sqlite", ".sqlite3", ".qea"}
+
+// databaseHeader is the magic string every SQLite 3 database file starts with.
+const databaseHeader = "SQLite format 3\x00"
+
+// Options controls what Analyze looks at.
+type Options struct {
+	// Extensions are the file extensions of databases, e.g. ".db".
+	Extensions []string
+	// MinSize is the size in bytes below which binary databases are ignored.
+	MinSize int64
+}
+
+// Blob is a binary database in the history.
+type Blob struct {
+	ID   string `json:"id"`
+	Path string `json:"path"`
+	// Size is the size of the database file.
+	Size int64 `json:"size"`
+	// DiskSize is what the blob takes in the packs, delta-compressed.
+	DiskSize int64 `json:"disk_size"`
+}
+
+// PathSummary sums up the binary databases committed at one path.
+type PathSummary struct {
+	Path     string `json:"path"`
+	Blobs    int    `json:"blobs"`
+	Size     int64  `json:"size"`
+	DiskSize int64  `json:"disk_size"`
+}
+
+// Commit identifies a commit by its hash and date.
+type Commit struct {
+	Hash string `json:"hash"`
+	Date string `json:"date"`
+}
+
+// Report is the result of Analyze.
+type Report struct {
+	// Paths are the paths with binary databases, largest first.
+	Paths []PathSummary `json:"paths"`
+	// Blobs is the number of binary databases, Size and DiskSize their
+	// total sizes.
+	Blobs    int   `json:"blobs"`
+	Size     int64 `json:"size"`
+	DiskSize int64 `json:"disk_size"`
+	// DumpBlobs is the number of database files stored as text, such as
+	// dumps, which the plans keep.
+	DumpBlobs int `json:"dump_blobs"`
+	// RepositorySize is the size of the object database, packs and loose
+	// objects.
+	RepositorySize int64 `json:"repository_size"`
+	// First and Last are the oldest and newest commits adding a binary
+	// database; nil if there are none.
+	First *Commit `json:"first,omitempty"`
+	Last  *Commit `json:"last,omitempty"`
+}
+
+// Analyze scans all refs of the repository in the working directory for
+// database files committed as binary SQLite files.
+func Analyze(ctx context.Context, opts Options) (*Report, error) {
+	candidates, err := databaseObjects(ctx, opts.Extensions)
+	if err != nil {
+		return nil, err
+	}
+	report := &Report{}
+	blobs, dumps, err := binaryBlobs(ctx, candidates, opts.MinSize)
+	if err != nil {
+		return nil, err
+	}
+	report.DumpBlobs = dumps
+	byPath := map[string]*PathSummary{}
+	binary := map[string]bool{}
+	for _, b := range blobs {
+		binary[b.ID] = true
+		report.Blobs++
+		report.Size += b.Size
+		report.DiskSize += b.DiskSize
+		p := byPath[b.Path]
+		if p == nil {
+			p = &PathSummary{Path: b.Path}
+			byPath[b.Path] = p
+		}
+		p.Blobs++
+		p.Size += b.Size
+		p.DiskSize += b.DiskSize
+	}
+	for _, p := range byPath {
+		report.Paths = append(report.Paths, *p)
+	}
+	sort.Slice(report.Paths, func(i, j int) bool {
+		if report.Paths[i].DiskSize != report.Paths[j].DiskSize {
+			return report.Paths[i].DiskSize > report.Paths[j].DiskSize
+		}
+		return report.Paths[i].Path < report.Paths[j].Path
+	})
+	if report.RepositorySize, err = repositorySize(ctx); err != nil {
+		return nil, err
+	}
+	if len(binary) > 0 {
+		if report.First, report.Last, err = commitRange(ctx, opts.Extensions, binary); err != nil {
+			return nil, err
+		}
+	}
+	return report, nil
+}
+
+// databaseObjects returns the path of every blob in the history whose name
+// has one of exts, by object ID.
+func databaseObjects(ctx context.Context, exts []string) (map[string]string, error) {
+	cmd := exec.CommandContext(ctx, "git", "rev-list", "--objects", "--all")
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("git rev-list failed: %w", err)
+	}
+	objects := map[string]string{}
+	scanner := bufio.NewScanner(out)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		id, path, ok := strings.Cut(scanner.Text(), " ")
+		if ok && hasExtension(path, exts) {
+			objects[id] = path
+		}
+	}
+	if err := cmd.Wait(); err != nil {
+		return nil, fmt.Errorf("git rev-list failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return objects, scanner.Err()
+}
+
+// hasExtension reports whether path ends with one of exts, ignoring case.
+func hasExtension(path string, exts []string) bool {
+	lower := strings.ToLower(path)
+	for _, ext := range exts {
+		if strings.HasSuffix(lower, strings.ToLower(ext)) {
+			return true
+		}
+	}
+	return false
+}
+
+// binaryBlobs reads the candidates with git cat-file and returns those that
+// are SQLite databases of at least minSize bytes, and the number of others.
+// Only the header of each blob is kept.
+func binaryBlobs(ctx context.Context, candidates map[string]string, minSize int64) ([]Blob, int, error) {
+	if len(candidates) == 0 {
+		return nil, 0, nil
+	}
+	ids := make([]string, 0, len(candidates))
+	for id := range candidates {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	cmd := exec.CommandContext(ctx, "git", "cat-file", "--batch=%(objectname) %(objecttype) %(objectsize) %(objectsize:disk)")
+	cmd.Stdin = strings.NewReader(strings.Join(ids, "\n") + "\n")
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, 0, err
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Start(); err != nil {
+		return nil, 0, fmt.Errorf("git cat-file failed: %w", err)
+	}
+	r := bufio.NewReaderSize(out, 64*1024)
+	var blobs []Blob
+	dumps := 0
+	header := make([]byte, len(databaseHeader))
+	for range ids {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			cmd.Wait()
+			return nil, 0, fmt.Errorf("git cat-file failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 4 {
+			// "<id> missing"
+			continue
+		}
+		size, _ := strconv.ParseInt(fields[2], 10, 64)
+		disk, _ := strconv.ParseInt(fields[3], 10, 64)
+		n, _ := io.ReadFull(r, header[:min(int64(len(header)), size)])
+		if _, err := io.CopyN(io.Discard, r, size-int64(n)+1); err != nil {
+			cmd.Wait()
+			return nil, 0, fmt.Errorf("git cat-file failed: %w", err)
+		}
+		if fields[1] != "blob" {
+			continue
+		}
+		if string(header[:n]) != databaseHeader {
+			dumps++
+			continue
+		}
+		if size >= minSize {
+			blobs = append(blobs, Blob{ID: fields[0], Path: candidates[fields[0]], Size: size, DiskSize: disk})
+		}
+	}
+	if err := cmd.Wait(); err != nil {
+		return nil, 0, fmt.Errorf("git cat-file failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return blobs, dumps, nil
+}
+
+// repositorySize returns the size of the packs and loose objects in bytes.
+func repositorySize(ctx context.Context) (int64, error) {
+	out, err := exec.CommandContext(ctx, "git", "count-objects", "-v").Output()
+	if err != nil {
+		return 0, fmt.Errorf("git count-objects failed: %w", err)
+	}
+	var kib int64
+	for _, line := range strings.Split(string(out), "\n") {
+		key, value, _ := strings.Cut(line, ": ")
+		if key == "size" || key == "size-pack" {
+			n, _ := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+			kib += n
+		}
+	}
+	return kib * 1024, nil
+}
+
+// commitRange returns the oldest and newest commits adding one of the
+// binary blobs.
+func commitRange(ctx context.Context, exts []string, binary map[string]bool) (first, last *Commit, err error) {
+	args := []string{"log", "--all", "--no-renames", "--raw", "--no-abbrev", "--format=commit %H %cs", "--"}
+	for _, ext := range exts {
+		args = append(args, ":(icase)*"+ext)
+	}
+	out, err := exec.CommandContext(ctx, "git", args...).Output()
+	if err != nil {
+		return nil, nil, fmt.Errorf("git log failed: %w", err)
+	}
+	var current Commit
+	for _, line := range strings.Split(string(out), "\n") {
+		if rest, ok := strings.CutPrefix(line, "commit "); ok {
+			current.Hash, current.Date, _ = strings.Cut(rest, " ")
+			continue
+		}
+		// :100644 100644 <old> <new> M<TAB>path
+		fields := strings.Fields(line)
+		if len(fields) < 5 || !strings.HasPrefix(line, ":") || !binary[fields[3]] {
+			continue
+		}
+		// git log lists the newest commits first
+		c := current
+		if last == nil {
+			last = &c
+		}
+		first = &c
+	}
+	return first, last, nil
+}
@@ -0,0 +1,65 @@
+package history
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAnalyze(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	dir := t.TempDir()
+	t.Chdir(dir)
+	git := func(args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", append([]string{"-c", "user.name=t", "-c", "user.email=t@example.com"}, args...)...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+	commit := func(files map[string]string) {
+		t.Helper()
+		for name, content := range files {
+			if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(name, []byte(content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		git("add", "-A")
+		git("commit", "-q", "-m", "change")
+	}
+	git("init", "-q")
+	database := func(fill string) string { return databaseHeader + strings.Repeat(fill, 4096) }
+	commit(map[string]string{"app.db": database("a"), "notes.txt": "x"})
+	commit(map[string]string{"app.db": database("b"), "data/Ref.SQLITE": database("c"), "small.db": databaseHeader})
+	commit(map[string]string{"app.db": "PRAGMA foreign_keys=OFF;\n"})
+
+	report, err := Analyze(context.Background(), Options{Extensions: DefaultExtensions, MinSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Blobs != 3 || report.DumpBlobs != 1 || report.Size != 3*int64(len(database("a"))) {
+		t.Errorf("report = %+v, want 3 binary databases and a dump", report)
+	}
+	if len(report.Paths) != 2 || report.Paths[0].Path != "app.db" || report.Paths[0].Blobs != 2 || report.Paths[1].Path != "data/Ref.SQLITE" {
+		t.Errorf("paths = %+v", report.Paths)
+	}
+	if report.First == nil || report.Last == nil || report.First.Hash == report.Last.Hash {
+		t.Errorf("first %+v, last %+v: want the first and second commit", report.First, report.Last)
+	}
+
+	plans := Plans(report, []string{".db"})
+	if len(plans) != 2 || plans[0].Name != "convert" || plans[1].LFSSize != report.Size {
+		t.Errorf("plans = %+v", plans)
+	}
+	if Plans(&Report{}, DefaultExtensions) != nil {
+		t.Error("plans for a history without binary databases")
+	}
+}
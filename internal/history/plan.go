@@ -0,0 +1,87 @@
+package history
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Plan is a way to rewrite the history without the binary databases.
+type Plan struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// Commands are the shell commands to run, in order, in a fresh clone.
+	Commands []string `json:"commands"`
+	// RepositorySize is the projected size of the object database after
+	// the rewrite and git gc; for a conversion to dumps a lower bound, as
+	// the dumps add their delta-compressed size.
+	RepositorySize int64 `json:"repository_size"`
+	// LFSSize is the storage the Git LFS server needs, 0 if it is not used.
+	LFSSize int64 `json:"lfs_size,omitempty"`
+	// Caveats are what to check before running the commands.
+	Caveats []string `json:"caveats"`
+}
+
+// convertCallback is the git filter-repo blob callback that turns every
+// SQLite database in the history into the dump gitsqlite clean writes.
+const convertCallback = `if blob.data.startswith(b"SQLite format 3\x00"):
+    import subprocess
+    blob.data = subprocess.run(["gitsqlite", "clean"], input=blob.data, stdout=subprocess.PIPE, check=True).stdout`
+
+// Plans returns the ways to rewrite the history r describes, best first, for
+// databases with extensions exts. There are none if r found no binary
+// databases.
+func Plans(r *Report, exts []string) []Plan {
+	if r.Blobs == 0 {
+		return nil
+	}
+	remaining := max(0, r.RepositorySize-r.DiskSize)
+	backup := "git clone --mirror <repository-url> backup.git"
+	cleanup := "git reflog expire --expire=now --all && git gc --prune=now --aggressive"
+	// git filter-repo removes the origin remote, so it cannot be pushed to
+	// by accident
+	push := "git remote add origin <repository-url> 2>/dev/null; git push --force --all origin && git push --force --tags origin"
+	common := []string{
+		"Rewriting history changes every commit hash from the first binary database on: everyone has to clone the repository again, and open pull requests must be recreated.",
+		"Run the commands in a fresh clone and keep the backup until the rewritten repository has been checked.",
+	}
+
+	patterns := make([]string, len(exts))
+	for i, ext := range exts {
+		patterns[i] = "*" + ext
+	}
+	return []Plan{
+		{
+			Name:        "convert",
+			Description: "Turn every binary database in the history into the dump gitsqlite clean writes, as if the filter had been used from the start. The data stays in the history and becomes diffable.",
+			Commands: []string{
+				backup,
+				"git filter-repo --force --blob-callback '\n" + convertCallback + "\n'",
+				cleanup,
+				push,
+			},
+			RepositorySize: remaining,
+			Caveats: append([]string{
+				"Needs git filter-repo (https://github.com/newren/git-filter-repo) and gitsqlite on PATH.",
+				"The callback converts every blob that is a SQLite database, whatever its path; commit .gitattributes with the gitsqlite filter for these paths if the history does not have it yet, or old checkouts contain dumps where the files were databases.",
+				fmt.Sprintf("The projected size leaves out the dumps, which delta-compress well; the current history already holds %d of them.", r.DumpBlobs),
+			}, common...),
+		},
+		{
+			Name:        "lfs",
+			Description: "Move the database files to Git LFS, keeping them binary. The history holds small pointer files instead.",
+			Commands: []string{
+				backup,
+				fmt.Sprintf("git lfs migrate import --everything --include=%q", strings.Join(patterns, ",")),
+				cleanup,
+				"git lfs push --all origin",
+				push,
+			},
+			RepositorySize: remaining,
+			LFSSize:        r.Size,
+			Caveats: append([]string{
+				"Needs Git LFS on every machine working with the repository, and a server that accepts the LFS storage.",
+				"Migrates every file matching the patterns, dumps included, and replaces their attributes with filter=lfs: only for databases that should no longer use the gitsqlite filter.",
+			}, common...),
+		},
+	}
+}
@@ -0,0 +1,153 @@
+// Package links verifies foreign-key-like relationships that span several
+// SQLite databases tracked in the same repository.
+//
+// Relationships are declared in a links file (default .gitsqlitelinks), one
+// per line:
+//
+//	# child-db:table.column -> parent-db:table.column
+//	data/orders.db:orders.customer_id -> data/customers.db:customers.id
+//
+// Database paths are relative to the directory containing the links file.
+package links
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/danielsiegl/gitsqlite/internal/sqlite"
+)
+
+// DefaultFile is the default name of the links declaration file.
+const DefaultFile = ".gitsqlitelinks"
+
+// maxReported limits the number of missing values reported per link.
+const maxReported = 20
+
+// Endpoint identifies a column in a table of a database file.
+type Endpoint struct {
+	Database string
+	Table    string
+	Column   string
+}
+
+func (e Endpoint) String() string {
+	return fmt.Sprintf("%s:%s.%s", e.Database, e.Table, e.Column)
+}
+
+// Link declares that every non-NULL value of Child must exist in Parent.
+type Link struct {
+	Line   int
+	Child  Endpoint
+	Parent Endpoint
+}
+
+// Violation describes child values without a matching parent row.
+type Violation struct {
+	Link Link
+	// Missing holds the first maxReported of the values, in sorted order.
+	Missing []string
+	// Count is the number of distinct values missing.
+	Count int
+}
+
+// Parse reads link declarations. Database paths are resolved against baseDir.
+func Parse(r io.Reader, baseDir string) ([]Link, error) {
+	var links []Link
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		child, parent, ok := strings.Cut(line, "->")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected 'child-db:table.column -> parent-db:table.column'", lineNo)
+		}
+		c, err := parseEndpoint(child, baseDir)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		p, err := parseEndpoint(parent, baseDir)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		links = append(links, Link{Line: lineNo, Child: c, Parent: p})
+	}
+	return links, scanner.Err()
+}
+
+func parseEndpoint(s string, baseDir string) (Endpoint, error) {
+	s = strings.TrimSpace(s)
+	i := strings.LastIndex(s, ":")
+	if i <= 0 {
+		return Endpoint{}, fmt.Errorf("missing database path in %q", s)
+	}
+	table, column, ok := strings.Cut(s[i+1:], ".")
+	if !ok || table == "" || column == "" {
+		return Endpoint{}, fmt.Errorf("expected table.column in %q", s)
+	}
+	db := s[:i]
+	if !filepath.IsAbs(db) {
+		db = filepath.Join(baseDir, db)
+	}
+	return Endpoint{Database: db, Table: table, Column: column}, nil
+}
+
+// Check verifies all links and returns the violated ones.
+func Check(ctx context.Context, eng *sqlite.Engine, links []Link) ([]Violation, error) {
+	var violations []Violation
+	for _, l := range links {
+		missing, count, err := missingValues(ctx, eng, l)
+		if err != nil {
+			return nil, fmt.Errorf("link on line %d (%s -> %s): %w", l.Line, l.Child, l.Parent, err)
+		}
+		if count > 0 {
+			violations = append(violations, Violation{Link: l, Missing: missing, Count: count})
+		}
+	}
+	return violations, nil
+}
+
+// missingValues returns the first maxReported child values that have no
+// matching parent value, and the number of all of them. The parent database
+// is attached to the child session so the comparison runs entirely inside
+// sqlite.
+func missingValues(ctx context.Context, eng *sqlite.Engine, l Link) ([]string, int, error) {
+	attach := "ATTACH DATABASE " + sqlite.QuoteLiteral(l.Parent.Database) + " AS parent_db; "
+	values := fmt.Sprintf(
+		"SELECT DISTINCT c.%s FROM main.%s AS c WHERE c.%s IS NOT NULL "+
+			"AND NOT EXISTS (SELECT 1 FROM parent_db.%s AS p WHERE p.%s = c.%s)",
+		sqlite.QuoteIdent(l.Child.Column), sqlite.QuoteIdent(l.Child.Table), sqlite.QuoteIdent(l.Child.Column),
+		sqlite.QuoteIdent(l.Parent.Table), sqlite.QuoteIdent(l.Parent.Column), sqlite.QuoteIdent(l.Child.Column))
+	rows, err := eng.Query(ctx, l.Child.Database, fmt.Sprintf("%sSELECT count(*) FROM (%s);", attach, values))
+	if err != nil {
+		return nil, 0, err
+	}
+	count := 0
+	if len(rows) > 0 && len(rows[0]) > 0 {
+		if count, err = strconv.Atoi(rows[0][0]); err != nil {
+			return nil, 0, fmt.Errorf("unexpected count %q: %w", rows[0][0], err)
+		}
+	}
+	if count == 0 {
+		return nil, 0, nil
+	}
+	rows, err = eng.Query(ctx, l.Child.Database, fmt.Sprintf("%s%s ORDER BY 1 LIMIT %d;", attach, values, maxReported))
+	if err != nil {
+		return nil, 0, err
+	}
+	missing := make([]string, 0, len(rows))
+	for _, row := range rows {
+		if len(row) > 0 {
+			missing = append(missing, row[0])
+		}
+	}
+	return missing, count, nil
+}
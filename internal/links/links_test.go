@@ -0,0 +1,70 @@
+package links
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/danielsiegl/gitsqlite/internal/sqlite"
+)
+
+func TestParse(t *testing.T) {
+	base := filepath.FromSlash("/repo")
+	declared, err := Parse(strings.NewReader("# orders\n\ndata/orders.db:orders.customer_id -> data/customers.db:customers.id\n"), base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Link{
+		Line:   3,
+		Child:  Endpoint{Database: filepath.Join(base, "data", "orders.db"), Table: "orders", Column: "customer_id"},
+		Parent: Endpoint{Database: filepath.Join(base, "data", "customers.db"), Table: "customers", Column: "id"},
+	}
+	if len(declared) != 1 || declared[0] != want {
+		t.Fatalf("Parse = %+v, want %+v", declared, want)
+	}
+
+	for _, text := range []string{"a.db:t.c", "a.db:t.c -> t.c", "a.db:t -> b.db:t.c"} {
+		if _, err := Parse(strings.NewReader(text), base); err == nil {
+			t.Errorf("Parse(%q) succeeded", text)
+		}
+	}
+}
+
+func TestCheck(t *testing.T) {
+	ctx := context.Background()
+	eng := &sqlite.Engine{Embedded: true}
+	dir := t.TempDir()
+	parent := filepath.Join(dir, "customers.db")
+	child := filepath.Join(dir, "orders.db")
+	if err := eng.Restore(ctx, parent, strings.NewReader("CREATE TABLE customers(id INTEGER PRIMARY KEY);\nINSERT INTO customers VALUES(1),(2);\n")); err != nil {
+		t.Fatal(err)
+	}
+	// Customers 1 and 2 exist, 100 to 124 do not, and 100 is ordered twice
+	script := "CREATE TABLE orders(id INTEGER PRIMARY KEY, customer_id INTEGER);\nINSERT INTO orders(customer_id) VALUES(1),(2),(NULL),(100);\n"
+	for i := 100; i < 125; i++ {
+		script += fmt.Sprintf("INSERT INTO orders(customer_id) VALUES(%d);\n", i)
+	}
+	if err := eng.Restore(ctx, child, strings.NewReader(script)); err != nil {
+		t.Fatal(err)
+	}
+
+	valid := Link{Line: 1, Child: Endpoint{child, "orders", "id"}, Parent: Endpoint{child, "orders", "id"}}
+	broken := Link{Line: 2, Child: Endpoint{child, "orders", "customer_id"}, Parent: Endpoint{parent, "customers", "id"}}
+	violations, err := Check(ctx, eng, []Link{valid, broken})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(violations) != 1 || violations[0].Link != broken {
+		t.Fatalf("violations = %+v, want the link on line 2 only", violations)
+	}
+	v := violations[0]
+	if v.Count != 25 || len(v.Missing) != maxReported || v.Missing[0] != "100" || v.Missing[maxReported-1] != "119" {
+		t.Errorf("violation counts %d values and reports %v, want 25 and 100 to 119", v.Count, v.Missing)
+	}
+
+	if _, err := Check(ctx, eng, []Link{{Line: 3, Child: Endpoint{child, "missing", "id"}, Parent: broken.Parent}}); err == nil || !strings.Contains(err.Error(), "line 3") {
+		t.Errorf("link to a missing table: error %v", err)
+	}
+}
@@ -0,0 +1,319 @@
+// Package lint implements schema quality rules for SQLite databases and
+// schema dumps. Each rule has a default severity that can be overridden, so
+// teams can decide which findings only warn and which fail the run.
+package lint
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/danielsiegl/gitsqlite/internal/filters"
+	"github.com/danielsiegl/gitsqlite/internal/sqlite"
+	"github.com/danielsiegl/gitsqlite/internal/stats"
+)
+
+// Severity controls how a rule's findings are reported.
+type Severity int
+
+const (
+	// Off disables a rule.
+	Off Severity = iota
+	// Warn reports findings without failing.
+	Warn
+	// Fail reports findings and makes the lint run fail.
+	Fail
+)
+
+// String returns the lower-case name of the severity.
+func (s Severity) String() string {
+	switch s {
+	case Warn:
+		return "warn"
+	case Fail:
+		return "fail"
+	default:
+		return "off"
+	}
+}
+
+// ParseSeverity parses "off", "warn" or "fail".
+func ParseSeverity(s string) (Severity, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "off":
+		return Off, nil
+	case "warn":
+		return Warn, nil
+	case "fail":
+		return Fail, nil
+	}
+	return Off, fmt.Errorf("unknown lint severity %q (expected off, warn or fail)", s)
+}
+
+// Finding is a single rule violation.
+type Finding struct {
+	Rule     string
+	Severity Severity
+	Object   string
+	Message  string
+}
+
+// Schema is the input to the lint rules.
+type Schema struct {
+	Tables  []*filters.CreateTable
+	Indexes []*filters.CreateIndex
+	// RowCounts holds the number of rows per table, keyed by lower-case
+	// name like SQLite looks up tables. It is nil when linting a schema file,
+	// in which case rules depending on data are skipped.
+	RowCounts map[string]int64
+}
+
+// Rule is a single lint check.
+type Rule struct {
+	ID          string
+	Description string
+	Default     Severity
+	Check       func(*Schema) []Finding
+}
+
+// Rules is the list of all available rules.
+var Rules = []Rule{
+	{
+		ID:          "no-primary-key",
+		Description: "table without primary key",
+		Default:     Warn,
+		Check:       checkNoPrimaryKey,
+	},
+	{
+		ID:          "column-without-type",
+		Description: "column declared without a type",
+		Default:     Warn,
+		Check:       checkColumnWithoutType,
+	},
+	{
+		ID:          "index-on-empty-table",
+		Description: "index on a table that has no rows",
+		Default:     Warn,
+		Check:       checkIndexOnEmptyTable,
+	},
+	{
+		ID:          "unindexed-foreign-key",
+		Description: "foreign key column without a supporting index",
+		Default:     Off,
+		Check:       checkUnindexedForeignKey,
+	},
+}
+
+// Config maps rule IDs to severities overriding the rule defaults.
+type Config map[string]Severity
+
+// ParseConfig parses a comma-separated list of rule=severity pairs,
+// e.g. "no-primary-key=fail,column-without-type=off".
+func ParseConfig(spec string) (Config, error) {
+	cfg := Config{}
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		id, sev, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid lint rule setting %q (expected rule=severity)", part)
+		}
+		if !knownRule(id) {
+			return nil, fmt.Errorf("unknown lint rule %q", id)
+		}
+		severity, err := ParseSeverity(sev)
+		if err != nil {
+			return nil, err
+		}
+		cfg[id] = severity
+	}
+	return cfg, nil
+}
+
+func knownRule(id string) bool {
+	for _, r := range Rules {
+		if r.ID == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Run evaluates all enabled rules and returns their findings sorted by rule
+// and object.
+func Run(s *Schema, cfg Config) []Finding {
+	var findings []Finding
+	for _, rule := range Rules {
+		severity := rule.Default
+		if override, ok := cfg[rule.ID]; ok {
+			severity = override
+		}
+		if severity == Off {
+			continue
+		}
+		for _, f := range rule.Check(s) {
+			f.Rule = rule.ID
+			f.Severity = severity
+			findings = append(findings, f)
+		}
+	}
+	sort.SliceStable(findings, func(i, j int) bool {
+		if findings[i].Rule != findings[j].Rule {
+			return findings[i].Rule < findings[j].Rule
+		}
+		return findings[i].Object < findings[j].Object
+	})
+	return findings
+}
+
+// Failed reports whether any finding has severity Fail.
+func Failed(findings []Finding) bool {
+	for _, f := range findings {
+		if f.Severity == Fail {
+			return true
+		}
+	}
+	return false
+}
+
+// Print writes findings in a human-readable, column-aligned form.
+func Print(w io.Writer, findings []Finding) {
+	for _, f := range findings {
+		fmt.Fprintf(w, "%-5s %-22s %s: %s\n", f.Severity, f.Rule, f.Object, f.Message)
+	}
+	fmt.Fprintf(w, "%d finding(s)\n", len(findings))
+}
+
+// LoadSchema parses CREATE TABLE and CREATE INDEX statements from a schema
+// dump. Other statements are ignored.
+func LoadSchema(r io.Reader) (*Schema, error) {
+	s := &Schema{}
+	scanner := filters.NewStatementScanner(r)
+	for scanner.Scan() {
+		stmt := strings.TrimSpace(scanner.Text())
+		upper := strings.ToUpper(stmt)
+		switch {
+		case strings.HasPrefix(upper, "CREATE TABLE"), strings.HasPrefix(upper, "CREATE TEMP TABLE"):
+			ct, err := filters.ParseCreateTable(stmt)
+			if err != nil {
+				continue
+			}
+			s.Tables = append(s.Tables, ct)
+		case strings.HasPrefix(upper, "CREATE INDEX"), strings.HasPrefix(upper, "CREATE UNIQUE INDEX"):
+			idx, err := filters.ParseCreateIndex(stmt)
+			if err != nil {
+				continue
+			}
+			s.Indexes = append(s.Indexes, idx)
+		}
+	}
+	return s, scanner.Err()
+}
+
+// LoadDatabase reads the schema and per-table row counts of a database.
+func LoadDatabase(ctx context.Context, eng *sqlite.Engine, dbPath string) (*Schema, error) {
+	var buf bytes.Buffer
+	if err := filters.DumpSchema(ctx, eng, dbPath, &buf, filters.DefaultOptions()); err != nil {
+		return nil, err
+	}
+	s, err := LoadSchema(&buf)
+	if err != nil {
+		return nil, err
+	}
+	db, err := stats.Collect(ctx, eng, dbPath, stats.Options{})
+	if err != nil {
+		return nil, err
+	}
+	s.RowCounts = map[string]int64{}
+	for name, n := range db.RowCounts() {
+		s.RowCounts[strings.ToLower(name)] = n
+	}
+	return s, nil
+}
+
+func checkNoPrimaryKey(s *Schema) []Finding {
+	var findings []Finding
+	for _, t := range s.Tables {
+		if !t.HasPrimaryKey() {
+			findings = append(findings, Finding{Object: "table " + t.TableName(), Message: "table has no primary key"})
+		}
+	}
+	return findings
+}
+
+func checkColumnWithoutType(s *Schema) []Finding {
+	var findings []Finding
+	for _, t := range s.Tables {
+		for _, col := range t.Columns {
+			if len(col.Type) == 0 {
+				findings = append(findings, Finding{
+					Object:  "column " + t.TableName() + "." + filters.UnquoteIdent(col.Name.Text),
+					Message: "column has no declared type",
+				})
+			}
+		}
+	}
+	return findings
+}
+
+func checkIndexOnEmptyTable(s *Schema) []Finding {
+	if s.RowCounts == nil {
+		return nil
+	}
+	var findings []Finding
+	for _, idx := range s.Indexes {
+		if n, ok := s.RowCounts[strings.ToLower(idx.Table)]; ok && n == 0 {
+			findings = append(findings, Finding{
+				Object:  "index " + idx.Name,
+				Message: fmt.Sprintf("index on table %s which has no rows", idx.Table),
+			})
+		}
+	}
+	return findings
+}
+
+func checkUnindexedForeignKey(s *Schema) []Finding {
+	leading := map[string]bool{}
+	for _, idx := range s.Indexes {
+		if len(idx.Columns) > 0 {
+			leading[strings.ToLower(idx.Table+"."+idx.Columns[0])] = true
+		}
+	}
+	var findings []Finding
+	for _, t := range s.Tables {
+		for _, col := range foreignKeyColumns(t) {
+			if !leading[strings.ToLower(t.TableName()+"."+col)] {
+				findings = append(findings, Finding{
+					Object:  "column " + t.TableName() + "." + col,
+					Message: "foreign key column is not the leading column of any index",
+				})
+			}
+		}
+	}
+	return findings
+}
+
+// foreignKeyColumns returns the first child column of every foreign key.
+func foreignKeyColumns(t *filters.CreateTable) []string {
+	var cols []string
+	for _, col := range t.Columns {
+		for _, c := range col.Constraints {
+			if c.Tokens[0].Is("REFERENCES") {
+				cols = append(cols, filters.UnquoteIdent(col.Name.Text))
+			}
+		}
+	}
+	for _, c := range t.Constraints {
+		for i := 0; i+3 < len(c); i++ {
+			if c[i].Is("FOREIGN") && c[i+1].Is("KEY") && c[i+2].Text == "(" {
+				cols = append(cols, filters.UnquoteIdent(c[i+3].Text))
+			}
+		}
+	}
+	return cols
+}
@@ -0,0 +1,92 @@
+package lint
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/danielsiegl/gitsqlite/internal/sqlite"
+)
+
+// objects returns the rule and object of findings, one per line.
+func objects(findings []Finding) string {
+	var lines []string
+	for _, f := range findings {
+		lines = append(lines, f.Rule+" "+f.Object)
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestRules(t *testing.T) {
+	schema := "CREATE TABLE parent(id INTEGER PRIMARY KEY, name TEXT);\n" +
+		"CREATE TABLE child(id INTEGER PRIMARY KEY, parent_id INTEGER REFERENCES parent(id), note);\n" +
+		"CREATE TABLE log(at TEXT, other_id INTEGER, FOREIGN KEY(other_id) REFERENCES parent(id));\n" +
+		"CREATE INDEX log_other ON log(other_id);\n" +
+		"CREATE INDEX parent_name ON parent(name);\n"
+	s, err := LoadSchema(strings.NewReader(schema))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Tables) != 3 || len(s.Indexes) != 2 {
+		t.Fatalf("loaded %d tables and %d indexes", len(s.Tables), len(s.Indexes))
+	}
+
+	// Without row counts the data rules are skipped
+	cfg := Config{"unindexed-foreign-key": Fail}
+	want := "column-without-type column child.note\n" +
+		"no-primary-key table log\n" +
+		"unindexed-foreign-key column child.parent_id"
+	findings := Run(s, cfg)
+	if got := objects(findings); got != want {
+		t.Errorf("findings:\n%s\nwant:\n%s", got, want)
+	}
+	if !Failed(findings) {
+		t.Error("a finding of a rule set to fail does not fail the run")
+	}
+
+	s.RowCounts = map[string]int64{"parent": 0, "child": 2, "log": 1}
+	findings = Run(s, Config{"column-without-type": Off, "no-primary-key": Off})
+	if got := objects(findings); got != "index-on-empty-table index parent_name" {
+		t.Errorf("findings with row counts:\n%s", got)
+	}
+	if Failed(findings) {
+		t.Error("warnings fail the run")
+	}
+}
+
+func TestIndexOnEmptyTableIgnoresCase(t *testing.T) {
+	ctx := context.Background()
+	eng := &sqlite.Engine{Embedded: true}
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	script := "CREATE TABLE Foo(x INTEGER PRIMARY KEY);\n" +
+		"CREATE INDEX foo_x ON foo(x);\n" +
+		"CREATE TABLE bar(x INTEGER PRIMARY KEY);\n" +
+		"CREATE INDEX bar_x ON BAR(x);\n" +
+		"INSERT INTO bar VALUES(1);\n"
+	if err := eng.Restore(ctx, dbPath, strings.NewReader(script)); err != nil {
+		t.Fatal(err)
+	}
+	s, err := LoadDatabase(ctx, eng, dbPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := objects(Run(s, nil)); got != "index-on-empty-table index foo_x" {
+		t.Errorf("findings:\n%s\nwant the index on the empty table Foo", got)
+	}
+}
+
+func TestParseConfig(t *testing.T) {
+	cfg, err := ParseConfig(" no-primary-key=fail , column-without-type=OFF,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg["no-primary-key"] != Fail || cfg["column-without-type"] != Off || len(cfg) != 2 {
+		t.Errorf("ParseConfig = %v", cfg)
+	}
+	for _, spec := range []string{"no-primary-key", "unknown-rule=warn", "no-primary-key=loud"} {
+		if _, err := ParseConfig(spec); err == nil {
+			t.Errorf("ParseConfig(%q) succeeded", spec)
+		}
+	}
+}
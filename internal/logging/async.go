@@ -0,0 +1,97 @@
+package logging
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+)
+
+// queueSize is the number of records the async handler buffers before it
+// starts dropping them.
+const queueSize = 4096
+
+// asyncHandler hands records to a goroutine that formats and writes them, so
+// logging on the hot path of clean and smudge never waits for file I/O. When
+// the queue is full, debug and info records are dropped and counted; warnings
+// and errors wait for room, so they are never lost.
+type asyncHandler struct {
+	inner slog.Handler
+	sink  *asyncSink
+}
+
+// asyncSink is the queue and writer goroutine shared by an asyncHandler and
+// the handlers derived from it with WithAttrs and WithGroup.
+type asyncSink struct {
+	mu      sync.RWMutex
+	closed  bool
+	queue   chan asyncRecord
+	done    chan struct{}
+	dropped atomic.Int64
+}
+
+type asyncRecord struct {
+	handler slog.Handler
+	record  slog.Record
+}
+
+// newAsyncHandler returns an asyncHandler writing through inner. flush is
+// called whenever the queue runs empty.
+func newAsyncHandler(inner slog.Handler, flush func()) *asyncHandler {
+	sink := &asyncSink{queue: make(chan asyncRecord, queueSize), done: make(chan struct{})}
+	go func() {
+		defer close(sink.done)
+		for rec := range sink.queue {
+			_ = rec.handler.Handle(context.Background(), rec.record)
+			if len(sink.queue) == 0 {
+				flush()
+			}
+		}
+	}()
+	return &asyncHandler{inner: inner, sink: sink}
+}
+
+func (h *asyncHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.inner.Enabled(ctx, level)
+}
+
+func (h *asyncHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.sink.mu.RLock()
+	defer h.sink.mu.RUnlock()
+	if h.sink.closed {
+		// Records logged while exiting are written directly
+		return h.inner.Handle(ctx, r)
+	}
+	rec := asyncRecord{handler: h.inner, record: r.Clone()}
+	if r.Level >= slog.LevelWarn {
+		h.sink.queue <- rec
+		return nil
+	}
+	select {
+	case h.sink.queue <- rec:
+	default:
+		h.sink.dropped.Add(1)
+	}
+	return nil
+}
+
+func (h *asyncHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &asyncHandler{inner: h.inner.WithAttrs(attrs), sink: h.sink}
+}
+
+func (h *asyncHandler) WithGroup(name string) slog.Handler {
+	return &asyncHandler{inner: h.inner.WithGroup(name), sink: h.sink}
+}
+
+// close writes the queued records and switches the handler to writing
+// directly. It returns the number of dropped records.
+func (h *asyncHandler) close() int64 {
+	h.sink.mu.Lock()
+	if !h.sink.closed {
+		h.sink.closed = true
+		close(h.sink.queue)
+	}
+	h.sink.mu.Unlock()
+	<-h.sink.done
+	return h.sink.dropped.Load()
+}
@@ -0,0 +1,52 @@
+package logging
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"testing"
+)
+
+// recordingHandler records messages, waiting for release before the first.
+type recordingHandler struct {
+	mu       sync.Mutex
+	release  chan struct{}
+	messages []string
+}
+
+func (h *recordingHandler) Enabled(context.Context, slog.Level) bool { return true }
+func (h *recordingHandler) WithAttrs([]slog.Attr) slog.Handler       { return h }
+func (h *recordingHandler) WithGroup(string) slog.Handler            { return h }
+
+func (h *recordingHandler) Handle(_ context.Context, r slog.Record) error {
+	<-h.release
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.messages = append(h.messages, r.Message)
+	return nil
+}
+
+func TestAsyncHandlerDropsWhenFull(t *testing.T) {
+	inner := &recordingHandler{release: make(chan struct{})}
+	h := newAsyncHandler(inner, func() {})
+	logger := slog.New(h)
+
+	// The writer is stuck on the first record, so the queue fills up
+	for i := 0; i < queueSize+10; i++ {
+		logger.Debug("debug")
+	}
+	close(inner.release)
+	logger.Error("error")
+	dropped := h.close()
+	logger.Info("after close")
+
+	if dropped < 9 {
+		t.Errorf("dropped = %d, want at least 9", dropped)
+	}
+	if got, want := int64(len(inner.messages))+dropped, int64(queueSize+12); got != want {
+		t.Errorf("written + dropped = %d, want %d", got, want)
+	}
+	if n := len(inner.messages); inner.messages[n-2] != "error" || inner.messages[n-1] != "after close" {
+		t.Errorf("last messages = %q", inner.messages[n-2:])
+	}
+}
@@ -0,0 +1,103 @@
+package logging
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/danielsiegl/gitsqlite/internal/version"
+)
+
+// recentLines is the number of log lines kept for crash reports.
+const recentLines = 50
+
+// recent keeps the last log lines of this process, also when logging to a
+// file is off, so a crash report can show what happened before the crash.
+var recent = &ringWriter{max: recentLines}
+
+// ringWriter keeps the last max lines written to it. The JSON handler writes
+// one record per Write call.
+type ringWriter struct {
+	mu    sync.Mutex
+	max   int
+	lines []string
+}
+
+func (r *ringWriter) Write(p []byte) (int, error) {
+	line := strings.TrimRight(string(p), "\n")
+	r.mu.Lock()
+	if len(r.lines) == r.max {
+		copy(r.lines, r.lines[1:])
+		r.lines = r.lines[:r.max-1]
+	}
+	r.lines = append(r.lines, line)
+	r.mu.Unlock()
+	return len(p), nil
+}
+
+func (r *ringWriter) snapshot() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.lines...)
+}
+
+// CrashReport describes a panic, for a bug report.
+type CrashReport struct {
+	Time      string            `json:"time"`
+	Panic     string            `json:"panic"`
+	Stack     string            `json:"stack"`
+	Args      []string          `json:"args"`
+	Version   map[string]string `json:"version"`
+	LastLog   []json.RawMessage `json:"last_log_lines"`
+	GoVersion string            `json:"go_version"`
+	Platform  string            `json:"platform"`
+}
+
+// WriteCrashReport writes a crash report for the panic value with stack to a
+// new file in dir and returns its path. It includes the last records logged
+// by this process. Call it after the logger's cleanup function, so that the
+// records still queued for the log file are included.
+func WriteCrashReport(dir string, value any, stack []byte) (string, error) {
+	now := time.Now().UTC()
+	report := CrashReport{
+		Time:  now.Format(time.RFC3339Nano),
+		Panic: fmt.Sprint(value),
+		Stack: string(stack),
+		Args:  os.Args,
+		Version: map[string]string{
+			"version":    version.Version,
+			"commit":     version.GitCommit,
+			"branch":     version.GitBranch,
+			"build_time": version.BuildTime,
+		},
+		GoVersion: runtime.Version(),
+		Platform:  runtime.GOOS + "/" + runtime.GOARCH,
+	}
+	for _, line := range recent.snapshot() {
+		if json.Valid([]byte(line)) {
+			report.LastLog = append(report.LastLog, json.RawMessage(line))
+		}
+	}
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, fmt.Sprintf("gitsqlite_crash_%s_%d.json",
+		now.Format("20060102T150405.000Z07:00"), os.Getpid()))
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return "", err
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		path = abs
+	}
+	return path, nil
+}
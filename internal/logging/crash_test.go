@@ -0,0 +1,18 @@
+package logging
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRingWriterKeepsLastLines(t *testing.T) {
+	r := &ringWriter{max: 3}
+	for i := 1; i <= 5; i++ {
+		fmt.Fprintf(r, "{\"n\":%d}\n", i)
+	}
+	got := r.snapshot()
+	want := []string{`{"n":3}`, `{"n":4}`, `{"n":5}`}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("snapshot() = %v, want %v", got, want)
+	}
+}
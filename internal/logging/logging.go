@@ -1,37 +1,85 @@
 package logging
 
 import (
+	"bufio"
+	"context"
 	"fmt"
 	"io"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/danielsiegl/gitsqlite/internal/gitdir"
 	"github.com/google/uuid"
 )
 
-// Setup configures a JSON slog logger.
+// RepoDir returns the log directory of the repository containing the current
+// working directory, <git-dir>/gitsqlite/logs, where log files can never be
+// committed by accident.
+func RepoDir(ctx context.Context) (string, error) {
+	return gitdir.Dir(ctx, "logs")
+}
+
+// EnvLevel is the environment variable that overrides -log-level, so a run
+// started by git can log at debug level without changing the filter command.
+const EnvLevel = "GITSQLITE_LOG_LEVEL"
+
+// ParseLevel parses a log level: debug, info, warn or error.
+func ParseLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn", "warning":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return 0, fmt.Errorf("invalid log level %q (expected debug, info, warn or error)", s)
+}
+
+// Setup configures a JSON slog logger that writes records of level and above.
 // logDir:
 //
 //	""       -> discard
 //	"stderr" -> stderr
-//	other    -> file in that directory
-func Setup(logDir string) (*slog.Logger, func()) {
+//	other    -> file in that directory, which is created if needed
+//
+// Old log files in the directory are removed as retention allows (see
+// Prune). Records for a log file are formatted and written by a background goroutine
+// (see asyncHandler); the returned cleanup function writes the pending ones,
+// notes how many were dropped and closes the file. It must run before the
+// process exits and may be called more than once.
+func Setup(logDir string, level slog.Level, retention Retention) (*slog.Logger, func()) {
 	var w io.Writer
-	cleanup := func() {}
+	var pruned []string
+	var async *asyncHandler
+	var flush func()
+	var closeFile func()
 
 	if logDir != "" && logDir != "stderr" {
 		fn := filepath.Join(logDir, fmt.Sprintf("gitsqlite_%s_%d_%s.log",
 			time.Now().UTC().Format("20060102T150405.000Z07:00"),
 			os.Getpid(), uuid.NewString()))
 		f, err := os.OpenFile(fn, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+		if os.IsNotExist(err) {
+			if err = os.MkdirAll(logDir, 0o755); err == nil {
+				f, err = os.OpenFile(fn, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+			}
+		}
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Warning: Failed to create log file %s: %v\n", fn, err)
 			w = os.Stderr
 		} else {
-			w = f
-			cleanup = func() { _ = f.Sync(); _ = f.Close() }
+			bw := bufio.NewWriterSize(f, 64*1024)
+			w = bw
+			flush = func() { _ = bw.Flush() }
+			closeFile = func() { _ = bw.Flush(); _ = f.Sync(); _ = f.Close() }
+			pruned = Prune(logDir, retention, fn, time.Now())
 		}
 	} else if logDir == "stderr" {
 		w = os.Stderr
@@ -40,12 +88,49 @@ func Setup(logDir string) (*slog.Logger, func()) {
 	}
 
 	lv := new(slog.LevelVar)
-	lv.Set(slog.LevelDebug)
-	logger := slog.New(slog.NewJSONHandler(w, &slog.HandlerOptions{Level: lv})).
+	lv.Set(level)
+	// Keep the last lines for crash reports (see WriteCrashReport)
+	var handler slog.Handler = slog.NewJSONHandler(io.MultiWriter(recent, w), &slog.HandlerOptions{Level: lv})
+	if closeFile != nil {
+		async = newAsyncHandler(handler, flush)
+		handler = async
+	}
+	logger := slog.New(handler).
 		With("invocation_id", uuid.NewString(), "pid", os.Getpid())
+	if len(pruned) > 0 {
+		logger.Info("Removed old log files", "count", len(pruned), "dir", logDir)
+	}
+
+	var once sync.Once
+	cleanup := func() {
+		once.Do(func() {
+			if async == nil {
+				return
+			}
+			if dropped := async.close(); dropped > 0 {
+				logger.Warn("Log records dropped because the log queue was full", "dropped", dropped)
+			}
+			closeFile()
+		})
+	}
 	return logger, cleanup
 }
 
+// FormatBytes formats n with a binary unit, such as "45.2 MB".
+func FormatBytes(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	value, unit := float64(n)/1024, "KB"
+	for _, u := range []string{"MB", "GB", "TB"} {
+		if value < 1024 {
+			break
+		}
+		value, unit = value/1024, u
+	}
+	return fmt.Sprintf("%.1f %s", value, unit)
+}
+
 // FormatDuration formats a duration as HH:MM:SS.mmm for human-readable logging
 func FormatDuration(d time.Duration) string {
 	hours := int(d.Hours())
@@ -0,0 +1,69 @@
+package logging
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseLevel(t *testing.T) {
+	tests := map[string]slog.Level{
+		"debug":   slog.LevelDebug,
+		"INFO":    slog.LevelInfo,
+		" warn ":  slog.LevelWarn,
+		"warning": slog.LevelWarn,
+		"error":   slog.LevelError,
+	}
+	for s, want := range tests {
+		if got, err := ParseLevel(s); err != nil || got != want {
+			t.Errorf("ParseLevel(%q) = %v, %v, want %v", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "trace", "4"} {
+		if _, err := ParseLevel(s); err == nil {
+			t.Errorf("ParseLevel(%q) succeeded", s)
+		}
+	}
+}
+
+func TestPrune(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	var files []string
+	for i, age := range []time.Duration{40 * 24 * time.Hour, 5 * time.Hour, 4 * time.Hour, 3 * time.Hour, 2 * time.Hour, time.Hour} {
+		path := filepath.Join(dir, fmt.Sprintf("gitsqlite_2026050%dT000000.000Z_1_x.log", i+1))
+		if err := os.WriteFile(path, make([]byte, 100), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, now.Add(-age), now.Add(-age)); err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, path)
+	}
+	crash := filepath.Join(dir, "crash.json")
+	if err := os.WriteFile(crash, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	removed := Prune(dir, Retention{MaxAge: 30 * 24 * time.Hour}, files[5], now)
+	if len(removed) != 1 || removed[0] != files[0] {
+		t.Errorf("MaxAge removed %v, want %v", removed, files[:1])
+	}
+	removed = Prune(dir, Retention{MaxFiles: 4, MaxSize: 350}, files[5], now)
+	if len(removed) != 2 || removed[0] != files[2] || removed[1] != files[1] {
+		t.Errorf("MaxFiles and MaxSize removed %v, want %v", removed, []string{files[2], files[1]})
+	}
+	// The running invocation's file is kept even if it is over the limits
+	if removed := Prune(dir, Retention{MaxFiles: 1, MaxSize: 1}, files[3], now); len(removed) != 2 {
+		t.Errorf("removed %v, want all but %s", removed, files[3])
+	}
+	if left, _ := ListSessions(dir); len(left) != 1 || left[0] != files[3] {
+		t.Errorf("left %v", left)
+	}
+	if _, err := os.Stat(crash); err != nil {
+		t.Errorf("crash report removed: %v", err)
+	}
+}
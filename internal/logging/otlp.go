@@ -0,0 +1,377 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Environment variables of the OpenTelemetry exporter specification read by
+// NewTelemetry, so gitsqlite picks up the configuration a build farm already
+// sets for its other tools.
+const (
+	EnvOTLPEndpoint       = "OTEL_EXPORTER_OTLP_ENDPOINT"
+	EnvOTLPHeaders        = "OTEL_EXPORTER_OTLP_HEADERS"
+	EnvOTLPTimeout        = "OTEL_EXPORTER_OTLP_TIMEOUT"
+	EnvServiceName        = "OTEL_SERVICE_NAME"
+	EnvResourceAttributes = "OTEL_RESOURCE_ATTRIBUTES"
+)
+
+// DefaultOTLPTimeout bounds an export. It is shorter than the specification's
+// 10s: git waits for the filter, and a collector that does not answer must
+// not hold up every checkout.
+const DefaultOTLPTimeout = 2 * time.Second
+
+// Telemetry exports runs to an OpenTelemetry collector with OTLP over HTTP,
+// in its JSON encoding: a trace with a span for the run and one for each of
+// its stages, and counters for the bytes and rows it processed.
+type Telemetry struct {
+	// Endpoint is the base URL of the collector; traces are sent to
+	// Endpoint/v1/traces and metrics to Endpoint/v1/metrics.
+	Endpoint string
+	// Headers are added to every request, e.g. for authentication.
+	Headers map[string]string
+	// Resource are the attributes describing the process, service.name
+	// included.
+	Resource map[string]string
+	Timeout  time.Duration
+	Client   *http.Client
+}
+
+// Run is what Telemetry exports about a filter run.
+type Run struct {
+	Operation string
+	Start     time.Time
+	End       time.Time
+	// OK is false if the run failed.
+	OK          bool
+	InputBytes  int64
+	OutputBytes int64
+	Rows        int64
+	Stages      []RunStage
+}
+
+// RunStage is a stage of a run, such as copy, dump or restore.
+type RunStage struct {
+	Name     string
+	End      time.Time
+	Duration time.Duration
+}
+
+// NewTelemetry returns the exporter to endpoint, or to the one in
+// OTEL_EXPORTER_OTLP_ENDPOINT if endpoint is empty; nil if neither is set.
+// version is reported as service.version.
+func NewTelemetry(endpoint, version string) (*Telemetry, error) {
+	if endpoint == "" {
+		endpoint = os.Getenv(EnvOTLPEndpoint)
+	}
+	if endpoint == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid OTLP endpoint %q (expected an http or https URL)", endpoint)
+	}
+	t := &Telemetry{
+		Endpoint: strings.TrimSuffix(endpoint, "/"),
+		Timeout:  DefaultOTLPTimeout,
+		Client:   http.DefaultClient,
+	}
+	if t.Headers, err = parseKeyValues(os.Getenv(EnvOTLPHeaders)); err != nil {
+		return nil, fmt.Errorf("%s: %w", EnvOTLPHeaders, err)
+	}
+	if t.Resource, err = parseKeyValues(os.Getenv(EnvResourceAttributes)); err != nil {
+		return nil, fmt.Errorf("%s: %w", EnvResourceAttributes, err)
+	}
+	if s := os.Getenv(EnvOTLPTimeout); s != "" {
+		ms, err := strconv.Atoi(s)
+		if err != nil || ms <= 0 {
+			return nil, fmt.Errorf("%s: invalid timeout %q (expected milliseconds)", EnvOTLPTimeout, s)
+		}
+		t.Timeout = time.Duration(ms) * time.Millisecond
+	}
+	t.Resource["service.name"] = "gitsqlite"
+	if name := os.Getenv(EnvServiceName); name != "" {
+		t.Resource["service.name"] = name
+	}
+	t.Resource["service.version"] = version
+	t.Resource["process.pid"] = strconv.Itoa(os.Getpid())
+	if host, err := os.Hostname(); err == nil {
+		t.Resource["host.name"] = host
+	}
+	return t, nil
+}
+
+// parseKeyValues parses a comma-separated list of key=value pairs with
+// URL-encoded values, the format of OTEL_EXPORTER_OTLP_HEADERS and
+// OTEL_RESOURCE_ATTRIBUTES.
+func parseKeyValues(s string) (map[string]string, error) {
+	values := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(pair, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid entry %q (expected key=value)", pair)
+		}
+		decoded, err := url.QueryUnescape(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %s: %w", key, err)
+		}
+		values[key] = decoded
+	}
+	return values, nil
+}
+
+// Export sends the trace and the metrics of run. Both requests are made
+// within the timeout; the first failure is returned.
+func (t *Telemetry) Export(ctx context.Context, run Run) error {
+	ctx, cancel := context.WithTimeout(ctx, t.Timeout)
+	defer cancel()
+	traceErr := t.post(ctx, "/v1/traces", t.traces(run))
+	metricsErr := t.post(ctx, "/v1/metrics", t.metrics(run))
+	if traceErr != nil {
+		return traceErr
+	}
+	return metricsErr
+}
+
+// post sends body as JSON to path under the endpoint.
+func (t *Telemetry) post(ctx context.Context, path string, body any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.Endpoint+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range t.Headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := t.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s: %s: %s", req.URL, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+// The OTLP/JSON messages, as far as gitsqlite uses them. 64-bit integers
+// are strings, as in the protobuf JSON mapping.
+
+// otlpValue is an AnyValue: {"stringValue": ...} or {"intValue": ...}.
+type otlpValue map[string]string
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpStatus struct {
+	// Code is 1 for ok, 2 for error.
+	Code int `json:"code"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpTraces struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpDataPoint struct {
+	Attributes        []otlpAttribute `json:"attributes"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	TimeUnixNano      string          `json:"timeUnixNano"`
+	AsInt             string          `json:"asInt"`
+}
+
+type otlpSum struct {
+	DataPoints []otlpDataPoint `json:"dataPoints"`
+	// AggregationTemporality is 1 for delta: each run reports what it
+	// added.
+	AggregationTemporality int  `json:"aggregationTemporality"`
+	IsMonotonic            bool `json:"isMonotonic"`
+}
+
+type otlpMetric struct {
+	Name        string  `json:"name"`
+	Description string  `json:"description"`
+	Unit        string  `json:"unit"`
+	Sum         otlpSum `json:"sum"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpMetrics struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+// scopeName is the instrumentation scope of everything gitsqlite exports.
+const scopeName = "github.com/danielsiegl/gitsqlite"
+
+// traces returns the trace of run: a span "gitsqlite <operation>" and a
+// child span for each stage, ending when the stage was recorded.
+func (t *Telemetry) traces(run Run) otlpTraces {
+	traceID := randomID(16)
+	rootID := randomID(8)
+	status := otlpStatus{Code: 1}
+	if !run.OK {
+		status.Code = 2
+	}
+	operation := []otlpAttribute{attribute("gitsqlite.operation", run.Operation)}
+	spans := []otlpSpan{{
+		TraceID:           traceID,
+		SpanID:            rootID,
+		Name:              "gitsqlite " + run.Operation,
+		Kind:              1, // internal
+		StartTimeUnixNano: unixNano(run.Start),
+		EndTimeUnixNano:   unixNano(run.End),
+		Attributes: append(operation,
+			intAttribute("gitsqlite.input_bytes", run.InputBytes),
+			intAttribute("gitsqlite.output_bytes", run.OutputBytes),
+			intAttribute("gitsqlite.rows", run.Rows)),
+		Status: status,
+	}}
+	for _, stage := range run.Stages {
+		spans = append(spans, otlpSpan{
+			TraceID:           traceID,
+			SpanID:            randomID(8),
+			ParentSpanID:      rootID,
+			Name:              stage.Name,
+			Kind:              1,
+			StartTimeUnixNano: unixNano(stage.End.Add(-stage.Duration)),
+			EndTimeUnixNano:   unixNano(stage.End),
+			Attributes:        operation,
+			Status:            otlpStatus{Code: 1},
+		})
+	}
+	return otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource:   t.resource(),
+		ScopeSpans: []otlpScopeSpans{{Scope: t.scope(), Spans: spans}},
+	}}}
+}
+
+// metrics returns the counters of run, as deltas over the run with the
+// operation and whether it failed as attributes.
+func (t *Telemetry) metrics(run Run) otlpMetrics {
+	attributes := []otlpAttribute{
+		attribute("gitsqlite.operation", run.Operation),
+		attribute("gitsqlite.status", map[bool]string{true: "ok", false: "error"}[run.OK]),
+	}
+	counter := func(name, description, unit string, value int64) otlpMetric {
+		return otlpMetric{Name: name, Description: description, Unit: unit, Sum: otlpSum{
+			DataPoints: []otlpDataPoint{{
+				Attributes:        attributes,
+				StartTimeUnixNano: unixNano(run.Start),
+				TimeUnixNano:      unixNano(run.End),
+				AsInt:             strconv.FormatInt(value, 10),
+			}},
+			AggregationTemporality: 1,
+			IsMonotonic:            true,
+		}}
+	}
+	return otlpMetrics{ResourceMetrics: []otlpResourceMetrics{{
+		Resource: t.resource(),
+		ScopeMetrics: []otlpScopeMetrics{{Scope: t.scope(), Metrics: []otlpMetric{
+			counter("gitsqlite.runs", "Filter runs", "{run}", 1),
+			counter("gitsqlite.input", "Bytes read by filter runs", "By", run.InputBytes),
+			counter("gitsqlite.output", "Bytes written by filter runs", "By", run.OutputBytes),
+			counter("gitsqlite.rows", "Rows dumped or restored by filter runs", "{row}", run.Rows),
+		}}},
+	}}}
+}
+
+// scope returns the instrumentation scope, versioned like the service.
+func (t *Telemetry) scope() otlpScope {
+	return otlpScope{Name: scopeName, Version: t.Resource["service.version"]}
+}
+
+// resource returns the resource attributes, sorted by key.
+func (t *Telemetry) resource() otlpResource {
+	keys := make([]string, 0, len(t.Resource))
+	for key := range t.Resource {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	r := otlpResource{Attributes: make([]otlpAttribute, len(keys))}
+	for i, key := range keys {
+		r.Attributes[i] = attribute(key, t.Resource[key])
+	}
+	return r
+}
+
+func attribute(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{"stringValue": value}}
+}
+
+func intAttribute(key string, value int64) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{"intValue": strconv.FormatInt(value, 10)}}
+}
+
+func unixNano(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// randomID returns n random bytes in hex, a trace ID for 16 and a span ID
+// for 8.
+func randomID(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,93 @@
+package logging
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTelemetryExport(t *testing.T) {
+	var mu sync.Mutex
+	bodies := map[string][]byte{}
+	headers := map[string]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		bodies[r.URL.Path] = body
+		headers[r.URL.Path] = r.Header.Get("Authorization")
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	t.Setenv(EnvOTLPEndpoint, server.URL+"/")
+	t.Setenv(EnvOTLPHeaders, "Authorization=Bearer%20token")
+	t.Setenv(EnvResourceAttributes, "ci.farm=west")
+	t.Setenv(EnvServiceName, "")
+	tel, err := NewTelemetry("", "1.2.3")
+	if err != nil || tel == nil {
+		t.Fatalf("NewTelemetry = %v, %v", tel, err)
+	}
+	start := time.Unix(1000, 0)
+	run := Run{Operation: "clean", Start: start, End: start.Add(3 * time.Second), OK: false,
+		InputBytes: 4096, OutputBytes: 1024, Rows: 7,
+		Stages: []RunStage{{Name: "copy", End: start.Add(time.Second), Duration: time.Second}}}
+	if err := tel.Export(t.Context(), run); err != nil {
+		t.Fatal(err)
+	}
+
+	var traces otlpTraces
+	if err := json.Unmarshal(bodies["/v1/traces"], &traces); err != nil {
+		t.Fatal(err)
+	}
+	scope := traces.ResourceSpans[0].ScopeSpans[0]
+	if len(scope.Spans) != 2 {
+		t.Fatalf("spans = %+v", scope.Spans)
+	}
+	root, stage := scope.Spans[0], scope.Spans[1]
+	if root.Name != "gitsqlite clean" || root.Status.Code != 2 || len(root.TraceID) != 32 || len(root.SpanID) != 16 || root.EndTimeUnixNano != "1003000000000" {
+		t.Errorf("root span = %+v", root)
+	}
+	if stage.Name != "copy" || stage.ParentSpanID != root.SpanID || stage.TraceID != root.TraceID || stage.StartTimeUnixNano != "1000000000000" || stage.EndTimeUnixNano != "1001000000000" {
+		t.Errorf("copy span = %+v", stage)
+	}
+	resource := map[string]string{}
+	for _, a := range traces.ResourceSpans[0].Resource.Attributes {
+		resource[a.Key] = a.Value["stringValue"]
+	}
+	if resource["service.name"] != "gitsqlite" || resource["service.version"] != "1.2.3" || resource["ci.farm"] != "west" {
+		t.Errorf("resource = %v", resource)
+	}
+	if headers["/v1/traces"] != "Bearer token" {
+		t.Errorf("Authorization = %q", headers["/v1/traces"])
+	}
+
+	var metrics otlpMetrics
+	if err := json.Unmarshal(bodies["/v1/metrics"], &metrics); err != nil {
+		t.Fatal(err)
+	}
+	values := map[string]string{}
+	for _, m := range metrics.ResourceMetrics[0].ScopeMetrics[0].Metrics {
+		values[m.Name] = m.Sum.DataPoints[0].AsInt
+	}
+	if values["gitsqlite.runs"] != "1" || values["gitsqlite.input"] != "4096" || values["gitsqlite.output"] != "1024" || values["gitsqlite.rows"] != "7" {
+		t.Errorf("metrics = %v", values)
+	}
+}
+
+func TestNewTelemetry(t *testing.T) {
+	t.Setenv(EnvOTLPEndpoint, "")
+	if tel, err := NewTelemetry("", "dev"); tel != nil || err != nil {
+		t.Errorf("NewTelemetry without endpoint = %v, %v", tel, err)
+	}
+	if _, err := NewTelemetry("localhost:4318", "dev"); err == nil {
+		t.Error("endpoint without scheme accepted")
+	}
+	t.Setenv(EnvOTLPTimeout, "soon")
+	if _, err := NewTelemetry("http://localhost:4318", "dev"); err == nil {
+		t.Error("invalid timeout accepted")
+	}
+}
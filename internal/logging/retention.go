@@ -0,0 +1,59 @@
+package logging
+
+import (
+	"os"
+	"time"
+)
+
+// Retention limits the log files kept in a log directory, so that a
+// repository logging every filter run does not collect them forever. A zero
+// field sets no limit.
+type Retention struct {
+	// MaxFiles is the number of log files kept, the new one included.
+	MaxFiles int
+	// MaxAge is how long after its last record a log file is kept.
+	MaxAge time.Duration
+	// MaxSize is the total size in bytes of the log files kept.
+	MaxSize int64
+}
+
+// DefaultRetention keeps the log files of the last 30 days, at most 100
+// files and 100 MB.
+var DefaultRetention = Retention{MaxFiles: 100, MaxAge: 30 * 24 * time.Hour, MaxSize: 100 << 20}
+
+// Prune removes the oldest log files in dir until the rest fits r, and
+// returns the paths removed. The file keep, the log of the running
+// invocation, is never removed. Files that cannot be removed, such as the
+// log of another invocation still open on Windows, are left for the next
+// run.
+func Prune(dir string, r Retention, keep string, now time.Time) []string {
+	files, err := ListSessions(dir)
+	if err != nil {
+		return nil
+	}
+	var removed []string
+	var count int
+	var size int64
+	// Newest first, so the limits keep the most recent files
+	for i := len(files) - 1; i >= 0; i-- {
+		path := files[i]
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		if path != keep {
+			tooOld := r.MaxAge > 0 && now.Sub(info.ModTime()) > r.MaxAge
+			tooMany := r.MaxFiles > 0 && count >= r.MaxFiles
+			tooLarge := r.MaxSize > 0 && size+info.Size() > r.MaxSize
+			if tooOld || tooMany || tooLarge {
+				if os.Remove(path) == nil {
+					removed = append(removed, path)
+				}
+				continue
+			}
+		}
+		count++
+		size += info.Size()
+	}
+	return removed
+}
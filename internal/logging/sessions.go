@@ -0,0 +1,192 @@
+package logging
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/danielsiegl/gitsqlite/internal/color"
+)
+
+// Session status, derived from the records of a log file.
+const (
+	StatusOK         = "ok"
+	StatusFailed     = "failed"
+	StatusIncomplete = "incomplete" // still running, hung or killed
+)
+
+// Record is one entry of a log file.
+type Record struct {
+	Time    time.Time
+	Level   string
+	Message string
+	// Attrs are the remaining attributes, except the ones repeated on every
+	// record of a session (invocation_id, pid).
+	Attrs map[string]any
+}
+
+// Session is the log of one gitsqlite invocation.
+type Session struct {
+	File      string
+	Operation string
+	Args      []string
+	PID       int
+	Status    string
+	Start     time.Time
+	End       time.Time
+	Records   []Record
+}
+
+// Duration is the time between the first and the last record.
+func (s *Session) Duration() time.Duration {
+	return s.End.Sub(s.Start)
+}
+
+// finishedMessage is logged by main when an operation succeeds.
+const finishedMessage = "gitsqlite finished successfully"
+
+// ListSessions returns the log files in dir, oldest first. The file names
+// start with the UTC start time, so they sort chronologically.
+func ListSessions(dir string) ([]string, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "gitsqlite_*.log"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// ReadSession parses the log file at path. Lines that are not JSON records,
+// like the last line of a log cut off by a crash, are skipped.
+func ReadSession(path string) (*Session, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	s, err := parseSession(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	s.File = path
+	return s, nil
+}
+
+func parseSession(r io.Reader) (*Session, error) {
+	s := &Session{Status: StatusIncomplete}
+	failed := false
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for sc.Scan() {
+		var attrs map[string]any
+		if err := json.Unmarshal(sc.Bytes(), &attrs); err != nil {
+			continue
+		}
+		rec := Record{Attrs: attrs}
+		if t, ok := attrs["time"].(string); ok {
+			rec.Time, _ = time.Parse(time.RFC3339Nano, t)
+		}
+		rec.Level, _ = attrs["level"].(string)
+		rec.Message, _ = attrs["msg"].(string)
+		if pid, ok := attrs["pid"].(float64); ok && s.PID == 0 {
+			s.PID = int(pid)
+		}
+		for _, key := range []string{"time", "level", "msg", "invocation_id", "pid"} {
+			delete(attrs, key)
+		}
+
+		if s.Operation == "" {
+			if op, ok := attrs["operation"].(string); ok {
+				s.Operation = op
+			}
+		}
+		if args, ok := attrs["args"].([]any); ok && s.Args == nil {
+			for _, a := range args {
+				s.Args = append(s.Args, fmt.Sprint(a))
+			}
+		}
+		if rec.Level == "ERROR" {
+			failed = true
+		}
+		if rec.Message == finishedMessage {
+			s.Status = StatusOK
+		}
+		if s.Start.IsZero() {
+			s.Start = rec.Time
+		}
+		s.End = rec.Time
+		s.Records = append(s.Records, rec)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if failed {
+		s.Status = StatusFailed
+	}
+	return s, nil
+}
+
+// PrintSession writes the header of s and, unless summary is set, its
+// records one per line to w, colored with palette.
+func PrintSession(w io.Writer, s *Session, summary bool, palette color.Palette) {
+	op := s.Operation
+	if op == "" {
+		op = "-"
+	}
+	status := fmt.Sprintf("%-10s", s.Status)
+	switch s.Status {
+	case StatusOK:
+		status = palette.Paint(color.Green, status)
+	case StatusFailed:
+		status = palette.Paint(color.Red, status)
+	default:
+		status = palette.Paint(color.Yellow, status)
+	}
+	fmt.Fprintf(w, "%s  %s %s %8s  pid %d  %s\n",
+		palette.Paint(color.Bold, s.Start.Local().Format("2006-01-02 15:04:05.000")),
+		palette.Paint(color.Bold, fmt.Sprintf("%-11s", op)), status,
+		s.Duration().Round(time.Millisecond), s.PID, palette.Paint(color.Dim, s.File))
+	if summary {
+		return
+	}
+	for _, rec := range s.Records {
+		level := fmt.Sprintf("%-5s", rec.Level)
+		switch rec.Level {
+		case "ERROR":
+			level = palette.Paint(color.Red, level)
+		case "WARN":
+			level = palette.Paint(color.Yellow, level)
+		case "DEBUG":
+			level = palette.Paint(color.Dim, level)
+		}
+		fmt.Fprintf(w, "  %s %s %s%s\n", palette.Paint(color.Dim, rec.Time.Local().Format("15:04:05.000")), level, rec.Message,
+			palette.Paint(color.Dim, formatAttrs(rec.Attrs)))
+	}
+}
+
+// formatAttrs formats attributes as " key=value", sorted by key.
+func formatAttrs(attrs map[string]any) string {
+	keys := make([]string, 0, len(attrs))
+	for k := range attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		v, ok := attrs[k].(string)
+		if !ok {
+			data, _ := json.Marshal(attrs[k])
+			v = string(data)
+		} else if strings.ContainsAny(v, " \t\"=") || v == "" {
+			v = fmt.Sprintf("%q", v)
+		}
+		fmt.Fprintf(&b, " %s=%s", k, v)
+	}
+	return b.String()
+}
@@ -0,0 +1,33 @@
+package logging
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseSession(t *testing.T) {
+	tests := []struct {
+		name   string
+		log    string
+		op     string
+		status string
+	}{
+		{"ok", `{"time":"2026-01-02T03:04:05.000Z","level":"INFO","msg":"gitsqlite started","pid":7,"operation":"clean"}
+{"time":"2026-01-02T03:04:06.500Z","level":"INFO","msg":"gitsqlite finished successfully","pid":7,"operation":"clean"}
+`, "clean", StatusOK},
+		{"failed", `{"time":"2026-01-02T03:04:05.000Z","level":"INFO","msg":"gitsqlite started","pid":7,"operation":"smudge"}
+{"time":"2026-01-02T03:04:05.100Z","level":"ERROR","msg":"smudge failed","pid":7}
+`, "smudge", StatusFailed},
+		{"cut off", `{"time":"2026-01-02T03:04:05.000Z","level":"INFO","msg":"gitsqlite started","pid":7,"operation":"clean"}
+{"time":"2026-01-02T03:04:0`, "clean", StatusIncomplete},
+	}
+	for _, tt := range tests {
+		s, err := parseSession(strings.NewReader(tt.log))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if s.Operation != tt.op || s.Status != tt.status || s.PID != 7 {
+			t.Errorf("%s: got operation %q, status %q, pid %d, want %q, %q, 7", tt.name, s.Operation, s.Status, s.PID, tt.op, tt.status)
+		}
+	}
+}
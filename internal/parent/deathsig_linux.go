@@ -0,0 +1,15 @@
+package parent
+
+import (
+	"log/slog"
+
+	"golang.org/x/sys/unix"
+)
+
+// dieWithParent asks the kernel to send SIGTERM, which stops the operation
+// like an interrupt, as soon as the parent exits.
+func dieWithParent() {
+	if err := unix.Prctl(unix.PR_SET_PDEATHSIG, uintptr(unix.SIGTERM), 0, 0, 0); err != nil {
+		slog.Debug("Failed to set the parent death signal", "error", err)
+	}
+}
@@ -0,0 +1,7 @@
+//go:build unix && !linux
+
+package parent
+
+// dieWithParent is only supported on Linux; elsewhere the exit of the parent
+// is noticed by polling.
+func dieWithParent() {}
@@ -0,0 +1,62 @@
+// Package parent notices when the process that started gitsqlite, normally git
+// running it as a filter, exits or closes the output, so that the operation
+// can be stopped instead of dumping into, or blocking on, a pipe nobody reads.
+package parent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Interval is how often the parent process and the output are checked.
+const Interval = 500 * time.Millisecond
+
+var (
+	// ErrGone is reported when the parent process exited.
+	ErrGone = errors.New("parent process exited")
+	// ErrOutputClosed is reported when the reader of the output closed it.
+	ErrOutputClosed = errors.New("output closed by its reader")
+)
+
+// probe checks the parent process and the output on one platform.
+type probe interface {
+	// parentGone reports whether the parent process has exited.
+	parentGone() bool
+	// outputClosed reports whether the reader of the output closed it.
+	outputClosed() bool
+}
+
+// Watch checks every interval whether the parent process exited or the reader
+// of out closed it. The returned channel receives the reason, wrapping ErrGone
+// or ErrOutputClosed, once; it receives nothing after ctx is done. Where the
+// platform allows, gitsqlite is also set up to be signaled (Linux) and its
+// child processes to be killed (Windows) when the parent exits without
+// waiting for the next check.
+func Watch(ctx context.Context, out *os.File, interval time.Duration) <-chan error {
+	gone := make(chan error, 1)
+	ppid := os.Getppid()
+	p := newProbe(ppid, out)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			switch {
+			case p.parentGone():
+				gone <- fmt.Errorf("%w (pid %d)", ErrGone, ppid)
+				return
+			case p.outputClosed():
+				gone <- ErrOutputClosed
+				return
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return gone
+}
@@ -0,0 +1,13 @@
+//go:build !unix && !windows
+
+package parent
+
+import "os"
+
+// noProbe never reports anything; the platform has no way to check.
+type noProbe struct{}
+
+func newProbe(ppid int, out *os.File) probe { return noProbe{} }
+
+func (noProbe) parentGone() bool   { return false }
+func (noProbe) outputClosed() bool { return false }
@@ -0,0 +1,58 @@
+package parent
+
+import (
+	"context"
+	"errors"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestWatchReportsClosedOutput(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("closed pipes are not detected on Windows")
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	gone := Watch(ctx, w, 10*time.Millisecond)
+	select {
+	case err := <-gone:
+		t.Fatalf("reported %v while the output is open", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	r.Close()
+	select {
+	case err := <-gone:
+		if !errors.Is(err, ErrOutputClosed) {
+			t.Errorf("got %v, want %v", err, ErrOutputClosed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("closed output not reported")
+	}
+}
+
+func TestWatchStopsWithContext(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	gone := Watch(ctx, w, 10*time.Millisecond)
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	r.Close()
+	select {
+	case err := <-gone:
+		t.Fatalf("reported %v after the context was done", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,45 @@
+//go:build unix
+
+package parent
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// unixProbe notices the exit of the parent by the process being reparented,
+// and a closed output by polling it for an error or hangup.
+type unixProbe struct {
+	ppid int
+	out  *os.File
+}
+
+func newProbe(ppid int, out *os.File) probe {
+	dieWithParent()
+	return &unixProbe{ppid: ppid, out: out}
+}
+
+// parentGone reports whether the process was reparented. A parent pid of 1
+// at the start means there is no parent to watch: it already exited, or
+// gitsqlite runs as the first process of a container.
+func (p *unixProbe) parentGone() bool {
+	return p.ppid > 1 && os.Getppid() != p.ppid
+}
+
+// outputClosed polls the output without waiting. A pipe whose reader closed
+// it reports POLLERR, a terminal that hung up POLLHUP.
+func (p *unixProbe) outputClosed() bool {
+	rc, err := p.out.SyscallConn()
+	if err != nil {
+		return false
+	}
+	var closed bool
+	rc.Control(func(fd uintptr) {
+		fds := []unix.PollFd{{Fd: int32(fd)}}
+		if n, err := unix.Poll(fds, 0); err == nil && n > 0 {
+			closed = fds[0].Revents&(unix.POLLERR|unix.POLLHUP) != 0
+		}
+	})
+	return closed
+}
@@ -0,0 +1,79 @@
+package parent
+
+import (
+	"log/slog"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// windowsProbe notices the exit of the parent through a handle of it. Windows
+// does not reparent processes, and an anonymous pipe cannot be checked for a
+// closed reader without writing to it, so only the parent is watched.
+type windowsProbe struct {
+	parent windows.Handle // 0 if the parent cannot be watched
+	gone   bool           // the parent exited before it could be opened
+}
+
+func newProbe(ppid int, out *os.File) probe {
+	killChildrenOnExit()
+	p := &windowsProbe{}
+	h, err := windows.OpenProcess(windows.SYNCHRONIZE|windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(ppid))
+	if err != nil {
+		slog.Debug("Cannot watch the parent process", "pid", ppid, "error", err)
+		return p
+	}
+	// The pid of an exited parent may already belong to a newer process
+	if started(h) > started(windows.CurrentProcess()) {
+		windows.CloseHandle(h)
+		p.gone = true
+		return p
+	}
+	p.parent = h
+	return p
+}
+
+func (p *windowsProbe) parentGone() bool {
+	if p.gone || p.parent == 0 {
+		return p.gone
+	}
+	event, err := windows.WaitForSingleObject(p.parent, 0)
+	p.gone = err == nil && event == windows.WAIT_OBJECT_0
+	return p.gone
+}
+
+func (p *windowsProbe) outputClosed() bool { return false }
+
+// started returns the creation time of the process h, 0 if unknown.
+func started(h windows.Handle) int64 {
+	var created, exited, kernel, user windows.Filetime
+	if err := windows.GetProcessTimes(h, &created, &exited, &kernel, &user); err != nil {
+		return 0
+	}
+	return created.Nanoseconds()
+}
+
+// killChildrenOnExit puts gitsqlite into a job object that kills all its
+// processes when the last handle to it closes, which is when gitsqlite exits
+// in any way, so that sqlite3 processes never outlive it.
+func killChildrenOnExit() {
+	job, err := windows.CreateJobObject(nil, nil)
+	if err != nil {
+		slog.Debug("Failed to create a job object", "error", err)
+		return
+	}
+	info := windows.JOBOBJECT_EXTENDED_LIMIT_INFORMATION{}
+	info.BasicLimitInformation.LimitFlags = windows.JOB_OBJECT_LIMIT_KILL_ON_JOB_CLOSE
+	if _, err := windows.SetInformationJobObject(job, windows.JobObjectExtendedLimitInformation,
+		uintptr(unsafe.Pointer(&info)), uint32(unsafe.Sizeof(info))); err != nil {
+		slog.Debug("Failed to configure the job object", "error", err)
+		windows.CloseHandle(job)
+		return
+	}
+	if err := windows.AssignProcessToJobObject(job, windows.CurrentProcess()); err != nil {
+		slog.Debug("Failed to join the job object", "error", err)
+		windows.CloseHandle(job)
+	}
+	// The handle stays open until gitsqlite exits
+}
@@ -0,0 +1,138 @@
+// Package profiling writes Go runtime profiles of a gitsqlite run (-profile),
+// so that performance problems on real repositories can be reported without a
+// custom build. CPU and heap profiles are pprof files, which
+// "go tool pprof -http=: FILE" shows as a flame graph; execution traces are
+// read with "go tool trace FILE".
+package profiling
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"strings"
+	"sync"
+)
+
+// Kinds of profiles.
+const (
+	// CPU samples where gitsqlite spends CPU time during the run.
+	CPU = "cpu"
+	// Mem records the heap allocations at the end of the run.
+	Mem = "mem"
+	// Trace records goroutines, system calls, GC and blocking during the run.
+	Trace = "trace"
+)
+
+// Spec maps kinds of profiles to the files they are written to.
+type Spec map[string]string
+
+// Parse parses a comma-separated list of kind=file items.
+func Parse(list string) (Spec, error) {
+	spec := Spec{}
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kind, file, ok := strings.Cut(item, "=")
+		kind, file = strings.TrimSpace(kind), strings.TrimSpace(file)
+		if !ok || file == "" {
+			return nil, fmt.Errorf("profile %q: expected kind=file", item)
+		}
+		if kind != CPU && kind != Mem && kind != Trace {
+			return nil, fmt.Errorf("profile %q: unknown kind %s (use %s, %s or %s)", item, kind, CPU, Mem, Trace)
+		}
+		if _, dup := spec[kind]; dup {
+			return nil, fmt.Errorf("profile %q: %s given twice", item, kind)
+		}
+		spec[kind] = file
+	}
+	return spec, nil
+}
+
+// Start starts the CPU profile and the execution trace of spec and returns
+// the function that stops them and writes the heap profile. It may be called
+// more than once; only the first call has an effect. Failures to write a
+// profile at the end are logged, they never fail the operation.
+func Start(spec Spec) (stop func(), err error) {
+	var files []*os.File
+	closeAll := func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}
+	create := func(kind string) (*os.File, error) {
+		f, err := os.Create(spec[kind])
+		if err != nil {
+			return nil, fmt.Errorf("cannot create %s profile: %w", kind, err)
+		}
+		files = append(files, f)
+		return f, nil
+	}
+
+	if _, ok := spec[CPU]; ok {
+		f, err := create(CPU)
+		if err != nil {
+			closeAll()
+			return nil, err
+		}
+		if err := pprof.StartCPUProfile(f); err != nil {
+			closeAll()
+			return nil, fmt.Errorf("cannot start CPU profile: %w", err)
+		}
+	}
+	if _, ok := spec[Trace]; ok {
+		f, err := create(Trace)
+		if err == nil {
+			if err = trace.Start(f); err != nil {
+				err = fmt.Errorf("cannot start trace: %w", err)
+			}
+		}
+		if err != nil {
+			if _, ok := spec[CPU]; ok {
+				pprof.StopCPUProfile()
+			}
+			closeAll()
+			return nil, err
+		}
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			if _, ok := spec[CPU]; ok {
+				pprof.StopCPUProfile()
+			}
+			if _, ok := spec[Trace]; ok {
+				trace.Stop()
+			}
+			closeAll()
+			if file, ok := spec[Mem]; ok {
+				if err := writeHeap(file); err != nil {
+					slog.Warn("cannot write heap profile", "file", file, "error", err)
+				}
+			}
+			for kind, file := range spec {
+				slog.Info("profile written", "kind", kind, "file", file)
+			}
+		})
+	}, nil
+}
+
+// writeHeap writes the heap profile after a garbage collection, so that it
+// shows the live heap as of the end of the run.
+func writeHeap(file string) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	runtime.GC()
+	err = pprof.WriteHeapProfile(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,55 @@
+package profiling
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		list    string
+		want    Spec
+		wantErr bool
+	}{
+		{"", Spec{}, false},
+		{"cpu=cpu.pprof", Spec{CPU: "cpu.pprof"}, false},
+		{"cpu=a, mem = b ,trace=c", Spec{CPU: "a", Mem: "b", Trace: "c"}, false},
+		{"cpu", nil, true},
+		{"cpu=", nil, true},
+		{"block=x", nil, true},
+		{"cpu=a,cpu=b", nil, true},
+	}
+	for _, tt := range tests {
+		got, err := Parse(tt.list)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("Parse(%q) error = %v, wantErr %v", tt.list, err, tt.wantErr)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("Parse(%q) = %v, want %v", tt.list, got, tt.want)
+			continue
+		}
+		for k, v := range tt.want {
+			if got[k] != v {
+				t.Errorf("Parse(%q)[%s] = %q, want %q", tt.list, k, got[k], v)
+			}
+		}
+	}
+}
+
+func TestStartWritesProfiles(t *testing.T) {
+	dir := t.TempDir()
+	spec := Spec{CPU: filepath.Join(dir, "cpu"), Mem: filepath.Join(dir, "mem"), Trace: filepath.Join(dir, "trace")}
+	stop, err := Start(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop()
+	stop()
+	for kind, file := range spec {
+		if info, err := os.Stat(file); err != nil || info.Size() == 0 {
+			t.Errorf("%s profile %s not written: %v", kind, file, err)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+// Package progress reports how far a long-running dump has come on a
+// terminal: tables and rows done, bytes written, and the time left. The line
+// keeps updating while nothing happens, with the time since the last row, so
+// a slow table can be told apart from a hang.
+package progress
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattn/go-isatty"
+
+	"github.com/danielsiegl/gitsqlite/internal/logging"
+)
+
+// Interval is how often the line is redrawn.
+const Interval = 250 * time.Millisecond
+
+// stallAfter is how long without a new row before the line says so.
+const stallAfter = 5 * time.Second
+
+// IsTerminal reports whether f is a terminal, where a line redrawn with
+// carriage returns is readable.
+func IsTerminal(f *os.File) bool {
+	fd := f.Fd()
+	return isatty.IsTerminal(fd) || isatty.IsCygwinTerminal(fd)
+}
+
+// Reporter draws the progress line. A nil *Reporter does nothing, so code
+// reporting progress needs no checks.
+type Reporter struct {
+	w        io.Writer
+	label    string
+	interval time.Duration
+	now      func() time.Time
+
+	mu          sync.Mutex
+	start       time.Time
+	lastRow     time.Time
+	tables      int
+	totalTables int
+	table       string
+	rows        int64
+	totalRows   int64
+	bytes       int64
+	width       int
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// New returns a reporter drawing the progress of operation label to w every
+// interval.
+func New(w io.Writer, label string, interval time.Duration) *Reporter {
+	return &Reporter{w: w, label: label, interval: interval, now: time.Now}
+}
+
+// Start sets the number of tables and rows to be dumped, 0 if unknown, and
+// starts drawing.
+func (r *Reporter) Start(tables int, rows int64) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.start, r.lastRow = r.now(), r.now()
+	r.totalTables, r.totalRows = tables, rows
+	r.tables, r.rows, r.bytes, r.table, r.width = 0, 0, 0, "", 0
+	r.mu.Unlock()
+	r.stop, r.done = make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(r.done)
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				r.draw()
+			case <-r.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Table records that the rows of table name follow.
+func (r *Reporter) Table(name string) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.tables++
+	r.table = name
+	r.mu.Unlock()
+}
+
+// Rows records n more rows.
+func (r *Reporter) Rows(n int64) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.rows += n
+	r.lastRow = r.now()
+	r.mu.Unlock()
+}
+
+// Writer returns w counting the bytes written to it; w itself if r is nil.
+func (r *Reporter) Writer(w io.Writer) io.Writer {
+	if r == nil {
+		return w
+	}
+	return &countingWriter{w: w, r: r}
+}
+
+// Finish stops drawing and ends the line with the final counts. Calling it
+// again, or without Start, does nothing.
+func (r *Reporter) Finish() {
+	if r == nil || r.stop == nil {
+		return
+	}
+	close(r.stop)
+	<-r.done
+	r.stop = nil
+	r.mu.Lock()
+	r.table = ""
+	r.mu.Unlock()
+	r.draw()
+	fmt.Fprintln(r.w)
+}
+
+// draw redraws the line, padded to clear the previous one.
+func (r *Reporter) draw() {
+	r.mu.Lock()
+	line := r.line()
+	pad := r.width - len(line)
+	r.width = len(line)
+	r.mu.Unlock()
+	if pad < 0 {
+		pad = 0
+	}
+	fmt.Fprint(r.w, "\r"+line+strings.Repeat(" ", pad))
+}
+
+// line returns the text of the progress line.
+func (r *Reporter) line() string {
+	now := r.now()
+	elapsed := now.Sub(r.start)
+	var b strings.Builder
+	fmt.Fprintf(&b, "%s: ", r.label)
+	if r.totalTables > 0 {
+		fmt.Fprintf(&b, "table %d/%d", r.tables, r.totalTables)
+	} else {
+		fmt.Fprintf(&b, "table %d", r.tables)
+	}
+	if r.table != "" {
+		fmt.Fprintf(&b, " %s", r.table)
+	}
+	if r.totalRows > 0 {
+		fmt.Fprintf(&b, ", %d/%d rows (%d%%)", r.rows, r.totalRows, min(100, r.rows*100/r.totalRows))
+	} else {
+		fmt.Fprintf(&b, ", %d rows", r.rows)
+	}
+	fmt.Fprintf(&b, ", %s written, %s", logging.FormatBytes(r.bytes), formatDuration(elapsed))
+	if r.totalRows > 0 && r.rows > 0 && r.rows < r.totalRows {
+		left := time.Duration(float64(elapsed) * float64(r.totalRows-r.rows) / float64(r.rows))
+		fmt.Fprintf(&b, ", ETA %s", formatDuration(left))
+	}
+	if idle := now.Sub(r.lastRow); idle >= stallAfter && r.stop != nil {
+		fmt.Fprintf(&b, ", no new rows for %s", formatDuration(idle))
+	}
+	return b.String()
+}
+
+// countingWriter adds the bytes written through it to a reporter.
+type countingWriter struct {
+	w io.Writer
+	r *Reporter
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.r.mu.Lock()
+	c.r.bytes += int64(n)
+	c.r.mu.Unlock()
+	return n, err
+}
+
+// Unwrap returns the underlying writer, so sqlite.Engine still sees the
+// buffer of a PipeOutput.
+func (c *countingWriter) Unwrap() io.Writer {
+	return c.w
+}
+
+// formatDuration formats d as m:ss, or h:mm:ss from an hour on.
+func formatDuration(d time.Duration) string {
+	s := int64(d.Round(time.Second).Seconds())
+	if s >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", s/3600, s/60%60, s%60)
+	}
+	return fmt.Sprintf("%d:%02d", s/60, s%60)
+}
@@ -0,0 +1,53 @@
+package progress
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLine(t *testing.T) {
+	clock := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var out bytes.Buffer
+	r := New(&out, "clean", time.Hour)
+	r.now = func() time.Time { return clock }
+	r.Start(4, 1000)
+
+	r.Table("users")
+	clock = clock.Add(10 * time.Second)
+	r.Rows(250)
+	if _, err := io.WriteString(r.Writer(io.Discard), strings.Repeat("x", 3<<20)); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := r.line(), "clean: table 1/4 users, 250/1000 rows (25%), 3.0 MB written, 0:10, ETA 0:30"; got != want {
+		t.Errorf("line = %q, want %q", got, want)
+	}
+
+	// No rows for a while
+	clock = clock.Add(time.Minute)
+	if got, want := r.line(), ", no new rows for 1:00"; !strings.HasSuffix(got, want) {
+		t.Errorf("line = %q, want suffix %q", got, want)
+	}
+
+	r.Table("orders")
+	r.Rows(750)
+	r.Finish()
+	if got, want := out.String(), "\rclean: table 2/4, 1000/1000 rows (100%), 3.0 MB written, 1:10\n"; got != want {
+		t.Errorf("output = %q, want %q", got, want)
+	}
+	r.Finish()
+}
+
+func TestNil(t *testing.T) {
+	var r *Reporter
+	r.Start(1, 1)
+	r.Table("t")
+	r.Rows(1)
+	var out bytes.Buffer
+	if w := r.Writer(&out); w != &out {
+		t.Errorf("Writer of a nil reporter wraps the writer")
+	}
+	r.Finish()
+}
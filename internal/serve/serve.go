@@ -0,0 +1,256 @@
+// Package serve answers requests about database files over a simple line
+// protocol on stdin and stdout (gitsqlite serve --stdio), so that an IDE
+// plugin can keep one gitsqlite process per workspace instead of starting one
+// for every file it shows.
+//
+// Every request is a line holding a command and a path, relative to the
+// directory serve was started in or absolute:
+//
+//	clean <path>   the dump of the database, as the clean filter writes it
+//	status <path>  whether the database differs from the git index
+//
+// Every response starts with a line. A failed request is answered with
+// "error <message>" and the session goes on. clean answers "ok <n>" followed
+// by the n bytes of the dump; status answers "ok unmodified", "ok modified"
+// or "ok untracked". The session ends when stdin is closed.
+package serve
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/danielsiegl/gitsqlite/internal/filters"
+	"github.com/danielsiegl/gitsqlite/internal/shutdown"
+	"github.com/danielsiegl/gitsqlite/internal/sqlite"
+)
+
+// Status values answered by status.
+const (
+	Unmodified = "unmodified"
+	Modified   = "modified"
+	Untracked  = "untracked"
+)
+
+// Server answers requests with one engine and one set of clean options.
+type Server struct {
+	Engine  *sqlite.Engine
+	Options filters.Options
+	// Dir is the directory relative paths in requests are resolved in.
+	Dir string
+	// Root is the top of the git worktree, which git commands run in and
+	// index paths are relative to; empty outside a repository.
+	Root string
+}
+
+// Serve answers the requests read from in on out until in ends or ctx is
+// done. Only failing to write a response ends it with an error.
+func (s *Server) Serve(ctx context.Context, in io.Reader, out io.Writer) error {
+	w := bufio.NewWriter(out)
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		command, path, _ := strings.Cut(line, " ")
+		slog.Debug("Request", "command", command, "path", path)
+		var err error
+		switch command {
+		case "clean":
+			err = s.clean(ctx, w, path)
+		case "status":
+			var status string
+			if status, err = s.status(ctx, path); err == nil {
+				_, err = fmt.Fprintf(w, "ok %s\n", status)
+			}
+		default:
+			err = fmt.Errorf("unknown command %q (expected clean or status)", command)
+		}
+		if err != nil {
+			var werr writeError
+			if errors.As(err, &werr) {
+				return werr.err
+			}
+			slog.Warn("Request failed", "command", command, "path", path, "error", err)
+			if _, err := fmt.Fprintf(w, "error %s\n", strings.ReplaceAll(err.Error(), "\n", " ")); err != nil {
+				return err
+			}
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// writeError marks a failure to write a response, which ends the session
+// instead of being answered.
+type writeError struct{ err error }
+
+func (e writeError) Error() string { return e.err.Error() }
+
+// clean writes the dump of the database at path to w, after its header.
+func (s *Server) clean(ctx context.Context, w io.Writer, path string) error {
+	dump, size, err := s.dump(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer dump.Close()
+	if _, err := fmt.Fprintf(w, "ok %d\n", size); err != nil {
+		return writeError{err}
+	}
+	if _, err := io.Copy(w, dump); err != nil {
+		return writeError{err}
+	}
+	return nil
+}
+
+// status compares the dump of the database at path with its entry in the
+// git index, as git status does after running the clean filter.
+func (s *Server) status(ctx context.Context, path string) (string, error) {
+	if s.Root == "" {
+		return "", fmt.Errorf("not inside a git repository")
+	}
+	if _, err := os.Stat(s.resolve(path)); err != nil {
+		return "", err
+	}
+	rel, err := s.indexPath(path)
+	if err != nil {
+		return "", err
+	}
+	out, err := s.git(ctx, "ls-files", "--stage", "--", ":(literal)"+rel)
+	if err != nil {
+		return "", err
+	}
+	// <mode> <object> <stage>\t<path>
+	fields := strings.Fields(out)
+	if len(fields) < 2 {
+		return Untracked, nil
+	}
+	dump, _, err := s.dump(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	defer dump.Close()
+	id, err := s.git(ctx, "hash-object", "--no-filters", dump.Name())
+	if err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(id) == fields[1] {
+		return Unmodified, nil
+	}
+	return Modified, nil
+}
+
+// dump cleans the database at path into a temporary file, which is removed
+// when it is closed, and returns it rewound with its size.
+func (s *Server) dump(ctx context.Context, path string) (*tempFile, int64, error) {
+	abs := s.resolve(path)
+	db, err := os.Open(abs)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer db.Close()
+	opts := s.Options
+	opts.SourcePath = ""
+	opts.InputSize = 0
+	if info, err := db.Stat(); err == nil {
+		opts.InputSize = info.Size()
+	}
+	if rel, err := s.indexPath(path); err == nil {
+		opts.SourcePath = filepath.FromSlash(rel)
+	}
+
+	f, err := os.CreateTemp("", "gitsqlite-serve-*.sql")
+	if err != nil {
+		return nil, 0, err
+	}
+	t := &tempFile{File: f, remove: shutdown.Remove(f.Name())}
+	if err := filters.Clean(ctx, s.Engine, db, t, opts); err != nil {
+		t.Close()
+		return nil, 0, err
+	}
+	size, err := t.Seek(0, io.SeekCurrent)
+	if err == nil {
+		_, err = t.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		t.Close()
+		return nil, 0, err
+	}
+	return t, size, nil
+}
+
+// tempFile is a temporary file removed when it is closed.
+type tempFile struct {
+	*os.File
+	remove func()
+}
+
+func (t *tempFile) Close() error {
+	err := t.File.Close()
+	t.remove()
+	return err
+}
+
+// FindRoot returns the top of the git worktree containing the working
+// directory, empty outside a repository.
+func FindRoot(ctx context.Context) string {
+	out, err := exec.CommandContext(ctx, "git", "rev-parse", "--show-toplevel").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// resolve returns path relative to Dir.
+func (s *Server) resolve(path string) string {
+	if filepath.IsAbs(path) {
+		return filepath.Clean(path)
+	}
+	return filepath.Join(s.Dir, path)
+}
+
+// indexPath returns the path of the file at path relative to Root, with
+// forward slashes, as git names it in the index.
+func (s *Server) indexPath(path string) (string, error) {
+	if s.Root == "" {
+		return "", fmt.Errorf("not inside a git repository")
+	}
+	abs := s.resolve(path)
+	// git reports Root with symbolic links resolved
+	if dir, err := filepath.EvalSymlinks(filepath.Dir(abs)); err == nil {
+		abs = filepath.Join(dir, filepath.Base(abs))
+	}
+	rel, err := filepath.Rel(s.Root, abs)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside the repository %s", path, s.Root)
+	}
+	return filepath.ToSlash(rel), nil
+}
+
+// git runs a git command in Root and returns its output.
+func (s *Server) git(ctx context.Context, args ...string) (string, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = s.Root
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s failed: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
@@ -0,0 +1,78 @@
+package serve
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/danielsiegl/gitsqlite/internal/filters"
+	"github.com/danielsiegl/gitsqlite/internal/sqlite"
+)
+
+func TestServe(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	dir := t.TempDir()
+	t.Chdir(dir)
+	git := func(stdin string, args ...string) string {
+		t.Helper()
+		cmd := exec.Command("git", args...)
+		cmd.Stdin = strings.NewReader(stdin)
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("git %v: %v", args, err)
+		}
+		return strings.TrimSpace(string(out))
+	}
+	git("", "init", "-q")
+	eng := &sqlite.Engine{Embedded: true}
+	if err := eng.Restore(t.Context(), filepath.Join(dir, "app.db"), strings.NewReader("CREATE TABLE t(a);\nINSERT INTO t VALUES(1);\n")); err != nil {
+		t.Fatal(err)
+	}
+	s := &Server{Engine: eng, Options: filters.Options{FloatPrecision: 9}, Dir: dir, Root: FindRoot(t.Context())}
+
+	// One session answers several requests, failed ones included
+	var out bytes.Buffer
+	if err := s.Serve(t.Context(), strings.NewReader("clean app.db\r\nfrob app.db\n\nstatus app.db\n"), &out); err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(&out)
+	header, _ := r.ReadString('\n')
+	n, err := strconv.Atoi(strings.TrimSpace(strings.TrimPrefix(header, "ok ")))
+	if err != nil {
+		t.Fatalf("clean header %q", header)
+	}
+	dump := make([]byte, n)
+	if _, err := io.ReadFull(r, dump); err != nil || !bytes.Contains(dump, []byte("INSERT INTO t VALUES(1);")) {
+		t.Fatalf("dump %q, %v", dump, err)
+	}
+	if line, _ := r.ReadString('\n'); !strings.HasPrefix(line, "error unknown command") {
+		t.Errorf("unknown command answered %q", line)
+	}
+	if line, _ := r.ReadString('\n'); line != "ok untracked\n" {
+		t.Errorf("status of a new file = %q", line)
+	}
+
+	// The index holds the dump, as after git add with the filter
+	id := git(string(dump), "hash-object", "-w", "--stdin")
+	git("", "update-index", "--add", "--cacheinfo", fmt.Sprintf("100644,%s,app.db", id))
+	for _, want := range []string{Unmodified, Modified} {
+		got, err := s.status(t.Context(), filepath.Join(dir, "app.db"))
+		if err != nil || got != want {
+			t.Errorf("status = %q, %v; want %q", got, err, want)
+		}
+		if err := eng.Restore(t.Context(), filepath.Join(dir, "app.db"), strings.NewReader("INSERT INTO t VALUES(2);\n")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := s.status(t.Context(), "missing.db"); err == nil {
+		t.Error("status of a missing file succeeded")
+	}
+}
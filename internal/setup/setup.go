@@ -0,0 +1,297 @@
+// Package setup configures git to use gitsqlite as clean/smudge filter and
+// diff driver: it writes the filter.gitsqlite and diff.gitsqlite config
+// entries and the attribute lines that assign them to database files.
+package setup
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Driver is the name of the filter and diff driver in git config and
+// attributes.
+const Driver = "gitsqlite"
+
+// DefaultExtensions are the file extensions configured if none are given.
+var DefaultExtensions = []string{".db"}
+
+// Options selects where and for which files gitsqlite is configured.
+type Options struct {
+	// Global writes the user's global git config and attributes file instead
+	// of those of the current repository.
+	Global bool
+	// Extensions are the database file extensions, e.g. ".db".
+	Extensions []string
+	// Command is how git invokes gitsqlite; see DefaultCommand.
+	Command string
+	// Name, if set, registers an additional filter and diff driver of that
+	// name whose commands select the configuration profile of the same name
+	// (-config-profile). Without Extensions no attribute lines are added for
+	// it, since its patterns usually overlap those of the plain driver.
+	Name string
+}
+
+// Result describes what Install changed.
+type Result struct {
+	// Config lists the config entries as "key = value".
+	Config []string
+	// AttributesFile is the attributes file the patterns were added to.
+	AttributesFile string
+	// Added lists the attribute lines that were added; lines already present
+	// are not repeated.
+	Added []string
+}
+
+// Install writes the filter and diff driver config and adds an attribute line
+// per extension. Running it again changes nothing.
+func Install(ctx context.Context, opts Options) (*Result, error) {
+	driver := DriverName(opts.Name)
+	exts, err := normalizeExtensions(opts.Extensions)
+	if err != nil {
+		return nil, err
+	}
+	attrFile, err := attributesFile(ctx, opts.Global)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &Result{AttributesFile: attrFile}
+	if result.Config, err = Configure(ctx, opts.Global, driver, opts.Command); err != nil {
+		return nil, err
+	}
+	if driver != Driver && len(opts.Extensions) == 0 {
+		return result, nil
+	}
+	if _, result.Added, err = AddAttributes(ctx, opts.Global, driver, exts); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// DriverName returns the driver registered for the profile name: Driver if
+// name is empty, otherwise name.
+func DriverName(name string) string {
+	if name == "" {
+		return Driver
+	}
+	return name
+}
+
+// Configure writes the config of the filter and diff driver named driver for
+// command and returns the entries as "key = value". Drivers other than Driver
+// select the configuration profile of their name.
+func Configure(ctx context.Context, global bool, driver, command string) ([]string, error) {
+	var entries []string
+	for _, entry := range configEntries(driver, command) {
+		if err := gitConfig(ctx, global, entry[0], entry[1]); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry[0]+" = "+entry[1])
+	}
+	return entries, nil
+}
+
+// AddAttributes adds an attribute line per extension, assigning driver, to
+// the attributes file and returns the file and the lines that were not
+// present yet.
+func AddAttributes(ctx context.Context, global bool, driver string, exts []string) (string, []string, error) {
+	exts, err := normalizeExtensions(exts)
+	if err != nil {
+		return "", nil, err
+	}
+	attrFile, err := attributesFile(ctx, global)
+	if err != nil {
+		return "", nil, err
+	}
+	lines := make([]string, len(exts))
+	for i, ext := range exts {
+		lines[i] = AttributeLine(driver, ext)
+	}
+	added, err := appendLines(attrFile, lines)
+	if err != nil {
+		return "", nil, err
+	}
+	return attrFile, added, nil
+}
+
+// configEntries returns the git config entries of driver for command. The
+// filter is required, so git fails instead of storing the binary database if
+// gitsqlite fails or is missing. The profile is given as a single word, so
+// that the operation stays the first clean or smudge word of the command.
+func configEntries(driver, command string) [][2]string {
+	if driver != Driver {
+		command += " -config-profile=" + driver
+	}
+	return [][2]string{
+		{"filter." + driver + ".clean", command + " clean"},
+		{"filter." + driver + ".smudge", command + " smudge"},
+		{"filter." + driver + ".required", "true"},
+		{"diff." + driver + ".textconv", command + " textconv"},
+	}
+}
+
+// AttributeLine returns the attribute line assigning the filter and diff
+// driver to files with extension ext.
+func AttributeLine(driver, ext string) string {
+	return "*" + ext + " filter=" + driver + " diff=" + driver
+}
+
+// ParseExtensions splits a comma-separated extension list.
+func ParseExtensions(list string) []string {
+	var exts []string
+	for _, ext := range strings.Split(list, ",") {
+		if ext = strings.TrimSpace(ext); ext != "" {
+			exts = append(exts, ext)
+		}
+	}
+	return exts
+}
+
+// normalizeExtensions accepts "db", ".db" and "*.db" and returns ".db".
+func normalizeExtensions(exts []string) ([]string, error) {
+	if len(exts) == 0 {
+		exts = DefaultExtensions
+	}
+	var out []string
+	for _, ext := range exts {
+		ext = "." + strings.TrimLeft(ext, "*.")
+		if ext == "." || strings.ContainsAny(ext, " \t/\\") {
+			return nil, fmt.Errorf("invalid file extension %q", ext)
+		}
+		out = append(out, ext)
+	}
+	return out, nil
+}
+
+// DefaultCommand returns how git should invoke the running executable: plain
+// "gitsqlite" if that resolves to it via PATH, otherwise its absolute path.
+// git runs filter commands through a POSIX shell, also on Windows, so the path
+// uses forward slashes and is quoted if it contains spaces.
+func DefaultCommand() string {
+	exe, err := os.Executable()
+	if err != nil {
+		return Driver
+	}
+	exe, _ = filepath.EvalSymlinks(exe)
+	if found, err := exec.LookPath(Driver); err == nil {
+		if found, err = filepath.EvalSymlinks(found); err == nil && sameFile(found, exe) {
+			return Driver
+		}
+	}
+	return shellPath(exe)
+}
+
+// shellPath returns path as a word of a POSIX shell command, with forward
+// slashes and quoted if it contains spaces.
+func shellPath(path string) string {
+	path = filepath.ToSlash(path)
+	if strings.ContainsAny(path, " \t'&()") {
+		return `"` + path + `"`
+	}
+	return path
+}
+
+// sameFile reports whether a and b name the same file.
+func sameFile(a, b string) bool {
+	ia, err := os.Stat(a)
+	if err != nil {
+		return false
+	}
+	ib, err := os.Stat(b)
+	if err != nil {
+		return false
+	}
+	return os.SameFile(ia, ib)
+}
+
+// gitConfig sets key to value in the local or global git config.
+func gitConfig(ctx context.Context, global bool, key, value string) error {
+	out, err := exec.CommandContext(ctx, "git", "config", scopeFlag(global), key, value).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("git config %s failed: %s: %w", key, strings.TrimSpace(string(out)), err)
+	}
+	return nil
+}
+
+// scopeFlag returns the git config option selecting the scope.
+func scopeFlag(global bool) string {
+	if global {
+		return "--global"
+	}
+	return "--local"
+}
+
+// attributesFile returns the .gitattributes file at the root of the current
+// repository, or the global attributes file (core.attributesFile, by default
+// $XDG_CONFIG_HOME/git/attributes).
+func attributesFile(ctx context.Context, global bool) (string, error) {
+	if !global {
+		out, err := exec.CommandContext(ctx, "git", "rev-parse", "--show-toplevel").Output()
+		if err != nil {
+			return "", fmt.Errorf("not inside a git repository (use --global to configure all repositories): %w", err)
+		}
+		return filepath.Join(filepath.FromSlash(strings.TrimSpace(string(out))), ".gitattributes"), nil
+	}
+
+	// --path expands a leading ~
+	out, err := exec.CommandContext(ctx, "git", "config", "--global", "--path", "--get", "core.attributesFile").Output()
+	if path := strings.TrimSpace(string(out)); err == nil && path != "" {
+		return filepath.FromSlash(path), nil
+	}
+	configHome := os.Getenv("XDG_CONFIG_HOME")
+	if configHome == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		configHome = filepath.Join(home, ".config")
+	}
+	return filepath.Join(configHome, "git", "attributes"), nil
+}
+
+// appendLines appends the lines not yet present in path and returns them.
+// Files using CRLF line endings keep them.
+func appendLines(path string, lines []string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	existing := make(map[string]bool)
+	for _, line := range strings.Split(string(data), "\n") {
+		existing[strings.TrimSpace(line)] = true
+	}
+	var added []string
+	for _, line := range lines {
+		if !existing[line] {
+			added = append(added, line)
+			existing[line] = true
+		}
+	}
+	if len(added) == 0 {
+		return nil, nil
+	}
+
+	eol := "\n"
+	if strings.Contains(string(data), "\r\n") {
+		eol = "\r\n"
+	}
+	var b strings.Builder
+	b.Write(data)
+	if len(data) > 0 && !strings.HasSuffix(string(data), "\n") {
+		b.WriteString(eol)
+	}
+	for _, line := range added {
+		b.WriteString(line + eol)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(path, []byte(b.String()), 0o644); err != nil {
+		return nil, err
+	}
+	return added, nil
+}
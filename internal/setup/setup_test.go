@@ -0,0 +1,135 @@
+package setup
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// initRepo creates a repository in a temporary directory, makes it the
+// working directory and keeps git away from the user's global and system
+// config. It returns the root of the repository.
+func initRepo(t *testing.T) string {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", filepath.Join(home, ".config"))
+	t.Setenv("GIT_CONFIG_GLOBAL", filepath.Join(home, ".gitconfig"))
+	t.Setenv("GIT_CONFIG_NOSYSTEM", "1")
+	t.Chdir(root)
+	git(t, "init", "-q")
+	return root
+}
+
+// git runs git in the working directory and returns its output.
+func git(t *testing.T, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", append([]string{"-c", "user.name=t", "-c", "user.email=t@example.com"}, args...)...)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %v: %v\n%s", args, err, out)
+	}
+	return string(out)
+}
+
+func TestInstall(t *testing.T) {
+	ctx := context.Background()
+	root := initRepo(t)
+	attrs := filepath.Join(root, ".gitattributes")
+	// An existing file with CRLF line endings, without a final newline and
+	// with one of the lines already
+	existing := "*.txt text\r\n*.db filter=gitsqlite diff=gitsqlite\r\n*.png binary"
+	if err := os.WriteFile(attrs, []byte(existing), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	opts := Options{Extensions: []string{"db", "*.sqlite"}, Command: `"/opt/git tools/gitsqlite"`}
+	result, err := Install(ctx, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.AttributesFile != attrs || strings.Join(result.Added, "|") != "*.sqlite filter=gitsqlite diff=gitsqlite" {
+		t.Errorf("Install = %+v, want the .sqlite line added to %s", result, attrs)
+	}
+	want := existing + "\r\n*.sqlite filter=gitsqlite diff=gitsqlite\r\n"
+	if data, _ := os.ReadFile(attrs); string(data) != want {
+		t.Errorf(".gitattributes = %q, want %q", data, want)
+	}
+	if got := git(t, "config", "--get-all", "filter.gitsqlite.clean"); got != `"/opt/git tools/gitsqlite" clean`+"\n" {
+		t.Errorf("filter.gitsqlite.clean = %q", got)
+	}
+
+	// Running it again changes nothing
+	result, err = Install(ctx, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Added) != 0 {
+		t.Errorf("second Install added %q", result.Added)
+	}
+	if data, _ := os.ReadFile(attrs); string(data) != want {
+		t.Errorf(".gitattributes after a second Install = %q, want %q", data, want)
+	}
+	for _, key := range []string{"filter.gitsqlite.clean", "filter.gitsqlite.smudge", "filter.gitsqlite.required", "diff.gitsqlite.textconv"} {
+		if got := git(t, "config", "--get-all", key); strings.Count(got, "\n") != 1 {
+			t.Errorf("%s after a second Install = %q, want one entry", key, got)
+		}
+	}
+
+	// A named driver without extensions gets no attribute lines
+	result, err = Install(ctx, Options{Name: "strict", Command: "gitsqlite"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Added) != 0 {
+		t.Errorf("Install of a named driver added %q", result.Added)
+	}
+	if got := git(t, "config", "filter.strict.smudge"); got != "gitsqlite -config-profile=strict smudge\n" {
+		t.Errorf("filter.strict.smudge = %q", got)
+	}
+}
+
+func TestInstallOutsideRepository(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	t.Setenv("GIT_CEILING_DIRECTORIES", filepath.Dir(t.TempDir()))
+	t.Chdir(t.TempDir())
+	if _, err := Install(context.Background(), Options{Command: "gitsqlite"}); err == nil || !strings.Contains(err.Error(), "--global") {
+		t.Errorf("Install outside a repository = %v, want a hint to --global", err)
+	}
+}
+
+func TestShellPath(t *testing.T) {
+	for path, want := range map[string]string{
+		"/usr/local/bin/gitsqlite":                "/usr/local/bin/gitsqlite",
+		"/opt/git tools/gitsqlite":                `"/opt/git tools/gitsqlite"`,
+		"/home/o'neil/bin/gitsqlite":              `"/home/o'neil/bin/gitsqlite"`,
+		filepath.Join("tools (x86)", "gitsqlite"): `"tools (x86)/gitsqlite"`,
+	} {
+		if got := shellPath(path); got != want {
+			t.Errorf("shellPath(%q) = %s, want %s", path, got, want)
+		}
+	}
+}
+
+func TestNormalizeExtensions(t *testing.T) {
+	got, err := normalizeExtensions([]string{"db", ".sqlite", "*.sqlite3"})
+	if err != nil || strings.Join(got, ",") != ".db,.sqlite,.sqlite3" {
+		t.Errorf("normalizeExtensions = %q, %v", got, err)
+	}
+	for _, ext := range []string{"*", "my db", "data/db"} {
+		if _, err := normalizeExtensions([]string{ext}); err == nil {
+			t.Errorf("normalizeExtensions accepted %q", ext)
+		}
+	}
+}
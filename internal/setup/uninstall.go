@@ -0,0 +1,194 @@
+package setup
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/danielsiegl/gitsqlite/internal/sqlite"
+)
+
+// UninstallOptions selects what Uninstall removes.
+type UninstallOptions struct {
+	// Global removes the configuration from the user's global git config and
+	// attributes file instead of those of the current repository.
+	Global bool
+	// DryRun only reports what would be changed.
+	DryRun bool
+	// Renormalize stages the tracked databases as binary files, so that the
+	// repository is usable without gitsqlite once the change is committed.
+	Renormalize bool
+	// Name removes the driver registered by Install with this Name instead
+	// of the plain one.
+	Name string
+}
+
+// UninstallResult describes what Uninstall changed, or would change in a dry
+// run.
+type UninstallResult struct {
+	// Config lists the removed config entries as "key = value".
+	Config []string
+	// AttributesFile is the attributes file lines were removed from.
+	AttributesFile string
+	// Removed lists the removed attribute lines.
+	Removed []string
+	// Staged lists the databases staged as binary files.
+	Staged []string
+	// Skipped lists tracked files using the filter that are not binary
+	// databases in the worktree and were therefore not staged.
+	Skipped []string
+}
+
+// Uninstall removes the filter and diff driver config and the attribute lines
+// written by Install. Running it again changes nothing.
+func Uninstall(ctx context.Context, opts UninstallOptions) (*UninstallResult, error) {
+	if opts.Renormalize && opts.Global {
+		return nil, fmt.Errorf("renormalizing needs a repository and cannot be combined with --global")
+	}
+	driver := DriverName(opts.Name)
+	attrFile, err := attributesFile(ctx, opts.Global)
+	if err != nil {
+		return nil, err
+	}
+	result := &UninstallResult{AttributesFile: attrFile}
+
+	// The attributes are needed to find the filtered files, so look them
+	// up before removing anything
+	if opts.Renormalize {
+		files, err := filteredFiles(ctx, filepath.Dir(attrFile), driver)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			if sqlite.IsDatabaseFile(file) {
+				result.Staged = append(result.Staged, file)
+			} else {
+				result.Skipped = append(result.Skipped, file)
+			}
+		}
+	}
+
+	for _, section := range []string{"filter." + driver, "diff." + driver} {
+		entries, err := configSection(ctx, opts.Global, section)
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) == 0 {
+			continue
+		}
+		result.Config = append(result.Config, entries...)
+		if opts.DryRun {
+			continue
+		}
+		out, err := exec.CommandContext(ctx, "git", "config", scopeFlag(opts.Global), "--remove-section", section).CombinedOutput()
+		if err != nil {
+			return nil, fmt.Errorf("git config --remove-section %s failed: %s: %w", section, strings.TrimSpace(string(out)), err)
+		}
+	}
+
+	result.Removed, err = removeAttributeLines(attrFile, driver, opts.DryRun)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(result.Staged) > 0 && !opts.DryRun {
+		args := append([]string{"add", "--renormalize", "--"}, result.Staged...)
+		if len(result.Removed) > 0 {
+			// Commit the removed attributes together with the binary files
+			args = append(args, attrFile)
+		}
+		if out, err := exec.CommandContext(ctx, "git", args...).CombinedOutput(); err != nil {
+			return nil, fmt.Errorf("git add --renormalize failed: %s: %w", strings.TrimSpace(string(out)), err)
+		}
+	}
+	return result, nil
+}
+
+// configSection returns the entries of a config section as "key = value".
+func configSection(ctx context.Context, global bool, section string) ([]string, error) {
+	pattern := "^" + strings.ReplaceAll(section, ".", `\.`) + `\.`
+	out, err := exec.CommandContext(ctx, "git", "config", scopeFlag(global), "--get-regexp", pattern).Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 1 {
+			// No matching entries
+			return nil, nil
+		}
+		return nil, fmt.Errorf("git config --get-regexp %s failed: %w", pattern, err)
+	}
+	var entries []string
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		key, value, _ := strings.Cut(line, " ")
+		entries = append(entries, key+" = "+value)
+	}
+	return entries, nil
+}
+
+// isInstalledLine reports whether line is an attribute line written by
+// Install for driver, for any pattern, possibly with -text added as doctor
+// suggests.
+func isInstalledLine(line, driver string) bool {
+	fields := strings.Fields(line)
+	if len(fields) == 4 && fields[3] == "-text" {
+		fields = fields[:3]
+	}
+	return len(fields) == 3 && fields[1] == "filter="+driver && fields[2] == "diff="+driver
+}
+
+// removeAttributeLines removes the lines written by Install for driver from
+// path and returns them. A missing file has nothing to remove.
+func removeAttributeLines(path, driver string, dryRun bool) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var removed []string
+	var kept [][]byte
+	for _, line := range bytes.SplitAfter(data, []byte("\n")) {
+		if isInstalledLine(string(line), driver) {
+			removed = append(removed, strings.TrimSpace(string(line)))
+			continue
+		}
+		kept = append(kept, line)
+	}
+	if len(removed) == 0 || dryRun {
+		return removed, nil
+	}
+	if err := os.WriteFile(path, bytes.Join(kept, nil), 0o644); err != nil {
+		return nil, err
+	}
+	return removed, nil
+}
+
+// filteredFiles returns the paths of the tracked files in the worktree at root
+// that use the filter driver.
+func filteredFiles(ctx context.Context, root, driver string) ([]string, error) {
+	ls := exec.CommandContext(ctx, "git", "ls-files", "-z")
+	ls.Dir = root
+	tracked, err := ls.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git ls-files failed: %w", err)
+	}
+	cmd := exec.CommandContext(ctx, "git", "check-attr", "-z", "--stdin", "filter")
+	cmd.Dir = root
+	cmd.Stdin = bytes.NewReader(tracked)
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git check-attr failed: %w", err)
+	}
+	// Output is a sequence of <path> NUL <attribute> NUL <value> NUL
+	fields := strings.Split(string(out), "\x00")
+	var files []string
+	for i := 0; i+2 < len(fields); i += 3 {
+		if fields[i+2] == driver {
+			files = append(files, filepath.Join(root, filepath.FromSlash(fields[i])))
+		}
+	}
+	return files, nil
+}
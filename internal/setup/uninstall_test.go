@@ -0,0 +1,113 @@
+package setup
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUninstall(t *testing.T) {
+	ctx := context.Background()
+	root := initRepo(t)
+	attrs := filepath.Join(root, ".gitattributes")
+	unrelated := "# databases\n*.txt text\n*.db -diff\n"
+	if err := os.WriteFile(attrs, []byte(unrelated), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Install(ctx, Options{Extensions: []string{"db", "sqlite"}, Command: "gitsqlite"}); err != nil {
+		t.Fatal(err)
+	}
+	// -text as doctor suggests, and a line of another driver
+	data, _ := os.ReadFile(attrs)
+	installed := strings.Replace(string(data), "*.sqlite filter=gitsqlite diff=gitsqlite", "*.sqlite filter=gitsqlite diff=gitsqlite -text", 1) +
+		"*.qea filter=strict diff=strict\n"
+	if err := os.WriteFile(attrs, []byte(installed), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	config := git(t, "config", "--local", "--list")
+
+	// A dry run reports what would be removed and changes nothing
+	result, err := Uninstall(ctx, UninstallOptions{DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Config) != 4 || len(result.Removed) != 2 {
+		t.Errorf("dry run = %+v, want 4 config entries and 2 attribute lines", result)
+	}
+	if data, _ := os.ReadFile(attrs); string(data) != installed {
+		t.Errorf("dry run changed .gitattributes to %q", data)
+	}
+	if got := git(t, "config", "--local", "--list"); got != config {
+		t.Errorf("dry run changed the config to\n%s\nfrom\n%s", got, config)
+	}
+
+	result, err = Uninstall(ctx, UninstallOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Config) != 4 || strings.Join(result.Removed, "|") != "*.db filter=gitsqlite diff=gitsqlite|*.sqlite filter=gitsqlite diff=gitsqlite -text" {
+		t.Errorf("Uninstall = %+v", result)
+	}
+	if data, _ := os.ReadFile(attrs); string(data) != unrelated+"*.qea filter=strict diff=strict\n" {
+		t.Errorf(".gitattributes = %q, want the unrelated lines kept", data)
+	}
+	if got := git(t, "config", "--local", "--list"); strings.Contains(got, "gitsqlite") {
+		t.Errorf("config after Uninstall:\n%s", got)
+	}
+
+	// Running it again changes nothing
+	result, err = Uninstall(ctx, UninstallOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Config) != 0 || len(result.Removed) != 0 {
+		t.Errorf("second Uninstall = %+v, want nothing removed", result)
+	}
+}
+
+func TestUninstallRenormalize(t *testing.T) {
+	ctx := context.Background()
+	root := initRepo(t)
+	// A filter that marks the files it cleans, so that the test needs no
+	// gitsqlite on the PATH
+	if _, err := Install(ctx, Options{Command: `sh -c 'cat; test "$0" = clean && echo cleaned'`}); err != nil {
+		t.Fatal(err)
+	}
+	database := "SQLite format 3\x00" + strings.Repeat("\x01", 100)
+	for name, content := range map[string]string{"app.db": database, "notes.db": "not a database\n", "readme.txt": "x\n"} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	git(t, "add", "-A")
+	git(t, "commit", "-q", "-m", "databases")
+	if got := git(t, "show", ":app.db"); !strings.HasSuffix(got, "cleaned\n") {
+		t.Fatalf("app.db was not stored through the filter: %q", got)
+	}
+
+	if _, err := Uninstall(ctx, UninstallOptions{Global: true, Renormalize: true}); err == nil {
+		t.Error("Uninstall accepted --global with --renormalize")
+	}
+	result, err := Uninstall(ctx, UninstallOptions{Renormalize: true, DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Staged) != 1 || filepath.Base(result.Staged[0]) != "app.db" || len(result.Skipped) != 1 || filepath.Base(result.Skipped[0]) != "notes.db" {
+		t.Errorf("dry run staged %q and skipped %q, want app.db and notes.db", result.Staged, result.Skipped)
+	}
+	if got := git(t, "status", "--porcelain"); got != "" {
+		t.Errorf("dry run changed the repository:\n%s", got)
+	}
+
+	if _, err := Uninstall(ctx, UninstallOptions{Renormalize: true}); err != nil {
+		t.Fatal(err)
+	}
+	if got := git(t, "diff", "--cached", "--name-only"); got != ".gitattributes\napp.db\n" {
+		t.Errorf("staged after Uninstall:\n%s", got)
+	}
+	if got := git(t, "show", ":app.db"); got != database {
+		t.Errorf("app.db is staged as %q, want the binary database", got)
+	}
+}
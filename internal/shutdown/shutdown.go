@@ -0,0 +1,81 @@
+// Package shutdown is the registry of what has to happen before gitsqlite
+// exits, whichever way it exits: removing temporary files, killing sqlite3
+// processes, stopping profiles, exporting telemetry and flushing the log.
+// Code registers the work when it creates what needs it and unregisters it
+// when it cleans up by itself. main runs the registry when it returns, and
+// every other exit goes through Exit, which runs it too; deferred functions
+// do not run on os.Exit, such as after a second interrupt.
+package shutdown
+
+import (
+	"os"
+	"sync"
+)
+
+var (
+	mu      sync.Mutex
+	nextID  int
+	pending []task
+	// running serializes Run, so a second caller, such as the interrupt
+	// handler, waits until the log has been flushed before exiting
+	running sync.Mutex
+)
+
+type task struct {
+	id int
+	fn func()
+}
+
+// Register adds fn to the registry and returns the function removing it
+// again without running it. fn runs at most once.
+func Register(fn func()) (unregister func()) {
+	mu.Lock()
+	defer mu.Unlock()
+	nextID++
+	id := nextID
+	pending = append(pending, task{id: id, fn: fn})
+	return func() {
+		mu.Lock()
+		defer mu.Unlock()
+		for i, t := range pending {
+			if t.id == id {
+				pending = append(pending[:i], pending[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+// Remove registers removing path and everything below it, and returns the
+// function doing it right away, to defer where path was created.
+func Remove(path string) (remove func()) {
+	unregister := Register(func() { os.RemoveAll(path) })
+	return func() {
+		unregister()
+		os.RemoveAll(path)
+	}
+}
+
+// Run runs the registered functions, the last registered first, and empties
+// the registry. Functions registered meanwhile run too.
+func Run() {
+	running.Lock()
+	defer running.Unlock()
+	for {
+		mu.Lock()
+		if len(pending) == 0 {
+			mu.Unlock()
+			return
+		}
+		t := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		mu.Unlock()
+		t.fn()
+	}
+}
+
+// Exit runs the registered functions and exits with code.
+func Exit(code int) {
+	Run()
+	os.Exit(code)
+}
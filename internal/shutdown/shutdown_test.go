@@ -0,0 +1,48 @@
+package shutdown
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRun(t *testing.T) {
+	var ran []string
+	Register(func() { ran = append(ran, "log") })
+	unregister := Register(func() { ran = append(ran, "unregistered") })
+	Register(func() {
+		ran = append(ran, "profiles")
+		Register(func() { ran = append(ran, "late") })
+	})
+	unregister()
+	unregister()
+	Run()
+	Run()
+	if want := []string{"profiles", "late", "log"}; !reflect.DeepEqual(ran, want) {
+		t.Errorf("ran %v, want %v", ran, want)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	dir := t.TempDir()
+	kept := filepath.Join(dir, "kept")
+	left := filepath.Join(dir, "left")
+	for _, path := range []string{kept, left} {
+		if err := os.WriteFile(path, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	Remove(kept)()
+	if err := os.WriteFile(kept, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	Remove(left)
+	Run()
+	if _, err := os.Stat(left); !os.IsNotExist(err) {
+		t.Errorf("%s not removed by Run: %v", left, err)
+	}
+	if _, err := os.Stat(kept); err != nil {
+		t.Errorf("%s removed again by Run: %v", kept, err)
+	}
+}
@@ -0,0 +1,86 @@
+package sqlite
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/danielsiegl/gitsqlite/internal/warnings"
+)
+
+// Attachment is a database attached to every SQLite session of the engine
+// under Name, so that views, triggers and queries (e.g. subset rules) can use
+// its tables. Only the main database is dumped and restored.
+type Attachment struct {
+	Name string
+	Path string
+}
+
+// ParseAttachments parses a comma-separated list of name=path items.
+func ParseAttachments(list string) ([]Attachment, error) {
+	var attachments []Attachment
+	seen := map[string]bool{}
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, path, ok := strings.Cut(item, "=")
+		name, path = strings.TrimSpace(name), strings.TrimSpace(path)
+		if !ok || name == "" || path == "" {
+			return nil, fmt.Errorf("attachment %q: expected name=path", item)
+		}
+		if lower := strings.ToLower(name); lower == "main" || lower == "temp" {
+			return nil, fmt.Errorf("attachment %q: %s is reserved", item, name)
+		}
+		if seen[strings.ToLower(name)] {
+			return nil, fmt.Errorf("attachment %q: duplicate name %s", item, name)
+		}
+		seen[strings.ToLower(name)] = true
+		attachments = append(attachments, Attachment{Name: name, Path: path})
+	}
+	return attachments, nil
+}
+
+// statement returns the ATTACH statement for a.
+func (a Attachment) statement() string {
+	return "ATTACH DATABASE " + QuoteLiteral(a.Path) + " AS " + QuoteIdent(a.Name) + ";"
+}
+
+// attachments returns the attachments whose files exist. ATTACH would create
+// a missing file, and during a checkout the other database may simply not
+// be written yet, so missing ones are skipped with a warning, once.
+func (e *Engine) attachments() []Attachment {
+	e.attachOnce.Do(func() {
+		for _, a := range e.Attach {
+			if _, err := os.Stat(a.Path); err != nil {
+				warnings.Emit(warnings.AttachMissing, "database %s to attach as %s not found, continuing without it", a.Path, a.Name)
+				continue
+			}
+			e.attached = append(e.attached, a)
+		}
+	})
+	return e.attached
+}
+
+// attachEmbedded attaches the attachments to an embedded connection.
+func attachEmbedded(ctx context.Context, conn *sql.Conn, attachments []Attachment) error {
+	for _, a := range attachments {
+		if _, err := conn.ExecContext(ctx, a.statement()); err != nil {
+			return fmt.Errorf("attaching %s as %s: %w", a.Path, a.Name, err)
+		}
+	}
+	return nil
+}
+
+// WithAttachment returns an engine like e that attaches a to every session
+// as well, using the sqlite3 binary e resolved.
+func (e *Engine) WithAttachment(a Attachment) *Engine {
+	e.mu.Lock()
+	resolved := e.resolved
+	e.mu.Unlock()
+	attach := append(append([]Attachment(nil), e.Attach...), a)
+	return &Engine{Bin: e.Bin, Embedded: e.Embedded, Select: e.Select, Attach: attach, Extensions: e.Extensions, resolved: resolved}
+}
@@ -0,0 +1,21 @@
+package sqlite
+
+import "testing"
+
+func TestParseAttachments(t *testing.T) {
+	got, err := ParseAttachments(" shared = data/shared.db ,ref=it's.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[0] != (Attachment{"shared", "data/shared.db"}) || got[1].Path != "it's.db" {
+		t.Fatalf("ParseAttachments() = %+v", got)
+	}
+	if want := `ATTACH DATABASE 'it''s.db' AS "ref";`; got[1].statement() != want {
+		t.Errorf("statement() = %s, want %s", got[1].statement(), want)
+	}
+	for _, bad := range []string{"shared", "=a.db", "temp=a.db", "a=x.db,A=y.db"} {
+		if _, err := ParseAttachments(bad); err == nil {
+			t.Errorf("ParseAttachments(%q) succeeded", bad)
+		}
+	}
+}
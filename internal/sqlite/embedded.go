@@ -0,0 +1,530 @@
+package sqlite
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite" // registers the "sqlite" database/sql driver
+)
+
+// EmbeddedPath is reported as the location of the embedded engine.
+const EmbeddedPath = "embedded (modernc.org/sqlite)"
+
+// openEmbedded opens dbPath with the embedded SQLite library and returns a
+// single connection, so that statements share transaction state like they do
+// in a sqlite3 CLI session. The attachments are attached to it.
+func openEmbedded(ctx context.Context, dbPath string, attach []Attachment) (*sql.DB, *sql.Conn, error) {
+	db, err := sql.Open("sqlite", dbPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn, err := db.Conn(ctx)
+	if err == nil {
+		if err = attachEmbedded(ctx, conn, attach); err != nil {
+			conn.Close()
+		}
+	}
+	if err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	return db, conn, nil
+}
+
+// restoreEmbedded executes the SQL script read from r against dbPath.
+func restoreEmbedded(ctx context.Context, dbPath string, attach []Attachment, r io.Reader) error {
+	script, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	db, conn, err := openEmbedded(ctx, dbPath, attach)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, string(script)); err != nil {
+		return classify(ctx, "restore", "", err)
+	}
+
+	// The embedded library is built with STAT4, so "ANALYZE sqlite_schema;"
+	// also creates sqlite_stat4, which the sqlite3 CLI does not. Drop it while
+	// empty so the restored database dumps like one restored by the CLI.
+	var stat4 int
+	if err := conn.QueryRowContext(ctx, "SELECT count(*) FROM sqlite_schema WHERE name='sqlite_stat4';").Scan(&stat4); err != nil {
+		return err
+	}
+	if stat4 == 0 {
+		return nil
+	}
+	var rows int
+	if err := conn.QueryRowContext(ctx, "SELECT count(*) FROM sqlite_stat4;").Scan(&rows); err != nil {
+		return err
+	}
+	if rows == 0 {
+		if _, err := conn.ExecContext(ctx, "DROP TABLE sqlite_stat4;"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queryEmbedded runs query against dbPath and returns the result rows as text,
+// formatted like the sqlite3 CLI in CSV mode.
+func queryEmbedded(ctx context.Context, dbPath string, attach []Attachment, query string) ([][]string, error) {
+	db, conn, err := openEmbedded(ctx, dbPath, attach)
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+	defer conn.Close()
+
+	rows, err := conn.QueryContext(ctx, query)
+	if err != nil {
+		return nil, classify(ctx, "query", "", err)
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	var result [][]string
+	values := make([]any, len(columns))
+	ptrs := make([]any, len(columns))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, classify(ctx, "query", "", err)
+		}
+		row := make([]string, len(values))
+		for i, v := range values {
+			row[i] = textValue(v)
+		}
+		result = append(result, row)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, classify(ctx, "query", "", err)
+	}
+	return result, nil
+}
+
+// textValue converts a value returned by the driver to the text sqlite3
+// would print for it.
+func textValue(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return formatGeneric(v, 15)
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case time.Time:
+		// The driver parses text in DATE/DATETIME columns; this is the
+		// layout it writes such values in
+		return v.Format("2006-01-02 15:04:05.999999999-07:00")
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// embeddedVersion returns the version of the embedded SQLite library in the
+// format of "sqlite3 -version".
+func embeddedVersion(ctx context.Context) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, ProbeTimeout)
+	defer cancel()
+	rows, err := queryEmbedded(ctx, ":memory:", nil, "SELECT sqlite_version() || ' ' || sqlite_source_id();")
+	if err != nil {
+		return "", err
+	}
+	if len(rows) != 1 || len(rows[0]) != 1 {
+		return "", fmt.Errorf("unexpected version query result %q", rows)
+	}
+	return rows[0][0], nil
+}
+
+// dumpEmbedded writes the same SQL text as "sqlite3 dbPath .dump" to out.
+func dumpEmbedded(ctx context.Context, dbPath string, attach []Attachment, out io.Writer) error {
+	db, conn, err := openEmbedded(ctx, dbPath, attach)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	defer conn.Close()
+
+	// Read everything from one snapshot, like the CLI's "SAVEPOINT dump"
+	if _, err := conn.ExecContext(ctx, "BEGIN;"); err != nil {
+		return classify(ctx, "dump", "", err)
+	}
+	defer conn.ExecContext(context.Background(), "ROLLBACK;")
+
+	w := bufio.NewWriterSize(out, 256*1024)
+	d := &dumper{ctx: ctx, conn: conn, w: w}
+	if err := d.dump(); err != nil {
+		return classify(ctx, "dump", "", err)
+	}
+	return w.Flush()
+}
+
+// tableRowsEmbedded writes the rows of table like .dump does, sorted by the
+// orderBy columns.
+func tableRowsEmbedded(ctx context.Context, dbPath string, attach []Attachment, table string, where string, orderBy []string, out io.Writer) error {
+	db, conn, err := openEmbedded(ctx, dbPath, attach)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	defer conn.Close()
+
+	w := bufio.NewWriterSize(out, 256*1024)
+	d := &dumper{ctx: ctx, conn: conn, w: w}
+	if err := d.writeRows(table, where, orderBy); err != nil {
+		return classify(ctx, "query", "", err)
+	}
+	return w.Flush()
+}
+
+// dumper mirrors the .dump command of the sqlite3 shell.
+type dumper struct {
+	ctx            context.Context
+	conn           *sql.Conn
+	w              *bufio.Writer
+	writableSchema bool
+}
+
+func (d *dumper) dump() error {
+	var virtual int
+	if err := d.conn.QueryRowContext(d.ctx,
+		"SELECT count(*) FROM sqlite_schema WHERE sql LIKE 'CREATE VIRTUAL TABLE%';").Scan(&virtual); err != nil {
+		return err
+	}
+	if virtual > 0 {
+		d.w.WriteString("/* WARNING: Script requires that SQLITE_DBCONFIG_DEFENSIVE be disabled */\n")
+	}
+	d.w.WriteString("PRAGMA foreign_keys=OFF;\nBEGIN TRANSACTION;\n")
+
+	type object struct{ name, kind, sql string }
+	var tables []object
+	rows, err := d.conn.QueryContext(d.ctx, "SELECT name, type, sql FROM sqlite_schema AS o "+
+		"WHERE (1) AND type=='table' AND sql NOT NULL "+
+		"ORDER BY tbl_name='sqlite_sequence', rowid")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var o object
+		if err := rows.Scan(&o.name, &o.kind, &o.sql); err != nil {
+			rows.Close()
+			return err
+		}
+		tables = append(tables, o)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, t := range tables {
+		if err := d.dumpTable(t.name, t.sql); err != nil {
+			return err
+		}
+	}
+
+	rows, err = d.conn.QueryContext(d.ctx, "SELECT sql FROM sqlite_schema AS o "+
+		"WHERE (1) AND sql NOT NULL AND type IN ('index','trigger','view') "+
+		"ORDER BY type COLLATE NOCASE DESC")
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var stmt string
+		if err := rows.Scan(&stmt); err != nil {
+			rows.Close()
+			return err
+		}
+		d.w.WriteString(stmt)
+		// A trailing line comment would swallow the semicolon
+		if strings.Contains(stmt, "--") {
+			d.w.WriteString("\n;\n")
+		} else {
+			d.w.WriteString(";\n")
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if d.writableSchema {
+		d.w.WriteString("PRAGMA writable_schema=OFF;\n")
+	}
+	d.w.WriteString("COMMIT;\n")
+	return nil
+}
+
+// dumpTable writes the definition and the rows of one table.
+func (d *dumper) dumpTable(name, createSQL string) error {
+	switch {
+	case name == "sqlite_sequence":
+		// Rows only; the table is created by AUTOINCREMENT
+	case len(name) == len("sqlite_stat1") && strings.HasPrefix(name, "sqlite_stat"):
+		d.w.WriteString("ANALYZE sqlite_schema;\n")
+	case strings.HasPrefix(name, "sqlite_"):
+		return nil
+	case strings.HasPrefix(createSQL, "CREATE VIRTUAL TABLE"):
+		// Virtual tables cannot be created before their module is loaded,
+		// so they are written into the schema directly; their content is
+		// restored through their shadow tables
+		if !d.writableSchema {
+			d.w.WriteString("PRAGMA writable_schema=ON;\n")
+			d.writableSchema = true
+		}
+		fmt.Fprintf(d.w, "INSERT INTO sqlite_schema(type,name,tbl_name,rootpage,sql)VALUES('table',%s,%s,0,%s);\n",
+			QuoteLiteral(name), QuoteLiteral(name), QuoteLiteral(createSQL))
+		return nil
+	default:
+		d.writeSchemaLine(createSQL)
+	}
+
+	return d.writeRows(name, "", nil)
+}
+
+// writeRows writes the rows of a table as INSERT statements, in storage
+// order or sorted by the orderBy columns, only those matching where if it is
+// not empty.
+func (d *dumper) writeRows(name string, where string, orderBy []string) error {
+	columns, err := d.columns(name)
+	if err != nil {
+		return err
+	}
+	selects := make([]string, len(columns))
+	for i, c := range columns {
+		// Unary plus hides the declared column type, so the driver returns
+		// values as stored instead of converting DATE columns to time.Time
+		selects[i] = "+" + QuoteIdent(c)
+	}
+	query := "SELECT " + strings.Join(selects, ",") + " FROM " + rowsSource(name, where, orderBy)
+	rows, err := d.conn.QueryContext(d.ctx, query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	prefix := "INSERT INTO " + quoteNameIfNeeded(name) + " VALUES("
+	values := make([]any, len(columns))
+	ptrs := make([]any, len(columns))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(ptrs...); err != nil {
+			return err
+		}
+		d.w.WriteString(prefix)
+		for i, v := range values {
+			if i > 0 {
+				d.w.WriteByte(',')
+			}
+			d.w.WriteString(literal(v))
+		}
+		d.w.WriteString(");\n")
+	}
+	return rows.Err()
+}
+
+// columns returns the names of the columns .dump selects: all columns except
+// generated and hidden ones.
+func (d *dumper) columns(table string) ([]string, error) {
+	rows, err := d.conn.QueryContext(d.ctx, "SELECT name FROM pragma_table_info("+QuoteLiteral(table)+")")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var columns []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		columns = append(columns, name)
+	}
+	return columns, rows.Err()
+}
+
+// writeSchemaLine writes a CREATE statement of a table. Like the shell, it
+// closes comments left open at the end and turns "CREATE TABLE 'x'" into
+// "CREATE TABLE IF NOT EXISTS 'x'".
+func (d *dumper) writeSchemaLine(stmt string) {
+	if strings.Contains(stmt, "/*") || strings.Contains(stmt, "--") {
+		for _, term := range []string{"", "*/", "\n"} {
+			if isComplete(stmt + term + ";") {
+				stmt += term
+				break
+			}
+		}
+	}
+	if strings.HasPrefix(stmt, "CREATE TABLE ") && len(stmt) > 13 && (stmt[13] == '\'' || stmt[13] == '"') {
+		stmt = "CREATE TABLE IF NOT EXISTS " + stmt[13:]
+	}
+	d.w.WriteString(stmt)
+	d.w.WriteString(";\n")
+}
+
+// isComplete reports whether sql ends in a semicolon outside of comments and
+// quotes. It covers what CREATE TABLE statements can contain; trigger bodies
+// never reach it.
+func isComplete(sql string) bool {
+	end := false
+	for i := 0; i < len(sql); i++ {
+		switch c := sql[i]; {
+		case c == ';':
+			end = true
+			continue
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\f':
+			continue
+		case c == '-' && i+1 < len(sql) && sql[i+1] == '-':
+			for i < len(sql) && sql[i] != '\n' {
+				i++
+			}
+			continue
+		case c == '/' && i+1 < len(sql) && sql[i+1] == '*':
+			j := strings.Index(sql[i+2:], "*/")
+			if j < 0 {
+				return false
+			}
+			i += j + 3
+			continue
+		case c == '\'' || c == '"' || c == '`' || c == '[':
+			closer := c
+			if c == '[' {
+				closer = ']'
+			}
+			j := strings.IndexByte(sql[i+1:], closer)
+			if j < 0 {
+				return false
+			}
+			i += j + 1
+		}
+		end = false
+	}
+	return end
+}
+
+// literal formats a value as an SQL literal the way the shell's insert mode
+// does.
+func literal(v any) string {
+	switch v := v.(type) {
+	case nil:
+		return "NULL"
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return realLiteral(v)
+	case string:
+		return textLiteral(v)
+	case []byte:
+		return "X'" + hex.EncodeToString(v) + "'"
+	case time.Time:
+		return textLiteral(textValue(v))
+	default:
+		return textLiteral(fmt.Sprint(v))
+	}
+}
+
+// realLiteral formats a REAL value; integral values keep a ".0" suffix so
+// they are read back as REAL.
+func realLiteral(r float64) string {
+	switch {
+	case math.IsInf(r, 1):
+		return "9.0e+999"
+	case math.IsInf(r, -1):
+		return "-9.0e+999"
+	case r >= -9.223372036854775808e18 && r < 9.223372036854775808e18 && r == math.Trunc(r):
+		return strconv.FormatInt(int64(r), 10) + ".0"
+	}
+	return formatGeneric(r, 20)
+}
+
+// textLiteral quotes a TEXT value. Values containing control characters are
+// written with unistr() escapes so that every row stays on one line.
+func textLiteral(s string) string {
+	control := false
+	for i := 0; i < len(s); i++ {
+		if s[i] < 0x20 {
+			control = true
+			break
+		}
+	}
+	if !control {
+		return QuoteLiteral(s)
+	}
+	var b strings.Builder
+	b.WriteString("unistr('")
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\'':
+			b.WriteString("''")
+		case c == '\\':
+			b.WriteString(`\\`)
+		case c < 0x20:
+			fmt.Fprintf(&b, `\u%04x`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteString("')")
+	return b.String()
+}
+
+// quoteNameIfNeeded double-quotes a table name unless it is a plain
+// identifier that is not a keyword.
+func quoteNameIfNeeded(name string) string {
+	if name == "" || !(isIdentStart(name[0])) || keywords[strings.ToUpper(name)] {
+		return QuoteIdent(name)
+	}
+	for i := 0; i < len(name); i++ {
+		if !isIdentStart(name[i]) && !(name[i] >= '0' && name[i] <= '9') {
+			return QuoteIdent(name)
+		}
+	}
+	return name
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// keywords are the SQLite keywords (sqlite3_keyword_name).
+var keywords = map[string]bool{}
+
+func init() {
+	for _, k := range strings.Fields(`ABORT ACTION ADD AFTER ALL ALTER ALWAYS ANALYZE AND AS ASC
+		ATTACH AUTOINCREMENT BEFORE BEGIN BETWEEN BY CASCADE CASE CAST CHECK COLLATE COLUMN
+		COMMIT CONFLICT CONSTRAINT CREATE CROSS CURRENT CURRENT_DATE CURRENT_TIME
+		CURRENT_TIMESTAMP DATABASE DEFAULT DEFERRABLE DEFERRED DELETE DESC DETACH DISTINCT DO
+		DROP EACH ELSE END ESCAPE EXCEPT EXCLUDE EXCLUSIVE EXISTS EXPLAIN FAIL FILTER FIRST
+		FOLLOWING FOR FOREIGN FROM FULL GENERATED GLOB GROUP GROUPS HAVING IF IGNORE IMMEDIATE
+		IN INDEX INDEXED INITIALLY INNER INSERT INSTEAD INTERSECT INTO IS ISNULL JOIN KEY LAST
+		LEFT LIKE LIMIT MATCH MATERIALIZED NATURAL NO NOT NOTHING NOTNULL NULL NULLS OF OFFSET
+		ON OR ORDER OTHERS OUTER OVER PARTITION PLAN PRAGMA PRECEDING PRIMARY QUERY RAISE RANGE
+		RECURSIVE REFERENCES REGEXP REINDEX RELEASE RENAME REPLACE RESTRICT RETURNING RIGHT
+		ROLLBACK ROW ROWS SAVEPOINT SELECT SET TABLE TEMP TEMPORARY THEN TIES TO TRANSACTION
+		TRIGGER UNBOUNDED UNION UNIQUE UPDATE USING VACUUM VALUES VIEW VIRTUAL WHEN WHERE WINDOW
+		WITH WITHOUT`) {
+		keywords[k] = true
+	}
+}
@@ -0,0 +1,229 @@
+package sqlite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os/exec"
+	"strings"
+
+	"github.com/danielsiegl/gitsqlite/internal/errs"
+)
+
+// Kinds of SQLite failures. Errors returned by the engine match them with
+// errors.Is; see Error.
+var (
+	ErrDiskFull      = errors.New("disk full")
+	ErrCorrupt       = errors.New("database corrupt")
+	ErrNotADatabase  = errors.New("not a database")
+	ErrLocked        = errors.New("database locked")
+	ErrNoSuchTable   = errors.New("no such table")
+	ErrNoExtension   = errors.New("extension missing")
+	ErrCannotOpen    = errors.New("cannot open database")
+	ErrReadOnly      = errors.New("database read-only")
+	ErrKilled        = errors.New("sqlite3 killed")
+	ErrUnclassified  = errors.New("sqlite3 failed")
+	errKindsByPhrase = []struct {
+		phrase string
+		kind   error
+	}{
+		// Checked in order; the first phrase found in the message wins
+		{"database or disk is full", ErrDiskFull},
+		{"no space left on device", ErrDiskFull},
+		{"disk image is malformed", ErrCorrupt},
+		{"malformed database schema", ErrCorrupt},
+		{"file is not a database", ErrNotADatabase},
+		{"file is encrypted", ErrNotADatabase},
+		{"is locked", ErrLocked},
+		{"database is busy", ErrLocked},
+		// Before "no such table": a table whose CREATE failed for want of
+		// an extension is missing in all later statements
+		{"no such function", ErrNoExtension},
+		{"no such module", ErrNoExtension},
+		{"no such collation sequence", ErrNoExtension},
+		{"no such tokenizer", ErrNoExtension},
+		{"no such table", ErrNoSuchTable},
+		{"unable to open database", ErrCannotOpen},
+		{"readonly database", ErrReadOnly},
+	}
+)
+
+// hints are the remediation hints shown for each kind of failure.
+var hints = map[error]string{
+	ErrDiskFull:     "free up disk space on the drive holding the database and the temporary directory (TMPDIR, or TEMP on Windows)",
+	ErrCorrupt:      "the database file is damaged; restore it with 'gitsqlite undo <file>' or 'git checkout -- <file>', or salvage it with 'sqlite3 <file> .recover'",
+	ErrNotADatabase: "the file is not a SQLite database; it may be a Git LFS pointer, an SQL dump or encrypted (check .gitattributes)",
+	ErrLocked:       "another program holds the database open; close it (e.g. your application or DB browser) and retry",
+	ErrNoSuchTable:  "a table named in the SQL or in -subset, -local-tables or -schema-file does not exist; check the table names",
+	ErrNoExtension:  "the database uses a function, collation, virtual table module or tokenizer that SQLite does not provide; load the extension defining it with -load-extension",
+	ErrCannotOpen:   "check that the file and its directory exist and are readable and writable",
+	ErrReadOnly:     "check the permissions of the database file and its directory",
+	ErrKilled:       "sqlite3 was terminated, e.g. by the system running out of memory or by a timeout",
+}
+
+// Error is a failed SQLite operation, classified from the stderr output and
+// exit code of sqlite3 or from the error of the embedded engine.
+type Error struct {
+	// Op is the failed operation, e.g. "dump".
+	Op string
+	// Kind is one of the Err* kinds above.
+	Kind error
+	// ExitCode is the exit code of sqlite3, or -1 if it was killed or not
+	// run.
+	ExitCode int
+	// Stderr is the trimmed error output of sqlite3.
+	Stderr string
+	// Err is the underlying error.
+	Err error
+	// TimedOut is set if the operation was stopped by a deadline.
+	TimedOut bool
+	// Interrupted is set if the operation was stopped by canceling its
+	// context, which gitsqlite does on SIGINT and SIGTERM.
+	Interrupted bool
+}
+
+func (e *Error) Error() string {
+	detail := e.Stderr
+	if first, rest, ok := strings.Cut(detail, "\n"); ok {
+		// A restore reports every failing statement; the first explains
+		// the most
+		detail = fmt.Sprintf("%s (and %d more lines)", first, strings.Count(rest, "\n")+1)
+	}
+	if detail == "" && e.Err != nil {
+		detail = e.Err.Error()
+	}
+	msg := fmt.Sprintf("SQLite %s failed: %s", e.Op, detail)
+	if e.ExitCode > 0 {
+		msg += fmt.Sprintf(" (exit code %d)", e.ExitCode)
+	}
+	return msg
+}
+
+func (e *Error) Unwrap() error { return e.Err }
+
+// Is reports whether target is the kind of e, or the errs kind of the failed
+// operation: errs.ErrInterrupted, errs.ErrTimeout, errs.ErrRestoreFailed or
+// errs.ErrDumpFailed.
+func (e *Error) Is(target error) bool {
+	switch target {
+	case e.Kind:
+		return true
+	case errs.ErrInterrupted:
+		return e.Interrupted
+	case errs.ErrTimeout:
+		return e.TimedOut
+	case errs.ErrRestoreFailed:
+		return e.Op == "restore"
+	case errs.ErrDumpFailed:
+		return e.Op != "restore"
+	}
+	return false
+}
+
+// Hint returns a remediation hint for err, or "" if there is none.
+func Hint(err error) string {
+	var sqlErr *Error
+	if errors.As(err, &sqlErr) {
+		return hints[sqlErr.Kind]
+	}
+	return ""
+}
+
+// Kind returns a short name of the kind of err for logs, or "" if err is not
+// a SQLite error.
+func Kind(err error) string {
+	var sqlErr *Error
+	if errors.As(err, &sqlErr) {
+		return sqlErr.Kind.Error()
+	}
+	return ""
+}
+
+// classify turns the failure of operation op into an *Error. stderr is the
+// error output of sqlite3, empty for the embedded engine; err is the error of
+// the command or library call. The failure is logged with its kind and exit
+// code.
+func classify(ctx context.Context, op, stderr string, err error) error {
+	stderr = strings.TrimSpace(stderr)
+	// A context canceled with a cause wrapping context.DeadlineExceeded,
+	// such as the time budget of a dump, timed out
+	cause := context.Cause(ctx)
+	timedOut := ctx.Err() != nil && errors.Is(cause, context.DeadlineExceeded)
+	e := &Error{Op: op, Kind: ErrUnclassified, ExitCode: -1, Stderr: stderr, Err: notFound(err),
+		TimedOut: timedOut, Interrupted: ctx.Err() != nil && !timedOut}
+	if ctx.Err() != nil && stderr == "" {
+		// Report why sqlite3 was killed rather than "signal: killed"
+		e.Err = cause
+	}
+
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		e.ExitCode = exitErr.ExitCode()
+		if e.ExitCode == -1 && ctx.Err() == nil {
+			e.Kind = ErrKilled
+		}
+	}
+	message := strings.ToLower(stderr)
+	if err != nil {
+		message += "\n" + strings.ToLower(err.Error())
+	}
+	for _, k := range errKindsByPhrase {
+		if strings.Contains(message, k.phrase) {
+			e.Kind = k.kind
+			break
+		}
+	}
+
+	slog.Error("SQLite command failed", "operation", op, "kind", e.Kind.Error(), "exitCode", e.ExitCode, "stderr", stderr, "error", err)
+	return e
+}
+
+// notFound marks err as errs.ErrSQLiteNotFound if sqlite3 could not be
+// started because the binary does not exist.
+func notFound(err error) error {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) && (errors.Is(err, exec.ErrNotFound) || errors.Is(err, fs.ErrNotExist)) {
+		return errs.Mark(err, errs.ErrSQLiteNotFound)
+	}
+	return err
+}
+
+// startFailure returns the reason sqlite3 could not be started: the cause of
+// the cancellation if ctx was already canceled, which is more telling than
+// "context canceled", otherwise err with a missing binary marked.
+func startFailure(ctx context.Context, err error) error {
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+	return notFound(err)
+}
+
+// stderrFailure reports the error output of a sqlite3 run that exited
+// successfully as a failure. The shell's .dump reports errors such as a
+// locked database only on stderr and still exits with 0.
+func stderrFailure(stderr string) error {
+	if strings.Contains(strings.ToLower(stderr), "error") {
+		return errors.New("sqlite3 reported errors")
+	}
+	return nil
+}
+
+// limitedBuffer keeps the first max bytes written to it and discards the
+// rest, so that a restore reporting an error per statement cannot exhaust
+// memory.
+type limitedBuffer struct {
+	strings.Builder
+	max int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.max - b.Len(); room > 0 {
+		b.Builder.Write(p[:min(len(p), room)])
+	}
+	return len(p), nil
+}
+
+// maxStderr is how much sqlite3 error output is kept.
+const maxStderr = 64 * 1024
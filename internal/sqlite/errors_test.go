@@ -0,0 +1,59 @@
+package sqlite
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/danielsiegl/gitsqlite/internal/errs"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		stderr string
+		err    error
+		want   error
+	}{
+		{"Error: near line 12: database or disk is full", errors.New("exit status 1"), ErrDiskFull},
+		{"sql error: database disk image is malformed (11)", nil, ErrCorrupt},
+		{"sql error: file is not a database (26)", nil, ErrNotADatabase},
+		{"sql error: database is locked (5)", nil, ErrLocked},
+		{"Parse error near line 2: no such table: nope", errors.New("exit status 1"), ErrNoSuchTable},
+		{"Parse error near line 3: no such function: half\nParse error near line 4: no such table: t", errors.New("exit status 1"), ErrNoExtension},
+		{"Parse error near line 2: no such module: fts5", errors.New("exit status 1"), ErrNoExtension},
+		{`Error: unable to open database "/x/y.db": unable to open database file`, nil, ErrCannotOpen},
+		{"", errors.New("attempt to write a readonly database (8)"), ErrReadOnly},
+		{"Error: something else", errors.New("exit status 1"), ErrUnclassified},
+	}
+	for _, tt := range tests {
+		err := classify(context.Background(), "dump", tt.stderr, tt.err)
+		if !errors.Is(err, tt.want) {
+			t.Errorf("classify(%q, %v) = %v, want kind %v", tt.stderr, tt.err, Kind(err), tt.want)
+		}
+		if (Hint(err) == "") != (tt.want == ErrUnclassified) {
+			t.Errorf("Hint for %q = %q", tt.stderr, Hint(err))
+		}
+	}
+}
+
+func TestClassifyCanceledContext(t *testing.T) {
+	interrupted, cancel := context.WithCancelCause(context.Background())
+	cancel(errors.New("interrupted"))
+	timedOut, cancelTimeout := context.WithCancelCause(context.Background())
+	cancelTimeout(fmt.Errorf("budget used up: %w", context.DeadlineExceeded))
+	tests := []struct {
+		name string
+		ctx  context.Context
+		want error
+	}{
+		{"interrupt", interrupted, errs.ErrInterrupted},
+		{"timeout cause", timedOut, errs.ErrTimeout},
+	}
+	for _, tt := range tests {
+		err := classify(tt.ctx, "dump", "", errors.New("signal: killed"))
+		if errs.Kind(err) != tt.want {
+			t.Errorf("%s: classify = %v of kind %v, want %v", tt.name, err, errs.Kind(err), tt.want)
+		}
+	}
+}
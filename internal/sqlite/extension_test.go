@@ -0,0 +1,27 @@
+package sqlite
+
+import "testing"
+
+func TestParseExtension(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{"./ext/icu", ".load './ext/icu'", false},
+		{`C:\ext\fts.dll, sqlite3_fts_init`, `.load 'C:\ext\fts.dll' 'sqlite3_fts_init'`, false},
+		{"", "", true},
+		{",entry", "", true},
+		{"it's.so", "", true},
+	}
+	for _, tt := range tests {
+		x, err := ParseExtension(tt.value)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseExtension(%q) error = %v, wantErr %v", tt.value, err, tt.wantErr)
+			continue
+		}
+		if err == nil && x.command() != tt.want {
+			t.Errorf("ParseExtension(%q).command() = %q, want %q", tt.value, x.command(), tt.want)
+		}
+	}
+}
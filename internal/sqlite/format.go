@@ -0,0 +1,183 @@
+package sqlite
+
+import (
+	"math"
+	"strings"
+)
+
+// This file ports the floating point formatting of SQLite's printf
+// (sqlite3FpDecode and the %!.Ng conversion), so that the embedded engine
+// writes the same digits as the sqlite3 CLI. Go's own formatting is exact,
+// but SQLite's double-double arithmetic differs from it in the last digits.
+
+// fpDecode returns the significant decimal digits of r > 0 and the position
+// of the decimal point relative to the first digit, rounded to iRound digits
+// (at most mxRound).
+func fpDecode(r float64, iRound, mxRound int) (digits []byte, iDP int) {
+	// Scale r into [9.2e17, 9.2e18] with double-double arithmetic
+	exp := 0
+	rr := [2]float64{r, 0}
+	if rr[0] > 9.223372036854774784e+18 {
+		for rr[0] > 9.223372036854774784e+118 {
+			exp += 100
+			dekkerMul2(&rr, 1.0e-100, -1.99918998026028836196e-117)
+		}
+		for rr[0] > 9.223372036854774784e+28 {
+			exp += 10
+			dekkerMul2(&rr, 1.0e-10, -3.6432197315497741579e-27)
+		}
+		for rr[0] > 9.223372036854774784e+18 {
+			exp += 1
+			dekkerMul2(&rr, 1.0e-01, -5.5511151231257827021e-18)
+		}
+	} else {
+		for rr[0] < 9.223372036854774784e-83 {
+			exp -= 100
+			dekkerMul2(&rr, 1.0e+100, -1.5902891109759918046e+83)
+		}
+		for rr[0] < 9.223372036854774784e+07 {
+			exp -= 10
+			dekkerMul2(&rr, 1.0e+10, 0.0)
+		}
+		for rr[0] < 9.22337203685477478e+17 {
+			exp -= 1
+			dekkerMul2(&rr, 1.0e+01, 0.0)
+		}
+	}
+	var v uint64
+	if rr[1] < 0 {
+		v = uint64(rr[0]) - uint64(-rr[1])
+	} else {
+		v = uint64(rr[0]) + uint64(rr[1])
+	}
+
+	var buf [24]byte
+	i := len(buf)
+	for v > 0 {
+		i--
+		buf[i] = byte(v%10) + '0'
+		v /= 10
+	}
+	digits = buf[i:]
+	iDP = len(digits) + exp
+
+	if iRound > 0 && (iRound < len(digits) || len(digits) > mxRound) {
+		if iRound > mxRound {
+			iRound = mxRound
+		}
+		roundUp := digits[iRound] >= '5'
+		digits = append([]byte(nil), digits[:iRound]...)
+		if roundUp {
+			j := iRound - 1
+			for {
+				digits[j]++
+				if digits[j] <= '9' {
+					break
+				}
+				digits[j] = '0'
+				if j == 0 {
+					digits = append([]byte{'1'}, digits...)
+					iDP++
+					break
+				}
+				j--
+			}
+		}
+	}
+	for len(digits) > 1 && digits[len(digits)-1] == '0' {
+		digits = digits[:len(digits)-1]
+	}
+	return digits, iDP
+}
+
+// dekkerMul2 multiplies the double-double x by y+yy. The float64 conversions
+// keep the compiler from fusing multiply-adds, which would change the result.
+func dekkerMul2(x *[2]float64, y, yy float64) {
+	hx := math.Float64frombits(math.Float64bits(x[0]) & 0xfffffffffc000000)
+	tx := x[0] - hx
+	hy := math.Float64frombits(math.Float64bits(y) & 0xfffffffffc000000)
+	ty := y - hy
+	p := float64(hx * hy)
+	q := float64(float64(hx*ty) + float64(tx*hy))
+	c := p + q
+	cc := float64(float64(p-c+q) + float64(tx*ty))
+	cc = float64(float64(float64(x[0]*yy)+float64(x[1]*y)) + cc)
+	x[0] = c + cc
+	x[1] = c - x[0]
+	x[1] += cc
+}
+
+// formatGeneric formats r like SQLite's "%!.<precision>g": the shortest of
+// fixed and exponential notation, always with a digit after the point.
+func formatGeneric(r float64, precision int) string {
+	if math.IsNaN(r) {
+		return "NaN"
+	}
+	var b strings.Builder
+	if r < 0 {
+		b.WriteByte('-')
+		r = -r
+	}
+	if math.IsInf(r, 0) {
+		b.WriteString("Inf")
+		return b.String()
+	}
+	digits, iDP := []byte("0"), 1
+	if r != 0 {
+		digits, iDP = fpDecode(r, precision, 26)
+	}
+
+	exp := iDP - 1
+	precision--
+	exponential := exp < -4 || exp > precision
+	digit := 0
+	next := func() byte {
+		if digit < len(digits) {
+			digit++
+			return digits[digit-1]
+		}
+		return '0'
+	}
+
+	if exponential {
+		b.WriteByte(next())
+	} else {
+		precision -= exp
+		if exp < 0 {
+			b.WriteByte('0')
+		} else {
+			for e := exp; e >= 0; e-- {
+				b.WriteByte(next())
+			}
+		}
+	}
+	b.WriteByte('.')
+	if !exponential {
+		for e := exp + 1; e < 0 && precision > 0; e++ {
+			b.WriteByte('0')
+			precision--
+		}
+	}
+	for ; precision > 0; precision-- {
+		b.WriteByte(next())
+	}
+
+	// Remove trailing zeros but keep one digit after the point
+	s := strings.TrimRight(b.String(), "0")
+	if strings.HasSuffix(s, ".") {
+		s += "0"
+	}
+	if exponential {
+		sign := byte('+')
+		if exp < 0 {
+			sign, exp = '-', -exp
+		}
+		s += "e" + string(sign)
+		if exp >= 100 {
+			s += string(byte(exp/100) + '0')
+			exp %= 100
+		}
+		s += string([]byte{byte(exp/10) + '0', byte(exp%10) + '0'})
+	}
+	return s
+}
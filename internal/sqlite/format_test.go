@@ -0,0 +1,77 @@
+package sqlite
+
+import "testing"
+
+func TestLiteral(t *testing.T) {
+	// Expected values are the output of "sqlite3 .dump" (3.50)
+	tests := []struct {
+		value any
+		want  string
+	}{
+		{nil, "NULL"},
+		{int64(-42), "-42"},
+		{0.1, "0.1000000000000000055"},
+		{1.0 / 3, "0.3333333333333333148"},
+		{100.0, "100.0"},
+		{-0.0, "0.0"},
+		{1e300, "9.99999999999999956e+299"},
+		{1e-5, "1.000000000000000082e-05"},
+		{6.02e23, "6.019999999999999959e+23"},
+		{123.456, "123.456000000000003"},
+		{1e20, "1.0e+20"},
+		{1e19, "10000000000000000000.0"},
+		{12345678901234567890.0, "12345678901234567170.0"},
+		{5e-324, "4.940656458412465441e-324"},
+		{0.5, "0.5"},
+		{"it's", "'it''s'"},
+		{"a\nb", `unistr('a\u000ab')`},
+		{"back\\\n", `unistr('back\\\u000a')`},
+		{"q'u\n", `unistr('q''u\u000a')`},
+		{"back\\slash", `'back\slash'`},
+		{"", "''"},
+		{[]byte{0x00, 0xff, 0x10}, "X'00ff10'"},
+		{[]byte{}, "X''"},
+	}
+	for _, tt := range tests {
+		if got := literal(tt.value); got != tt.want {
+			t.Errorf("literal(%#v) = %s, want %s", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestFormatGeneric(t *testing.T) {
+	// Expected values are the output of "sqlite3 -csv" (%!.15g)
+	tests := []struct {
+		value float64
+		want  string
+	}{
+		{0.1 + 0.2, "0.3"},
+		{1e300, "1.0e+300"},
+		{100.0, "100.0"},
+		{1.0 / 3, "0.333333333333333"},
+		{2e-7, "2.0e-07"},
+		{123456789012345678.0, "1.23456789012346e+17"},
+		{1e15, "1.0e+15"},
+		{-0.0, "0.0"},
+	}
+	for _, tt := range tests {
+		if got := formatGeneric(tt.value, 15); got != tt.want {
+			t.Errorf("formatGeneric(%v, 15) = %s, want %s", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestQuoteNameIfNeeded(t *testing.T) {
+	for name, want := range map[string]string{
+		"plain":       "plain",
+		"_x1":         "_x1",
+		"order":       `"order"`,
+		"quoted name": `"quoted name"`,
+		"1abc":        `"1abc"`,
+		`a"b`:         `"a""b"`,
+	} {
+		if got := quoteNameIfNeeded(name); got != want {
+			t.Errorf("quoteNameIfNeeded(%q) = %s, want %s", name, got, want)
+		}
+	}
+}
@@ -4,11 +4,61 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
+	"os"
 	"time"
+
+	"github.com/danielsiegl/gitsqlite/internal/errs"
 )
 
-// WriteWithTimeout writes a single line to the output writer with timeout protection
+// WriteWithTimeout writes a single line to the output writer with timeout
+// protection. If the line does not fit into the buffer of out, writing it
+// first writes what is buffered, and the timeout covers that too.
 func (e *Engine) WriteWithTimeout(out io.Writer, data []byte, operation string) error {
+	return e.writeWithDeadline(out, data, operation, e.timeoutFor(buffered(out)+len(data)))
+}
+
+// chunkSize returns ChunkSize, or DefaultChunkSize if it is not set.
+func (e *Engine) chunkSize() int {
+	if e.ChunkSize > 0 {
+		return e.ChunkSize
+	}
+	return DefaultChunkSize
+}
+
+// timeoutFor returns the time allowed to write n bytes: a second per
+// started chunk, at least one.
+func (e *Engine) timeoutFor(n int) time.Duration {
+	chunk := e.chunkSize()
+	return max(time.Duration((n+chunk-1)/chunk)*time.Second, time.Second)
+}
+
+// buffered returns the number of bytes buffered in out, or in the writer it
+// passes data on to.
+func buffered(out io.Writer) int {
+	for out != nil {
+		if w, ok := out.(interface{ Buffered() int }); ok {
+			return w.Buffered()
+		}
+		u, ok := out.(interface{ Unwrap() io.Writer })
+		if !ok {
+			return 0
+		}
+		out = u.Unwrap()
+	}
+	return 0
+}
+
+// writeWithDeadline writes data to out and gives up after timeout. Writes that
+// only fill a buffer cannot block and are done directly.
+func (e *Engine) writeWithDeadline(out io.Writer, data []byte, operation string, timeout time.Duration) error {
+	if canWriteWithoutBlocking(out, len(data)) {
+		if _, err := out.Write(data); err != nil {
+			slog.Error("Failed to write output line", "operation", operation, "error", err)
+			return err
+		}
+		return nil
+	}
+
 	type writeResult struct {
 		bytesWritten int
 		err          error
@@ -18,6 +68,8 @@ func (e *Engine) WriteWithTimeout(out io.Writer, data []byte, operation string)
 		n, err := out.Write(data)
 		writeChan <- writeResult{bytesWritten: n, err: err}
 	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
 	select {
 	case result := <-writeChan:
 		if result.err != nil {
@@ -25,64 +77,43 @@ func (e *Engine) WriteWithTimeout(out io.Writer, data []byte, operation string)
 			return result.err
 		}
 		return nil
-	case <-time.After(1 * time.Second):
-		slog.Error("Write operation timed out", "operation", operation, "timeout_seconds", 1)
-		return fmt.Errorf("write operation timed out after 1 second for %s operation", operation)
+	case <-timer.C:
+		slog.Error("Write operation timed out", "operation", operation, "timeout_seconds", timeout.Seconds())
+		return errs.Mark(fmt.Errorf("write operation timed out after %s for %s operation", timeout, operation), errs.ErrTimeout)
 	}
 }
 
-// WriteWithTimeoutAndChunking writes data to the output writer in chunks with timeout protection
-// to detect broken pipes early and prevent hanging indefinitely.
-func (e *Engine) WriteWithTimeoutAndChunking(out io.Writer, data []byte, operation string) error {
-	slog.Debug("About to write output", "operation", operation, "size_bytes", len(data))
-
-	// Test if the output pipe is still open with a minimal write
-	slog.Debug("Testing output pipe connectivity", "operation", operation)
-	testWrite := []byte{}
-	if _, testErr := out.Write(testWrite); testErr != nil {
-		slog.Error("Output pipe is already closed/broken before main write", "operation", operation, "error", testErr)
-		return testErr
+// CopyWithTimeout copies src to out. Writers that copy efficiently on their
+// own, such as PipeOutput and regular files, are given src as a whole; other
+// writers receive chunks of ChunkSize bytes, each written with timeout
+// protection.
+func (e *Engine) CopyWithTimeout(out io.Writer, src io.Reader, operation string) (int64, error) {
+	rf, ok := out.(io.ReaderFrom)
+	if f, isFile := out.(*os.File); isFile && !isRegularFile(f) {
+		// Pipes and consoles may block indefinitely
+		ok = false
+	}
+	if ok {
+		slog.Debug("Copying output directly", "operation", operation)
+		return rf.ReadFrom(src)
 	}
-	slog.Debug("Output pipe test successful, proceeding with chunked write", "operation", operation)
-
-	// Write in chunks to detect broken pipe earlier and provide better error reporting
-	chunkSize := 64 * 1024 // 64KB chunks
-	totalWritten := 0
-	totalChunks := (len(data) + chunkSize - 1) / chunkSize
-
-	slog.Debug("Starting chunked write", "operation", operation, "total_chunks", totalChunks, "chunk_size", chunkSize)
 
-	for totalWritten < len(data) {
-		endPos := totalWritten + chunkSize
-		if endPos > len(data) {
-			endPos = len(data)
+	buf := make([]byte, e.chunkSize())
+	var written int64
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			if werr := e.WriteWithTimeout(out, buf[:n], operation); werr != nil {
+				slog.Error("Failed to write output chunk", "operation", operation, "error", werr, "total_bytes_written", written)
+				return written, werr
+			}
+			written += int64(n)
 		}
-
-		chunkNum := (totalWritten / chunkSize) + 1
-		chunk := data[totalWritten:endPos]
-		slog.Debug("Writing chunk", "operation", operation, "chunk_number", chunkNum, "chunk_size", len(chunk), "offset", totalWritten)
-
-		// Use WriteWithTimeout for each chunk
-		if err := e.WriteWithTimeout(out, chunk, operation); err != nil {
-			slog.Error("Failed to write output chunk",
-				"operation", operation,
-				"error", err,
-				"total_bytes_written", totalWritten,
-				"total_size", len(data),
-				"chunk_number", chunkNum)
-			return err
+		if err == io.EOF {
+			return written, nil
 		}
-		totalWritten += len(chunk)
-
-		slog.Debug("Successfully wrote chunk", "operation", operation, "chunk_number", chunkNum, "bytes_written", len(chunk))
-
-		// Log progress for large writes
-		if len(data) > 1024*1024 && totalWritten%(256*1024) == 0 {
-			percent := float64(totalWritten) / float64(len(data)) * 100
-			slog.Debug("Write progress", "operation", operation, "bytes_written", totalWritten, "total_size", len(data), "percent", percent)
+		if err != nil {
+			return written, err
 		}
 	}
-
-	slog.Debug("Successfully wrote output", "operation", operation, "bytes_written", totalWritten, "total_size", len(data))
-	return nil
 }
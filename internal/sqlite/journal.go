@@ -0,0 +1,51 @@
+package sqlite
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Journal modes smudge can write a database in. Only WAL mode is stored in
+// the database file; a database written in rollback (delete) mode opens in
+// whatever rollback mode the application chooses.
+const (
+	JournalDelete = "delete"
+	JournalWAL    = "wal"
+)
+
+// IsJournalMode reports whether mode is a journal mode smudge can write.
+func IsJournalMode(mode string) bool {
+	return mode == JournalDelete || mode == JournalWAL
+}
+
+// IsWAL reports whether the database at path is in WAL mode, which its header
+// records as file format version 2 in bytes 18 and 19.
+func IsWAL(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	header := make([]byte, 20)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return false
+	}
+	return string(header[:len(databaseHeader)]) == databaseHeader && header[18] == 2 && header[19] == 2
+}
+
+// SetJournalMode switches the database at dbPath to mode. Leaving WAL mode
+// checkpoints the WAL into the database file first, so that the file alone
+// holds every committed transaction and no -wal or -shm file is left behind.
+func (e *Engine) SetJournalMode(ctx context.Context, dbPath, mode string) error {
+	rows, err := e.Query(ctx, dbPath, "PRAGMA journal_mode="+mode+";")
+	if err != nil {
+		return err
+	}
+	if len(rows) == 0 || len(rows[0]) == 0 || !strings.EqualFold(rows[0][0], mode) {
+		return fmt.Errorf("cannot switch %s to %s journal mode", dbPath, mode)
+	}
+	return nil
+}
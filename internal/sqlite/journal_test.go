@@ -0,0 +1,44 @@
+package sqlite
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSetJournalMode(t *testing.T) {
+	ctx := context.Background()
+	eng := &Engine{Embedded: true}
+	db := filepath.Join(t.TempDir(), "test.db")
+	if err := eng.Restore(ctx, db, strings.NewReader("CREATE TABLE t(x);\nINSERT INTO t VALUES(1);\n")); err != nil {
+		t.Fatal(err)
+	}
+	if IsWAL(db) {
+		t.Fatal("restored database is in WAL mode")
+	}
+
+	if err := eng.SetJournalMode(ctx, db, JournalWAL); err != nil {
+		t.Fatal(err)
+	}
+	if !IsWAL(db) {
+		t.Error("database not in WAL mode after switching to it")
+	}
+	for _, suffix := range []string{"-wal", "-shm"} {
+		if _, err := os.Stat(db + suffix); err == nil {
+			t.Errorf("%s file left behind", suffix)
+		}
+	}
+
+	if err := eng.SetJournalMode(ctx, db, JournalDelete); err != nil {
+		t.Fatal(err)
+	}
+	if IsWAL(db) {
+		t.Error("database still in WAL mode after switching to delete")
+	}
+	rows, err := eng.Query(ctx, db, "SELECT x FROM t;")
+	if err != nil || len(rows) != 1 || rows[0][0] != "1" {
+		t.Errorf("rows = %v, %v; want [[1]]", rows, err)
+	}
+}
@@ -0,0 +1,173 @@
+package sqlite
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/danielsiegl/gitsqlite/internal/errs"
+)
+
+// DefaultPipeBuffer is the default size of the blocks read from stdin and
+// written to stdout.
+const DefaultPipeBuffer = 1 << 20
+
+// DefaultChunkSize is the default amount of data each second of write
+// timeout covers, and the size of the blocks copied to writers without a
+// buffer of their own.
+const DefaultChunkSize = 64 * 1024
+
+// PipeOutput buffers output to a pipe and writes it in blocks, each with
+// timeout protection. Dumps consist of many short lines; writing them one by
+// one costs a system call each, which is especially slow for pipes on Windows.
+// Flush must be called when the operation completes.
+type PipeOutput struct {
+	*bufio.Writer
+	file *os.File
+	raw  *timeoutWriter
+}
+
+// NewPipeOutput returns a PipeOutput writing blocks of up to size bytes to f.
+// A size of 0 or less disables buffering.
+func (e *Engine) NewPipeOutput(f *os.File, size int, operation string) *PipeOutput {
+	logPipeInfo(f, "stdout")
+	if size <= 0 {
+		// A one-byte buffer writes through immediately
+		size = 1
+	}
+	raw := &timeoutWriter{eng: e, out: f, operation: operation}
+	return &PipeOutput{Writer: bufio.NewWriterSize(raw, size), file: f, raw: raw}
+}
+
+// ReadFrom copies r to the output, bypassing the buffer. If the output is a
+// regular file, the OS copies the data directly where it can (copy_file_range
+// or sendfile on Linux); writes to a regular file cannot stall. Otherwise r
+// is copied in blocks with timeout protection.
+func (p *PipeOutput) ReadFrom(r io.Reader) (int64, error) {
+	if err := p.Flush(); err != nil {
+		return 0, err
+	}
+	if isRegularFile(p.file) {
+		return p.file.ReadFrom(r)
+	}
+	buf := make([]byte, max(p.Size(), p.raw.eng.chunkSize()))
+	// Hiding WriterTo makes io.CopyBuffer use buf
+	return io.CopyBuffer(p.raw, struct{ io.Reader }{r}, buf)
+}
+
+// NewPipeInput returns a reader that reads f in blocks of up to size bytes.
+// A size of 0 or less reads f directly. If timeout is positive and f is not a
+// regular file, a read that receives no data for timeout fails with an input
+// stalled error, marked as a timeout.
+func NewPipeInput(f *os.File, size int, timeout time.Duration, operation string) io.Reader {
+	logPipeInfo(f, "stdin")
+	var r io.Reader = f
+	if timeout > 0 && !isRegularFile(f) {
+		r = &stallReader{f: f, timeout: timeout, operation: operation}
+	}
+	if size <= 0 {
+		return r
+	}
+	// Wrapping hides bufio.Reader.WriteTo, which would bypass the buffer
+	return struct{ io.Reader }{bufio.NewReaderSize(r, size)}
+}
+
+// stallReader reads f with a timeout per read, the read side of
+// timeoutWriter: a writer that neither sends data nor closes the pipe, such as
+// a half-configured filter pipeline or a terminal nobody types into, fails
+// the operation instead of hanging it. A read that timed out keeps running in
+// the background, so the reader fails for good.
+type stallReader struct {
+	f         *os.File
+	timeout   time.Duration
+	operation string
+	buf       []byte
+	read      int64
+	err       error
+}
+
+func (s *stallReader) Read(p []byte) (int, error) {
+	if s.err != nil {
+		return 0, s.err
+	}
+	// The background read fills a buffer of its own, as p may be reused
+	// after a timeout
+	if len(s.buf) < len(p) {
+		s.buf = make([]byte, len(p))
+	}
+	buf := s.buf[:len(p)]
+	type readResult struct {
+		n   int
+		err error
+	}
+	done := make(chan readResult, 1)
+	go func() {
+		n, err := s.f.Read(buf)
+		done <- readResult{n, err}
+	}()
+	timer := time.NewTimer(s.timeout)
+	defer timer.Stop()
+	select {
+	case r := <-done:
+		n := copy(p, buf[:r.n])
+		s.read += int64(n)
+		return n, r.err
+	case <-timer.C:
+		kind := "pipe"
+		if info, err := s.f.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+			kind = "terminal"
+		}
+		slog.Error("Input stalled", "operation", s.operation, "timeout_seconds", s.timeout.Seconds(),
+			"bytes_read", s.read, "stdin", kind, "parent_pid", os.Getppid())
+		s.err = errs.Mark(fmt.Errorf("input stalled: no data on stdin (%s) for %s after %d bytes in %s operation", kind, s.timeout, s.read, s.operation), errs.ErrTimeout)
+		return 0, s.err
+	}
+}
+
+// isRegularFile reports whether f is a regular file rather than a pipe,
+// console or device.
+func isRegularFile(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode().IsRegular()
+}
+
+// timeoutWriter writes blocks with a timeout of one second per started
+// chunk.
+type timeoutWriter struct {
+	eng       *Engine
+	out       io.Writer
+	operation string
+}
+
+func (w *timeoutWriter) Write(p []byte) (int, error) {
+	if err := w.eng.writeWithDeadline(w.out, p, w.operation, w.eng.timeoutFor(len(p))); err != nil {
+		return 0, err
+	}
+	slog.Debug("Wrote output block", "operation", w.operation, "size_bytes", len(p))
+	return len(p), nil
+}
+
+// availableWriter is implemented by buffered writers that accept up to
+// Available bytes without blocking.
+type availableWriter interface {
+	Available() int
+}
+
+// canWriteWithoutBlocking reports whether writing n bytes to out only fills a
+// buffer. Writers that pass data on unchanged expose their target with Unwrap.
+func canWriteWithoutBlocking(out io.Writer, n int) bool {
+	for out != nil {
+		if w, ok := out.(availableWriter); ok {
+			return n <= w.Available()
+		}
+		u, ok := out.(interface{ Unwrap() io.Writer })
+		if !ok {
+			return false
+		}
+		out = u.Unwrap()
+	}
+	return false
+}
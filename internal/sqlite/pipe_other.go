@@ -0,0 +1,8 @@
+//go:build !windows
+
+package sqlite
+
+import "os"
+
+// logPipeInfo only reports pipe details on Windows.
+func logPipeInfo(f *os.File, name string) {}
@@ -0,0 +1,90 @@
+package sqlite
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/danielsiegl/gitsqlite/internal/errs"
+)
+
+func TestPipeInputStall(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	in := NewPipeInput(r, 16, 50*time.Millisecond, "clean")
+	if _, err := w.WriteString("some input\n"); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 64)
+	n, err := in.Read(buf)
+	if err != nil || string(buf[:n]) != "some input\n" {
+		t.Fatalf("Read() = %q, %v", buf[:n], err)
+	}
+
+	_, err = in.Read(buf)
+	if !errors.Is(err, errs.ErrTimeout) || !strings.Contains(err.Error(), "input stalled") {
+		t.Fatalf("Read() of a stalled pipe: %v, want an input stalled timeout", err)
+	}
+	// The reader stays failed, also once data arrives
+	w.WriteString("late\n")
+	if _, err := in.Read(buf); !errors.Is(err, errs.ErrTimeout) {
+		t.Errorf("Read() after the stall: %v", err)
+	}
+}
+
+func TestPipeInputEOF(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	go func() {
+		w.WriteString("all of it")
+		w.Close()
+	}()
+	data, err := io.ReadAll(NewPipeInput(r, 0, time.Second, "smudge"))
+	if err != nil || string(data) != "all of it" {
+		t.Errorf("ReadAll() = %q, %v", data, err)
+	}
+}
+
+func TestWriteTimeoutCoversBufferedOutput(t *testing.T) {
+	e := &Engine{ChunkSize: 1024}
+	for _, tc := range []struct {
+		n    int
+		want time.Duration
+	}{{0, time.Second}, {1024, time.Second}, {1025, 2 * time.Second}, {10 * 1024, 10 * time.Second}} {
+		if got := e.timeoutFor(tc.n); got != tc.want {
+			t.Errorf("timeoutFor(%d) = %v, want %v", tc.n, got, tc.want)
+		}
+	}
+	if got := (&Engine{}).chunkSize(); got != DefaultChunkSize {
+		t.Errorf("default chunk size = %d", got)
+	}
+
+	// A line that does not fit into the buffer flushes it first
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+	out := e.NewPipeOutput(w, 8*1024, "test")
+	if _, err := out.Write(make([]byte, 8*1024-10)); err != nil {
+		t.Fatal(err)
+	}
+	if got := buffered(struct{ io.Writer }{out}); got != 0 {
+		t.Errorf("buffered through a writer without Unwrap = %d", got)
+	}
+	if got := buffered(out); got != 8*1024-10 {
+		t.Errorf("buffered = %d", got)
+	}
+}
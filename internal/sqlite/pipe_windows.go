@@ -0,0 +1,26 @@
+package sqlite
+
+import (
+	"log/slog"
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+// logPipeInfo logs the buffer sizes of f if it is a pipe. git creates the
+// stdin and stdout pipes of a filter as anonymous pipes, whose buffer size is
+// fixed by the creating process: SetNamedPipeHandleState cannot enlarge it and
+// overlapped I/O is not supported on them. gitsqlite therefore reduces the
+// number of system calls by reading and writing in large blocks instead.
+func logPipeInfo(f *os.File, name string) {
+	h := windows.Handle(f.Fd())
+	if t, err := windows.GetFileType(h); err != nil || t != windows.FILE_TYPE_PIPE {
+		return
+	}
+	var flags, outSize, inSize, maxInstances uint32
+	if err := windows.GetNamedPipeInfo(h, &flags, &outSize, &inSize, &maxInstances); err != nil {
+		slog.Debug("Failed to query pipe buffer sizes", "stream", name, "error", err)
+		return
+	}
+	slog.Debug("Pipe buffer sizes", "stream", name, "out_buffer_bytes", outSize, "in_buffer_bytes", inSize)
+}
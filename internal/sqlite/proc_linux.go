@@ -0,0 +1,12 @@
+package sqlite
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// killWithParent has sqlite3 killed when gitsqlite exits, also when it is
+// killed itself and cannot stop sqlite3 through its context.
+func killWithParent(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Pdeathsig: syscall.SIGKILL}
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+
+package sqlite
+
+import "os/exec"
+
+// killWithParent is only supported on Linux; on Windows the job object set up
+// by the parent package kills sqlite3 with gitsqlite.
+func killWithParent(cmd *exec.Cmd) {}
@@ -0,0 +1,87 @@
+package sqlite
+
+import (
+	"bufio"
+	"os"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/danielsiegl/gitsqlite/internal/warnings"
+)
+
+// sqlite3 runs the commands in ~/.sqliterc before anything else unless -init
+// names another file. Settings such as .echo, .output, .nullvalue, .timer or
+// .load, and SQL such as PRAGMA foreign_keys=ON, would change dumps and
+// restores from one machine to the next, so every session starts with the
+// empty null device instead. -safe would go further, but it rejects the
+// PRAGMA writable_schema in dumps of virtual tables as well as ATTACH, .load
+// and VACUUM INTO.
+var initArgs = []string{"-init", os.DevNull}
+
+var rcOnce sync.Once
+
+// warnIgnoredRC emits W013, once, if the ~/.sqliterc sqlite3 would have read
+// contains commands, naming them.
+func warnIgnoredRC() {
+	rcOnce.Do(func() {
+		path := rcPath()
+		if path == "" {
+			return
+		}
+		if commands := rcCommands(path); len(commands) > 0 {
+			warnings.Emit(warnings.SQLiteRCIgnored, "%s is ignored so that its commands (%s) do not change dumps and restores; use -load-extension or -attach for what the databases need",
+				path, strings.Join(commands, ", "))
+		}
+	})
+}
+
+// rcPath returns the ~/.sqliterc sqlite3 reads: in the home directory of the
+// passwd entry of the user, else $HOME, on Unix, and in %USERPROFILE% on
+// Windows.
+func rcPath() string {
+	home := ""
+	if runtime.GOOS != "windows" {
+		if u, err := user.Current(); err == nil {
+			home = u.HomeDir
+		}
+	}
+	if home == "" {
+		home, _ = os.UserHomeDir()
+	}
+	if home == "" {
+		return ""
+	}
+	return filepath.Join(home, ".sqliterc")
+}
+
+// rcCommands returns the distinct dot-commands and SQL keywords the lines of
+// the rc file at path start with; none if it does not exist or only holds
+// comments.
+func rcCommands(path string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var commands []string
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "--") || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		command := strings.TrimRight(fields[0], ";")
+		if !strings.HasPrefix(command, ".") {
+			command = strings.ToUpper(command)
+		}
+		if !seen[command] {
+			seen[command] = true
+			commands = append(commands, command)
+		}
+	}
+	return commands
+}
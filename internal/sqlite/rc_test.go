@@ -0,0 +1,23 @@
+package sqlite
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestRCCommands(t *testing.T) {
+	path := filepath.Join(t.TempDir(), ".sqliterc")
+	rc := "-- interactive settings\n.headers on\n.mode column\n\n.headers off\npragma foreign_keys=ON;\n"
+	if err := os.WriteFile(path, []byte(rc), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{".headers", ".mode", "PRAGMA"}
+	if got := rcCommands(path); !slices.Equal(got, want) {
+		t.Errorf("rcCommands = %q, want %q", got, want)
+	}
+	if got := rcCommands(filepath.Join(t.TempDir(), "missing")); got != nil {
+		t.Errorf("rcCommands of a missing file = %q, want none", got)
+	}
+}
@@ -1,124 +1,498 @@
 // WriteWithTimeout writes a single line to the output writer with timeout protection
 // Package sqlite provides SQLite database operations with enhanced binary detection.
 //
-// This package automatically detects SQLite binaries from multiple sources:
+// This package automatically detects SQLite binaries from multiple sources,
+// each a Provider with a priority:
+// - Directories listed in GITSQLITE_SQLITE_DIRS
 // - Standard PATH lookup
+// - macOS/Linux: Homebrew locations (sqlite is keg-only there)
 // - Windows: WinGet package manager locations (user and system installations)
 // - Linux: Standard apt installation paths (/usr/bin, /usr/local/bin, etc.)
 //
 // The enhanced detection ensures SQLite binaries are found even when they're
 // installed via package managers but not in the current PATH.
+//
+// Alternatively, an Engine with Embedded set runs all operations in-process
+// with a pure-Go SQLite library and writes the same dumps as the sqlite3 CLI.
 package sqlite
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
+	"encoding/csv"
 	"fmt"
 	"io"
 	"log/slog"
+	"os"
 	"os/exec"
-	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+
+	"github.com/danielsiegl/gitsqlite/internal/errs"
+	"github.com/danielsiegl/gitsqlite/internal/shutdown"
+)
+
+// Engine kinds selectable with -engine.
+const (
+	EngineCLI      = "cli"
+	EngineEmbedded = "embedded"
 )
 
-// Engine shells out to a sqlite3 binary.
+// Engine shells out to a sqlite3 binary, or uses the SQLite library linked
+// into gitsqlite if Embedded is set.
 type Engine struct {
 	Bin string
+	// Embedded selects the pure-Go SQLite engine, which needs no sqlite3
+	// executable.
+	Embedded bool
+	// Select chooses among several sqlite3 binaries found by detection.
+	Select Selection
+	// Attach lists databases attached to every session.
+	Attach []Attachment
+	// Extensions are loaded into every sqlite3 session; the embedded engine
+	// cannot load them.
+	Extensions []Extension
+	// ChunkSize is the amount of output each second of write timeout
+	// covers, and the size of the blocks copied to unbuffered writers;
+	// DefaultChunkSize if 0.
+	ChunkSize int
+
+	mu       sync.Mutex
+	resolved string
+	provider string
+	// version is the version of resolved once known, "" before.
+	version    string
+	attachOnce sync.Once
+	attached   []Attachment
+}
+
+// command returns the sqlite3 command running args, without ~/.sqliterc and
+// with the extensions loaded and the attachments attached first. sqlite3 ignores failing -cmd
+// options unless -bail is given, which would dump or restore without the
+// extension; -bail only stops a restore at its first error, which fails it
+// anyway.
+func (e *Engine) command(ctx context.Context, binaryPath string, args ...string) *exec.Cmd {
+	warnIgnoredRC()
+	cmdArgs := append([]string(nil), initArgs...)
+	if len(e.Extensions) > 0 {
+		cmdArgs = append(cmdArgs, "-bail")
+	}
+	for _, x := range e.Extensions {
+		cmdArgs = append(cmdArgs, "-cmd", x.command())
+	}
+	for _, a := range e.attachments() {
+		cmdArgs = append(cmdArgs, "-cmd", a.statement())
+	}
+	cmd := exec.CommandContext(ctx, binaryPath, append(cmdArgs, args...)...)
+	killWithParent(cmd)
+	return cmd
+}
+
+// start starts cmd and registers killing it if gitsqlite exits before it
+// ends, where the OS does not (see killWithParent); done unregisters it,
+// after cmd.Wait.
+func start(cmd *exec.Cmd) (done func(), err error) {
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return shutdown.Register(func() { cmd.Process.Kill() }), nil
+}
+
+// run runs cmd like cmd.Run, killing it if gitsqlite exits first.
+func run(cmd *exec.Cmd) error {
+	done, err := start(cmd)
+	if err != nil {
+		return err
+	}
+	defer done()
+	return cmd.Wait()
 }
 
 func (e *Engine) Restore(ctx context.Context, dbPath string, sql io.Reader) error {
+	if e.Embedded {
+		return restoreEmbedded(ctx, dbPath, e.attachments(), sql)
+	}
 
-	binaryPath, _ := e.GetBinPath()
+	binaryPath, _ := e.GetBinPath(ctx)
 
-	cmd := exec.CommandContext(ctx, binaryPath, dbPath)
+	cmd := e.command(ctx, binaryPath, dbPath)
 	cmd.Stdin = sql
-	return cmd.Run()
+	stderr := &limitedBuffer{max: maxStderr}
+	cmd.Stderr = stderr
+	if err := run(cmd); err != nil {
+		return classify(ctx, "restore", stderr.String(), err)
+	}
+	return nil
 }
 
 // Dump performs a raw SQLite .dump operation without any filtering or normalization.
 // This is a purely technical operation that streams the complete SQLite dump output.
 func (e *Engine) Dump(ctx context.Context, dbPath string, out io.Writer) error {
-	binaryPath, err := e.GetBinPath()
+	if e.Embedded {
+		return dumpEmbedded(ctx, dbPath, e.attachments(), out)
+	}
+	binaryPath, err := e.GetBinPath(ctx)
 	if err != nil {
 		return err
 	}
 
-	cmd := exec.CommandContext(ctx, binaryPath, dbPath, ".dump")
+	cmd := e.command(ctx, binaryPath, dbPath, ".dump")
 	cmd.Stdout = out
 
-	var stderr strings.Builder
-	cmd.Stderr = &stderr
+	stderr := &limitedBuffer{max: maxStderr}
+	cmd.Stderr = stderr
 
 	slog.Debug("Starting SQLite .dump command")
 
-	if err := cmd.Run(); err != nil {
-		stderrOutput := stderr.String()
-		if stderrOutput != "" {
-			return fmt.Errorf("SQLite dump failed: %s: %w", stderrOutput, err)
-		}
-		return fmt.Errorf("SQLite dump failed: %w", err)
+	err = run(cmd)
+	if err == nil {
+		err = stderrFailure(stderr.String())
+	}
+	if err != nil {
+		return classify(ctx, "dump", stderr.String(), err)
 	}
 
 	slog.Debug("Dump completed successfully")
 	return nil
 }
 
+// OpenDump starts a raw .dump of dbPath and returns its output as a stream.
+// Closing the stream waits for the dump to finish and returns its error.
+func (e *Engine) OpenDump(ctx context.Context, dbPath string) (io.ReadCloser, error) {
+	if e.Embedded {
+		pr, pw := io.Pipe()
+		done := make(chan error, 1)
+		go func() {
+			err := dumpEmbedded(ctx, dbPath, e.attachments(), pw)
+			pw.CloseWithError(err)
+			done <- err
+		}()
+		return &dumpStream{Reader: pr, wait: func() error {
+			pr.Close()
+			return <-done
+		}}, nil
+	}
+
+	binaryPath, err := e.GetBinPath(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cmd := e.command(ctx, binaryPath, dbPath, ".dump")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stdout pipe: %w", err)
+	}
+	stderr := &limitedBuffer{max: maxStderr}
+	cmd.Stderr = stderr
+
+	slog.Debug("Starting SQLite .dump command")
+
+	done, err := start(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start SQLite dump: %w", startFailure(ctx, err))
+	}
+	return &dumpStream{Reader: stdout, wait: func() error {
+		// Closing first lets sqlite3 exit if the reader stopped early
+		stdout.Close()
+		err := cmd.Wait()
+		done()
+		if err == nil {
+			err = stderrFailure(stderr.String())
+		}
+		if err != nil {
+			return classify(ctx, "dump", stderr.String(), err)
+		}
+		return nil
+	}}, nil
+}
+
+// OpenTableRows streams the rows of table as INSERT statements formatted
+// exactly like those of .dump, sorted by the orderBy columns, or in the
+// storage order .dump uses without any. If where is not empty, only the rows
+// matching that SQL expression are written. Closing the stream waits for the
+// query to finish and returns its error.
+func (e *Engine) OpenTableRows(ctx context.Context, dbPath string, table string, where string, orderBy []string) (io.ReadCloser, error) {
+	if e.Embedded {
+		pr, pw := io.Pipe()
+		done := make(chan error, 1)
+		go func() {
+			err := tableRowsEmbedded(ctx, dbPath, e.attachments(), table, where, orderBy, pw)
+			pw.CloseWithError(err)
+			done <- err
+		}()
+		return &dumpStream{Reader: pr, wait: func() error {
+			pr.Close()
+			return <-done
+		}}, nil
+	}
+
+	// Like .dump, select all columns except generated and hidden ones
+	rows, err := e.Query(ctx, dbPath, "SELECT name FROM pragma_table_info("+QuoteLiteral(table)+");")
+	if err != nil {
+		return nil, err
+	}
+	columns := make([]string, len(rows))
+	for i, row := range rows {
+		columns[i] = QuoteIdent(row[0])
+	}
+	query := "SELECT " + strings.Join(columns, ",") + " FROM " + rowsSource(table, where, orderBy) + ";"
+
+	binaryPath, err := e.GetBinPath(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// The shell quotes the name given to ".mode insert" like .dump does;
+	// double-quoted dot-command arguments use backslash escapes
+	name := `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(table) + `"`
+	cmd := e.command(ctx, binaryPath, "-batch", dbPath, ".mode insert "+name, query)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get stdout pipe: %w", err)
+	}
+	stderr := &limitedBuffer{max: maxStderr}
+	cmd.Stderr = stderr
+	done, err := start(cmd)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start SQLite query: %w", startFailure(ctx, err))
+	}
+	return &dumpStream{Reader: stdout, wait: func() error {
+		stdout.Close()
+		err := cmd.Wait()
+		done()
+		if err != nil {
+			return classify(ctx, "query", stderr.String(), err)
+		}
+		return nil
+	}}, nil
+}
+
+// rowsSource returns the FROM clause and the rest of the query selecting the
+// rows of table for OpenTableRows.
+func rowsSource(table string, where string, orderBy []string) string {
+	source := QuoteIdent(table)
+	if len(orderBy) == 0 {
+		// An index chosen for the condition would change the order of the
+		// table scan .dump uses
+		if where != "" {
+			source += " NOT INDEXED WHERE " + where
+		}
+		return source
+	}
+	if where != "" {
+		source += " WHERE " + where
+	}
+	order := make([]string, len(orderBy))
+	for i, c := range orderBy {
+		order[i] = QuoteIdent(c)
+	}
+	return source + " ORDER BY " + strings.Join(order, ",")
+}
+
+// dumpStream is the output of a running dump.
+type dumpStream struct {
+	io.Reader
+	wait func() error
+	once sync.Once
+	err  error
+}
+
+// Close waits for the dump to finish; it may be called more than once.
+func (s *dumpStream) Close() error {
+	s.once.Do(func() { s.err = s.wait() })
+	return s.err
+}
+
+// VacuumInto writes a compacted copy of the database at dbPath to target,
+// which must not exist or be empty.
+func (e *Engine) VacuumInto(ctx context.Context, dbPath, target string) error {
+	_, err := e.Query(ctx, dbPath, "VACUUM INTO "+QuoteLiteral(target)+";")
+	return err
+}
+
+// Query runs a single SQL statement against dbPath and returns the result rows.
+// Values are returned as text; NULL is returned as an empty string.
+func (e *Engine) Query(ctx context.Context, dbPath string, query string) ([][]string, error) {
+	if e.Embedded {
+		return queryEmbedded(ctx, dbPath, e.attachments(), query)
+	}
+	binaryPath, err := e.GetBinPath(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := e.command(ctx, binaryPath, "-batch", "-csv", "-noheader", dbPath, query)
+	stderr := &limitedBuffer{max: maxStderr}
+	cmd.Stderr = stderr
+
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	if err := run(cmd); err != nil {
+		return nil, classify(ctx, "query", stderr.String(), err)
+	}
+
+	reader := csv.NewReader(&output)
+	reader.FieldsPerRecord = -1
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse SQLite query output: %w", err)
+	}
+	return rows, nil
+}
+
+// databaseHeader is the magic string every SQLite 3 database file starts with.
+const databaseHeader = "SQLite format 3\x00"
+
+// IsDatabaseFile reports whether the file at path is a binary SQLite database.
+func IsDatabaseFile(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	header := make([]byte, len(databaseHeader))
+	if _, err := io.ReadFull(f, header); err != nil {
+		return false
+	}
+	return string(header) == databaseHeader
+}
+
 // ValidateBinary checks if the SQLite binary is available and accessible, including package manager locations
-func (e *Engine) ValidateBinary() error {
-	_, err := e.GetBinPath()
+func (e *Engine) ValidateBinary(ctx context.Context) error {
+	if e.Embedded {
+		return nil
+	}
+	_, err := e.GetBinPath(ctx)
 	return err
 }
 
 // CheckAvailability performs a comprehensive check of SQLite availability and returns detailed information
-func (e *Engine) CheckAvailability() (path string, version string, err error) {
-	path, err = e.GetBinPath()
+// The version probe is bounded by ProbeTimeout; its result is cached like the
+// path, so checks on every filter run spawn no further process.
+func (e *Engine) CheckAvailability(ctx context.Context) (path string, version string, err error) {
+	if e.Embedded {
+		version, err = embeddedVersion(ctx)
+		return EmbeddedPath, version, err
+	}
+	path, err = e.GetBinPath(ctx)
 	if err != nil {
 		return "", "", err
 	}
 
-	cmd := exec.Command(path, "-version")
-	output, vErr := cmd.Output()
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.version != "" {
+		return path, e.version, nil
+	}
+	version, vErr := probeVersion(ctx, path)
 	if vErr != nil {
 		return path, "", fmt.Errorf("failed to get SQLite version: %w", vErr)
 	}
-	version = strings.TrimSpace(string(output))
+	e.version = version
 	return path, version, nil
 }
 
-// GetBinPath returns the full path to the SQLite binary, checking package manager locations
-func (e *Engine) GetBinPath() (string, error) {
-	// Return cached path if available
-	if e.Bin != "" {
-		return e.Bin, nil
+// GetBinPath returns the full path to the SQLite binary. A name is resolved
+// through the detection providers (PATH, package manager locations, ...); the
+// result is cached for later calls.
+func (e *Engine) GetBinPath(ctx context.Context) (string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.resolved != "" {
+		return e.resolved, nil
+	}
+	if e.Bin == "" {
+		return "", errs.Mark(fmt.Errorf("no SQLite executable configured"), errs.ErrSQLiteNotFound)
 	}
-	// First try the standard PATH lookup
-	path, err := exec.LookPath(e.Bin)
-	if err == nil {
-		return path, nil
-	}
-
-	// Platform-specific fallback searches for sqlite3
-	if e.Bin == "sqlite3" {
-		var fallbackPath string
-		var fallbackErr error
-
-		switch runtime.GOOS {
-		case "windows":
-			fallbackPath, fallbackErr = e.findSQLiteInWinGet()
-		case "linux":
-			fallbackPath, fallbackErr = e.findSQLiteInApt()
-		default:
-			// For other platforms, return the original PATH error
-			return "", err
-		}
 
-		if fallbackErr == nil {
-			return fallbackPath, nil
+	candidates := e.candidates()
+	chosen := choose(ctx, candidates, e.Select, false)
+	if chosen < 0 {
+		var reasons []string
+		for _, c := range candidates {
+			reasons = append(reasons, fmt.Sprintf("%s (%s): %v", c.Path, c.Provider, c.Err))
 		}
+		if len(reasons) == 0 {
+			return "", errs.Mark(fmt.Errorf("SQLite executable '%s' not found in PATH or package manager locations", e.Bin), errs.ErrSQLiteNotFound)
+		}
+		return "", errs.Mark(fmt.Errorf("no usable SQLite executable '%s' found: %s", e.Bin, strings.Join(reasons, "; ")), errs.ErrSQLiteNotFound)
+	}
+	e.resolved, e.provider = candidates[chosen].Path, candidates[chosen].Provider
+	// Detection probed the versions of candidates it does not trust
+	e.version = candidates[chosen].Version
+	slog.Info("Selected SQLite executable", "path", e.resolved, "provider", candidates[chosen].Provider,
+		"version", candidates[chosen].Version, "selection", e.Select.String(), "candidates", len(candidates))
+	return e.resolved, nil
+}
+
+// BinSource returns how the binary of GetBinPath was found: the name of the
+// detection provider (see ProviderNames), "-sqlite" for a path given
+// explicitly, or "embedded" for the embedded engine.
+func (e *Engine) BinSource(ctx context.Context) (string, error) {
+	if e.Embedded {
+		return "embedded", nil
+	}
+	if _, err := e.GetBinPath(ctx); err != nil {
+		return "", err
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.provider, nil
+}
 
-		// Return combined error message
-		return "", fmt.Errorf("SQLite executable '%s' not found in PATH or package manager locations. PATH error: %v. Package manager search error: %v", e.Bin, err, fallbackErr)
+// WriterVersion returns the SQLITE_VERSION_NUMBER (e.g. 3045001) of the
+// library that last modified the database, as recorded at offset 96 of the
+// database header.
+func WriterVersion(path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	header := make([]byte, 100)
+	if _, err := io.ReadFull(f, header); err != nil {
+		return 0, fmt.Errorf("failed to read database header: %w", err)
+	}
+	if string(header[:len(databaseHeader)]) != databaseHeader {
+		return 0, fmt.Errorf("not a SQLite database")
+	}
+	return int(binary.BigEndian.Uint32(header[96:100])), nil
+}
+
+// ParseVersionNumber converts the output of "sqlite3 -version" (or a plain
+// "3.45.1") into a SQLITE_VERSION_NUMBER. It returns 0 if s is not a version.
+func ParseVersionNumber(s string) int {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return 0
+	}
+	parts := strings.SplitN(fields[0], ".", 3)
+	if len(parts) != 3 {
+		return 0
 	}
+	var n [3]int
+	for i, p := range parts {
+		v, err := strconv.Atoi(p)
+		if err != nil {
+			return 0
+		}
+		n[i] = v
+	}
+	return n[0]*1000000 + n[1]*1000 + n[2]
+}
+
+// FormatVersionNumber converts a SQLITE_VERSION_NUMBER back to "3.45.1".
+func FormatVersionNumber(n int) string {
+	return fmt.Sprintf("%d.%d.%d", n/1000000, n/1000%1000, n%1000)
+}
+
+// QuoteIdent quotes an SQL identifier.
+func QuoteIdent(s string) string {
+	return `"` + strings.ReplaceAll(s, `"`, `""`) + `"`
+}
 
-	// For non-sqlite3 binary names, return original error
-	return "", err
+// QuoteLiteral quotes an SQL string literal.
+func QuoteLiteral(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
 }
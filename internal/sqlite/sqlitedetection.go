@@ -1,108 +1,367 @@
 package sqlite
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"sort"
+	"strings"
+	"time"
 )
 
-// getLinuxAptSQLitePaths returns common apt SQLite installation paths on Linux
-func getLinuxAptSQLitePaths() []string {
+// ProbeTimeout bounds every "sqlite3 -version" probe, so that a wedged binary
+// (e.g. on a network share) cannot hang -version or binary detection.
+const ProbeTimeout = 5 * time.Second
+
+// EnvSearchDirs names the environment variable listing additional
+// directories to search for sqlite3, separated like PATH. They take
+// precedence over all other locations.
+const EnvSearchDirs = "GITSQLITE_SQLITE_DIRS"
+
+// Provider finds sqlite3 binaries in one kind of location, e.g. PATH or the
+// directories of a package manager.
+type Provider interface {
+	// Name identifies the provider in detection reports.
+	Name() string
+	// Priority orders providers; candidates of lower values are preferred.
+	Priority() int
+	// Find returns the existing binaries called name, most preferred first.
+	Find(name string) []string
+}
+
+// providers are the registered providers; see RegisterProvider.
+var providers = []Provider{
+	dirsProvider{name: "custom", priority: 10, dirs: func() []string { return filepath.SplitList(os.Getenv(EnvSearchDirs)) }},
+	pathProvider{},
+	dirsProvider{name: "homebrew", priority: 30, dirs: homebrewDirs},
+	dirsProvider{name: "apt", priority: 40, dirs: aptDirs},
+	dirsProvider{name: "winget", priority: 40, dirs: wingetDirs},
+}
+
+// RegisterProvider adds a provider to binary detection.
+func RegisterProvider(p Provider) {
+	providers = append(providers, p)
+}
+
+// ProviderNames returns the names of the registered providers in priority
+// order.
+func ProviderNames() []string {
+	var names []string
+	for _, p := range sortedProviders() {
+		names = append(names, p.Name())
+	}
+	return names
+}
+
+// sortedProviders returns the registered providers ordered by priority.
+func sortedProviders() []Provider {
+	ordered := append([]Provider(nil), providers...)
+	sort.SliceStable(ordered, func(i, j int) bool { return ordered[i].Priority() < ordered[j].Priority() })
+	return ordered
+}
+
+// pathProvider finds binaries in the directories of PATH, in PATH order.
+type pathProvider struct{}
+
+func (pathProvider) Name() string  { return "PATH" }
+func (pathProvider) Priority() int { return 20 }
+
+func (pathProvider) Find(name string) []string {
+	var found []string
+	for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+		if dir == "" {
+			continue
+		}
+		// A path containing a separator is checked directly, with PATHEXT
+		// applied on Windows
+		path, err := exec.LookPath(filepath.Join(dir, name))
+		if err != nil {
+			continue
+		}
+		if abs, err := filepath.Abs(path); err == nil {
+			path = abs
+		}
+		found = append(found, path)
+	}
+	return found
+}
+
+// dirsProvider finds binaries in a fixed list of directories.
+type dirsProvider struct {
+	name     string
+	priority int
+	dirs     func() []string
+}
+
+func (p dirsProvider) Name() string  { return p.name }
+func (p dirsProvider) Priority() int { return p.priority }
+
+func (p dirsProvider) Find(name string) []string {
+	if runtime.GOOS == "windows" && filepath.Ext(name) == "" {
+		name += ".exe"
+	}
+	var found []string
+	for _, dir := range p.dirs() {
+		if dir == "" {
+			continue
+		}
+		path := filepath.Join(dir, name)
+		if info, err := os.Stat(path); err == nil && !info.IsDir() {
+			found = append(found, path)
+		}
+	}
+	return found
+}
+
+// aptDirs returns the directories apt installs sqlite3 into on Linux.
+func aptDirs() []string {
 	if runtime.GOOS != "linux" {
 		return nil
 	}
-	return []string{
-		"/usr/bin/sqlite3",
-		"/usr/local/bin/sqlite3",
-		"/bin/sqlite3",
-		"/usr/sbin/sqlite3",
+	return []string{"/usr/bin", "/usr/local/bin", "/bin", "/usr/sbin"}
+}
+
+// homebrewDirs returns the Homebrew directories holding sqlite3. Homebrew's
+// sqlite is keg-only, so it is not linked into the bin directory by default.
+func homebrewDirs() []string {
+	var prefixes []string
+	switch runtime.GOOS {
+	case "darwin":
+		prefixes = []string{"/opt/homebrew", "/usr/local"}
+	case "linux":
+		prefixes = []string{"/home/linuxbrew/.linuxbrew"}
+	default:
+		return nil
 	}
+	var dirs []string
+	for _, prefix := range prefixes {
+		dirs = append(dirs, filepath.Join(prefix, "opt", "sqlite", "bin"), filepath.Join(prefix, "bin"))
+	}
+	return dirs
 }
 
-// getWinGetSQLitePaths returns common WinGet SQLite installation paths on Windows
-func getWinGetSQLitePaths() []string {
+// wingetDirs returns the WinGet package directories of SQLite on Windows.
+func wingetDirs() []string {
 	if runtime.GOOS != "windows" {
 		return nil
 	}
-	paths := []string{}
-	sqlitePatterns := []string{
-		"SQLite.SQLite_Microsoft.Winget.Source_*",
-		"SQLite.SQLite_*",
-	}
-	userProfile := os.Getenv("USERPROFILE")
-	if userProfile != "" {
-		userWinGetPath := filepath.Join(userProfile, "AppData", "Local", "Microsoft", "WinGet", "Packages")
-		for _, pattern := range sqlitePatterns {
-			fullPattern := filepath.Join(userWinGetPath, pattern)
-			matches, err := filepath.Glob(fullPattern)
-			if err == nil {
-				for _, match := range matches {
-					paths = append(paths, filepath.Join(match, "sqlite3.exe"))
-				}
-			}
-		}
+	var roots []string
+	if userProfile := os.Getenv("USERPROFILE"); userProfile != "" {
+		roots = append(roots, filepath.Join(userProfile, "AppData", "Local", "Microsoft", "WinGet", "Packages"))
 	}
-	programFiles := os.Getenv("ProgramFiles")
-	if programFiles != "" {
-		systemWinGetPath := filepath.Join(programFiles, "WinGet", "Packages")
-		for _, pattern := range sqlitePatterns {
-			fullPattern := filepath.Join(systemWinGetPath, pattern)
-			matches, err := filepath.Glob(fullPattern)
-			if err == nil {
-				for _, match := range matches {
-					paths = append(paths, filepath.Join(match, "sqlite3.exe"))
-				}
-			}
+	if programFiles := os.Getenv("ProgramFiles"); programFiles != "" {
+		roots = append(roots, filepath.Join(programFiles, "WinGet", "Packages"))
+	}
+	if programData := os.Getenv("ProgramData"); programData != "" {
+		roots = append(roots, filepath.Join(programData, "Microsoft", "WinGet", "Packages"))
+	}
+	var dirs []string
+	for _, root := range roots {
+		for _, pattern := range []string{"SQLite.SQLite_Microsoft.Winget.Source_*", "SQLite.SQLite_*"} {
+			matches, _ := filepath.Glob(filepath.Join(root, pattern))
+			dirs = append(dirs, matches...)
 		}
 	}
-	programData := os.Getenv("ProgramData")
-	if programData != "" {
-		altSystemWinGetPath := filepath.Join(programData, "Microsoft", "WinGet", "Packages")
-		for _, pattern := range sqlitePatterns {
-			fullPattern := filepath.Join(altSystemWinGetPath, pattern)
-			matches, err := filepath.Glob(fullPattern)
-			if err == nil {
-				for _, match := range matches {
-					paths = append(paths, filepath.Join(match, "sqlite3.exe"))
-				}
+	return dirs
+}
+
+// Candidate is a sqlite3 binary found during detection.
+type Candidate struct {
+	Path     string
+	Provider string
+	Priority int
+	// Version is the output of "-version"; it is only set if the candidate
+	// was probed.
+	Version string
+	// Err is the reason the candidate cannot be used.
+	Err error
+	// Chosen is set on the candidate the engine uses.
+	Chosen bool
+	// Reason explains why the candidate was or was not chosen.
+	Reason string
+}
+
+// Detect returns the binaries called name found by all providers, ordered by
+// priority. A file found by several providers is listed once.
+func Detect(name string) []Candidate {
+	var candidates []Candidate
+	var seen []os.FileInfo
+	for _, p := range sortedProviders() {
+		for _, path := range p.Find(name) {
+			info, err := os.Stat(path)
+			if err != nil {
+				continue
+			}
+			duplicate := false
+			for _, s := range seen {
+				duplicate = duplicate || os.SameFile(s, info)
+			}
+			if duplicate {
+				continue
 			}
+			seen = append(seen, info)
+			candidates = append(candidates, Candidate{Path: path, Provider: p.Name(), Priority: p.Priority()})
 		}
 	}
-	return paths
+	return candidates
 }
 
-// findSQLiteInApt searches for SQLite in apt installation directories
-func (e *Engine) findSQLiteInApt() (string, error) {
-	if runtime.GOOS != "linux" {
-		return "", fmt.Errorf("apt search only available on Linux")
-	}
-	paths := getLinuxAptSQLitePaths()
-	for _, path := range paths {
-		if _, err := os.Stat(path); err == nil {
-			cmd := exec.Command(path, "-version")
-			if err := cmd.Run(); err == nil {
-				return path, nil
-			}
+// Selection policies for -sqlite-select.
+const (
+	SelectFirst  = "first"
+	SelectNewest = "newest"
+	SelectOldest = "oldest"
+	SelectExact  = "exact"
+)
+
+// Selection decides which of several usable candidates the engine uses.
+type Selection struct {
+	// Policy is one of SelectFirst (the zero value), SelectNewest,
+	// SelectOldest and SelectExact.
+	Policy string
+	// Version is the SQLITE_VERSION_NUMBER required by SelectExact.
+	Version int
+}
+
+// ParseSelection parses "first", "newest", "oldest" or "exact:3.45.1".
+func ParseSelection(s string) (Selection, error) {
+	switch s {
+	case "", SelectFirst:
+		return Selection{Policy: SelectFirst}, nil
+	case SelectNewest, SelectOldest:
+		return Selection{Policy: s}, nil
+	}
+	if v, ok := strings.CutPrefix(s, SelectExact+":"); ok {
+		if n := ParseVersionNumber(v); n != 0 {
+			return Selection{Policy: SelectExact, Version: n}, nil
 		}
 	}
-	return "", fmt.Errorf("SQLite not found in standard apt installation directories")
+	return Selection{}, fmt.Errorf("invalid selection %q (expected first, newest, oldest or exact:<version>)", s)
 }
 
-// findSQLiteInWinGet searches for SQLite in WinGet installation directories
-func (e *Engine) findSQLiteInWinGet() (string, error) {
-	if runtime.GOOS != "windows" {
-		return "", fmt.Errorf("WinGet search only available on Windows")
-	}
-	paths := getWinGetSQLitePaths()
-	for _, path := range paths {
-		if _, err := os.Stat(path); err == nil {
-			cmd := exec.Command(path, "-version")
-			if err := cmd.Run(); err == nil {
-				return path, nil
+// String returns the selection in the form accepted by ParseSelection.
+func (sel Selection) String() string {
+	switch sel.Policy {
+	case "":
+		return SelectFirst
+	case SelectExact:
+		return SelectExact + ":" + FormatVersionNumber(sel.Version)
+	}
+	return sel.Policy
+}
+
+// choose returns the index of the candidate sel selects, or -1, and sets the
+// Reason of every candidate. With SelectFirst the first usable candidate in
+// priority order wins; PATH and explicit paths are what running the command
+// would use, so they are trusted without a probe, while candidates of other
+// providers must answer "-version". Other policies compare the versions of
+// all candidates. If probeAll is set, every candidate is probed so that
+// reports can show their versions.
+func choose(ctx context.Context, candidates []Candidate, sel Selection, probeAll bool) int {
+	if sel.Policy != "" && sel.Policy != SelectFirst {
+		probeAll = true
+	}
+	chosen, examined := -1, 0
+	for i := range candidates {
+		c := &candidates[i]
+		if chosen >= 0 && !probeAll {
+			break
+		}
+		examined++
+		trusted := c.Provider == (pathProvider{}).Name() || c.Provider == explicitProvider
+		if !trusted || probeAll {
+			c.Version, c.Err = probeVersion(ctx, c.Path)
+		}
+		if c.Err == nil && sel.Policy == SelectExact && ParseVersionNumber(c.Version) != sel.Version {
+			c.Err = fmt.Errorf("version is not %s", FormatVersionNumber(sel.Version))
+		}
+		if c.Err != nil {
+			c.Reason = "not usable: " + c.Err.Error()
+			continue
+		}
+		if chosen < 0 || better(sel, c, &candidates[chosen]) {
+			chosen = i
+		}
+	}
+
+	for i := range candidates[:examined] {
+		c := &candidates[i]
+		switch {
+		case c.Err != nil:
+		case i == chosen:
+			c.Chosen = true
+			switch sel.Policy {
+			case SelectNewest, SelectOldest:
+				c.Reason = fmt.Sprintf("chosen: %s usable version (-sqlite-select %s)", sel.Policy, sel)
+			case SelectExact:
+				c.Reason = fmt.Sprintf("chosen: first candidate with version %s (-sqlite-select %s)", FormatVersionNumber(sel.Version), sel)
+			default:
+				c.Reason = fmt.Sprintf("chosen: first usable candidate (%s has priority %d)", c.Provider, c.Priority)
 			}
+		case sel.Policy == SelectNewest || sel.Policy == SelectOldest:
+			c.Reason = fmt.Sprintf("not chosen: %s is the %s version", candidates[chosen].Path, sel.Policy)
+		default:
+			c.Reason = fmt.Sprintf("not chosen: %s is found first", candidates[chosen].Path)
 		}
 	}
-	return "", fmt.Errorf("SQLite not found in WinGet installation directories")
+	return chosen
+}
+
+// better reports whether c is preferred over the current choice under sel.
+// Equal versions keep the candidate found first.
+func better(sel Selection, c, current *Candidate) bool {
+	v, cur := ParseVersionNumber(c.Version), ParseVersionNumber(current.Version)
+	switch sel.Policy {
+	case SelectNewest:
+		return v > cur
+	case SelectOldest:
+		return v != 0 && (cur == 0 || v < cur)
+	}
+	return false
+}
+
+// explicitProvider is the provider name of a path given with -sqlite.
+const explicitProvider = "-sqlite"
+
+// candidates returns the candidates for the engine's binary: an explicit
+// path given with -sqlite is the only candidate.
+func (e *Engine) candidates() []Candidate {
+	if isExplicitPath(e.Bin) {
+		return []Candidate{{Path: e.Bin, Provider: explicitProvider}}
+	}
+	return Detect(e.Bin)
+}
+
+// DetectionReport returns every candidate for the engine's binary with its
+// version and why it was or was not chosen.
+func (e *Engine) DetectionReport(ctx context.Context) []Candidate {
+	candidates := e.candidates()
+	choose(ctx, candidates, e.Select, true)
+	return candidates
+}
+
+// isExplicitPath reports whether bin is a path rather than a name to search.
+func isExplicitPath(bin string) bool {
+	return strings.ContainsAny(bin, `/\`)
+}
+
+// probeVersion runs "path -version" and returns its trimmed output.
+func probeVersion(ctx context.Context, path string) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, ProbeTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, path, append(initArgs, "-version")...)
+	// Don't wait for children of a killed sqlite3 that keep stdout open
+	cmd.WaitDelay = time.Second
+	output, err := cmd.Output()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return "", fmt.Errorf("%s -version did not respond within %s", path, ProbeTimeout)
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
 }
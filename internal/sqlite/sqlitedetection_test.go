@@ -0,0 +1,154 @@
+package sqlite
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+// fakeSQLite writes a script to dir/sqlite3 that reports version.
+func fakeSQLite(t *testing.T, dir, version string) string {
+	t.Helper()
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "sqlite3")
+	script := "#!/bin/sh\necho '" + version + " 2024-01-30 00:00:00 0000 (64-bit)'\n"
+	if err := os.WriteFile(path, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestDetectAndSelect(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake binaries are shell scripts")
+	}
+	root := t.TempDir()
+	older := fakeSQLite(t, filepath.Join(root, "a"), "3.45.1")
+	newer := fakeSQLite(t, filepath.Join(root, "b"), "3.46.0")
+	onPath := fakeSQLite(t, filepath.Join(root, "path"), "3.44.0")
+	t.Setenv(EnvSearchDirs, filepath.Join(root, "a")+string(os.PathListSeparator)+filepath.Join(root, "b"))
+	t.Setenv("PATH", filepath.Join(root, "path"))
+	// Ignore binaries installed on the machine running the test
+	saved := providers
+	t.Cleanup(func() { providers = saved })
+	providers = nil
+	for _, p := range saved {
+		if p.Name() == "custom" || p.Name() == "PATH" {
+			providers = append(providers, p)
+		}
+	}
+
+	candidates := Detect("sqlite3")
+	var paths []string
+	for _, c := range candidates {
+		paths = append(paths, c.Path+" "+c.Provider)
+	}
+	want := []string{older + " custom", newer + " custom", onPath + " PATH"}
+	if strings.Join(paths, "\n") != strings.Join(want, "\n") {
+		t.Fatalf("Detect = %q, want %q", paths, want)
+	}
+
+	tests := []struct {
+		selection string
+		want      string
+	}{
+		{"first", older},
+		{"newest", newer},
+		{"oldest", onPath},
+		{"exact:3.46.0", newer},
+		{"exact:3.1.0", ""},
+	}
+	for _, tt := range tests {
+		sel, err := ParseSelection(tt.selection)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e := &Engine{Bin: "sqlite3", Select: sel}
+		got, err := e.GetBinPath(context.Background())
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%s: GetBinPath = %q, want error", tt.selection, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("%s: GetBinPath = %q, %v, want %q", tt.selection, got, err, tt.want)
+		}
+
+		chosen := 0
+		for _, c := range e.DetectionReport(context.Background()) {
+			if c.Reason == "" {
+				t.Errorf("%s: no reason for %s", tt.selection, c.Path)
+			}
+			if c.Chosen {
+				chosen++
+				if c.Path != tt.want {
+					t.Errorf("%s: report chose %s, want %s", tt.selection, c.Path, tt.want)
+				}
+			}
+		}
+		if chosen != 1 {
+			t.Errorf("%s: report chose %d candidates, want 1", tt.selection, chosen)
+		}
+	}
+
+	for _, tt := range []struct {
+		engine *Engine
+		want   string
+	}{
+		{&Engine{Bin: "sqlite3"}, "custom"},
+		{&Engine{Bin: "sqlite3", Select: Selection{Policy: SelectOldest}}, "PATH"},
+		{&Engine{Bin: onPath}, explicitProvider},
+		{&Engine{Embedded: true}, "embedded"},
+	} {
+		if got, err := tt.engine.BinSource(context.Background()); err != nil || got != tt.want {
+			t.Errorf("BinSource of %+v = %q, %v; want %q", tt.engine, got, err, tt.want)
+		}
+	}
+}
+
+func TestCheckAvailabilityCachesVersion(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake binaries are shell scripts")
+	}
+	dir := t.TempDir()
+	path := fakeSQLite(t, dir, "3.45.1")
+	// Record every run of the binary
+	calls := filepath.Join(dir, "calls")
+	script, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(strings.Replace(string(script), "\n", "\necho run >> '"+calls+"'\n", 1)), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	e := &Engine{Bin: path}
+	for i := 0; i < 3; i++ {
+		if _, version, err := e.CheckAvailability(context.Background()); err != nil || !strings.HasPrefix(version, "3.45.1") {
+			t.Fatalf("CheckAvailability = %q, %v", version, err)
+		}
+	}
+	if runs, _ := os.ReadFile(calls); strings.Count(string(runs), "run") != 1 {
+		t.Errorf("sqlite3 run %d times for 3 checks, want once", strings.Count(string(runs), "run"))
+	}
+}
+
+func TestParseSelection(t *testing.T) {
+	for _, s := range []string{"first", "newest", "oldest", "exact:3.45.1"} {
+		sel, err := ParseSelection(s)
+		if err != nil || sel.String() != s {
+			t.Errorf("ParseSelection(%q) = %v, %v", s, sel, err)
+		}
+	}
+	for _, s := range []string{"latest", "exact:", "exact:3.45"} {
+		if _, err := ParseSelection(s); err == nil {
+			t.Errorf("ParseSelection(%q) succeeded, want error", s)
+		}
+	}
+}
@@ -0,0 +1,21 @@
+package sqlite
+
+import (
+	"fmt"
+	"os"
+)
+
+// Go reads and writes files and pipes on Windows with ReadFile and WriteFile,
+// never through the text mode of the C runtime, so stdin and stdout carry
+// database bytes unchanged: no CRLF translation and no end of file at Ctrl+Z.
+// Only a console translates. Go writes to it with WriteConsoleW, as UTF-16
+// text with invalid bytes replaced, so a database written there is lost.
+
+// CheckBinaryOutput returns an error if f is a terminal or console, which
+// cannot take the binary data of operation.
+func CheckBinaryOutput(f *os.File, operation string) error {
+	if !isConsole(f) {
+		return nil
+	}
+	return fmt.Errorf("%s writes binary data, which a terminal would corrupt; redirect stdout to a file", operation)
+}
@@ -0,0 +1,14 @@
+//go:build !windows
+
+package sqlite
+
+import (
+	"os"
+
+	"github.com/mattn/go-isatty"
+)
+
+// isConsole reports whether f is a terminal.
+func isConsole(f *os.File) bool {
+	return isatty.IsTerminal(f.Fd())
+}
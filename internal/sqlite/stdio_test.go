@@ -0,0 +1,27 @@
+package sqlite
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckBinaryOutput(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "out.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := CheckBinaryOutput(f, "smudge"); err != nil {
+		t.Errorf("regular file: %v", err)
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	defer w.Close()
+	if err := CheckBinaryOutput(w, "smudge"); err != nil {
+		t.Errorf("pipe: %v", err)
+	}
+}
@@ -0,0 +1,19 @@
+package sqlite
+
+import (
+	"os"
+
+	"github.com/mattn/go-isatty"
+	"golang.org/x/sys/windows"
+)
+
+// isConsole reports whether f is a Windows console, whose writes Go converts
+// to UTF-16 text, or a Cygwin or MSYS2 terminal such as mintty, which is a
+// pipe to gitsqlite but shows the bytes as text.
+func isConsole(f *os.File) bool {
+	var mode uint32
+	if windows.GetConsoleMode(windows.Handle(f.Fd()), &mode) == nil {
+		return true
+	}
+	return isatty.IsCygwinTerminal(f.Fd())
+}
@@ -0,0 +1,150 @@
+// Package stats collects the size of the tables of a database: row counts,
+// bytes of data and the number of distinct values per column. Features that
+// need to know how large a database or table is read it from here instead of
+// querying the database themselves.
+package stats
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/danielsiegl/gitsqlite/internal/sqlite"
+)
+
+// Database holds the statistics of a database file.
+type Database struct {
+	// Path is the database file.
+	Path string `json:"path"`
+	// Size is the size of the file in bytes.
+	Size int64 `json:"size"`
+	// Tables holds the user tables, sorted by name.
+	Tables []Table `json:"tables"`
+}
+
+// Table holds the statistics of a table.
+type Table struct {
+	Name string `json:"name"`
+	Rows int64  `json:"rows"`
+	// Bytes is the size of the values of all rows, text and numbers counted
+	// in their text form, as they take up space in a dump. It does not
+	// include indexes or the free space of pages.
+	Bytes int64 `json:"bytes"`
+	// Columns is empty unless Options.Columns is set.
+	Columns []Column `json:"columns,omitempty"`
+}
+
+// Column holds the statistics of a column.
+type Column struct {
+	Name string `json:"name"`
+	// Distinct is the number of distinct values other than NULL.
+	Distinct int64 `json:"distinct"`
+	Nulls    int64 `json:"nulls"`
+}
+
+// Options select what Collect computes.
+type Options struct {
+	// Columns computes the column statistics, which sorts the values of
+	// every column and takes longer than counting rows.
+	Columns bool
+	// RowsOnly counts rows and leaves Bytes 0, which reads no values and
+	// is much faster on large tables.
+	RowsOnly bool
+}
+
+// Collect reads the statistics of the database at dbPath. Every table is
+// read once; internal tables such as sqlite_sequence and virtual tables,
+// whose content lives in other tables, are left out.
+func Collect(ctx context.Context, eng *sqlite.Engine, dbPath string, opts Options) (*Database, error) {
+	info, err := os.Stat(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	db := &Database{Path: dbPath, Size: info.Size(), Tables: []Table{}}
+	rows, err := eng.Query(ctx, dbPath, "SELECT name FROM sqlite_schema WHERE type = 'table' AND name NOT LIKE 'sqlite\\_%' ESCAPE '\\' "+
+		"AND sql NOT LIKE 'CREATE VIRTUAL%' ORDER BY name;")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read schema: %w", err)
+	}
+	for _, row := range rows {
+		if len(row) != 1 {
+			continue
+		}
+		table, err := collectTable(ctx, eng, dbPath, row[0], opts)
+		if err != nil {
+			return nil, fmt.Errorf("table %s: %w", row[0], err)
+		}
+		db.Tables = append(db.Tables, *table)
+	}
+	return db, nil
+}
+
+// Table returns the statistics of the table name, case-insensitively, or
+// nil if there is no such table.
+func (db *Database) Table(name string) *Table {
+	for i := range db.Tables {
+		if strings.EqualFold(db.Tables[i].Name, name) {
+			return &db.Tables[i]
+		}
+	}
+	return nil
+}
+
+// RowCounts returns the row counts by table name.
+func (db *Database) RowCounts() map[string]int64 {
+	counts := make(map[string]int64, len(db.Tables))
+	for _, t := range db.Tables {
+		counts[t.Name] = t.Rows
+	}
+	return counts
+}
+
+// collectTable reads the statistics of one table with a single query.
+func collectTable(ctx context.Context, eng *sqlite.Engine, dbPath, name string, opts Options) (*Table, error) {
+	rows, err := eng.Query(ctx, dbPath, fmt.Sprintf("SELECT name FROM pragma_table_info(%s);", sqlite.QuoteLiteral(name)))
+	if err != nil {
+		return nil, err
+	}
+	var columns, sizes []string
+	for _, row := range rows {
+		if len(row) == 1 {
+			columns = append(columns, row[0])
+			sizes = append(sizes, fmt.Sprintf("ifnull(length(CAST(%s AS BLOB)), 0)", sqlite.QuoteIdent(row[0])))
+		}
+	}
+	if len(sizes) == 0 {
+		sizes = []string{"0"}
+	}
+	exprs := []string{"count(*)", "ifnull(sum(" + strings.Join(sizes, " + ") + "), 0)"}
+	if opts.RowsOnly {
+		exprs[1] = "0"
+	}
+	if opts.Columns {
+		for _, col := range columns {
+			exprs = append(exprs, fmt.Sprintf("count(DISTINCT %s)", sqlite.QuoteIdent(col)),
+				fmt.Sprintf("count(*) - count(%s)", sqlite.QuoteIdent(col)))
+		}
+	}
+	rows, err = eng.Query(ctx, dbPath, fmt.Sprintf("SELECT %s FROM %s;", strings.Join(exprs, ", "), sqlite.QuoteIdent(name)))
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) != 1 || len(rows[0]) != len(exprs) {
+		return nil, fmt.Errorf("unexpected result of %d rows", len(rows))
+	}
+	values := make([]int64, len(exprs))
+	for i, text := range rows[0] {
+		if values[i], err = strconv.ParseInt(text, 10, 64); err != nil {
+			return nil, fmt.Errorf("unexpected value %q: %w", text, err)
+		}
+	}
+	t := &Table{Name: name, Rows: values[0], Bytes: values[1]}
+	if opts.Columns {
+		for i, col := range columns {
+			t.Columns = append(t.Columns, Column{Name: col, Distinct: values[2+2*i], Nulls: values[3+2*i]})
+		}
+	}
+	return t, nil
+}
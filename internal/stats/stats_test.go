@@ -0,0 +1,55 @@
+package stats
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/danielsiegl/gitsqlite/internal/sqlite"
+)
+
+func TestCollect(t *testing.T) {
+	ctx := context.Background()
+	eng := &sqlite.Engine{Embedded: true}
+	dbPath := filepath.Join(t.TempDir(), "test.db")
+	script := "CREATE TABLE b(id INTEGER PRIMARY KEY, name TEXT);\n" +
+		"INSERT INTO b VALUES(1,'ab'),(2,'ab'),(3,NULL);\n" +
+		"CREATE TABLE a(x);\n" +
+		"CREATE TABLE seq(id INTEGER PRIMARY KEY AUTOINCREMENT);\n"
+	if err := eng.Restore(ctx, dbPath, strings.NewReader(script)); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := Collect(ctx, eng, dbPath, Options{Columns: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, table := range db.Tables {
+		names = append(names, table.Name)
+	}
+	if got := strings.Join(names, " "); got != "a b seq" {
+		t.Fatalf("tables %q, want a b seq", got)
+	}
+	b := db.Table("B")
+	// ids 1, 2 and 3 are one byte each in text form, 'ab' two
+	if b == nil || b.Rows != 3 || b.Bytes != 7 {
+		t.Fatalf("table b: %+v, want 3 rows of 7 bytes", b)
+	}
+	want := []Column{{Name: "id", Distinct: 3}, {Name: "name", Distinct: 1, Nulls: 1}}
+	if len(b.Columns) != len(want) || b.Columns[0] != want[0] || b.Columns[1] != want[1] {
+		t.Errorf("columns of b: %+v, want %+v", b.Columns, want)
+	}
+	if a := db.Table("a"); a.Rows != 0 || a.Bytes != 0 {
+		t.Errorf("table a: %+v, want empty", a)
+	}
+
+	db, err = Collect(ctx, eng, dbPath, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.RowCounts()["b"] != 3 || db.Table("b").Columns != nil {
+		t.Errorf("without columns: %+v", db.Tables)
+	}
+}
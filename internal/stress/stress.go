@@ -0,0 +1,482 @@
+// Package stress runs clean and smudge over and over under pipe pressure, in
+// process and as child processes, to reproduce intermittent hangs on the
+// machines where they occur. Every run is fed and read through OS pipes, as
+// git does, and is reported as stalled if neither its input nor its output
+// moves for a while.
+package stress
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime/pprof"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/danielsiegl/gitsqlite/internal/filters"
+	"github.com/danielsiegl/gitsqlite/internal/sqlite"
+)
+
+// How the output of a run is read.
+const (
+	// ReaderFast reads the output as fast as it comes.
+	ReaderFast = "fast"
+	// ReaderSlow reads the output in small blocks with pauses, so the pipe
+	// stays full and the filter waits on every write.
+	ReaderSlow = "slow"
+	// ReaderEarlyClose reads the start of the output and closes the pipe,
+	// like git does when it no longer needs the rest.
+	ReaderEarlyClose = "early-close"
+)
+
+// slowBlock and slowPause pace ReaderSlow; a block per pause stays well
+// within the write timeout of the filters.
+const (
+	slowBlock = 4 * 1024
+	slowPause = time.Millisecond
+)
+
+// earlyCloseAfter is how much output ReaderEarlyClose reads.
+const earlyCloseAfter = 64 * 1024
+
+// DefaultStallTimeout is how long a run may make no progress before it is
+// reported as stalled.
+const DefaultStallTimeout = 30 * time.Second
+
+// Outcomes of a run.
+const (
+	OutcomeOK      = "ok"
+	OutcomeFailed  = "failed"
+	OutcomeStalled = "stalled"
+)
+
+// Scenario is one way of running a filter.
+type Scenario struct {
+	// Op is "clean" or "smudge".
+	Op string
+	// Child runs the filter as a child process instead of in process.
+	Child bool
+	// Reader is how the output is read, e.g. ReaderSlow.
+	Reader string
+}
+
+func (s Scenario) String() string {
+	mode := "in-process"
+	if s.Child {
+		mode = "child"
+	}
+	return s.Op + "/" + mode + "/" + s.Reader
+}
+
+// Scenarios returns the scenarios of an iteration: both operations with every
+// reader, in process and, if child is set, as child processes.
+func Scenarios(child bool) []Scenario {
+	var scenarios []Scenario
+	for _, isChild := range []bool{false, true} {
+		if isChild && !child {
+			continue
+		}
+		for _, op := range []string{"clean", "smudge"} {
+			for _, reader := range []string{ReaderFast, ReaderSlow, ReaderEarlyClose} {
+				scenarios = append(scenarios, Scenario{Op: op, Child: isChild, Reader: reader})
+			}
+		}
+	}
+	return scenarios
+}
+
+// Options configure Run.
+type Options struct {
+	// Iterations is how often every scenario is run.
+	Iterations int
+	// Parallel is how many runs happen at the same time.
+	Parallel int
+	// StallTimeout is how long a run may make no progress; see
+	// DefaultStallTimeout.
+	StallTimeout time.Duration
+	// Executable is the gitsqlite binary for the child runs, which are
+	// skipped if it is empty. It is run with Args followed by the operation.
+	Executable string
+	Args       []string
+	// Clean and Smudge are the options of the in-process runs.
+	Clean  filters.Options
+	Smudge filters.SmudgeOptions
+	// PipeBuffer is the pipe buffer of the in-process runs (-pipe-buffer).
+	PipeBuffer int
+	// ReadTimeout is the stdin timeout of the in-process runs
+	// (-read-timeout).
+	ReadTimeout time.Duration
+}
+
+// Result is the outcome of a single run.
+type Result struct {
+	Iteration int
+	Scenario  Scenario
+	Outcome   string
+	Duration  time.Duration
+	// Bytes is how much output was read.
+	Bytes int64
+	// Err is why the run failed or stalled.
+	Err error
+	// Stacks is the goroutine dump taken when an in-process run stalled.
+	Stacks string
+}
+
+// Summary counts the results of Run.
+type Summary struct {
+	Runs    int
+	Failed  int
+	Stalled int
+}
+
+// OK reports whether every run finished as expected.
+func (s Summary) OK() bool {
+	return s.Failed == 0 && s.Stalled == 0
+}
+
+// Run cleans the database at dbPath once for reference, then runs every
+// scenario opts.Iterations times, opts.Parallel at a time, and calls report
+// with the result of each run. Runs reading all output must give the
+// reference dump (clean) or a database (smudge); runs closing the output
+// early may fail, but must finish. A stalled in-process run is canceled,
+// which may leave its goroutines behind. Run stops early if ctx is canceled.
+func Run(ctx context.Context, eng *sqlite.Engine, dbPath string, opts Options, report func(Result)) (Summary, error) {
+	if opts.StallTimeout <= 0 {
+		opts.StallTimeout = DefaultStallTimeout
+	}
+	opts.Parallel = max(opts.Parallel, 1)
+
+	// The reference dump is also the input of the smudge runs
+	ref, err := os.CreateTemp("", "gitsqlite-stress-*.sql")
+	if err != nil {
+		return Summary{}, err
+	}
+	defer os.Remove(ref.Name())
+	defer ref.Close()
+	db, err := os.Open(dbPath)
+	if err != nil {
+		return Summary{}, err
+	}
+	h := sha256.New()
+	err = filters.Clean(ctx, eng, db, io.MultiWriter(ref, h), opts.Clean)
+	db.Close()
+	if err != nil {
+		return Summary{}, fmt.Errorf("reference clean failed: %w", err)
+	}
+	s := &stress{eng: eng, opts: opts, inputs: map[string]string{"clean": dbPath, "smudge": ref.Name()}, cleanSum: h.Sum(nil)}
+
+	type job struct {
+		iteration int
+		scenario  Scenario
+	}
+	jobs := make(chan job)
+	go func() {
+		defer close(jobs)
+		for i := 1; i <= opts.Iterations; i++ {
+			for _, sc := range Scenarios(opts.Executable != "") {
+				select {
+				case jobs <- job{i, sc}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	var summary Summary
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for range opts.Parallel {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				r := s.run(ctx, j.scenario)
+				r.Iteration = j.iteration
+				if ctx.Err() != nil && r.Outcome != OutcomeOK {
+					// Interrupted, not failed
+					continue
+				}
+				mu.Lock()
+				summary.Runs++
+				switch r.Outcome {
+				case OutcomeFailed:
+					summary.Failed++
+				case OutcomeStalled:
+					summary.Stalled++
+				}
+				report(r)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return summary, context.Cause(ctx)
+}
+
+type stress struct {
+	eng      *sqlite.Engine
+	opts     Options
+	inputs   map[string]string
+	cleanSum []byte
+}
+
+// progress records when a run last moved data and how much output was read.
+type progress struct {
+	last atomic.Int64
+	read atomic.Int64
+}
+
+func (p *progress) touch() { p.last.Store(time.Now().UnixNano()) }
+
+func (p *progress) idle() time.Duration {
+	return time.Since(time.Unix(0, p.last.Load()))
+}
+
+// progressWriter touches progress on every write.
+type progressWriter struct {
+	w io.Writer
+	p *progress
+}
+
+func (w progressWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.p.touch()
+	return n, err
+}
+
+// run runs the scenario once.
+func (s *stress) run(ctx context.Context, sc Scenario) (result Result) {
+	result.Scenario = sc
+	start := time.Now()
+	defer func() { result.Duration = time.Since(start) }()
+
+	input, err := os.Open(s.inputs[sc.Op])
+	if err != nil {
+		result.Outcome, result.Err = OutcomeFailed, err
+		return result
+	}
+	defer input.Close()
+	inR, inW, err := os.Pipe()
+	if err != nil {
+		result.Outcome, result.Err = OutcomeFailed, err
+		return result
+	}
+	outR, outW, err := os.Pipe()
+	if err != nil {
+		inR.Close()
+		inW.Close()
+		result.Outcome, result.Err = OutcomeFailed, err
+		return result
+	}
+	defer inW.Close()
+	defer outR.Close()
+
+	runCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	var wait func() error
+	if sc.Child {
+		wait, err = s.startChild(runCtx, sc.Op, inR, outW)
+	} else {
+		wait = s.startInProcess(runCtx, sc.Op, inR, outW)
+	}
+	if err != nil {
+		result.Outcome, result.Err = OutcomeFailed, err
+		return result
+	}
+
+	p := &progress{}
+	p.touch()
+	go func() {
+		// Fails with a broken pipe if the filter stops reading early
+		io.Copy(progressWriter{inW, p}, input)
+		inW.Close()
+	}()
+	type readResult struct {
+		n      int64
+		sum    []byte
+		prefix []byte
+		err    error
+	}
+	read := make(chan readResult, 1)
+	go func() {
+		var r readResult
+		r.n, r.sum, r.prefix, r.err = consume(outR, sc.Reader, p)
+		if sc.Reader == ReaderEarlyClose {
+			outR.Close()
+		}
+		read <- r
+	}()
+	done := make(chan error, 1)
+	go func() { done <- wait() }()
+
+	tick := time.NewTicker(min(s.opts.StallTimeout/10, time.Second))
+	defer tick.Stop()
+	var runErr error
+	var out readResult
+	interrupted := ctx.Done()
+	for running, reading := true, true; running || reading; {
+		select {
+		case runErr = <-done:
+			running = false
+		case out = <-read:
+			reading = false
+		case <-interrupted:
+			// Copies to the output do not watch the context; closing the
+			// pipes stops them
+			interrupted = nil
+			outR.Close()
+			inW.Close()
+		case <-tick.C:
+			if p.idle() < s.opts.StallTimeout {
+				continue
+			}
+			result.Outcome = OutcomeStalled
+			result.Err = fmt.Errorf("no progress for %s (%d bytes of output read)", s.opts.StallTimeout, p.read.Load())
+			if !sc.Child {
+				var stacks bytes.Buffer
+				pprof.Lookup("goroutine").WriteTo(&stacks, 2)
+				result.Stacks = stacks.String()
+			}
+			// Unblock the run: cancel kills its sqlite3 processes or the
+			// child, closing the pipes fails its reads and writes
+			cancel(errors.New("stalled"))
+			outR.Close()
+			inW.Close()
+			select {
+			case <-done:
+			case <-time.After(s.opts.StallTimeout):
+				result.Err = fmt.Errorf("%w; it did not stop when canceled", result.Err)
+			}
+			return result
+		}
+	}
+
+	result.Bytes = out.n
+	result.Outcome = OutcomeOK
+	if sc.Reader == ReaderEarlyClose {
+		// Failing with a broken pipe is fine, hanging is not
+		return result
+	}
+	switch {
+	case runErr != nil:
+		result.Outcome, result.Err = OutcomeFailed, runErr
+	case out.err != nil:
+		result.Outcome, result.Err = OutcomeFailed, fmt.Errorf("reading output: %w", out.err)
+	case sc.Op == "clean" && !bytes.Equal(out.sum, s.cleanSum):
+		result.Outcome, result.Err = OutcomeFailed, errors.New("output differs from the reference dump")
+	case sc.Op == "smudge" && !bytes.HasPrefix(out.prefix, []byte("SQLite format 3\x00")):
+		result.Outcome, result.Err = OutcomeFailed, errors.New("output is not a SQLite database")
+	}
+	return result
+}
+
+// startInProcess runs the filter op in a goroutine reading in and writing
+// out, which it closes when done.
+func (s *stress) startInProcess(ctx context.Context, op string, in, out *os.File) func() error {
+	done := make(chan error, 1)
+	go func() {
+		stdin := sqlite.NewPipeInput(in, s.opts.PipeBuffer, s.opts.ReadTimeout, op)
+		stdout := s.eng.NewPipeOutput(out, s.opts.PipeBuffer, op)
+		var err error
+		if op == "clean" {
+			err = filters.Clean(ctx, s.eng, stdin, stdout, s.opts.Clean)
+		} else {
+			err = filters.Smudge(ctx, s.eng, stdin, stdout, s.opts.Smudge)
+		}
+		if err == nil {
+			err = stdout.Flush()
+		}
+		out.Close()
+		in.Close()
+		done <- err
+	}()
+	return func() error { return <-done }
+}
+
+// startChild starts gitsqlite op as a child process reading in and writing
+// out, which are closed in this process once the child has them.
+func (s *stress) startChild(ctx context.Context, op string, in, out *os.File) (func() error, error) {
+	args := append(append([]string{}, s.opts.Args...), op)
+	cmd := exec.CommandContext(ctx, s.opts.Executable, args...)
+	cmd.Stdin, cmd.Stdout = in, out
+	var stderr bytes.Buffer
+	cmd.Stderr = &limitedWriter{w: &stderr, n: 4096}
+	// Grandchildren keeping stderr open must not keep a killed child
+	// waiting
+	cmd.WaitDelay = time.Second
+	err := cmd.Start()
+	in.Close()
+	out.Close()
+	if err != nil {
+		return nil, err
+	}
+	return func() error {
+		if err := cmd.Wait(); err != nil {
+			if msg := strings.TrimSpace(stderr.String()); msg != "" {
+				return fmt.Errorf("%w: %s", err, msg)
+			}
+			return err
+		}
+		return nil
+	}, nil
+}
+
+// consume reads r as the reader kind does and returns how much it read, the
+// SHA-256 of what it read and the first bytes.
+func consume(r io.Reader, kind string, p *progress) (int64, []byte, []byte, error) {
+	h := sha256.New()
+	var prefix []byte
+	var n int64
+	size := 64 * 1024
+	if kind == ReaderSlow {
+		size = slowBlock
+	}
+	buf := make([]byte, size)
+	for {
+		m, err := r.Read(buf)
+		if m > 0 {
+			p.touch()
+			p.read.Add(int64(m))
+			h.Write(buf[:m])
+			if len(prefix) < 16 {
+				prefix = append(prefix, buf[:min(m, 16-len(prefix))]...)
+			}
+			n += int64(m)
+		}
+		if err == io.EOF {
+			return n, h.Sum(nil), prefix, nil
+		}
+		if err != nil {
+			return n, nil, prefix, err
+		}
+		switch {
+		case kind == ReaderSlow:
+			time.Sleep(slowPause)
+		case kind == ReaderEarlyClose && n >= earlyCloseAfter:
+			return n, nil, prefix, nil
+		}
+	}
+}
+
+// limitedWriter keeps the first n bytes written to it.
+type limitedWriter struct {
+	w io.Writer
+	n int
+}
+
+func (l *limitedWriter) Write(b []byte) (int, error) {
+	if l.n > 0 {
+		m := min(len(b), l.n)
+		l.w.Write(b[:m])
+		l.n -= m
+	}
+	return len(b), nil
+}
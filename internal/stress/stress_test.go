@@ -0,0 +1,42 @@
+package stress
+
+import (
+	"context"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/danielsiegl/gitsqlite/internal/sqlite"
+)
+
+func TestRunReportsStalls(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("no sh")
+	}
+	ctx := context.Background()
+	eng := &sqlite.Engine{Embedded: true}
+	db := filepath.Join(t.TempDir(), "test.db")
+	if err := eng.Restore(ctx, db, strings.NewReader("CREATE TABLE t(x REAL);\nINSERT INTO t VALUES(1.5);\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The child runs never write anything, like a hung filter
+	opts := Options{Iterations: 1, Parallel: 12, StallTimeout: 300 * time.Millisecond,
+		Executable: sh, Args: []string{"-c", "exec sleep 10"}}
+	var results []Result
+	summary, err := Run(ctx, eng, db, opts, func(r Result) { results = append(results, r) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if summary.Runs != 12 || summary.Failed != 0 || summary.Stalled != 6 {
+		t.Errorf("summary = %+v, want 12 runs, 6 stalled", summary)
+	}
+	for _, r := range results {
+		if stalled := r.Outcome == OutcomeStalled; stalled != r.Scenario.Child {
+			t.Errorf("%s: outcome %s (%v)", r.Scenario, r.Outcome, r.Err)
+		}
+	}
+}
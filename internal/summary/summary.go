@@ -0,0 +1,258 @@
+// Package summary collects what a filter run did, the bytes read and
+// written, the rows and the time each stage took, and prints it at the end
+// of the run (-stats). The stages are the ones the log records durations
+// for.
+package summary
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/danielsiegl/gitsqlite/internal/logging"
+)
+
+// Formats for -stats.
+const (
+	// FormatLine prints one line.
+	FormatLine = "line"
+	// FormatJSON prints a JSON object.
+	FormatJSON = "json"
+)
+
+// Flag is the value of -stats: FormatLine, FormatJSON or "" for none. It is
+// a boolean flag, so -stats alone selects FormatLine and -stats=json JSON.
+type Flag string
+
+func (f *Flag) String() string {
+	return string(*f)
+}
+
+// Set sets the format; "true" and "false" are accepted for -stats and
+// -stats=false.
+func (f *Flag) Set(value string) error {
+	switch strings.ToLower(value) {
+	case "true", FormatLine:
+		*f = FormatLine
+	case "false", "":
+		*f = ""
+	case FormatJSON:
+		*f = FormatJSON
+	default:
+		return fmt.Errorf("invalid format %q (expected %s or %s)", value, FormatLine, FormatJSON)
+	}
+	return nil
+}
+
+// IsBoolFlag lets -stats be given without a value.
+func (f *Flag) IsBoolFlag() bool {
+	return true
+}
+
+// Summary is the summary of a run. A nil *Summary records nothing, so
+// operations need no checks.
+type Summary struct {
+	mu        sync.Mutex
+	operation string
+	format    string
+	start     time.Time
+	input     int64
+	output    int64
+	rows      int64
+	stages    []Stage
+	// fingerprint is the environment of the run, for the JSON summary
+	fingerprint any
+}
+
+// Stage is a part of a run, the time it took and when it ended.
+type Stage struct {
+	Name     string
+	Duration time.Duration
+	End      time.Time
+}
+
+// New returns a summary of operation, started now, printed in format:
+// FormatLine, FormatJSON or "" for a summary that is only exported as
+// telemetry.
+func New(operation, format string) *Summary {
+	return &Summary{operation: operation, format: format, start: time.Now()}
+}
+
+// Stage records that stage name took d, ending now.
+func (s *Summary) Stage(name string, d time.Duration) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.stages = append(s.stages, Stage{Name: name, Duration: d, End: time.Now()})
+	s.mu.Unlock()
+}
+
+// Rows records n rows written or restored.
+func (s *Summary) Rows(n int64) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.rows += n
+	s.mu.Unlock()
+}
+
+// Input records n bytes of input not read through Reader, such as a
+// database file given by name.
+func (s *Summary) Input(n int64) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.input += n
+	s.mu.Unlock()
+}
+
+// Output records n bytes of output not written through Writer, such as a
+// database file replaced by renaming.
+func (s *Summary) Output(n int64) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.output += n
+	s.mu.Unlock()
+}
+
+// Fingerprint records the environment of the run, which the JSON summary
+// includes.
+func (s *Summary) Fingerprint(v any) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.fingerprint = v
+	s.mu.Unlock()
+}
+
+// Reader returns r counting the bytes read from it as input.
+func (s *Summary) Reader(r io.Reader) io.Reader {
+	if s == nil {
+		return r
+	}
+	return &countingReader{r: r, s: s}
+}
+
+// Writer returns w counting the bytes written to it as output. Copies into
+// w with ReadFrom, such as the copy of a restored database to a file, keep
+// going through w's ReadFrom.
+func (s *Summary) Writer(w io.Writer) io.Writer {
+	if s == nil {
+		return w
+	}
+	return &countingWriter{w: w, s: s}
+}
+
+// report is the JSON form of a summary.
+type report struct {
+	Operation    string        `json:"operation"`
+	InputBytes   int64         `json:"input_bytes"`
+	OutputBytes  int64         `json:"output_bytes"`
+	Rows         int64         `json:"rows"`
+	Stages       []stageReport `json:"stages"`
+	TotalSeconds float64       `json:"total_seconds"`
+	Fingerprint  any           `json:"fingerprint,omitempty"`
+}
+
+type stageReport struct {
+	Name    string  `json:"name"`
+	Seconds float64 `json:"seconds"`
+}
+
+// Run returns the run so far, ending now, for telemetry; ok is whether it
+// succeeded.
+func (s *Summary) Run(ok bool) logging.Run {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	run := logging.Run{Operation: s.operation, Start: s.start, End: time.Now(), OK: ok,
+		InputBytes: s.input, OutputBytes: s.output, Rows: s.rows}
+	for _, stage := range s.stages {
+		run.Stages = append(run.Stages, logging.RunStage{Name: stage.Name, End: stage.End, Duration: stage.Duration})
+	}
+	return run
+}
+
+// Print writes the summary to w, with the time since New as total. A
+// summary without format prints nothing.
+func (s *Summary) Print(w io.Writer) error {
+	if s == nil || s.format == "" {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	total := time.Since(s.start)
+	if s.format == FormatJSON {
+		r := report{Operation: s.operation, InputBytes: s.input, OutputBytes: s.output, Rows: s.rows,
+			Stages: []stageReport{}, TotalSeconds: seconds(total), Fingerprint: s.fingerprint}
+		for _, stage := range s.stages {
+			r.Stages = append(r.Stages, stageReport{Name: stage.Name, Seconds: seconds(stage.Duration)})
+		}
+		return json.NewEncoder(w).Encode(r)
+	}
+	stages := make([]string, len(s.stages))
+	for i, stage := range s.stages {
+		stages[i] = fmt.Sprintf("%s %.3fs", stage.Name, seconds(stage.Duration))
+	}
+	line := fmt.Sprintf("%s: %s in, %s out, %d rows, %.3fs", s.operation, logging.FormatBytes(s.input), logging.FormatBytes(s.output), s.rows, seconds(total))
+	if len(stages) > 0 {
+		line += " (" + strings.Join(stages, ", ") + ")"
+	}
+	_, err := fmt.Fprintln(w, line)
+	return err
+}
+
+// seconds returns d in seconds, rounded to milliseconds.
+func seconds(d time.Duration) float64 {
+	return float64(d.Milliseconds()) / 1000
+}
+
+type countingReader struct {
+	r io.Reader
+	s *Summary
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.s.mu.Lock()
+	c.s.input += int64(n)
+	c.s.mu.Unlock()
+	return n, err
+}
+
+type countingWriter struct {
+	w io.Writer
+	s *Summary
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.add(int64(n))
+	return n, err
+}
+
+func (c *countingWriter) ReadFrom(r io.Reader) (int64, error) {
+	n, err := io.Copy(c.w, r)
+	c.add(n)
+	return n, err
+}
+
+// Unwrap returns the underlying writer, so sqlite.Engine still sees the
+// buffer of a PipeOutput.
+func (c *countingWriter) Unwrap() io.Writer {
+	return c.w
+}
+
+func (c *countingWriter) add(n int64) {
+	c.s.mu.Lock()
+	c.s.output += n
+	c.s.mu.Unlock()
+}
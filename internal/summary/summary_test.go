@@ -0,0 +1,86 @@
+package summary
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSummary(t *testing.T) {
+	s := New("clean", FormatLine)
+	if _, err := io.Copy(s.Writer(io.Discard), s.Reader(strings.NewReader(strings.Repeat("x", 2048)))); err != nil {
+		t.Fatal(err)
+	}
+	s.Output(512)
+	s.Rows(3)
+	s.Stage("copy", 1500*time.Millisecond)
+	s.Stage("dump", 20*time.Millisecond)
+
+	var out bytes.Buffer
+	if err := s.Print(&out); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out.String(), "clean: 2.0 KB in, 2.5 KB out, 3 rows, "; !strings.HasPrefix(got, want) || !strings.HasSuffix(got, "s (copy 1.500s, dump 0.020s)\n") {
+		t.Errorf("line = %q", got)
+	}
+
+	s.format = FormatJSON
+	out.Reset()
+	if err := s.Print(&out); err != nil {
+		t.Fatal(err)
+	}
+	var r report
+	if err := json.Unmarshal(out.Bytes(), &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.Operation != "clean" || r.InputBytes != 2048 || r.OutputBytes != 2560 || r.Rows != 3 || len(r.Stages) != 2 || r.Stages[0] != (stageReport{"copy", 1.5}) {
+		t.Errorf("JSON = %s", out.String())
+	}
+
+	var none *Summary
+	none.Stage("copy", time.Second)
+	if err := none.Print(&out); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestRun(t *testing.T) {
+	s := New("smudge", "")
+	s.Input(100)
+	s.Stage("restore", 10*time.Millisecond)
+	run := s.Run(true)
+	if run.Operation != "smudge" || !run.OK || run.InputBytes != 100 || len(run.Stages) != 1 || run.Stages[0].Name != "restore" || run.Stages[0].End.Before(run.Start) || run.End.Before(run.Stages[0].End) {
+		t.Errorf("Run = %+v", run)
+	}
+	var out bytes.Buffer
+	if err := s.Print(&out); err != nil || out.Len() != 0 {
+		t.Errorf("Print without format = %q, %v", out.String(), err)
+	}
+}
+
+func TestFlag(t *testing.T) {
+	for _, tc := range []struct {
+		args []string
+		want Flag
+	}{
+		{nil, ""},
+		{[]string{"-stats"}, FormatLine},
+		{[]string{"-stats=json"}, FormatJSON},
+		{[]string{"-stats=false"}, ""},
+	} {
+		var f Flag
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		fs.Var(&f, "stats", "")
+		if err := fs.Parse(tc.args); err != nil || f != tc.want {
+			t.Errorf("%v: %q, %v; want %q", tc.args, f, err, tc.want)
+		}
+	}
+	var f Flag
+	if err := f.Set("xml"); err == nil {
+		t.Error("Set(xml) succeeded")
+	}
+}
@@ -0,0 +1,79 @@
+// Package tempdir selects the directory gitsqlite and the sqlite3 processes it
+// starts create their temporary files in, such as the copy of the database
+// clean dumps and the database smudge restores. These are as large as the
+// database, more than the small or restricted system temporary directories of
+// some corporate machines can hold.
+package tempdir
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+
+	"github.com/danielsiegl/gitsqlite/internal/gitdir"
+)
+
+// EnvDir is the environment variable selecting the temporary directory when
+// -temp-dir is not given.
+const EnvDir = "GITSQLITE_TMPDIR"
+
+// Resolve returns the temporary directory to use: dir if not empty, else
+// $GITSQLITE_TMPDIR, else the repository's <git-dir>/gitsqlite/tmp if git
+// started gitsqlite, e.g. as a filter; "" keeps the system default.
+func Resolve(ctx context.Context, dir string) string {
+	if dir != "" {
+		return dir
+	}
+	if env := os.Getenv(EnvDir); env != "" {
+		return env
+	}
+	if startedByGit() {
+		if repo, err := RepoDir(ctx); err == nil {
+			return repo
+		}
+	}
+	return ""
+}
+
+// startedByGit reports whether gitsqlite runs as a command of git, such as
+// a filter or textconv; git sets GIT_EXEC_PATH for the commands it starts.
+func startedByGit() bool {
+	return os.Getenv("GIT_EXEC_PATH") != ""
+}
+
+// RepoDir returns the temporary directory of the repository containing the
+// current working directory, <git-dir>/gitsqlite/tmp. It is on the disk of
+// the repository, which has room for its databases, and never committed.
+func RepoDir(ctx context.Context) (string, error) {
+	return gitdir.Dir(ctx, "tmp")
+}
+
+// Use makes dir, which is created if needed, the temporary directory of
+// gitsqlite and of the processes it starts, by setting the environment
+// variables os.TempDir and SQLite read.
+func Use(dir string) (string, error) {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(abs, 0o700); err != nil {
+		return "", err
+	}
+	for _, name := range envVars() {
+		if err := os.Setenv(name, abs); err != nil {
+			return "", err
+		}
+	}
+	return abs, nil
+}
+
+// envVars names the environment variables selecting the temporary directory.
+// SQLite reads SQLITE_TMPDIR before TMPDIR on Unix and TMP before TEMP on
+// Windows.
+func envVars() []string {
+	if runtime.GOOS == "windows" {
+		return []string{"TMP", "TEMP"}
+	}
+	return []string{"TMPDIR", "SQLITE_TMPDIR"}
+}
@@ -0,0 +1,49 @@
+package tempdir
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	ctx := context.Background()
+	t.Setenv(EnvDir, "")
+	t.Setenv("GIT_EXEC_PATH", "")
+	if got := Resolve(ctx, ""); got != "" {
+		t.Errorf("Resolve without settings = %q, want the system default", got)
+	}
+	t.Setenv(EnvDir, "from-env")
+	if got := Resolve(ctx, "from-flag"); got != "from-flag" {
+		t.Errorf("Resolve(from-flag) = %q, want the flag to take precedence", got)
+	}
+	if got := Resolve(ctx, ""); got != "from-env" {
+		t.Errorf("Resolve with %s = %q, want from-env", EnvDir, got)
+	}
+}
+
+func TestUse(t *testing.T) {
+	for _, name := range envVars() {
+		t.Setenv(name, os.Getenv(name))
+	}
+	dir := filepath.Join(t.TempDir(), "nested", "tmp")
+	abs, err := Use(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if abs != dir {
+		t.Errorf("Use = %q, want %q", abs, dir)
+	}
+	if got := os.TempDir(); got != dir {
+		t.Errorf("os.TempDir() = %q after Use, want %q", got, dir)
+	}
+	f, err := os.CreateTemp("", "gitsqlite-*.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	if filepath.Dir(f.Name()) != dir {
+		t.Errorf("temporary file %s not created in %s", f.Name(), dir)
+	}
+}
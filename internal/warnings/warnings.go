@@ -0,0 +1,167 @@
+// Package warnings implements gitsqlite's structured warnings. Every warning
+// has a stable ID, is printed to stderr in a consistent format
+// ("gitsqlite: warning W003: ...") and can be suppressed by ID, so automation
+// can tell actionable warnings from known-acceptable ones.
+package warnings
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ID identifies a warning class.
+type ID string
+
+const (
+	// PassthroughUsed: the input was passed through unconverted after an error.
+	PassthroughUsed ID = "W001"
+	// SQLiteVersionDrift: the database was last written by a newer SQLite
+	// library than the engine used for the dump.
+	SQLiteVersionDrift ID = "W002"
+	// LargeTable: a table is large enough to make diffs and merges unwieldy.
+	LargeTable ID = "W003"
+	// JournalNotFolded: a -wal/-journal file exists but was not included.
+	JournalNotFolded ID = "W004"
+	// EditorArtifact: an editor lock file or temp copy was found.
+	EditorArtifact ID = "W005"
+	// LocalMergeFailed: local rows or tables of the worktree database could
+	// not be preserved in the restored database.
+	LocalMergeFailed ID = "W006"
+	// BackupFailed: the worktree database could not be backed up before
+	// being replaced by smudge.
+	BackupFailed ID = "W007"
+	// InvalidUTF8: text that is not valid UTF-8 was replaced in the output.
+	InvalidUTF8 ID = "W008"
+	// RedactUnmatched: a redaction rule names a table or column that is not
+	// in the database.
+	RedactUnmatched ID = "W009"
+	// FilterMisconfigured: the git filter configuration or attributes of the
+	// database are inconsistent (swapped commands, not required, CRLF
+	// conversion).
+	FilterMisconfigured ID = "W010"
+	// EmptyOutputUsed: clean or smudge failed and wrote empty output
+	// (-on-error empty).
+	EmptyOutputUsed ID = "W011"
+	// AttachMissing: a database to attach (-attach) does not exist.
+	AttachMissing ID = "W012"
+	// SQLiteRCIgnored: the user's ~/.sqliterc holds commands that sqlite3
+	// sessions of gitsqlite skip.
+	SQLiteRCIgnored ID = "W013"
+	// ConfigIgnored: .gitsqlite.toml sets an option that a file in the
+	// repository may not set, such as the sqlite3 binary.
+	ConfigIgnored ID = "W014"
+)
+
+// Descriptions documents every warning ID.
+var Descriptions = map[ID]string{
+	PassthroughUsed:     "input passed through unconverted after an error",
+	SQLiteVersionDrift:  "database written by a newer SQLite than the dumping engine",
+	LargeTable:          "table exceeds the large-table threshold",
+	JournalNotFolded:    "journal file next to the database was not included",
+	EditorArtifact:      "editor lock file or temporary copy detected",
+	LocalMergeFailed:    "local rows or tables could not be preserved on smudge",
+	BackupFailed:        "worktree database could not be backed up before smudge",
+	InvalidUTF8:         "invalid UTF-8 text was replaced in the output",
+	RedactUnmatched:     "redaction rule matches no column",
+	FilterMisconfigured: "git filter configuration or attributes are inconsistent",
+	EmptyOutputUsed:     "output left empty after an error",
+	AttachMissing:       "database to attach not found",
+	SQLiteRCIgnored:     "~/.sqliterc is ignored by gitsqlite's sqlite3 sessions",
+	ConfigIgnored:       "setting of .gitsqlite.toml ignored for security",
+}
+
+// EnvSuppress is the environment variable holding IDs to suppress.
+const EnvSuppress = "GITSQLITE_SUPPRESS"
+
+var (
+	mu         sync.Mutex
+	suppressed = map[ID]bool{}
+	emitted    []ID
+	// recorders receive the warnings emitted while they record (see Record).
+	recorders []*[]Warning
+
+	// Output is where warnings are printed. Filter operations must never
+	// write to stdout, so this defaults to stderr.
+	Output io.Writer = os.Stderr
+)
+
+// Suppress disables the given warning IDs. The list may be comma-separated;
+// IDs are case-insensitive. Unknown IDs are returned as an error.
+func Suppress(list string) error {
+	mu.Lock()
+	defer mu.Unlock()
+	for _, item := range strings.Split(list, ",") {
+		item = strings.ToUpper(strings.TrimSpace(item))
+		if item == "" {
+			continue
+		}
+		if _, ok := Descriptions[ID(item)]; !ok {
+			return fmt.Errorf("unknown warning ID %q", item)
+		}
+		suppressed[ID(item)] = true
+	}
+	return nil
+}
+
+// IsSuppressed reports whether id is suppressed.
+func IsSuppressed(id ID) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return suppressed[id]
+}
+
+// Emit logs the warning and prints it to Output unless it is suppressed.
+// Suppressed warnings are still logged at debug level.
+func Emit(id ID, format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	mu.Lock()
+	defer mu.Unlock()
+	for _, r := range recorders {
+		*r = append(*r, Warning{ID: id, Message: msg})
+	}
+	if suppressed[id] {
+		slog.Debug("Suppressed warning", "warning_id", string(id), "message", msg)
+		return
+	}
+	emitted = append(emitted, id)
+	slog.Warn(msg, "warning_id", string(id))
+	fmt.Fprintf(Output, "gitsqlite: warning %s: %s\n", id, msg)
+}
+
+// Emitted returns the IDs of all warnings printed so far.
+func Emitted() []ID {
+	mu.Lock()
+	defer mu.Unlock()
+	return append([]ID(nil), emitted...)
+}
+
+// Warning is a warning emitted while Record recorded.
+type Warning struct {
+	ID      ID     `json:"id"`
+	Message string `json:"message"`
+}
+
+// Record starts recording the warnings emitted, suppressed ones included, so
+// that they can be emitted again later. The returned function stops the
+// recording and returns them; calling it again returns nil.
+func Record() func() []Warning {
+	r := new([]Warning)
+	mu.Lock()
+	recorders = append(recorders, r)
+	mu.Unlock()
+	return func() []Warning {
+		mu.Lock()
+		defer mu.Unlock()
+		for i, other := range recorders {
+			if other == r {
+				recorders = append(recorders[:i], recorders[i+1:]...)
+				return *r
+			}
+		}
+		return nil
+	}
+}
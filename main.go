@@ -2,16 +2,49 @@ package main
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"syscall"
+	"time"
 
+	"github.com/danielsiegl/gitsqlite/internal/backup"
+	"github.com/danielsiegl/gitsqlite/internal/color"
+	"github.com/danielsiegl/gitsqlite/internal/compression"
+	"github.com/danielsiegl/gitsqlite/internal/config"
+	"github.com/danielsiegl/gitsqlite/internal/daemon"
+	"github.com/danielsiegl/gitsqlite/internal/doctor"
+	"github.com/danielsiegl/gitsqlite/internal/e2e"
+	"github.com/danielsiegl/gitsqlite/internal/errs"
 	"github.com/danielsiegl/gitsqlite/internal/filters"
+	"github.com/danielsiegl/gitsqlite/internal/fingerprint"
+	"github.com/danielsiegl/gitsqlite/internal/history"
+	"github.com/danielsiegl/gitsqlite/internal/links"
+	"github.com/danielsiegl/gitsqlite/internal/lint"
 	"github.com/danielsiegl/gitsqlite/internal/logging"
+	"github.com/danielsiegl/gitsqlite/internal/parent"
+	"github.com/danielsiegl/gitsqlite/internal/profiling"
+	"github.com/danielsiegl/gitsqlite/internal/progress"
+	"github.com/danielsiegl/gitsqlite/internal/serve"
+	"github.com/danielsiegl/gitsqlite/internal/setup"
+	"github.com/danielsiegl/gitsqlite/internal/shutdown"
 	"github.com/danielsiegl/gitsqlite/internal/sqlite"
+	"github.com/danielsiegl/gitsqlite/internal/stats"
+	"github.com/danielsiegl/gitsqlite/internal/stress"
+	"github.com/danielsiegl/gitsqlite/internal/summary"
+	"github.com/danielsiegl/gitsqlite/internal/tempdir"
 	"github.com/danielsiegl/gitsqlite/internal/version"
+	"github.com/danielsiegl/gitsqlite/internal/warnings"
 )
 
 func usage() {
@@ -19,29 +52,82 @@ func usage() {
 	fmt.Fprintf(os.Stderr, "Usage: %s [options] <operation>\n\n", exe)
 	fmt.Fprintf(os.Stderr, "Operations:\n")
 	fmt.Fprintf(os.Stderr, "  clean   - Convert binary SQLite database to SQL dump (reads from stdin, writes to stdout; filtered to be byte-for-byte identical)\n")
+	fmt.Fprintf(os.Stderr, "            optional argument: worktree path (git %%f) used to detect -wal/-journal sidecar files\n")
 	fmt.Fprintf(os.Stderr, "  smudge  - Convert SQL dump to binary SQLite database (reads from stdin, writes to stdout)\n")
-	fmt.Fprintf(os.Stderr, "  diff    - Stream SQL dump from binary SQLite database (reads from file, writes to stdout; no filtering)\n\n")
-	fmt.Fprintf(os.Stderr, "Options:\n")
+	fmt.Fprintf(os.Stderr, "            optional argument: worktree path (git %%f) backed up before replacement; unversioned rows/tables kept with -subset/-local-tables\n")
+	fmt.Fprintf(os.Stderr, "  diff    - Stream SQL dump from binary SQLite database (reads from file, writes to stdout; no filtering)\n")
+	fmt.Fprintf(os.Stderr, "  textconv    - Like diff, but tables and rows sorted by name and primary key with explicit column lists (for diff.<driver>.textconv)\n")
+	fmt.Fprintf(os.Stderr, "  stats       - Show the rows, bytes of data and distinct values per column of the tables of a database (--json, --columns=false)\n")
+	fmt.Fprintf(os.Stderr, "  export      - Write every table of a database to a CSV or TSV file of its own, rows in clean order (--dir out --format csv|tsv)\n")
+	fmt.Fprintf(os.Stderr, "  dbdiff      - Print the SQL statements turning one database into another, using sqldiff if installed [--builtin]\n")
+	fmt.Fprintf(os.Stderr, "  diff-driver - Compare the versions git passes to diff.<driver>.command like dbdiff, restoring dumps and treating /dev/null as empty [--builtin]\n")
+	fmt.Fprintf(os.Stderr, "  lint    - Check a database or schema file against schema quality rules (reads from file, writes report to stdout)\n")
+	fmt.Fprintf(os.Stderr, "  check-links - Verify cross-database relationships declared in .gitsqlitelinks (or the given file)\n")
+	fmt.Fprintf(os.Stderr, "  check-split - Check that the data of databases stored next to a schema file matches it and that no database bypasses the filter (--json)\n")
+	fmt.Fprintf(os.Stderr, "  train-dict  - Train per-table zstd compression dictionaries from a database into -dict-dir\n")
+	fmt.Fprintf(os.Stderr, "  undo        - Restore the database at the given path from the newest smudge backup\n")
+	fmt.Fprintf(os.Stderr, "  install     - Configure the git filter, diff driver and attributes [--global|--local] [--ext .db,.sqlite]\n")
+	fmt.Fprintf(os.Stderr, "  uninstall   - Remove that configuration again [--global|--local] [--dry-run] [--renormalize]\n")
+	fmt.Fprintf(os.Stderr, "  detect      - Show the sqlite3 binary used; --verbose lists every candidate and why it was or wasn't chosen\n")
+	fmt.Fprintf(os.Stderr, "  verify      - Check that a database survives clean -> smudge -> clean unchanged and passes integrity_check, or the hashes of a dump (--table)\n")
+	fmt.Fprintf(os.Stderr, "  logs        - Show recent -log files [--last N] [--op clean] [--failed] [--list] [--dir logs]\n")
+	fmt.Fprintf(os.Stderr, "  doctor      - Check sqlite3, git filter configuration, attributes, PATH, temp and log directory, line endings, journal modes and schema split (--json, --fix)\n")
+	fmt.Fprintf(os.Stderr, "  prune-history - Find databases committed as binary files and print plans to rewrite history without them (--json, --min-size N)\n")
+	fmt.Fprintf(os.Stderr, "  serve       - Answer clean and status requests for database files, one per line, for IDE plugins (--stdio)\n")
+	fmt.Fprintf(os.Stderr, "  daemon      - Run the clean and smudge jobs of filters started with -daemon, detecting sqlite3 once [--socket path] [--idle 10m]\n")
+	fmt.Fprintf(os.Stderr, "  fingerprint - Print the platform, locale, SQLite version and compile options and options hash the output depends on (--json)\n")
+	fmt.Fprintf(os.Stderr, "  stress      - Run clean and smudge of a database over and over under pipe pressure and report stalls [--iterations N] [--parallel P]\n")
+	fmt.Fprintf(os.Stderr, "  e2e         - Run git round trips with gitsqlite as filter in temporary repositories [--run name,...] [--keep] [--list]\n\n")
+	fmt.Fprintf(os.Stderr, "Options (defaults can be set in %s at the repository root):\n", config.FileName)
 	flag.PrintDefaults()
 	fmt.Fprintf(os.Stderr, "\nExamples:\n")
 	fmt.Fprintf(os.Stderr, "  %s clean < database.db > database.sql\n", exe)
+	fmt.Fprintf(os.Stderr, "  %s clean database.db < database.db > database.sql\n", exe)
 	fmt.Fprintf(os.Stderr, "  %s smudge < database.sql > database.db\n", exe)
 	fmt.Fprintf(os.Stderr, "  %s diff database.db\n", exe)
+	fmt.Fprintf(os.Stderr, "  %s textconv database.db\n", exe)
+	fmt.Fprintf(os.Stderr, "  %s stats database.db --json\n", exe)
+	fmt.Fprintf(os.Stderr, "  %s export database.db --dir out --format csv\n", exe)
+	fmt.Fprintf(os.Stderr, "  %s dbdiff old.db new.db\n", exe)
+	fmt.Fprintf(os.Stderr, "  git config diff.gitsqlite.command \"%s diff-driver\"\n", exe)
+	fmt.Fprintf(os.Stderr, "  %s -lint-rules no-primary-key=fail lint database.db\n", exe)
+	fmt.Fprintf(os.Stderr, "  %s check-links\n", exe)
+	fmt.Fprintf(os.Stderr, "  %s check-split --json\n", exe)
+	fmt.Fprintf(os.Stderr, "  %s train-dict database.db\n", exe)
+	fmt.Fprintf(os.Stderr, "  %s -output database.db smudge < database.sql\n", exe)
+	fmt.Fprintf(os.Stderr, "  %s undo database.db\n", exe)
+	fmt.Fprintf(os.Stderr, "  %s install --ext .db,.sqlite\n", exe)
+	fmt.Fprintf(os.Stderr, "  %s uninstall --dry-run\n", exe)
+	fmt.Fprintf(os.Stderr, "  %s detect --verbose\n", exe)
+	fmt.Fprintf(os.Stderr, "  %s verify database.db\n", exe)
+	fmt.Fprintf(os.Stderr, "  %s logs --failed --last 3\n", exe)
+	fmt.Fprintf(os.Stderr, "  %s doctor --fix\n", exe)
+	fmt.Fprintf(os.Stderr, "  %s prune-history --min-size 1048576\n", exe)
+	fmt.Fprintf(os.Stderr, "  %s serve --stdio\n", exe)
+	fmt.Fprintf(os.Stderr, "  %s daemon --idle 10m\n", exe)
+	fmt.Fprintf(os.Stderr, "  %s -daemon .git/gitsqlite/daemon.sock clean %%f\n", exe)
+	fmt.Fprintf(os.Stderr, "  %s -format jsonl fingerprint --json\n", exe)
+	fmt.Fprintf(os.Stderr, "  %s -log stress --iterations 100 --parallel 4 database.db\n", exe)
+	fmt.Fprintf(os.Stderr, "  %s e2e --run roundtrip,checkout --keep\n", exe)
 	fmt.Fprintf(os.Stderr, "  %s -sqlite /usr/local/bin/sqlite3 clean < database.db\n", exe)
+	fmt.Fprintf(os.Stderr, "  %s -engine embedded clean < database.db > database.sql\n", exe)
 	fmt.Fprintf(os.Stderr, "  %s -log clean < database.db > database.sql\n", exe)
 	fmt.Fprintf(os.Stderr, "  %s -log-dir ./logs clean < database.db > database.sql\n", exe)
 
 	fmt.Fprintf(os.Stderr, "  %s -float-precision 6 clean < database.db > database.sql\n", exe)
+	fmt.Fprintf(os.Stderr, "  %s -canonical-schema clean < database.db > database.sql\n", exe)
 	fmt.Fprintf(os.Stderr, "\nSchema/Data Separation Examples:\n")
 	fmt.Fprintf(os.Stderr, "  %s -data-only clean < database.db > data.sql\n", exe)
 	fmt.Fprintf(os.Stderr, "  %s -schema clean < database.db > data.sql\n", exe)
 	fmt.Fprintf(os.Stderr, "  %s -schema-file schema.sql clean < database.db > data.sql\n", exe)
 	fmt.Fprintf(os.Stderr, "  %s -schema smudge < data.sql > database.db\n", exe)
 	fmt.Fprintf(os.Stderr, "  %s -schema-file schema.sql smudge < data.sql > database.db\n", exe)
+	fmt.Fprintf(os.Stderr, "  %s -subset clean database.db < database.db > database.sql\n", exe)
+	fmt.Fprintf(os.Stderr, "  %s -subset smudge database.db < database.sql > database.db\n", exe)
 }
 
 // showVersionInfo displays detailed version information and checks SQLite availability
-func showVersionInfo(sqliteCmd string, logger *slog.Logger, cleanup func()) {
+func showVersionInfo(ctx context.Context, engine *sqlite.Engine, logger *slog.Logger) {
 	logger.Info("showing version information")
 	fmt.Printf("gitsqlite version %s\n", version.Version)
 	fmt.Printf("Git commit: %s\n", version.GitCommit)
@@ -54,22 +140,19 @@ func showVersionInfo(sqliteCmd string, logger *slog.Logger, cleanup func()) {
 			"build_time", version.BuildTime, "executable_path", execPath)
 	} else {
 		logger.Error("failed to get executable path", "error", err)
-		cleanup() // Ensure log is flushed before exit
 		fmt.Fprintf(os.Stderr, "Error getting executable path: %v\n", err)
-		os.Exit(1)
+		shutdown.Exit(errs.ExitFailed)
 	}
-	logger.Info("checking sqlite availability", "sqlite_cmd", sqliteCmd)
+	logger.Info("checking sqlite availability", "sqlite_cmd", engine.Bin, "embedded", engine.Embedded)
 	fmt.Printf("Checking SQLite availability...\n")
 
-	engine := &sqlite.Engine{Bin: sqliteCmd}
-	sqlitePath, version, err := engine.CheckAvailability()
+	sqlitePath, version, err := engine.CheckAvailability(ctx)
 	if err != nil {
 
-		logger.Error("sqlite availability check failed", "sqlite_cmd", sqliteCmd, "error", err)
-		cleanup() // Ensure log is flushed before exit
+		logger.Error("sqlite availability check failed", "sqlite_cmd", engine.Bin, "error", err)
 		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
-		fmt.Fprintf(os.Stderr, "Please ensure SQLite is installed or provide the correct path using -sqlite flag\n")
-		os.Exit(2)
+		fmt.Fprintf(os.Stderr, "Please ensure SQLite is installed, provide the correct path using -sqlite flag, or use -engine embedded\n")
+		shutdown.Exit(errs.ExitSQLiteNotFound)
 
 	}
 	fmt.Printf("SQLite found at: %s\n", sqlitePath)
@@ -77,100 +160,1837 @@ func showVersionInfo(sqliteCmd string, logger *slog.Logger, cleanup func()) {
 	logger.Info("sqlite availability check completed", "version", version, "path", sqlitePath)
 }
 
+// versionInfo is what -version -json prints.
+type versionInfo struct {
+	Version    string `json:"version"`
+	Commit     string `json:"commit"`
+	Branch     string `json:"branch"`
+	BuildTime  string `json:"build_time"`
+	Executable string `json:"executable"`
+	Engine     string `json:"engine"`
+	// SQLitePath and SQLiteVersion are empty if no usable sqlite3 was
+	// found; Error tells why.
+	SQLitePath    string `json:"sqlite_path"`
+	SQLiteVersion string `json:"sqlite_version"`
+	// SQLiteSource is how the binary was found (see sqlite.Engine.BinSource)
+	SQLiteSource string `json:"sqlite_source"`
+	Error        string `json:"error,omitempty"`
+}
+
+// showVersionJSON prints the version information and the sqlite3 binary in
+// use as a JSON object, for provisioning scripts. It exits like -version if
+// no usable sqlite3 is found, after printing the object with the error.
+func showVersionJSON(ctx context.Context, engine *sqlite.Engine, logger *slog.Logger) {
+	info := versionInfo{Version: version.Version, Commit: version.GitCommit, Branch: version.GitBranch, BuildTime: version.BuildTime, Engine: "sqlite3"}
+	if engine.Embedded {
+		info.Engine = "embedded"
+	}
+	if execPath, err := os.Executable(); err == nil {
+		info.Executable = execPath
+	}
+	path, sqliteVersion, err := engine.CheckAvailability(ctx)
+	if err == nil {
+		info.SQLiteSource, err = engine.BinSource(ctx)
+	}
+	info.SQLitePath, info.SQLiteVersion = path, sqliteVersion
+	if err != nil {
+		info.Error = err.Error()
+	}
+	logger.Info("version information displayed", "version", info.Version, "commit", info.Commit, "branch", info.Branch,
+		"build_time", info.BuildTime, "executable_path", info.Executable, "sqlite_path", info.SQLitePath,
+		"sqlite_version", info.SQLiteVersion, "sqlite_source", info.SQLiteSource)
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if werr := enc.Encode(info); werr != nil {
+		logger.Error("failed to write version information", "error", werr)
+		fmt.Fprintf(os.Stderr, "Error: %v\n", werr)
+		shutdown.Exit(errs.Code(werr))
+	}
+	if err != nil {
+		logger.Error("sqlite availability check failed", "sqlite_cmd", engine.Bin, "error", err)
+		shutdown.Exit(errs.ExitSQLiteNotFound)
+	}
+}
+
+// operations lists all supported operations
+var operations = []string{"clean", "smudge", "diff", "textconv", "stats", "export", "dbdiff", "diff-driver", "lint", "check-links", "check-split", "train-dict", "undo", "install", "uninstall", "detect", "verify", "logs", "doctor", "prune-history", "serve", "daemon", "fingerprint", "stress", "e2e"}
+
 // validateOperation checks if the provided operation is valid
-func validateOperation(logger *slog.Logger, cleanup func()) string {
+func validateOperation(logger *slog.Logger) string {
 	if flag.NArg() < 1 {
 		logger.Error("no operation specified")
-		cleanup() // Ensure log is flushed before exit
 		fmt.Fprintf(os.Stderr, "Error: No operation specified\n\n")
 		flag.Usage()
-		os.Exit(1)
+		shutdown.Exit(errs.ExitUsage)
+	}
+	op := flag.Arg(0)
+	known := false
+	for _, candidate := range operations {
+		if op == candidate {
+			known = true
+		}
+	}
+	if !known {
+		logger.Error("unknown operation", "operation", op)
+		fmt.Fprintf(os.Stderr, "Error: Unknown operation '%s'\n", op)
+		fmt.Fprintf(os.Stderr, "Supported operations: %s\n", strings.Join(operations, ", "))
+		fmt.Fprintf(os.Stderr, "Use -help for more information\n")
+		shutdown.Exit(errs.ExitUsage)
+	}
+	return op
+}
+
+// flushOutput writes the output still buffered for stdout.
+func flushOutput(stdout *sqlite.PipeOutput, op string, logger *slog.Logger) {
+	if err := stdout.Flush(); err != nil {
+		logger.Error("failed to write output", "operation", op, slog.Any("error", err))
+		fmt.Fprintf(os.Stderr, "Error writing output for %s operation: %v\n", op, err)
+		shutdown.Exit(errs.Code(err))
+	}
+}
+
+// defaultLogDir returns the directory -log writes to: log_dir from
+// .gitsqlite.toml, the repository's .git/gitsqlite/logs, or the current
+// directory outside a repository. An invalid configuration file is reported
+// later by applyRepoConfig.
+func defaultLogDir(ctx context.Context) string {
+	if file := config.Find("."); file != "" {
+		if cfg, err := config.Load(file); err == nil && cfg.LogDir != "" {
+			return cfg.LogDir
+		}
+	}
+	if dir, err := logging.RepoDir(ctx); err == nil {
+		return dir
+	}
+	return "."
+}
+
+// interruptGrace is how long an interrupted operation may take to stop its
+// sqlite3 processes and remove its temporary files
+const interruptGrace = 5 * time.Second
+
+// handleSignals cancels the context on SIGINT or SIGTERM (on Windows Ctrl+C,
+// Ctrl+Break and closing the console), or when parentGone reports that git
+// exited or stopped reading, which kills the running sqlite3 processes; the
+// operation then fails, removes its temporary files on the way out and exits
+// with the interrupted exit code. A second signal, or an operation that does
+// not stop within interruptGrace, exits right away; shutdown.Exit still
+// removes the temporary files and kills the sqlite3 processes registered.
+func handleSignals(cancel context.CancelCauseFunc, parentGone <-chan error, logger *slog.Logger) {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-signals:
+			logger.Warn("interrupted, stopping", "signal", sig.String())
+			cancel(errs.Mark(fmt.Errorf("interrupted (%v)", sig), errs.ErrInterrupted))
+		case err := <-parentGone:
+			logger.Warn("git went away, stopping", "error", err)
+			cancel(errs.Mark(err, errs.ErrInterrupted))
+		}
+
+		select {
+		case sig := <-signals:
+			logger.Error("interrupted again, exiting", "signal", sig.String())
+		case <-time.After(interruptGrace):
+			logger.Error("operation did not stop after interrupt, exiting", "grace_seconds", interruptGrace.Seconds())
+		}
+		fmt.Fprintf(os.Stderr, "Error: interrupted\n")
+		shutdown.Exit(errs.ExitInterrupted)
+	}()
+}
+
+// recoverCrash turns a panic in the main goroutine into a crash report in the
+// log directory (or where -log would write), so rare crashes in the filter
+// path can be reported with their stack and the preceding log records
+func recoverCrash(logTarget string, logger *slog.Logger) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	stack := debug.Stack()
+	logger.Error("gitsqlite crashed", "panic", fmt.Sprint(r), "stack", string(stack))
+	shutdown.Run() // The crash report includes the flushed log records
+
+	dir := logTarget
+	if dir == "" || dir == "stderr" {
+		dir = defaultLogDir(context.Background())
+	}
+	fmt.Fprintf(os.Stderr, "Error: gitsqlite crashed: %v\n", r)
+	if path, err := logging.WriteCrashReport(dir, r, stack); err == nil {
+		fmt.Fprintf(os.Stderr, "Crash report written to %s\n", path)
+		fmt.Fprintf(os.Stderr, "Please attach it to an issue at https://github.com/danielsiegl/gitsqlite/issues\n")
+	} else {
+		fmt.Fprintf(os.Stderr, "Failed to write crash report: %v\n%s", err, stack)
+	}
+	shutdown.Exit(errs.ExitCrash)
+}
+
+// applyRepoConfig sets the flags not given on the command line from the
+// repository's .gitsqlite.toml, including the profiles matching the database
+// file of the operation (its path argument or output) and the profile named
+// profile (-config-profile)
+func applyRepoConfig(output, profile string, logger *slog.Logger) {
+	file := config.Find(".")
+	if file == "" {
+		if profile != "" {
+			logger.Error("configuration profile without configuration file", "profile", profile)
+			fmt.Fprintf(os.Stderr, "Error: -config-profile %s: no %s found\n", profile, config.FileName)
+			shutdown.Exit(errs.ExitUsage)
+		}
+		return
+	}
+	cfg, err := config.Load(file)
+	if err != nil {
+		logger.Error("invalid configuration file", "file", file, "error", err)
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		shutdown.Exit(errs.ExitUsage)
+	}
+
+	target := output
+	if flag.NArg() >= 2 {
+		target = flag.Arg(1)
+	}
+	settings, err := cfg.Resolve(target, profile)
+	if err != nil {
+		logger.Error("invalid configuration profile", "file", file, "profile", profile, "error", err)
+		fmt.Fprintf(os.Stderr, "Error: %s: %v\n", file, err)
+		shutdown.Exit(errs.ExitUsage)
+	}
+	explicit := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	for name, value := range settings.Flags() {
+		if explicit[name] {
+			continue
+		}
+		if err := flag.Set(name, value); err != nil {
+			logger.Error("invalid configuration value", "file", file, "flag", name, "value", value, "error", err)
+			fmt.Fprintf(os.Stderr, "Error: %s: invalid value %q for %s: %v\n", file, value, name, err)
+			shutdown.Exit(errs.ExitUsage)
+		}
+		logger.Info("flag set from configuration file", "file", file, "flag", name, "value", value)
+	}
+	// A cloned repository must not choose what its filter runs
+	for _, key := range settings.Untrusted() {
+		if !explicit[key] {
+			warnings.Emit(warnings.ConfigIgnored, "%s: %s is ignored, a file in the repository may not set it; pass -%s in the filter commands in git config", file, key, key)
+		}
+	}
+}
+
+// printSummary prints the -stats summary of the run, if requested
+func printSummary(s *summary.Summary, logger *slog.Logger) {
+	if err := s.Print(os.Stderr); err != nil {
+		logger.Warn("cannot print summary", "error", err)
+	}
+}
+
+// printSQLiteError reports a failed SQLite command of operation op, with a
+// remediation hint if the failure was classified
+func printSQLiteError(op string, err error) {
+	fmt.Fprintf(os.Stderr, "Error running SQLite command for %s operation: %v\n", op, err)
+	printHint(err)
+}
+
+// printHint prints the remediation hint for a SQLite error, if there is one
+func printHint(err error) {
+	if hint := sqlite.Hint(err); hint != "" {
+		fmt.Fprintf(os.Stderr, "Hint: %s\n", hint)
+	}
+}
+
+// executeOperation runs the specified operation with the given engine
+func executeOperation(ctx context.Context, op string, engine *sqlite.Engine, opts filters.Options, smudgeOpts filters.SmudgeOptions, onError string, lintRules string, dictDir string, dictSize int, pipeBuffer int, readTimeout time.Duration, palette color.Palette, logger *slog.Logger) {
+	stdin := sqlite.NewPipeInput(os.Stdin, pipeBuffer, readTimeout, op)
+	stdout := engine.NewPipeOutput(os.Stdout, pipeBuffer, op)
+
+	switch op {
+	case "smudge":
+		logger.Info("starting smudge")
+		err := filters.WithFallback(engine, onError, op, smudgeOpts.Summary.Reader(stdin), smudgeOpts.Summary.Writer(stdout), func(in io.Reader, out io.Writer) error {
+			return filters.Smudge(ctx, engine, in, out, smudgeOpts)
+		})
+		if err != nil {
+			logger.Error("smudge failed", slog.Any("error", err))
+			printSQLiteError("smudge", err)
+			shutdown.Exit(errs.Code(err))
+		}
+		flushOutput(stdout, op, logger)
+		printSummary(smudgeOpts.Summary, logger)
+		logger.Info("smudge completed")
+
+	case "clean":
+		logger.Info("starting clean")
+		err := filters.WithFallback(engine, onError, op, opts.Summary.Reader(stdin), opts.Summary.Writer(stdout), func(in io.Reader, out io.Writer) error {
+			return filters.Clean(ctx, engine, in, out, opts)
+		})
+		if err != nil {
+			logger.Error("clean failed", slog.Any("error", err))
+			printSQLiteError("clean", err)
+			shutdown.Exit(errs.Code(err))
+		}
+		flushOutput(stdout, op, logger)
+		printSummary(opts.Summary, logger)
+		logger.Info("clean completed")
+
+	case "diff":
+		logger.Info("starting diff")
+		if flag.NArg() < 2 {
+			fmt.Fprintf(os.Stderr, "Usage: %s diff <database.db>\n", os.Args[0])
+			shutdown.Exit(errs.ExitUsage)
+		}
+		dbFile := flag.Arg(1)
+		if info, err := os.Stat(dbFile); err == nil {
+			opts.Summary.Input(info.Size())
+		}
+		if err := filters.Diff(ctx, engine, dbFile, opts.Summary.Writer(stdout), opts); err != nil {
+			logger.Error("diff failed", slog.Any("error", err))
+			printSQLiteError("diff", err)
+			shutdown.Exit(errs.Code(err))
+		}
+		flushOutput(stdout, op, logger)
+		printSummary(opts.Summary, logger)
+		logger.Info("diff completed")
+
+	case "textconv":
+		logger.Info("starting textconv")
+		if flag.NArg() < 2 {
+			fmt.Fprintf(os.Stderr, "Usage: %s textconv <database.db>\n", os.Args[0])
+			shutdown.Exit(errs.ExitUsage)
+		}
+		dbFile := flag.Arg(1)
+		if err := filters.Textconv(ctx, engine, dbFile, stdout, opts); err != nil {
+			logger.Error("textconv failed", slog.Any("error", err))
+			printSQLiteError("textconv", err)
+			shutdown.Exit(errs.Code(err))
+		}
+		flushOutput(stdout, op, logger)
+		logger.Info("textconv completed")
+
+	case "stats":
+		logger.Info("starting stats")
+		runStats(ctx, engine, flag.Args()[1:], logger)
+		logger.Info("stats completed")
+
+	case "export":
+		logger.Info("starting export")
+		runExport(ctx, engine, flag.Args()[1:], opts, logger)
+		logger.Info("export completed")
+
+	case "dbdiff":
+		logger.Info("starting dbdiff")
+		runDBDiff(ctx, engine, flag.Args()[1:], opts, logger)
+		logger.Info("dbdiff completed")
+
+	case "diff-driver":
+		logger.Info("starting diff-driver")
+		runDiffDriver(ctx, engine, flag.Args()[1:], stdout, opts, smudgeOpts, logger)
+		flushOutput(stdout, op, logger)
+		logger.Info("diff-driver completed")
+
+	case "lint":
+		logger.Info("starting lint")
+		if flag.NArg() < 2 {
+			fmt.Fprintf(os.Stderr, "Usage: %s lint <database.db|schema.sql>\n", os.Args[0])
+			shutdown.Exit(errs.ExitUsage)
+		}
+		runLint(ctx, engine, flag.Arg(1), lintRules, logger)
+		logger.Info("lint completed")
+
+	case "check-links":
+		logger.Info("starting check-links")
+		linksFile := links.DefaultFile
+		if flag.NArg() >= 2 {
+			linksFile = flag.Arg(1)
+		}
+		runCheckLinks(ctx, engine, linksFile, logger)
+		logger.Info("check-links completed")
+
+	case "check-split":
+		logger.Info("starting check-split")
+		runCheckSplit(ctx, flag.Args()[1:], palette, logger)
+		logger.Info("check-split completed")
+
+	case "train-dict":
+		logger.Info("starting train-dict")
+		if flag.NArg() < 2 {
+			fmt.Fprintf(os.Stderr, "Usage: %s train-dict <database.db>\n", os.Args[0])
+			shutdown.Exit(errs.ExitUsage)
+		}
+		runTrainDict(ctx, engine, flag.Arg(1), dictDir, dictSize, logger)
+		logger.Info("train-dict completed")
+
+	case "undo":
+		logger.Info("starting undo")
+		if flag.NArg() < 2 {
+			fmt.Fprintf(os.Stderr, "Usage: %s undo <database.db>\n", os.Args[0])
+			shutdown.Exit(errs.ExitUsage)
+		}
+		runUndo(ctx, flag.Arg(1), logger)
+		logger.Info("undo completed")
+
+	case "install":
+		logger.Info("starting install")
+		runInstall(ctx, flag.Args()[1:], logger)
+		logger.Info("install completed")
+
+	case "uninstall":
+		logger.Info("starting uninstall")
+		runUninstall(ctx, flag.Args()[1:], logger)
+		logger.Info("uninstall completed")
+
+	case "detect":
+		logger.Info("starting detect")
+		runDetect(ctx, engine, flag.Args()[1:], logger)
+		logger.Info("detect completed")
+
+	case "verify":
+		logger.Info("starting verify")
+		runVerify(ctx, engine, flag.Args()[1:], opts, palette, logger)
+		logger.Info("verify completed")
+
+	case "logs":
+		logger.Info("starting logs")
+		runLogs(ctx, flag.Args()[1:], palette, logger)
+		logger.Info("logs completed")
+
+	case "prune-history":
+		logger.Info("starting prune-history")
+		runPruneHistory(ctx, flag.Args()[1:], palette, logger)
+		logger.Info("prune-history completed")
+
+	case "serve":
+		logger.Info("starting serve")
+		runServe(ctx, engine, flag.Args()[1:], opts, logger)
+		logger.Info("serve completed")
+
+	case "daemon":
+		logger.Info("starting daemon")
+		runDaemon(ctx, engine, flag.Args()[1:], opts, smudgeOpts, onError, logger)
+		logger.Info("daemon completed")
+
+	case "fingerprint":
+		logger.Info("starting fingerprint")
+		runFingerprint(ctx, engine, flag.Args()[1:], logger)
+		logger.Info("fingerprint completed")
+
+	case "doctor":
+		logger.Info("starting doctor")
+		runDoctor(ctx, engine, flag.Args()[1:], palette, logger)
+		logger.Info("doctor completed")
+
+	case "stress":
+		logger.Info("starting stress")
+		runStress(ctx, engine, flag.Args()[1:], opts, smudgeOpts, pipeBuffer, readTimeout, palette, logger)
+		logger.Info("stress completed")
+
+	case "e2e":
+		logger.Info("starting e2e")
+		runE2E(ctx, engine, flag.Args()[1:], palette, logger)
+		logger.Info("e2e completed")
+	}
+}
+
+// statusColor returns the color of a check status
+func statusColor(status string) color.Color {
+	switch status {
+	case doctor.StatusOK:
+		return color.Green
+	case doctor.StatusWarn:
+		return color.Yellow
+	case doctor.StatusFail:
+		return color.Red
+	}
+	return color.Dim
+}
+
+// parseArgs parses the arguments of an operation; invalid ones exit with the
+// usage exit code
+func parseArgs(fs *flag.FlagSet, args []string) {
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			shutdown.Exit(errs.ExitOK)
+		}
+		shutdown.Exit(errs.ExitUsage)
+	}
+}
+
+// runDoctor prints the result of every environment check and exits with
+// the check-failed exit code if any check failed. --fix applies the safe
+// remediations first and checks again; --json prints the findings as JSON
+func runDoctor(ctx context.Context, engine *sqlite.Engine, args []string, palette color.Palette, logger *slog.Logger) {
+	fs := flag.NewFlagSet("doctor", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "Print the findings as JSON")
+	fix := fs.Bool("fix", false, "Fix missing attributes, filter config and log directory, then check again")
+	parseArgs(fs, args)
+
+	logDir := defaultLogDir(ctx)
+	checks := doctor.Run(ctx, engine, logDir)
+	var fixes []doctor.FixResult
+	if *fix {
+		fixes = doctor.Fix(ctx, checks)
+		for _, f := range fixes {
+			logger.Info("doctor fix", "check", f.Check, "action", f.Action, "error", f.Error)
+		}
+		if len(fixes) > 0 {
+			checks = doctor.Run(ctx, engine, logDir)
+		}
+	}
+	failed, warned := 0, 0
+	for _, c := range checks {
+		switch c.Status {
+		case doctor.StatusFail:
+			failed++
+		case doctor.StatusWarn:
+			warned++
+		}
+		logger.Info("doctor check", "check", c.Name, "status", c.Status, "detail", c.Detail)
+	}
+
+	if *asJSON {
+		out := struct {
+			Checks   []doctor.Check     `json:"checks"`
+			Fixes    []doctor.FixResult `json:"fixes,omitempty"`
+			Failed   int                `json:"failed"`
+			Warnings int                `json:"warnings"`
+		}{checks, fixes, failed, warned}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(out); err != nil {
+			logger.Error("failed to write doctor output", "error", err)
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			shutdown.Exit(errs.Code(err))
+		}
+	} else {
+		printDoctor(checks, fixes, failed, warned, palette)
+	}
+	if doctor.Failed(checks) {
+		shutdown.Exit(errs.ExitCheckFailed)
+	}
+}
+
+// printDoctor prints the applied fixes and the checks, one per line, and a
+// summary
+func printDoctor(checks []doctor.Check, fixes []doctor.FixResult, failed, warned int, palette color.Palette) {
+	for _, f := range fixes {
+		if f.Error != "" {
+			fmt.Printf("%s %s: %s\n", palette.Paint(color.Red, "could not fix"), f.Check, f.Error)
+		} else {
+			fmt.Printf("%s %s\n", palette.Paint(color.Green, "fixed"), f.Action)
+		}
+	}
+	width := 0
+	for _, c := range checks {
+		width = max(width, len(c.Name))
+	}
+	for _, c := range checks {
+		status := palette.Paint(statusColor(c.Status), fmt.Sprintf("%-5s", strings.ToUpper(c.Status)))
+		fmt.Printf("%s %-*s  %s\n", status, width, c.Name, c.Detail)
+		if c.Fix != "" && c.Status != doctor.StatusOK {
+			fix := "fix: " + c.Fix
+			if c.Fixable {
+				fix += "; or run gitsqlite doctor --fix"
+			}
+			fmt.Printf("%s %-*s  %s\n", strings.Repeat(" ", 5), width, "", palette.Paint(color.Bold, fix))
+		}
+	}
+	summary := fmt.Sprintf("%d check(s): %d failed, %d warning(s)", len(checks), failed, warned)
+	switch {
+	case failed > 0:
+		summary = palette.Paint(color.Red, summary)
+	case warned > 0:
+		summary = palette.Paint(color.Yellow, summary)
+	}
+	fmt.Println(summary)
+}
+
+// runPruneHistory reports the databases the history holds as binary files
+// and prints the plans to rewrite it without them
+func runPruneHistory(ctx context.Context, args []string, palette color.Palette, logger *slog.Logger) {
+	fs := flag.NewFlagSet("prune-history", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "Print the report and plans as JSON")
+	exts := fs.String("ext", strings.Join(history.DefaultExtensions, ","), "Comma-separated database file extensions")
+	minSize := fs.Int64("min-size", 0, "Ignore binary databases smaller than this many bytes")
+	parseArgs(fs, args)
+	extensions := setup.ParseExtensions(*exts)
+	for i, ext := range extensions {
+		extensions[i] = "." + strings.TrimLeft(ext, "*.")
+	}
+
+	report, err := history.Analyze(ctx, history.Options{Extensions: extensions, MinSize: *minSize})
+	if err != nil {
+		logger.Error("prune-history failed", "error", err)
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		shutdown.Exit(errs.Code(err))
+	}
+	plans := history.Plans(report, extensions)
+	logger.Info("prune-history result", "blobs", report.Blobs, "size", report.Size, "disk_size", report.DiskSize)
+
+	if *asJSON {
+		out := struct {
+			*history.Report
+			Plans []history.Plan `json:"plans"`
+		}{report, plans}
+		if out.Plans == nil {
+			out.Plans = []history.Plan{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(out); err != nil {
+			logger.Error("failed to write prune-history output", "error", err)
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			shutdown.Exit(errs.Code(err))
+		}
+		return
+	}
+	if report.Blobs == 0 {
+		fmt.Printf("%s: no %s file in the history is a binary SQLite database (%d stored as text)\n",
+			palette.Paint(color.Green, "ok"), strings.Join(extensions, "/"), report.DumpBlobs)
+		return
+	}
+	fmt.Printf("%d binary database(s) in the history: %s, %s in the packs, of %s in total\n",
+		report.Blobs, logging.FormatBytes(report.Size), logging.FormatBytes(report.DiskSize), logging.FormatBytes(report.RepositorySize))
+	fmt.Printf("committed from %s (%.10s) to %s (%.10s)\n\n", report.First.Date, report.First.Hash, report.Last.Date, report.Last.Hash)
+	width := len("path")
+	for _, p := range report.Paths {
+		width = max(width, len(p.Path))
+	}
+	fmt.Printf("%-*s  %6s  %10s  %10s\n", width, "path", "blobs", "size", "packed")
+	for _, p := range report.Paths {
+		fmt.Printf("%-*s  %6d  %10s  %10s\n", width, p.Path, p.Blobs, logging.FormatBytes(p.Size), logging.FormatBytes(p.DiskSize))
+	}
+	for _, plan := range plans {
+		fmt.Printf("\n%s %s\n%s\n", palette.Paint(color.Bold, "Plan:"), palette.Paint(color.Bold, plan.Name), plan.Description)
+		fmt.Printf("repository after the rewrite: about %s", logging.FormatBytes(plan.RepositorySize))
+		if plan.LFSSize > 0 {
+			fmt.Printf(", plus %s of LFS storage", logging.FormatBytes(plan.LFSSize))
+		}
+		fmt.Println()
+		for _, command := range plan.Commands {
+			fmt.Printf("  %s\n", command)
+		}
+		for _, caveat := range plan.Caveats {
+			fmt.Printf("  - %s\n", caveat)
+		}
+	}
+}
+
+// runLogs prints the newest log files matching the filters, oldest first
+func runLogs(ctx context.Context, args []string, palette color.Palette, logger *slog.Logger) {
+	fs := flag.NewFlagSet("logs", flag.ContinueOnError)
+	last := fs.Int("last", 5, "Number of invocations to show")
+	op := fs.String("op", "", "Only show invocations of this operation")
+	failed := fs.Bool("failed", false, "Only show invocations that failed or did not finish")
+	list := fs.Bool("list", false, "Print one line per invocation instead of its records")
+	dir := fs.String("dir", "", "Log directory (default: where -log writes)")
+	parseArgs(fs, args)
+
+	if *dir == "" {
+		*dir = defaultLogDir(ctx)
+	}
+	files, err := logging.ListSessions(*dir)
+	if err != nil {
+		logger.Error("failed to list log files", "dir", *dir, "error", err)
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		shutdown.Exit(errs.Code(err))
+	}
+
+	var shown []*logging.Session
+	for i := len(files) - 1; i >= 0 && len(shown) < *last; i-- {
+		session, err := logging.ReadSession(files[i])
+		if err != nil {
+			logger.Warn("skipping unreadable log file", "file", files[i], "error", err)
+			continue
+		}
+		// Skip the log of this invocation
+		if session.PID == os.Getpid() {
+			continue
+		}
+		if *op != "" && session.Operation != *op {
+			continue
+		}
+		if *failed && session.Status == logging.StatusOK {
+			continue
+		}
+		shown = append(shown, session)
+	}
+	if len(shown) == 0 {
+		fmt.Printf("no matching log files in %s\n", *dir)
+		return
+	}
+	for i := len(shown) - 1; i >= 0; i-- {
+		logging.PrintSession(os.Stdout, shown[i], *list, palette)
+	}
+}
+
+// runVerify round-trips the database through clean and smudge and exits with
+// status 4 if the second dump differs or the restored database is damaged
+func runVerify(ctx context.Context, engine *sqlite.Engine, args []string, opts filters.Options, palette color.Palette, logger *slog.Logger) {
+	fs := flag.NewFlagSet("verify", flag.ContinueOnError)
+	tables := fs.String("table", "", "For dumps: only check the hashes of these comma-separated tables")
+	parseArgs(fs, args)
+	if fs.NArg() != 1 {
+		fmt.Fprintf(os.Stderr, "Usage: %s verify <database.db>\n       %s verify [--table a,b] <dump.sql>\n", os.Args[0], os.Args[0])
+		shutdown.Exit(errs.ExitUsage)
+	}
+	dbFile := fs.Arg(0)
+	if !sqlite.IsDatabaseFile(dbFile) {
+		runVerifyDump(dbFile, filters.ParseTableList(*tables), opts.DictDir, palette, logger)
+		return
+	}
+	if *tables != "" {
+		fmt.Fprintf(os.Stderr, "Error: --table checks the table hashes of a dump; %s is a database\n", dbFile)
+		shutdown.Exit(errs.ExitUsage)
+	}
+	result, err := filters.Verify(ctx, engine, dbFile, opts)
+	if err != nil {
+		logger.Error("verify failed", slog.Any("error", err))
+		printSQLiteError("verify", err)
+		shutdown.Exit(errs.Code(err))
+	}
+
+	if result.Identical {
+		fmt.Printf("round trip:      %s (%d bytes of SQL)\n", palette.Paint(color.Green, "identical"), result.Size)
+	} else {
+		fmt.Printf("round trip:      %s\n", palette.Paint(color.Red, fmt.Sprintf("differs at line %d", result.Line)))
+		fmt.Printf("  original:      %s\n", shorten(result.Original, 200))
+		fmt.Printf("  restored:      %s\n", shorten(result.Restored, 200))
+	}
+	integrity := strings.Join(result.Integrity, "; ")
+	if integrity == "ok" {
+		integrity = palette.Paint(color.Green, integrity)
+	} else {
+		integrity = palette.Paint(color.Red, integrity)
+	}
+	fmt.Printf("integrity_check: %s\n", integrity)
+	logger.Info("verify result", "file", dbFile, "identical", result.Identical, "line", result.Line, "integrity", result.Integrity)
+	if !result.OK() {
+		shutdown.Exit(errs.ExitCheckFailed)
+	}
+}
+
+// runVerifyDump checks the hashes a dump records, of the whole file and of
+// its tables (-table-hashes), or only those of tables, and exits with the
+// check-failed code if one does not match. A compressed dump is read with
+// the dictionaries in dictDir
+func runVerifyDump(dumpFile string, tables []string, dictDir string, palette color.Palette, logger *slog.Logger) {
+	f, err := os.Open(dumpFile)
+	if err != nil {
+		logger.Error("cannot open dump", "file", dumpFile, "error", err)
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		shutdown.Exit(errs.ExitUsage)
+	}
+	defer f.Close()
+	result, err := filters.VerifyDumpHashes(f, tables, dictDir)
+	if err != nil {
+		logger.Error("verify failed", slog.Any("error", err))
+		fmt.Fprintf(os.Stderr, "Error reading %s: %v\n", dumpFile, err)
+		shutdown.Exit(errs.Code(err))
+	}
+
+	status := func(c filters.HashCheck) string {
+		switch {
+		case c.OK():
+			return palette.Paint(color.Green, "ok")
+		case c.Actual == "":
+			return palette.Paint(color.Red, "not in the dump")
+		case c.Expected == "":
+			return palette.Paint(color.Red, "no hash recorded")
+		}
+		return palette.Paint(color.Red, "changed")
+	}
+	if result.File != nil {
+		fmt.Printf("file hash:       %s\n", status(*result.File))
+	}
+	if len(result.Tables) == 0 {
+		fmt.Printf("table hashes:    none (written by clean -table-hashes)\n")
+	}
+	for _, t := range result.Tables {
+		fmt.Printf("table %-10s %s\n", t.Name+":", status(t))
+	}
+	logger.Info("verify result", "file", dumpFile, "ok", result.OK())
+	if !result.OK() {
+		shutdown.Exit(errs.ExitCheckFailed)
+	}
+}
+
+// runDaemon runs the clean and smudge jobs of filters started with -daemon
+// until it is interrupted, or idle for --idle
+func runDaemon(ctx context.Context, engine *sqlite.Engine, args []string, opts filters.Options, smudgeOpts filters.SmudgeOptions, onError string, logger *slog.Logger) {
+	fs := flag.NewFlagSet("daemon", flag.ContinueOnError)
+	socket := fs.String("socket", "", "Socket to listen on (default: gitsqlite/"+daemon.SocketName+" in the git directory)")
+	idle := fs.Duration("idle", 0, "Stop after no job arrived for this long (0 runs until interrupted)")
+	parseArgs(fs, args)
+	if fs.NArg() > 0 || *idle < 0 {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] daemon [--socket path] [--idle 10m]\n", os.Args[0])
+		shutdown.Exit(errs.ExitUsage)
+	}
+
+	// git runs the filters at the top of the worktree, which the paths of
+	// their jobs are relative to
+	if root := serve.FindRoot(ctx); root != "" {
+		if err := os.Chdir(root); err != nil {
+			logger.Error("cannot change to the worktree", "root", root, "error", err)
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			shutdown.Exit(errs.ExitFailed)
+		}
+	}
+	if *socket == "" {
+		logDir, err := logging.RepoDir(ctx)
+		if err != nil {
+			logger.Error("no socket outside a repository", "error", err)
+			fmt.Fprintf(os.Stderr, "Error: not inside a git repository; give the socket with --socket\n")
+			shutdown.Exit(errs.ExitUsage)
+		}
+		*socket = filepath.Join(filepath.Dir(logDir), daemon.SocketName)
+		if err := os.MkdirAll(filepath.Dir(*socket), 0o755); err != nil {
+			logger.Error("cannot create socket directory", "error", err)
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			shutdown.Exit(errs.ExitFailed)
+		}
+		// Relative to the worktree the path is short enough for a socket,
+		// and the one to give the filters
+		if dir, err := os.Getwd(); err == nil {
+			if rel, err := filepath.Rel(dir, *socket); err == nil {
+				*socket = rel
+			}
+		}
+	}
+	listener, err := daemon.Listen(*socket)
+	if err != nil {
+		logger.Error("cannot listen", "socket", *socket, "error", err)
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		shutdown.Exit(errs.ExitFailed)
+	}
+
+	server := &daemon.Server{Engine: engine, Key: daemonKey(), Clean: opts, Smudge: smudgeOpts, OnError: onError, Idle: *idle}
+	logger.Info("daemon listening", "socket", *socket, "idle", idle.String())
+	fmt.Fprintf(os.Stderr, "gitsqlite daemon listening on %s; filters started with -daemon %s and the same options hand their jobs to it\n", *socket, *socket)
+	if err := server.Serve(ctx, listener); err != nil {
+		logger.Error("daemon failed", "error", err)
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		shutdown.Exit(errs.Code(err))
+	}
+}
+
+// forwardJob hands a clean or smudge job to the daemon listening on socket
+// and exits with the exit code of the job if it failed. It returns false if
+// no daemon took the job, which then runs in this process
+func forwardJob(ctx context.Context, socket string, job daemon.Job, pipeBuffer int, readTimeout time.Duration, logger *slog.Logger) bool {
+	stdin := sqlite.NewPipeInput(os.Stdin, pipeBuffer, readTimeout, job.Op)
+	code, err := daemon.Forward(ctx, socket, job, stdin, os.Stdout, os.Stderr)
+	if errors.Is(err, daemon.ErrUnavailable) {
+		logger.Info("running the job without the daemon", "socket", socket, "reason", err)
+		return false
+	}
+	if err != nil {
+		logger.Error(job.Op+" through the daemon failed", "socket", socket, slog.Any("error", err))
+		fmt.Fprintf(os.Stderr, "Error: %s through the daemon on %s: %v\n", job.Op, socket, err)
+		shutdown.Exit(errs.Code(err))
+	}
+	logger.Info(job.Op+" run by the daemon", "socket", socket, "exit_code", code)
+	if code != errs.ExitOK {
+		shutdown.Exit(code)
+	}
+	return true
+}
+
+// daemonLocalFlags only concern the process they are given to, such as its
+// log, and may differ between the daemon and its clients; -output is sent
+// with every job.
+var daemonLocalFlags = map[string]bool{
+	"daemon": true, "output": true, "color": true, "help": true, "version": true, "json": true,
+	"log": true, "log-dir": true, "log-level": true, "log-max-age": true, "log-max-files": true, "log-max-size": true,
+	"pipe-buffer": true, "profile": true, "progress": true, "read-timeout": true,
+}
+
+// daemonKey identifies the settings clean and smudge run with: the build,
+// the working directory, the environment read by the operations, the flags
+// set on the command line or from .gitsqlite.toml, without
+// daemonLocalFlags, and the subset rules, which the daemon loads once. The
+// daemon only runs jobs with its own key.
+func daemonKey() string {
+	h := sha256.New()
+	dir, _ := os.Getwd()
+	fmt.Fprintf(h, "%s %s\n%s\n", version.Version, version.GitCommit, dir)
+	for _, env := range []string{warnings.EnvSuppress, tempdir.EnvDir} {
+		fmt.Fprintf(h, "%s=%s\n", env, os.Getenv(env))
+	}
+	flag.Visit(func(f *flag.Flag) {
+		if !daemonLocalFlags[f.Name] {
+			fmt.Fprintf(h, "-%s=%s\n", f.Name, f.Value.String())
+		}
+	})
+	if name := subsetRulesFile(flag.Lookup("subset").Value.String() == "true", flag.Lookup("subset-file").Value.String()); name != "" {
+		rules, err := os.ReadFile(name)
+		fmt.Fprintf(h, "subset %x %v\n", sha256.Sum256(rules), err)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// subsetRulesFile returns the file of subset rules -subset-file or -subset
+// selects, "" if there is none.
+func subsetRulesFile(subset bool, file string) string {
+	if file != "" {
+		return file
+	}
+	if subset {
+		return filters.DefaultSubsetFile
+	}
+	return ""
+}
+
+// runServe answers requests about database files on stdin and stdout until
+// stdin is closed, so an IDE plugin can keep one gitsqlite per workspace
+func runServe(ctx context.Context, engine *sqlite.Engine, args []string, opts filters.Options, logger *slog.Logger) {
+	fs := flag.NewFlagSet("serve", flag.ContinueOnError)
+	stdio := fs.Bool("stdio", false, "Read requests from stdin and write the responses to stdout")
+	parseArgs(fs, args)
+	if !*stdio || fs.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "Usage: %s serve --stdio\n", os.Args[0])
+		shutdown.Exit(errs.ExitUsage)
+	}
+
+	dir, err := os.Getwd()
+	if err != nil {
+		logger.Error("cannot get working directory", "error", err)
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		shutdown.Exit(errs.ExitFailed)
+	}
+	server := &serve.Server{Engine: engine, Options: opts, Dir: dir, Root: serve.FindRoot(ctx)}
+	if server.Root != "" {
+		// Like under git, clean finds sidecar files and the dump in the
+		// index by the path relative to the top of the worktree
+		if err := os.Chdir(server.Root); err != nil {
+			logger.Error("cannot change to the worktree", "root", server.Root, "error", err)
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			shutdown.Exit(errs.ExitFailed)
+		}
+	}
+	logger.Info("serving requests on stdin", "dir", dir, "root", server.Root)
+	if err := server.Serve(ctx, os.Stdin, os.Stdout); err != nil {
+		logger.Error("serve failed", "error", err)
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		shutdown.Exit(errs.Code(err))
+	}
+}
+
+// runStress runs clean and smudge of a database over and over under pipe
+// pressure and exits with the check-failed code if a run failed or stalled
+func runStress(ctx context.Context, engine *sqlite.Engine, args []string, opts filters.Options, smudgeOpts filters.SmudgeOptions, pipeBuffer int, readTimeout time.Duration, palette color.Palette, logger *slog.Logger) {
+	fs := flag.NewFlagSet("stress", flag.ContinueOnError)
+	iterations := fs.Int("iterations", 10, "How often every scenario is run")
+	parallel := fs.Int("parallel", 1, "How many runs happen at the same time")
+	stallTimeout := fs.Duration("stall-timeout", stress.DefaultStallTimeout, "Report a run as stalled after this long without progress")
+	inProcess := fs.Bool("in-process", false, "Only run the filters in process, not as child processes")
+	parseArgs(fs, args)
+	if fs.NArg() != 1 || *iterations < 1 || *parallel < 1 {
+		fmt.Fprintf(os.Stderr, "Usage: %s stress [--iterations N] [--parallel P] [--stall-timeout 30s] [--in-process] <database.db>\n", os.Args[0])
+		shutdown.Exit(errs.ExitUsage)
+	}
+	dbFile := fs.Arg(0)
+	if !sqlite.IsDatabaseFile(dbFile) {
+		logger.Error("not a database file", "file", dbFile)
+		fmt.Fprintf(os.Stderr, "Error: %s is not a SQLite database\n", dbFile)
+		shutdown.Exit(errs.ExitUsage)
+	}
+
+	options := stress.Options{
+		Iterations:   *iterations,
+		Parallel:     *parallel,
+		StallTimeout: *stallTimeout,
+		Clean:        opts,
+		// Smudge writes to the pipe only, never to a database file
+		Smudge:      filters.SmudgeOptions{SchemaFile: smudgeOpts.SchemaFile, EnforceHash: smudgeOpts.EnforceHash, BlobDir: smudgeOpts.BlobDir, DictDir: smudgeOpts.DictDir, Jobs: smudgeOpts.Jobs},
+		PipeBuffer:  pipeBuffer,
+		ReadTimeout: readTimeout,
+	}
+	if !*inProcess {
+		exe, err := os.Executable()
+		if err != nil {
+			logger.Error("cannot find own executable", "error", err)
+			fmt.Fprintf(os.Stderr, "Error: cannot find the gitsqlite executable for child runs (use --in-process): %v\n", err)
+			shutdown.Exit(errs.ExitFailed)
+		}
+		options.Executable = exe
+		options.Args = childArgs(os.Args[1 : len(os.Args)-flag.NArg()])
+	}
+
+	fmt.Printf("stress: %s, %d iteration(s) of %d scenario(s), %d in parallel\n", dbFile, *iterations, len(stress.Scenarios(options.Executable != "")), *parallel)
+	start := time.Now()
+	summary, err := stress.Run(ctx, engine, dbFile, options, func(r stress.Result) {
+		attrs := []any{"iteration", r.Iteration, "scenario", r.Scenario.String(), "outcome", r.Outcome,
+			"duration_ms", r.Duration.Milliseconds(), "bytes", r.Bytes}
+		switch r.Outcome {
+		case stress.OutcomeOK:
+			logger.Debug("stress run", attrs...)
+			return
+		case stress.OutcomeFailed:
+			logger.Error("stress run failed", append(attrs, "error", r.Err)...)
+		case stress.OutcomeStalled:
+			logger.Error("stress run stalled", append(attrs, "error", r.Err, "goroutines", r.Stacks)...)
+		}
+		fmt.Printf("%s  #%d %s after %s: %v\n", palette.Paint(color.Red, r.Outcome), r.Iteration, r.Scenario, r.Duration.Round(time.Millisecond), r.Err)
+	})
+	if err != nil && summary.Runs == 0 {
+		logger.Error("stress failed", slog.Any("error", err))
+		printSQLiteError("stress", err)
+		shutdown.Exit(errs.Code(err))
+	}
+
+	status := palette.Paint(color.Green, "ok")
+	if !summary.OK() {
+		status = palette.Paint(color.Red, "problems found")
+	}
+	fmt.Printf("%d run(s) in %s: %d failed, %d stalled: %s\n", summary.Runs, time.Since(start).Round(time.Millisecond), summary.Failed, summary.Stalled, status)
+	logger.Info("stress result", "file", dbFile, "runs", summary.Runs, "failed", summary.Failed, "stalled", summary.Stalled)
+	if err != nil {
+		// Interrupted after some runs
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		shutdown.Exit(errs.Code(err))
+	}
+	if !summary.OK() {
+		if summary.Stalled > 0 {
+			fmt.Printf("the goroutines of stalled in-process runs are in the log (-log)\n")
+		}
+		shutdown.Exit(errs.ExitCheckFailed)
+	}
+}
+
+// runE2E runs the end-to-end scenarios with this executable as the filter of
+// temporary git repositories and exits with the check-failed code if one fails
+func runE2E(ctx context.Context, engine *sqlite.Engine, args []string, palette color.Palette, logger *slog.Logger) {
+	fs := flag.NewFlagSet("e2e", flag.ContinueOnError)
+	run := fs.String("run", "", "Comma-separated names of the scenarios to run (default all)")
+	keep := fs.Bool("keep", false, "Keep the temporary repositories for inspection")
+	list := fs.Bool("list", false, "List the scenarios and exit")
+	parseArgs(fs, args)
+	if fs.NArg() != 0 {
+		fmt.Fprintf(os.Stderr, "Usage: %s e2e [--run name,...] [--keep] [--list]\n", os.Args[0])
+		shutdown.Exit(errs.ExitUsage)
+	}
+	if *list {
+		for _, s := range e2e.Scenarios {
+			fmt.Printf("%-14s %s\n", s.Name, s.Description)
+		}
+		return
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		logger.Error("cannot find own executable", "error", err)
+		fmt.Fprintf(os.Stderr, "Error: cannot find the gitsqlite executable: %v\n", err)
+		shutdown.Exit(errs.ExitFailed)
+	}
+	options := e2e.Options{
+		Executable: exe,
+		Args:       childArgs(os.Args[1 : len(os.Args)-flag.NArg()]),
+		Keep:       *keep,
+	}
+	if *run != "" {
+		options.Only = strings.Split(*run, ",")
+	}
+
+	fmt.Printf("e2e: %s %s\n", exe, strings.Join(options.Args, " "))
+	dir, failed, err := e2e.Run(ctx, engine, options, func(r e2e.Result) {
+		attrs := []any{"scenario", r.Scenario.Name, "duration_ms", r.Duration.Milliseconds(), "dir", r.Dir}
+		if r.Err != nil {
+			logger.Error("e2e scenario failed", append(attrs, "error", r.Err)...)
+			fmt.Printf("%s  %-14s %s\n      %v\n", palette.Paint(color.Red, "FAIL"), r.Scenario.Name, r.Duration.Round(time.Millisecond), r.Err)
+			return
+		}
+		logger.Info("e2e scenario passed", attrs...)
+		fmt.Printf("%s    %-14s %s\n", palette.Paint(color.Green, "ok"), r.Scenario.Name, r.Duration.Round(time.Millisecond))
+	})
+	if *keep && dir != "" {
+		fmt.Printf("repositories kept in %s\n", dir)
+	}
+	if err != nil {
+		logger.Error("e2e failed", slog.Any("error", err))
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		shutdown.Exit(errs.Code(err))
+	}
+	logger.Info("e2e result", "failed", failed)
+	if failed > 0 {
+		fmt.Printf("%d scenario(s) failed: %s\n", failed, palette.Paint(color.Red, "problems found"))
+		shutdown.Exit(errs.ExitCheckFailed)
+	}
+	fmt.Printf("all scenarios passed: %s\n", palette.Paint(color.Green, "ok"))
+}
+
+// childArgs returns the global flags for the child processes of stress and e2e:
+// those given to gitsqlite, without -profile, whose file the children would
+// overwrite
+func childArgs(args []string) []string {
+	var out []string
+	for i := 0; i < len(args); i++ {
+		name := strings.TrimLeft(args[i], "-")
+		if name == "profile" {
+			i++ // skip the value
+			continue
+		}
+		if strings.HasPrefix(name, "profile=") {
+			continue
+		}
+		out = append(out, args[i])
+	}
+	return out
+}
+
+// shorten returns the line s without its newline, cut to at most max bytes
+func shorten(s string, max int) string {
+	s = strings.TrimRight(s, "\r\n")
+	if len(s) > max {
+		s = s[:max] + "..."
+	}
+	return s
+}
+
+// runDetect reports the sqlite3 binary the engine uses; with --verbose it
+// lists every candidate found, its version and why it was or wasn't chosen
+func runDetect(ctx context.Context, engine *sqlite.Engine, args []string, logger *slog.Logger) {
+	fs := flag.NewFlagSet("detect", flag.ContinueOnError)
+	verbose := fs.Bool("verbose", false, "List every candidate with its version and why it was or wasn't chosen")
+	parseArgs(fs, args)
+
+	if engine.Embedded {
+		path, version, err := engine.CheckAvailability(ctx)
+		if err != nil {
+			logger.Error("embedded engine not available", "error", err)
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			shutdown.Exit(errs.ExitSQLiteNotFound)
+		}
+		fmt.Printf("%s: %s\n", path, version)
+		return
+	}
+
+	candidates := engine.DetectionReport(ctx)
+	var chosen *sqlite.Candidate
+	for i, c := range candidates {
+		if c.Chosen {
+			chosen = &candidates[i]
+		}
+		logger.Info("sqlite candidate", "path", c.Path, "provider", c.Provider, "version", c.Version, "chosen", c.Chosen, "reason", c.Reason)
+	}
+	if *verbose {
+		fmt.Printf("Candidates for %s:\n", engine.Bin)
+		for _, c := range candidates {
+			marker := " "
+			if c.Chosen {
+				marker = "*"
+			}
+			fmt.Printf("%s %s [%s]\n", marker, c.Path, c.Provider)
+			if c.Version != "" {
+				fmt.Printf("    version: %s\n", c.Version)
+			}
+			fmt.Printf("    %s\n", c.Reason)
+		}
+		if len(candidates) == 0 {
+			fmt.Printf("  none found (searched %s)\n", strings.Join(sqlite.ProviderNames(), ", "))
+		}
+	}
+	if chosen == nil {
+		fmt.Fprintf(os.Stderr, "Error: no usable SQLite executable '%s' found\n", engine.Bin)
+		shutdown.Exit(errs.ExitSQLiteNotFound)
 	}
-	op := flag.Arg(0)
-	if op != "clean" && op != "smudge" && op != "diff" {
-		logger.Error("unknown operation", "operation", op)
-		cleanup() // Ensure log is flushed before exit
-		fmt.Fprintf(os.Stderr, "Error: Unknown operation '%s'\n", op)
-		fmt.Fprintf(os.Stderr, "Supported operations: clean, smudge, diff\n")
-		fmt.Fprintf(os.Stderr, "Use -help for more information\n")
-		os.Exit(1)
+	if !*verbose {
+		fmt.Printf("%s [%s]: %s\n", chosen.Path, chosen.Provider, chosen.Version)
 	}
-	return op
 }
 
-// executeOperation runs the specified operation with the given engine
-func executeOperation(ctx context.Context, op string, engine *sqlite.Engine, floatPrecision int, dataOnly bool, schemaFilename string, verifyHash bool, logger *slog.Logger, cleanup func()) {
-	switch op {
-	case "smudge":
-		logger.Info("starting smudge")
-		if err := filters.Smudge(ctx, engine, os.Stdin, os.Stdout, schemaFilename, verifyHash); err != nil {
-			logger.Error("smudge failed", slog.Any("error", err))
-			cleanup() // Ensure log is flushed before exit
-			fmt.Fprintf(os.Stderr, "Error running SQLite command for smudge operation: %v\n", err)
-			os.Exit(3)
+// runInstall configures git to use gitsqlite for database files
+func runInstall(ctx context.Context, args []string, logger *slog.Logger) {
+	fs := flag.NewFlagSet("install", flag.ContinueOnError)
+	global := fs.Bool("global", false, "Configure all repositories of the current user")
+	local := fs.Bool("local", false, "Configure the current repository (default)")
+	exts := fs.String("ext", strings.Join(setup.DefaultExtensions, ","), "Comma-separated database file extensions")
+	name := fs.String("name", "", "Register an additional filter and diff driver of this name applying the profile of the same name in .gitsqlite.toml")
+	parseArgs(fs, args)
+	if *global && *local {
+		fmt.Fprintf(os.Stderr, "Error: --global and --local are mutually exclusive\n")
+		shutdown.Exit(errs.ExitUsage)
+	}
+	extensions := setup.ParseExtensions(*exts)
+	if *name != "" {
+		checkProfileName(*name, logger)
+		extGiven := false
+		fs.Visit(func(f *flag.Flag) { extGiven = extGiven || f.Name == "ext" })
+		if !extGiven {
+			extensions = nil
 		}
-		logger.Info("smudge completed")
+	}
 
-	case "clean":
-		logger.Info("starting clean")
-		if err := filters.Clean(ctx, engine, os.Stdin, os.Stdout, floatPrecision, dataOnly, schemaFilename); err != nil {
-			logger.Error("clean failed", slog.Any("error", err))
-			cleanup() // Ensure log is flushed before exit
-			fmt.Fprintf(os.Stderr, "Error running SQLite command for clean operation: %v\n", err)
-			os.Exit(3)
+	result, err := setup.Install(ctx, setup.Options{
+		Global:     *global,
+		Extensions: extensions,
+		Command:    setup.DefaultCommand(),
+		Name:       *name,
+	})
+	if err != nil {
+		logger.Error("install failed", "error", err)
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		shutdown.Exit(errs.Code(err))
+	}
+	for _, entry := range result.Config {
+		fmt.Printf("set %s\n", entry)
+	}
+	for _, line := range result.Added {
+		fmt.Printf("added '%s' to %s\n", line, result.AttributesFile)
+	}
+	switch {
+	case *name != "" && extensions == nil:
+		fmt.Printf("assign it in %s with lines like '%s' below the lines of the plain driver (the last matching line wins)\n", result.AttributesFile, setup.AttributeLine(*name, ".strict.db"))
+	case len(result.Added) == 0:
+		fmt.Printf("%s already lists all patterns\n", result.AttributesFile)
+	}
+	logger.Info("git configured", "global", *global, "name", *name, "attributes_file", result.AttributesFile, "added", len(result.Added))
+}
+
+// checkProfileName exits unless name can name a driver and .gitsqlite.toml has
+// a profile of that name, so that install --name does not register a filter
+// that fails on every file
+func checkProfileName(name string, logger *slog.Logger) {
+	var err error
+	switch file := config.Find("."); {
+	case !config.ValidName(name):
+		err = fmt.Errorf("invalid name %q: use letters, digits, '-' and '_'", name)
+	case name == setup.Driver:
+		err = fmt.Errorf("%s is the name of the plain driver; install it without --name", name)
+	case file == "":
+		err = fmt.Errorf("--name %s: no %s with a profile named %s found", name, config.FileName, name)
+	default:
+		var cfg *config.Config
+		if cfg, err = config.Load(file); err == nil && !cfg.HasProfile(name) {
+			err = fmt.Errorf("%s has no profile named %s; add one with name = %q", file, name, name)
 		}
-		logger.Info("clean completed")
+	}
+	if err != nil {
+		logger.Error("invalid profile name", "name", name, "error", err)
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		shutdown.Exit(errs.ExitUsage)
+	}
+}
 
-	case "diff":
-		logger.Info("starting diff")
-		if flag.NArg() < 2 {
-			fmt.Fprintf(os.Stderr, "Usage: %s diff <database.db>\n", os.Args[0])
-			os.Exit(2)
+// runUninstall removes the git configuration written by install
+func runUninstall(ctx context.Context, args []string, logger *slog.Logger) {
+	fs := flag.NewFlagSet("uninstall", flag.ContinueOnError)
+	global := fs.Bool("global", false, "Remove the configuration of the current user")
+	local := fs.Bool("local", false, "Remove the configuration of the current repository (default)")
+	dryRun := fs.Bool("dry-run", false, "Only show what would be removed")
+	renormalize := fs.Bool("renormalize", false, "Stage the tracked databases as binary files so the repository works without gitsqlite")
+	name := fs.String("name", "", "Remove the driver registered with install --name instead of the plain one")
+	parseArgs(fs, args)
+	if *global && *local {
+		fmt.Fprintf(os.Stderr, "Error: --global and --local are mutually exclusive\n")
+		shutdown.Exit(errs.ExitUsage)
+	}
+
+	result, err := setup.Uninstall(ctx, setup.UninstallOptions{Global: *global, DryRun: *dryRun, Renormalize: *renormalize, Name: *name})
+	if err != nil {
+		logger.Error("uninstall failed", "error", err)
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		shutdown.Exit(errs.Code(err))
+	}
+	verb := map[bool]string{false: "", true: "would "}[*dryRun]
+	for _, entry := range result.Config {
+		fmt.Printf("%sunset %s\n", verb, entry)
+	}
+	for _, line := range result.Removed {
+		fmt.Printf("%sremove '%s' from %s\n", verb, line, result.AttributesFile)
+	}
+	for _, file := range result.Staged {
+		fmt.Printf("%sstage %s as binary\n", verb, file)
+	}
+	for _, file := range result.Skipped {
+		fmt.Printf("skipped %s: not a binary SQLite database in the worktree\n", file)
+	}
+	if len(result.Config) == 0 && len(result.Removed) == 0 {
+		fmt.Printf("gitsqlite is not configured\n")
+	}
+	if len(result.Staged) > 0 && !*dryRun {
+		fmt.Printf("commit to store the databases as binary files\n")
+	}
+	logger.Info("git configuration removed", "global", *global, "name", *name, "dry_run", *dryRun, "config", len(result.Config), "attributes", len(result.Removed), "staged", len(result.Staged))
+}
+
+// runUndo restores a worktree database from the newest snapshot taken by smudge
+func runUndo(ctx context.Context, path string, logger *slog.Logger) {
+	store, err := backup.Open(ctx)
+	if err == nil {
+		var snapshot string
+		snapshot, err = store.Undo(path)
+		if err == nil {
+			fmt.Printf("restored %s from %s\n", path, snapshot)
+			logger.Info("database restored from backup", "path", path, "snapshot", snapshot)
+			return
 		}
-		dbFile := flag.Arg(1)
-		if err := filters.Diff(ctx, engine, dbFile, os.Stdout, dataOnly, schemaFilename); err != nil {
-			logger.Error("diff failed", slog.Any("error", err))
-			cleanup() // Ensure log is flushed before exit
-			fmt.Fprintf(os.Stderr, "Error running SQLite command for diff operation: %v\n", err)
-			os.Exit(3)
+	}
+	logger.Error("undo failed", "path", path, "error", err)
+	fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	shutdown.Exit(errs.Code(err))
+}
+
+// runTrainDict trains one zstd dictionary per table with enough data and
+// stores them in dictDir, keeping the ones they replace for older dumps
+func runTrainDict(ctx context.Context, engine *sqlite.Engine, dbFile string, dictDir string, dictSize int, logger *slog.Logger) {
+	trainOpts := compression.DefaultTrainOptions()
+	trainOpts.DictSize = dictSize
+
+	// Sample generously: the dictionary is trained on up to 100x its size
+	samples, err := filters.SampleTableData(ctx, engine, dbFile, 100*dictSize)
+	if err != nil {
+		logger.Error("train-dict failed", slog.Any("error", err))
+		printSQLiteError("train-dict", err)
+		shutdown.Exit(errs.Code(err))
+	}
+	if err := os.MkdirAll(dictDir, 0o755); err != nil {
+		logger.Error("failed to create dictionary directory", "dir", dictDir, "error", err)
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		shutdown.Exit(errs.Code(err))
+	}
+
+	trained := 0
+	for table, lines := range samples {
+		if strings.ContainsAny(table, `/\:`) {
+			logger.Warn("skipping table with unsafe file name", "table", table)
+			continue
+		}
+		dict, err := compression.Train(table, lines, trainOpts)
+		if err != nil {
+			logger.Info("no dictionary trained", "table", table, "reason", err)
+			fmt.Printf("skipped %s: %v\n", table, err)
+			continue
+		}
+		path, err := compression.Store(dictDir, table, dict)
+		if err != nil {
+			logger.Error("failed to write dictionary", "file", path, "error", err)
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			shutdown.Exit(errs.Code(err))
+		}
+		trained++
+		fmt.Printf("trained %s: %d bytes -> %s\n", table, len(dict), path)
+		logger.Info("dictionary trained", "table", table, "size", len(dict), "file", path)
+	}
+	fmt.Printf("%d dictionary(ies) written to %s\n", trained, dictDir)
+}
+
+// runCheckLinks verifies the relationships declared in linksFile and exits
+// with status 4 if any child value has no matching parent
+func runCheckLinks(ctx context.Context, engine *sqlite.Engine, linksFile string, logger *slog.Logger) {
+	f, err := os.Open(linksFile)
+	if err != nil {
+		logger.Error("failed to open links file", "file", linksFile, "error", err)
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		shutdown.Exit(errs.Code(err))
+	}
+	declared, err := links.Parse(f, filepath.Dir(linksFile))
+	f.Close()
+	if err != nil {
+		logger.Error("invalid links file", "file", linksFile, "error", err)
+		fmt.Fprintf(os.Stderr, "Error in %s: %v\n", linksFile, err)
+		shutdown.Exit(errs.ExitUsage)
+	}
+
+	violations, err := links.Check(ctx, engine, declared)
+	if err != nil {
+		logger.Error("check-links failed", slog.Any("error", err))
+		printSQLiteError("check-links", err)
+		shutdown.Exit(errs.Code(err))
+	}
+
+	for _, v := range violations {
+		shown := ""
+		if v.Count > len(v.Missing) {
+			shown = fmt.Sprintf(" (first %d shown)", len(v.Missing))
+		}
+		fmt.Printf("%s -> %s: %d missing value(s)%s: %s\n", v.Link.Child, v.Link.Parent, v.Count, shown, strings.Join(v.Missing, ", "))
+	}
+	fmt.Printf("%d link(s) checked, %d violated\n", len(declared), len(violations))
+	logger.Info("check-links result", "links", len(declared), "violations", len(violations))
+	if len(violations) > 0 {
+		shutdown.Exit(errs.ExitCheckFailed)
+	}
+}
+
+// runCheckSplit checks the databases stored next to a schema file against it
+// and exits with status 4 if one does not match or a database bypasses the
+// filter
+func runCheckSplit(ctx context.Context, args []string, palette color.Palette, logger *slog.Logger) {
+	fs := flag.NewFlagSet("check-split", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "Print the result per database file as JSON")
+	parseArgs(fs, args)
+
+	results, err := doctor.CheckSplit(ctx)
+	if err != nil {
+		logger.Error("check-split failed", "error", err)
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		shutdown.Exit(errs.Code(err))
+	}
+	failed := 0
+	for _, r := range results {
+		if r.Status == doctor.StatusFail {
+			failed++
+		}
+		logger.Info("check-split result", "path", r.Path, "schema", r.Schema, "status", r.Status, "problems", r.Problems)
+	}
+
+	if *asJSON {
+		if results == nil {
+			results = []doctor.SplitFile{}
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(results); err != nil {
+			logger.Error("failed to write check-split output", "error", err)
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			shutdown.Exit(errs.Code(err))
+		}
+	} else {
+		printCheckSplit(results, failed, palette)
+	}
+	if failed > 0 {
+		shutdown.Exit(errs.ExitCheckFailed)
+	}
+}
+
+// printCheckSplit prints a line per database file stored next to a schema
+// file or bypassing the filter, its problems below it, and a summary
+func printCheckSplit(results []doctor.SplitFile, failed int, palette color.Palette) {
+	if results == nil {
+		fmt.Println("no database is stored next to a schema file")
+		return
+	}
+	checked := 0
+	for _, r := range results {
+		if r.Status == doctor.StatusSkip {
+			continue
+		}
+		checked++
+		status := palette.Paint(statusColor(r.Status), fmt.Sprintf("%-5s", strings.ToUpper(r.Status)))
+		if r.Schema != "" {
+			fmt.Printf("%s %s (schema %s)\n", status, r.Path, r.Schema)
+		} else {
+			fmt.Printf("%s %s\n", status, r.Path)
+		}
+		for _, problem := range r.Problems {
+			fmt.Printf("%s %s\n", strings.Repeat(" ", 5), problem)
+		}
+	}
+	fmt.Printf("%d database file(s) checked, %d failed\n", checked, failed)
+}
+
+// runLint checks a database or schema file against the lint rules and exits
+// with status 4 if any rule configured to fail reports a finding
+func runLint(ctx context.Context, engine *sqlite.Engine, target string, rules string, logger *slog.Logger) {
+	cfg, err := lint.ParseConfig(rules)
+	if err != nil {
+		logger.Error("invalid lint rules", "rules", rules, "error", err)
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		shutdown.Exit(errs.ExitUsage)
+	}
+
+	var schema *lint.Schema
+	if sqlite.IsDatabaseFile(target) {
+		schema, err = lint.LoadDatabase(ctx, engine, target)
+	} else {
+		var f *os.File
+		if f, err = os.Open(target); err == nil {
+			schema, err = lint.LoadSchema(f)
+			f.Close()
+		}
+	}
+	if err != nil {
+		logger.Error("lint failed", "target", target, slog.Any("error", err))
+		fmt.Fprintf(os.Stderr, "Error reading %s for lint operation: %v\n", target, err)
+		printHint(err)
+		shutdown.Exit(errs.Code(err))
+	}
+
+	findings := lint.Run(schema, cfg)
+	lint.Print(os.Stdout, findings)
+	logger.Info("lint findings", "target", target, "count", len(findings))
+	if lint.Failed(findings) {
+		shutdown.Exit(errs.ExitCheckFailed)
+	}
+}
+
+// runFingerprint prints the environment fingerprint of runs with the given
+// options; --json prints it as JSON, for comparing two machines.
+func runFingerprint(ctx context.Context, engine *sqlite.Engine, args []string, logger *slog.Logger) {
+	fs := flag.NewFlagSet("fingerprint", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "Print the fingerprint as JSON")
+	parseArgs(fs, args)
+	if fs.NArg() != 0 {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] fingerprint [--json]\n", os.Args[0])
+		shutdown.Exit(errs.ExitUsage)
+	}
+
+	// A fingerprint without the SQLite fields is still printed, then the
+	// error reported
+	fp, collectErr := fingerprint.Collect(ctx, engine, outputOptions())
+	logger.Info("environment fingerprint", "fingerprint", fp)
+	var err error
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(fp)
+	} else {
+		err = fp.Print(os.Stdout)
+	}
+	if err != nil {
+		logger.Error("failed to write fingerprint", "error", err)
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		shutdown.Exit(errs.Code(err))
+	}
+	if collectErr != nil {
+		logger.Error("fingerprint failed", slog.Any("error", collectErr))
+		fmt.Fprintf(os.Stderr, "Error querying SQLite for fingerprint operation: %v\n", collectErr)
+		printHint(collectErr)
+		shutdown.Exit(errs.Code(collectErr))
+	}
+}
+
+// reportingFlags only change how a run is logged, reported or tuned, or
+// differ between machines by design, not the dump or database it writes;
+// outputOptions leaves them out.
+var reportingFlags = map[string]bool{
+	"backups": true, "chunk-size": true, "clean-cache": true, "sinks": true, "color": true, "help": true, "jobs": true,
+	"log": true, "log-dir": true, "log-level": true, "log-max-age": true, "log-max-files": true, "log-max-size": true,
+	"otlp-endpoint": true, "output": true, "pipe-buffer": true, "profile": true, "progress": true, "read-timeout": true,
+	"sqlite": true, "sqlite-select": true, "stats": true, "suppress-warnings": true, "temp-dir": true, "version": true, "json": true,
+}
+
+// outputOptions returns the options set on the command line or from
+// .gitsqlite.toml as name=value, sorted by name, without reportingFlags.
+func outputOptions() []string {
+	options := []string{}
+	flag.Visit(func(f *flag.Flag) {
+		if !reportingFlags[f.Name] {
+			options = append(options, f.Name+"="+f.Value.String())
+		}
+	})
+	return options
+}
+
+// runStats prints the statistics of the tables of a database; --json prints
+// them as JSON. Flags may follow the database path.
+func runStats(ctx context.Context, engine *sqlite.Engine, args []string, logger *slog.Logger) {
+	fs := flag.NewFlagSet("stats", flag.ContinueOnError)
+	asJSON := fs.Bool("json", false, "Print the statistics as JSON")
+	columns := fs.Bool("columns", true, "Count the distinct and NULL values of every column")
+	parseArgs(fs, args)
+	var dbFile string
+	if fs.NArg() > 0 {
+		dbFile = fs.Arg(0)
+		parseArgs(fs, fs.Args()[1:])
+	}
+	if dbFile == "" || fs.NArg() != 0 {
+		fmt.Fprintf(os.Stderr, "Usage: %s stats [--json] [--columns=false] <database.db>\n", os.Args[0])
+		shutdown.Exit(errs.ExitUsage)
+	}
+	if !sqlite.IsDatabaseFile(dbFile) {
+		logger.Error("not a database file", "file", dbFile)
+		fmt.Fprintf(os.Stderr, "Error: %s is not a SQLite database\n", dbFile)
+		shutdown.Exit(errs.ExitUsage)
+	}
+
+	db, err := stats.Collect(ctx, engine, dbFile, stats.Options{Columns: *columns})
+	if err != nil {
+		logger.Error("stats failed", "file", dbFile, slog.Any("error", err))
+		fmt.Fprintf(os.Stderr, "Error reading %s for stats operation: %v\n", dbFile, err)
+		printHint(err)
+		shutdown.Exit(errs.Code(err))
+	}
+	logger.Info("stats collected", "file", dbFile, "tables", len(db.Tables))
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(db); err != nil {
+			logger.Error("failed to write stats output", "error", err)
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			shutdown.Exit(errs.Code(err))
+		}
+		return
+	}
+	printStats(db)
+}
+
+// runExport writes the tables of a database to CSV or TSV files with the
+// filtering options of clean. Flags may follow the database path.
+func runExport(ctx context.Context, engine *sqlite.Engine, args []string, opts filters.Options, logger *slog.Logger) {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	dir := fs.String("dir", "", "Directory to write the files to (created if missing)")
+	format := fs.String("format", filters.ExportCSV, "File format: csv or tsv")
+	parseArgs(fs, args)
+	var dbFile string
+	if fs.NArg() > 0 {
+		dbFile = fs.Arg(0)
+		parseArgs(fs, fs.Args()[1:])
+	}
+	if dbFile == "" || *dir == "" || fs.NArg() != 0 || (*format != filters.ExportCSV && *format != filters.ExportTSV) {
+		fmt.Fprintf(os.Stderr, "Usage: %s export <database.db> --dir <directory> [--format csv|tsv]\n", os.Args[0])
+		shutdown.Exit(errs.ExitUsage)
+	}
+	if !sqlite.IsDatabaseFile(dbFile) {
+		logger.Error("not a database file", "file", dbFile)
+		fmt.Fprintf(os.Stderr, "Error: %s is not a SQLite database\n", dbFile)
+		shutdown.Exit(errs.ExitUsage)
+	}
+
+	files, err := filters.Export(ctx, engine, dbFile, *dir, *format, opts)
+	if err != nil {
+		logger.Error("export failed", "file", dbFile, "dir", *dir, slog.Any("error", err))
+		fmt.Fprintf(os.Stderr, "Error reading %s for export operation: %v\n", dbFile, err)
+		printHint(err)
+		shutdown.Exit(errs.Code(err))
+	}
+	logger.Info("exported tables", "file", dbFile, "dir", *dir, "files", len(files))
+	for _, name := range files {
+		fmt.Println(filepath.Join(*dir, name))
+	}
+}
+
+// runDBDiff prints the statements turning the first database into the
+// second. Flags may follow the database paths.
+func runDBDiff(ctx context.Context, engine *sqlite.Engine, args []string, opts filters.Options, logger *slog.Logger) {
+	fs := flag.NewFlagSet("dbdiff", flag.ContinueOnError)
+	builtin := fs.Bool("builtin", false, "Compare rows by primary key even if sqldiff is installed")
+	parseArgs(fs, args)
+	var files []string
+	for fs.NArg() > 0 && len(files) < 2 {
+		files = append(files, fs.Arg(0))
+		parseArgs(fs, fs.Args()[1:])
+	}
+	if len(files) != 2 || fs.NArg() != 0 {
+		fmt.Fprintf(os.Stderr, "Usage: %s dbdiff [--builtin] <old.db> <new.db>\n", os.Args[0])
+		shutdown.Exit(errs.ExitUsage)
+	}
+	for _, file := range files {
+		if !sqlite.IsDatabaseFile(file) {
+			logger.Error("not a database file", "file", file)
+			fmt.Fprintf(os.Stderr, "Error: %s is not a SQLite database\n", file)
+			shutdown.Exit(errs.ExitUsage)
 		}
-		logger.Info("diff completed")
+	}
+
+	if err := filters.DBDiff(ctx, engine, files[0], files[1], os.Stdout, filters.DBDiffOptions{Builtin: *builtin, LocalTables: opts.LocalTables}); err != nil {
+		logger.Error("dbdiff failed", "old", files[0], "new", files[1], slog.Any("error", err))
+		fmt.Fprintf(os.Stderr, "Error comparing %s and %s for dbdiff operation: %v\n", files[0], files[1], err)
+		printHint(err)
+		shutdown.Exit(errs.Code(err))
+	}
+}
+
+// runDiffDriver compares the two versions of a database git passes to an
+// external diff command (diff.<driver>.command)
+func runDiffDriver(ctx context.Context, engine *sqlite.Engine, args []string, out io.Writer, opts filters.Options, smudgeOpts filters.SmudgeOptions, logger *slog.Logger) {
+	fs := flag.NewFlagSet("diff-driver", flag.ContinueOnError)
+	builtin := fs.Bool("builtin", false, "Compare rows by primary key even if sqldiff is installed")
+	parseArgs(fs, args)
+	driverArgs, err := filters.ParseDiffDriverArgs(fs.Args())
+	if err != nil {
+		logger.Error("invalid diff-driver arguments", "args", fs.Args(), slog.Any("error", err))
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		fmt.Fprintf(os.Stderr, "Usage: git config diff.gitsqlite.command \"%s diff-driver [--builtin]\"\n", os.Args[0])
+		shutdown.Exit(errs.ExitUsage)
+	}
+	logger.Info("comparing versions", "path", driverArgs.Path, "old", driverArgs.Old.ID, "new", driverArgs.New.ID)
+
+	dbdiffOpts := filters.DBDiffOptions{Builtin: *builtin, LocalTables: opts.LocalTables}
+	if err := filters.DiffDriver(ctx, engine, driverArgs, out, smudgeOpts, dbdiffOpts); err != nil {
+		logger.Error("diff-driver failed", "path", driverArgs.Path, slog.Any("error", err))
+		fmt.Fprintf(os.Stderr, "Error comparing versions of %s for diff-driver operation: %v\n", driverArgs.Path, err)
+		printHint(err)
+		shutdown.Exit(errs.Code(err))
 	}
 }
 
+// printStats prints a line per table, followed by a line per column if the
+// column statistics were collected, and a summary
+func printStats(db *stats.Database) {
+	width := len("TABLE")
+	for _, t := range db.Tables {
+		width = max(width, len(t.Name))
+	}
+	fmt.Printf("%-*s %12s %14s\n", width, "TABLE", "ROWS", "BYTES")
+	var rows, bytes int64
+	for _, t := range db.Tables {
+		fmt.Printf("%-*s %12d %14d\n", width, t.Name, t.Rows, t.Bytes)
+		for _, c := range t.Columns {
+			fmt.Printf("  %s: %d distinct, %d NULL\n", c.Name, c.Distinct, c.Nulls)
+		}
+		rows += t.Rows
+		bytes += t.Bytes
+	}
+	fmt.Printf("%d tables, %d rows, %d bytes of data in a %d byte file\n", len(db.Tables), rows, bytes, db.Size)
+}
+
 func main() {
 	// Flags (kept compatible with original main.go)
 	var (
 		showVersion    = flag.Bool("version", false, "Show version information")
-		enableLog      = flag.Bool("log", false, "Enable logging to file in current directory")
-		logDir         = flag.String("log-dir", "", "Log to specified directory instead of current directory")
+		versionJSON    = flag.Bool("json", false, "With -version: print the version information as a JSON object")
+		enableLog      = flag.Bool("log", false, "Enable logging to a file in .git/gitsqlite/logs (log_dir in .gitsqlite.toml, or the current directory outside a repository)")
+		logDir         = flag.String("log-dir", "", "Log to the specified directory instead of the default")
+		logMaxFiles    = flag.Int("log-max-files", logging.DefaultRetention.MaxFiles, "Number of log files kept in the log directory; older ones are removed when a run starts (0 keeps all)")
+		logMaxAge      = flag.Duration("log-max-age", logging.DefaultRetention.MaxAge, "Remove log files older than this when a run starts (0 keeps all)")
+		logMaxSize     = flag.Int64("log-max-size", logging.DefaultRetention.MaxSize, "Total size in bytes of the log files kept; the oldest are removed when a run starts (0 for no limit)")
+		logLevel       = flag.String("log-level", "info", "Lowest level of the records -log writes: debug, info, warn or error; also read from GITSQLITE_LOG_LEVEL, which takes precedence")
 		sqliteCmd      = flag.String("sqlite", "sqlite3", "Path to SQLite executable")
+		sqliteSelect   = flag.String("sqlite-select", sqlite.SelectFirst, "Which sqlite3 to use if several are found: first (priority order), newest, oldest or exact:<version> (e.g. exact:3.45.1)")
+		configProfile  = flag.String("config-profile", "", "Apply the profile with this name from .gitsqlite.toml (used by filters registered with install --name)")
+		collations     = flag.String("collations", "", "For smudge: comma-separated name=other collation mappings, restoring the schema with collation other where it uses name, for collations not available here")
+		attach         = flag.String("attach", "", "Comma-separated name=path databases attached to every SQLite session, for views, triggers and subset rules using their tables (only the main database is versioned)")
+		engineKind     = flag.String("engine", sqlite.EngineCLI, "SQLite engine: cli (sqlite3 executable) or embedded (built-in, no sqlite3 needed)")
 		showHelp       = flag.Bool("help", false, "Show help information")
 		floatPrecision = flag.Int("float-precision", 9, "Number of digits after decimal point for float normalization in INSERT statements")
 		dataOnly       = flag.Bool("data-only", false, "For clean/diff: output only data (INSERT statements), no schema")
 		schema         = flag.Bool("schema", false, "Use .gitsqliteschema for schema/data separation (works with all operations)")
 		schemaFile     = flag.String("schema-file", "", "Use specified file for schema/data separation (works with all operations)")
+		subset         = flag.Bool("subset", false, "Use .gitsqlitesubset to version only matching rows of listed tables (clean/diff/smudge)")
+		subsetFile     = flag.String("subset-file", "", "Use specified file of 'table: condition' rules to version only matching rows (clean/diff/smudge)")
+		localTables    = flag.String("local-tables", "", "Comma-separated tables that are never versioned; smudge with a path argument (%f) keeps them from the existing database")
+		internalTables = flag.String("internal-tables", filters.DefaultInternalTables, "For clean/diff: comma-separated SQLite internal tables whose content is versioned: sqlite_sequence, sqlite_stat1 to sqlite_stat4, stat (all statistics), all or none")
+		pipeBuffer     = flag.Int("pipe-buffer", sqlite.DefaultPipeBuffer, "Size in bytes of the blocks read from stdin and written to stdout (0 writes every line directly)")
+		chunkSize      = flag.Int("chunk-size", sqlite.DefaultChunkSize, "Bytes of output that must be written per second before a write times out, and the size of the blocks copied to unbuffered outputs")
+		tempDir        = flag.String("temp-dir", "", "Directory for temporary databases and dumps, also used by sqlite3 (default $GITSQLITE_TMPDIR, else .git/gitsqlite/tmp when run by git, else the system temporary directory)")
+		readTimeout    = flag.Duration("read-timeout", time.Minute, "For clean/smudge: fail if stdin, when it is a pipe or terminal, delivers no data for this long (0 waits forever)")
+		jobs           = flag.Int("jobs", 1, "For smudge: restore large dumps with up to N parallel sqlite3 processes (max 8)")
+		output         = flag.String("output", "", "For smudge: replace this database file (backed up first) instead of writing to stdout")
+		daemonSocket   = flag.String("daemon", "", "For clean/smudge: hand the job to the gitsqlite daemon listening on this socket; without one, or if it runs with other settings, the job runs here")
+		incremental    = flag.Bool("incremental", false, "For smudge with -output: restore only the tables that changed since the last smudge of the file, using table hashes kept in .git/gitsqlite/tables")
+		sinks          = flag.String("sinks", "", "For clean: comma-separated format=path files written from the same dump besides the output, in format sql, jsonl or manifest (tables, row counts and output hashes as JSON)")
+		cleanCache     = flag.Bool("clean-cache", false, "For clean: keep the output in .git/gitsqlite/cache by the SHA-256 of the database and the settings, and copy it from there when the same database is cleaned again")
+		backups        = flag.Int("backups", backup.DefaultKeep, "For smudge with a path argument (%f): snapshots of the replaced database kept in .git/gitsqlite/backups (0 disables)")
 		verifyHash     = flag.Bool("verify-hash", false, "Enforce hash verification on smudge (fails if hash is invalid/missing; without this flag, validation status is logged only)")
+		dictDir        = flag.String("dict-dir", compression.DefaultDictDir, "For train-dict, clean -compress zstd and smudge: directory the per-table zstd dictionaries are stored in and read from")
+		dictSize       = flag.Int("dict-size", compression.DefaultTrainOptions().DictSize, "For train-dict: maximum dictionary size in bytes")
+		lintRules      = flag.String("lint-rules", "", "For lint: comma-separated rule=off|warn|fail overrides (e.g. no-primary-key=fail)")
+		sidecars       = flag.String("sidecars", filters.SidecarFold, "For clean with a path argument (%f), diff and textconv: handle -wal/-journal files as fold|warn|ignore")
+		journalMode    = flag.String("journal-mode", sqlite.JournalDelete, "For smudge: journal mode of the restored database, delete (rollback journal) or wal")
+		annotateCounts = flag.Bool("annotate-counts", false, "For clean/diff: emit a '-- rows: N' comment after each table's data (ignored by smudge)")
+		suppressWarn   = flag.String("suppress-warnings", "", "Comma-separated warning IDs to suppress (e.g. W002,W003); also read from GITSQLITE_SUPPRESS")
+		controlChars   = flag.String("control-chars", filters.ControlCharsKeep, "For clean/diff: write text values with line breaks and other control characters as the engine does (keep) or as one-line 'a'||char(10)||'b' concatenations (char)")
+		redact         = flag.String("redact", "", "For clean/diff: comma-separated table.column=action rules replacing sensitive values; action is hash, drop (NULL) or empty")
+		invalidUTF8    = flag.String("invalid-utf8", filters.UTF8Escape, "For clean/diff: write text that is not valid UTF-8 as escape (lossless CAST(X'..' AS TEXT)) or replace (U+FFFD)")
+		compress       = flag.String("compress", "", "For clean: compress the output with gzip or zstd; smudge detects compressed input by itself")
+		normalizer     = flag.String("normalizer", filters.NormalizerFast, "For clean/diff: float normalizer, fast (byte scanner) or regex (previous implementation, same output)")
+		colorMode      = flag.String("color", color.Auto, "Color the output of doctor, verify and logs: auto (terminals, unless NO_COLOR is set), always or never; filter output is never colored")
+		rowOrder       = flag.String("row-order", filters.RowOrderKey, "For clean/diff: order rows of tables keyed by non-INTEGER primary keys by key (pk), or keep the sqlite3 .dump order (dump)")
+		schemaOrder    = flag.String("schema-order", filters.SchemaOrderSorted, "For clean/diff: write tables, indexes, views and triggers sorted by dependencies and name (sorted), or keep the sqlite3 .dump order (dump)")
+		blobThreshold  = flag.Int64("blob-threshold", 0, "For clean/diff: replace BLOB values larger than this many bytes with pointers and store them in -blob-dir (0 keeps all BLOBs inline)")
+		blobDir        = flag.String("blob-dir", filters.DefaultBlobDir, "For clean/smudge: content-addressed directory externalized BLOBs are stored in and restored from")
+		onError        = flag.String("on-error", filters.OnErrorFail, "For clean/smudge: on failure exit with an error (fail), write the input unchanged (passthrough) or write nothing (empty); passthrough and empty exit 0")
+		otlpEndpoint   = flag.String("otlp-endpoint", "", "For clean/smudge/diff: export a trace of the run and counters of bytes and rows to this OpenTelemetry collector over OTLP/HTTP (default $OTEL_EXPORTER_OTLP_ENDPOINT)")
+		profile        = flag.String("profile", "", "Write Go runtime profiles of the run: comma-separated cpu=FILE, mem=FILE and trace=FILE (view with go tool pprof or go tool trace)")
+		vacuum         = flag.Bool("vacuum", false, "For clean: dump a compacted copy of the database made with VACUUM INTO, independent of fragmentation and free pages")
+		upgradeFormat  = flag.Bool("upgrade-format", false, "For clean: write the current dump format even if the dump in the git index has the format of an older release")
+		dataFormat     = flag.String("format", filters.DataFormatSQL, "For clean/diff: write rows as INSERT statements (sql) or as one JSON object per row (jsonl); smudge reads both")
+		formatVersion  = flag.Int("format-version", 0, fmt.Sprintf("For clean/diff: pin the dump format version (1 to %d); 0 keeps the version of the dump in the git index, or writes the newest without one", filters.CurrentFormat))
+		tableHashes    = flag.Bool("table-hashes", false, "For clean: write the hash of every table before the hash of the whole file, so verify can tell which tables of a dump changed")
+		canonSchema    = flag.Bool("canonical-schema", false, "For clean/diff: rewrite CREATE TABLE statements in canonical form (constraint order, keyword case, one column per line)")
+		assertIdem     = flag.Bool("assert-idempotent", false, "For clean/diff: normalize every statement a second time and fail if that changes it, catching normalization bugs before they reach the repository (default true with -strict)")
+		showProgress   = flag.Bool("progress", false, "For clean/diff: show tables and rows done, bytes written and the time left on stderr, if it is a terminal")
+		strict         = flag.Bool("strict", false, "For clean/diff: turn on the checks that trade speed for safety (-assert-idempotent)")
 	)
+	var extensions sqlite.Extensions
+	var statsFormat summary.Flag
+	flag.Var(&statsFormat, "stats", "For clean/smudge/diff: print a summary of input and output size, rows and the duration of each stage to stderr at the end, as one line (-stats) or JSON (-stats=json)")
+	flag.Var(&extensions, "load-extension", "Load the SQLite extension path[,entrypoint] into every sqlite3 session, for databases using e.g. FTS5 tokenizers or ICU (repeatable; cli engine only)")
+	// Writes to a closed stdout fail with EPIPE, reported as a broken pipe,
+	// instead of killing the process with SIGPIPE
+	signal.Ignore(syscall.SIGPIPE)
+
 	flag.Usage = usage
-	flag.Parse()
+	// Exit with the usage exit code rather than flag's 2, which means that
+	// sqlite3 is missing
+	flag.CommandLine.Init(os.Args[0], flag.ContinueOnError)
+	if err := flag.CommandLine.Parse(os.Args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			shutdown.Exit(errs.ExitOK)
+		}
+		shutdown.Exit(errs.ExitUsage)
+	}
 
-	// Setup logging with same semantics: -log -> current dir, -log-dir overrides
+	// Setup logging: -log -> repository log directory, -log-dir overrides
 	var logTarget string
-	if *enableLog || *logDir != "" {
-		if *logDir != "" {
-			logTarget = *logDir
-		} else {
-			logTarget = "."
+	if *logDir != "" {
+		logTarget = *logDir
+	} else if *enableLog {
+		logTarget = defaultLogDir(context.Background())
+	}
+	levelName := *logLevel
+	if env := os.Getenv(logging.EnvLevel); env != "" {
+		levelName = env
+	}
+	level, err := logging.ParseLevel(levelName)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: -log-level: %v\n", err)
+		shutdown.Exit(errs.ExitUsage)
+	}
+	retention := logging.Retention{MaxFiles: *logMaxFiles, MaxAge: *logMaxAge, MaxSize: *logMaxSize}
+	if retention.MaxFiles < 0 || retention.MaxAge < 0 || retention.MaxSize < 0 {
+		fmt.Fprintf(os.Stderr, "Error: -log-max-files, -log-max-age and -log-max-size must not be negative\n")
+		shutdown.Exit(errs.ExitUsage)
+	}
+	logger, flushLog := logging.Setup(logTarget, level, retention)
+	// Every exit from here on goes through shutdown.Exit, or the deferred
+	// shutdown.Run, which flush the log last
+	shutdown.Register(flushLog)
+	defer shutdown.Run()
+
+	// Profiles cover the whole run and are written before the log is flushed
+	if *profile != "" {
+		spec, err := profiling.Parse(*profile)
+		var stopProfiles func()
+		if err == nil {
+			stopProfiles, err = profiling.Start(spec)
+		}
+		if err != nil {
+			logger.Error("cannot start profiling", "profile", *profile, "error", err)
+			fmt.Fprintf(os.Stderr, "Error: -profile: %v\n", err)
+			shutdown.Exit(errs.ExitUsage)
 		}
+		shutdown.Register(stopProfiles)
 	}
-	logger, cleanup := logging.Setup(logTarget)
-	defer cleanup()
+
+	// The telemetry of a run is exported before the log is flushed, also on
+	// the error paths, which report the run as failed
+	telemetry, err := logging.NewTelemetry(*otlpEndpoint, version.Version)
+	if err != nil {
+		logger.Error("invalid telemetry configuration", "error", err)
+		fmt.Fprintf(os.Stderr, "Error: -otlp-endpoint: %v\n", err)
+		shutdown.Exit(errs.ExitUsage)
+	}
+	var run *summary.Summary
+	succeeded := false
+	if telemetry != nil {
+		shutdown.Register(func() {
+			if run == nil {
+				return
+			}
+			if err := telemetry.Export(context.Background(), run.Run(succeeded)); err != nil {
+				logger.Warn("cannot export telemetry", "endpoint", telemetry.Endpoint, "error", err)
+			}
+		})
+	}
+	defer recoverCrash(logTarget, logger)
 
 	// Set the logger as the default so all slog calls use it
 	slog.SetDefault(logger)
 
-	logger.Info("gitsqlite started", "args", os.Args)
+	logger.Info("gitsqlite started", "args", os.Args, "operation", flag.Arg(0))
+
+	for _, list := range []string{os.Getenv(warnings.EnvSuppress), *suppressWarn} {
+		if err := warnings.Suppress(list); err != nil {
+			logger.Error("invalid warning suppression", "error", err)
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			shutdown.Exit(errs.ExitUsage)
+		}
+	}
+
+	applyRepoConfig(*output, *configProfile, logger)
 
 	if *showHelp {
 		logger.Info("showing help")
@@ -178,24 +1998,98 @@ func main() {
 		return
 	}
 
+	if *engineKind != sqlite.EngineCLI && *engineKind != sqlite.EngineEmbedded {
+		logger.Error("unknown engine", "engine", *engineKind)
+		fmt.Fprintf(os.Stderr, "Error: Unknown engine '%s' (use %s or %s)\n", *engineKind, sqlite.EngineCLI, sqlite.EngineEmbedded)
+		shutdown.Exit(errs.ExitUsage)
+	}
+	selection, err := sqlite.ParseSelection(*sqliteSelect)
+	if err != nil {
+		logger.Error("invalid sqlite selection", "sqlite_select", *sqliteSelect, "error", err)
+		fmt.Fprintf(os.Stderr, "Error: -sqlite-select: %v\n", err)
+		shutdown.Exit(errs.ExitUsage)
+	}
+	attachments, err := sqlite.ParseAttachments(*attach)
+	if err != nil {
+		logger.Error("invalid attachments", "attach", *attach, "error", err)
+		fmt.Fprintf(os.Stderr, "Error: invalid -attach value: %v\n", err)
+		shutdown.Exit(errs.ExitUsage)
+	}
+	if len(extensions) > 0 && *engineKind == sqlite.EngineEmbedded {
+		logger.Error("extensions need the cli engine", "extensions", extensions.String())
+		fmt.Fprintf(os.Stderr, "Error: -load-extension needs -engine %s; the embedded engine cannot load extensions\n", sqlite.EngineCLI)
+		shutdown.Exit(errs.ExitUsage)
+	}
+	if *chunkSize <= 0 {
+		logger.Error("invalid chunk size", "chunk_size", *chunkSize)
+		fmt.Fprintf(os.Stderr, "Error: -chunk-size must be positive\n")
+		shutdown.Exit(errs.ExitUsage)
+	}
+	engine := &sqlite.Engine{Bin: *sqliteCmd, Embedded: *engineKind == sqlite.EngineEmbedded, Select: selection, Attach: attachments, Extensions: extensions, ChunkSize: *chunkSize}
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	// Temporary files are as large as the database: keep them off small
+	// system temporary directories. The repository default is only a
+	// preference, so failing to create it is not an error
+	if dir := tempdir.Resolve(ctx, *tempDir); dir != "" {
+		abs, err := tempdir.Use(dir)
+		if err != nil && (*tempDir != "" || os.Getenv(tempdir.EnvDir) != "") {
+			logger.Error("cannot use temporary directory", "dir", dir, "error", err)
+			fmt.Fprintf(os.Stderr, "Error: -temp-dir: %v\n", err)
+			shutdown.Exit(errs.ExitUsage)
+		}
+		if err != nil {
+			logger.Warn("cannot use repository temporary directory, using the system one", "dir", dir, "error", err)
+		} else {
+			logger.Debug("using temporary directory", "dir", abs)
+		}
+	}
+	// git runs these operations and reads their output; stop them when it
+	// exits or closes the output rather than finishing for nobody
+	var parentGone <-chan error
+	switch flag.Arg(0) {
+	case "clean", "smudge", "diff", "textconv", "diff-driver":
+		parentGone = parent.Watch(ctx, os.Stdout, parent.Interval)
+	}
+	handleSignals(cancel, parentGone, logger)
+
 	if *showVersion {
-		showVersionInfo(*sqliteCmd, logger, cleanup)
+		if *versionJSON {
+			showVersionJSON(ctx, engine, logger)
+		} else {
+			showVersionInfo(ctx, engine, logger)
+		}
 		return
 	}
 
 	// Operation required and validation
-	op := validateOperation(logger, cleanup)
-	ctx := context.Background()
-	engine := &sqlite.Engine{Bin: *sqliteCmd}
+	op := validateOperation(logger)
+
+	// A daemon started with the same settings runs clean and smudge, so this
+	// process does not detect sqlite3 itself. -stats and telemetry report
+	// on this process, so they keep the job here
+	if *daemonSocket != "" && (op == "clean" || op == "smudge") && statsFormat == "" && telemetry == nil {
+		job := daemon.Job{Op: op, Key: daemonKey(), Output: *output}
+		if flag.NArg() >= 2 {
+			job.Path = flag.Arg(1)
+		}
+		if forwardJob(ctx, *daemonSocket, job, *pipeBuffer, *readTimeout, logger) {
+			succeeded = true
+			return
+		}
+	}
 
-	// Validate sqlite binary is available
-	if err := engine.ValidateBinary(); err != nil {
+	// Validate sqlite binary is available; install and uninstall only change
+	// git configuration, detect and doctor report missing binaries themselves
+	// and logs only reads log files. Clean and smudge with -on-error
+	// passthrough or empty handle a missing binary like any other failure
+	lenient := (op == "clean" || op == "smudge") && *onError != filters.OnErrorFail
+	if err := engine.ValidateBinary(ctx); err != nil && !lenient && op != "install" && op != "uninstall" && op != "detect" && op != "logs" && op != "doctor" && op != "fingerprint" && op != "check-split" {
 		logger.Error("sqlite executable not accessible", "sqlite_cmd", *sqliteCmd, "error", err)
-		cleanup() // Ensure log is flushed before exit
 		fmt.Fprintf(os.Stderr, "Error: SQLite executable '%s' not found in PATH or does not exist\n", *sqliteCmd)
-		fmt.Fprintf(os.Stderr, "Please ensure SQLite is installed or provide the correct path using -sqlite flag\n")
+		fmt.Fprintf(os.Stderr, "Please ensure SQLite is installed, provide the correct path using -sqlite flag, or use -engine embedded\n")
 		fmt.Fprintf(os.Stderr, "Use -help for more information\n")
-		os.Exit(2)
+		shutdown.Exit(errs.ExitSQLiteNotFound)
 	}
 
 	// Determine schema filename based on flags
@@ -207,8 +2101,250 @@ func main() {
 		// -schema flag uses default filename
 		schemaFilename = ".gitsqliteschema"
 	}
+	sinkList, err := filters.ParseSinks(*sinks)
+	if err != nil {
+		logger.Error("invalid sinks", "sinks", *sinks, "error", err)
+		fmt.Fprintf(os.Stderr, "Error: invalid -sinks value: %v\n", err)
+		shutdown.Exit(errs.ExitUsage)
+	}
+	if len(sinkList) > 0 && schemaFilename != "" {
+		logger.Error("sinks with a schema file", "sinks", *sinks, "schema_file", schemaFilename)
+		fmt.Fprintf(os.Stderr, "Error: -sinks cannot be combined with -schema or -schema-file\n")
+		shutdown.Exit(errs.ExitUsage)
+	}
+
+	opts := filters.Options{
+		FloatPrecision:  *floatPrecision,
+		Normalizer:      *normalizer,
+		DataOnly:        *dataOnly,
+		SchemaOutput:    schemaFilename,
+		Compress:        *compress,
+		CanonicalSchema: *canonSchema,
+		TableHashes:     *tableHashes,
+		Vacuum:          *vacuum,
+		AnnotateCounts:  *annotateCounts,
+		Sidecars:        *sidecars,
+		InvalidUTF8:     *invalidUTF8,
+		ControlChars:    *controlChars,
+		RowOrder:        *rowOrder,
+		SchemaOrder:     *schemaOrder,
+		UpgradeFormat:   *upgradeFormat,
+		DataFormat:      *dataFormat,
+		FormatVersion:   *formatVersion,
+		BlobThreshold:   *blobThreshold,
+		BlobDir:         *blobDir,
+		DictDir:         *dictDir,
+		Sinks:           sinkList,
+	}
+	// -strict turns on the checks unless they are set explicitly
+	opts.AssertIdempotent = *assertIdem
+	if *strict {
+		assertSet := false
+		flag.Visit(func(f *flag.Flag) { assertSet = assertSet || f.Name == "assert-idempotent" })
+		opts.AssertIdempotent = opts.AssertIdempotent || !assertSet
+	}
+	if *showProgress && (op == "clean" || op == "diff") && progress.IsTerminal(os.Stderr) {
+		opts.Progress = progress.New(os.Stderr, op, progress.Interval)
+	}
+	if op == "clean" && flag.NArg() >= 2 {
+		opts.SourcePath = flag.Arg(1)
+	}
+	opts.InputSize = filters.InputSize(os.Stdin)
+	if *cleanCache && (op == "clean" || op == "daemon") {
+		if cache, err := filters.OpenCleanCache(ctx); err != nil {
+			logger.Info("clean cache disabled", "reason", err)
+		} else {
+			opts.Cache = cache
+		}
+	}
+
+	// Determine subset rules based on flags
+	if subsetFilename := subsetRulesFile(*subset, *subsetFile); subsetFilename != "" {
+		rules, err := filters.LoadSubset(subsetFilename)
+		if err != nil {
+			logger.Error("failed to load subset rules", "file", subsetFilename, "error", err)
+			fmt.Fprintf(os.Stderr, "Error: failed to load subset rules: %v\n", err)
+			shutdown.Exit(errs.ExitUsage)
+		}
+		opts.Subset = rules
+	}
+
+	opts.LocalTables = filters.ParseTableList(*localTables)
+
+	opts.InternalTables, err = filters.ParseInternalTables(*internalTables)
+	if err != nil {
+		logger.Error("invalid internal tables", "internal_tables", *internalTables, "error", err)
+		fmt.Fprintf(os.Stderr, "Error: invalid -internal-tables value: %v\n", err)
+		shutdown.Exit(errs.ExitUsage)
+	}
+
+	redactRules, err := filters.ParseRedactRules(*redact)
+	if err != nil {
+		logger.Error("invalid redaction rules", "redact", *redact, "error", err)
+		fmt.Fprintf(os.Stderr, "Error: invalid -redact value: %v\n", err)
+		shutdown.Exit(errs.ExitUsage)
+	}
+	opts.Redact = redactRules
+
+	collationMap, err := filters.ParseCollationMap(*collations)
+	if err != nil {
+		logger.Error("invalid collation mappings", "collations", *collations, "error", err)
+		fmt.Fprintf(os.Stderr, "Error: invalid -collations value: %v\n", err)
+		shutdown.Exit(errs.ExitUsage)
+	}
+
+	smudgeOpts := filters.SmudgeOptions{
+		SchemaFile:  schemaFilename,
+		EnforceHash: *verifyHash,
+		Subset:      opts.Subset,
+		LocalTables: opts.LocalTables,
+		Jobs:        *jobs,
+		InputSize:   opts.InputSize,
+		BlobDir:     *blobDir,
+		DictDir:     *dictDir,
+		JournalMode: *journalMode,
+		Collations:  collationMap,
+	}
+	if (statsFormat != "" || telemetry != nil) && (op == "clean" || op == "smudge" || op == "diff") {
+		opts.Summary = summary.New(op, string(statsFormat))
+		smudgeOpts.Summary = opts.Summary
+		run = opts.Summary
+	}
+	// Fingerprinting queries sqlite3, so it is only done for the log and the
+	// JSON summary
+	if (logTarget != "" || statsFormat == summary.FormatJSON) && (op == "clean" || op == "smudge" || op == "diff") {
+		fp, err := fingerprint.Collect(ctx, engine, outputOptions())
+		if err != nil {
+			logger.Warn("cannot query SQLite for the fingerprint", "error", err)
+		}
+		logger.Info("environment fingerprint", "fingerprint", fp)
+		opts.Summary.Fingerprint(fp)
+	}
+	if op == "smudge" && (flag.NArg() >= 2 || *output != "") || op == "daemon" {
+		// The file being replaced is the one backed up and merged from; the
+		// daemon gets it with every job
+		if op == "smudge" {
+			smudgeOpts.Output = *output
+			smudgeOpts.TargetPath = *output
+			if *output == "" {
+				smudgeOpts.TargetPath = flag.Arg(1)
+			}
+		}
+		if *backups > 0 {
+			if store, err := backup.Open(ctx); err != nil {
+				logger.Info("backups disabled", "reason", err)
+			} else {
+				smudgeOpts.Backups = store
+				smudgeOpts.BackupKeep = *backups
+			}
+		}
+		if *incremental && (*output != "" || op == "daemon") {
+			if cache, err := filters.OpenTableCache(ctx); err != nil {
+				logger.Info("incremental restore disabled", "reason", err)
+			} else {
+				smudgeOpts.TableCache = cache
+			}
+		}
+	}
+	if opts.Sidecars != filters.SidecarFold && opts.Sidecars != filters.SidecarWarn && opts.Sidecars != filters.SidecarIgnore {
+		logger.Error("invalid sidecars policy", "sidecars", opts.Sidecars)
+		fmt.Fprintf(os.Stderr, "Error: invalid -sidecars value '%s' (expected fold, warn or ignore)\n", opts.Sidecars)
+		shutdown.Exit(errs.ExitUsage)
+	}
+
+	if opts.InvalidUTF8 != filters.UTF8Escape && opts.InvalidUTF8 != filters.UTF8Replace {
+		logger.Error("invalid UTF-8 policy", "invalid_utf8", opts.InvalidUTF8)
+		fmt.Fprintf(os.Stderr, "Error: invalid -invalid-utf8 value '%s' (expected escape or replace)\n", opts.InvalidUTF8)
+		shutdown.Exit(errs.ExitUsage)
+	}
+
+	if opts.ControlChars != filters.ControlCharsKeep && opts.ControlChars != filters.ControlCharsChar {
+		logger.Error("invalid control character policy", "control_chars", opts.ControlChars)
+		fmt.Fprintf(os.Stderr, "Error: invalid -control-chars value '%s' (expected keep or char)\n", opts.ControlChars)
+		shutdown.Exit(errs.ExitUsage)
+	}
+
+	if !sqlite.IsJournalMode(*journalMode) {
+		logger.Error("invalid journal mode", "journal_mode", *journalMode)
+		fmt.Fprintf(os.Stderr, "Error: invalid -journal-mode value '%s' (expected %s or %s)\n", *journalMode, sqlite.JournalDelete, sqlite.JournalWAL)
+		shutdown.Exit(errs.ExitUsage)
+	}
+
+	if !filters.IsOnErrorPolicy(*onError) {
+		logger.Error("invalid failure policy", "on_error", *onError)
+		fmt.Fprintf(os.Stderr, "Error: invalid -on-error value '%s' (expected fail, passthrough or empty)\n", *onError)
+		shutdown.Exit(errs.ExitUsage)
+	}
+	if (op == "clean" || op == "smudge") && *onError != filters.OnErrorFail {
+		logger.Info("failure policy", "on_error", *onError)
+	}
+
+	if opts.BlobThreshold < 0 || opts.BlobDir == "" {
+		logger.Error("invalid BLOB externalization settings", "blob_threshold", opts.BlobThreshold, "blob_dir", opts.BlobDir)
+		fmt.Fprintf(os.Stderr, "Error: -blob-threshold must not be negative and -blob-dir must not be empty\n")
+		shutdown.Exit(errs.ExitUsage)
+	}
+
+	if opts.Compress != "" && !compression.IsFormat(opts.Compress) {
+		logger.Error("invalid compression format", "compress", opts.Compress)
+		fmt.Fprintf(os.Stderr, "Error: invalid -compress value '%s' (expected gzip or zstd)\n", opts.Compress)
+		shutdown.Exit(errs.ExitUsage)
+	}
+
+	if opts.Normalizer != filters.NormalizerFast && opts.Normalizer != filters.NormalizerRegex {
+		logger.Error("invalid normalizer", "normalizer", opts.Normalizer)
+		fmt.Fprintf(os.Stderr, "Error: invalid -normalizer value '%s' (expected fast or regex)\n", opts.Normalizer)
+		shutdown.Exit(errs.ExitUsage)
+	}
+
+	if opts.RowOrder != filters.RowOrderKey && opts.RowOrder != filters.RowOrderDump {
+		logger.Error("invalid row order", "row_order", opts.RowOrder)
+		fmt.Fprintf(os.Stderr, "Error: invalid -row-order value '%s' (expected pk or dump)\n", opts.RowOrder)
+		shutdown.Exit(errs.ExitUsage)
+	}
+	if opts.SchemaOrder != filters.SchemaOrderSorted && opts.SchemaOrder != filters.SchemaOrderDump {
+		logger.Error("invalid schema order", "schema_order", opts.SchemaOrder)
+		fmt.Fprintf(os.Stderr, "Error: invalid -schema-order value '%s' (expected sorted or dump)\n", opts.SchemaOrder)
+		shutdown.Exit(errs.ExitUsage)
+	}
+	if opts.DataFormat != filters.DataFormatSQL && opts.DataFormat != filters.DataFormatJSONL {
+		logger.Error("invalid data format", "format", opts.DataFormat)
+		fmt.Fprintf(os.Stderr, "Error: invalid -format value '%s' (expected sql or jsonl)\n", opts.DataFormat)
+		shutdown.Exit(errs.ExitUsage)
+	}
+	if opts.FormatVersion < 0 || opts.FormatVersion > filters.CurrentFormat {
+		logger.Error("unsupported format version", "format_version", opts.FormatVersion, "supported", filters.CurrentFormat)
+		fmt.Fprintf(os.Stderr, "Error: unsupported -format-version %d (this gitsqlite writes versions 1 to %d; upgrade it to write newer ones)\n", opts.FormatVersion, filters.CurrentFormat)
+		shutdown.Exit(errs.ExitUsage)
+	}
+	if !color.IsMode(*colorMode) {
+		logger.Error("invalid color mode", "color", *colorMode)
+		fmt.Fprintf(os.Stderr, "Error: invalid -color value '%s' (expected auto, always or never)\n", *colorMode)
+		shutdown.Exit(errs.ExitUsage)
+	}
+
+	// A terminal would show the database as garbage, and a Windows console
+	// converts it to text; refuse before reading the input
+	if (op == "smudge" && smudgeOpts.Output == "") || (op == "clean" && opts.Compress != "") {
+		if err := sqlite.CheckBinaryOutput(os.Stdout, op); err != nil {
+			logger.Error("binary output to a terminal", "operation", op)
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			if op == "smudge" {
+				fmt.Fprintf(os.Stderr, "Hint: use -output <database.db> to write the database file directly\n")
+			}
+			shutdown.Exit(errs.ExitUsage)
+		}
+	}
+
+	// Warn once about a filter configuration that would lose or corrupt data
+	if (op == "clean" || op == "smudge") && flag.NArg() >= 2 {
+		for _, problem := range doctor.Misconfigurations(ctx, flag.Arg(1)) {
+			warnings.Emit(warnings.FilterMisconfigured, "%s", problem)
+		}
+	}
 
-	executeOperation(ctx, op, engine, *floatPrecision, *dataOnly, schemaFilename, *verifyHash, logger, cleanup)
+	executeOperation(ctx, op, engine, opts, smudgeOpts, *onError, *lintRules, *dictDir, *dictSize, *pipeBuffer, *readTimeout, color.New(*colorMode, os.Stdout), logger)
 
+	succeeded = true
 	logger.Info("gitsqlite finished successfully", "operation", op)
 }
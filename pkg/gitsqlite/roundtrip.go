@@ -0,0 +1,138 @@
+// Package gitsqlite lets other Go programs check that their SQLite files are
+// stored faithfully by the gitsqlite git filter, e.g. in the test suite of an
+// application that ships a database.
+package gitsqlite
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/danielsiegl/gitsqlite/internal/filters"
+	"github.com/danielsiegl/gitsqlite/internal/sqlite"
+)
+
+// Options are the clean settings of the filter whose round trip is checked.
+// The zero value stands for a filter without flags, run by the embedded
+// SQLite library.
+type Options struct {
+	// SQLite is the sqlite3 binary to run, as -sqlite; if empty, the
+	// embedded SQLite library is used and no sqlite3 needs to be installed.
+	SQLite string
+	// FloatPrecision is the number of digits floats are rounded to, as
+	// -float-precision; 0 for the default of 9.
+	FloatPrecision int
+	// CanonicalSchema rewrites CREATE TABLE statements, as -canonical-schema.
+	CanonicalSchema bool
+	// RowOrder is "pk" (default) or "dump", as -row-order.
+	RowOrder string
+	// SchemaOrder is "sorted" (default) or "dump", as -schema-order.
+	SchemaOrder string
+	// DataFormat is "sql" (default) or "jsonl", as -format.
+	DataFormat string
+	// ControlChars is "keep" (default) or "char", as -control-chars.
+	ControlChars string
+}
+
+// Report describes the outcome of RoundTripEqual.
+type Report struct {
+	// Identical reports whether cleaning the restored database gave the
+	// same SQL, byte for byte, as cleaning the original.
+	Identical bool
+	// Line is the first line of the dump that differs (1-based), 0 if
+	// Identical.
+	Line int
+	// Original and Restored are that line in the dump of the database and
+	// of the restored database; a missing line is "<end of output>".
+	Original, Restored string
+	// Integrity holds the rows of PRAGMA integrity_check on the restored
+	// database, ["ok"] if it is sound.
+	Integrity []string
+	// Size is the size of the dump in bytes.
+	Size int64
+}
+
+// RoundTripEqual runs the database file db through clean, smudge and clean
+// again, as git does on commit and checkout, and reports whether both dumps
+// are the same byte for byte and the restored database passes
+// integrity_check. The error is set if the round trip could not run, e.g.
+// because db is not a database; a difference is not an error.
+//
+// Progress is logged through slog.Default.
+func RoundTripEqual(ctx context.Context, db []byte, opts Options) (bool, Report, error) {
+	filterOpts, err := filterOptions(opts)
+	if err != nil {
+		return false, Report{}, err
+	}
+	eng := &sqlite.Engine{Bin: opts.SQLite, Embedded: opts.SQLite == ""}
+	if err := eng.ValidateBinary(ctx); err != nil {
+		return false, Report{}, err
+	}
+
+	f, err := os.CreateTemp("", "gitsqlite-roundtrip-*.db")
+	if err != nil {
+		return false, Report{}, err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(db); err != nil {
+		_ = f.Close()
+		return false, Report{}, err
+	}
+	if err := f.Close(); err != nil {
+		return false, Report{}, err
+	}
+	if !sqlite.IsDatabaseFile(f.Name()) {
+		return false, Report{}, fmt.Errorf("not an SQLite database")
+	}
+	filterOpts.InputSize = int64(len(db))
+
+	result, err := filters.Verify(ctx, eng, f.Name(), filterOpts)
+	if err != nil {
+		return false, Report{}, err
+	}
+	report := Report{
+		Identical: result.Identical,
+		Line:      result.Line,
+		Original:  result.Original,
+		Restored:  result.Restored,
+		Integrity: result.Integrity,
+		Size:      result.Size,
+	}
+	return result.OK(), report, nil
+}
+
+// filterOptions returns the filter options for opts, checked like the flags
+// they stand for.
+func filterOptions(opts Options) (filters.Options, error) {
+	o := filters.DefaultOptions()
+	o.Sidecars = filters.SidecarIgnore
+	if opts.FloatPrecision != 0 {
+		o.FloatPrecision = opts.FloatPrecision
+	}
+	o.CanonicalSchema = opts.CanonicalSchema
+	if opts.RowOrder != "" {
+		o.RowOrder = opts.RowOrder
+	}
+	if opts.SchemaOrder != "" {
+		o.SchemaOrder = opts.SchemaOrder
+	}
+	if opts.DataFormat != "" {
+		o.DataFormat = opts.DataFormat
+	}
+	if opts.ControlChars != "" {
+		o.ControlChars = opts.ControlChars
+	}
+	switch {
+	case o.FloatPrecision < 0:
+		return o, fmt.Errorf("invalid FloatPrecision %d", o.FloatPrecision)
+	case o.RowOrder != filters.RowOrderKey && o.RowOrder != filters.RowOrderDump:
+		return o, fmt.Errorf("invalid RowOrder %q (expected pk or dump)", o.RowOrder)
+	case o.SchemaOrder != filters.SchemaOrderSorted && o.SchemaOrder != filters.SchemaOrderDump:
+		return o, fmt.Errorf("invalid SchemaOrder %q (expected sorted or dump)", o.SchemaOrder)
+	case o.DataFormat != filters.DataFormatSQL && o.DataFormat != filters.DataFormatJSONL:
+		return o, fmt.Errorf("invalid DataFormat %q (expected sql or jsonl)", o.DataFormat)
+	case o.ControlChars != filters.ControlCharsKeep && o.ControlChars != filters.ControlCharsChar:
+		return o, fmt.Errorf("invalid ControlChars %q (expected keep or char)", o.ControlChars)
+	}
+	return o, nil
+}
@@ -0,0 +1,47 @@
+package gitsqlite
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/danielsiegl/gitsqlite/internal/sqlite"
+)
+
+func TestRoundTripEqual(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "app.db")
+	eng := &sqlite.Engine{Embedded: true}
+	schema := "CREATE TABLE t(id INTEGER PRIMARY KEY, name TEXT, score REAL);\n" +
+		"INSERT INTO t VALUES(1,'a',1.5);\nINSERT INTO t VALUES(2,'b''c',NULL);\n" +
+		"CREATE INDEX t_name ON t(name);\n"
+	if err := eng.Restore(ctx, path, strings.NewReader(schema)); err != nil {
+		t.Fatal(err)
+	}
+	db, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, opts := range []Options{{}, {DataFormat: "jsonl", RowOrder: "dump"}} {
+		equal, report, err := RoundTripEqual(ctx, db, opts)
+		if err != nil {
+			t.Fatalf("%+v: %v", opts, err)
+		}
+		if !equal || !report.Identical || report.Line != 0 || report.Size == 0 {
+			t.Errorf("%+v: round trip not equal: %+v", opts, report)
+		}
+		if len(report.Integrity) != 1 || report.Integrity[0] != "ok" {
+			t.Errorf("%+v: integrity = %v", opts, report.Integrity)
+		}
+	}
+
+	if _, _, err := RoundTripEqual(ctx, []byte("CREATE TABLE t(x);\n"), Options{}); err == nil {
+		t.Error("no error for a file that is not a database")
+	}
+	if _, _, err := RoundTripEqual(ctx, db, Options{RowOrder: "random"}); err == nil {
+		t.Error("no error for an invalid row order")
+	}
+}